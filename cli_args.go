@@ -12,45 +12,80 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
+// runtimeArgs are the options that can be changed after mount through
+// "-runtime-opts" and SIGHUP. Everything else in argContainer is fixed at
+// mount time.
+type runtimeArgs struct {
+	debug, quiet, silent, stats bool
+}
+
 // argContainer stores the parsed CLI options and arguments
 type argContainer struct {
-	debug, init, zerokey, fusedebug, openssl, passwd, fg, version,
-	plaintextnames, quiet, nosyslog, wpanic,
+	runtimeArgs
+	init, zerokey, fusedebug, openssl, passwd, fg, version,
+	plaintextnames, nosyslog, wpanic,
 	longnames, allow_other, reverse, aessiv, nonempty, raw64,
 	noprealloc, speed, hkdf, serialize_reads, forcedecode, hh, info,
-	sharedstorage, devrandom, fsck bool
+	sharedstorage, devrandom, fsck, dirivRecover, casefold,
+	reverseNameOnly, discard, mkdir, mkdirParents, mlock, mlockStrict, flat, dirivXattr,
+	emulateHiresTime, coalesceWrites, fsyncMetadata, migrateNames, trash, preserveDirMtime, watch, dirCountCache, sortDirs, blockcrc, scrub, pruneEmptyOnUnmount, macosForks, json, hideCorrupt, showCorrupt, secureDelete, execStrict, noatime, compatOpendir, singleThreaded, useKeyring, clearKeyring, journal, exactSize, longSymlinks, noReaddirplus, repairLongnames, dryRun, paranoidWrite, showConf bool
 	// Mount options with opposites
 	dev, nodev, suid, nosuid, exec, noexec, rw, ro bool
 	masterkey, mountpoint, cipherdir, cpuprofile,
-	memprofile, ko, ctlsock, fsname, force_owner, trace string
-	// -extpass, -badname, -passfile can be passed multiple times
-	extpass, badname, passfile multipleStrings
+	memprofile, ko, ctlsock, fsname, subtype, force_owner, trace, unicodeNormalize,
+	encryptPath, decryptPath, ctlsockRo, runtimeOpts, dirivName, sameMasterkey, fido2Add string
+	// -extpass, -badname, -passfile, -exec-after-mount, -exec-after-unmount,
+	// -fido2 can be passed multiple times
+	extpass, badname, passfile, execAfterMount, execAfterUnmount, fido2 multipleStrings
 	// For reverse mode, several ways to specify exclusions. All can be specified multiple times.
-	exclude, excludeWildcard, excludeFrom multipleStrings
+	exclude, excludeWildcard, excludeFrom, reverseInclude multipleStrings
 	// Configuration file name override
-	config             string
-	notifypid, scryptn int
+	config                        string
+	notifypid, scryptn, readahead, maxNameLength, retry, maxBackingFds, passfd, fido2Remove, readyFd int
+	// Plaintext byte limit for -quota
+	quota uint64
+	// Bandwidth limits for -read-bps and -write-bps
+	readBps, writeBps uint64
 	// Idle time before autounmount
 	idle time.Duration
+	// Time after mount before the filesystem becomes read-only
+	readonlyAfter time.Duration
+	// Wait before the first "-retry"
+	retryBackoff time.Duration
+	// Kernel cache time for lookups of missing files
+	negativeTimeout time.Duration
+	// Kernel cache times for file attributes and for directory entries
+	attrTimeout, entryTimeout time.Duration
+	// Lifetime of the master key cached by -use-keyring
+	keyringTTL time.Duration
 	// Helper variables that are NOT cli options all start with an underscore
 	// _configCustom is true when the user sets a custom config file name.
 	_configCustom bool
 	// _ctlsockFd stores the control socket file descriptor (ctlsock stores the path)
 	_ctlsockFd net.Listener
+	// _ctlsockRoFd is the same for the read-only control socket
+	_ctlsockRoFd net.Listener
 	// _forceOwner is, if non-nil, a parsed, validated Owner (as opposed to the string above)
 	_forceOwner *fuse.Owner
 	// _explicitScryptn is true then the user passed "-scryptn=xyz"
 	_explicitScryptn bool
+	// _cliRuntimeArgs are the runtimeArgs from the command line, before
+	// "-runtime-opts" has been applied
+	_cliRuntimeArgs runtimeArgs
+	// _createdDirs lists the directories created by "-mkdir", parents first
+	_createdDirs []string
 }
 
 type multipleStrings []string
@@ -72,6 +107,10 @@ func (s *multipleStrings) Empty() bool {
 
 var flagSet *flag.FlagSet
 
+// maxReadAhead is the largest value accepted for "-readahead". 1024 blocks
+// are 4 MiB of plaintext per open file.
+const maxReadAhead = 1024
+
 // prefixOArgs transform options passed via "-o foo,bar" into regular options
 // like "-foo -bar" and prefixes them to the command line.
 // Testcases in TestPrefixOArgs().
@@ -149,6 +188,7 @@ func parseCliOpts() (args argContainer) {
 	flagSet.BoolVar(&args.plaintextnames, "plaintextnames", false, "Do not encrypt file names")
 	flagSet.BoolVar(&args.quiet, "q", false, "")
 	flagSet.BoolVar(&args.quiet, "quiet", false, "Quiet - silence informational messages")
+	flagSet.BoolVar(&args.silent, "silent", false, "Silence informational messages and warnings, only print fatal errors")
 	flagSet.BoolVar(&args.nosyslog, "nosyslog", false, "Do not redirect output to syslog when running in the background")
 	flagSet.BoolVar(&args.wpanic, "wpanic", false, "When encountering a warning, panic and exit immediately")
 	flagSet.BoolVar(&args.longnames, "longnames", true, "Store names longer than 176 bytes in extra files")
@@ -156,7 +196,14 @@ func parseCliOpts() (args argContainer) {
 		"Only works if user_allow_other is set in /etc/fuse.conf.")
 	flagSet.BoolVar(&args.reverse, "reverse", false, "Reverse mode")
 	flagSet.BoolVar(&args.aessiv, "aessiv", false, "AES-SIV encryption")
+	flagSet.BoolVar(&args.flat, "flat", false, "Do not use gocryptfs.diriv files, encrypt all names with a fixed IV")
+	flagSet.BoolVar(&args.dirivXattr, "diriv-xattr", false, "Store directory IVs in an xattr instead of gocryptfs.diriv files")
+	flagSet.BoolVar(&args.blockcrc, "blockcrc", false, "Append a CRC32C to each block that -scrub can check without the password")
+	flagSet.BoolVar(&args.exactSize, "exact-size", false, "Store the plaintext size of each file in an xattr and check it against the backing file")
+	flagSet.BoolVar(&args.longSymlinks, "long-symlinks", false, "Store symlink targets that are too long for the backing filesystem in gocryptfs.longlinks")
 	flagSet.BoolVar(&args.nonempty, "nonempty", false, "Allow mounting over non-empty directories")
+	flagSet.BoolVar(&args.mkdir, "mkdir", false, "Create the mountpoint if it does not exist")
+	flagSet.BoolVar(&args.mkdirParents, "mkdir-parents", false, "Like -mkdir, but also create missing parent directories")
 	flagSet.BoolVar(&args.raw64, "raw64", true, "Use unpadded base64 for file names")
 	flagSet.BoolVar(&args.noprealloc, "noprealloc", false, "Disable preallocation before writing")
 	flagSet.BoolVar(&args.speed, "speed", false, "Run crypto speed test")
@@ -169,6 +216,45 @@ func parseCliOpts() (args argContainer) {
 	flagSet.BoolVar(&args.sharedstorage, "sharedstorage", false, "Make concurrent access to a shared CIPHERDIR safer")
 	flagSet.BoolVar(&args.devrandom, "devrandom", false, "Use /dev/random for generating master key")
 	flagSet.BoolVar(&args.fsck, "fsck", false, "Run a filesystem check on CIPHERDIR")
+	flagSet.BoolVar(&args.json, "j", false, "")
+	flagSet.BoolVar(&args.json, "json", false, "Print the results of -info and -fsck as JSON")
+	flagSet.BoolVar(&args.macosForks, "macos-forks", false, "Store macOS AppleDouble \"._\" files in an encrypted xattr of the main file")
+	flagSet.BoolVar(&args.pruneEmptyOnUnmount, "prune-empty-on-unmount", false, "Remove empty directories after unmount")
+	flagSet.BoolVar(&args.scrub, "scrub", false, "Check CIPHERDIR for bit rot without the password (needs -blockcrc)")
+	flagSet.BoolVar(&args.migrateNames, "migrate-names", false, "Encrypt the file names of a -plaintextnames CIPHERDIR")
+	flagSet.BoolVar(&args.repairLongnames, "repair-longnames", false, "Remove orphaned gocryptfs.longname.*.name files from CIPHERDIR")
+	flagSet.BoolVar(&args.dryRun, "dry-run", false, "Only list what -repair-longnames would remove")
+	flagSet.BoolVar(&args.casefold, "casefold", false, "Look up file names case-insensitively")
+	flagSet.BoolVar(&args.discard, "discard", false, "Support fallocate(FALLOC_FL_PUNCH_HOLE) and deallocate the space in the backing files")
+	flagSet.BoolVar(&args.emulateHiresTime, "emulate-hires-time", false, "Store nanosecond timestamps in xattrs, for backing filesystems with coarse timestamps")
+	flagSet.BoolVar(&args.fsyncMetadata, "fsync-metadata", false, "Fsync new files and directories and their parent directory on creation")
+	flagSet.BoolVar(&args.coalesceWrites, "coalesce-writes", false, "Cache the block small writes go to, and write it to disk when leaving the block or on fsync and close")
+	flagSet.BoolVar(&args.mlock, "mlock", false, "Lock key material into RAM so it is not swapped out")
+	flagSet.BoolVar(&args.mlockStrict, "mlock-strict", false, "Like -mlock, but exit if locking fails")
+	flagSet.BoolVar(&args.stats, "stats", false, "Collect latency statistics, query them via -ctlsock")
+	flagSet.BoolVar(&args.preserveDirMtime, "preserve-dir-mtime", false, "Keep internal bookkeeping from changing the mtime of directories")
+	flagSet.BoolVar(&args.dirCountCache, "dir-count-cache", false, "Remember the number of entries of directories to speed up rmdir")
+	flagSet.BoolVar(&args.sortDirs, "sort-dirs", false, "Return directory entries sorted by name")
+	flagSet.BoolVar(&args.watch, "watch", false, "Report changes as plaintext paths via -ctlsock, and show changes made directly in CIPHERDIR right away")
+	flagSet.BoolVar(&args.trash, "trash", false, "Move deleted files and directories into a trash directory, manage it via -ctlsock")
+	flagSet.BoolVar(&args.reverseNameOnly, "reverse-name-only", false, "Reverse mode: only expose encrypted names, all files appear empty")
+	flagSet.BoolVar(&args.hideCorrupt, "hide-corrupt", false, "Skip entries whose names cannot be decrypted, "+
+		"and log each of them only once")
+	flagSet.BoolVar(&args.showCorrupt, "show-corrupt", false, "List entries whose names cannot be decrypted "+
+		"under a placeholder name, and log each of them only once")
+	flagSet.BoolVar(&args.execStrict, "exec-strict", false, "Unmount and exit with an error if an -exec-after-* command fails")
+	flagSet.BoolVar(&args.noatime, "noatime", false, "Do not update the access time of backing files when reading")
+	flagSet.BoolVar(&args.compatOpendir, "compat-opendir", false, "Open backing directories without O_DIRECTORY if the filesystem rejects it")
+	flagSet.BoolVar(&args.journal, "journal", false, "Write overwrites to a journal first, so a crash cannot leave a half-written block. Slow")
+	flagSet.BoolVar(&args.showConf, "show-conf", false, "List gocryptfs.conf in the root directory and make it readable, instead of hiding it")
+	flagSet.BoolVar(&args.paranoidWrite, "paranoid-write", false, "Read back and decrypt every block after writing it, fail the write if it does not match. Slow")
+	flagSet.BoolVar(&args.singleThreaded, "single-threaded", false, "Handle one FUSE request at a time. Debugging aid, very slow")
+	flagSet.BoolVar(&args.noReaddirplus, "no-readdirplus", false, "Return directory entries without attributes, for kernels with READDIRPLUS bugs")
+	flagSet.BoolVar(&args.useKeyring, "use-keyring", false, "Cache the master key in the kernel session keyring, and use a cached key instead of asking for the password")
+	flagSet.BoolVar(&args.clearKeyring, "clear-keyring", false, "Remove the master key cached by -use-keyring from the kernel keyring and exit")
+	flagSet.BoolVar(&args.secureDelete, "secure-delete", false, "Overwrite file content with random data before deleting or truncating it")
+	flagSet.BoolVar(&args.dirivRecover, "diriv-recover", false, "List directories with a missing or corrupt "+
+		"gocryptfs.diriv as empty instead of returning an I/O error")
 
 	// Mount options with opposites
 	flagSet.BoolVar(&args.dev, "dev", false, "Allow device files")
@@ -186,9 +272,18 @@ func parseCliOpts() (args argContainer) {
 	flagSet.StringVar(&args.config, "config", "", "Use specified config file instead of CIPHERDIR/gocryptfs.conf")
 	flagSet.StringVar(&args.ko, "ko", "", "Pass additional options directly to the kernel, comma-separated list")
 	flagSet.StringVar(&args.ctlsock, "ctlsock", "", "Create control socket at specified path")
+	flagSet.StringVar(&args.ctlsockRo, "ctlsock-ro", "", "Create read-only control socket at specified path")
+	flagSet.StringVar(&args.runtimeOpts, "runtime-opts", "", "Read -d, -q and -stats from specified file, and again on SIGHUP")
 	flagSet.StringVar(&args.fsname, "fsname", "", "Override the filesystem name")
+	flagSet.StringVar(&args.subtype, "subtype", "", "Override the filesystem subtype shown as \"fuse.SUBTYPE\"")
 	flagSet.StringVar(&args.force_owner, "force_owner", "", "uid:gid pair to coerce ownership")
 	flagSet.StringVar(&args.trace, "trace", "", "Write execution trace to file")
+	flagSet.StringVar(&args.encryptPath, "encrypt-path", "", "Print the ciphertext path of the given plaintext path and exit")
+	flagSet.StringVar(&args.decryptPath, "decrypt-path", "", "Print the plaintext path of the given ciphertext path and exit")
+	flagSet.StringVar(&args.sameMasterkey, "same-masterkey", "", "Check that the given CIPHERDIR or config file has the same master key and exit")
+	flagSet.StringVar(&args.fido2Add, "fido2-add", "", "Register the FIDO2 key at the given device path as an additional key and exit")
+	flagSet.StringVar(&args.dirivName, "diriv-name", "", "Use specified name instead of gocryptfs.diriv for the directory IV files")
+	flagSet.StringVar(&args.unicodeNormalize, "unicode-normalize", "", "Normalize file names to Unicode form \"nfc\" or \"nfd\" before encryption")
 
 	// Exclusion options
 	flagSet.Var(&args.exclude, "e", "Alias for -exclude")
@@ -196,11 +291,18 @@ func parseCliOpts() (args argContainer) {
 	flagSet.Var(&args.excludeWildcard, "ew", "Alias for -exclude-wildcard")
 	flagSet.Var(&args.excludeWildcard, "exclude-wildcard", "Exclude path from reverse view, supporting wildcards")
 	flagSet.Var(&args.excludeFrom, "exclude-from", "File from which to read exclusion patterns (with -exclude-wildcard syntax)")
+	flagSet.Var(&args.reverseInclude, "reverse-include", "Only show paths matching this pattern, and their parent directories, in the reverse view")
 
 	// multipleStrings options ([]string)
 	flagSet.Var(&args.extpass, "extpass", "Use external program for the password prompt")
 	flagSet.Var(&args.badname, "badname", "Glob pattern invalid file names that should be shown")
 	flagSet.Var(&args.passfile, "passfile", "Read password from file")
+	flagSet.IntVar(&args.passfd, "passfd", -1, "Read password from already-open file descriptor")
+	flagSet.IntVar(&args.readyFd, "ready-fd", -1, "Write a JSON line to this already-open file descriptor once the filesystem is mounted")
+	flagSet.Var(&args.execAfterMount, "exec-after-mount", "Run command with the mountpoint as argument once the filesystem is mounted")
+	flagSet.Var(&args.execAfterUnmount, "exec-after-unmount", "Run command with the mountpoint as argument after unmount")
+	flagSet.Var(&args.fido2, "fido2", "Require a FIDO2 key in addition to the password, trying the given device paths")
+	flagSet.IntVar(&args.fido2Remove, "fido2-remove", -1, "Remove the FIDO2 key in the given slot and exit")
 
 	flagSet.IntVar(&args.notifypid, "notifypid", 0, "Send USR1 to the specified process after "+
 		"successful mount - used internally for daemonization")
@@ -208,9 +310,39 @@ func parseCliOpts() (args argContainer) {
 	flagSet.IntVar(&args.scryptn, scryptn, configfile.ScryptDefaultLogN, "scrypt cost parameter logN. Possible values: 10-28. "+
 		"A lower value speeds up mounting and reduces its memory needs, but makes the password susceptible to brute-force attacks")
 
+	flagSet.IntVar(&args.readahead, "readahead", 0, "Prefetch and decrypt this many blocks "+
+		"after a sequential read. 0 disables prefetching")
+
+	flagSet.IntVar(&args.maxNameLength, "max-name-length", 0, "Store encrypted names longer than this "+
+		"as long names. Only used with -init, -masterkey and -zerokey. 0 means 255")
+
+	flagSet.IntVar(&args.maxBackingFds, "max-backing-fds", 0, "Keep at most this many backing files "+
+		"open at the same time, further opens wait. 0 means unlimited")
+	flagSet.IntVar(&args.retry, "retry", 0, "Retry operations on CIPHERDIR up to this many times "+
+		"when they fail with EAGAIN, EINTR or ESTALE. 0 disables retrying")
+	flagSet.DurationVar(&args.retryBackoff, "retry-backoff", 10*time.Millisecond,
+		"Wait before the first -retry. Doubles with each further retry")
+
+	flagSet.Uint64Var(&args.quota, "quota", 0, "Limit the plaintext bytes stored in the filesystem. "+
+		"Writes fail with EDQUOT when the limit is reached. 0 means no limit")
+	flagSet.Uint64Var(&args.readBps, "read-bps", 0, "Limit reads from CIPHERDIR to this many bytes per second. "+
+		"0 means no limit")
+	flagSet.Uint64Var(&args.writeBps, "write-bps", 0, "Limit writes to CIPHERDIR to this many bytes per second. "+
+		"0 means no limit")
+
 	flagSet.DurationVar(&args.idle, "i", 0, "Alias for -idle")
 	flagSet.DurationVar(&args.idle, "idle", 0, "Auto-unmount after specified idle duration (ignored in reverse mode). "+
 		"Durations are specified like \"500s\" or \"2h45m\". 0 means stay mounted indefinitely.")
+	flagSet.DurationVar(&args.readonlyAfter, "readonly-after", 0, "Make the filesystem read-only after specified duration since mount. "+
+		"0 means never.")
+	flagSet.DurationVar(&args.negativeTimeout, "negative-timeout", time.Second, "Let the kernel cache lookups "+
+		"of missing files for specified duration. 0 disables the cache")
+	flagSet.DurationVar(&args.attrTimeout, "attr-timeout", time.Second, "Let the kernel cache file "+
+		"attributes for specified duration. 0 disables the cache")
+	flagSet.DurationVar(&args.entryTimeout, "entry-timeout", time.Second, "Let the kernel cache directory "+
+		"entries for specified duration. 0 disables the cache")
+	flagSet.DurationVar(&args.keyringTTL, "keyring-ttl", 10*time.Minute, "Let the kernel remove the master key "+
+		"cached by -use-keyring after specified duration")
 
 	var nofail bool
 	flagSet.BoolVar(&nofail, "nofail", false, "Ignored for /etc/fstab compatibility")
@@ -231,6 +363,28 @@ func parseCliOpts() (args argContainer) {
 	if isFlagPassed(flagSet, scryptn) {
 		args._explicitScryptn = true
 	}
+	if args.subtype != "" && strings.IndexFunc(args.subtype, isInvalidSubtypeRune) >= 0 {
+		tlog.Fatal.Printf("Invalid \"-subtype\" setting %q: only letters, digits, '.', '_' and '-' are allowed", args.subtype)
+		os.Exit(exitcodes.Usage)
+	}
+	cacheTimeouts := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"negative-timeout", args.negativeTimeout},
+		{"attr-timeout", args.attrTimeout},
+		{"entry-timeout", args.entryTimeout},
+	}
+	for _, t := range cacheTimeouts {
+		if t.d < 0 {
+			tlog.Fatal.Printf("Invalid \"-%s\" setting %v: must not be negative", t.name, t.d)
+			os.Exit(exitcodes.Usage)
+		}
+		if args.sharedstorage && t.d > 0 && isFlagPassed(flagSet, t.name) {
+			tlog.Fatal.Printf("-%s cannot be used together with -sharedstorage, which disables all caches", t.name)
+			os.Exit(exitcodes.Usage)
+		}
+	}
 	// "-openssl" needs some post-processing
 	if opensslAuto == "auto" {
 		args.openssl = stupidgcm.PreferOpenSSL()
@@ -267,6 +421,69 @@ func parseCliOpts() (args argContainer) {
 		args.allow_other = false
 		args.ko = "noexec"
 	}
+	if args.readahead < 0 || args.readahead > maxReadAhead {
+		tlog.Fatal.Printf("Invalid \"-readahead\" setting %d: must be between 0 and %d",
+			args.readahead, maxReadAhead)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.maxNameLength != 0 && (args.maxNameLength < nametransform.MinLongNameMax ||
+		args.maxNameLength > nametransform.NameMax) {
+		tlog.Fatal.Printf("Invalid \"-max-name-length\" setting %d: must be between %d and %d",
+			args.maxNameLength, nametransform.MinLongNameMax, nametransform.NameMax)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.maxNameLength != 0 && (args.plaintextnames || !args.longnames) {
+		tlog.Fatal.Printf("-max-name-length cannot be used together with -plaintextnames or -longnames=false")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.dirivName != "" {
+		if err := nametransform.CheckDirIVName(args.dirivName); err != nil {
+			tlog.Fatal.Printf("Invalid \"-diriv-name\" setting: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.passfd < -1 {
+		tlog.Fatal.Printf("Invalid \"-passfd\" setting: %d", args.passfd)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.keyringTTL <= 0 {
+		tlog.Fatal.Printf("Invalid \"-keyring-ttl\" setting: %v", args.keyringTTL)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.readyFd < -1 {
+		tlog.Fatal.Printf("Invalid \"-ready-fd\" setting: %d", args.readyFd)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.readyFd >= 0 {
+		if args.readyFd == args.passfd {
+			tlog.Fatal.Printf("-ready-fd and -passfd cannot use the same file descriptor")
+			os.Exit(exitcodes.Usage)
+		}
+		var st syscall.Stat_t
+		if err := syscall.Fstat(args.readyFd, &st); err != nil {
+			tlog.Fatal.Printf("-ready-fd %d: %v", args.readyFd, err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if (len(args.fido2) != 0 || args.fido2Add != "" || args.fido2Remove >= 0) && (args.zerokey || args.masterkey != "") {
+		tlog.Fatal.Printf("The options -fido2, -fido2-add and -fido2-remove cannot be used together with -zerokey or -masterkey")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.fido2Remove < -1 {
+		tlog.Fatal.Printf("Invalid \"-fido2-remove\" setting: %d", args.fido2Remove)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.passfd >= 0 {
+		if !args.extpass.Empty() || len(args.passfile) != 0 || args.masterkey != "" || args.zerokey {
+			tlog.Fatal.Printf("The option -passfd cannot be used together with -extpass, -passfile, -masterkey or -zerokey")
+			os.Exit(exitcodes.Usage)
+		}
+		// -passwd reads two passwords, the fd is closed after the first one
+		if args.passwd {
+			tlog.Fatal.Printf("The options -passfd and -passwd cannot be used at the same time")
+			os.Exit(exitcodes.Usage)
+		}
+	}
 	if !args.extpass.Empty() && len(args.passfile) != 0 {
 		tlog.Fatal.Printf("The options -extpass and -passfile cannot be used at the same time")
 		os.Exit(exitcodes.Usage)
@@ -279,10 +496,59 @@ func parseCliOpts() (args argContainer) {
 		tlog.Fatal.Printf("The options -extpass and -masterkey cannot be used at the same time")
 		os.Exit(exitcodes.Usage)
 	}
+	if args.zerokey && args.masterkey != "" {
+		tlog.Fatal.Printf("The options -zerokey and -masterkey cannot be used at the same time")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.zerokey && (len(args.passfile) != 0 || !args.extpass.Empty()) {
+		tlog.Fatal.Printf("The option -zerokey does not use a password, -passfile and -extpass cannot be used with it")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.zerokey && args.passwd {
+		tlog.Fatal.Printf("The options -zerokey and -passwd cannot be used at the same time")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.sameMasterkey != "" && (args.zerokey || args.masterkey != "") {
+		tlog.Fatal.Printf("-same-masterkey compares the master keys stored in the config files, " +
+			"-zerokey and -masterkey cannot be used with it")
+		os.Exit(exitcodes.Usage)
+	}
 	if args.idle < 0 {
 		tlog.Fatal.Printf("Idle timeout cannot be less than 0")
 		os.Exit(exitcodes.Usage)
 	}
+	if args.readonlyAfter < 0 {
+		tlog.Fatal.Printf("-readonly-after cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.pruneEmptyOnUnmount && args.ro {
+		tlog.Fatal.Printf("-prune-empty-on-unmount cannot be used together with -ro")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.execStrict && args.execAfterMount.Empty() && args.execAfterUnmount.Empty() {
+		tlog.Fatal.Printf("-exec-strict needs -exec-after-mount or -exec-after-unmount")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.hideCorrupt && args.showCorrupt {
+		tlog.Fatal.Printf("-hide-corrupt and -show-corrupt cannot be used together")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.maxBackingFds < 0 {
+		tlog.Fatal.Printf("-max-backing-fds cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.retry < 0 || args.retryBackoff < 0 {
+		tlog.Fatal.Printf("-retry and -retry-backoff cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.json && !args.info && !args.fsck {
+		tlog.Fatal.Printf("-json only works together with -info or -fsck")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.dryRun && !args.repairLongnames {
+		tlog.Fatal.Printf("-dry-run only works together with -repair-longnames")
+		os.Exit(exitcodes.Usage)
+	}
 	return args
 }
 
@@ -309,9 +575,44 @@ func countOpFlags(args *argContainer) int {
 	if args.fsck {
 		count++
 	}
+	if args.scrub {
+		count++
+	}
+	if args.migrateNames {
+		count++
+	}
+	if args.repairLongnames {
+		count++
+	}
+	if args.encryptPath != "" {
+		count++
+	}
+	if args.decryptPath != "" {
+		count++
+	}
+	if args.sameMasterkey != "" {
+		count++
+	}
+	if args.fido2Add != "" {
+		count++
+	}
+	if args.fido2Remove >= 0 {
+		count++
+	}
+	if args.clearKeyring {
+		count++
+	}
 	return count
 }
 
+// isInvalidSubtypeRune returns true for characters that "-subtype" must not
+// contain. The subtype ends up in the mount options and in the type column
+// of /proc/mounts, which are separated by ',' and by whitespace.
+func isInvalidSubtypeRune(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+		r == '.' || r == '_' || r == '-')
+}
+
 // isFlagPassed finds out if the flag was explictely passed on the command line.
 // https://stackoverflow.com/a/54747682/1380267
 func isFlagPassed(flagSet *flag.FlagSet, name string) bool {
@@ -1,18 +1,85 @@
 package ctlsock
 
+import "time"
+
 // RequestStruct is sent by a client (encoded as JSON).
-// You cannot perform both encryption and decryption in the same request.
+// Exactly one of the fields must be set.
 type RequestStruct struct {
 	// EncryptPath is the path that should be encrypted.
 	EncryptPath string
 	// DecryptPath is the path that should be decrypted.
 	DecryptPath string
+	// Stats requests the latency statistics collected with "-stats".
+	Stats bool `json:",omitempty"`
+	// Status requests the state of the mount, see MountStatus.
+	Status bool `json:",omitempty"`
+	// TrashList requests the entries in the "-trash" directory.
+	TrashList bool `json:",omitempty"`
+	// TrashRestore is the ID of a trashed entry that should be moved back
+	// to where it was deleted from.
+	TrashRestore string `json:",omitempty"`
+	// TrashPurge is the ID of a trashed entry that should be deleted for
+	// good, or "*" for all of them.
+	TrashPurge string `json:",omitempty"`
+	// Quota requests the usage and limit of "-quota".
+	Quota bool `json:",omitempty"`
+	// Watch subscribes to the change events of "-watch". The server sends
+	// one response per event until the connection is closed.
+	Watch bool `json:",omitempty"`
+	// ReadOnlyAfter restarts the timer of "-readonly-after" so that the
+	// filesystem becomes read-only after this duration, for example "1h".
+	// Fails with EROFS if it is read-only already.
+	ReadOnlyAfter string `json:",omitempty"`
+	// PathInfo is the plaintext path of a file whose storage size should be
+	// reported, see PathInfo.
+	PathInfo string `json:",omitempty"`
+	// Prefetch is the plaintext path of a directory whose subtree should be
+	// walked in the background, to warm the caches before it is used. ""
+	// is not a valid value, use "/" for the whole filesystem. Fails with
+	// EBUSY while an earlier walk is running.
+	Prefetch string `json:",omitempty"`
+	// PrefetchStat makes a Prefetch walk also stat every entry. Only used
+	// together with Prefetch.
+	PrefetchStat bool `json:",omitempty"`
+	// PrefetchStatus requests the progress of the last Prefetch walk.
+	PrefetchStatus bool `json:",omitempty"`
+	// Bandwidth requests the limits and current rates of "-read-bps" and
+	// "-write-bps".
+	Bandwidth bool `json:",omitempty"`
+	// BulkChmod is the plaintext path of a file or directory whose mode,
+	// and the mode of everything below it, should be set to BulkMode and
+	// BulkDirMode. "/" is the whole filesystem. The answer is sent when
+	// all entries have been processed.
+	BulkChmod string `json:",omitempty"`
+	// BulkMode is the new mode of everything but directories and
+	// symlinks. Nil leaves them alone. Only used together with BulkChmod.
+	BulkMode *uint32 `json:",omitempty"`
+	// BulkDirMode is the new mode of directories. Nil leaves them alone.
+	// Only used together with BulkChmod.
+	BulkDirMode *uint32 `json:",omitempty"`
+	// BulkChown is like BulkChmod, but sets the owner to BulkUID and
+	// BulkGID.
+	BulkChown string `json:",omitempty"`
+	// BulkUID is the new owner. Nil leaves it alone. Only used together
+	// with BulkChown.
+	BulkUID *uint32 `json:",omitempty"`
+	// BulkGID is the new group. Nil leaves it alone. Only used together
+	// with BulkChown.
+	BulkGID *uint32 `json:",omitempty"`
+	// Transaction is a list of renames and unlinks that are applied in
+	// order, all or nothing: if one of them fails, the ones before it are
+	// undone. Like every request, the JSON encoding must be smaller than
+	// ctlsocksrv.ReadBufSize (5000 bytes), which limits a Transaction to a
+	// few dozen operations on short paths.
+	Transaction []TransactionOp `json:",omitempty"`
 }
 
 // ResponseStruct is sent by the server in response to a request
 // (encoded as JSON).
 type ResponseStruct struct {
 	// Result is the resulting decrypted or encrypted path. Empty on error.
+	// For ReadOnlyAfter, it is the time the filesystem becomes read-only,
+	// in RFC 3339 format.
 	Result string
 	// ErrNo is the error number as defined in errno.h.
 	// 0 means success and -1 means that the error number is not known
@@ -23,4 +90,177 @@ type ResponseStruct struct {
 	// WarnText contains warnings that may have been encountered while
 	// processing the message.
 	WarnText string
+	// Stats is the answer to a Stats request, keyed by operation name.
+	Stats map[string]OpStats `json:",omitempty"`
+	// Status is the answer to a Status request.
+	Status *MountStatus `json:",omitempty"`
+	// Trash is the answer to a TrashList request, oldest entry first.
+	Trash []TrashItem `json:",omitempty"`
+	// Quota is the answer to a Quota request.
+	Quota *QuotaStatus `json:",omitempty"`
+	// Event is a change event sent after a Watch request.
+	Event *WatchEvent `json:",omitempty"`
+	// PathInfo is the answer to a PathInfo request.
+	PathInfo *PathInfo `json:",omitempty"`
+	// Prefetch is the answer to Prefetch and PrefetchStatus requests.
+	Prefetch *PrefetchStatus `json:",omitempty"`
+	// Bandwidth is the answer to a Bandwidth request.
+	Bandwidth *BandwidthStatus `json:",omitempty"`
+	// Bulk is the answer to BulkChmod and BulkChown requests.
+	Bulk *BulkStatus `json:",omitempty"`
+}
+
+// OpStats summarizes the latency of one FUSE operation. Durations are
+// encoded as nanoseconds in JSON.
+type OpStats struct {
+	// Count is the number of calls since mount.
+	Count uint64
+	// P50 is the median latency.
+	P50 time.Duration
+	// P99 is the 99th percentile latency.
+	P99 time.Duration
+	// Max is the largest latency seen.
+	Max time.Duration
+}
+
+// MountStatus is the state of a mount. Durations are encoded as nanoseconds
+// in JSON.
+type MountStatus struct {
+	// OpenFiles is the number of open file handles.
+	OpenFiles int64
+	// BytesRead is the number of plaintext bytes read since mount.
+	BytesRead uint64
+	// BytesWritten is the number of plaintext bytes written since mount.
+	BytesWritten uint64
+	// Uptime is the time since mount.
+	Uptime time.Duration
+	// FeatureFlags are the feature flags from the config file. Empty if the
+	// filesystem was mounted with "-masterkey" or "-zerokey".
+	FeatureFlags []string
+	// ReadOnly is true if the timer of "-readonly-after" has expired.
+	ReadOnly bool `json:",omitempty"`
+}
+
+// TrashItem is an entry in the "-trash" directory.
+type TrashItem struct {
+	// ID identifies the entry in TrashRestore and TrashPurge requests.
+	ID string
+	// Path is the plaintext path the entry was deleted from.
+	Path string
+	// Time is when the entry was deleted.
+	Time time.Time
+}
+
+// QuotaStatus is the plaintext usage of a mount with "-quota".
+type QuotaStatus struct {
+	// Used is the number of plaintext bytes in the filesystem.
+	Used uint64
+	// Limit is the quota passed to "-quota".
+	Limit uint64
+}
+
+// Values of WatchEvent.Op
+const (
+	// WatchCreate means that the entry has been created or moved here.
+	WatchCreate = "create"
+	// WatchDelete means that the entry has been deleted or moved away.
+	WatchDelete = "delete"
+	// WatchModify means that a file has been written to and closed.
+	WatchModify = "modify"
+	// WatchOverflow means that events have been lost. Path is empty.
+	WatchOverflow = "overflow"
+)
+
+// WatchEvent is a change of the filesystem reported by "-watch".
+type WatchEvent struct {
+	// Op is one of WatchCreate, WatchDelete, WatchModify or WatchOverflow.
+	Op string
+	// Path is the plaintext path of the changed entry.
+	Path string
+}
+
+// PathInfo describes how a file is stored in CIPHERDIR.
+type PathInfo struct {
+	// CipherPath is the encrypted path, like the answer to EncryptPath.
+	CipherPath string
+	// PlainSize is the size of the file in the mount.
+	PlainSize uint64
+	// CipherSize is the size of the file in CIPHERDIR.
+	CipherSize uint64
+	// Blocks is the number of content blocks.
+	Blocks uint64
+	// HeaderBytes is the size of the file header. Empty files have none.
+	HeaderBytes uint64
+	// Overhead is CipherSize divided by PlainSize. 0 for empty files.
+	Overhead float64
+}
+
+// PrefetchStatus is the progress of a Prefetch walk.
+type PrefetchStatus struct {
+	// Path is the plaintext path of the walked subtree.
+	Path string
+	// Running is true until the walk has finished.
+	Running bool
+	// Dirs is the number of directories read so far.
+	Dirs uint64
+	// Entries is the number of directory entries seen so far.
+	Entries uint64
+	// Errors is the number of directories or entries that could not be
+	// read. They are skipped.
+	Errors uint64
+	// Started is when the walk was started.
+	Started time.Time
+	// Finished is when the walk has finished. Zero while it is running.
+	Finished time.Time
+}
+
+// BandwidthStatus is the IO against CIPHERDIR of a mount with "-read-bps" or
+// "-write-bps". All numbers are ciphertext bytes. The fields of a direction
+// without a limit are zero.
+type BandwidthStatus struct {
+	// ReadLimit is the limit passed to "-read-bps", in bytes per second.
+	ReadLimit uint64
+	// ReadRate is the rate of reads over the last second.
+	ReadRate uint64
+	// BytesRead is the number of bytes read since mount.
+	BytesRead uint64
+	// WriteLimit is the limit passed to "-write-bps", in bytes per second.
+	WriteLimit uint64
+	// WriteRate is the rate of writes over the last second.
+	WriteRate uint64
+	// BytesWritten is the number of bytes written since mount.
+	BytesWritten uint64
+}
+
+// BulkStatus is the result of a BulkChmod or BulkChown request.
+type BulkStatus struct {
+	// Changed is the number of entries whose mode or owner has been
+	// changed.
+	Changed uint64
+	// Unchanged is the number of entries that already had the requested
+	// mode or owner.
+	Unchanged uint64
+	// Errors is the number of entries that could not be changed. They
+	// are skipped.
+	Errors uint64
+}
+
+// Values of TransactionOp.Op
+const (
+	// TransactionRename renames Path to NewPath. An existing NewPath is
+	// replaced, like rename(2) does.
+	TransactionRename = "rename"
+	// TransactionUnlink deletes the file, symlink or special file at Path.
+	TransactionUnlink = "unlink"
+)
+
+// TransactionOp is one operation of a Transaction request.
+type TransactionOp struct {
+	// Op is TransactionRename or TransactionUnlink.
+	Op string
+	// Path is the plaintext path the operation applies to.
+	Path string
+	// NewPath is the plaintext path Path is renamed to. Only used by
+	// TransactionRename.
+	NewPath string `json:",omitempty"`
 }
@@ -24,9 +24,11 @@ func exitOnUsr1() {
 }
 
 // forkChild - execute ourselves once again, this time with the "-fg" flag, and
-// wait for SIGUSR1 or child exit.
+// wait for SIGUSR1 or child exit. The file descriptors "fds" ("-passfd" and
+// "-ready-fd") are passed on to the child under the same numbers. Negative
+// values are ignored.
 // This is a workaround for the missing true fork function in Go.
-func forkChild() int {
+func forkChild(fds ...int) int {
 	name := os.Args[0]
 	// Use the full path to our executable if we can get if from /proc.
 	buf := make([]byte, syscallcompat.PATH_MAX)
@@ -41,12 +43,28 @@ func forkChild() int {
 	c.Stdout = os.Stdout
 	c.Stderr = os.Stderr
 	c.Stdin = os.Stdin
+	// ExtraFiles[i] becomes fd 3+i in the child. 0, 1 and 2 are passed anyway.
+	for _, fd := range fds {
+		if fd < 3 {
+			continue
+		}
+		for len(c.ExtraFiles) < fd-2 {
+			c.ExtraFiles = append(c.ExtraFiles, nil)
+		}
+		c.ExtraFiles[fd-3] = os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+	}
 	exitOnUsr1()
 	err = c.Start()
 	if err != nil {
 		tlog.Fatal.Printf("forkChild: starting %s failed: %v", name, err)
 		return exitcodes.ForkChild
 	}
+	// The child uses the fds, we don't need them anymore
+	for _, f := range c.ExtraFiles {
+		if f != nil {
+			f.Close()
+		}
+	}
 	err = c.Wait()
 	if err != nil {
 		if exiterr, ok := err.(*exec.ExitError); ok {
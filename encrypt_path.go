@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// translatePath implements "-encrypt-path" and "-decrypt-path": it unlocks
+// the filesystem without mounting it, translates the path given on the
+// command line and prints the result to stdout.
+// Calls os.Exit on errors.
+func translatePath(args *argContainer) {
+	args.allow_other = false
+	// Nothing is mounted, so CIPHERDIR must not change
+	args.ro = true
+	pfs, wipeKeys := initFuseFrontend(args)
+	fs := pfs.(ctlsocksrv.Interface)
+	var out string
+	var err error
+	op, in := "-encrypt-path", args.encryptPath
+	if args.encryptPath != "" {
+		out, err = fs.EncryptPath(cleanRelPath(in))
+	} else {
+		op, in = "-decrypt-path", args.decryptPath
+		out, err = fs.DecryptPath(cleanRelPath(in))
+	}
+	wipeKeys()
+	if err != nil {
+		tlog.Fatal.Printf("%s %q: %v", op, in, err)
+		os.Exit(exitcodes.Other)
+	}
+	fmt.Println(out)
+}
+
+// cleanRelPath turns a path that may be given as "/a/b/" or "./a/b" into
+// the "a/b" form that is used internally.
+func cleanRelPath(p string) string {
+	p = strings.Trim(p, "/")
+	for strings.HasPrefix(p, "./") {
+		p = strings.TrimLeft(p[2:], "/")
+	}
+	if p == "." {
+		return ""
+	}
+	return p
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// runHook runs the command given via "-exec-after-mount" or
+// "-exec-after-unmount" (passed in as "flagName") with the mountpoint appended
+// as the last argument. Like "-extpass", a single string is split on spaces.
+// The exit status is logged and returned as an error.
+func runHook(flagName string, hook multipleStrings, mountpoint string) error {
+	var parts []string
+	if len(hook) == 1 {
+		parts = strings.Split(hook[0], " ")
+	} else {
+		parts = hook
+	}
+	parts = append(parts[:len(parts):len(parts)], mountpoint)
+	tlog.Debug.Printf("%s: running %q, arguments: %q", flagName, parts[0], parts[1:])
+	cmd := exec.Command(parts[0], parts[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		err = fmt.Errorf("%s: %q failed: %v", flagName, parts[0], err)
+		tlog.Warn.Println(err)
+		return err
+	}
+	tlog.Info.Printf("%s: %q exited successfully", flagName, parts[0])
+	return nil
+}
+
+// runAfterUnmountHook runs "-exec-after-unmount", if set. It must only be
+// called after unmount. With "-exec-strict", a failure is returned as an
+// exitcodes.Err.
+func runAfterUnmountHook(args *argContainer) error {
+	if args.execAfterUnmount.Empty() {
+		return nil
+	}
+	err := runHook("-exec-after-unmount", args.execAfterUnmount, args.mountpoint)
+	if err != nil && args.execStrict {
+		return exitcodes.NewErr(err.Error(), exitcodes.ExecHook)
+	}
+	return nil
+}
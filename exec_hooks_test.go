@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRunHook(t *testing.T) {
+	f, err := ioutil.TempFile("", "TestRunHook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	// Passed more than once: the arguments are used as-is, and the mountpoint
+	// ends up in $0 of the shell script
+	hook := multipleStrings{"/bin/sh", "-c", "echo -n \"$0\" > " + f.Name()}
+	if err = runHook("-exec-after-mount", hook, "/mnt/x y"); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "/mnt/x y" {
+		t.Errorf("want %q, got %q", "/mnt/x y", content)
+	}
+	// Passed once: split on spaces
+	if err = runHook("-exec-after-mount", multipleStrings{"test -d"}, "/"); err != nil {
+		t.Error(err)
+	}
+	if err = runHook("-exec-after-mount", multipleStrings{"false"}, "/"); err == nil {
+		t.Error("a failing command should return an error")
+	}
+	if err = runHook("-exec-after-mount", multipleStrings{"/does/not/exist"}, "/"); err == nil {
+		t.Error("a missing command should return an error")
+	}
+}
+
+func TestRunAfterUnmountHook(t *testing.T) {
+	args := &argContainer{mountpoint: "/"}
+	if err := runAfterUnmountHook(args); err != nil {
+		t.Error(err)
+	}
+	args.execAfterUnmount = multipleStrings{"false"}
+	if err := runAfterUnmountHook(args); err != nil {
+		t.Errorf("without -exec-strict, failures should only be logged: %v", err)
+	}
+	args.execStrict = true
+	if err := runAfterUnmountHook(args); err == nil {
+		t.Error("with -exec-strict, failures should be returned")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fido2"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// unlockFIDO2 gets the FIDO2 secret of the filesystem from the first key
+// passed to "-fido2" that matches a slot in "cf". Devices that are not
+// plugged in are skipped. Returns the secret and the slot number.
+func unlockFIDO2(args *argContainer, cf *configfile.ConfFile) ([]byte, int, error) {
+	if len(args.fido2) == 0 {
+		tlog.Fatal.Printf("This filesystem needs a FIDO2 key in addition to the password, pass -fido2 DEVICE")
+		return nil, -1, exitcodes.NewErr("FIDO2 key required", exitcodes.FIDO2)
+	}
+	for _, device := range args.fido2 {
+		if _, err := os.Stat(device); err != nil {
+			tlog.Info.Printf("FIDO2: skipping %q: %v", device, err)
+			continue
+		}
+		for i := range cf.FIDO2 {
+			slot := &cf.FIDO2[i]
+			hmacSecret, err := fido2.Secret(device, slot.CredentialID, slot.HMACSalt)
+			if err != nil {
+				tlog.Info.Printf("FIDO2: slot %d, %q: %v", i, device, err)
+				continue
+			}
+			secret, err := slot.DecryptSecret(hmacSecret)
+			for j := range hmacSecret {
+				hmacSecret[j] = 0
+			}
+			if err != nil {
+				tlog.Fatal.Printf("FIDO2: slot %d: %v", i, err)
+				return nil, -1, err
+			}
+			tlog.Info.Printf("FIDO2: unlocked slot %d with %q", i, device)
+			return secret, i, nil
+		}
+	}
+	tlog.Fatal.Printf("None of the FIDO2 keys %q matches the %d slot(s) of this filesystem",
+		[]string(args.fido2), len(cf.FIDO2))
+	return nil, -1, exitcodes.NewErr("no matching FIDO2 key", exitcodes.FIDO2)
+}
+
+// combineFIDO2 combines the password "pw" with the FIDO2 secret if the
+// config file "cf" has the FIDO2 feature flag, and wipes "pw". Otherwise, it
+// returns "pw" unchanged.
+func combineFIDO2(args *argContainer, cf *configfile.ConfFile, pw []byte) ([]byte, error) {
+	if !cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		return pw, nil
+	}
+	secret, _, err := unlockFIDO2(args, cf)
+	if err != nil {
+		return nil, err
+	}
+	combined := fido2.Combine(pw, secret)
+	for i := range pw {
+		pw[i] = 0
+	}
+	return combined, nil
+}
+
+// newFIDO2Slot creates a credential on the key at "device" and returns a
+// slot that holds the FIDO2 secret "secret".
+func newFIDO2Slot(device string, secret []byte) (*configfile.FIDO2Slot, error) {
+	credentialID, err := fido2.Register(device)
+	if err != nil {
+		return nil, err
+	}
+	salt := cryptocore.RandBytes(fido2.SaltLen)
+	hmacSecret, err := fido2.Secret(device, credentialID, salt)
+	if err != nil {
+		return nil, err
+	}
+	slot, err := configfile.NewFIDO2Slot(credentialID, salt, hmacSecret, secret)
+	for i := range hmacSecret {
+		hmacSecret[i] = 0
+	}
+	if err != nil {
+		return nil, exitcodes.NewErr(err.Error(), exitcodes.FIDO2)
+	}
+	return slot, nil
+}
+
+// initFIDO2 creates a new FIDO2 secret and a slot for it on every key passed
+// to "-fido2", and combines the secret with the password "pw", which is
+// wiped. Returns the combined password and the slots for the config file.
+func initFIDO2(args *argContainer, pw []byte) ([]byte, []configfile.FIDO2Slot, error) {
+	secret := cryptocore.RandBytes(configfile.FIDO2SecretLen)
+	var slots []configfile.FIDO2Slot
+	for _, device := range args.fido2 {
+		slot, err := newFIDO2Slot(device, secret)
+		if err != nil {
+			return nil, nil, err
+		}
+		slots = append(slots, *slot)
+	}
+	combined := fido2.Combine(pw, secret)
+	for i := range pw {
+		pw[i] = 0
+	}
+	return combined, slots, nil
+}
+
+// loadFIDO2Config loads the config file and checks the password and the
+// FIDO2 key like a mount does. Returns the config file and the FIDO2 secret.
+// Used by "-fido2-add" and "-fido2-remove".
+func loadFIDO2Config(args *argContainer) (*configfile.ConfFile, []byte) {
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		exitcodes.Exit(err)
+	}
+	if !cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		tlog.Fatal.Printf("The filesystem does not use a FIDO2 key. Create it with -init -fido2 to use one.")
+		os.Exit(exitcodes.FIDO2)
+	}
+	pw := readpassword.Once([]string(args.extpass), []string(args.passfile), args.passfd, "")
+	secret, _, err := unlockFIDO2(args, cf)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	// Combine wipes the secret, but the caller still needs it
+	combined := fido2.Combine(pw, append([]byte(nil), secret...))
+	for i := range pw {
+		pw[i] = 0
+	}
+	tlog.Info.Println("Decrypting master key")
+	masterkey, err := cf.DecryptMasterKey(combined)
+	for i := range combined {
+		combined[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	return cf, secret
+}
+
+// fido2Add registers the key passed to "-fido2-add" in a new slot.
+// Does not return (calls os.Exit both on success and on error).
+func fido2Add(args *argContainer) {
+	cf, secret := loadFIDO2Config(args)
+	slot, err := newFIDO2Slot(args.fido2Add, secret)
+	for i := range secret {
+		secret[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	cf.FIDO2 = append(cf.FIDO2, *slot)
+	if err = cf.WriteFile(); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"FIDO2 key added in slot %d."+tlog.ColorReset, len(cf.FIDO2)-1)
+	os.Exit(0)
+}
+
+// fido2Remove removes the slot passed to "-fido2-remove". The last slot
+// cannot be removed, "-passwd -masterkey" does that.
+// Does not return (calls os.Exit both on success and on error).
+func fido2Remove(args *argContainer) {
+	cf, secret := loadFIDO2Config(args)
+	for i := range secret {
+		secret[i] = 0
+	}
+	n := args.fido2Remove
+	if n >= len(cf.FIDO2) {
+		tlog.Fatal.Printf("There is no FIDO2 slot %d, the filesystem has %d slot(s)", n, len(cf.FIDO2))
+		os.Exit(exitcodes.Usage)
+	}
+	if len(cf.FIDO2) == 1 {
+		tlog.Fatal.Printf("Refusing to remove the last FIDO2 key. To stop using FIDO2, reset the password with -passwd -masterkey.")
+		os.Exit(exitcodes.Usage)
+	}
+	cf.FIDO2 = append(cf.FIDO2[:n], cf.FIDO2[n+1:]...)
+	if err := cf.WriteFile(); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"FIDO2 slot %d removed, %d slot(s) left."+tlog.ColorReset, n, len(cf.FIDO2))
+	os.Exit(0)
+}
@@ -18,10 +18,32 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
+// fsckCorruption is a problem found by fsck
+type fsckCorruption struct {
+	// Path is the plaintext path of the corrupt file or directory. Corrupt
+	// xattr names are reported as "PATH xattr:NAME".
+	Path string
+	// Offset is the file offset of the read that failed, for corrupt file
+	// content
+	Offset *int64 `json:",omitempty"`
+	// Message is the error message that fsck printed
+	Message string
+}
+
+// fsckResult is the output of "-fsck -json"
+type fsckResult struct {
+	Corrupt      []fsckCorruption
+	Skipped      []string
+	CorruptCount int
+	SkippedCount int
+	// ExitStatus is the exit code of gocryptfs, 0 or exitcodes.FsckErrors
+	ExitStatus int
+}
+
 type fsckObj struct {
 	fs *fusefrontend.FS
 	// List of corrupt files
-	corruptList []string
+	corruptList []fsckCorruption
 	// List of skipped files
 	skippedList []string
 	// Protects corruptList
@@ -30,15 +52,38 @@ type fsckObj struct {
 	watchDone chan struct{}
 	// Inode numbers of hard-linked files (Nlink > 1) that we have already checked
 	seenInodes map[uint64]struct{}
+	// CIPHERDIR, and whether the blocks carry a CRC32C ("-blockcrc")
+	cipherdir string
+	blockCRC  bool
+	// jsonOut suppresses the messages, the results are printed as JSON at
+	// the end ("-json")
+	jsonOut bool
 }
 
 func runsAsRoot() bool {
 	return syscall.Geteuid() == 0
 }
 
-func (ck *fsckObj) markCorrupt(path string) {
+// printf prints a message about a problem, unless we output JSON, and returns
+// it without the "fsck: " prefix.
+func (ck *fsckObj) printf(format string, a ...interface{}) string {
+	msg := fmt.Sprintf(format, a...)
+	if !ck.jsonOut {
+		fmt.Printf("fsck: %s\n", msg)
+	}
+	return msg
+}
+
+func (ck *fsckObj) markCorrupt(path string, msg string) {
 	ck.listLock.Lock()
-	ck.corruptList = append(ck.corruptList, path)
+	ck.corruptList = append(ck.corruptList, fsckCorruption{Path: path, Message: msg})
+	ck.listLock.Unlock()
+}
+
+// markCorruptAt is like markCorrupt for a failed read at offset "off"
+func (ck *fsckObj) markCorruptAt(path string, off int64, msg string) {
+	ck.listLock.Lock()
+	ck.corruptList = append(ck.corruptList, fsckCorruption{Path: path, Offset: &off, Message: msg})
 	ck.listLock.Unlock()
 }
 
@@ -53,8 +98,8 @@ func (ck *fsckObj) watchMitigatedCorruptionsOpenDir(path string) {
 	for {
 		select {
 		case item := <-ck.fs.MitigatedCorruptions:
-			fmt.Printf("fsck: corrupt entry in dir %q: %q\n", path, item)
-			ck.markCorrupt(filepath.Join(path, item))
+			msg := ck.printf("corrupt entry in dir %q: %q", path, item)
+			ck.markCorrupt(filepath.Join(path, item), msg)
 		case <-ck.watchDone:
 			return
 		}
@@ -71,11 +116,11 @@ func (ck *fsckObj) dir(path string) {
 	ck.watchDone <- struct{}{}
 	// Also catch non-mitigated corruptions
 	if !status.Ok() {
-		fmt.Printf("fsck: error opening dir %q: %v\n", path, status)
+		msg := ck.printf("error opening dir %q: %v", path, status)
 		if status == fuse.EACCES && !runsAsRoot() {
 			ck.markSkipped(path)
 		} else {
-			ck.markCorrupt(path)
+			ck.markCorrupt(path, msg)
 		}
 		return
 	}
@@ -98,7 +143,7 @@ func (ck *fsckObj) dir(path string) {
 		case syscall.S_IFIFO, syscall.S_IFSOCK, syscall.S_IFBLK, syscall.S_IFCHR:
 			// nothing to check
 		default:
-			fmt.Printf("fsck: unhandled file type %x\n", filetype)
+			ck.printf("unhandled file type %x", filetype)
 		}
 	}
 }
@@ -106,8 +151,7 @@ func (ck *fsckObj) dir(path string) {
 func (ck *fsckObj) symlink(path string) {
 	_, status := ck.fs.Readlink(path, nil)
 	if !status.Ok() {
-		ck.markCorrupt(path)
-		fmt.Printf("fsck: error reading symlink %q: %v\n", path, status)
+		ck.markCorrupt(path, ck.printf("error reading symlink %q: %v", path, status))
 	}
 }
 
@@ -116,8 +160,20 @@ func (ck *fsckObj) watchMitigatedCorruptionsRead(path string) {
 	for {
 		select {
 		case item := <-ck.fs.MitigatedCorruptions:
-			fmt.Printf("fsck: corrupt file %q (inode %s)\n", path, item)
-			ck.markCorrupt(path)
+			ck.markCorrupt(path, ck.printf("corrupt file %q (inode %s)", path, item))
+		case <-ck.watchDone:
+			return
+		}
+	}
+}
+
+// Watch for mitigated corruptions that occur during GetAttr(). With the
+// ExactSize feature flag, these are size mismatches.
+func (ck *fsckObj) watchMitigatedCorruptionsGetAttr(path string) {
+	for {
+		select {
+		case <-ck.fs.MitigatedCorruptions:
+			ck.markCorrupt(path, ck.printf("file %q does not have the stored size", path))
 		case <-ck.watchDone:
 			return
 		}
@@ -127,10 +183,12 @@ func (ck *fsckObj) watchMitigatedCorruptionsRead(path string) {
 // Check file for corruption
 func (ck *fsckObj) file(path string) {
 	tlog.Debug.Printf("ck.file %q\n", path)
+	// Run GetAttr and catch transparently mitigated corruptions
+	go ck.watchMitigatedCorruptionsGetAttr(path)
 	attr, status := ck.fs.GetAttr(path, nil)
+	ck.watchDone <- struct{}{}
 	if !status.Ok() {
-		ck.markCorrupt(path)
-		fmt.Printf("fsck: error stating file %q: %v\n", path, status)
+		ck.markCorrupt(path, ck.printf("error stating file %q: %v", path, status))
 		return
 	}
 	if attr.Nlink > 1 {
@@ -144,11 +202,11 @@ func (ck *fsckObj) file(path string) {
 	ck.xattrs(path)
 	f, status := ck.fs.Open(path, syscall.O_RDONLY, nil)
 	if !status.Ok() {
-		fmt.Printf("fsck: error opening file %q: %v\n", path, status)
+		msg := ck.printf("error opening file %q: %v", path, status)
 		if status == fuse.EACCES && !runsAsRoot() {
 			ck.markSkipped(path)
 		} else {
-			ck.markCorrupt(path)
+			ck.markCorrupt(path, msg)
 		}
 		return
 	}
@@ -164,8 +222,9 @@ func (ck *fsckObj) file(path string) {
 		tlog.Debug.Printf("ck.file: read %d bytes from offset %d\n", len(buf), off)
 		result, status := f.Read(buf, off)
 		if !status.Ok() {
-			ck.markCorrupt(path)
-			fmt.Printf("fsck: error reading file %q (inum %d): %v\n", path, inum(f), status)
+			ck.markCorruptAt(path, off, ck.printf("error reading file %q (inum %d) at offset %d: %v",
+				path, inum(f), off, status))
+			ck.explainCRC(path)
 			return
 		}
 		n := result.Size()
@@ -188,13 +247,33 @@ func (ck *fsckObj) file(path string) {
 	}
 }
 
+// explainCRC tells bit rot apart from other corruption by checking the
+// CRC32C of the blocks of the file at "path", if the filesystem has them
+func (ck *fsckObj) explainCRC(path string) {
+	if !ck.blockCRC {
+		return
+	}
+	cPath, err := ck.fs.EncryptPath(path)
+	if err != nil {
+		return
+	}
+	cPath = filepath.Join(ck.cipherdir, cPath)
+	fi, err := os.Stat(cPath)
+	if err != nil {
+		return
+	}
+	if scrubFile(cPath, fi.Size()) {
+		ck.printf("all blocks of %q have a correct CRC32C: the file has been modified, not damaged by bit rot", path)
+	}
+}
+
 // Watch for mitigated corruptions that occur during ListXAttr()
 func (ck *fsckObj) watchMitigatedCorruptionsListXAttr(path string) {
 	for {
 		select {
 		case item := <-ck.fs.MitigatedCorruptions:
-			fmt.Printf("fsck: corrupt xattr name on file %q: %q\n", path, item)
-			ck.markCorrupt(path + " xattr:" + item)
+			msg := ck.printf("corrupt xattr name on file %q: %q", path, item)
+			ck.markCorrupt(path+" xattr:"+item, msg)
 		case <-ck.watchDone:
 			return
 		}
@@ -209,18 +288,17 @@ func (ck *fsckObj) xattrs(path string) {
 	ck.watchDone <- struct{}{}
 	// Also catch non-mitigated corruptions
 	if !status.Ok() {
-		fmt.Printf("fsck: error listing xattrs on %q: %v\n", path, status)
-		ck.markCorrupt(path)
+		ck.markCorrupt(path, ck.printf("error listing xattrs on %q: %v", path, status))
 		return
 	}
 	for _, a := range attrs {
 		_, status := ck.fs.GetXAttr(path, a, nil)
 		if !status.Ok() {
-			fmt.Printf("fsck: error reading xattr %q from %q: %v\n", a, path, status)
+			msg := ck.printf("error reading xattr %q from %q: %v", a, path, status)
 			if status == fuse.EACCES && !runsAsRoot() {
 				ck.markSkipped(path)
 			} else {
-				ck.markCorrupt(path)
+				ck.markCorrupt(path, msg)
 			}
 		}
 	}
@@ -239,9 +317,15 @@ func fsck(args *argContainer) {
 		fs:         fs,
 		watchDone:  make(chan struct{}),
 		seenInodes: make(map[uint64]struct{}),
+		cipherdir:  args.cipherdir,
+		blockCRC:   args.blockcrc,
+		jsonOut:    args.json,
 	}
 	ck.dir("")
 	wipeKeys()
+	if args.json {
+		ck.printJSON()
+	}
 	if len(ck.corruptList) == 0 && len(ck.skippedList) == 0 {
 		tlog.Info.Printf("fsck summary: no problems found\n")
 		return
@@ -249,10 +333,33 @@ func fsck(args *argContainer) {
 	if len(ck.skippedList) > 0 {
 		tlog.Warn.Printf("fsck: re-run this program as root to check all files!\n")
 	}
-	fmt.Printf("fsck summary: %d corrupt files, %d files skipped\n", len(ck.corruptList), len(ck.skippedList))
+	if !args.json {
+		fmt.Printf("fsck summary: %d corrupt files, %d files skipped\n", len(ck.corruptList), len(ck.skippedList))
+	}
 	os.Exit(exitcodes.FsckErrors)
 }
 
+// printJSON prints the results for "-fsck -json"
+func (ck *fsckObj) printJSON() {
+	res := fsckResult{
+		Corrupt:      ck.corruptList,
+		Skipped:      ck.skippedList,
+		CorruptCount: len(ck.corruptList),
+		SkippedCount: len(ck.skippedList),
+	}
+	if res.CorruptCount > 0 || res.SkippedCount > 0 {
+		res.ExitStatus = exitcodes.FsckErrors
+	}
+	// Print empty lists as [], not null
+	if res.Corrupt == nil {
+		res.Corrupt = []fsckCorruption{}
+	}
+	if res.Skipped == nil {
+		res.Skipped = []string{}
+	}
+	printJSON(res)
+}
+
 type sortableDirEntries []fuse.DirEntry
 
 func (s sortableDirEntries) Len() int {
@@ -105,7 +105,16 @@ func main() {
 
 func dumpMasterKey(fn string) {
 	tlog.Info.Enabled = false
-	pw := readpassword.Once(nil, nil, "")
+	cf, err := configfile.Load(fn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exitcodes.Exit(err)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		fmt.Fprintln(os.Stderr, "Filesystems that use FIDO2 keys are not supported, use gocryptfs -passwd -masterkey to remove them")
+		os.Exit(exitcodes.FIDO2)
+	}
+	pw := readpassword.Once(nil, nil, -1, "")
 	masterkey, _, err := configfile.LoadAndDecrypt(fn, pw)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -134,10 +143,16 @@ func inspectCiphertext(fd *os.File, aessiv bool) {
 		errExit(err)
 	}
 	prettyPrintHeader(header, aessiv)
+	// Files on "BlockCRC" filesystems have a CRC32C at the end of each block
+	blockCRC := header.Version == contentenc.BlockCRCVersion
+	bs := int64(blockSize)
+	if blockCRC {
+		bs = int64(contentenc.BlockCRCCipherBS(contentenc.DefaultBS))
+	}
 	var i int64
-	buf := make([]byte, blockSize)
+	buf := make([]byte, bs)
 	for i = 0; ; i++ {
-		off := contentenc.HeaderLen + i*blockSize
+		off := contentenc.HeaderLen + i*bs
 		n, err := fd.ReadAt(buf, off)
 		if err != nil && err != io.EOF {
 			errExit(err)
@@ -146,17 +161,30 @@ func inspectCiphertext(fd *os.File, aessiv bool) {
 			break
 		}
 		// A block contains at least the IV, the Auth Tag and 1 data byte
-		if n < ivLen+authTagLen+1 {
+		minLen := ivLen + authTagLen + 1
+		if blockCRC {
+			minLen += contentenc.BlockCRCLen
+		}
+		if n < minLen {
 			errExit(fmt.Errorf("corrupt block: truncated data, len=%d", n))
 		}
 		data := buf[:n]
+		crc := ""
+		if blockCRC {
+			if contentenc.CheckBlockCRC(data) {
+				crc = ", CRC: ok"
+			} else {
+				crc = ", CRC: BAD"
+			}
+			data = data[:len(data)-contentenc.BlockCRCLen]
+		}
 		// Parse block data
 		iv := data[:ivLen]
 		tag := data[len(data)-authTagLen:]
 		if aessiv {
 			tag = data[ivLen : ivLen+authTagLen]
 		}
-		fmt.Printf("Block %2d: IV: %s, Tag: %s, Offset: %5d Len: %d\n",
-			i, hex.EncodeToString(iv), hex.EncodeToString(tag), off, len(data))
+		fmt.Printf("Block %2d: IV: %s, Tag: %s, Offset: %5d Len: %d%s\n",
+			i, hex.EncodeToString(iv), hex.EncodeToString(tag), off, n, crc)
 	}
 }
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
 	"strings"
 
@@ -13,10 +15,31 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
+// infoJSON is the output of "-info -json". It contains the same fields as
+// the human-readable output.
+type infoJSON struct {
+	Creator      string
+	FeatureFlags []string
+	LongNameMax  int `json:",omitempty"`
+	// EncryptedKeyLen is the length of the encrypted master key in bytes
+	EncryptedKeyLen int
+	Scrypt          struct {
+		SaltLen, N, R, P, KeyLen int
+	}
+	// FIDO2 lists the start of the credential ID of every FIDO2 slot, in hex
+	FIDO2 []string `json:",omitempty"`
+	// ReverseCompatible tells if a reverse mount with this config produces
+	// ciphertext that a forward mount can decrypt. If not,
+	// ReverseMismatches lists the reasons.
+	ReverseCompatible bool
+	ReverseMismatches []configfile.ReverseMismatch `json:",omitempty"`
+}
+
 // info pretty-prints the contents of the config file at "filename" for human
-// consumption, stripping out sensitive data.
+// consumption, stripping out sensitive data. With "jsonOut", the same data is
+// printed as a JSON object.
 // This is called when you pass the "-info" option.
-func info(filename string) {
+func info(filename string, jsonOut bool) {
 	// Read from disk
 	js, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -34,11 +57,56 @@ func info(filename string) {
 		tlog.Fatal.Printf("Unsupported on-disk format %d", cf.Version)
 		os.Exit(exitcodes.LoadConf)
 	}
-	// Pretty-print
-	fmt.Printf("Creator:      %s\n", cf.Creator)
-	fmt.Printf("FeatureFlags: %s\n", strings.Join(cf.FeatureFlags, " "))
-	fmt.Printf("EncryptedKey: %dB\n", len(cf.EncryptedKey))
+	var out infoJSON
+	out.Creator = cf.Creator
+	out.FeatureFlags = cf.FeatureFlags
+	out.LongNameMax = cf.LongNameMax
+	out.EncryptedKeyLen = len(cf.EncryptedKey)
 	s := cf.ScryptObject
+	out.Scrypt.SaltLen, out.Scrypt.N, out.Scrypt.R, out.Scrypt.P, out.Scrypt.KeyLen =
+		len(s.Salt), s.N, s.R, s.P, s.KeyLen
+	for _, slot := range cf.FIDO2 {
+		id := slot.CredentialID
+		if len(id) > 8 {
+			id = id[:8]
+		}
+		out.FIDO2 = append(out.FIDO2, hex.EncodeToString(id))
+	}
+	// Can a reverse mount with this config produce ciphertext that a forward
+	// mount can decrypt?
+	out.ReverseMismatches = cf.ReverseMismatches()
+	out.ReverseCompatible = len(out.ReverseMismatches) == 0
+	if jsonOut {
+		printJSON(out)
+		return
+	}
+	// Pretty-print
+	fmt.Printf("Creator:      %s\n", out.Creator)
+	fmt.Printf("FeatureFlags: %s\n", strings.Join(out.FeatureFlags, " "))
+	if out.LongNameMax != 0 {
+		fmt.Printf("LongNameMax:  %d\n", out.LongNameMax)
+	}
+	fmt.Printf("EncryptedKey: %dB\n", out.EncryptedKeyLen)
 	fmt.Printf("ScryptObject: Salt=%dB N=%d R=%d P=%d KeyLen=%d\n",
-		len(s.Salt), s.N, s.R, s.P, s.KeyLen)
+		out.Scrypt.SaltLen, out.Scrypt.N, out.Scrypt.R, out.Scrypt.P, out.Scrypt.KeyLen)
+	for i, id := range out.FIDO2 {
+		fmt.Printf("FIDO2:        slot %d credential %s\n", i, id)
+	}
+	if out.ReverseCompatible {
+		fmt.Printf("ReverseMode:  compatible\n")
+		return
+	}
+	fmt.Printf("ReverseMode:  incompatible\n")
+	for _, m := range out.ReverseMismatches {
+		fmt.Printf("  %s\n", m)
+	}
+}
+
+// printJSON prints "v" as indented JSON to stdout. Used by "-json".
+func printJSON(v interface{}) {
+	out, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		log.Panicf("printJSON: %v", err)
+	}
+	fmt.Println(string(out))
 }
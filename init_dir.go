@@ -10,6 +10,7 @@ import (
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/readpassword"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
@@ -33,6 +34,55 @@ func isEmptyDir(dir string) error {
 	return fmt.Errorf("directory %s not empty", dir)
 }
 
+// isInitDir checks that CIPHERDIR is empty for "-init", apart from the files
+// that "-init" creates itself. A concurrent "-init" of the same directory
+// may already have created them. Then we fail with EEXIST when creating the
+// config file, which is clearer than "not empty".
+func isInitDir(args *argContainer) error {
+	err := isDir(args.cipherdir)
+	if err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(args.cipherdir)
+	if err != nil {
+		return err
+	}
+	dirivName := args.dirivName
+	if dirivName == "" {
+		dirivName = nametransform.DirIVFilename
+	}
+	for _, e := range entries {
+		if (e.Name() == configfile.ConfDefaultName && !args._configCustom) || e.Name() == dirivName {
+			continue
+		}
+		if e.Name() == configfile.ConfDefaultName+".tmp" && !args._configCustom {
+			// Left behind by a crashed "-init". Let configfile.Create
+			// fail with an explanation.
+			continue
+		}
+		return fmt.Errorf("directory %s not empty", args.cipherdir)
+	}
+	return nil
+}
+
+// initWriteConfFailed exits after configfile.Create has failed with "err".
+// EEXIST means that another "-init" has won the race for the config file,
+// or is still writing its temporary file.
+func initWriteConfFailed(args *argContainer, err error) {
+	if os.IsExist(err) {
+		if pe, ok := err.(*os.PathError); ok && pe.Path != args.config {
+			tlog.Fatal.Printf("%q already exists. Another gocryptfs -init of the same directory may be running, "+
+				"or a previous one crashed, in which case %q can be deleted", pe.Path, pe.Path)
+			os.Exit(exitcodes.Init)
+		}
+		tlog.Fatal.Printf("Config file %q already exists. Another gocryptfs -init of the same directory may have been faster",
+			args.config)
+		os.Exit(exitcodes.Init)
+	}
+	tlog.Fatal.Println(err)
+	os.Exit(exitcodes.WriteConf)
+}
+
 // isDir checks if "dir" exists and is a directory.
 func isDir(dir string) error {
 	fi, err := os.Stat(dir)
@@ -48,11 +98,38 @@ func isDir(dir string) error {
 // initDir handles "gocryptfs -init". It prepares a directory for use as a
 // gocryptfs storage directory.
 // In forward mode, this means creating the gocryptfs.conf and gocryptfs.diriv
-// files in an empty directory.
+// (or "-diriv-name") files in an empty directory.
 // In reverse mode, we create .gocryptfs.reverse.conf and the directory does
 // not need to be empty.
 func initDir(args *argContainer) {
 	var err error
+	if args.flat && (args.plaintextnames || args.reverse) {
+		tlog.Fatal.Printf("-flat is not supported together with -plaintextnames or -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.dirivXattr && (args.plaintextnames || args.flat || args.reverse) {
+		tlog.Fatal.Printf("-diriv-xattr is not supported together with -plaintextnames, -flat or -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.exactSize && args.reverse {
+		tlog.Fatal.Printf("-exact-size is not supported together with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.longSymlinks && (args.plaintextnames || args.reverse) {
+		tlog.Fatal.Printf("-long-symlinks is not supported together with -plaintextnames or -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.dirivName != "" {
+		if args.plaintextnames || args.flat || args.dirivXattr {
+			tlog.Fatal.Printf("-diriv-name is not supported together with -plaintextnames, -flat or -diriv-xattr")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.dirivName == fusefrontend.TrashDirName || args.dirivName == fusefrontend.LongLinkDirName ||
+			args.dirivName == fusefrontend.JournalDirName {
+			tlog.Fatal.Printf("-diriv-name: %q is reserved", args.dirivName)
+			os.Exit(exitcodes.Usage)
+		}
+	}
 	if args.reverse {
 		_, err = os.Stat(args.config)
 		if err == nil {
@@ -60,24 +137,85 @@ func initDir(args *argContainer) {
 			os.Exit(exitcodes.Init)
 		}
 	} else {
-		err = isEmptyDir(args.cipherdir)
+		err = isInitDir(args)
 		if err != nil {
 			tlog.Fatal.Printf("Invalid cipherdir: %v", err)
 			os.Exit(exitcodes.Init)
 		}
 	}
-	// Choose password for config file
-	if args.extpass.Empty() {
-		tlog.Info.Printf("Choose a password for protecting your files.")
+	if args.dirivXattr {
+		// Store the root DirIV first so that we fail before writing the
+		// config file if the backing filesystem has no xattr support
+		dirfd, err := syscall.Open(args.cipherdir, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+		if err == nil {
+			err = nametransform.WriteDirIVXattrAt(dirfd)
+			syscall.Close(dirfd)
+		}
+		if err == syscall.EEXIST {
+			tlog.Fatal.Printf("-diriv-xattr: %q already has a directory IV. Is another gocryptfs -init running?",
+				args.cipherdir)
+			os.Exit(exitcodes.Init)
+		}
+		if err != nil {
+			tlog.Fatal.Printf("-diriv-xattr: cannot store the directory IV in an xattr of %q: %v",
+				args.cipherdir, err)
+			os.Exit(exitcodes.Init)
+		}
 	}
-	{
-		password := readpassword.Twice([]string(args.extpass), []string(args.passfile))
-		creator := tlog.ProgramName + " " + GitVersion
-		err = configfile.Create(args.config, password, args.plaintextnames,
-			args.scryptn, creator, args.aessiv, args.devrandom)
+	creator := tlog.ProgramName + " " + GitVersion
+	if args.zerokey {
+		// "-zerokey": all-zero master key, no password
+		printZerokeyWarning()
+		err = configfile.CreateZeroKey(&configfile.CreateArgs{
+			Filename:       args.config,
+			PlaintextNames: args.plaintextnames,
+			LogN:           args.scryptn,
+			Creator:        creator,
+			AESSIV:         args.aessiv,
+			Flat:           args.flat,
+			BlockCRC:       args.blockcrc,
+			ExactSize:      args.exactSize,
+			LongSymlinks:   args.longSymlinks,
+			LongNameMax:    args.maxNameLength,
+			DirIVXattr:     args.dirivXattr,
+			DirIVName:      args.dirivName,
+		})
 		if err != nil {
-			tlog.Fatal.Println(err)
-			os.Exit(exitcodes.WriteConf)
+			initWriteConfFailed(args, err)
+		}
+	} else {
+		// Choose password for config file
+		if args.extpass.Empty() {
+			tlog.Info.Printf("Choose a password for protecting your files.")
+		}
+		password := readpassword.Twice([]string(args.extpass), []string(args.passfile), args.passfd)
+		var fido2Slots []configfile.FIDO2Slot
+		if len(args.fido2) != 0 {
+			password, fido2Slots, err = initFIDO2(args, password)
+			if err != nil {
+				tlog.Fatal.Println(err)
+				exitcodes.Exit(err)
+			}
+		}
+		err = configfile.Create(&configfile.CreateArgs{
+			Filename:       args.config,
+			Password:       password,
+			PlaintextNames: args.plaintextnames,
+			LogN:           args.scryptn,
+			Creator:        creator,
+			AESSIV:         args.aessiv,
+			Devrandom:      args.devrandom,
+			Flat:           args.flat,
+			BlockCRC:       args.blockcrc,
+			ExactSize:      args.exactSize,
+			LongSymlinks:   args.longSymlinks,
+			LongNameMax:    args.maxNameLength,
+			DirIVXattr:     args.dirivXattr,
+			DirIVName:      args.dirivName,
+			FIDO2:          fido2Slots,
+		})
+		if err != nil {
+			initWriteConfFailed(args, err)
 		}
 		for i := range password {
 			password[i] = 0
@@ -85,12 +223,17 @@ func initDir(args *argContainer) {
 		// password runs out of scope here
 	}
 	// Forward mode with filename encryption enabled needs a gocryptfs.diriv file
-	// in the root dir
-	if !args.plaintextnames && !args.reverse {
+	// in the root dir, unless the filesystem is flat or stores the DirIVs in
+	// xattrs
+	if !args.plaintextnames && !args.reverse && !args.flat && !args.dirivXattr {
 		// Open cipherdir (following symlinks)
 		dirfd, err := syscall.Open(args.cipherdir, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
 		if err == nil {
-			err = nametransform.WriteDirIVAt(dirfd)
+			dirivName := args.dirivName
+			if dirivName == "" {
+				dirivName = nametransform.DirIVFilename
+			}
+			err = nametransform.WriteDirIVNameAt(dirfd, dirivName)
 			syscall.Close(dirfd)
 		}
 		if err != nil {
@@ -104,6 +247,16 @@ func initDir(args *argContainer) {
 		mountArgs = " -reverse"
 		fsName = "gocryptfs-reverse"
 	}
+	if args.zerokey {
+		mountArgs += " -zerokey"
+	}
+	if args._configCustom {
+		config := args.config
+		if strings.Contains(config, " ") {
+			config = "\"" + config + "\""
+		}
+		mountArgs += " -config " + config
+	}
 	tlog.Info.Printf(tlog.ColorGreen+"The %s filesystem has been created successfully."+tlog.ColorReset,
 		fsName)
 	wd, _ := os.Getwd()
@@ -8,11 +8,14 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"path/filepath"
 	"syscall"
 
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/mlock"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 import "os"
@@ -26,8 +29,17 @@ const (
 	// the config file gets stored next to the plain-text files. Make it hidden
 	// (start with dot) to not annoy the user.
 	ConfReverseName = ".gocryptfs.reverse.conf"
+	// ConfBackupSuffix is appended to the config file name to get the
+	// name of the backup of the previous version that WriteFile makes.
+	ConfBackupSuffix = ".bak"
 )
 
+// IsConfName returns true if "name" is the name of the config file or its
+// backup in the root directory of a forward-mode CIPHERDIR.
+func IsConfName(name string) bool {
+	return name == ConfDefaultName || name == ConfDefaultName+ConfBackupSuffix
+}
+
 // ConfFile is the content of a config file.
 type ConfFile struct {
 	// Creator is the gocryptfs version string.
@@ -46,6 +58,15 @@ type ConfFile struct {
 	// mounting. This mechanism is analogous to the ext4 feature flags that are
 	// stored in the superblock.
 	FeatureFlags []string
+	// LongNameMax is the length above which encrypted names are hashed to
+	// long names. Only set together with the LongNameMax feature flag.
+	LongNameMax int `json:",omitempty"`
+	// DirIVName is the name of the per-directory IV files. Only set together
+	// with the DirIVName feature flag.
+	DirIVName string `json:",omitempty"`
+	// FIDO2 are the key slots of the FIDO2 second factor, one per hardware
+	// key. Only set together with the FIDO2 feature flag.
+	FIDO2 []FIDO2Slot `json:",omitempty"`
 	// Filename is the name of the config file. Not exported to JSON.
 	filename string
 }
@@ -65,50 +86,116 @@ func randBytesDevRandom(n int) []byte {
 	return b
 }
 
+// CreateArgs exists because the argument list of Create became too long.
+type CreateArgs struct {
+	// Filename is the path of the new config file, which must not exist yet
+	Filename string
+	// Password encrypts the master key. If FIDO2 is not empty, it must
+	// already be combined with the FIDO2 secret the slots hold.
+	Password       []byte
+	PlaintextNames bool
+	// LogN is the scrypt cost parameter
+	LogN    int
+	Creator string
+	AESSIV  bool
+	// Devrandom gets the master key from /dev/random
+	Devrandom bool
+	Flat      bool
+	BlockCRC  bool
+	ExactSize bool
+	// LongSymlinks is ignored for PlaintextNames
+	LongSymlinks bool
+	// LongNameMax = 0 means the default of 255 bytes
+	LongNameMax int
+	// DirIVXattr is ignored for PlaintextNames and Flat
+	DirIVXattr bool
+	// DirIVName = "" means the default gocryptfs.diriv. It is ignored when
+	// there are no gocryptfs.diriv files.
+	DirIVName string
+	FIDO2     []FIDO2Slot
+}
+
 // Create - create a new config with a random key encrypted with
-// "password" and write it to "filename".
-// Uses scrypt with cost parameter logN.
-func Create(filename string, password []byte, plaintextNames bool,
-	logN int, creator string, aessiv bool, devrandom bool) error {
+// args.Password and write it to args.Filename.
+func Create(args *CreateArgs) error {
+	// Generate new random master key
+	var key []byte
+	if args.Devrandom {
+		key = randBytesDevRandom(cryptocore.KeyLen)
+	} else {
+		key = cryptocore.RandBytes(cryptocore.KeyLen)
+	}
+	tlog.PrintMasterkeyReminder(key)
+	err := create(args, key, args.Password, args.FIDO2)
+	for i := range key {
+		key[i] = 0
+	}
+	// key runs out of scope here
+	return err
+}
+
+// CreateZeroKey - create a new config for "-zerokey": the master key is all
+// zeros and is encrypted with an empty password. IsZeroKey recognizes such
+// config files. args.Password, args.Devrandom and args.FIDO2 are ignored.
+func CreateZeroKey(args *CreateArgs) error {
+	return create(args, make([]byte, cryptocore.KeyLen), nil, nil)
+}
+
+// create - create a new config with "key" encrypted with "password" and
+// write it to args.Filename.
+func create(args *CreateArgs, key []byte, password []byte, fido2 []FIDO2Slot) error {
 	var cf ConfFile
-	cf.filename = filename
-	cf.Creator = creator
+	cf.filename = args.Filename
+	cf.Creator = args.Creator
 	cf.Version = contentenc.CurrentVersion
 
 	// Set feature flags
 	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagGCMIV128])
 	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagHKDF])
-	if plaintextNames {
+	if args.PlaintextNames {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagPlaintextNames])
 	} else {
-		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagDirIV])
+		if args.Flat {
+			cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagFlat])
+		} else {
+			cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagDirIV])
+			if args.DirIVXattr {
+				cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagDirIVXattr])
+			} else if args.DirIVName != "" && args.DirIVName != nametransform.DirIVFilename {
+				cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagDirIVName])
+				cf.DirIVName = args.DirIVName
+			}
+		}
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagEMENames])
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagLongNames])
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagRaw64])
+		if args.LongNameMax != 0 && args.LongNameMax != nametransform.NameMax {
+			cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagLongNameMax])
+			cf.LongNameMax = args.LongNameMax
+		}
+		if args.LongSymlinks {
+			cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagLongSymlinks])
+		}
 	}
-	if aessiv {
+	if args.AESSIV {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagAESSIV])
 	}
-	{
-		// Generate new random master key
-		var key []byte
-		if devrandom {
-			key = randBytesDevRandom(cryptocore.KeyLen)
-		} else {
-			key = cryptocore.RandBytes(cryptocore.KeyLen)
-		}
-		tlog.PrintMasterkeyReminder(key)
-		// Encrypt it using the password
-		// This sets ScryptObject and EncryptedKey
-		// Note: this looks at the FeatureFlags, so call it AFTER setting them.
-		cf.EncryptKey(key, password, logN)
-		for i := range key {
-			key[i] = 0
-		}
-		// key runs out of scope here
+	if args.BlockCRC {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagBlockCRC])
+	}
+	if args.ExactSize {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagExactSize])
 	}
+	if len(fido2) != 0 {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagFIDO2])
+		cf.FIDO2 = fido2
+	}
+	// Encrypt the key using the password
+	// This sets ScryptObject and EncryptedKey
+	// Note: this looks at the FeatureFlags, so call it AFTER setting them.
+	cf.EncryptKey(key, password, args.LogN)
 	// Write file to disk
-	return cf.WriteFile()
+	return cf.createFile()
 }
 
 // LoadAndDecrypt - read config file from disk and decrypt the
@@ -175,9 +262,57 @@ func Load(filename string) (*ConfFile, error) {
 	var requiredFlags []flagIota
 	if cf.IsFeatureFlagSet(FlagPlaintextNames) {
 		requiredFlags = requiredFlagsPlaintextNames
+	} else if cf.IsFeatureFlagSet(FlagFlat) {
+		if cf.IsFeatureFlagSet(FlagDirIV) {
+			return nil, fmt.Errorf("Feature flags %q and %q are mutually exclusive",
+				knownFlags[FlagFlat], knownFlags[FlagDirIV])
+		}
+		requiredFlags = requiredFlagsFlat
 	} else {
 		requiredFlags = requiredFlagsNormal
 	}
+	if cf.IsFeatureFlagSet(FlagDirIVXattr) && !cf.IsFeatureFlagSet(FlagDirIV) {
+		return nil, fmt.Errorf("Feature flag %q requires %q",
+			knownFlags[FlagDirIVXattr], knownFlags[FlagDirIV])
+	}
+	if cf.IsFeatureFlagSet(FlagDirIVName) {
+		if !cf.IsFeatureFlagSet(FlagDirIV) || cf.IsFeatureFlagSet(FlagDirIVXattr) {
+			return nil, fmt.Errorf("Feature flag %q requires %q and excludes %q",
+				knownFlags[FlagDirIVName], knownFlags[FlagDirIV], knownFlags[FlagDirIVXattr])
+		}
+		if err = nametransform.CheckDirIVName(cf.DirIVName); err != nil {
+			return nil, fmt.Errorf("DirIVName: %v", err)
+		}
+	} else if cf.DirIVName != "" {
+		return nil, fmt.Errorf("DirIVName is set, but feature flag %q is missing",
+			knownFlags[FlagDirIVName])
+	}
+	if cf.IsFeatureFlagSet(FlagLongNameMax) {
+		if !cf.IsFeatureFlagSet(FlagLongNames) {
+			return nil, fmt.Errorf("Feature flag %q requires %q",
+				knownFlags[FlagLongNameMax], knownFlags[FlagLongNames])
+		}
+		if cf.LongNameMax < nametransform.MinLongNameMax || cf.LongNameMax > nametransform.NameMax {
+			return nil, fmt.Errorf("LongNameMax=%d is out of range %d...%d", cf.LongNameMax,
+				nametransform.MinLongNameMax, nametransform.NameMax)
+		}
+	} else if cf.LongNameMax != 0 {
+		return nil, fmt.Errorf("LongNameMax is set, but feature flag %q is missing",
+			knownFlags[FlagLongNameMax])
+	}
+	if cf.IsFeatureFlagSet(FlagFIDO2) {
+		if len(cf.FIDO2) == 0 {
+			return nil, fmt.Errorf("Feature flag %q requires at least one FIDO2 slot",
+				knownFlags[FlagFIDO2])
+		}
+		for i, s := range cf.FIDO2 {
+			if len(s.CredentialID) == 0 || len(s.HMACSalt) == 0 || len(s.EncryptedSecret) == 0 {
+				return nil, fmt.Errorf("FIDO2 slot %d is incomplete", i)
+			}
+		}
+	} else if len(cf.FIDO2) != 0 {
+		return nil, fmt.Errorf("FIDO2 is set, but feature flag %q is missing", knownFlags[FlagFIDO2])
+	}
 	deprecatedFs := false
 	for _, i := range requiredFlags {
 		if !cf.IsFeatureFlagSet(i) {
@@ -230,9 +365,31 @@ func (cf *ConfFile) DecryptMasterKey(password []byte) (masterkey []byte, err err
 		tlog.Warn.Printf("failed to unlock master key: %s", err.Error())
 		return nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
 	}
+	mlock.Lock(masterkey)
 	return masterkey, nil
 }
 
+// IsZeroKey returns true if the config file has been created with
+// "-zerokey", that is, if the empty password decrypts the master key and
+// the master key is all zeros.
+func (cf *ConfFile) IsZeroKey() bool {
+	scryptHash := cf.ScryptObject.DeriveKey(nil)
+	ce := getKeyEncrypter(scryptHash, cf.IsFeatureFlagSet(FlagHKDF))
+	tlog.Warn.Enabled = false // Silence DecryptBlock() error messages
+	key, err := ce.DecryptBlock(cf.EncryptedKey, 0, nil)
+	tlog.Warn.Enabled = true
+	ce.Wipe()
+	if err != nil {
+		return false
+	}
+	for _, b := range key {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 // EncryptKey - encrypt "key" using an scrypt hash generated from "password"
 // and store it in cf.EncryptedKey.
 // Uses scrypt with cost parameter logN and stores the scrypt parameters in
@@ -258,22 +415,106 @@ func (cf *ConfFile) EncryptKey(key []byte, password []byte, logN int) {
 
 // WriteFile - write out config in JSON format to file "filename.tmp"
 // then rename over "filename".
-// This way a password change atomically replaces the file.
+// This way a password change atomically replaces the file. The previous
+// version of the file is kept as "filename.bak" for manual recovery,
+// replacing an older backup.
+//
+// The steps are ordered so that a crash at any point leaves at least one
+// valid config file behind.
 func (cf *ConfFile) WriteFile() error {
+	return cf.writeFile(false)
+}
+
+// WriteFileKeepBackup is like WriteFile, but never replaces an existing
+// "filename.bak", as it may be the only copy of a config that still works.
+// Fails if the backup cannot be created.
+func (cf *ConfFile) WriteFileKeepBackup() error {
+	return cf.writeFile(true)
+}
+
+func (cf *ConfFile) writeFile(keepBackup bool) error {
+	tmp := cf.filename + ".tmp"
+	err := cf.writeNew(tmp)
+	if os.IsExist(err) {
+		return fmt.Errorf("%v. Another gocryptfs process may be writing the config, "+
+			"or a previous one crashed, in which case %q can be deleted", err, tmp)
+	}
+	if err != nil {
+		return err
+	}
+	writeFileHook("tmp")
+	bak := cf.filename + ConfBackupSuffix
+	err = cf.backup(!keepBackup)
+	if err != nil {
+		if keepBackup {
+			os.Remove(tmp)
+			if os.IsExist(err) {
+				return fmt.Errorf("backup %q already exists. It may be the only copy of a working config, "+
+					"move it somewhere else first", bak)
+			}
+			return fmt.Errorf("could not create backup %q: %v", bak, err)
+		}
+		tlog.Warn.Printf("Warning: could not create backup %q: %v", bak, err)
+	}
+	writeFileHook("backup")
+	err = os.Rename(tmp, cf.filename)
+	if err != nil {
+		return err
+	}
+	writeFileHook("rename")
+	// Persist the rename
+	syncDir(filepath.Dir(cf.filename))
+	return nil
+}
+
+// createFile writes the config of a new filesystem to "filename". Unlike
+// WriteFile, it fails with EEXIST if the file already exists, so that only
+// one of several concurrent "gocryptfs -init" runs can succeed.
+//
+// The config is written to "filename.tmp" first and then hardlinked into
+// place, so that a crash never leaves a truncated config file behind.
+// A concurrent "-init" can also make the creation of "filename.tmp" fail
+// with EEXIST. That error is returned unwrapped, so that os.IsExist works.
+func (cf *ConfFile) createFile() error {
 	tmp := cf.filename + ".tmp"
+	err := cf.writeNew(tmp)
+	if err != nil {
+		return err
+	}
+	writeFileHook("tmp")
+	// Unlike rename(2), link(2) fails with EEXIST if the config file exists
+	err = os.Link(tmp, cf.filename)
+	os.Remove(tmp)
+	if err != nil {
+		return err
+	}
+	writeFileHook("link")
+	// Persist the link
+	syncDir(filepath.Dir(cf.filename))
+	return nil
+}
+
+// writeNew writes the config in JSON format to "path", which is created
+// with O_EXCL. On failure, the file is removed again, unless it already
+// existed.
+func (cf *ConfFile) writeNew(path string) error {
 	// 0400 permissions: gocryptfs.conf should be kept secret and never be written to.
-	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
 	if err != nil {
 		return err
 	}
 	js, err := json.MarshalIndent(cf, "", "\t")
 	if err != nil {
+		fd.Close()
+		os.Remove(path)
 		return err
 	}
 	// For convenience for the user, add a newline at the end.
 	js = append(js, '\n')
 	_, err = fd.Write(js)
 	if err != nil {
+		fd.Close()
+		os.Remove(path)
 		return err
 	}
 	err = fd.Sync()
@@ -286,12 +527,56 @@ func (cf *ConfFile) WriteFile() error {
 	}
 	err = fd.Close()
 	if err != nil {
+		os.Remove(path)
 		return err
 	}
-	err = os.Rename(tmp, cf.filename)
+	return nil
+}
+
+// writeFileHook is called by WriteFile and createFile after each step. Used
+// by the tests to simulate a crash.
+var writeFileHook = func(step string) {}
+
+// backup hardlinks the existing config file to "filename.bak". An older
+// backup is replaced if "replace" is set, otherwise backup fails with EEXIST.
+func (cf *ConfFile) backup(replace bool) error {
+	bak := cf.filename + ConfBackupSuffix
+	if _, err := os.Stat(cf.filename); os.IsNotExist(err) {
+		// Nothing to back up (-init)
+		return nil
+	}
+	if !replace {
+		return os.Link(cf.filename, bak)
+	}
+	// Link to a temporary name first so that an existing backup is
+	// replaced atomically
+	tmp := bak + ".tmp"
+	os.Remove(tmp)
+	err := os.Link(cf.filename, tmp)
+	if err == nil {
+		err = os.Rename(tmp, bak)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
 	return err
 }
 
+// syncDir fsyncs directory "dir" so that renames inside it are persisted.
+func syncDir(dir string) {
+	fd, err := os.Open(dir)
+	if err != nil {
+		tlog.Warn.Printf("Warning: syncDir: %v", err)
+		return
+	}
+	defer fd.Close()
+	err = fd.Sync()
+	if err != nil {
+		tlog.Warn.Printf("Warning: syncDir: fsync failed: %v", err)
+		syscall.Sync()
+	}
+}
+
 // getKeyEncrypter is a helper function that returns the right ContentEnc
 // instance for the "useHKDF" setting.
 func getKeyEncrypter(scryptHash []byte, useHKDF bool) *contentenc.ContentEnc {
@@ -302,6 +587,6 @@ func getKeyEncrypter(scryptHash []byte, useHKDF bool) *contentenc.ContentEnc {
 		IVLen = contentenc.DefaultIVBits
 	}
 	cc := cryptocore.New(scryptHash, cryptocore.BackendGoGCM, IVLen, useHKDF, false)
-	ce := contentenc.New(cc, 4096, false)
+	ce := contentenc.New(cc, 4096, false, false)
 	return ce
 }
@@ -1,15 +1,28 @@
 package configfile
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
 var testPw = []byte("test")
 
+// newTmpConf removes config_test/tmp.conf, which Create refuses to
+// overwrite, and returns its name
+func newTmpConf() string {
+	os.Remove("config_test/tmp.conf")
+	return "config_test/tmp.conf"
+}
+
 func TestLoadV1(t *testing.T) {
 	_, _, err := LoadAndDecrypt("config_test/v1.conf", testPw)
 	if err == nil {
@@ -62,7 +75,12 @@ func TestLoadV2StrangeFeature(t *testing.T) {
 }
 
 func TestCreateConfDefault(t *testing.T) {
-	err := Create("config_test/tmp.conf", testPw, false, 10, "test", false, false)
+	err := Create(&CreateArgs{
+		Filename: newTmpConf(),
+		Password: testPw,
+		LogN:     10,
+		Creator:  "test",
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -80,17 +98,39 @@ func TestCreateConfDefault(t *testing.T) {
 			t.Errorf("Feature flag %q should be set but is not", knownFlags[f])
 		}
 	}
+	// An existing config file is not overwritten
+	err = Create(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: testPw,
+		LogN:     10,
+		Creator:  "test",
+	})
+	if !os.IsExist(err) {
+		t.Errorf("want EEXIST, got %v", err)
+	}
 }
 
 func TestCreateConfDevRandom(t *testing.T) {
-	err := Create("config_test/tmp.conf", testPw, false, 10, "test", false, true)
+	err := Create(&CreateArgs{
+		Filename:  newTmpConf(),
+		Password:  testPw,
+		LogN:      10,
+		Creator:   "test",
+		Devrandom: true,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestCreateConfPlaintextnames(t *testing.T) {
-	err := Create("config_test/tmp.conf", testPw, true, 10, "test", false, false)
+	err := Create(&CreateArgs{
+		Filename:       newTmpConf(),
+		Password:       testPw,
+		PlaintextNames: true,
+		LogN:           10,
+		Creator:        "test",
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -109,9 +149,49 @@ func TestCreateConfPlaintextnames(t *testing.T) {
 	}
 }
 
+func TestCreateConfZeroKey(t *testing.T) {
+	err := CreateZeroKey(&CreateArgs{
+		Filename: newTmpConf(),
+		LogN:     10,
+		Creator:  "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Load("config_test/tmp.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsZeroKey() {
+		t.Error("config created with CreateZeroKey should be recognized")
+	}
+	err = Create(&CreateArgs{
+		Filename: newTmpConf(),
+		Password: testPw,
+		LogN:     10,
+		Creator:  "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = Load("config_test/tmp.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.IsZeroKey() {
+		t.Error("config created with Create should not be recognized")
+	}
+}
+
 // Reverse mode uses AESSIV
 func TestCreateConfFileAESSIV(t *testing.T) {
-	err := Create("config_test/tmp.conf", testPw, false, 10, "test", true, false)
+	err := Create(&CreateArgs{
+		Filename: newTmpConf(),
+		Password: testPw,
+		LogN:     10,
+		Creator:  "test",
+		AESSIV:   true,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -145,3 +225,434 @@ func TestIsFeatureFlagKnown(t *testing.T) {
 		t.Errorf("flag %q should be NOT known", f)
 	}
 }
+
+// TestWriteFileCrash simulates a crash after each step of WriteFile during a
+// password change and checks that a config file that can be unlocked with
+// either the old or the new password always exists.
+func TestWriteFileCrash(t *testing.T) {
+	if !testing.Verbose() {
+		tlog.Warn.Enabled = false
+	}
+	defer func() { writeFileHook = func(string) {} }()
+	newPw := []byte("newpassword")
+	for _, crashStep := range []string{"tmp", "backup", "rename", ""} {
+		dir, err := ioutil.TempDir("", "TestWriteFileCrash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		fn := filepath.Join(dir, ConfDefaultName)
+		if err = Create(&CreateArgs{
+			Filename: fn,
+			Password: testPw,
+			LogN:     10,
+			Creator:  "test",
+		}); err != nil {
+			t.Fatal(err)
+		}
+		key, cf, err := LoadAndDecrypt(fn, testPw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFileHook = func(step string) {
+			if step == crashStep {
+				panic("simulated crash")
+			}
+		}
+		func() {
+			defer func() { recover() }()
+			cf.EncryptKey(key, newPw, 10)
+			cf.WriteFile()
+		}()
+		writeFileHook = func(string) {}
+		ok := false
+		for _, f := range []string{fn, fn + ConfBackupSuffix} {
+			for _, pw := range [][]byte{testPw, newPw} {
+				if _, _, err = LoadAndDecrypt(f, pw); err == nil {
+					ok = true
+				}
+			}
+		}
+		if !ok {
+			t.Errorf("crash after step %q: no usable config left", crashStep)
+		}
+		if crashStep == "" {
+			// No crash: new password in the config, old one in the backup
+			if _, _, err = LoadAndDecrypt(fn, newPw); err != nil {
+				t.Error(err)
+			}
+			if _, _, err = LoadAndDecrypt(fn+ConfBackupSuffix, testPw); err != nil {
+				t.Errorf("backup: %v", err)
+			}
+		}
+	}
+}
+
+// TestCreateFileCrash simulates a crash after each step of Create and checks
+// that the config file is either complete or does not exist at all.
+func TestCreateFileCrash(t *testing.T) {
+	defer func() { writeFileHook = func(string) {} }()
+	for _, crashStep := range []string{"tmp", "link", ""} {
+		dir, err := ioutil.TempDir("", "TestCreateFileCrash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		fn := filepath.Join(dir, ConfDefaultName)
+		writeFileHook = func(step string) {
+			if step == crashStep {
+				panic("simulated crash")
+			}
+		}
+		func() {
+			defer func() { recover() }()
+			Create(&CreateArgs{
+				Filename: fn,
+				Password: testPw,
+				LogN:     10,
+				Creator:  "test",
+			})
+		}()
+		writeFileHook = func(string) {}
+		if _, err = os.Stat(fn); os.IsNotExist(err) {
+			if crashStep != "tmp" {
+				t.Errorf("crash after step %q: config file missing", crashStep)
+			}
+			continue
+		}
+		if _, _, err = LoadAndDecrypt(fn, testPw); err != nil {
+			t.Errorf("crash after step %q: %v", crashStep, err)
+		}
+		if _, err = os.Stat(fn + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("crash after step %q: temp file should be deleted, stat returned %v", crashStep, err)
+		}
+	}
+}
+
+// TestWriteFileKeepBackup checks that WriteFileKeepBackup keeps the previous
+// version of the config, and refuses to replace an older backup.
+func TestWriteFileKeepBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestWriteFileKeepBackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, ConfDefaultName)
+	if err = Create(&CreateArgs{
+		Filename: fn,
+		Password: testPw,
+		LogN:     10,
+		Creator:  "test",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	key, cf, err := LoadAndDecrypt(fn, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.EncryptKey(key, []byte("pw2"), 10)
+	if err = cf.WriteFileKeepBackup(); err != nil {
+		t.Fatal(err)
+	}
+	cf.EncryptKey(key, []byte("pw3"), 10)
+	if err = cf.WriteFileKeepBackup(); err == nil {
+		t.Error("replacing an existing backup should fail")
+	}
+	if _, _, err = LoadAndDecrypt(fn, []byte("pw2")); err != nil {
+		t.Error(err)
+	}
+	if _, _, err = LoadAndDecrypt(fn+ConfBackupSuffix, testPw); err != nil {
+		t.Error(err)
+	}
+	if _, err = os.Stat(fn + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp file should be deleted, stat returned %v", err)
+	}
+}
+
+func TestCreateConfFlat(t *testing.T) {
+	err := Create(&CreateArgs{
+		Filename: newTmpConf(),
+		Password: testPw,
+		LogN:     10,
+		Creator:  "test",
+		Flat:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagFlat) || c.IsFeatureFlagSet(FlagDirIV) {
+		t.Errorf("wrong feature flags: %v", c.FeatureFlags)
+	}
+	// DirIV and Flat contradict each other
+	c.FeatureFlags = append(c.FeatureFlags, knownFlags[FlagDirIV])
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Load("config_test/tmp.conf"); err == nil {
+		t.Error("loading a config with both DirIV and Flat should fail")
+	}
+}
+
+func TestCreateConfDirIVXattr(t *testing.T) {
+	err := Create(&CreateArgs{
+		Filename:   newTmpConf(),
+		Password:   testPw,
+		LogN:       10,
+		Creator:    "test",
+		DirIVXattr: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagDirIVXattr) || !c.IsFeatureFlagSet(FlagDirIV) {
+		t.Errorf("wrong feature flags: %v", c.FeatureFlags)
+	}
+	// DirIVXattr without DirIV
+	c.ClearFeatureFlag(FlagDirIV)
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Load("config_test/tmp.conf"); err == nil {
+		t.Error("loading a config with DirIVXattr, but without DirIV should fail")
+	}
+	// Ignored for flat filesystems
+	err = Create(&CreateArgs{
+		Filename:   newTmpConf(),
+		Password:   testPw,
+		LogN:       10,
+		Creator:    "test",
+		Flat:       true,
+		DirIVXattr: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err = LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.IsFeatureFlagSet(FlagDirIVXattr) {
+		t.Errorf("wrong feature flags: %v", c.FeatureFlags)
+	}
+}
+
+func TestCreateConfDirIVName(t *testing.T) {
+	err := Create(&CreateArgs{
+		Filename:  newTmpConf(),
+		Password:  testPw,
+		LogN:      10,
+		Creator:   "test",
+		DirIVName: ".iv",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagDirIVName) || c.DirIVName != ".iv" {
+		t.Errorf("wrong config: flags=%v DirIVName=%q", c.FeatureFlags, c.DirIVName)
+	}
+	if len(c.ReverseMismatches()) != 2 {
+		t.Errorf("reverse mode should reject the name: %v", c.ReverseMismatches())
+	}
+	// Names that could be encrypted names are rejected
+	for _, name := range []string{"abc", "gocryptfs.longname.x", "a/b", ConfDefaultName} {
+		c.DirIVName = name
+		if err = c.WriteFile(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = Load("config_test/tmp.conf"); err == nil {
+			t.Errorf("loading a config with DirIVName=%q should fail", name)
+		}
+	}
+	// The default name is not recorded
+	err = Create(&CreateArgs{
+		Filename:  newTmpConf(),
+		Password:  testPw,
+		LogN:      10,
+		Creator:   "test",
+		DirIVName: "gocryptfs.diriv",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err = LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.IsFeatureFlagSet(FlagDirIVName) || c.DirIVName != "" {
+		t.Errorf("wrong config: flags=%v DirIVName=%q", c.FeatureFlags, c.DirIVName)
+	}
+}
+
+func TestCreateConfFIDO2(t *testing.T) {
+	hmacSecret := bytes.Repeat([]byte{1}, 32)
+	secret := bytes.Repeat([]byte{2}, FIDO2SecretLen)
+	slot, err := NewFIDO2Slot([]byte("credential"), []byte("salt"), hmacSecret, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Create(&CreateArgs{
+		Filename: newTmpConf(),
+		Password: testPw,
+		LogN:     10,
+		Creator:  "test",
+		FIDO2:    []FIDO2Slot{*slot},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagFIDO2) || len(c.FIDO2) != 1 ||
+		string(c.FIDO2[0].CredentialID) != "credential" || string(c.FIDO2[0].HMACSalt) != "salt" {
+		t.Fatalf("wrong config: flags=%v FIDO2=%v", c.FeatureFlags, c.FIDO2)
+	}
+	if got, err := c.FIDO2[0].DecryptSecret(hmacSecret); err != nil || !bytes.Equal(got, secret) {
+		t.Errorf("DecryptSecret: got %x, %v", got, err)
+	}
+	if _, err = c.FIDO2[0].DecryptSecret(bytes.Repeat([]byte{3}, 32)); err == nil {
+		t.Error("DecryptSecret with the wrong hmac-secret should fail")
+	}
+	// The flag without slots is rejected, and the other way round
+	slots := c.FIDO2
+	c.FIDO2 = nil
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Load("config_test/tmp.conf"); err == nil {
+		t.Error("loading a config with the FIDO2 flag but without FIDO2 should fail")
+	}
+	c.FIDO2 = []FIDO2Slot{{CredentialID: []byte("credential"), HMACSalt: []byte("salt")}}
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Load("config_test/tmp.conf"); err == nil {
+		t.Error("loading a config with an incomplete FIDO2 slot should fail")
+	}
+	c.FIDO2 = slots
+	c.ClearFeatureFlag(FlagFIDO2)
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Load("config_test/tmp.conf"); err == nil {
+		t.Error("loading a config with FIDO2 but without the flag should fail")
+	}
+}
+
+func TestCreateConfLongNameMax(t *testing.T) {
+	err := Create(&CreateArgs{
+		Filename:    newTmpConf(),
+		Password:    testPw,
+		LogN:        10,
+		Creator:     "test",
+		LongNameMax: 143,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(FlagLongNameMax) || c.LongNameMax != 143 {
+		t.Errorf("wrong config: flags=%v LongNameMax=%d", c.FeatureFlags, c.LongNameMax)
+	}
+	if len(c.ReverseMismatches()) != 2 {
+		t.Errorf("reverse mode should reject the threshold: %v", c.ReverseMismatches())
+	}
+	// Out of range
+	c.LongNameMax = 10
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Load("config_test/tmp.conf"); err == nil {
+		t.Error("loading a config with LongNameMax=10 should fail")
+	}
+	// The default threshold is not recorded
+	err = Create(&CreateArgs{
+		Filename:    newTmpConf(),
+		Password:    testPw,
+		LogN:        10,
+		Creator:     "test",
+		LongNameMax: 255,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, c, err = LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.IsFeatureFlagSet(FlagLongNameMax) || c.LongNameMax != 0 {
+		t.Errorf("wrong config: flags=%v LongNameMax=%d", c.FeatureFlags, c.LongNameMax)
+	}
+}
+
+func TestReverseMismatches(t *testing.T) {
+	testcases := []struct {
+		aessiv, plaintextnames, flat, exactSize, longSymlinks bool
+		// params that are expected to differ
+		want []string
+	}{
+		{false, false, false, false, false, []string{"content encryption"}},
+		{true, false, false, false, false, nil},
+		{true, true, false, false, false, nil},
+		{true, false, true, false, false, []string{"name encryption"}},
+		{false, false, true, false, false, []string{"content encryption", "name encryption"}},
+		{true, false, false, true, false, []string{"file size storage"}},
+		{true, false, false, false, true, []string{"long symlink targets"}},
+		// Ignored without encrypted names
+		{true, true, false, false, true, nil},
+	}
+	for _, tc := range testcases {
+		err := Create(&CreateArgs{
+			Filename:       newTmpConf(),
+			Password:       testPw,
+			PlaintextNames: tc.plaintextnames,
+			LogN:           10,
+			Creator:        "test",
+			AESSIV:         tc.aessiv,
+			Flat:           tc.flat,
+			ExactSize:      tc.exactSize,
+			LongSymlinks:   tc.longSymlinks,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := Load("config_test/tmp.conf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, m := range c.ReverseMismatches() {
+			got = append(got, m.Param)
+		}
+		if strings.Join(got, ",") != strings.Join(tc.want, ",") {
+			t.Errorf("%v: want mismatches %v, got %v", c.FeatureFlags, tc.want, got)
+		}
+	}
+}
+
+// TestDirIVNameConfNames checks that the config file and the files that are
+// created next to it cannot be used as DirIV name.
+func TestDirIVNameConfNames(t *testing.T) {
+	for _, n := range []string{ConfDefaultName, ConfDefaultName + ConfBackupSuffix,
+		ConfDefaultName + ".tmp", ConfDefaultName + ConfBackupSuffix + ".tmp", ConfReverseName} {
+		if err := nametransform.CheckDirIVName(n); err == nil {
+			t.Errorf("%q should be rejected", n)
+		}
+	}
+}
@@ -25,6 +25,37 @@ const (
 	// Note that this flag does not change the password hashing algorithm
 	// which always is scrypt.
 	FlagHKDF
+	// FlagFlat disables the per-directory IV files. All file names are
+	// encrypted with the same fixed IV instead.
+	FlagFlat
+	// FlagNamesMigration is set while "-migrate-names" encrypts the file
+	// names of a PlaintextNames filesystem. The filesystem must not be
+	// mounted until the migration has finished. Versions of gocryptfs that
+	// do not know the flag refuse to load the config file.
+	FlagNamesMigration
+	// FlagBlockCRC appends a CRC32C to each file content block, so that bit
+	// rot can be detected without the key. Files have header version 3.
+	FlagBlockCRC
+	// FlagLongNameMax means that encrypted names are hashed to long names
+	// above the length stored in ConfFile.LongNameMax instead of 255 bytes.
+	FlagLongNameMax
+	// FlagDirIVXattr means that the per-directory IVs are stored in an xattr
+	// of each directory instead of a gocryptfs.diriv file. Requires FlagDirIV.
+	FlagDirIVXattr
+	// FlagDirIVName means that the gocryptfs.diriv files have the name
+	// stored in ConfFile.DirIVName. Requires FlagDirIV.
+	FlagDirIVName
+	// FlagFIDO2 means that unlocking the master key needs a FIDO2 key that
+	// matches one of the slots in ConfFile.FIDO2 in addition to the password.
+	FlagFIDO2
+	// FlagExactSize means that the plaintext size of each regular file is
+	// stored in an encrypted xattr, so that truncated or extended backing
+	// files are detected.
+	FlagExactSize
+	// FlagLongSymlinks means that encrypted symlink targets that are too
+	// long for the backing filesystem are stored in a file in
+	// "gocryptfs.longlinks", and the symlink points to that file.
+	FlagLongSymlinks
 )
 
 // knownFlags stores the known feature flags and their string representation
@@ -37,6 +68,15 @@ var knownFlags = map[flagIota]string{
 	FlagAESSIV:         "AESSIV",
 	FlagRaw64:          "Raw64",
 	FlagHKDF:           "HKDF",
+	FlagFlat:           "Flat",
+	FlagNamesMigration: "NamesMigration",
+	FlagBlockCRC:       "BlockCRC",
+	FlagLongNameMax:    "LongNameMax",
+	FlagDirIVXattr:     "DirIVXattr",
+	FlagDirIVName:      "DirIVName",
+	FlagFIDO2:          "FIDO2",
+	FlagExactSize:      "ExactSize",
+	FlagLongSymlinks:   "LongSymlinks",
 }
 
 // Filesystems that do not have these feature flags set are deprecated.
@@ -46,6 +86,12 @@ var requiredFlagsNormal = []flagIota{
 	FlagGCMIV128,
 }
 
+// Flat filesystems have encrypted file names, but no DirIVs.
+var requiredFlagsFlat = []flagIota{
+	FlagEMENames,
+	FlagGCMIV128,
+}
+
 // Filesystems without filename encryption obviously don't have or need the
 // filename related feature flags.
 var requiredFlagsPlaintextNames = []flagIota{
@@ -62,6 +108,27 @@ func (cf *ConfFile) isFeatureFlagKnown(flag string) bool {
 	return false
 }
 
+// SetFeatureFlag enables the feature flag "flag". Does nothing if it is
+// already set.
+func (cf *ConfFile) SetFeatureFlag(flag flagIota) {
+	if cf.IsFeatureFlagSet(flag) {
+		return
+	}
+	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[flag])
+}
+
+// ClearFeatureFlag disables the feature flag "flag".
+func (cf *ConfFile) ClearFeatureFlag(flag flagIota) {
+	flagString := knownFlags[flag]
+	out := cf.FeatureFlags[:0]
+	for _, f := range cf.FeatureFlags {
+		if f != flagString {
+			out = append(out, f)
+		}
+	}
+	cf.FeatureFlags = out
+}
+
 // IsFeatureFlagSet returns true if the feature flag "flagWant" is enabled.
 func (cf *ConfFile) IsFeatureFlagSet(flagWant flagIota) bool {
 	flagString := knownFlags[flagWant]
@@ -0,0 +1,64 @@
+package configfile
+
+import (
+	"fmt"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/mlock"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// FIDO2SecretLen is the length of the FIDO2 secret of a filesystem
+const FIDO2SecretLen = 32
+
+// FIDO2Slot is a FIDO2 credential that unlocks the filesystem together with
+// the password, like a LUKS key slot.
+//
+// The password is not combined with the hmac-secret of the credential
+// directly, which is different for every key, but with the FIDO2 secret of
+// the filesystem, a random value created on "-init". Every slot holds a copy
+// of it, encrypted with the hmac-secret of its credential. Keys can be added
+// and removed without touching EncryptedKey.
+type FIDO2Slot struct {
+	// CredentialID identifies the credential on the key
+	CredentialID []byte
+	// HMACSalt is passed to the key to get the hmac-secret
+	HMACSalt []byte
+	// EncryptedSecret is the FIDO2 secret of the filesystem, encrypted with
+	// the hmac-secret
+	EncryptedSecret []byte
+}
+
+// NewFIDO2Slot returns a slot for the credential "credentialID" that holds
+// "secret" encrypted with "hmacSecret", the answer of the key to "salt".
+func NewFIDO2Slot(credentialID []byte, salt []byte, hmacSecret []byte, secret []byte) (*FIDO2Slot, error) {
+	if len(hmacSecret) != cryptocore.KeyLen {
+		return nil, fmt.Errorf("hmac-secret has %d bytes, want %d", len(hmacSecret), cryptocore.KeyLen)
+	}
+	ce := getKeyEncrypter(hmacSecret, true)
+	defer ce.Wipe()
+	return &FIDO2Slot{
+		CredentialID:    credentialID,
+		HMACSalt:        salt,
+		EncryptedSecret: ce.EncryptBlock(secret, 0, nil),
+	}, nil
+}
+
+// DecryptSecret decrypts the FIDO2 secret of the filesystem with
+// "hmacSecret", the answer of the key to s.HMACSalt.
+func (s *FIDO2Slot) DecryptSecret(hmacSecret []byte) ([]byte, error) {
+	if len(hmacSecret) != cryptocore.KeyLen {
+		return nil, fmt.Errorf("hmac-secret has %d bytes, want %d", len(hmacSecret), cryptocore.KeyLen)
+	}
+	ce := getKeyEncrypter(hmacSecret, true)
+	defer ce.Wipe()
+	tlog.Warn.Enabled = false // Silence DecryptBlock() error messages
+	secret, err := ce.DecryptBlock(s.EncryptedSecret, 0, nil)
+	tlog.Warn.Enabled = true
+	if err != nil {
+		return nil, exitcodes.NewErr("FIDO2 slot does not decrypt, corrupt config file?", exitcodes.FIDO2)
+	}
+	mlock.Lock(secret)
+	return secret, nil
+}
@@ -0,0 +1,85 @@
+package configfile
+
+import (
+	"fmt"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// ReverseMismatch is a parameter of a config file that reverse mode handles
+// differently from forward mode.
+type ReverseMismatch struct {
+	// Param is the parameter that differs, like "content encryption"
+	Param string
+	// Forward is what the config file specifies
+	Forward string
+	// Reverse is what reverse mode needs
+	Reverse string
+}
+
+func (m ReverseMismatch) String() string {
+	return fmt.Sprintf("%s: config file has %s, reverse mode needs %s", m.Param, m.Forward, m.Reverse)
+}
+
+// ReverseMismatches checks if a reverse mount with this config file produces
+// ciphertext that a forward mount of the same config file can decrypt, and
+// returns the parameters that prevent it. Returns nil if there are none.
+//
+// Note that the ciphertext of a reverse mount is never byte-for-byte
+// identical to a forward-mode CIPHERDIR with the same content: reverse mode
+// derives file IDs, block IVs and directory IVs from the file path, while
+// forward mode generates them randomly.
+func (cf *ConfFile) ReverseMismatches() (out []ReverseMismatch) {
+	if !cf.IsFeatureFlagSet(FlagAESSIV) {
+		// GCM with IVs derived from the path would reuse nonces when a file
+		// changes
+		out = append(out, ReverseMismatch{
+			Param:   "content encryption",
+			Forward: "AES-GCM",
+			Reverse: "AES-SIV (" + knownFlags[FlagAESSIV] + " feature flag)",
+		})
+	}
+	if cf.IsFeatureFlagSet(FlagFlat) {
+		out = append(out, ReverseMismatch{
+			Param:   "name encryption",
+			Forward: "one IV for all directories (" + knownFlags[FlagFlat] + " feature flag)",
+			Reverse: "per-directory IVs (" + knownFlags[FlagDirIV] + " feature flag)",
+		})
+	}
+	if cf.IsFeatureFlagSet(FlagDirIVXattr) {
+		out = append(out, ReverseMismatch{
+			Param:   "directory IV storage",
+			Forward: "xattr (" + knownFlags[FlagDirIVXattr] + " feature flag)",
+			Reverse: "gocryptfs.diriv files",
+		})
+	}
+	if cf.IsFeatureFlagSet(FlagDirIVName) {
+		out = append(out, ReverseMismatch{
+			Param:   "directory IV file name",
+			Forward: cf.DirIVName + " (" + knownFlags[FlagDirIVName] + " feature flag)",
+			Reverse: nametransform.DirIVFilename,
+		})
+	}
+	if cf.IsFeatureFlagSet(FlagLongNameMax) {
+		out = append(out, ReverseMismatch{
+			Param:   "long name threshold",
+			Forward: fmt.Sprintf("%d bytes (%s feature flag)", cf.LongNameMax, knownFlags[FlagLongNameMax]),
+			Reverse: fmt.Sprintf("%d bytes", nametransform.NameMax),
+		})
+	}
+	if cf.IsFeatureFlagSet(FlagExactSize) {
+		out = append(out, ReverseMismatch{
+			Param:   "file size storage",
+			Forward: "xattr (" + knownFlags[FlagExactSize] + " feature flag)",
+			Reverse: "inferred from the file size",
+		})
+	}
+	if cf.IsFeatureFlagSet(FlagLongSymlinks) {
+		out = append(out, ReverseMismatch{
+			Param:   "long symlink targets",
+			Forward: "stored in gocryptfs.longlinks (" + knownFlags[FlagLongSymlinks] + " feature flag)",
+			Reverse: "not supported",
+		})
+	}
+	return out
+}
@@ -4,11 +4,13 @@ import (
 	"log"
 	"math"
 	"os"
+	"time"
 
 	"golang.org/x/crypto/scrypt"
 
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/mlock"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -31,6 +33,16 @@ const (
 	scryptMinSaltLen = 32
 )
 
+// KDFProgress, if set, is called when a key derivation is still running after
+// KDFProgressDelay, which happens with high scrypt cost parameters or on slow
+// machines. It should tell the user that we are busy, and return once "done"
+// is closed. DeriveKey waits for it to return, so it can clean up its output.
+var KDFProgress func(logN int, done <-chan struct{})
+
+// KDFProgressDelay is how long a key derivation may take before KDFProgress
+// is called. Zero calls it right away.
+var KDFProgressDelay = 1 * time.Second
+
 // ScryptKDF is an instance of the scrypt key deriviation function.
 type ScryptKDF struct {
 	// Salt is the random salt that is passed to scrypt
@@ -64,13 +76,46 @@ func NewScryptKDF(logN int) ScryptKDF {
 func (s *ScryptKDF) DeriveKey(pw []byte) []byte {
 	s.validateParams()
 
+	stop := startKDFProgress(s.LogN())
 	k, err := scrypt.Key(pw, s.Salt, s.N, s.R, s.P, s.KeyLen)
+	stop()
 	if err != nil {
 		log.Panicf("DeriveKey failed: %v", err)
 	}
+	mlock.Lock(k)
 	return k
 }
 
+// startKDFProgress arms the KDFProgress callback. Call the returned function
+// when the key derivation is done.
+func startKDFProgress(logN int) (stop func()) {
+	cb := KDFProgress
+	if cb == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	run := func() {
+		cb(logN, done)
+		close(finished)
+	}
+	if KDFProgressDelay <= 0 {
+		go run()
+		return func() {
+			close(done)
+			<-finished
+		}
+	}
+	timer := time.AfterFunc(KDFProgressDelay, run)
+	return func() {
+		close(done)
+		if !timer.Stop() {
+			// The callback has already started, wait for it
+			<-finished
+		}
+	}
+}
+
 // LogN - N is saved as 2^LogN, but LogN is much easier to work with.
 // This function gives you LogN = Log2(N).
 func (s *ScryptKDF) LogN() int {
@@ -2,6 +2,7 @@ package configfile
 
 import (
 	"testing"
+	"time"
 )
 
 /*
@@ -58,3 +59,29 @@ func BenchmarkScrypt16(b *testing.B) {
 func BenchmarkScrypt17(b *testing.B) {
 	benchmarkScryptN(17, b)
 }
+
+func TestKDFProgress(t *testing.T) {
+	defer func(d time.Duration) {
+		KDFProgress = nil
+		KDFProgressDelay = d
+	}(KDFProgressDelay)
+	var calls []int
+	KDFProgress = func(logN int, done <-chan struct{}) {
+		<-done
+		calls = append(calls, logN)
+	}
+	// Never reached: the callback must not run
+	KDFProgressDelay = time.Hour
+	kdf := NewScryptKDF(10)
+	kdf.DeriveKey(testPw)
+	if len(calls) != 0 {
+		t.Errorf("fast derivation: want no callback, got %v", calls)
+	}
+	// Already reached: DeriveKey must wait for the callback
+	KDFProgressDelay = 0
+	kdf = NewScryptKDF(12)
+	kdf.DeriveKey(testPw)
+	if len(calls) != 1 || calls[0] != 12 {
+		t.Errorf("slow derivation: want [12], got %v", calls)
+	}
+}
@@ -0,0 +1,96 @@
+package contentenc
+
+// Block checksums ("BlockCRC" feature flag)
+//
+// Format of a ciphertext block: [ nonce ] [ ciphertext ] [ tag ] [ CRC32C ]
+//
+// The CRC32C covers everything that comes before it in the block. Other than
+// the GCM tag, it can be checked without the key, so an unprivileged process
+// can scan for bit rot. The tag stays authoritative: a block with a good CRC
+// but a bad tag is still rejected, and a block with a good tag but a bad CRC
+// is still decrypted.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+const (
+	// BlockCRCLen is the length of the CRC32C at the end of each block
+	BlockCRCLen = 4
+	// BlockCRCVersion is the file header version of filesystems that have
+	// the "BlockCRC" feature flag set
+	BlockCRCVersion = 3
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// appendBlockCRC appends the CRC32C of "block[start:]" to "block"
+func appendBlockCRC(block []byte, start int) []byte {
+	var crc [BlockCRCLen]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.Checksum(block[start:], crcTable))
+	return append(block, crc[:]...)
+}
+
+// CheckBlockCRC returns true if the last 4 bytes of "block" are the CRC32C of
+// the rest of the block. Does not need the key.
+func CheckBlockCRC(block []byte) bool {
+	if len(block) < BlockCRCLen {
+		return false
+	}
+	n := len(block) - BlockCRCLen
+	return binary.BigEndian.Uint32(block[n:]) == crc32.Checksum(block[:n], crcTable)
+}
+
+// BlockCRCCipherBS returns the ciphertext block size of a "BlockCRC"
+// filesystem with plaintext block size "plainBS". All current filesystems
+// use 128-bit IVs.
+func BlockCRCCipherBS(plainBS uint64) uint64 {
+	return plainBS + DefaultIVBits/8 + cryptocore.AuthTagLen + BlockCRCLen
+}
+
+// ScrubFile checks the header version and the CRC32C of all blocks of the
+// ciphertext file "r" of size "size", without decrypting anything. Returns
+// the numbers of the blocks that fail the check. File holes (all-zero
+// blocks) pass.
+func ScrubFile(r io.ReaderAt, size int64, plainBS uint64) (badBlocks []uint64, err error) {
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, HeaderLen)
+	if _, err = r.ReadAt(buf, 0); err != nil {
+		return nil, fmt.Errorf("reading header: %v", err)
+	}
+	h, err := ParseHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	if h.Version != BlockCRCVersion {
+		return nil, fmt.Errorf("header version %d, want %d", h.Version, BlockCRCVersion)
+	}
+	cipherBS := BlockCRCCipherBS(plainBS)
+	allZero := make([]byte, cipherBS)
+	buf = make([]byte, cipherBS)
+	for blockNo := uint64(0); ; blockNo++ {
+		off := int64(HeaderLen + blockNo*cipherBS)
+		if off >= size {
+			return badBlocks, nil
+		}
+		n, err := r.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			return badBlocks, err
+		}
+		block := buf[:n]
+		if n == int(cipherBS) && bytes.Equal(block, allZero) {
+			continue
+		}
+		if !CheckBlockCRC(block) {
+			badBlocks = append(badBlocks, blockNo)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package contentenc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// TestBlockCRC encrypts a file with "BlockCRC", checks it with ScrubFile,
+// and checks that bit rot is detected without the key while decryption
+// still relies on the GCM tag.
+func TestBlockCRC(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	be := New(cc, DefaultBS, false, true)
+	if be.CipherBS() != BlockCRCCipherBS(DefaultBS) {
+		t.Fatalf("CipherBS: want %d, got %d", BlockCRCCipherBS(DefaultBS), be.CipherBS())
+	}
+	h := be.RandomHeader()
+	if h.Version != BlockCRCVersion {
+		t.Errorf("header version: want %d, got %d", BlockCRCVersion, h.Version)
+	}
+	// Two full blocks, a hole and a partial block
+	plain := [][]byte{
+		bytes.Repeat([]byte("a"), DefaultBS),
+		bytes.Repeat([]byte("b"), DefaultBS),
+		nil,
+		[]byte("c"),
+	}
+	file := h.Pack()
+	for i, p := range plain {
+		if p == nil {
+			file = append(file, make([]byte, be.CipherBS())...)
+			continue
+		}
+		file = append(file, be.EncryptBlock(p, uint64(i), h.ID)...)
+	}
+	if len(file) != HeaderLen+3*int(be.CipherBS())+1+int(be.BlockOverhead()) {
+		t.Errorf("unexpected file size %d", len(file))
+	}
+	bad, err := ScrubFile(bytes.NewReader(file), int64(len(file)), DefaultBS)
+	if err != nil || len(bad) != 0 {
+		t.Fatalf("ScrubFile on a good file: bad=%v err=%v", bad, err)
+	}
+	// Flip a bit in the ciphertext of block 1
+	file[HeaderLen+int(be.CipherBS())+100] ^= 1
+	bad, err = ScrubFile(bytes.NewReader(file), int64(len(file)), DefaultBS)
+	if err != nil || len(bad) != 1 || bad[0] != 1 {
+		t.Errorf("ScrubFile after a bit flip in block 1: bad=%v err=%v", bad, err)
+	}
+	cBlock := func(i int) []byte {
+		start := HeaderLen + i*int(be.CipherBS())
+		end := start + int(be.CipherBS())
+		if end > len(file) {
+			end = len(file)
+		}
+		return file[start:end]
+	}
+	if _, err = be.DecryptBlock(cBlock(1), 1, h.ID); err == nil {
+		t.Error("DecryptBlock of a corrupt block should fail")
+	}
+	// A corrupt CRC does not prevent decryption, the GCM tag is authoritative
+	last := cBlock(3)
+	last[len(last)-1] ^= 1
+	p, err := be.DecryptBlock(last, 3, h.ID)
+	if err != nil || string(p) != "c" {
+		t.Errorf("DecryptBlock with a corrupt CRC: p=%q err=%v", p, err)
+	}
+	// The file header must match the block format
+	if _, err = be.ParseHeader(file[:HeaderLen]); err != nil {
+		t.Error(err)
+	}
+	if _, err = New(cc, DefaultBS, false, false).ParseHeader(file[:HeaderLen]); err == nil {
+		t.Error("header version 3 should be rejected without BlockCRC")
+	}
+}
@@ -9,19 +9,32 @@ import (
 type bPool struct {
 	sync.Pool
 	sliceLen int
+	// wipe overwrites slices with zeros when they are returned to the pool.
+	// Used for pools that hold plaintext, so it does not linger in memory.
+	wipe bool
 }
 
-func newBPool(sliceLen int) bPool {
+func newBPool(sliceLen int, wipe bool) bPool {
 	return bPool{
 		Pool: sync.Pool{
 			New: func() interface{} { return make([]byte, sliceLen) },
 		},
 		sliceLen: sliceLen,
+		wipe:     wipe,
 	}
 }
 
 // Put grows the slice "s" to its maximum capacity and puts it into the pool.
+// Don't use "s" anymore afterwards.
+//
+// If the pool wipes its slices, only the first len(s) bytes are wiped, so
+// "s" must cover everything that has been written to.
 func (b *bPool) Put(s []byte) {
+	if b.wipe {
+		for i := range s {
+			s[i] = 0
+		}
+	}
 	s = s[:cap(s)]
 	if len(s) != b.sliceLen {
 		log.Panicf("wrong len=%d, want=%d", len(s), b.sliceLen)
@@ -53,34 +53,43 @@ type ContentEnc struct {
 	allZeroNonce []byte
 	// Force decode even if integrity check fails (openSSL only)
 	forceDecode bool
+	// Append a CRC32C to each block ("BlockCRC" feature flag)
+	blockCRC bool
 
 	// Ciphertext block "sync.Pool" pool. Always returns cipherBS-sized byte
 	// slices (usually 4128 bytes).
 	cBlockPool bPool
 	// Plaintext block pool. Always returns plainBS-sized byte slices
-	// (usually 4096 bytes).
+	// (usually 4096 bytes). Wiped when a slice is returned.
 	pBlockPool bPool
 	// Ciphertext request data pool. Always returns byte slices of size
 	// fuse.MAX_KERNEL_WRITE + encryption overhead.
 	// Used by Read() to temporarily store the ciphertext as it is read from
 	// disk.
 	CReqPool bPool
-	// Plaintext request data pool. Slice have size fuse.MAX_KERNEL_WRITE.
+	// Plaintext request data pool. Slice have size fuse.MAX_KERNEL_WRITE
+	// plus one block. Wiped when a slice is returned.
 	PReqPool bPool
 }
 
-// New returns an initialized ContentEnc instance.
-func New(cc *cryptocore.CryptoCore, plainBS uint64, forceDecode bool) *ContentEnc {
+// New returns an initialized ContentEnc instance. With "blockCRC", a CRC32C
+// is appended to each block, see block_crc.go.
+func New(cc *cryptocore.CryptoCore, plainBS uint64, forceDecode bool, blockCRC bool) *ContentEnc {
 	if fuse.MAX_KERNEL_WRITE%plainBS != 0 {
 		log.Panicf("unaligned MAX_KERNEL_WRITE=%d", fuse.MAX_KERNEL_WRITE)
 	}
 	cipherBS := plainBS + uint64(cc.IVLen) + cryptocore.AuthTagLen
+	if blockCRC {
+		cipherBS += BlockCRCLen
+	}
 	// Take IV and GHASH overhead into account.
 	cReqSize := int(fuse.MAX_KERNEL_WRITE / plainBS * cipherBS)
 	// Unaligned reads (happens during fsck, could also happen with O_DIRECT?)
 	// touch one additional ciphertext and plaintext block. Reserve space for the
 	// extra block.
 	cReqSize += int(cipherBS)
+	// Room for the file header, see EncryptBlocksWithHeader.
+	cReqSize += HeaderLen
 	pReqSize := fuse.MAX_KERNEL_WRITE + int(plainBS)
 	c := &ContentEnc{
 		cryptoCore:   cc,
@@ -89,10 +98,11 @@ func New(cc *cryptocore.CryptoCore, plainBS uint64, forceDecode bool) *ContentEn
 		allZeroBlock: make([]byte, cipherBS),
 		allZeroNonce: make([]byte, cc.IVLen),
 		forceDecode:  forceDecode,
-		cBlockPool:   newBPool(int(cipherBS)),
-		CReqPool:     newBPool(cReqSize),
-		pBlockPool:   newBPool(int(plainBS)),
-		PReqPool:     newBPool(pReqSize),
+		blockCRC:     blockCRC,
+		cBlockPool:   newBPool(int(cipherBS), false),
+		CReqPool:     newBPool(cReqSize, false),
+		pBlockPool:   newBPool(int(plainBS), true),
+		PReqPool:     newBPool(pReqSize, true),
 	}
 	return c
 }
@@ -107,16 +117,24 @@ func (be *ContentEnc) CipherBS() uint64 {
 	return be.cipherBS
 }
 
-// DecryptBlocks decrypts a number of blocks
+// DecryptBlocks decrypts a number of blocks.
+// Returns a byte slice from PReqPool - so don't forget to return it
+// to the pool.
+//
+// The blocks are decrypted directly into the returned slice, without going
+// through an intermediate per-block buffer.
 func (be *ContentEnc) DecryptBlocks(ciphertext []byte, firstBlockNo uint64, fileID []byte) ([]byte, error) {
 	cBuf := bytes.NewBuffer(ciphertext)
 	var err error
-	pBuf := bytes.NewBuffer(be.PReqPool.Get()[:0])
+	plaintext := be.PReqPool.Get()[:0]
+	// The associated data only differs in the block number. Allocate it
+	// once and update the block number in place.
+	aData := concatAD(firstBlockNo, fileID)
 	blockNo := firstBlockNo
 	for cBuf.Len() > 0 {
 		cBlock := cBuf.Next(int(be.cipherBS))
-		var pBlock []byte
-		pBlock, err = be.DecryptBlock(cBlock, blockNo, fileID)
+		binary.BigEndian.PutUint64(aData, blockNo)
+		plaintext, err = be.decryptBlockAppend(plaintext, cBlock, aData)
 		if err != nil {
 			if be.forceDecode && err == stupidgcm.ErrAuth {
 				tlog.Warn.Printf("DecryptBlocks: authentication failure in block #%d, overridden by forcedecode", firstBlockNo)
@@ -124,11 +142,9 @@ func (be *ContentEnc) DecryptBlocks(ciphertext []byte, firstBlockNo uint64, file
 				break
 			}
 		}
-		pBuf.Write(pBlock)
-		be.pBlockPool.Put(pBlock)
 		blockNo++
 	}
-	return pBuf.Bytes(), err
+	return plaintext, err
 }
 
 // concatAD concatenates the block number and the file ID to a byte blob
@@ -165,9 +181,56 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 		return make([]byte, be.plainBS), nil
 	}
 
+	plaintext, err := be.decryptBlockAppend(be.pBlockPool.Get()[:0], ciphertext, concatAD(blockNo, fileID))
+	if err != nil && !(be.forceDecode && err == stupidgcm.ErrAuth) {
+		return nil, err
+	}
+	return plaintext, err
+}
+
+// decryptBlockAppend works like DecryptBlock, but takes the associated data
+// instead of block number and file ID, and appends the plaintext to
+// "dst" and returns the extended slice. If "dst" has enough spare capacity,
+// which is the case for slices from PReqPool, the block is decrypted in
+// place and nothing is allocated.
+//
+// On error, the returned slice is "dst" (or, with forcedecode, "dst" plus
+// the corrupt plaintext).
+func (be *ContentEnc) decryptBlockAppend(dst []byte, ciphertext []byte, aData []byte) ([]byte, error) {
+
+	// Empty block?
+	if len(ciphertext) == 0 {
+		return dst, nil
+	}
+
+	// All-zero block?
+	if bytes.Equal(ciphertext, be.allZeroBlock) {
+		tlog.Debug.Printf("DecryptBlock: file hole encountered")
+		n := len(dst)
+		if cap(dst)-n < int(be.plainBS) {
+			return append(dst, make([]byte, be.plainBS)...), nil
+		}
+		dst = dst[:n+int(be.plainBS)]
+		// The spare capacity may contain old data if dst comes from a pool
+		for i := n; i < len(dst); i++ {
+			dst[i] = 0
+		}
+		return dst, nil
+	}
+
+	crcOK := true
+	if be.blockCRC {
+		if len(ciphertext) < be.cryptoCore.IVLen+BlockCRCLen {
+			tlog.Warn.Printf("DecryptBlock: Block is too short: %d bytes", len(ciphertext))
+			return dst, errors.New("Block is too short")
+		}
+		crcOK = CheckBlockCRC(ciphertext)
+		ciphertext = ciphertext[:len(ciphertext)-BlockCRCLen]
+	}
+
 	if len(ciphertext) < be.cryptoCore.IVLen {
 		tlog.Warn.Printf("DecryptBlock: Block is too short: %d bytes", len(ciphertext))
-		return nil, errors.New("Block is too short")
+		return dst, errors.New("Block is too short")
 	}
 
 	// Extract nonce
@@ -176,27 +239,28 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 		// Bug in tmpfs?
 		// https://github.com/rfjakob/gocryptfs/issues/56
 		// http://www.spinics.net/lists/kernel/msg2370127.html
-		return nil, errors.New("all-zero nonce")
+		return dst, errors.New("all-zero nonce")
 	}
 	ciphertextOrig := ciphertext
 	ciphertext = ciphertext[be.cryptoCore.IVLen:]
 
 	// Decrypt
-	plaintext := be.pBlockPool.Get()
-	plaintext = plaintext[:0]
-	aData := concatAD(blockNo, fileID)
-	plaintext, err := be.cryptoCore.AEADCipher.Open(plaintext, nonce, ciphertext, aData)
+	out, err := be.cryptoCore.AEADCipher.Open(dst, nonce, ciphertext, aData)
 
 	if err != nil {
-		tlog.Debug.Printf("DecryptBlock: %s, len=%d", err.Error(), len(ciphertextOrig))
+		tlog.Debug.Printf("DecryptBlock: %s, len=%d, crcOK=%v", err.Error(), len(ciphertextOrig), crcOK)
 		tlog.Debug.Println(hex.Dump(ciphertextOrig))
 		if be.forceDecode && err == stupidgcm.ErrAuth {
-			return plaintext, err
+			return out, err
 		}
-		return nil, err
+		return dst, err
+	}
+	if !crcOK {
+		// The GCM tag is authoritative, only the CRC itself is corrupt
+		tlog.Warn.Printf("DecryptBlock: CRC32C mismatch in a block that passed authentication")
 	}
 
-	return plaintext, nil
+	return out, nil
 }
 
 // At some point, splitting the ciphertext into more groups will not improve
@@ -205,70 +269,104 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 const encryptMaxSplit = 2
 
 // encryptBlocksParallel splits the plaintext into parts and encrypts them
-// in parallel.
-func (be *ContentEnc) encryptBlocksParallel(plaintextBlocks [][]byte, ciphertextBlocks [][]byte, firstBlockNo uint64, fileID []byte) {
+// in parallel into "out". Returns the number of ciphertext bytes written.
+func (be *ContentEnc) encryptBlocksParallel(plaintextBlocks [][]byte, out []byte, firstBlockNo uint64, fileID []byte) int {
 	ncpu := runtime.NumCPU()
 	if ncpu > encryptMaxSplit {
 		ncpu = encryptMaxSplit
 	}
 	groupSize := len(plaintextBlocks) / ncpu
 	var wg sync.WaitGroup
+	// Each group writes its ciphertext right behind the ciphertext of the
+	// previous group
+	outOff := 0
 	for i := 0; i < ncpu; i++ {
+		low := i * groupSize
+		high := (i + 1) * groupSize
+		if i == ncpu-1 {
+			// Last part picks up any left-over blocks
+			//
+			// The last part could run in the original goroutine, but
+			// doing that complicates the code, and, surprisingly,
+			// incurs a 1 % performance penalty.
+			high = len(plaintextBlocks)
+		}
+		group := plaintextBlocks[low:high]
+		groupOut := out[outOff:]
+		outOff += be.cipherLen(group)
 		wg.Add(1)
-		go func(i int) {
-			low := i * groupSize
-			high := (i + 1) * groupSize
-			if i == ncpu-1 {
-				// Last part picks up any left-over blocks
-				//
-				// The last part could run in the original goroutine, but
-				// doing that complicates the code, and, surprisingly,
-				// incurs a 1 % performance penalty.
-				high = len(plaintextBlocks)
-			}
-			be.doEncryptBlocks(plaintextBlocks[low:high], ciphertextBlocks[low:high], firstBlockNo+uint64(low), fileID)
+		go func(group [][]byte, groupOut []byte, blockNo uint64) {
+			be.doEncryptBlocks(group, groupOut, blockNo, fileID)
 			wg.Done()
-		}(i)
+		}(group, groupOut, firstBlockNo+uint64(low))
 	}
 	wg.Wait()
+	return outOff
+}
+
+// cipherLen returns the total ciphertext length of "plaintextBlocks"
+func (be *ContentEnc) cipherLen(plaintextBlocks [][]byte) (n int) {
+	overhead := int(be.BlockOverhead())
+	for _, p := range plaintextBlocks {
+		if len(p) > 0 {
+			n += len(p) + overhead
+		}
+	}
+	return n
 }
 
 // EncryptBlocks is like EncryptBlock but takes multiple plaintext blocks.
 // Returns a byte slice from CReqPool - so don't forget to return it
 // to the pool.
+//
+// The blocks are encrypted directly into the returned slice, without going
+// through an intermediate per-block buffer.
 func (be *ContentEnc) EncryptBlocks(plaintextBlocks [][]byte, firstBlockNo uint64, fileID []byte) []byte {
-	ciphertextBlocks := make([][]byte, len(plaintextBlocks))
+	return be.EncryptBlocksWithHeader(nil, plaintextBlocks, firstBlockNo, fileID)
+}
+
+// EncryptBlocksWithHeader is like EncryptBlocks, but the returned slice
+// starts with the packed file header "header", followed by the ciphertext.
+// This allows writing a new file header and block #0 in one go without
+// copying the ciphertext.
+func (be *ContentEnc) EncryptBlocksWithHeader(header []byte, plaintextBlocks [][]byte, firstBlockNo uint64, fileID []byte) []byte {
+	out := be.CReqPool.Get()
+	if l := len(header) + be.cipherLen(plaintextBlocks); l > len(out) {
+		log.Panicf("EncryptBlocks: ciphertext of %d bytes does not fit into the %d bytes request buffer", l, len(out))
+	}
+	n := copy(out, header)
 	// For large writes, we parallelize encryption.
 	if len(plaintextBlocks) >= 32 && runtime.NumCPU() >= 2 {
-		be.encryptBlocksParallel(plaintextBlocks, ciphertextBlocks, firstBlockNo, fileID)
+		n += be.encryptBlocksParallel(plaintextBlocks, out[n:], firstBlockNo, fileID)
 	} else {
-		be.doEncryptBlocks(plaintextBlocks, ciphertextBlocks, firstBlockNo, fileID)
+		n += be.doEncryptBlocks(plaintextBlocks, out[n:], firstBlockNo, fileID)
 	}
-	// Concatenate ciphertext into a single byte array.
-	tmp := be.CReqPool.Get()
-	out := bytes.NewBuffer(tmp[:0])
-	for _, v := range ciphertextBlocks {
-		out.Write(v)
-		// Return the memory to cBlockPool
-		be.cBlockPool.Put(v)
-	}
-	return out.Bytes()
+	return out[:n]
 }
 
-// doEncryptBlocks is called by EncryptBlocks to do the actual encryption work
-func (be *ContentEnc) doEncryptBlocks(in [][]byte, out [][]byte, firstBlockNo uint64, fileID []byte) {
+// doEncryptBlocks is called by EncryptBlocks to do the actual encryption work.
+// The ciphertext blocks are written back-to-back into "out". Returns the
+// number of bytes written.
+func (be *ContentEnc) doEncryptBlocks(in [][]byte, out []byte, firstBlockNo uint64, fileID []byte) int {
+	// The associated data only differs in the block number. Allocate it
+	// once and update the block number in place.
+	aData := concatAD(firstBlockNo, fileID)
+	n := 0
 	for i, v := range in {
-		out[i] = be.EncryptBlock(v, firstBlockNo+uint64(i), fileID)
+		if len(v) == 0 {
+			continue
+		}
+		binary.BigEndian.PutUint64(aData, firstBlockNo+uint64(i))
+		n += len(be.encryptBlockAppend(out[n:n], v, aData, nil))
 	}
+	return n
 }
 
 // EncryptBlock - Encrypt plaintext using a random nonce.
 // blockNo and fileID are used as associated data.
-// The output is nonce + ciphertext + tag.
+// The output is nonce + ciphertext + tag (+ CRC32C with "BlockCRC").
 func (be *ContentEnc) EncryptBlock(plaintext []byte, blockNo uint64, fileID []byte) []byte {
-	// Get a fresh random nonce
-	nonce := be.cryptoCore.IVGenerator.Get()
-	return be.doEncryptBlock(plaintext, blockNo, fileID, nonce)
+	return be.doEncryptBlock(plaintext, blockNo, fileID, nil)
 }
 
 // EncryptBlockNonce - Encrypt plaintext using a nonce chosen by the caller.
@@ -283,29 +381,49 @@ func (be *ContentEnc) EncryptBlockNonce(plaintext []byte, blockNo uint64, fileID
 }
 
 // doEncryptBlock is the backend for EncryptBlock and EncryptBlockNonce.
-// blockNo and fileID are used as associated data.
+// blockNo and fileID are used as associated data. If "nonce" is nil, a
+// random nonce is used.
 // The output is nonce + ciphertext + tag.
 func (be *ContentEnc) doEncryptBlock(plaintext []byte, blockNo uint64, fileID []byte, nonce []byte) []byte {
 	// Empty block?
 	if len(plaintext) == 0 {
 		return plaintext
 	}
-	if len(nonce) != be.cryptoCore.IVLen {
+	if nonce != nil && len(nonce) != be.cryptoCore.IVLen {
 		log.Panic("wrong nonce length")
 	}
 	// Block is authenticated with block number and file ID
 	aData := concatAD(blockNo, fileID)
-	// Get a cipherBS-sized block of memory, copy the nonce into it and truncate to
-	// nonce length
+	// Get a cipherBS-sized block of memory to hold the output
 	cBlock := be.cBlockPool.Get()
-	copy(cBlock, nonce)
-	cBlock = cBlock[0:len(nonce)]
+	return be.encryptBlockAppend(cBlock[:0], plaintext, aData, nonce)
+}
+
+// encryptBlockAppend encrypts "plaintext" and appends nonce + ciphertext + tag
+// to "dst". If "dst" has enough spare capacity, nothing is allocated. If
+// "nonce" is nil, a random nonce is generated directly into the output.
+func (be *ContentEnc) encryptBlockAppend(dst []byte, plaintext []byte, aData []byte, nonce []byte) []byte {
+	ivLen := be.cryptoCore.IVLen
+	n := len(dst)
+	if cap(dst)-n < ivLen {
+		dst = append(dst, make([]byte, ivLen)...)
+	} else {
+		dst = dst[:n+ivLen]
+	}
+	if nonce == nil {
+		be.cryptoCore.IVGenerator.Read(dst[n:])
+	} else {
+		copy(dst[n:], nonce)
+	}
 	// Encrypt plaintext and append to nonce
-	ciphertext := be.cryptoCore.AEADCipher.Seal(cBlock, nonce, plaintext, aData)
+	ciphertext := be.cryptoCore.AEADCipher.Seal(dst, dst[n:], plaintext, aData)
+	if be.blockCRC {
+		ciphertext = appendBlockCRC(ciphertext, n)
+	}
 	overhead := int(be.cipherBS - be.plainBS)
-	if len(plaintext)+overhead != len(ciphertext) {
+	if len(plaintext)+overhead != len(ciphertext)-n {
 		log.Panicf("unexpected ciphertext length: plaintext=%d, overhead=%d, ciphertext=%d",
-			len(plaintext), overhead, len(ciphertext))
+			len(plaintext), overhead, len(ciphertext)-n)
 	}
 	return ciphertext
 }
@@ -317,27 +435,42 @@ func (be *ContentEnc) MergeBlocks(oldData []byte, newData []byte, offset int) []
 	if len(oldData) == 0 && offset == 0 {
 		return newData
 	}
-
-	// Make block of maximum size
-	out := make([]byte, be.plainBS)
-
-	// Copy old and new data into it
+	// Make block of maximum size and copy old data into it
+	out := make([]byte, len(oldData), be.plainBS)
 	copy(out, oldData)
-	l := len(newData)
-	copy(out[offset:offset+l], newData)
+	return be.MergeBlocksInPlace(out, newData, offset)
+}
 
+// MergeBlocksInPlace is like MergeBlocks, but uses the spare capacity of
+// "oldData" for the result instead of allocating a new block. "oldData"
+// must have a capacity of at least one block.
+func (be *ContentEnc) MergeBlocksInPlace(oldData []byte, newData []byte, offset int) []byte {
+	// Fastpath for small-file creation
+	if len(oldData) == 0 && offset == 0 {
+		return newData
+	}
 	// Crop to length
 	outLen := len(oldData)
 	newLen := offset + len(newData)
 	if outLen < newLen {
 		outLen = newLen
 	}
-	return out[0:outLen]
+	out := oldData[:outLen]
+	// The gap between old and new data reads as zeros. The spare capacity
+	// may contain stale data if oldData comes from a pool.
+	for i := len(oldData); i < offset; i++ {
+		out[i] = 0
+	}
+	copy(out[offset:], newData)
+	return out
 }
 
 // Wipe tries to wipe secret keys from memory by overwriting them with zeros
 // and/or setting references to nil.
 func (be *ContentEnc) Wipe() {
+	if be.cryptoCore == nil {
+		return
+	}
 	be.cryptoCore.Wipe()
 	be.cryptoCore = nil
 }
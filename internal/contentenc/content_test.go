@@ -1,8 +1,12 @@
 package contentenc
 
 import (
+	"bytes"
+	"math"
 	"testing"
 
+	"github.com/hanwen/go-fuse/v2/fuse"
+
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 )
 
@@ -24,7 +28,7 @@ func TestSplitRange(t *testing.T) {
 
 	key := make([]byte, cryptocore.KeyLen)
 	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
-	f := New(cc, DefaultBS, false)
+	f := New(cc, DefaultBS, false, false)
 
 	for _, r := range ranges {
 		parts := f.ExplodePlainRange(r.offset, r.length)
@@ -52,7 +56,7 @@ func TestCiphertextRange(t *testing.T) {
 
 	key := make([]byte, cryptocore.KeyLen)
 	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
-	f := New(cc, DefaultBS, false)
+	f := New(cc, DefaultBS, false, false)
 
 	for _, r := range ranges {
 
@@ -75,7 +79,7 @@ func TestCiphertextRange(t *testing.T) {
 func TestBlockNo(t *testing.T) {
 	key := make([]byte, cryptocore.KeyLen)
 	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
-	f := New(cc, DefaultBS, false)
+	f := New(cc, DefaultBS, false, false)
 
 	b := f.CipherOffToBlockNo(788)
 	if b != 0 {
@@ -94,3 +98,169 @@ func TestBlockNo(t *testing.T) {
 		t.Errorf("actual: %d", b)
 	}
 }
+
+// TestMaxPlainSize checks that the ciphertext size of the largest possible
+// plaintext file fits into an int64, and that one more byte does not.
+func TestMaxPlainSize(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	f := New(cc, DefaultBS, false, false)
+	max := f.MaxPlainSize()
+	if c := f.PlainSizeToCipherSize(max); c > math.MaxInt64 {
+		t.Errorf("ciphertext size %d of max plaintext size %d overflows int64", c, max)
+	}
+	if c := f.PlainSizeToCipherSize(max + 1); c <= math.MaxInt64 {
+		t.Errorf("max plaintext size %d is too small, %d would still fit", max, max+1)
+	}
+	if p := f.CipherSizeToPlainSize(f.PlainSizeToCipherSize(max)); p != max {
+		t.Errorf("round-trip mismatch: %d != %d", p, max)
+	}
+}
+
+// BenchmarkEncryptBlocks encrypts one maximum-sized FUSE write request
+func BenchmarkEncryptBlocks(b *testing.B) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	f := New(cc, DefaultBS, false, false)
+	plaintext := make([]byte, fuse.MAX_KERNEL_WRITE)
+	var blocks [][]byte
+	for i := 0; i < len(plaintext); i += DefaultBS {
+		blocks = append(blocks, plaintext[i:i+DefaultBS])
+	}
+	fileID := make([]byte, headerIDLen)
+	b.SetBytes(int64(len(plaintext)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ciphertext := f.EncryptBlocks(blocks, 0, fileID)
+		f.CReqPool.Put(ciphertext)
+	}
+}
+
+// BenchmarkDecryptBlocks decrypts one maximum-sized FUSE read request
+func BenchmarkDecryptBlocks(b *testing.B) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	f := New(cc, DefaultBS, false, false)
+	plaintext := make([]byte, fuse.MAX_KERNEL_WRITE)
+	var blocks [][]byte
+	for i := 0; i < len(plaintext); i += DefaultBS {
+		blocks = append(blocks, plaintext[i:i+DefaultBS])
+	}
+	fileID := make([]byte, headerIDLen)
+	ciphertext := f.EncryptBlocks(blocks, 0, fileID)
+	b.SetBytes(int64(len(plaintext)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		out, err := f.DecryptBlocks(ciphertext, 0, fileID)
+		if err != nil {
+			b.Fatal(err)
+		}
+		f.PReqPool.Put(out)
+	}
+}
+
+// TestEncryptDecryptBlocks round-trips requests of different sizes, including
+// a partial last block and requests large enough for parallel encryption.
+func TestEncryptDecryptBlocks(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	f := New(cc, DefaultBS, false, false)
+	fileID := make([]byte, headerIDLen)
+	for _, size := range []int{1, DefaultBS, DefaultBS + 1, 32*DefaultBS - 7, fuse.MAX_KERNEL_WRITE} {
+		plaintext := make([]byte, size)
+		for i := range plaintext {
+			plaintext[i] = byte(i * 7)
+		}
+		var blocks [][]byte
+		for i := 0; i < size; i += DefaultBS {
+			end := i + DefaultBS
+			if end > size {
+				end = size
+			}
+			blocks = append(blocks, plaintext[i:end])
+		}
+		ciphertext := f.EncryptBlocks(blocks, 5, fileID)
+		if want := int(f.PlainSizeToCipherSize(uint64(size)) - HeaderLen); len(ciphertext) != want {
+			t.Fatalf("size %d: ciphertext len %d, want %d", size, len(ciphertext), want)
+		}
+		out, err := f.DecryptBlocks(ciphertext, 5, fileID)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(out, plaintext) {
+			t.Errorf("size %d: content mismatch", size)
+		}
+		// Wrong block number must fail authentication
+		if _, err = f.DecryptBlocks(ciphertext, 6, fileID); err == nil {
+			t.Errorf("size %d: decrypting with the wrong block number worked", size)
+		}
+		f.CReqPool.Put(ciphertext)
+		f.PReqPool.Put(out)
+	}
+}
+
+// TestMergeBlocksInPlace checks that the gap between old and new data is
+// zeroed even if the buffer contains stale data.
+func TestMergeBlocksInPlace(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	f := New(cc, DefaultBS, false, false)
+	buf := bytes.Repeat([]byte("s"), DefaultBS)
+	out := f.MergeBlocksInPlace(buf[:3], []byte("new"), 6)
+	if want := []byte("sss\x00\x00\x00new"); !bytes.Equal(out, want) {
+		t.Errorf("want %q, got %q", want, out)
+	}
+	if out2 := f.MergeBlocks([]byte("sss"), []byte("new"), 6); !bytes.Equal(out, out2) {
+		t.Errorf("MergeBlocks differs: %q", out2)
+	}
+}
+
+// TestEncryptBlocksWithHeader checks that the header is placed in front of
+// the ciphertext, and that this costs no extra allocations compared to
+// EncryptBlocks.
+func TestEncryptBlocksWithHeader(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	f := New(cc, DefaultBS, false, false)
+	h := RandomHeader()
+	header := h.Pack()
+	for _, size := range []int{1, DefaultBS + 1, fuse.MAX_KERNEL_WRITE} {
+		plaintext := bytes.Repeat([]byte("x"), size)
+		var blocks [][]byte
+		for i := 0; i < size; i += DefaultBS {
+			end := i + DefaultBS
+			if end > size {
+				end = size
+			}
+			blocks = append(blocks, plaintext[i:end])
+		}
+		buf := f.EncryptBlocksWithHeader(header, blocks, 0, h.ID)
+		if want := int(f.PlainSizeToCipherSize(uint64(size))); len(buf) != want {
+			t.Fatalf("size %d: len %d, want %d", size, len(buf), want)
+		}
+		if !bytes.Equal(buf[:HeaderLen], header) {
+			t.Errorf("size %d: header mismatch", size)
+		}
+		out, err := f.DecryptBlocks(buf[HeaderLen:], 0, h.ID)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(out, plaintext) {
+			t.Errorf("size %d: content mismatch", size)
+		}
+		f.CReqPool.Put(buf)
+		f.PReqPool.Put(out)
+
+		without := testing.AllocsPerRun(10, func() {
+			f.CReqPool.Put(f.EncryptBlocks(blocks, 0, h.ID))
+		})
+		with := testing.AllocsPerRun(10, func() {
+			f.CReqPool.Put(f.EncryptBlocksWithHeader(header, blocks, 0, h.ID))
+		})
+		if with > without {
+			t.Errorf("size %d: %v allocations with header, %v without", size, with, without)
+		}
+	}
+}
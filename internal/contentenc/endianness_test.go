@@ -0,0 +1,113 @@
+package contentenc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+// The vectors below were created on a little-endian (amd64) machine. All
+// numbers in the on-disk format are big-endian, so they must come out the
+// same on big-endian machines. The block number is chosen so that each of
+// its bytes is different, and the host byte order cannot give the same
+// result by accident.
+const (
+	testVectorBlockNo   = 0x0102030405060708
+	testVectorPlaintext = "gocryptfs on-disk format"
+	testVectorHeader    = "0002a0a1a2a3a4a5a6a7a8a9aaabacadaeaf"
+	testVectorGCM       = "101112131415161718191a1b1c1d1e1f5001aa9b7dc9dda3fd3ec837c248f6284f1e7eb51cb96d130506e8b8e904cf4b0b3f4da55f2cba17"
+	testVectorSIV       = "101112131415161718191a1b1c1d1e1ffade5d4a30de83626225a6bfe65fbbfb96ef56e0ee2c0920a26b9080a357770c79c4e8a104c068f9"
+	// testVectorGCM with "-blockcrc"
+	testVectorGCMCRC = testVectorGCM + "0a825f2e"
+)
+
+func testVectorBytes(n int, start byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = start + byte(i)
+	}
+	return b
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestOnDiskFormatHeader checks that the file header is serialized the same
+// way on every host
+func TestOnDiskFormatHeader(t *testing.T) {
+	id := testVectorBytes(headerIDLen, 0xa0)
+	h := FileHeader{Version: CurrentVersion, ID: id}
+	want := mustDecodeHex(t, testVectorHeader)
+	if !bytes.Equal(h.Pack(), want) {
+		t.Errorf("Pack: want %x, got %x", want, h.Pack())
+	}
+	h2, err := ParseHeader(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h2.Version != CurrentVersion || !bytes.Equal(h2.ID, id) {
+		t.Errorf("ParseHeader: got %v", h2)
+	}
+	// Reading the version in little-endian order, as a naive reader on the
+	// "wrong" machine would, gives 512, which ParseHeader must reject
+	swapped := append([]byte{}, want...)
+	binary.LittleEndian.PutUint16(swapped, CurrentVersion)
+	if _, err = ParseHeader(swapped); err == nil {
+		t.Error("ParseHeader accepted a byte-swapped version")
+	}
+}
+
+// TestOnDiskFormatBlocks checks that blocks encrypted on a little-endian
+// machine decrypt on this one, and that encryption reproduces them
+// byte-for-byte
+func TestOnDiskFormatBlocks(t *testing.T) {
+	key := testVectorBytes(cryptocore.KeyLen, 0)
+	fileID := testVectorBytes(headerIDLen, 0xa0)
+	testCases := []struct {
+		backend  cryptocore.AEADTypeEnum
+		blockCRC bool
+		vector   string
+	}{
+		{cryptocore.BackendGoGCM, false, testVectorGCM},
+		{cryptocore.BackendAESSIV, false, testVectorSIV},
+		{cryptocore.BackendGoGCM, true, testVectorGCMCRC},
+	}
+	for _, tc := range testCases {
+		cc := cryptocore.New(key, tc.backend, DefaultIVBits, true, false)
+		f := New(cc, DefaultBS, false, tc.blockCRC)
+		vector := mustDecodeHex(t, tc.vector)
+		plaintext, err := f.DecryptBlock(vector, testVectorBlockNo, fileID)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.vector, err)
+		}
+		if string(plaintext) != testVectorPlaintext {
+			t.Errorf("%s: want %q, got %q", tc.vector, testVectorPlaintext, plaintext)
+		}
+		nonce := vector[:cc.IVLen]
+		ciphertext := f.doEncryptBlock([]byte(testVectorPlaintext), testVectorBlockNo, fileID, nonce)
+		if !bytes.Equal(ciphertext, vector) {
+			t.Errorf("encryption mismatch:\nwant %x\ngot  %x", vector, ciphertext)
+		}
+		// Emulate a machine that puts the block number into the associated
+		// data in little-endian order. It must not be able to decrypt the
+		// block.
+		if tc.blockCRC {
+			continue
+		}
+		aData := make([]byte, 8, 8+headerIDLen)
+		binary.LittleEndian.PutUint64(aData, testVectorBlockNo)
+		aData = append(aData, fileID...)
+		_, err = cc.AEADCipher.Open(nil, nonce, vector[len(nonce):], aData)
+		if err == nil {
+			t.Errorf("%s: decrypted with a little-endian block number", tc.vector)
+		}
+	}
+}
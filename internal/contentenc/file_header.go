@@ -3,6 +3,9 @@ package contentenc
 // Per-file header
 //
 // Format: [ "Version" uint16 big endian ] [ "Id" 16 random bytes ]
+//
+// The version is CurrentVersion, or BlockCRCVersion if the blocks of the file
+// carry a CRC32C.
 
 import (
 	"bytes"
@@ -32,7 +35,7 @@ type FileHeader struct {
 
 // Pack - serialize fileHeader object
 func (h *FileHeader) Pack() []byte {
-	if len(h.ID) != headerIDLen || h.Version != CurrentVersion {
+	if len(h.ID) != headerIDLen || (h.Version != CurrentVersion && h.Version != BlockCRCVersion) {
 		log.Panic("FileHeader object not properly initialized")
 	}
 	buf := make([]byte, HeaderLen)
@@ -56,9 +59,9 @@ func ParseHeader(buf []byte) (*FileHeader, error) {
 	}
 	var h FileHeader
 	h.Version = binary.BigEndian.Uint16(buf[0:headerVersionLen])
-	if h.Version != CurrentVersion {
-		return nil, fmt.Errorf("ParseHeader: invalid version, want=%d have=%d. Header hexdump: %s",
-			CurrentVersion, h.Version, hex.EncodeToString(buf))
+	if h.Version != CurrentVersion && h.Version != BlockCRCVersion {
+		return nil, fmt.Errorf("ParseHeader: invalid version, want=%d or %d have=%d. Header hexdump: %s",
+			CurrentVersion, BlockCRCVersion, h.Version, hex.EncodeToString(buf))
 	}
 	h.ID = buf[headerVersionLen:]
 	if bytes.Equal(h.ID, allZeroFileID) {
@@ -75,3 +78,34 @@ func RandomHeader() *FileHeader {
 	h.ID = cryptocore.RandBytes(headerIDLen)
 	return &h
 }
+
+// HeaderVersion returns the file header version that goes with the block
+// format of "be"
+func (be *ContentEnc) HeaderVersion() uint16 {
+	if be.blockCRC {
+		return BlockCRCVersion
+	}
+	return CurrentVersion
+}
+
+// RandomHeader - create new fileHeader object with random Id and the header
+// version that goes with the block format of "be"
+func (be *ContentEnc) RandomHeader() *FileHeader {
+	h := RandomHeader()
+	h.Version = be.HeaderVersion()
+	return h
+}
+
+// ParseHeader is like the ParseHeader function, but also checks that the
+// header version goes with the block format of "be"
+func (be *ContentEnc) ParseHeader(buf []byte) (*FileHeader, error) {
+	h, err := ParseHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	if want := be.HeaderVersion(); h.Version != want {
+		return nil, fmt.Errorf("ParseHeader: header version %d does not match the filesystem, want=%d",
+			h.Version, want)
+	}
+	return h, nil
+}
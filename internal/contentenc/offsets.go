@@ -2,6 +2,7 @@ package contentenc
 
 import (
 	"log"
+	"math"
 
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
@@ -79,6 +80,23 @@ func (be *ContentEnc) PlainSizeToCipherSize(plainSize uint64) uint64 {
 	return plainSize + overhead
 }
 
+// MaxPlainSize returns the largest plaintext file size whose ciphertext size
+// still fits into an int64, which is the limit for file sizes and offsets
+// of the backing file. Every block adds overhead, so this is a bit smaller
+// than math.MaxInt64. Operations that would go beyond this size must fail
+// with EFBIG instead of wrapping around in the offset calculations.
+func (be *ContentEnc) MaxPlainSize() uint64 {
+	const maxCipherSize = uint64(math.MaxInt64)
+	blocks := (maxCipherSize - HeaderLen) / be.cipherBS
+	rest := (maxCipherSize - HeaderLen) % be.cipherBS
+	plainSize := blocks * be.plainBS
+	// The last, partial block needs room for its own overhead
+	if rest > be.BlockOverhead() {
+		plainSize += rest - be.BlockOverhead()
+	}
+	return plainSize
+}
+
 // ExplodePlainRange splits a plaintext byte range into (possibly partial) blocks
 // Returns an empty slice if length == 0.
 func (be *ContentEnc) ExplodePlainRange(offset uint64, length uint64) []IntraBlock {
@@ -126,6 +144,23 @@ func (be *ContentEnc) ExplodeCipherRange(offset uint64, length uint64) []IntraBl
 	return blocks
 }
 
+// CipherSizeToBlocks returns the number of blocks in a ciphertext file of
+// "cipherSize" bytes. The last block may be partial.
+func (be *ContentEnc) CipherSizeToBlocks(cipherSize uint64) uint64 {
+	if cipherSize <= HeaderLen {
+		return 0
+	}
+	return be.CipherOffToBlockNo(cipherSize-1) + 1
+}
+
+// CipherSectorsToPlainSectors converts the allocation of a ciphertext file,
+// in 512-byte sectors as reported in st_blocks, to the allocation that the
+// plaintext accounts for. The crypto overhead is removed proportionally,
+// rounding up, so a file that has any data allocated never shows zero.
+func (be *ContentEnc) CipherSectorsToPlainSectors(sectors uint64) uint64 {
+	return (sectors*be.plainBS + be.cipherBS - 1) / be.cipherBS
+}
+
 // BlockOverhead returns the per-block overhead.
 func (be *ContentEnc) BlockOverhead() uint64 {
 	return be.cipherBS - be.plainBS
@@ -9,9 +9,11 @@ import (
 	"fmt"
 	"log"
 	"runtime"
+	"sync"
 
 	"github.com/rfjakob/eme"
 
+	"github.com/rfjakob/gocryptfs/internal/mlock"
 	"github.com/rfjakob/gocryptfs/internal/siv_aead"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
@@ -47,6 +49,9 @@ type CryptoCore struct {
 	// GCM needs unique IVs (nonces)
 	IVGenerator *nonceGenerator
 	IVLen       int
+	// wipeOnce makes Wipe safe to call more than once, and from several
+	// goroutines (signal handler and unmount path)
+	wipeOnce sync.Once
 }
 
 // New returns a new CryptoCore object or panics.
@@ -92,6 +97,7 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool, forceDec
 			gcmKey = hkdfDerive(key, hkdfInfoGCMContent, KeyLen)
 		} else {
 			gcmKey = append([]byte{}, key...)
+			mlock.Lock(gcmKey)
 		}
 		switch aeadType {
 		case BackendOpenSSL:
@@ -127,6 +133,7 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool, forceDec
 		} else {
 			s := sha512.Sum512(key)
 			key64 = s[:]
+			mlock.Lock(key64)
 		}
 		aeadCipher = siv_aead.New(key64)
 		for i := range key64 {
@@ -150,11 +157,25 @@ type wiper interface {
 }
 
 // Wipe tries to wipe secret keys from memory by overwriting them with zeros
-// and/or setting references to nil.
+// and/or setting references to nil. It is called on unmount and when
+// gocryptfs is terminated by a signal. Calling it again is a no-op.
 //
-// This is not bulletproof due to possible GC copies, but
-// still raises to bar for extracting the key.
+// The content keys of the OpenSSL and AES-SIV backends are stored in byte
+// slices we own, and these are overwritten. The Go GCM backend and EME keep
+// their expanded keys inside the Go standard library, where we cannot reach
+// them. For these, we only drop the references and force a GC, so the memory
+// may be reused.
+//
+// This is not bulletproof: the garbage collector may have copied key
+// material around before, and the kernel may have swapped it out. But it
+// still raises the bar for extracting the key.
+//
+// The CryptoCore must not be used anymore after Wipe.
 func (c *CryptoCore) Wipe() {
+	c.wipeOnce.Do(c.wipe)
+}
+
+func (c *CryptoCore) wipe() {
 	be := c.AEADBackend
 	if be == BackendOpenSSL || be == BackendAESSIV {
 		tlog.Debug.Printf("CryptoCore.Wipe: Wiping AEADBackend %d key", be)
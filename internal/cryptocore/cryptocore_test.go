@@ -39,3 +39,49 @@ func TestNewPanic(t *testing.T) {
 	key := make([]byte, 16)
 	New(key, BackendOpenSSL, 128, true, false)
 }
+
+// Wipe must make the keys unusable, and calling it twice must not crash
+func TestWipe(t *testing.T) {
+	key := make([]byte, 32)
+	backends := []AEADTypeEnum{BackendGoGCM, BackendAESSIV}
+	if !stupidgcm.BuiltWithoutOpenssl {
+		backends = append(backends, BackendOpenSSL)
+	}
+	for _, be := range backends {
+		c := New(key, be, 128, true, false)
+		aead := c.AEADCipher
+		c.Wipe()
+		c.Wipe()
+		if c.AEADCipher != nil || c.EMECipher != nil {
+			t.Errorf("backend %d: references not cleared", be)
+		}
+		if be == BackendGoGCM {
+			// We cannot wipe the key inside the Go stdlib
+			continue
+		}
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("backend %d: Seal with a wiped key did not panic", be)
+				}
+			}()
+			aead.Seal(nil, make([]byte, 16), []byte("foo"), nil)
+		}()
+	}
+}
+
+// SelfTest must pass for all backends. OpenSSL must produce the same output
+// as Go GCM.
+func TestSelfTest(t *testing.T) {
+	backends := []AEADTypeEnum{BackendGoGCM, BackendAESSIV}
+	if !stupidgcm.BuiltWithoutOpenssl {
+		backends = append(backends, BackendOpenSSL)
+	}
+	for _, be := range backends {
+		for _, useHKDF := range []bool{true, false} {
+			if err := SelfTest(be, useHKDF); err != nil {
+				t.Errorf("backend %d, hkdf=%v: %v", be, useHKDF, err)
+			}
+		}
+	}
+}
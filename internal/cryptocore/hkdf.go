@@ -5,6 +5,8 @@ import (
 	"log"
 
 	"golang.org/x/crypto/hkdf"
+
+	"github.com/rfjakob/gocryptfs/internal/mlock"
 )
 
 const (
@@ -21,6 +23,7 @@ const (
 func hkdfDerive(masterkey []byte, info string, outLen int) (out []byte) {
 	h := hkdf.New(sha256.New, masterkey, nil, []byte(info))
 	out = make([]byte, outLen)
+	mlock.Lock(out)
 	n, err := h.Read(out)
 	if n != outLen || err != nil {
 		log.Panicf("hkdfDerive: hkdf read failed, got %d bytes, error: %v", n, err)
@@ -30,3 +30,12 @@ type nonceGenerator struct {
 func (n *nonceGenerator) Get() []byte {
 	return randPrefetcher.read(n.nonceLen)
 }
+
+// Read fills "dst" with a random nonce, without allocating. "dst" must be
+// exactly "nonceLen" bytes long.
+func (n *nonceGenerator) Read(dst []byte) {
+	if len(dst) != n.nonceLen {
+		log.Panicf("wrong nonce length %d, want %d", len(dst), n.nonceLen)
+	}
+	randPrefetcher.readInto(dst)
+}
@@ -0,0 +1,98 @@
+package cryptocore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+)
+
+// selfTestVector is a known-answer test for one AEAD backend. The key is
+// 00 01 02 ... 1f, the nonce is 80 81 ... 8f.
+type selfTestVector struct {
+	aessiv  bool
+	useHKDF bool
+	// Output of AEADCipher.Seal(selfTestPlaintext, selfTestAD)
+	aead string
+	// Output of EMECipher.Encrypt with the nonce as the tweak and
+	// selfTestPlaintext padded to 32 bytes with zeros
+	eme string
+}
+
+var backendNames = map[AEADTypeEnum]string{
+	BackendOpenSSL: "OpenSSL GCM",
+	BackendGoGCM:   "Go GCM",
+	BackendAESSIV:  "AES-SIV",
+}
+
+var (
+	selfTestPlaintext = []byte("gocryptfs self-test")
+	selfTestAD        = []byte("additional data")
+)
+
+// The GCM vectors are the output of Go's crypto/cipher. OpenSSL must produce
+// the same.
+var selfTestVectors = []selfTestVector{
+	{false, false,
+		"b07e9266928ad5110fe502a8c68c5f258a52ab3c30ec87c1817aa81e802aca1bec83d1",
+		"136d738edb7ea7c0150a0067aff0adf4854f072a6e9005ce45d33883df64277b"},
+	{false, true,
+		"3dffe81a547f45f27818125c4236e511f387e32aa5accfd9691a8fff6f389dba583764",
+		"6bf0ee888e3957eb2f8af5f9238191aa2a0533283bcef63534e835480eda2701"},
+	{true, false,
+		"b9cd06c4feec402037aa0ac6fd3d8529dcac7dd106f5046081a93ce27805422a4d5391",
+		"136d738edb7ea7c0150a0067aff0adf4854f072a6e9005ce45d33883df64277b"},
+	{true, true,
+		"1d3bef9cbf5e651d56d05e365675afa936aafcc13f11f589278567f1ef2034340ed8c9",
+		"6bf0ee888e3957eb2f8af5f9238191aa2a0533283bcef63534e835480eda2701"},
+}
+
+// SelfTest encrypts a known plaintext using "aeadType" and compares the
+// result with the known ciphertext, then decrypts it again. The same is done
+// for EME. This catches a broken crypto backend (miscompiled, or a CPU
+// feature that has been misdetected) before it is used for real data.
+//
+// Only 128-bit IVs are tested, this is what all current filesystems use.
+func SelfTest(aeadType AEADTypeEnum, useHKDF bool) error {
+	var v *selfTestVector
+	for i := range selfTestVectors {
+		if selfTestVectors[i].aessiv == (aeadType == BackendAESSIV) && selfTestVectors[i].useHKDF == useHKDF {
+			v = &selfTestVectors[i]
+		}
+	}
+	key := make([]byte, KeyLen)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	nonce := make([]byte, 16)
+	for i := range nonce {
+		nonce[i] = byte(0x80 + i)
+	}
+	// The key is not secret, no need to Wipe()
+	c := New(key, aeadType, 128, useHKDF, false)
+	name := backendNames[aeadType]
+	// Content encryption
+	want, _ := hex.DecodeString(v.aead)
+	ciphertext := c.AEADCipher.Seal(nil, nonce, selfTestPlaintext, selfTestAD)
+	if !bytes.Equal(ciphertext, want) {
+		return fmt.Errorf("%s: wrong ciphertext %x", name, ciphertext)
+	}
+	plaintext, err := c.AEADCipher.Open(nil, nonce, ciphertext, selfTestAD)
+	if err != nil {
+		return fmt.Errorf("%s: decryption failed: %v", name, err)
+	}
+	if !bytes.Equal(plaintext, selfTestPlaintext) {
+		return fmt.Errorf("%s: wrong plaintext %x", name, plaintext)
+	}
+	// File name encryption
+	want, _ = hex.DecodeString(v.eme)
+	block := make([]byte, 32)
+	copy(block, selfTestPlaintext)
+	ciphertext = c.EMECipher.Encrypt(nonce, block)
+	if !bytes.Equal(ciphertext, want) {
+		return fmt.Errorf("EME: wrong ciphertext %x", ciphertext)
+	}
+	if plaintext = c.EMECipher.Decrypt(nonce, ciphertext); !bytes.Equal(plaintext, block) {
+		return fmt.Errorf("EME: wrong plaintext %x", plaintext)
+	}
+	return nil
+}
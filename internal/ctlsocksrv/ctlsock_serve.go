@@ -10,6 +10,7 @@ import (
 	"net"
 	"os"
 	"syscall"
+	"time"
 
 	"github.com/rfjakob/gocryptfs/ctlsock"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
@@ -21,11 +22,122 @@ type Interface interface {
 	DecryptPath(string) (string, error)
 }
 
+// StatsInterface is implemented by filesystems that can collect latency
+// statistics ("-stats"). Stats returns nil if collection is disabled.
+type StatsInterface interface {
+	Stats() map[string]ctlsock.OpStats
+}
+
+// StatusInterface is implemented by filesystems that can report the state
+// of the mount.
+type StatusInterface interface {
+	Status() ctlsock.MountStatus
+}
+
+// QuotaInterface is implemented by filesystems that can enforce a quota
+// ("-quota"). Quota returns nil if no quota is set.
+type QuotaInterface interface {
+	Quota() *ctlsock.QuotaStatus
+}
+
+// WatchInterface is implemented by filesystems that can report changes
+// ("-watch"). Watch returns a nil channel if watching is disabled. The
+// channel is closed when the subscriber falls behind; "cancel" ends the
+// subscription.
+type WatchInterface interface {
+	Watch() (events <-chan ctlsock.WatchEvent, cancel func())
+}
+
+// TrashInterface is implemented by filesystems that can move deleted entries
+// into a trash directory ("-trash").
+type TrashInterface interface {
+	TrashList() ([]ctlsock.TrashItem, error)
+	TrashRestore(id string) (string, error)
+	TrashPurge(id string) error
+}
+
+// ReadOnlyInterface is implemented by filesystems that can become read-only
+// after a timeout ("-readonly-after"). ReadOnlyAfter restarts the timer and
+// returns the new deadline.
+type ReadOnlyInterface interface {
+	ReadOnlyAfter(d time.Duration) (time.Time, error)
+}
+
+// PathInfoInterface is implemented by filesystems that can report how a file
+// is stored in CIPHERDIR.
+type PathInfoInterface interface {
+	PathInfo(plainPath string) (*ctlsock.PathInfo, error)
+}
+
+// PrefetchInterface is implemented by filesystems that can walk a subtree in
+// the background to warm the caches. Prefetch starts the walk and fails with
+// EBUSY if one is running already. PrefetchStatus returns nil if no walk has
+// been started yet.
+type PrefetchInterface interface {
+	Prefetch(plainPath string, stat bool) (*ctlsock.PrefetchStatus, error)
+	PrefetchStatus() *ctlsock.PrefetchStatus
+}
+
+// BandwidthInterface is implemented by filesystems that can limit the
+// bandwidth used against CIPHERDIR ("-read-bps", "-write-bps"). Bandwidth
+// returns nil if no limit is set.
+type BandwidthInterface interface {
+	Bandwidth() *ctlsock.BandwidthStatus
+}
+
+// BulkInterface is implemented by filesystems that can change the mode or
+// owner of a whole subtree directly on the backing files. Nil arguments
+// leave the attribute alone.
+type BulkInterface interface {
+	BulkChmod(plainPath string, mode *uint32, dirMode *uint32) (*ctlsock.BulkStatus, error)
+	BulkChown(plainPath string, uid *uint32, gid *uint32) (*ctlsock.BulkStatus, error)
+}
+
+// TransactionInterface is implemented by filesystems that can apply a list
+// of renames and unlinks all or nothing. The paths have already been
+// sanitized.
+type TransactionInterface interface {
+	Transaction(ops []ctlsock.TransactionOp) error
+}
+
 type ctlSockHandler struct {
 	fs     Interface
 	socket *net.UnixListener
+	// readOnly rejects mutating commands, "-ctlsock-ro"
+	readOnly bool
+}
+
+// command describes a request type understood by the control socket.
+type command struct {
+	// name is used in error messages
+	name string
+	// mutating commands change the state of the filesystem and are
+	// rejected on a read-only socket
+	mutating bool
 }
 
+var (
+	cmdEncryptPath   = command{name: "EncryptPath"}
+	cmdDecryptPath   = command{name: "DecryptPath"}
+	cmdStats         = command{name: "Stats"}
+	cmdStatus        = command{name: "Status"}
+	cmdTrashList     = command{name: "TrashList"}
+	cmdTrashRestore  = command{name: "TrashRestore", mutating: true}
+	cmdTrashPurge    = command{name: "TrashPurge", mutating: true}
+	cmdQuota         = command{name: "Quota"}
+	cmdWatch         = command{name: "Watch"}
+	cmdReadOnlyAfter = command{name: "ReadOnlyAfter", mutating: true}
+	cmdPathInfo      = command{name: "PathInfo"}
+	// Prefetch does not change the filesystem, but a monitoring user should
+	// not be able to cause that much IO
+	cmdPrefetch       = command{name: "Prefetch", mutating: true}
+	cmdPrefetchStatus = command{name: "PrefetchStatus"}
+	cmdBandwidth      = command{name: "Bandwidth"}
+	cmdBulkChmod      = command{name: "BulkChmod", mutating: true}
+	cmdBulkChown      = command{name: "BulkChown", mutating: true}
+	cmdTransaction    = command{name: "Transaction", mutating: true}
+)
+
 // Serve serves incoming connections on "sock". This call blocks so you
 // probably want to run it in a new goroutine.
 func Serve(sock net.Listener, fs Interface) {
@@ -36,6 +148,17 @@ func Serve(sock net.Listener, fs Interface) {
 	handler.acceptLoop()
 }
 
+// ServeReadOnly is like Serve, but only allows commands that do not change
+// the state of the filesystem. Mutating commands fail with EPERM.
+func ServeReadOnly(sock net.Listener, fs Interface) {
+	handler := ctlSockHandler{
+		fs:       fs,
+		socket:   sock.(*net.UnixListener),
+		readOnly: true,
+	}
+	handler.acceptLoop()
+}
+
 func (ch *ctlSockHandler) acceptLoop() {
 	for {
 		conn, err := ch.socket.Accept()
@@ -56,6 +179,7 @@ func (ch *ctlSockHandler) acceptLoop() {
 // assumes that the path does not contain too many characters that had to be
 // be escaped in JSON (for example, a null byte blows up to "\u0000").
 // We abort the connection if the request is bigger than this.
+// This also limits the number of operations in a Transaction request.
 const ReadBufSize = 5000
 
 // handleConnection reads and parses JSON requests from "conn"
@@ -93,18 +217,82 @@ func (ch *ctlSockHandler) handleConnection(conn *net.UnixConn) {
 func (ch *ctlSockHandler) handleRequest(in *ctlsock.RequestStruct, conn *net.UnixConn) {
 	var err error
 	var inPath, outPath, clean, warnText string
-	// You cannot perform both decryption and encryption in one request
-	if in.DecryptPath != "" && in.EncryptPath != "" {
+	// Only one request per message
+	n := 0
+	for _, set := range []bool{in.EncryptPath != "", in.DecryptPath != "", in.Stats, in.Status,
+		in.TrashList, in.TrashRestore != "", in.TrashPurge != "", in.Quota, in.Watch,
+		in.ReadOnlyAfter != "", in.PathInfo != "", in.Prefetch != "", in.PrefetchStatus,
+		in.Bandwidth, in.BulkChmod != "", in.BulkChown != "", in.Transaction != nil} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
 		err = errors.New("Ambiguous")
 		sendResponse(conn, err, "", "")
 		return
 	}
+	switch {
+	case in.Stats:
+		ch.handleStats(conn)
+		return
+	case in.Status:
+		ch.handleStatus(conn)
+		return
+	case in.TrashList:
+		ch.handleTrash(conn, cmdTrashList, "")
+		return
+	case in.TrashRestore != "":
+		ch.handleTrash(conn, cmdTrashRestore, in.TrashRestore)
+		return
+	case in.TrashPurge != "":
+		ch.handleTrash(conn, cmdTrashPurge, in.TrashPurge)
+		return
+	case in.Quota:
+		ch.handleQuota(conn)
+		return
+	case in.Watch:
+		ch.handleWatch(conn)
+		return
+	case in.ReadOnlyAfter != "":
+		ch.handleReadOnlyAfter(conn, in.ReadOnlyAfter)
+		return
+	case in.PathInfo != "":
+		ch.handlePathInfo(conn, in.PathInfo)
+		return
+	case in.Prefetch != "":
+		ch.handlePrefetch(conn, cmdPrefetch, in.Prefetch, in.PrefetchStat)
+		return
+	case in.PrefetchStatus:
+		ch.handlePrefetch(conn, cmdPrefetchStatus, "", false)
+		return
+	case in.Bandwidth:
+		ch.handleBandwidth(conn)
+		return
+	case in.BulkChmod != "":
+		ch.handleBulk(conn, cmdBulkChmod, in.BulkChmod, in)
+		return
+	case in.BulkChown != "":
+		ch.handleBulk(conn, cmdBulkChown, in.BulkChown, in)
+		return
+	case in.Transaction != nil:
+		ch.handleTransaction(conn, in.Transaction)
+		return
+	}
 	// Neither encryption nor encryption has been requested, makes no sense
 	if in.DecryptPath == "" && in.EncryptPath == "" {
 		err = errors.New("Empty input")
 		sendResponse(conn, err, "", "")
 		return
 	}
+	cmd := cmdDecryptPath
+	if in.EncryptPath != "" {
+		cmd = cmdEncryptPath
+	}
+	if err = ch.checkAllowed(cmd); err != nil {
+		sendResponse(conn, err, "", "")
+		return
+	}
 	// Canonicalize input path
 	if in.EncryptPath != "" {
 		inPath = in.EncryptPath
@@ -131,6 +319,330 @@ func (ch *ctlSockHandler) handleRequest(in *ctlsock.RequestStruct, conn *net.Uni
 	sendResponse(conn, err, outPath, warnText)
 }
 
+// handleStats answers a Stats request
+func (ch *ctlSockHandler) handleStats(conn *net.UnixConn) {
+	if err := ch.checkAllowed(cmdStats); err != nil {
+		sendResponse(conn, err, "", "")
+		return
+	}
+	var stats map[string]ctlsock.OpStats
+	if sfs, ok := ch.fs.(StatsInterface); ok {
+		stats = sfs.Stats()
+	}
+	if stats == nil {
+		sendResponse(conn, errors.New("Statistics are disabled, mount with -stats"), "", "")
+		return
+	}
+	msg := ctlsock.ResponseStruct{Stats: stats}
+	writeResponse(conn, &msg)
+}
+
+// handleStatus answers a Status request
+func (ch *ctlSockHandler) handleStatus(conn *net.UnixConn) {
+	if err := ch.checkAllowed(cmdStatus); err != nil {
+		sendResponse(conn, err, "", "")
+		return
+	}
+	sfs, ok := ch.fs.(StatusInterface)
+	if !ok {
+		sendResponse(conn, errors.New("Status is not supported by this filesystem"), "", "")
+		return
+	}
+	status := sfs.Status()
+	msg := ctlsock.ResponseStruct{Status: &status}
+	writeResponse(conn, &msg)
+}
+
+// handleQuota answers a Quota request
+func (ch *ctlSockHandler) handleQuota(conn *net.UnixConn) {
+	if err := ch.checkAllowed(cmdQuota); err != nil {
+		sendResponse(conn, err, "", "")
+		return
+	}
+	var quota *ctlsock.QuotaStatus
+	if qfs, ok := ch.fs.(QuotaInterface); ok {
+		quota = qfs.Quota()
+	}
+	if quota == nil {
+		sendResponse(conn, errors.New("No quota set, mount with -quota"), "", "")
+		return
+	}
+	msg := ctlsock.ResponseStruct{Quota: quota}
+	writeResponse(conn, &msg)
+}
+
+// handleBandwidth answers a Bandwidth request
+func (ch *ctlSockHandler) handleBandwidth(conn *net.UnixConn) {
+	if err := ch.checkAllowed(cmdBandwidth); err != nil {
+		sendResponse(conn, err, "", "")
+		return
+	}
+	var bw *ctlsock.BandwidthStatus
+	if bfs, ok := ch.fs.(BandwidthInterface); ok {
+		bw = bfs.Bandwidth()
+	}
+	if bw == nil {
+		sendResponse(conn, errors.New("No bandwidth limit set, mount with -read-bps or -write-bps"), "", "")
+		return
+	}
+	writeResponse(conn, &ctlsock.ResponseStruct{Bandwidth: bw})
+}
+
+// handleWatch answers a Watch request by sending one response per event,
+// until the client goes away
+func (ch *ctlSockHandler) handleWatch(conn *net.UnixConn) {
+	if err := ch.checkAllowed(cmdWatch); err != nil {
+		sendResponse(conn, err, "", "")
+		return
+	}
+	var events <-chan ctlsock.WatchEvent
+	cancel := func() {}
+	if wfs, ok := ch.fs.(WatchInterface); ok {
+		events, cancel = wfs.Watch()
+	}
+	defer cancel()
+	if events == nil {
+		sendResponse(conn, errors.New("Watching is disabled, mount with -watch"), "", "")
+		return
+	}
+	for ev := range events {
+		ev := ev
+		msg := ctlsock.ResponseStruct{Event: &ev}
+		if writeResponse(conn, &msg) != nil {
+			return
+		}
+	}
+	sendResponse(conn, errors.New("Too many pending events, watch has been cancelled"), "", "")
+}
+
+// handleReadOnlyAfter answers a ReadOnlyAfter request. "after" is the new
+// duration of the timer, in time.ParseDuration format.
+func (ch *ctlSockHandler) handleReadOnlyAfter(conn *net.UnixConn, after string) {
+	if err := ch.checkAllowed(cmdReadOnlyAfter); err != nil {
+		sendResponse(conn, err, "", "")
+		return
+	}
+	rfs, ok := ch.fs.(ReadOnlyInterface)
+	if !ok {
+		sendResponse(conn, errors.New("ReadOnlyAfter is not supported by this filesystem"), "", "")
+		return
+	}
+	d, err := time.ParseDuration(after)
+	if err != nil {
+		sendResponse(conn, &os.PathError{Op: cmdReadOnlyAfter.name, Path: after, Err: syscall.EINVAL}, "", "")
+		return
+	}
+	deadline, err := rfs.ReadOnlyAfter(d)
+	if err != nil {
+		// Keep the error number for sendResponse
+		if errno, ok := err.(syscall.Errno); ok {
+			err = &os.PathError{Op: cmdReadOnlyAfter.name, Path: after, Err: errno}
+		}
+		sendResponse(conn, err, "", "")
+		return
+	}
+	sendResponse(conn, nil, deadline.Format(time.RFC3339), "")
+}
+
+// handlePathInfo answers a PathInfo request for the plaintext path "inPath"
+func (ch *ctlSockHandler) handlePathInfo(conn *net.UnixConn, inPath string) {
+	if err := ch.checkAllowed(cmdPathInfo); err != nil {
+		sendResponse(conn, err, "", "")
+		return
+	}
+	pfs, ok := ch.fs.(PathInfoInterface)
+	if !ok {
+		sendResponse(conn, errors.New("PathInfo is not supported by this filesystem"), "", "")
+		return
+	}
+	var warnText string
+	clean := SanitizePath(inPath)
+	if inPath != clean {
+		warnText = fmt.Sprintf("Non-canonical input path '%s' has been interpreted as '%s'.", inPath, clean)
+	}
+	if clean == "" {
+		sendResponse(conn, errors.New("Empty input after canonicalization"), "", warnText)
+		return
+	}
+	info, err := pfs.PathInfo(clean)
+	if err != nil {
+		// Keep the error number for sendResponse
+		if errno, ok := err.(syscall.Errno); ok {
+			err = &os.PathError{Op: cmdPathInfo.name, Path: clean, Err: errno}
+		}
+		sendResponse(conn, err, "", warnText)
+		return
+	}
+	msg := ctlsock.ResponseStruct{PathInfo: info, WarnText: warnText}
+	writeResponse(conn, &msg)
+}
+
+// handlePrefetch answers the Prefetch and PrefetchStatus requests. "inPath"
+// is the plaintext path to walk, where "/" means the whole filesystem.
+func (ch *ctlSockHandler) handlePrefetch(conn *net.UnixConn, cmd command, inPath string, stat bool) {
+	if err := ch.checkAllowed(cmd); err != nil {
+		sendResponse(conn, err, "", "")
+		return
+	}
+	pfs, ok := ch.fs.(PrefetchInterface)
+	if !ok {
+		sendResponse(conn, errors.New("Prefetch is not supported by this filesystem"), "", "")
+		return
+	}
+	if cmd == cmdPrefetchStatus {
+		status := pfs.PrefetchStatus()
+		if status == nil {
+			sendResponse(conn, errors.New("No Prefetch has been started"), "", "")
+			return
+		}
+		writeResponse(conn, &ctlsock.ResponseStruct{Prefetch: status})
+		return
+	}
+	var warnText string
+	clean := SanitizePath(inPath)
+	if inPath != clean && inPath != "/" {
+		warnText = fmt.Sprintf("Non-canonical input path '%s' has been interpreted as '%s'.", inPath, clean)
+	}
+	status, err := pfs.Prefetch(clean, stat)
+	if err != nil {
+		// Keep the error number for sendResponse
+		if errno, ok := err.(syscall.Errno); ok {
+			err = &os.PathError{Op: cmd.name, Path: inPath, Err: errno}
+		}
+		sendResponse(conn, err, "", warnText)
+		return
+	}
+	writeResponse(conn, &ctlsock.ResponseStruct{Prefetch: status, WarnText: warnText})
+}
+
+// handleBulk answers the BulkChmod and BulkChown requests. "inPath" is the
+// plaintext path of the subtree, where "/" means the whole filesystem.
+func (ch *ctlSockHandler) handleBulk(conn *net.UnixConn, cmd command, inPath string, in *ctlsock.RequestStruct) {
+	if err := ch.checkAllowed(cmd); err != nil {
+		sendResponse(conn, err, "", "")
+		return
+	}
+	bfs, ok := ch.fs.(BulkInterface)
+	if !ok {
+		sendResponse(conn, errors.New(cmd.name+" is not supported by this filesystem"), "", "")
+		return
+	}
+	var warnText string
+	clean := SanitizePath(inPath)
+	if inPath != clean && inPath != "/" {
+		warnText = fmt.Sprintf("Non-canonical input path '%s' has been interpreted as '%s'.", inPath, clean)
+	}
+	var status *ctlsock.BulkStatus
+	var err error
+	if cmd == cmdBulkChmod {
+		if in.BulkMode == nil && in.BulkDirMode == nil {
+			err = &os.PathError{Op: cmd.name, Path: "BulkMode and BulkDirMode are both missing", Err: syscall.EINVAL}
+		} else {
+			status, err = bfs.BulkChmod(clean, in.BulkMode, in.BulkDirMode)
+		}
+	} else {
+		if in.BulkUID == nil && in.BulkGID == nil {
+			err = &os.PathError{Op: cmd.name, Path: "BulkUID and BulkGID are both missing", Err: syscall.EINVAL}
+		} else {
+			status, err = bfs.BulkChown(clean, in.BulkUID, in.BulkGID)
+		}
+	}
+	if err != nil {
+		// Keep the error number for sendResponse
+		if errno, ok := err.(syscall.Errno); ok {
+			err = &os.PathError{Op: cmd.name, Path: inPath, Err: errno}
+		}
+		sendResponse(conn, err, "", warnText)
+		return
+	}
+	writeResponse(conn, &ctlsock.ResponseStruct{Bulk: status, WarnText: warnText})
+}
+
+// handleTransaction answers a Transaction request
+func (ch *ctlSockHandler) handleTransaction(conn *net.UnixConn, ops []ctlsock.TransactionOp) {
+	if err := ch.checkAllowed(cmdTransaction); err != nil {
+		sendResponse(conn, err, "", "")
+		return
+	}
+	tfs, ok := ch.fs.(TransactionInterface)
+	if !ok {
+		sendResponse(conn, errors.New("Transaction is not supported by this filesystem"), "", "")
+		return
+	}
+	var warnText string
+	clean := make([]ctlsock.TransactionOp, len(ops))
+	for i, op := range ops {
+		bad := ""
+		switch {
+		case op.Op != ctlsock.TransactionRename && op.Op != ctlsock.TransactionUnlink:
+			bad = fmt.Sprintf("unknown Op %q", op.Op)
+		case op.Op == ctlsock.TransactionRename && op.NewPath == "":
+			bad = "NewPath is missing"
+		case op.Op == ctlsock.TransactionUnlink && op.NewPath != "":
+			bad = "NewPath is only used by rename"
+		}
+		clean[i] = ctlsock.TransactionOp{Op: op.Op, Path: SanitizePath(op.Path), NewPath: SanitizePath(op.NewPath)}
+		if bad == "" && (clean[i].Path == "" || op.Op == ctlsock.TransactionRename && clean[i].NewPath == "") {
+			bad = "empty path after canonicalization"
+		}
+		if bad != "" {
+			err := &os.PathError{Op: cmdTransaction.name, Path: fmt.Sprintf("operation %d: %s", i, bad), Err: syscall.EINVAL}
+			sendResponse(conn, err, "", "")
+			return
+		}
+		if clean[i].Path != op.Path || clean[i].NewPath != op.NewPath {
+			warnText = "Non-canonical input paths have been canonicalized."
+		}
+	}
+	if len(clean) == 0 {
+		sendResponse(conn, &os.PathError{Op: cmdTransaction.name, Path: "no operations", Err: syscall.EINVAL}, "", "")
+		return
+	}
+	sendResponse(conn, tfs.Transaction(clean), "", warnText)
+}
+
+// handleTrash answers the TrashList, TrashRestore and TrashPurge requests.
+// "id" is the trashed entry to restore or purge.
+func (ch *ctlSockHandler) handleTrash(conn *net.UnixConn, cmd command, id string) {
+	if err := ch.checkAllowed(cmd); err != nil {
+		sendResponse(conn, err, "", "")
+		return
+	}
+	tfs, ok := ch.fs.(TrashInterface)
+	if !ok {
+		sendResponse(conn, errors.New("Trash is not supported by this filesystem"), "", "")
+		return
+	}
+	var err error
+	var msg ctlsock.ResponseStruct
+	switch cmd {
+	case cmdTrashList:
+		msg.Trash, err = tfs.TrashList()
+	case cmdTrashRestore:
+		msg.Result, err = tfs.TrashRestore(id)
+	case cmdTrashPurge:
+		err = tfs.TrashPurge(id)
+	}
+	if err != nil {
+		// Keep the error number for sendResponse
+		if errno, ok := err.(syscall.Errno); ok {
+			err = &os.PathError{Op: cmd.name, Path: id, Err: errno}
+		}
+		sendResponse(conn, err, "", "")
+		return
+	}
+	writeResponse(conn, &msg)
+}
+
+// checkAllowed returns EPERM if "cmd" is not allowed on this socket.
+func (ch *ctlSockHandler) checkAllowed(cmd command) error {
+	if ch.readOnly && cmd.mutating {
+		tlog.Info.Printf("ctlsock: rejecting %s on read-only socket", cmd.name)
+		return &os.PathError{Op: cmd.name, Path: "read-only control socket", Err: syscall.EPERM}
+	}
+	return nil
+}
+
 // sendResponse sends a JSON response message
 func sendResponse(conn *net.UnixConn, err error, result string, warnText string) {
 	msg := ctlsock.ResponseStruct{
@@ -149,10 +661,15 @@ func sendResponse(conn *net.UnixConn, err error, result string, warnText string)
 			msg.ErrNo = int32(syscall.ENOENT)
 		}
 	}
+	writeResponse(conn, &msg)
+}
+
+// writeResponse marshals "msg" and sends it
+func writeResponse(conn *net.UnixConn, msg *ctlsock.ResponseStruct) error {
 	jsonMsg, err := json.Marshal(msg)
 	if err != nil {
 		tlog.Warn.Printf("ctlsock: Marshal failed: %v", err)
-		return
+		return err
 	}
 	// For convenience for the user, add a newline at the end.
 	jsonMsg = append(jsonMsg, '\n')
@@ -160,4 +677,5 @@ func sendResponse(conn *net.UnixConn, err error, result string, warnText string)
 	if err != nil {
 		tlog.Warn.Printf("ctlsock: Write failed: %v", err)
 	}
+	return err
 }
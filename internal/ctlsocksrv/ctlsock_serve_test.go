@@ -0,0 +1,29 @@
+package ctlsocksrv
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestCheckAllowed(t *testing.T) {
+	mutating := command{name: "Test", mutating: true}
+	rw := ctlSockHandler{}
+	ro := ctlSockHandler{readOnly: true}
+	for _, cmd := range []command{cmdEncryptPath, cmdDecryptPath, mutating} {
+		if err := rw.checkAllowed(cmd); err != nil {
+			t.Errorf("%s should be allowed on the normal socket: %v", cmd.name, err)
+		}
+	}
+	for _, cmd := range []command{cmdEncryptPath, cmdDecryptPath, cmdStats, cmdStatus, cmdTrashList, cmdQuota, cmdWatch, cmdPathInfo, cmdPrefetchStatus, cmdBandwidth} {
+		if err := ro.checkAllowed(cmd); err != nil {
+			t.Errorf("%s should be allowed on the read-only socket: %v", cmd.name, err)
+		}
+	}
+	for _, cmd := range []command{mutating, cmdTrashRestore, cmdTrashPurge, cmdReadOnlyAfter, cmdPrefetch, cmdBulkChmod, cmdBulkChown, cmdTransaction} {
+		err := ro.checkAllowed(cmd)
+		if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EPERM {
+			t.Errorf("%s on read-only socket: want EPERM, got %v", cmd.name, err)
+		}
+	}
+}
@@ -70,6 +70,19 @@ const (
 	ExcludeError = 29
 	// DevNull means that /dev/null could not be opened
 	DevNull = 30
+	// Mlock means that key material could not be locked into RAM, and
+	// "-mlock-strict" was passed
+	Mlock = 31
+	// SelfTest means that the crypto self-test at mount time failed
+	SelfTest = 32
+	// ExecHook means that a "-exec-after-mount" or "-exec-after-unmount"
+	// command failed and "-exec-strict" was passed
+	ExecHook = 33
+	// KeyMismatch means that "-same-masterkey" found different master keys
+	KeyMismatch = 34
+	// FIDO2 means that the FIDO2 second factor could not be used, for
+	// example because the device is not present
+	FIDO2 = 35
 )
 
 // Err wraps an error with an associated numeric exit code
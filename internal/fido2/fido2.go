@@ -0,0 +1,147 @@
+// Package fido2 uses a FIDO2 hardware key with the hmac-secret extension as
+// a second factor, "-fido2" on the command line. It talks to the key through
+// the fido2-cred and fido2-assert programs from libfido2.
+package fido2
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/mlock"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// relyingPartyID identifies gocryptfs to the key
+	relyingPartyID = "gocryptfs"
+	// SaltLen is the length of the hmac-secret salt stored in the config
+	// file
+	SaltLen = 32
+)
+
+// fido2Err returns an error with exit code exitcodes.FIDO2
+func fido2Err(format string, a ...interface{}) error {
+	return exitcodes.NewErr(fmt.Sprintf(format, a...), exitcodes.FIDO2)
+}
+
+// check verifies that the libfido2 tool "prog" is installed and that
+// "device" exists. The tools do not say clearly that the device is missing.
+func check(prog string, device string) error {
+	if _, err := exec.LookPath(prog); err != nil {
+		return fido2Err("%s not found, please install the libfido2 command line tools", prog)
+	}
+	if _, err := os.Stat(device); err != nil {
+		return fido2Err("FIDO2 device %q not found, is the key plugged in? %v", device, err)
+	}
+	return nil
+}
+
+// run executes the libfido2 tool "prog" with "args". The lines in "stdin"
+// are fed to its standard input. Returns the lines of its standard output,
+// and its standard error if it fails.
+// The tool itself asks for the PIN on the terminal if it needs one.
+func run(prog string, device string, stdin []string, args ...string) ([]string, string, error) {
+	cmd := exec.Command(prog, append(args, device)...)
+	cmd.Stdin = strings.NewReader(strings.Join(stdin, "\n") + "\n")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		return nil, msg, fido2Err("%s failed: %v: %s", prog, err, msg)
+	}
+	return strings.Split(stdout.String(), "\n"), "", nil
+}
+
+// runPIN calls check and run. If the tool fails, it tries again with "-v",
+// which makes the tool ask for the PIN of the key. A key that does not
+// know the credential fails the same way with a PIN, so that error is
+// returned right away.
+func runPIN(prog string, device string, stdin []string, args ...string) ([]string, error) {
+	if err := check(prog, device); err != nil {
+		return nil, err
+	}
+	out, stderr, err := run(prog, device, stdin, args...)
+	if err == nil || strings.Contains(stderr, "FIDO_ERR_NO_CREDENTIALS") {
+		return out, err
+	}
+	tlog.Info.Printf("FIDO2: %v", err)
+	tlog.Info.Printf("FIDO2: trying again with PIN, touch your key when it blinks")
+	out, _, err = run(prog, device, stdin, append(args, "-v")...)
+	return out, err
+}
+
+// field decodes the base64 line "i" of the output of "prog"
+func field(prog string, out []string, i int) ([]byte, error) {
+	if len(out) <= i {
+		return nil, fido2Err("%s: short output, got %d lines", prog, len(out))
+	}
+	b, err := base64.StdEncoding.DecodeString(out[i])
+	if err != nil || len(b) == 0 {
+		return nil, fido2Err("%s: invalid output line %d: %v", prog, i+1, err)
+	}
+	return b, nil
+}
+
+// Register creates a new credential with the hmac-secret extension on the
+// key at "device" and returns its ID.
+func Register(device string) ([]byte, error) {
+	tlog.Info.Printf("FIDO2: creating a credential, touch your key when it blinks")
+	cdh := base64.StdEncoding.EncodeToString(cryptocore.RandBytes(32))
+	userID := base64.StdEncoding.EncodeToString(cryptocore.RandBytes(32))
+	// fido2-cred -M reads the client data hash, the relying party ID, the
+	// user name and the user ID, and prints the client data hash, the
+	// relying party ID, the format, the authenticator data and the
+	// credential ID, followed by the attestation.
+	out, err := runPIN("fido2-cred", device, []string{cdh, relyingPartyID, relyingPartyID, userID}, "-M", "-h")
+	if err != nil {
+		return nil, err
+	}
+	return field("fido2-cred", out, 4)
+}
+
+// Secret asks the key at "device" for the hmac-secret of "credentialID"
+// and "salt".
+func Secret(device string, credentialID []byte, salt []byte) ([]byte, error) {
+	tlog.Info.Printf("FIDO2: touch your key when it blinks")
+	cdh := base64.StdEncoding.EncodeToString(cryptocore.RandBytes(32))
+	stdin := []string{cdh, relyingPartyID,
+		base64.StdEncoding.EncodeToString(credentialID),
+		base64.StdEncoding.EncodeToString(salt)}
+	// fido2-assert -G reads the client data hash, the relying party ID, the
+	// credential ID and the salt, and prints the client data hash, the
+	// relying party ID, the authenticator data, the signature and the
+	// hmac-secret.
+	out, err := runPIN("fido2-assert", device, stdin, "-G", "-h")
+	if err != nil {
+		return nil, err
+	}
+	secret, err := field("fido2-assert", out, 4)
+	if err != nil {
+		return nil, err
+	}
+	mlock.Lock(secret)
+	return secret, nil
+}
+
+// Combine mixes the password and the FIDO2 secret into the input for
+// scrypt, using HKDF-Extract with the FIDO2 secret as salt. Unlocking needs
+// both. The secret is wiped.
+func Combine(password []byte, secret []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(password)
+	combined := h.Sum(nil)
+	for i := range secret {
+		secret[i] = 0
+	}
+	mlock.Lock(combined)
+	return combined
+}
@@ -0,0 +1,97 @@
+package fido2
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+)
+
+// fakeTools puts fido2-cred and fido2-assert scripts into PATH that behave
+// like the real tools with a key that has a PIN: fido2-assert fails without
+// "-v". The hmac-secret it returns is the salt. Returns a fake device path.
+func fakeTools(t *testing.T) (device string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "fido2_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scripts := map[string]string{
+		"fido2-cred": `#!/bin/sh
+read cdh; read rp; read user; read uid
+printf '%s\n%s\npacked\nYXV0aA==\nY3JlZGVudGlhbA==\nc2ln\n' "$cdh" "$rp"
+`,
+		"fido2-assert": `#!/bin/sh
+case " $* " in *" -v "*) ;; *) echo "FIDO_ERR_PIN_REQUIRED" >&2; exit 1;; esac
+read cdh; read rp; read cred; read salt
+[ "$cred" = "Y3JlZGVudGlhbA==" ] || { echo "FIDO_ERR_NO_CREDENTIALS" >&2; exit 1; }
+printf '%s\n%s\nYXV0aA==\nc2ln\n%s\n' "$cdh" "$rp" "$salt"
+`,
+	}
+	for name, content := range scripts {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	device = filepath.Join(dir, "hidraw0")
+	if err = ioutil.WriteFile(device, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+":"+oldPath)
+	return device, func() {
+		os.Setenv("PATH", oldPath)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRegisterSecret(t *testing.T) {
+	device, cleanup := fakeTools(t)
+	defer cleanup()
+	credentialID, err := Register(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(credentialID) != "credential" {
+		t.Errorf("wrong credential ID %q", credentialID)
+	}
+	salt := bytes.Repeat([]byte{1}, SaltLen)
+	secret, err := Secret(device, credentialID, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(secret, salt) {
+		t.Errorf("wrong secret %x", secret)
+	}
+	if _, err = Secret(device, []byte("other"), salt); err == nil {
+		t.Error("unknown credential should fail")
+	}
+}
+
+func TestDeviceMissing(t *testing.T) {
+	device, cleanup := fakeTools(t)
+	defer cleanup()
+	_, err := Secret(device+".missing", []byte("credential"), make([]byte, SaltLen))
+	if _, ok := err.(exitcodes.Err); !ok {
+		t.Fatalf("want an exitcodes.Err, got %v", err)
+	}
+}
+
+func TestCombine(t *testing.T) {
+	pw := []byte("password")
+	c1 := Combine(pw, []byte("secret1"))
+	c2 := Combine(pw, []byte("secret2"))
+	c3 := Combine([]byte("other"), []byte("secret1"))
+	if len(c1) != 32 || bytes.Equal(c1, c2) || bytes.Equal(c1, c3) {
+		t.Errorf("both factors must change the result: %x %x %x", c1, c2, c3)
+	}
+	secret := []byte("secret1")
+	if c4 := Combine(pw, secret); !bytes.Equal(c1, c4) {
+		t.Errorf("not deterministic: %x != %x", c1, c4)
+	}
+	if !bytes.Equal(secret, make([]byte, len(secret))) {
+		t.Errorf("secret has not been wiped: %q", secret)
+	}
+}
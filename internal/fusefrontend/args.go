@@ -1,6 +1,8 @@
 package fusefrontend
 
 import (
+	"time"
+
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
@@ -11,6 +13,21 @@ type Args struct {
 	Cipherdir      string
 	PlaintextNames bool
 	LongNames      bool
+	// Flat means there are no gocryptfs.diriv files ("Flat" feature flag).
+	// The NameTransform must be set up for flat mode as well.
+	Flat bool
+	// DirIVXattr means the DirIVs are stored in an xattr of each directory
+	// instead of gocryptfs.diriv files ("DirIVXattr" feature flag). The
+	// NameTransform must be set up for this as well.
+	DirIVXattr bool
+	// ExactSize means that the plaintext size of regular files is stored in
+	// an encrypted xattr and checked against the backing file ("ExactSize"
+	// feature flag).
+	ExactSize bool
+	// LongSymlinks means that encrypted symlink targets that are too long
+	// for the backing filesystem are stored in LongLinkDirName
+	// ("LongSymlinks" feature flag).
+	LongSymlinks bool
 	// Should we chown a file after it has been created?
 	// This only makes sense if (1) allow_other is set and (2) we run as root.
 	PreserveOwner bool
@@ -22,12 +39,30 @@ type Args struct {
 	ForceOwner *fuse.Owner
 	// ConfigCustom is true when the user select a non-default config file
 	// location. If it is false, reverse mode maps ".gocryptfs.reverse.conf"
-	// to "gocryptfs.conf" in the plaintext dir.
+	// to "gocryptfs.conf" in the plaintext dir. In forward mode, it disables
+	// hiding "gocryptfs.conf" in the root directory.
 	ConfigCustom bool
 	// NoPrealloc disables automatic preallocation before writing
 	NoPrealloc bool
+	// EmulateHiresTime stores nanosecond timestamps of regular files in an
+	// encrypted xattr, "-emulate-hires-time"
+	EmulateHiresTime bool
 	// Try to serialize read operations, "-serialize_reads"
 	SerializeReads bool
+	// ReadAhead is the number of blocks to prefetch after a sequential read,
+	// "-readahead". Zero disables prefetching. Ignored if SerializeReads is
+	// set.
+	ReadAhead int
+	// CoalesceWrites keeps the block that small writes go to in memory
+	// until the writes move on to another block, "-coalesce-writes"
+	CoalesceWrites bool
+	// FsyncMetadata fsyncs new files and directories, their
+	// gocryptfs.diriv and .name files, and the parent directory on
+	// creation, "-fsync-metadata"
+	FsyncMetadata bool
+	// FeatureFlags are the feature flags from the config file, reported by
+	// the ctlsock "Status" command. Nil if there is no config file.
+	FeatureFlags []string
 	// Force decode even if integrity check fails (openSSL only)
 	ForceDecode bool
 	// Exclude is a list of paths to make inaccessible, starting match at
@@ -39,4 +74,81 @@ type Args struct {
 	// ExcludeFrom is a list of files from which to read exclusion patterns
 	// (with wildcard syntax)
 	ExcludeFrom []string
+	// ReverseInclude is a list of path patterns to show in the reverse
+	// view, hiding everything else but their ancestors, "-reverse-include"
+	ReverseInclude []string
+	// DirIVRecover makes OpenDir return an empty listing instead of EIO when
+	// gocryptfs.diriv is missing or corrupt, "-diriv-recover"
+	DirIVRecover bool
+	// CaseFold enables case-insensitive lookup of existing names, "-casefold"
+	CaseFold bool
+	// ReverseNameOnly makes all regular files appear empty in reverse mode,
+	// so only the encrypted directory tree is exposed, "-reverse-name-only"
+	ReverseNameOnly bool
+	// Discard enables fallocate(FALLOC_FL_PUNCH_HOLE), which deallocates
+	// the space in the backing file, "-discard"
+	Discard bool
+	// Stats records latency histograms that can be queried via the control
+	// socket, "-stats". This is the initial value, it can be changed at
+	// runtime with FS.SetStats.
+	Stats bool
+	// Trash makes Unlink and Rmdir move entries into a trash directory that
+	// can be managed via the control socket, "-trash"
+	Trash bool
+	// Quota is the maximum number of plaintext bytes in the filesystem,
+	// "-quota". Zero means no limit.
+	Quota uint64
+	// ReadBps and WriteBps limit the bytes per second read from and written
+	// to the backing files, "-read-bps" and "-write-bps". Zero means no
+	// limit.
+	ReadBps  uint64
+	WriteBps uint64
+	// PreserveDirMtime restores the mtime of backing directories after
+	// internal bookkeeping, "-preserve-dir-mtime"
+	PreserveDirMtime bool
+	// Watch reports changes to CIPHERDIR via the control socket, "-watch"
+	Watch bool
+	// DirCountCache remembers the number of entries of directories to skip
+	// reading empty directories in Rmdir, "-dir-count-cache"
+	DirCountCache bool
+	// SortDirs sorts directory listings by the decrypted name, "-sort-dirs"
+	SortDirs bool
+	// ReadOnlyAfter makes all operations that change the filesystem fail
+	// with EROFS once this much time has passed since mount,
+	// "-readonly-after". Zero means never.
+	ReadOnlyAfter time.Duration
+	// MacOSForks stores the AppleDouble files "._name" in an encrypted xattr
+	// of "name" instead of a separate file, "-macos-forks"
+	MacOSForks bool
+	// MaxBackingFds limits the number of backing files that are open at the
+	// same time, "-max-backing-fds". Zero means unlimited.
+	MaxBackingFds int
+	// HideCorrupt skips directory entries whose names cannot be decrypted
+	// and logs each of them only once, "-hide-corrupt"
+	HideCorrupt bool
+	// ShowCorrupt is like HideCorrupt, but lists such entries under a
+	// placeholder name, "-show-corrupt"
+	ShowCorrupt bool
+	// SecureDelete overwrites file content with random bytes before it is
+	// deleted or truncated away, "-secure-delete"
+	SecureDelete bool
+	// NoAtime opens backing files and directories with O_NOATIME, so reading
+	// does not update their access time, "-noatime"
+	NoAtime bool
+	// CompatOpendir retries opening directories without O_DIRECTORY if the
+	// backing filesystem rejects the flag, "-compat-opendir"
+	CompatOpendir bool
+	// ReadOnly means the filesystem is mounted with "-ro", or not mounted at
+	// all, like for "-encrypt-path". Nothing in CIPHERDIR is changed then, not
+	// even by replaying the journal.
+	ReadOnly bool
+	// Journal writes every write that overwrites existing data to a journal
+	// first, so a crash cannot leave a half-written block, "-journal"
+	Journal bool
+	// ShowConf lists gocryptfs.conf and its backup in the root directory
+	// and passes them through read-only, "-show-conf"
+	ShowConf bool
+	// ParanoidWrite reads back and decrypts every block after writing it,
+	// and fails the write with EIO if it does not match, "-paranoid-write"
+	ParanoidWrite bool
 }
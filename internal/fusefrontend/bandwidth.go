@@ -0,0 +1,20 @@
+package fusefrontend
+
+import (
+	"github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/ctlsocksrv"
+)
+
+var _ ctlsocksrv.BandwidthInterface = &FS{} // Verify that interface is implemented.
+
+// Bandwidth implements ctlsocksrv.BandwidthInterface. Returns nil if neither
+// "-read-bps" nor "-write-bps" is set.
+func (fs *FS) Bandwidth() *ctlsock.BandwidthStatus {
+	if fs.readLimit == nil && fs.writeLimit == nil {
+		return nil
+	}
+	var s ctlsock.BandwidthStatus
+	s.ReadLimit, s.ReadRate, s.BytesRead = fs.readLimit.Status()
+	s.WriteLimit, s.WriteRate, s.BytesWritten = fs.writeLimit.Status()
+	return &s
+}
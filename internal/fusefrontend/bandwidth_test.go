@@ -0,0 +1,38 @@
+package fusefrontend
+
+import (
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+func TestBandwidth(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	if newTestFS(Args{Cipherdir: cipherdir}).Bandwidth() != nil {
+		t.Error("Bandwidth should be nil without limits")
+	}
+	// The limits are high enough to never wait in this test
+	fs := newTestFS(Args{Cipherdir: cipherdir, ReadBps: 1 << 40, WriteBps: 1 << 40})
+	writeTestFile(t, fs, "file", []byte("content"))
+	bw := fs.Bandwidth()
+	if bw == nil {
+		t.Fatal("Bandwidth is nil")
+	}
+	// Header plus one block with nonce and tag
+	want := fs.contentEnc.PlainSizeToCipherSize(7)
+	if bw.WriteLimit != 1<<40 || bw.BytesWritten != want {
+		t.Errorf("want limit %d and %d bytes written, got %+v", uint64(1<<40), want, bw)
+	}
+	if got := readTestFile(t, fs, "file"); string(got) != "content" {
+		t.Fatalf("want %q, got %q", "content", got)
+	}
+	if bw = fs.Bandwidth(); bw.BytesRead == 0 {
+		t.Errorf("reads were not counted: %+v", bw)
+	}
+	// A mount with only a write limit does not count reads
+	fs2 := newTestFS(Args{Cipherdir: cipherdir, WriteBps: 1 << 40})
+	readTestFile(t, fs2, "file")
+	if bw = fs2.Bandwidth(); bw.ReadLimit != 0 || bw.BytesRead != 0 {
+		t.Errorf("read fields should be zero: %+v", bw)
+	}
+}
@@ -0,0 +1,8 @@
+package fusefrontend
+
+import (
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// setBlksize does nothing, as fuse.Attr has no Blksize field on MacOS.
+func setBlksize(a *fuse.Attr, blksize uint64) {}
@@ -0,0 +1,10 @@
+package fusefrontend
+
+import (
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// setBlksize sets the preferred IO size reported in st_blksize.
+func setBlksize(a *fuse.Attr, blksize uint64) {
+	a.Blksize = uint32(blksize)
+}
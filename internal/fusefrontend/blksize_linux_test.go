@@ -0,0 +1,49 @@
+package fusefrontend
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestGetAttrBlksize checks that regular files report our plaintext block
+// size as st_blksize, and an allocation without the crypto overhead.
+func TestGetAttrBlksize(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, LongNames: true})
+	f, code := fs.Create("file", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	if _, code = f.Write(make([]byte, 100000), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(backingFile(t, cipherdir), &st); err != nil {
+		t.Fatal(err)
+	}
+	var fa fuse.Attr
+	if code = f.GetAttr(&fa); !code.Ok() {
+		t.Fatal(code)
+	}
+	a, code := fs.GetAttr("file", nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	for _, a := range []*fuse.Attr{a, &fa} {
+		if a.Blksize != uint32(fs.contentEnc.PlainBS()) {
+			t.Errorf("Blksize: want %d, got %d", fs.contentEnc.PlainBS(), a.Blksize)
+		}
+		if a.Blocks == 0 || a.Blocks > uint64(st.Blocks) {
+			t.Errorf("Blocks: want at most the %d backing blocks, got %d", st.Blocks, a.Blocks)
+		}
+	}
+	if a.Blocks != fa.Blocks {
+		t.Errorf("GetAttr and File.GetAttr disagree: %d != %d blocks", a.Blocks, fa.Blocks)
+	}
+}
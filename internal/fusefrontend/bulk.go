@@ -0,0 +1,153 @@
+package fusefrontend
+
+// BulkChmod and BulkChown change the mode or owner of a whole subtree through
+// the control socket. Mode and owner are stored unencrypted on the backing
+// files, so we change them there directly: no FUSE round trip per file, and
+// no need to decrypt the names. Like Chmod and Chown, the gocryptfs.diriv
+// and .name files keep their attributes.
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+var _ ctlsocksrv.BulkInterface = &FS{} // Verify that interface is implemented.
+
+// bulkOp changes the backing entry "cName" in "dirfd", which has the
+// attributes "st". It returns false if there was nothing to change.
+type bulkOp func(dirfd int, cName string, st *unix.Stat_t) (changed bool, err error)
+
+// BulkChmod implements ctlsocksrv.BulkInterface. Directories get "dirMode",
+// symlinks are skipped, and everything else gets "mode".
+func (fs *FS) BulkChmod(plainPath string, mode *uint32, dirMode *uint32) (*ctlsock.BulkStatus, error) {
+	for _, m := range []*uint32{mode, dirMode} {
+		if m != nil && *m&^07777 != 0 {
+			return nil, syscall.EINVAL
+		}
+	}
+	return fs.bulk("BulkChmod", plainPath, func(dirfd int, cName string, st *unix.Stat_t) (bool, error) {
+		want := mode
+		switch st.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			want = dirMode
+		case syscall.S_IFLNK:
+			// The mode of a symlink is always 0777
+			want = nil
+		}
+		if want == nil || uint32(st.Mode)&07777 == *want {
+			return false, nil
+		}
+		return true, syscallcompat.FchmodatNofollow(dirfd, cName, *want)
+	})
+}
+
+// BulkChown implements ctlsocksrv.BulkInterface. Symlinks themselves are
+// changed, not their targets.
+func (fs *FS) BulkChown(plainPath string, uid *uint32, gid *uint32) (*ctlsock.BulkStatus, error) {
+	return fs.bulk("BulkChown", plainPath, func(dirfd int, cName string, st *unix.Stat_t) (bool, error) {
+		newUID, newGID := -1, -1
+		if uid != nil && *uid != st.Uid {
+			newUID = int(*uid)
+		}
+		if gid != nil && *gid != st.Gid {
+			newGID = int(*gid)
+		}
+		if newUID == -1 && newGID == -1 {
+			return false, nil
+		}
+		return true, syscallcompat.Fchownat(dirfd, cName, newUID, newGID, unix.AT_SYMLINK_NOFOLLOW)
+	})
+}
+
+// bulk applies "op" to "plainPath" and everything below it. Entries that
+// cannot be changed are counted and skipped.
+func (fs *FS) bulk(name string, plainPath string, op bulkOp) (*ctlsock.BulkStatus, error) {
+	if fs.isFiltered(plainPath) {
+		return nil, syscall.EPERM
+	}
+	if fs.isReadOnly() {
+		return nil, syscall.EROFS
+	}
+	dirfd, cName, err := fs.openBackingDir(plainPath)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(dirfd)
+	var st unix.Stat_t
+	if err = syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return nil, err
+	}
+	var status ctlsock.BulkStatus
+	fs.bulkEntry(dirfd, cName, &st, plainPath == "", op, &status)
+	tlog.Info.Printf("%s %q: %d changed, %d unchanged, %d errors",
+		name, plainPath, status.Changed, status.Unchanged, status.Errors)
+	return &status, nil
+}
+
+// bulkEntry applies "op" to everything below the directory "cName" in
+// "dirfd" first, so that a new mode cannot lock us out, and then to "cName"
+// itself. "root" is true for the root directory of CIPHERDIR.
+func (fs *FS) bulkEntry(dirfd int, cName string, st *unix.Stat_t, root bool, op bulkOp, status *ctlsock.BulkStatus) {
+	if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		fs.bulkDir(dirfd, cName, root, op, status)
+	}
+	changed, err := op(dirfd, cName, st)
+	if err != nil {
+		tlog.Debug.Printf("bulkEntry %q: %v", cName, err)
+		status.Errors++
+	} else if changed {
+		status.Changed++
+	} else {
+		status.Unchanged++
+	}
+}
+
+// bulkDir calls bulkEntry for the entries of the directory "cName" in
+// "dirfd", except for our own files.
+func (fs *FS) bulkDir(dirfd int, cName string, root bool, op bulkOp, status *ctlsock.BulkStatus) {
+	fd, err := fs.openat(dirfd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		tlog.Debug.Printf("bulkDir %q: %v", cName, err)
+		status.Errors++
+		return
+	}
+	defer syscall.Close(fd)
+	entries, err := syscallcompat.Getdents(fd)
+	if err != nil {
+		tlog.Debug.Printf("bulkDir %q: %v", cName, err)
+		status.Errors++
+		return
+	}
+	for _, e := range entries {
+		if fs.isInternalBackingName(root, e.Name) {
+			continue
+		}
+		var st unix.Stat_t
+		if err = syscallcompat.Fstatat(fd, e.Name, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			status.Errors++
+			continue
+		}
+		fs.bulkEntry(fd, e.Name, &st, false, op, status)
+	}
+}
+
+// isInternalBackingName returns true if the backing entry "cName" is one of
+// our own files that OpenDir hides. "root" is true for the root directory
+// of CIPHERDIR.
+func (fs *FS) isInternalBackingName(root bool, cName string) bool {
+	if root && (fs.isConfName("", cName) || fs.isTrashName("", cName) ||
+		fs.isLongLinkDir("", cName) || fs.isJournalName("", cName)) {
+		return true
+	}
+	if fs.args.PlaintextNames {
+		return false
+	}
+	return cName == fs.nameTransform.DirIVName() || nametransform.NameType(cName) == nametransform.LongNameFilename
+}
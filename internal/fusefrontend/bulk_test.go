@@ -0,0 +1,93 @@
+package fusefrontend
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+func TestBulkChmod(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	for _, d := range []string{"a", "a/b"} {
+		if code := fs.Mkdir(d, 0700, nil); !code.Ok() {
+			t.Fatal(code)
+		}
+	}
+	writeTestFile(t, fs, "a/file1", []byte("x"))
+	writeTestFile(t, fs, "a/b/file2", []byte("x"))
+	if code := fs.Chmod("a/b/file2", 0640, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.Symlink("file1", "a/link", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	cDir, err := fs.EncryptPath("a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirIV := filepath.Join(cipherdir, cDir, nametransform.DirIVFilename)
+	before, err := os.Stat(dirIV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := uint32(010000)
+	if _, err := fs.BulkChmod("a", &bad, nil); err != syscall.EINVAL {
+		t.Errorf("want EINVAL, got %v", err)
+	}
+	mode, dirMode := uint32(0640), uint32(0750)
+	status, err := fs.BulkChmod("a", &mode, &dirMode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Changed: a, a/b, a/file1; unchanged: a/b/file2, a/link
+	if status.Changed != 3 || status.Unchanged != 2 || status.Errors != 0 {
+		t.Errorf("want 3 changed, 2 unchanged, 0 errors, got %+v", status)
+	}
+	for path, want := range map[string]uint32{"a": 0750, "a/b": 0750, "a/file1": 0640, "a/b/file2": 0640} {
+		a, code := fs.GetAttr(path, nil)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		if a.Mode&07777 != want {
+			t.Errorf("%s: want mode %o, got %o", path, want, a.Mode&07777)
+		}
+	}
+	after, err := os.Stat(dirIV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Mode() != before.Mode() {
+		t.Errorf("gocryptfs.diriv should keep mode %o, got %o", before.Mode(), after.Mode())
+	}
+	// Nothing left to do
+	status, err = fs.BulkChmod("a", &mode, &dirMode)
+	if err != nil || status.Changed != 0 || status.Unchanged != 5 {
+		t.Errorf("second run: want 5 unchanged, got %+v (%v)", status, err)
+	}
+}
+
+func TestBulkChown(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	if code := fs.Mkdir("a", 0700, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	writeTestFile(t, fs, "a/file", []byte("x"))
+	// Setting our own gid works without privileges
+	gid := uint32(os.Getgid())
+	status, err := fs.BulkChown("a", nil, &gid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Changed != 0 || status.Unchanged != 2 || status.Errors != 0 {
+		t.Errorf("want 2 unchanged, got %+v", status)
+	}
+	if _, err = fs.BulkChown("missing", nil, &gid); err != syscall.ENOENT {
+		t.Errorf("want ENOENT, got %v", err)
+	}
+}
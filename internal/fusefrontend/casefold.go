@@ -0,0 +1,129 @@
+package fusefrontend
+
+// Case-insensitive name lookup, "-casefold"
+
+import (
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// casefoldPath replaces each component of the plaintext path "relPath" with
+// the name of an existing directory entry that matches it case-insensitively.
+// Components that exist with the exact spelling, or that have no match, are
+// kept as they are. If "foldLast" is false, the last component is kept as
+// well, see openBackingDirNew.
+//
+// This is O(n) in the number of directory entries for each path component
+// that does not exist with the exact spelling, hence opt-in.
+//
+// Symlink-safe through Openat() with O_NOFOLLOW.
+func (fs *FS) casefoldPath(relPath string, foldLast bool) string {
+	if relPath == "" {
+		return relPath
+	}
+	dirfd, err := fs.openCipherdir()
+	if err != nil {
+		return relPath
+	}
+	parts := strings.Split(relPath, "/")
+	for i, name := range parts {
+		if i == len(parts)-1 && !foldLast {
+			break
+		}
+		var iv []byte
+		if !fs.args.PlaintextNames {
+			iv, err = fs.readDirIV(dirfd)
+			if err != nil {
+				break
+			}
+		}
+		parts[i] = fs.casefoldName(dirfd, iv, name, i == 0)
+		// Last part? We are done.
+		if i == len(parts)-1 {
+			break
+		}
+		cName := parts[i]
+		if !fs.args.PlaintextNames {
+			cName, err = fs.nameTransform.EncryptAndHashName(parts[i], iv)
+			if err != nil {
+				break
+			}
+		}
+		// Descend into next directory. If this fails, the rest of the path
+		// does not exist, and we leave it alone.
+		dirfd2, err := fs.openat(dirfd, cName, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+		syscall.Close(dirfd)
+		if err != nil {
+			return strings.Join(parts, "/")
+		}
+		dirfd = dirfd2
+	}
+	syscall.Close(dirfd)
+	return strings.Join(parts, "/")
+}
+
+// casefoldName returns the plaintext name of the entry in the directory
+// opened as "dirfd" that matches "name" case-insensitively. If an entry
+// called exactly "name" exists, or if nothing matches, "name" is returned
+// unchanged. "iv" is the directory IV (nil with PlaintextNames), "isRoot"
+// tells us that dirfd is the root directory.
+func (fs *FS) casefoldName(dirfd int, iv []byte, name string, isRoot bool) string {
+	cName := name
+	if !fs.args.PlaintextNames {
+		var err error
+		cName, err = fs.nameTransform.EncryptAndHashName(name, iv)
+		if err != nil {
+			return name
+		}
+	}
+	var st unix.Stat_t
+	if err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW); err == nil {
+		// Exact match
+		return name
+	}
+	fd, err := fs.openat(dirfd, ".", syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return name
+	}
+	defer syscall.Close(fd)
+	entries, err := syscallcompat.Getdents(fd)
+	if err != nil {
+		tlog.Warn.Printf("casefoldName: Getdents: %v", err)
+		return name
+	}
+	for _, e := range entries {
+		plain := e.Name
+		if isRoot && (fs.isConfName("", plain) || fs.isTrashName("", plain) || fs.isLongLinkDir("", plain) || fs.isJournalName("", plain)) {
+			continue
+		}
+		if !fs.args.PlaintextNames {
+			if plain == fs.nameTransform.DirIVName() {
+				continue
+			}
+			switch nametransform.NameType(plain) {
+			case nametransform.LongNameFilename:
+				continue
+			case nametransform.LongNameContent:
+				plain, err = nametransform.ReadLongNameAt(fd, plain)
+				if err != nil {
+					continue
+				}
+			}
+			plain, err = fs.nameTransform.DecryptName(plain, iv)
+			if err != nil {
+				continue
+			}
+		}
+		if strings.EqualFold(plain, name) {
+			tlog.Debug.Printf("casefoldName: %q -> %q", name, plain)
+			return plain
+		}
+	}
+	return name
+}
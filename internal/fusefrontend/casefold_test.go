@@ -0,0 +1,75 @@
+package fusefrontend
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+func testCasefold(t *testing.T, plaintextnames bool) {
+	var cipherdir string
+	if plaintextnames {
+		cipherdir = test_helpers.InitFS(t, "-plaintextnames")
+	} else {
+		cipherdir = test_helpers.InitFS(t)
+	}
+	fs := newTestFS(Args{Cipherdir: cipherdir, PlaintextNames: plaintextnames, CaseFold: true})
+	if code := fs.Mkdir("Dir", 0700, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	f, code := fs.Create("Dir/Foo.txt", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	// Lookup with different case
+	if _, code = fs.GetAttr("dir/foo.TXT", nil); !code.Ok() {
+		t.Errorf("GetAttr: %v", code)
+	}
+	// Creating a name that only differs in case must fail
+	_, code = fs.Create("DIR/FOO.txt", uint32(os.O_RDWR), 0600, nil)
+	if code != fuse.Status(syscall.EEXIST) {
+		t.Errorf("Create: want EEXIST, got %v", code)
+	}
+	if code = fs.Mkdir("dir", 0700, nil); code != fuse.Status(syscall.EEXIST) {
+		t.Errorf("Mkdir: want EEXIST, got %v", code)
+	}
+	// Non-existing names stay non-existing
+	if _, code = fs.GetAttr("dir/bar.txt", nil); code != fuse.ENOENT {
+		t.Errorf("GetAttr: want ENOENT, got %v", code)
+	}
+	// The listing shows the original spelling
+	entries, code := fs.OpenDir("dIr", nil)
+	if !code.Ok() || len(entries) != 1 || entries[0].Name != "Foo.txt" {
+		t.Errorf("OpenDir: got %v, %v", entries, code)
+	}
+	// A rename that only changes the case
+	if code = fs.Rename("dir/foo.txt", "dir/FOO.txt", nil); !code.Ok() {
+		t.Fatalf("Rename: %v", code)
+	}
+	entries, code = fs.OpenDir("Dir", nil)
+	if !code.Ok() || len(entries) != 1 || entries[0].Name != "FOO.txt" {
+		t.Errorf("OpenDir after Rename: got %v, %v", entries, code)
+	}
+	// Renaming to a case variant of another file must fail like Create
+	f, code = fs.Create("Dir/bar.txt", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	if code = fs.Rename("Dir/bar.txt", "Dir/foo.TXT", nil); code != fuse.Status(syscall.EEXIST) {
+		t.Errorf("Rename: want EEXIST, got %v", code)
+	}
+}
+
+func TestCasefold(t *testing.T) {
+	testCasefold(t, false)
+}
+
+func TestCasefoldPlaintextnames(t *testing.T) {
+	testCasefold(t, true)
+}
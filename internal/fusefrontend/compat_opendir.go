@@ -0,0 +1,57 @@
+package fusefrontend
+
+import (
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// openatFunc is used by openat. Tests replace it to simulate a backing
+// filesystem that rejects O_DIRECTORY.
+var openatFunc = syscallcompat.Openat
+
+// openat works like syscallcompat.Openat, plus the "-compat-opendir" fallback
+// for directories, see compatOpenDir.
+func (fs *FS) openat(dirfd int, name string, flags int, mode uint32) (int, error) {
+	return fs.compatOpenDir(flags, func(flags int) (int, error) {
+		return openatFunc(dirfd, name, flags, mode)
+	})
+}
+
+// openCipherdir opens CIPHERDIR with O_PATH, following symlinks.
+func (fs *FS) openCipherdir() (int, error) {
+	return fs.compatOpenDir(syscall.O_DIRECTORY|syscallcompat.O_PATH, func(flags int) (int, error) {
+		return syscall.Open(fs.args.Cipherdir, flags, 0)
+	})
+}
+
+// compatOpenDir calls "open" with "flags". If "flags" contain O_DIRECTORY
+// and the backing filesystem rejects it with EINVAL or ENOTSUP,
+// "-compat-opendir" opens again without O_DIRECTORY, and checks with Fstat
+// that the result is a directory. It fails with ENOTDIR if it is not.
+//
+// O_NONBLOCK makes sure that the fallback does not hang if it hits a FIFO.
+// It has no effect on directories.
+func (fs *FS) compatOpenDir(flags int, open func(flags int) (int, error)) (int, error) {
+	fd, err := open(flags)
+	if err != syscall.EINVAL && err != syscall.ENOTSUP || !fs.args.CompatOpendir ||
+		flags&syscall.O_DIRECTORY == 0 {
+		return fd, err
+	}
+	tlog.Debug.Printf("compatOpenDir: O_DIRECTORY rejected with %v, opening without it", err)
+	fd, err = open(flags&^syscall.O_DIRECTORY | syscall.O_NONBLOCK)
+	if err != nil {
+		return -1, err
+	}
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		syscall.Close(fd)
+		return -1, syscall.ENOTDIR
+	}
+	return fd, nil
+}
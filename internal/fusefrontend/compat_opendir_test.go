@@ -0,0 +1,54 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// rejectODirectory simulates a backing filesystem that does not support
+// O_DIRECTORY
+func rejectODirectory(dirfd int, path string, flags int, mode uint32) (int, error) {
+	if flags&syscall.O_DIRECTORY != 0 {
+		return -1, syscall.EINVAL
+	}
+	return syscallcompat.Openat(dirfd, path, flags, mode)
+}
+
+func TestCompatOpendir(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	openatFunc = rejectODirectory
+	defer func() { openatFunc = syscallcompat.Openat }()
+
+	fs := newTestFS(Args{Cipherdir: cipherdir, CompatOpendir: true})
+	if code := fs.Mkdir("dir", 0700, nil); !code.Ok() {
+		t.Fatalf("Mkdir: %v", code)
+	}
+	writeTestFile(t, fs, "dir/file", []byte("content"))
+	entries, code := fs.OpenDir("dir", nil)
+	if !code.Ok() {
+		t.Fatalf("OpenDir: %v", code)
+	}
+	if len(entries) != 1 || entries[0].Name != "file" {
+		t.Errorf("OpenDir: want [file], got %v", entries)
+	}
+	// The fallback must not accept files as directories
+	if _, code = fs.OpenDir("dir/file", nil); code != fuse.Status(syscall.ENOTDIR) {
+		t.Errorf("OpenDir on a file: want ENOTDIR, got %v", code)
+	}
+	// Without the option, the error is passed through
+	fs2 := newTestFS(Args{Cipherdir: cipherdir})
+	if _, code = fs2.OpenDir("dir", nil); code != fuse.EINVAL {
+		t.Errorf("OpenDir without -compat-opendir: want EINVAL, got %v", code)
+	}
+	if code = fs.Unlink("dir/file", nil); !code.Ok() {
+		t.Fatalf("Unlink: %v", code)
+	}
+	if code = fs.Rmdir("dir", nil); !code.Ok() {
+		t.Errorf("Rmdir: %v", code)
+	}
+}
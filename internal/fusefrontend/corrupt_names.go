@@ -0,0 +1,88 @@
+package fusefrontend
+
+// "-hide-corrupt" and "-show-corrupt": directory entries whose names cannot
+// be decrypted. By default, OpenDir logs a warning and skips them on every
+// listing. With either option, each entry is only logged once. With
+// "-show-corrupt", the entry is listed as
+//
+//     gocryptfs.corrupt.[32 hex digits]
+//
+// where the hex digits are derived from the name in CIPHERDIR, so that it
+// can be inspected and deleted.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// corruptPrefix starts the placeholder names of "-show-corrupt"
+const corruptPrefix = "gocryptfs.corrupt."
+
+// corruptPlaceholder returns the name that "-show-corrupt" shows for the
+// entry "diskName" in CIPHERDIR.
+func corruptPlaceholder(diskName string) string {
+	h := sha256.Sum256([]byte(diskName))
+	return corruptPrefix + hex.EncodeToString(h[:16])
+}
+
+// warnCorrupt logs that the entry "diskName" in the directory "dirName"
+// cannot be decrypted. With "-hide-corrupt" or "-show-corrupt", it logs
+// only the first time it sees the entry.
+func (fs *FS) warnCorrupt(dirName string, diskName string, format string, a ...interface{}) {
+	if fs.args.HideCorrupt || fs.args.ShowCorrupt {
+		key := dirName + "/" + diskName
+		fs.corruptSeenLock.Lock()
+		seen := fs.corruptSeen[key]
+		if !seen {
+			if fs.corruptSeen == nil {
+				fs.corruptSeen = make(map[string]bool)
+			}
+			fs.corruptSeen[key] = true
+		}
+		fs.corruptSeenLock.Unlock()
+		if seen {
+			return
+		}
+	}
+	tlog.Warn.Printf(format, a...)
+}
+
+// corruptLookup finds the entry in the directory "dirfd" whose
+// "-show-corrupt" placeholder is "name". Returns false if "name" is not a
+// placeholder, or if there is no such entry.
+func (fs *FS) corruptLookup(dirfd int, name string) (diskName string, ok bool) {
+	if !fs.args.ShowCorrupt || !strings.HasPrefix(name, corruptPrefix) {
+		return "", false
+	}
+	// dirfd may be an O_PATH fd, which Getdents cannot read
+	fd, err := fs.openat(dirfd, ".", syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return "", false
+	}
+	defer syscall.Close(fd)
+	entries, err := syscallcompat.Getdents(fd)
+	if err != nil {
+		return "", false
+	}
+	for _, e := range entries {
+		if corruptPlaceholder(e.Name) == name {
+			return e.Name, true
+		}
+	}
+	return "", false
+}
+
+// encryptAndHashName encrypts the name of an entry of the directory "dirfd",
+// which is encrypted with "iv". Maps "-show-corrupt" placeholders back to the
+// name in CIPHERDIR.
+func (fs *FS) encryptAndHashName(dirfd int, name string, iv []byte) (string, error) {
+	if diskName, ok := fs.corruptLookup(dirfd, name); ok {
+		return diskName, nil
+	}
+	return fs.nameTransform.EncryptAndHashName(name, iv)
+}
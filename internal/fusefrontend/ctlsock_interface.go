@@ -5,8 +5,14 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/ctlsocksrv"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
@@ -15,6 +21,70 @@ import (
 
 var _ ctlsocksrv.Interface = &FS{} // Verify that interface is implemented.
 
+var _ ctlsocksrv.StatsInterface = &FS{} // Verify that interface is implemented.
+
+// Stats implements ctlsocksrv.StatsInterface. Returns nil if "-stats" is off.
+func (fs *FS) Stats() map[string]ctlsock.OpStats {
+	return fs.stats.Snapshot()
+}
+
+// SetStats turns "-stats" on or off at runtime. The collected statistics
+// are kept while it is off.
+func (fs *FS) SetStats(enabled bool) {
+	fs.stats.SetEnabled(enabled)
+}
+
+var _ ctlsocksrv.StatusInterface = &FS{} // Verify that interface is implemented.
+
+// Status implements ctlsocksrv.StatusInterface.
+func (fs *FS) Status() ctlsock.MountStatus {
+	return ctlsock.MountStatus{
+		OpenFiles:    atomic.LoadInt64(&fs.openFiles),
+		BytesRead:    atomic.LoadUint64(&fs.bytesRead),
+		BytesWritten: atomic.LoadUint64(&fs.bytesWritten),
+		Uptime:       time.Since(fs.mountTime),
+		FeatureFlags: fs.args.FeatureFlags,
+		ReadOnly:     fs.isReadOnly(),
+	}
+}
+
+var _ ctlsocksrv.PathInfoInterface = &FS{} // Verify that interface is implemented.
+
+// PathInfo implements ctlsocksrv.PathInfoInterface. Only works on regular
+// files, fails with EINVAL otherwise.
+//
+// Symlink-safe through openBackingDir().
+func (fs *FS) PathInfo(plainPath string) (*ctlsock.PathInfo, error) {
+	cPath, err := fs.EncryptPath(plainPath)
+	if err != nil {
+		return nil, err
+	}
+	dirfd, cName, err := fs.openBackingDir(plainPath)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(dirfd)
+	var st unix.Stat_t
+	err = syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return nil, err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return nil, syscall.EINVAL
+	}
+	info := &ctlsock.PathInfo{
+		CipherPath:  cPath,
+		PlainSize:   fs.contentEnc.CipherSizeToPlainSize(uint64(st.Size)),
+		CipherSize:  uint64(st.Size),
+		Blocks:      fs.contentEnc.CipherSizeToBlocks(uint64(st.Size)),
+		HeaderBytes: contentenc.MinUint64(uint64(st.Size), contentenc.HeaderLen),
+	}
+	if info.PlainSize > 0 {
+		info.Overhead = float64(info.CipherSize) / float64(info.PlainSize)
+	}
+	return info, nil
+}
+
 // EncryptPath implements ctlsock.Backend
 //
 // Symlink-safe through openBackingDir().
@@ -67,7 +137,7 @@ func (fs *FS) decryptPathAt(dirfd int, cipherPath string) (plainPath string, err
 	parts := strings.Split(cipherPath, "/")
 	wd := dirfd
 	for i, part := range parts {
-		dirIV, err := nametransform.ReadDirIVAt(wd)
+		dirIV, err := fs.readDirIV(wd)
 		if err != nil {
 			fmt.Printf("ReadDirIV: %v\n", err)
 			return "", err
@@ -91,7 +161,7 @@ func (fs *FS) decryptPathAt(dirfd int, cipherPath string) (plainPath string, err
 			break
 		}
 		// Descend into next directory
-		wd, err = syscallcompat.Openat(wd, part, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+		wd, err = fs.openat(wd, part, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
 		if err != nil {
 			return "", err
 		}
@@ -0,0 +1,127 @@
+package fusefrontend
+
+// "-dir-count-cache": Rmdir has to read the backing directory to find out
+// if it is empty except for gocryptfs.diriv. With "-dir-count-cache", the
+// number of entries is remembered per directory when it is listed or
+// created, and kept up to date when we create or delete entries in it.
+// Rmdir skips reading directories that are known to be empty.
+//
+// The cache is only trusted when it says "empty". If the directory has
+// been changed behind our back, the rmdir(2) after moving gocryptfs.diriv
+// away fails with ENOTEMPTY and Rmdir rolls back, like it does for
+// concurrent creates. A stale cache therefore costs time, but never
+// deletes anything.
+
+import (
+	"sync"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// dirCountMax is the maximum number of directories in the cache. When it is
+// reached, the cache is cleared.
+const dirCountMax = 10000
+
+// dirCountKey identifies a backing directory. Unlike the path, device and
+// inode number do not change when a parent directory is renamed.
+type dirCountKey struct {
+	dev uint64
+	ino uint64
+}
+
+// dirCounts maps directories to their number of plaintext entries
+type dirCounts struct {
+	sync.Mutex
+	m map[dirCountKey]int
+}
+
+// dirCountKeyAt returns the key of "name" in "dirfd". Pass "." for "dirfd"
+// itself.
+func dirCountKeyAt(dirfd int, name string) (dirCountKey, bool) {
+	var st unix.Stat_t
+	var err error
+	if name == "." {
+		err = unix.Fstat(dirfd, &st)
+	} else {
+		err = syscallcompat.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW)
+	}
+	if err != nil {
+		return dirCountKey{}, false
+	}
+	return dirCountKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
+
+// dirCountSet stores the number of entries "n" of the directory "name" in
+// "dirfd"
+func (fs *FS) dirCountSet(dirfd int, name string, n int) {
+	if !fs.args.DirCountCache {
+		return
+	}
+	k, ok := dirCountKeyAt(dirfd, name)
+	if !ok {
+		return
+	}
+	c := &fs.dirCounts
+	c.Lock()
+	defer c.Unlock()
+	if c.m == nil || len(c.m) >= dirCountMax {
+		c.m = make(map[dirCountKey]int)
+	}
+	c.m[k] = n
+}
+
+// dirCountAdd adds "delta" to the number of entries of "dirfd", if it is
+// known.
+func (fs *FS) dirCountAdd(dirfd int, delta int) {
+	if !fs.args.DirCountCache {
+		return
+	}
+	k, ok := dirCountKeyAt(dirfd, ".")
+	if !ok {
+		return
+	}
+	c := &fs.dirCounts
+	c.Lock()
+	defer c.Unlock()
+	if n, ok := c.m[k]; ok {
+		if n+delta < 0 {
+			// We have missed a change
+			delete(c.m, k)
+			return
+		}
+		c.m[k] = n + delta
+	}
+}
+
+// dirCountForget drops "dirfd" from the cache
+func (fs *FS) dirCountForget(dirfd int) {
+	if !fs.args.DirCountCache {
+		return
+	}
+	k, ok := dirCountKeyAt(dirfd, ".")
+	if !ok {
+		return
+	}
+	c := &fs.dirCounts
+	c.Lock()
+	defer c.Unlock()
+	delete(c.m, k)
+}
+
+// dirCountEmpty returns true if "dirfd" is known to be empty
+func (fs *FS) dirCountEmpty(dirfd int) bool {
+	if !fs.args.DirCountCache {
+		return false
+	}
+	k, ok := dirCountKeyAt(dirfd, ".")
+	if !ok {
+		return false
+	}
+	c := &fs.dirCounts
+	c.Lock()
+	defer c.Unlock()
+	n, ok := c.m[k]
+	return ok && n == 0
+}
@@ -0,0 +1,118 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// makeTree creates a tree of "depth" levels below "dir", with "fanout"
+// directories and files in each directory
+func makeTree(t *testing.T, fs *FS, dir string, depth int, fanout int) {
+	for i := 0; i < fanout; i++ {
+		name := fmt.Sprintf("%s/file%d", dir, i)
+		f, code := fs.Create(name, uint32(os.O_WRONLY), 0600, nil)
+		if !code.Ok() {
+			t.Fatalf("Create %q: %v", name, code)
+		}
+		f.Release()
+		if depth == 0 {
+			continue
+		}
+		name = fmt.Sprintf("%s/dir%d", dir, i)
+		if code = fs.Mkdir(name, 0700, nil); !code.Ok() {
+			t.Fatalf("Mkdir %q: %v", name, code)
+		}
+		makeTree(t, fs, name, depth-1, fanout)
+	}
+}
+
+// removeTree deletes "dir" like "rm -r": list, delete the children, rmdir
+func removeTree(t *testing.T, fs *FS, dir string) {
+	entries, code := fs.OpenDir(dir, nil)
+	if !code.Ok() {
+		t.Fatalf("OpenDir %q: %v", dir, code)
+	}
+	for _, e := range entries {
+		name := dir + "/" + e.Name
+		if e.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			removeTree(t, fs, name)
+		} else if code = fs.Unlink(name, nil); !code.Ok() {
+			t.Fatalf("Unlink %q: %v", name, code)
+		}
+	}
+	if code = fs.Rmdir(dir, nil); !code.Ok() {
+		t.Fatalf("Rmdir %q: %v", dir, code)
+	}
+}
+
+// TestDirCountRemoveTree creates and deletes a large tree with and without
+// "-dir-count-cache", and checks that nothing is left behind.
+func TestDirCountRemoveTree(t *testing.T) {
+	for _, cache := range []bool{false, true} {
+		cipherdir := test_helpers.InitFS(t)
+		fs := newTestFS(Args{Cipherdir: cipherdir, DirCountCache: cache})
+		if code := fs.Mkdir("top", 0700, nil); !code.Ok() {
+			t.Fatal(code)
+		}
+		makeTree(t, fs, "top", 3, 6)
+		// Rmdir on a non-empty directory must fail
+		if code := fs.Rmdir("top/dir0", nil); code != fuse.Status(syscall.ENOTEMPTY) {
+			t.Errorf("cache=%v: want ENOTEMPTY, got %v", cache, code)
+		}
+		removeTree(t, fs, "top")
+		entries, err := ioutil.ReadDir(cipherdir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Only gocryptfs.conf and gocryptfs.diriv are left
+		if len(entries) != 2 {
+			for _, e := range entries {
+				t.Logf("left over: %q", e.Name())
+			}
+			t.Errorf("cache=%v: %d entries left in CIPHERDIR", cache, len(entries))
+		}
+	}
+}
+
+// TestDirCountStale checks that Rmdir does not delete a directory that the
+// cache believes to be empty, but that has been filled behind our back.
+func TestDirCountStale(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, DirCountCache: true})
+	if code := fs.Mkdir("dir", 0700, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	cDir, err := fs.EncryptPath("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirfd, err := syscall.Open(filepath.Join(cipherdir, cDir), syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	if !fs.dirCountEmpty(dirfd) {
+		t.Fatal("new directory should be known to be empty")
+	}
+	if err = ioutil.WriteFile(filepath.Join(cipherdir, cDir, "foo"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := fs.Rmdir("dir", nil); code != fuse.Status(syscall.ENOTEMPTY) {
+		t.Errorf("want ENOTEMPTY, got %v", code)
+	}
+	if fs.dirCountEmpty(dirfd) {
+		t.Error("the stale entry should have been dropped")
+	}
+	// The directory is still intact
+	if _, code := fs.OpenDir("dir", nil); !code.Ok() {
+		t.Errorf("OpenDir: %v", code)
+	}
+}
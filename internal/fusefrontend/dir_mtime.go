@@ -0,0 +1,69 @@
+package fusefrontend
+
+// "-preserve-dir-mtime": gocryptfs creates, renames and deletes files of its
+// own in the backing directories, like gocryptfs.diriv and the ".name"
+// files of long names. Each of these updates the mtime of the backing
+// directory, which the user sees as the mtime of the plaintext directory.
+// With "-preserve-dir-mtime", the mtime is restored after bookkeeping that
+// does not correspond to a change the user can see: filling a new directory
+// with its gocryptfs.diriv, and rolling back an operation that failed.
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// dirMtime is the saved mtime of the directory "name" in "dirfd"
+type dirMtime struct {
+	dirfd int
+	name  string
+	mtime time.Time
+	// ok is false if nothing has been saved
+	ok bool
+}
+
+// saveDirMtime returns the mtime of the directory "name" in "dirfd" for
+// restoreDirMtime. Pass "." for "dirfd" itself. Does nothing without
+// "-preserve-dir-mtime".
+func (fs *FS) saveDirMtime(dirfd int, name string) dirMtime {
+	if !fs.args.PreserveDirMtime {
+		return dirMtime{}
+	}
+	var st unix.Stat_t
+	err := syscallcompat.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		tlog.Warn.Printf("saveDirMtime %q: %v", name, err)
+		return dirMtime{}
+	}
+	return dirMtime{
+		dirfd: dirfd,
+		name:  name,
+		mtime: time.Unix(int64(st.Mtim.Sec), int64(st.Mtim.Nsec)),
+		ok:    true,
+	}
+}
+
+// restoreDirMtime sets the mtime saved by saveDirMtime. A change the user
+// makes in the same directory at the same time can lose its mtime update.
+func (fs *FS) restoreDirMtime(d dirMtime) {
+	if !d.ok {
+		return
+	}
+	err := syscallcompat.UtimesNanoAtNofollow(d.dirfd, d.name, nil, &d.mtime)
+	if err != nil {
+		tlog.Warn.Printf("restoreDirMtime %q: %v", d.name, err)
+	}
+}
+
+// rollbackLongName deletes the ".name" file of "cName" in "dirfd" after the
+// operation that needed it has failed, and restores the mtime of "dirfd"
+// that has been saved before the ".name" file was written.
+func (fs *FS) rollbackLongName(dirfd int, cName string, d dirMtime) {
+	nametransform.DeleteLongNameAt(dirfd, cName)
+	fs.restoreDirMtime(d)
+}
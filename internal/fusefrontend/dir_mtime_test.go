@@ -0,0 +1,55 @@
+package fusefrontend
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestPreserveDirMtime checks that a failed Create of a long name, which
+// writes and deletes the ".name" file again, changes the mtime of the parent
+// directory only without "-preserve-dir-mtime".
+func TestPreserveDirMtime(t *testing.T) {
+	for _, preserve := range []bool{false, true} {
+		cipherdir := test_helpers.InitFS(t)
+		fs := newTestFS(Args{Cipherdir: cipherdir, PreserveDirMtime: preserve})
+		longName := strings.Repeat("x", 200)
+		f, code := fs.Create(longName, uint32(os.O_RDWR), 0600, nil)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		f.Release()
+		// Delete the ".name" file behind our back, so that writing it
+		// succeeds, and only creating the file fails
+		names, err := filepath.Glob(filepath.Join(cipherdir, "*"+nametransform.LongNameSuffix))
+		if err != nil || len(names) != 1 {
+			t.Fatalf("no .name file: %v %v", names, err)
+		}
+		if err = os.Remove(names[0]); err != nil {
+			t.Fatal(err)
+		}
+		old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+		if err := os.Chtimes(cipherdir, old, old); err != nil {
+			t.Fatal(err)
+		}
+		if _, code = fs.Create(longName, uint32(os.O_RDWR), 0600, nil); code != fuse.Status(syscall.EEXIST) {
+			t.Fatalf("want EEXIST, got %v", code)
+		}
+		a, code := fs.GetAttr("", nil)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		unchanged := a.ModTime().Equal(old)
+		if unchanged != preserve {
+			t.Errorf("preserve=%v: mtime %v, set to %v before", preserve, a.ModTime(), old)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package fusefrontend
+
+import (
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// withDirectIO sets FOPEN_DIRECT_IO on files that were opened with O_DIRECT,
+// so the kernel does not cache their plaintext and passes every read and
+// write on to us. Applications doing O_DIRECT usually have their own cache
+// and don't want the data cached twice.
+//
+// The kernel then sends the requests with whatever offset and length the
+// application used. This is no problem because we never pass O_DIRECT on to
+// the backing file (see mangleOpenFlags()), and partial blocks go through the
+// usual read-modify-write path.
+//
+// Shared writable mmap is not possible on files with FOPEN_DIRECT_IO.
+func withDirectIO(f nodefs.File, status fuse.Status, flags uint32) (nodefs.File, fuse.Status) {
+	if !status.Ok() {
+		return nil, status
+	}
+	if flags&syscallcompat.O_DIRECT == 0 {
+		return f, status
+	}
+	return &nodefs.WithFlags{
+		File:        f,
+		Description: "O_DIRECT",
+		FuseFlags:   fuse.FOPEN_DIRECT_IO,
+	}, status
+}
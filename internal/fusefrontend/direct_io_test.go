@@ -0,0 +1,68 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+func TestDirectIO(t *testing.T) {
+	if syscallcompat.O_DIRECT == 0 {
+		t.Skip("O_DIRECT is not supported on this platform")
+	}
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	flags := uint32(os.O_RDWR | syscallcompat.O_DIRECT)
+	nodeFile, code := fs.Create("file", flags, 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	w, ok := nodeFile.(*nodefs.WithFlags)
+	if !ok || w.FuseFlags&fuse.FOPEN_DIRECT_IO == 0 {
+		t.Fatalf("Create with O_DIRECT: want FOPEN_DIRECT_IO, got %#v", nodeFile)
+	}
+	// Unaligned writes that only cover parts of blocks must go through
+	// read-modify-write
+	full := bytes.Repeat([]byte("a"), 10000)
+	if _, code = w.Write(full, 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = w.Write([]byte("bbb"), 4095); !code.Ok() {
+		t.Fatal(code)
+	}
+	copy(full[4095:], "bbb")
+	w.Release()
+
+	nodeFile, code = fs.Open("file", flags, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer nodeFile.Release()
+	if _, ok = nodeFile.(*nodefs.WithFlags); !ok {
+		t.Errorf("Open with O_DIRECT: want FOPEN_DIRECT_IO, got %#v", nodeFile)
+	}
+	buf := make([]byte, 5001)
+	res, code := nodeFile.Read(buf, 3333)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	data, _ := res.Bytes(buf)
+	if !bytes.Equal(data, full[3333:8334]) {
+		t.Error("content mismatch")
+	}
+	// Without O_DIRECT, the page cache is used as usual
+	f2, code := fs.Open("file", uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f2.Release()
+	if _, ok = f2.(*File); !ok {
+		t.Errorf("Open without O_DIRECT: want *File, got %#v", f2)
+	}
+}
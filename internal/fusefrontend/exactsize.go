@@ -0,0 +1,160 @@
+package fusefrontend
+
+// "ExactSize" feature flag: store the plaintext size of regular files in an
+// encrypted xattr, and check the size inferred from the backing file
+// against it.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/inomap"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// exactSizeXattr is the plaintext name of the xattr that stores the size.
+// Like hiresTimeXattr, it cannot be accessed from the mountpoint.
+const exactSizeXattr = "gocryptfs.size"
+
+// exactSizeBlockNo is the block number the size is encrypted with. Together
+// with the file ID, it binds the value to the file, and no content block
+// can have this number.
+const exactSizeBlockNo = ^uint64(0)
+
+// exactSizeBegin returns the size of the backing file before an operation
+// that may change it. Pass the result to exactSizeEnd afterwards.
+// The caller must hold ContentLock exclusively.
+func (f *File) exactSizeBegin() int64 {
+	if !f.fs.args.ExactSize {
+		return 0
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(f.intFd(), &st); err != nil {
+		return -1
+	}
+	return st.Size
+}
+
+// exactSizeEnd stores the new plaintext size if the size of the backing
+// file has changed since exactSizeBegin. Empty files have no size xattr.
+func (f *File) exactSizeEnd(before int64) {
+	if !f.fs.args.ExactSize {
+		return
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(f.intFd(), &st); err != nil || st.Size == before {
+		return
+	}
+	size := f.contentEnc.CipherSizeToPlainSize(uint64(st.Size))
+	if size == 0 {
+		err := unix.Fremovexattr(f.intFd(), f.fs.exactSizeCAttr)
+		if err != nil && err != unix.ENODATA {
+			tlog.Warn.Printf("ino%d: exactSizeEnd: cannot remove the size: %v", f.qIno.Ino, err)
+		}
+		return
+	}
+	fileID := f.fileTableEntry.ID
+	if fileID == nil {
+		var err error
+		if fileID, err = f.readFileID(); err != nil {
+			tlog.Warn.Printf("ino%d: exactSizeEnd: cannot read the file ID: %v", f.qIno.Ino, err)
+			return
+		}
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], size)
+	cData := f.contentEnc.EncryptBlock(buf[:], exactSizeBlockNo, fileID)
+	if err := unix.Fsetxattr(f.intFd(), f.fs.exactSizeCAttr, cData, 0); err != nil {
+		tlog.Warn.Printf("ino%d: exactSizeEnd: cannot store the size: %v", f.qIno.Ino, err)
+	}
+}
+
+// readExactSize returns the size stored for the backing file "fd". Files
+// without the xattr have size zero.
+func (fs *FS) readExactSize(fd int) (uint64, error) {
+	cData, err := syscallcompat.Fgetxattr(fd, fs.exactSizeCAttr)
+	if err == unix.ENODATA {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, contentenc.HeaderLen)
+	if _, err = syscall.Pread(fd, buf, 0); err != nil {
+		return 0, err
+	}
+	h, err := fs.contentEnc.ParseHeader(buf)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read the file ID: %v", err)
+	}
+	data, err := fs.contentEnc.DecryptBlock(cData, exactSizeBlockNo, h.ID)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != 8 {
+		return 0, fmt.Errorf("size has %d bytes", len(data))
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+// fgetAttrExactSize compares the plaintext size in "a", which has been
+// inferred from the backing file "fd", with the stored size. On a
+// mismatch, "a" gets the stored size and the file "item" is reported as
+// corrupt. An operation in progress on the file is waited for, so it
+// cannot cause a mismatch.
+func (fs *FS) fgetAttrExactSize(fd int, a *fuse.Attr, item string) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return
+	}
+	if e := openfiletable.Lookup(inomap.QInoFromStat(&st)); e != nil {
+		e.ContentLock.RLock()
+		defer e.ContentLock.RUnlock()
+		if err := syscall.Fstat(fd, &st); err != nil {
+			return
+		}
+	}
+	inferred := fs.contentEnc.CipherSizeToPlainSize(uint64(st.Size))
+	a.Size = inferred
+	stored, err := fs.readExactSize(fd)
+	if err != nil {
+		tlog.Warn.Printf("ino%d: corrupt size xattr: %v", a.Ino, err)
+		fs.reportMitigatedCorruption(item)
+		return
+	}
+	if stored != inferred {
+		tlog.Warn.Printf("ino%d: size mismatch: stored %d, inferred from the backing file %d",
+			a.Ino, stored, inferred)
+		fs.reportMitigatedCorruption(item)
+		a.Size = stored
+	}
+}
+
+// getAttrExactSize is like fgetAttrExactSize for the regular file at
+// "relPath". Files we cannot open are not checked.
+func (fs *FS) getAttrExactSize(relPath string, a *fuse.Attr) {
+	dirfd, cName, err := fs.openBackingDir(relPath)
+	if err != nil {
+		return
+	}
+	defer syscall.Close(dirfd)
+	// O_NONBLOCK so we cannot hang if the file has been replaced by a FIFO
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		tlog.Debug.Printf("getAttrExactSize: cannot check %q: %v", relPath, err)
+		return
+	}
+	defer syscall.Close(fd)
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return
+	}
+	fs.fgetAttrExactSize(fd, a, relPath)
+}
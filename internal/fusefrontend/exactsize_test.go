@@ -0,0 +1,118 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// checkSize verifies that GetAttr returns "want" for "path", and that the
+// stored size disagrees with the backing file exactly if "corrupt" is set
+func checkSize(t *testing.T, fs *FS, path string, want uint64, corrupt bool) {
+	t.Helper()
+	a, code := fs.GetAttr(path, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if a.Size != want {
+		t.Errorf("%s: want size %d, got %d", path, want, a.Size)
+	}
+	select {
+	case <-fs.MitigatedCorruptions:
+		if !corrupt {
+			t.Errorf("%s: unexpected size mismatch", path)
+		}
+	default:
+		if corrupt {
+			t.Errorf("%s: size mismatch has not been reported", path)
+		}
+	}
+}
+
+// The size is stored on writes and truncates. Changing the backing file
+// behind our back is detected.
+func TestExactSize(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, ExactSize: true})
+	fs.MitigatedCorruptions = make(chan string, 1)
+	writeTestFile(t, fs, "file", bytes.Repeat([]byte("a"), 10000))
+	checkSize(t, fs, "file", 10000, false)
+	for _, size := range []uint64{5000, 20000, 0, 3} {
+		if code := fs.Truncate("file", size, nil); !code.Ok() {
+			t.Fatal(code)
+		}
+		checkSize(t, fs, "file", size, false)
+	}
+	if code := fs.Truncate("file", 0, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	backing := backingFile(t, cipherdir)
+	if _, err := syscallcompat.Lgetxattr(backing, fs.exactSizeCAttr); err != unix.ENODATA {
+		t.Errorf("empty files should not have a size xattr: %v", err)
+	}
+
+	// Cut off the last block
+	f, code := fs.Open("file", uint32(os.O_WRONLY), nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write(bytes.Repeat([]byte("a"), 10000), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	if err := os.Truncate(backing, int64(fs.contentEnc.PlainSizeToCipherSize(8192))); err != nil {
+		t.Fatal(err)
+	}
+	checkSize(t, fs, "file", 10000, true)
+	f, code = fs.Open("file", uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	var a fuse.Attr
+	if code = f.GetAttr(&a); !code.Ok() || a.Size != 10000 {
+		t.Errorf("File.GetAttr: want size 10000, got %d (%v)", a.Size, code)
+	}
+	select {
+	case <-fs.MitigatedCorruptions:
+	default:
+		t.Error("File.GetAttr: size mismatch has not been reported")
+	}
+}
+
+// The size xattr of another file with the right size is rejected
+func TestExactSizeCopied(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, ExactSize: true})
+	fs.MitigatedCorruptions = make(chan string, 1)
+	writeTestFile(t, fs, "file1", bytes.Repeat([]byte("a"), 10000))
+	writeTestFile(t, fs, "file2", bytes.Repeat([]byte("b"), 4096))
+	cFile1, _ := fs.EncryptPath("file1")
+	cFile2, _ := fs.EncryptPath("file2")
+	backing1 := filepath.Join(cipherdir, cFile1)
+	val, err := syscallcompat.Lgetxattr(filepath.Join(cipherdir, cFile2), fs.exactSizeCAttr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = syscall.Truncate(backing1, int64(fs.contentEnc.PlainSizeToCipherSize(4096))); err != nil {
+		t.Fatal(err)
+	}
+	if err = unix.Lsetxattr(backing1, fs.exactSizeCAttr, val, 0); err != nil {
+		t.Fatal(err)
+	}
+	checkSize(t, fs, "file1", 4096, true)
+	checkSize(t, fs, "file2", 4096, false)
+	names, code := fs.ListXAttr("file1", nil)
+	if !code.Ok() || len(names) != 0 {
+		t.Errorf("the size xattr should be hidden, got %q (%v)", names, code)
+	}
+}
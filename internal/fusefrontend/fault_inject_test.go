@@ -0,0 +1,95 @@
+// +build faultinject
+
+package fusefrontend
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// Run with "go test -tags faultinject -run Fault".
+
+// mkdirWithIv removes the new directory if gocryptfs.diriv cannot be
+// created
+func TestFaultMkdirRollback(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	disarm := syscallcompat.InjectFault(syscallcompat.Fault{Op: "Openat",
+		Path: nametransform.DirIVFilename, Err: syscall.ENOSPC})
+	defer disarm()
+	if code := fs.Mkdir("dir", 0700, nil); code != fuse.Status(syscall.ENOSPC) {
+		t.Errorf("want ENOSPC, got %v", code)
+	}
+	if !disarm() {
+		t.Fatal("fault did not fire")
+	}
+	if _, code := fs.GetAttr("dir", nil); code != fuse.ENOENT {
+		t.Errorf("the directory should be gone, GetAttr returned %v", code)
+	}
+}
+
+// Rmdir moves gocryptfs.diriv back if deleting the directory fails
+func TestFaultRmdirRenameRollback(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	if code := fs.Mkdir("dir", 0700, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	cDir, err := fs.EncryptPath("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	disarm := syscallcompat.InjectFault(syscallcompat.Fault{Op: "Unlinkat",
+		Path: cDir, Err: syscall.ENOTEMPTY})
+	defer disarm()
+	if code := fs.Rmdir("dir", nil); code != fuse.Status(syscall.ENOTEMPTY) {
+		t.Errorf("want ENOTEMPTY, got %v", code)
+	}
+	if !disarm() {
+		t.Fatal("fault did not fire")
+	}
+	if _, err = os.Stat(filepath.Join(cipherdir, cDir, nametransform.DirIVFilename)); err != nil {
+		t.Errorf("gocryptfs.diriv has not been moved back: %v", err)
+	}
+	// No gocryptfs.diriv.rmdir.XYZ leftovers in the parent directory
+	matches, _ := filepath.Glob(filepath.Join(cipherdir, nametransform.DirIVFilename+".rmdir.*"))
+	if len(matches) != 0 {
+		t.Errorf("leftovers: %v", matches)
+	}
+	if code := fs.Rmdir("dir", nil); !code.Ok() {
+		t.Errorf("second Rmdir: %v", code)
+	}
+}
+
+// Rmdir restores the permissions it had to add when reading the directory
+// fails
+func TestFaultRmdirPermRollback(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	if code := fs.Mkdir("dir", 0500, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	disarm := syscallcompat.InjectFault(syscallcompat.Fault{Op: "Getdents", Err: syscall.EIO})
+	defer disarm()
+	if code := fs.Rmdir("dir", nil); code != fuse.EIO {
+		t.Errorf("want EIO, got %v", code)
+	}
+	if !disarm() {
+		t.Fatal("fault did not fire")
+	}
+	st, code := fs.GetAttr("dir", nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if st.Mode&07777 != 0500 {
+		t.Errorf("want mode 0500, got %#o", st.Mode&07777)
+	}
+}
@@ -0,0 +1,70 @@
+package fusefrontend
+
+// "-max-backing-fds": caps the number of backing files that are open at the
+// same time. Every open file handle (File) holds a slot from Open or Create
+// until Release. Opens that find no free slot queue until another file is
+// released, and fail with EMFILE after fdLimitWait. An application that keeps
+// more files open than the limit would otherwise hang forever.
+//
+// Files that gocryptfs opens for itself, like the one in FS.Truncate, do not
+// take a slot. They are closed before the operation returns, and the caller
+// may hold locks that the file handles in the queue need.
+//
+// Only the file handles are counted, and not the short-lived directory fds
+// that each operation uses internally (openBackingDir). Those are closed
+// before the operation returns, so they are bounded by the number of
+// requests in flight. As a slot is taken before any fd is opened, an
+// operation never waits for a slot while it holds one, and operations that
+// need two directory fds, like Rename, do not wait at all. This keeps the
+// limit free of deadlocks.
+
+import (
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// fdLimitWait is how long acquire waits for a free slot.
+var fdLimitWait = 10 * time.Second
+
+// fdLimit is a counting semaphore. The nil value means unlimited.
+type fdLimit chan struct{}
+
+// newFdLimit returns an fdLimit with "n" slots, or nil if n <= 0.
+func newFdLimit(n int) fdLimit {
+	if n <= 0 {
+		return nil
+	}
+	return make(fdLimit, n)
+}
+
+// acquire takes a slot, waiting up to fdLimitWait for one to become free.
+// Returns false if there was none.
+func (l fdLimit) acquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l <- struct{}{}:
+		return true
+	default:
+	}
+	tlog.Debug.Printf("fdLimit: all %d slots in use, waiting", cap(l))
+	t := time.NewTimer(fdLimitWait)
+	defer t.Stop()
+	select {
+	case l <- struct{}{}:
+		return true
+	case <-t.C:
+		tlog.Warn.Printf("fdLimit: all %d slots still in use after %v, returning EMFILE", cap(l), fdLimitWait)
+		return false
+	}
+}
+
+// release returns a slot taken by acquire.
+func (l fdLimit) release() {
+	if l == nil {
+		return
+	}
+	<-l
+}
@@ -0,0 +1,86 @@
+package fusefrontend
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestMaxBackingFds checks that "-max-backing-fds" queues opens, that failed
+// opens do not leak a slot, and that operations that do not keep a file open
+// do not wait.
+func TestMaxBackingFds(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, LongNames: true, MaxBackingFds: 1})
+	f1, code := fs.Create("a", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	// Does not need a file handle and must not wait
+	if code = fs.Mkdir("dir", 0700, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code = fs.Rename("dir", "dir2", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	done := make(chan fuse.Status)
+	go func() {
+		f2, code := fs.Open("a", uint32(os.O_RDONLY), nil)
+		if code.Ok() {
+			f2.Release()
+		}
+		done <- code
+	}()
+	select {
+	case code = <-done:
+		t.Fatalf("Open should have waited, returned %v", code)
+	case <-time.After(100 * time.Millisecond):
+	}
+	f1.Release()
+	select {
+	case code = <-done:
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Open still waiting after Release")
+	}
+	// Failed opens give their slot back
+	for i := 0; i < 3; i++ {
+		if _, code = fs.Open("missing", uint32(os.O_RDONLY), nil); code != fuse.ENOENT {
+			t.Fatalf("want ENOENT, got %v", code)
+		}
+		if _, code = fs.Create("a", uint32(os.O_RDWR), 0600, nil); code.Ok() {
+			t.Fatal("Create of an existing file should fail")
+		}
+	}
+	f3, code := fs.Open("a", uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	// Opens give up after fdLimitWait, while Truncate, which opens the file
+	// for itself, does not need a slot
+	defer func(d time.Duration) { fdLimitWait = d }(fdLimitWait)
+	fdLimitWait = 10 * time.Millisecond
+	if _, code = fs.Open("a", uint32(os.O_RDONLY), nil); code != fuse.Status(syscall.EMFILE) {
+		t.Errorf("Open: want EMFILE, got %v", code)
+	}
+	if _, code = fs.Create("b", uint32(os.O_RDWR), 0600, nil); code != fuse.Status(syscall.EMFILE) {
+		t.Errorf("Create: want EMFILE, got %v", code)
+	}
+	if code = fs.Truncate("a", 10, nil); !code.Ok() {
+		t.Errorf("Truncate: %v", code)
+	}
+	f3.Release()
+	// The slot is free again
+	f4, code := fs.Open("a", uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f4.Release()
+}
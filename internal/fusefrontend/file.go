@@ -10,6 +10,7 @@ import (
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -19,6 +20,7 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/inomap"
 	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/opstats"
 	"github.com/rfjakob/gocryptfs/internal/serialize_reads"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
@@ -51,6 +53,20 @@ type File struct {
 	// The opCount is used to judge whether "lastWrittenOffset" is still
 	// guaranteed to be correct.
 	lastOpCount uint64
+	// hiresMtime is the time of the last write that has not been stored by
+	// flushHiresTime yet ("-emulate-hires-time"). Protected by ContentLock.
+	hiresMtime time.Time
+	// readAhead is the prefetch state for "-readahead". Nil if disabled.
+	readAhead *readAhead
+	// dirty is the block cached by "-coalesce-writes". Protected by
+	// ContentLock.
+	dirty dirtyBlock
+	// killPrivPending is 1 if the SUID and SGID bits still have to be
+	// cleared on the first write, see killPriv. Accessed atomically.
+	killPrivPending uint32
+	// fdSlot is true if the file holds a slot from "-max-backing-fds", see
+	// fd_limit.go
+	fdSlot bool
 	// Parent filesystem
 	fs *FS
 	// We embed a nodefs.NewDefaultFile() that returns ENOSYS for every operation we
@@ -59,8 +75,9 @@ type File struct {
 	nodefs.File
 }
 
-// NewFile returns a new go-fuse File instance.
-func NewFile(fd *os.File, fs *FS) (*File, fuse.Status) {
+// NewFile returns a new go-fuse File instance. "caller" is the context of the
+// FUSE request that opened the file.
+func NewFile(fd *os.File, fs *FS, caller *fuse.Context) (*File, fuse.Status) {
 	var st syscall.Stat_t
 	err := syscall.Fstat(int(fd.Fd()), &st)
 	if err != nil {
@@ -70,14 +87,22 @@ func NewFile(fd *os.File, fs *FS) (*File, fuse.Status) {
 	qi := inomap.QInoFromStat(&st)
 	e := openfiletable.Register(qi)
 
-	return &File{
+	f := &File{
 		fd:             fd,
 		contentEnc:     fs.contentEnc,
 		qIno:           qi,
 		fileTableEntry: e,
 		fs:             fs,
 		File:           nodefs.NewDefaultFile(),
-	}, fuse.OK
+	}
+	if fs.args.ReadAhead > 0 && !fs.args.SerializeReads {
+		f.readAhead = newReadAhead()
+	}
+	if killPrivMode(uint32(st.Mode)) != uint32(st.Mode) && !isPrivileged(caller) {
+		f.killPrivPending = 1
+	}
+	atomic.AddInt64(&fs.openFiles, 1)
+	return f, fuse.OK
 }
 
 // intFd - return the backing file descriptor as an integer.
@@ -93,6 +118,7 @@ func (f *File) readFileID() ([]byte, error) {
 	// This makes File ID poisoning more difficult.
 	readLen := contentenc.HeaderLen + 1
 	buf := make([]byte, readLen)
+	f.fs.readLimit.Wait(readLen)
 	n, err := f.fd.ReadAt(buf, 0)
 	if err != nil {
 		if err == io.EOF && n != 0 {
@@ -103,7 +129,7 @@ func (f *File) readFileID() ([]byte, error) {
 		return nil, err
 	}
 	buf = buf[:contentenc.HeaderLen]
-	h, err := contentenc.ParseHeader(buf)
+	h, err := f.contentEnc.ParseHeader(buf)
 	if err != nil {
 		return nil, err
 	}
@@ -114,7 +140,7 @@ func (f *File) readFileID() ([]byte, error) {
 // Returns the new file ID.
 // The caller must hold fileIDLock.Lock().
 func (f *File) createHeader() (fileID []byte, err error) {
-	h := contentenc.RandomHeader()
+	h := f.contentEnc.RandomHeader()
 	buf := h.Pack()
 	// Prevent partially written (=corrupt) header by preallocating the space beforehand
 	if !f.fs.args.NoPrealloc {
@@ -127,6 +153,7 @@ func (f *File) createHeader() (fileID []byte, err error) {
 		}
 	}
 	// Actually write header
+	f.fs.writeLimit.Wait(len(buf))
 	_, err = f.fd.WriteAt(buf, 0)
 	if err != nil {
 		return nil, err
@@ -138,12 +165,31 @@ func (f *File) createHeader() (fileID []byte, err error) {
 // to "dst".
 // Arguments "length" and "off" do not have to be block-aligned.
 //
-// doRead reads the corresponding ciphertext blocks from disk, decrypts them and
-// returns the requested part of the plaintext.
-//
-// Called by Read() for normal reading,
-// by Write() and Truncate() via doWrite() for Read-Modify-Write.
+// Called by Truncate() to read the new last block when shrinking a file.
 func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Status) {
+	out, pooled, status := f.doReadPooled(off, length)
+	if status != fuse.OK {
+		return nil, status
+	}
+	out = append(dst, out...)
+	if pooled != nil {
+		f.contentEnc.PReqPool.Put(pooled)
+	}
+	return out, fuse.OK
+}
+
+// doReadPooled reads the ciphertext blocks that cover "length" plaintext
+// bytes at plaintext offset "off" from disk and decrypts them into a buffer
+// from PReqPool.
+//
+// Returns the requested part of the plaintext as "out", which points into
+// "pooled". The caller must give "pooled" back to PReqPool once it is done
+// with "out". "pooled" is nil if nothing was read.
+//
+// Called by Read() for normal reading, which passes the buffer to go-fuse
+// without copying it again, by doWrite() for Read-Modify-Write, and by
+// doRead().
+func (f *File) doReadPooled(off uint64, length uint64) (out []byte, pooled []byte, status fuse.Status) {
 	// Get the file ID, either from the open file table, or from disk.
 	var fileID []byte
 	f.fileTableEntry.IDLock.Lock()
@@ -158,7 +204,7 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 			f.fileTableEntry.IDLock.Unlock()
 			if err == io.EOF {
 				// Empty file
-				return nil, fuse.OK
+				return nil, nil, fuse.OK
 			}
 			buf := make([]byte, 100)
 			n, _ := f.fd.ReadAt(buf, 0)
@@ -166,7 +212,7 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 			hexdump := hex.EncodeToString(buf)
 			tlog.Warn.Printf("doRead %d: corrupt header: %v\nFile hexdump (%d bytes): %s",
 				f.qIno.Ino, err, n, hexdump)
-			return nil, fuse.EIO
+			return nil, nil, fuse.EIO
 		}
 		// Save into the file table
 		f.fileTableEntry.ID = fileID
@@ -184,15 +230,17 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 
 	ciphertext := f.fs.contentEnc.CReqPool.Get()
 	ciphertext = ciphertext[:int(alignedLength)]
+	f.fs.readLimit.Wait(len(ciphertext))
 	n, err := f.fd.ReadAt(ciphertext, int64(alignedOffset))
 	if err != nil && err != io.EOF {
 		tlog.Warn.Printf("read: ReadAt: %s", err.Error())
-		return nil, fuse.ToStatus(err)
+		f.fs.contentEnc.CReqPool.Put(ciphertext)
+		return nil, nil, fuse.ToStatus(err)
 	}
 	// The ReadAt came back empty. We can skip all the decryption and return early.
 	if n == 0 {
 		f.fs.contentEnc.CReqPool.Put(ciphertext)
-		return dst, fuse.OK
+		return nil, nil, fuse.OK
 	}
 	// Truncate ciphertext buffer down to actually read bytes
 	ciphertext = ciphertext[0:n]
@@ -212,12 +260,13 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 		} else {
 			curruptBlockNo := firstBlockNo + f.contentEnc.PlainOffToBlockNo(uint64(len(plaintext)))
 			tlog.Warn.Printf("doRead %d: corrupt block #%d: %v", f.qIno.Ino, curruptBlockNo, err)
-			return nil, fuse.EIO
+			// The failed block may have left data behind the end of plaintext
+			f.fs.contentEnc.PReqPool.Put(plaintext[:cap(plaintext)])
+			return nil, nil, fuse.EIO
 		}
 	}
 
 	// Crop down to the relevant part
-	var out []byte
 	lenHave := len(plaintext)
 	lenWant := int(skip + length)
 	if lenHave > lenWant {
@@ -227,14 +276,12 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, fuse.Statu
 	}
 	// else: out stays empty, file was smaller than the requested offset
 
-	out = append(dst, out...)
-	f.fs.contentEnc.PReqPool.Put(plaintext)
-
-	return out, fuse.OK
+	return out, plaintext, fuse.OK
 }
 
 // Read - FUSE call
 func (f *File) Read(buf []byte, off int64) (resultData fuse.ReadResult, code fuse.Status) {
+	defer f.fs.stats.Record(opstats.Read, f.fs.stats.Now())
 	if len(buf) > fuse.MAX_KERNEL_WRITE {
 		// This would crash us due to our fixed-size buffer pool
 		tlog.Warn.Printf("Read: rejecting oversized request with EMSGSIZE, len=%d", len(buf))
@@ -243,14 +290,42 @@ func (f *File) Read(buf []byte, off int64) (resultData fuse.ReadResult, code fus
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
+	sequential := false
+	if f.readAhead != nil {
+		sequential = f.readAheadWait(off, len(buf))
+	}
+
 	f.fileTableEntry.ContentLock.RLock()
+	for f.fileTableEntry.Dirty != nil {
+		// "-coalesce-writes": get the cached block to disk first
+		f.fileTableEntry.ContentLock.RUnlock()
+		if status := f.flushDirty(); !status.Ok() {
+			return nil, status
+		}
+		f.fileTableEntry.ContentLock.RLock()
+	}
 	defer f.fileTableEntry.ContentLock.RUnlock()
 
 	tlog.Debug.Printf("ino%d: FUSE Read: offset=%d length=%d", f.qIno.Ino, off, len(buf))
+	// Nothing can be stored beyond the maximum file size, and the offset
+	// calculations would overflow.
+	max := f.contentEnc.MaxPlainSize()
+	if uint64(off) >= max {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	if uint64(off)+uint64(len(buf)) > max {
+		buf = buf[:max-uint64(off)]
+	}
+	if sequential {
+		if out, ok := f.readAheadGet(buf, off); ok {
+			atomic.AddUint64(&f.fs.bytesRead, uint64(len(out)))
+			return fuse.ReadResultData(out), fuse.OK
+		}
+	}
 	if f.fs.args.SerializeReads {
 		serialize_reads.Wait(off, len(buf))
 	}
-	out, status := f.doRead(buf[:0], uint64(off), uint64(len(buf)))
+	out, pooled, status := f.doReadPooled(uint64(off), uint64(len(buf)))
 	if f.fs.args.SerializeReads {
 		serialize_reads.Done()
 	}
@@ -258,7 +333,46 @@ func (f *File) Read(buf []byte, off int64) (resultData fuse.ReadResult, code fus
 		return nil, status
 	}
 	tlog.Debug.Printf("ino%d: Read: status %v, returning %d bytes", f.qIno.Ino, status, len(out))
-	return fuse.ReadResultData(out), status
+	atomic.AddUint64(&f.fs.bytesRead, uint64(len(out)))
+	// A short read means we hit the end of the file. No need to prefetch.
+	if sequential && len(out) == len(buf) {
+		f.readAheadStart(off+int64(len(out)), len(buf))
+	}
+	if pooled == nil {
+		return fuse.ReadResultData(out), status
+	}
+	return &pooledReadResult{data: out, pooled: pooled, contentEnc: f.contentEnc}, status
+}
+
+// pooledReadResult hands decrypted data to go-fuse without copying it into
+// the reply buffer first. The backing buffer goes back to PReqPool when
+// go-fuse calls Done() after sending the reply to the kernel. If Done() is
+// never called, the buffer is simply garbage-collected.
+type pooledReadResult struct {
+	// data is the plaintext to return, a sub-slice of pooled
+	data       []byte
+	pooled     []byte
+	contentEnc *contentenc.ContentEnc
+}
+
+// Bytes implements fuse.ReadResult
+func (r *pooledReadResult) Bytes(buf []byte) ([]byte, fuse.Status) {
+	return r.data, fuse.OK
+}
+
+// Size implements fuse.ReadResult
+func (r *pooledReadResult) Size() int {
+	return len(r.data)
+}
+
+// Done implements fuse.ReadResult
+func (r *pooledReadResult) Done() {
+	if r.pooled == nil {
+		return
+	}
+	r.contentEnc.PReqPool.Put(r.pooled)
+	r.pooled = nil
+	r.data = nil
 }
 
 // doWrite - encrypt "data" and write it to plaintext offset "off"
@@ -271,7 +385,11 @@ func (f *File) Read(buf []byte, off int64) (resultData fuse.ReadResult, code fus
 //
 // Empty writes do nothing and are allowed.
 func (f *File) doWrite(data []byte, off int64) (uint32, fuse.Status) {
+	defer f.quotaEnd(f.quotaBegin())
+	defer f.exactSizeEnd(f.exactSizeBegin())
 	fileWasEmpty := false
+	// header is the new file header if it has not been written yet
+	var header []byte
 	// Get the file ID, create a new one if it does not exist yet.
 	var fileID []byte
 	// The caller has exclusively locked ContentLock, which blocks all other
@@ -282,8 +400,14 @@ func (f *File) doWrite(data []byte, off int64) (uint32, fuse.Status) {
 		// If the file ID is not cached, read it from disk
 		var err error
 		fileID, err = f.readFileID()
-		// Write a new file header if the file is empty
-		if err == io.EOF {
+		// Write a new file header if the file is empty. If we write to the
+		// first block, which is the common case for new files, the header
+		// goes to disk together with the block in a single write.
+		if err == io.EOF && len(data) > 0 && uint64(off) < f.contentEnc.PlainBS() {
+			h := f.contentEnc.RandomHeader()
+			fileID, header, err = h.ID, h.Pack(), nil
+			fileWasEmpty = true
+		} else if err == io.EOF {
 			fileID, err = f.createHeader()
 			fileWasEmpty = true
 		}
@@ -296,18 +420,33 @@ func (f *File) doWrite(data []byte, off int64) (uint32, fuse.Status) {
 	dataBuf := bytes.NewBuffer(data)
 	blocks := f.contentEnc.ExplodePlainRange(uint64(off), uint64(len(data)))
 	toEncrypt := make([][]byte, len(blocks))
+	// Buffers from PReqPool used for Read-Modify-Write. At most the first and
+	// the last block are partial.
+	var rmwBufs [][]byte
+	defer func() {
+		for _, buf := range rmwBufs {
+			f.contentEnc.PReqPool.Put(buf)
+		}
+	}()
 	for i, b := range blocks {
 		blockData := dataBuf.Next(int(b.Length))
 		// Incomplete block -> Read-Modify-Write
 		if b.IsPartial() {
 			// Read
-			oldData, status := f.doRead(nil, b.BlockPlainOff(), f.contentEnc.PlainBS())
+			oldData, pooled, status := f.doReadPooled(b.BlockPlainOff(), f.contentEnc.PlainBS())
 			if status != fuse.OK {
 				tlog.Warn.Printf("ino%d fh%d: RMW read failed: %s", f.qIno.Ino, f.intFd(), status.String())
 				return 0, status
 			}
+			if pooled == nil {
+				// Nothing to read, merge into an empty buffer
+				pooled = f.contentEnc.PReqPool.Get()
+				oldData = pooled[:0]
+			}
+			// Reading and merging only touches the first block of the buffer
+			rmwBufs = append(rmwBufs, pooled[:f.contentEnc.PlainBS()])
 			// Modify
-			blockData = f.contentEnc.MergeBlocks(oldData, blockData, int(b.Skip))
+			blockData = f.contentEnc.MergeBlocksInPlace(oldData, blockData, int(b.Skip))
 			tlog.Debug.Printf("len(oldData)=%d len(blockData)=%d", len(oldData), len(blockData))
 		}
 		tlog.Debug.Printf("ino%d: Writing %d bytes to block #%d",
@@ -315,12 +454,16 @@ func (f *File) doWrite(data []byte, off int64) (uint32, fuse.Status) {
 		// Write into the to-encrypt list
 		toEncrypt[i] = blockData
 	}
-	// Encrypt all blocks
-	ciphertext := f.contentEnc.EncryptBlocks(toEncrypt, blocks[0].BlockNo, f.fileTableEntry.ID)
+	// Encrypt all blocks. The header directly precedes block #0, so
+	// it is written together with the ciphertext.
+	ciphertext := f.contentEnc.EncryptBlocksWithHeader(header, toEncrypt, blocks[0].BlockNo, f.fileTableEntry.ID)
+	cOff := int64(blocks[0].BlockCipherOff())
+	if header != nil {
+		cOff = 0
+	}
 	// Preallocate so we cannot run out of space in the middle of the write.
 	// This prevents partially written (=corrupt) blocks.
 	var err error
-	cOff := int64(blocks[0].BlockCipherOff())
 	if !f.fs.args.NoPrealloc {
 		err = syscallcompat.EnospcPrealloc(f.intFd(), cOff, int64(len(ciphertext)))
 		if err != nil {
@@ -339,14 +482,38 @@ func (f *File) doWrite(data []byte, off int64) (uint32, fuse.Status) {
 		}
 	}
 	// Write
-	_, err = f.fd.WriteAt(ciphertext, cOff)
+	f.fs.writeLimit.Wait(len(ciphertext))
+	if f.fs.journal != nil {
+		err = f.fs.journal.write(f.fd, ciphertext, cOff)
+	} else {
+		_, err = f.fd.WriteAt(ciphertext, cOff)
+	}
+	var verifyErr error
+	if err == nil && f.fs.args.ParanoidWrite {
+		verifyErr = f.verifyWrite(ciphertext, cOff, header != nil, blocks[0].BlockNo, toEncrypt)
+	}
 	// Return memory to CReqPool
 	f.fs.contentEnc.CReqPool.Put(ciphertext)
 	if err != nil {
 		tlog.Warn.Printf("ino%d fh%d: doWrite: WriteAt off=%d len=%d failed: %v",
 			f.qIno.Ino, f.intFd(), cOff, len(ciphertext), err)
+		if header != nil {
+			// Do not leave a partial header behind
+			f.fileTableEntry.ID = nil
+			syscall.Ftruncate(f.intFd(), 0)
+		}
 		return 0, fuse.ToStatus(err)
 	}
+	if verifyErr != nil {
+		tlog.Warn.Printf("ino%d fh%d: doWrite: -paranoid-write: verifying off=%d len=%d failed: %v",
+			f.qIno.Ino, f.intFd(), cOff, len(ciphertext), verifyErr)
+		if header != nil {
+			// The file was empty before
+			f.fileTableEntry.ID = nil
+			syscall.Ftruncate(f.intFd(), 0)
+		}
+		return 0, fuse.EIO
+	}
 	return uint32(len(data)), fuse.OK
 }
 
@@ -364,11 +531,15 @@ func (f *File) isConsecutiveWrite(off int64) bool {
 //
 // If the write creates a hole, pads the file to the next block boundary.
 func (f *File) Write(data []byte, off int64) (uint32, fuse.Status) {
+	defer f.fs.stats.Record(opstats.Write, f.fs.stats.Now())
 	if len(data) > fuse.MAX_KERNEL_WRITE {
 		// This would crash us due to our fixed-size buffer pool
 		tlog.Warn.Printf("Write: rejecting oversized request with EMSGSIZE, len=%d", len(data))
 		return 0, fuse.Status(syscall.EMSGSIZE)
 	}
+	if code := f.fs.checkWritable(); !code.Ok() {
+		return 0, code
+	}
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 	if f.released {
@@ -379,6 +550,28 @@ func (f *File) Write(data []byte, off int64) (uint32, fuse.Status) {
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
 	tlog.Debug.Printf("ino%d: FUSE Write: offset=%d length=%d", f.qIno.Ino, off, len(data))
+	if off < 0 || uint64(off)+uint64(len(data)) > f.contentEnc.MaxPlainSize() {
+		return 0, fuse.Status(syscall.EFBIG)
+	}
+	if status := f.quotaCheckGrow(uint64(off) + uint64(len(data))); !status.Ok() {
+		return 0, status
+	}
+	if status := f.killPriv(); !status.Ok() {
+		return 0, status
+	}
+	if handled, status := f.coalesceWrite(data, off); handled {
+		if !status.Ok() {
+			return 0, status
+		}
+		f.lastOpCount = openfiletable.WriteOpCount()
+		f.lastWrittenOffset = off + int64(len(data)) - 1
+		f.markHiresMtime()
+		atomic.AddUint64(&f.fs.bytesWritten, uint64(len(data)))
+		return uint32(len(data)), fuse.OK
+	}
+	if status := f.flushDirtyLocked(); !status.Ok() {
+		return 0, status
+	}
 	// If the write creates a file hole, we have to zero-pad the last block.
 	// But if the write directly follows an earlier write, it cannot create a
 	// hole, and we can save one Stat() call.
@@ -392,6 +585,8 @@ func (f *File) Write(data []byte, off int64) (uint32, fuse.Status) {
 	if status.Ok() {
 		f.lastOpCount = openfiletable.WriteOpCount()
 		f.lastWrittenOffset = off + int64(len(data)) - 1
+		f.markHiresMtime()
+		atomic.AddUint64(&f.fs.bytesWritten, uint64(n))
 	}
 	return n, status
 }
@@ -402,9 +597,19 @@ func (f *File) Release() {
 	if f.released {
 		log.Panicf("ino%d fh%d: double release", f.qIno.Ino, f.intFd())
 	}
+	// Errors have already been logged by FlushDirty
+	f.flushDirty()
+	f.flushHiresTime()
+	if f.readAhead != nil {
+		f.readAheadRelease()
+	}
 	f.released = true
+	atomic.AddInt64(&f.fs.openFiles, -1)
 	openfiletable.Unregister(f.qIno)
 	f.fd.Close()
+	if f.fdSlot {
+		f.fs.backingFds.release()
+	}
 	f.fdLock.Unlock()
 }
 
@@ -412,6 +617,12 @@ func (f *File) Release() {
 func (f *File) Flush() fuse.Status {
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
+	if !f.released {
+		if status := f.syncDirty(); !status.Ok() {
+			return status
+		}
+		f.flushHiresTime()
+	}
 
 	// Since Flush() may be called for each dup'd fd, we don't
 	// want to really close the file, we just want to flush. This
@@ -429,12 +640,18 @@ func (f *File) Flush() fuse.Status {
 func (f *File) Fsync(flags int) (code fuse.Status) {
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
+	if status := f.syncDirty(); !status.Ok() {
+		return status
+	}
 
 	return fuse.ToStatus(syscall.Fsync(f.intFd()))
 }
 
 // Chmod FUSE call
 func (f *File) Chmod(mode uint32) fuse.Status {
+	if code := f.fs.checkWritable(); !code.Ok() {
+		return code
+	}
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
@@ -446,6 +663,9 @@ func (f *File) Chmod(mode uint32) fuse.Status {
 
 // Chown FUSE call
 func (f *File) Chown(uid uint32, gid uint32) fuse.Status {
+	if code := f.fs.checkWritable(); !code.Ok() {
+		return code
+	}
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
@@ -458,6 +678,9 @@ func (f *File) GetAttr(a *fuse.Attr) fuse.Status {
 	defer f.fdLock.RUnlock()
 
 	tlog.Debug.Printf("file.GetAttr()")
+	if status := f.flushDirty(); !status.Ok() {
+		return status
+	}
 	st := syscall.Stat_t{}
 	err := syscall.Fstat(f.intFd(), &st)
 	if err != nil {
@@ -465,7 +688,14 @@ func (f *File) GetAttr(a *fuse.Attr) fuse.Status {
 	}
 	f.fs.inoMap.TranslateStat(&st)
 	a.FromStat(&st)
-	a.Size = f.contentEnc.CipherSizeToPlainSize(a.Size)
+	if f.fs.args.EmulateHiresTime {
+		f.fs.fgetAttrHiresTime(f.intFd(), a)
+		f.applyHiresMtime(a)
+	}
+	f.fs.plainAttr(a)
+	if f.fs.args.ExactSize {
+		f.fs.fgetAttrExactSize(f.intFd(), a, fmt.Sprint(f.qIno.Ino))
+	}
 	if f.fs.args.ForceOwner != nil {
 		a.Owner = *f.fs.args.ForceOwner
 	}
@@ -475,8 +705,27 @@ func (f *File) GetAttr(a *fuse.Attr) fuse.Status {
 
 // Utimens FUSE call
 func (f *File) Utimens(a *time.Time, m *time.Time) fuse.Status {
+	if code := f.fs.checkWritable(); !code.Ok() {
+		return code
+	}
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
+	if f.released {
+		return fuse.EBADF
+	}
+	// Flushing later would change the mtime again
+	if status := f.flushDirty(); !status.Ok() {
+		return status
+	}
 	err := syscallcompat.FutimesNano(f.intFd(), a, m)
+	if err == nil && f.fs.args.EmulateHiresTime {
+		if m != nil {
+			// The explicit mtime wins over the time of earlier writes
+			f.fileTableEntry.ContentLock.Lock()
+			f.hiresMtime = time.Time{}
+			f.fileTableEntry.ContentLock.Unlock()
+		}
+		f.fs.storeHiresTime(f.intFd(), a, m)
+	}
 	return fuse.ToStatus(err)
 }
@@ -20,6 +20,10 @@ const FALLOC_DEFAULT = 0x00
 // FALLOC_FL_KEEP_SIZE allocates disk space while not modifying the file size
 const FALLOC_FL_KEEP_SIZE = 0x01
 
+// FALLOC_FL_PUNCH_HOLE deallocates disk space. Must be combined with
+// FALLOC_FL_KEEP_SIZE.
+const FALLOC_FL_PUNCH_HOLE = 0x02
+
 // Only warn once
 var allocateWarnOnce sync.Once
 
@@ -35,11 +39,19 @@ var allocateWarnOnce sync.Once
 // This allows us to reuse the file grow mechanics from Truncate as they are
 // complicated and hard to get right.
 //
-// Other modes (hole punching, zeroing) are not supported.
-func (f *File) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
-	if mode != FALLOC_DEFAULT && mode != FALLOC_FL_KEEP_SIZE {
+// mode=FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE is implemented by punchHole
+// when "-discard" is enabled.
+//
+// Other modes (zeroing, collapsing) are not supported.
+func (f *File) Allocate(off uint64, sz uint64, mode uint32) (code fuse.Status) {
+	if code := f.fs.checkWritable(); !code.Ok() {
+		return code
+	}
+	punchHole := f.fs.args.Discard && mode == FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE
+	if mode != FALLOC_DEFAULT && mode != FALLOC_FL_KEEP_SIZE && !punchHole {
 		f := func() {
-			tlog.Info.Printf("fallocate: only mode 0 (default) and 1 (keep size) are supported")
+			tlog.Info.Printf("fallocate: only mode 0 (default) and 1 (keep size) are supported, " +
+				"and mode 3 (punch hole) with -discard")
 		}
 		allocateWarnOnce.Do(f)
 		return fuse.Status(syscall.EOPNOTSUPP)
@@ -50,8 +62,31 @@ func (f *File) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
 	if f.released {
 		return fuse.EBADF
 	}
+	if code := f.killPriv(); !code.Ok() {
+		return code
+	}
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
+	defer f.exactSizeEnd(f.exactSizeBegin())
+	defer func() {
+		if code.Ok() && mode != FALLOC_FL_KEEP_SIZE {
+			f.markHiresMtime()
+		}
+	}()
+	if off+sz > f.contentEnc.MaxPlainSize() || off+sz < off {
+		return fuse.Status(syscall.EFBIG)
+	}
+	if status := f.flushDirtyLocked(); !status.Ok() {
+		return status
+	}
+	if punchHole {
+		return f.punchHole(off, sz)
+	}
+	if mode == FALLOC_DEFAULT {
+		if status := f.quotaCheckGrow(off + sz); !status.Ok() {
+			return status
+		}
+	}
 
 	blocks := f.contentEnc.ExplodePlainRange(off, sz)
 	firstBlock := blocks[0]
@@ -92,7 +127,10 @@ func (f *File) Allocate(off uint64, sz uint64, mode uint32) fuse.Status {
 }
 
 // Truncate - FUSE call
-func (f *File) Truncate(newSize uint64) fuse.Status {
+func (f *File) Truncate(newSize uint64) (code fuse.Status) {
+	if code := f.fs.checkWritable(); !code.Ok() {
+		return code
+	}
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 	if f.released {
@@ -100,12 +138,30 @@ func (f *File) Truncate(newSize uint64) fuse.Status {
 		tlog.Warn.Printf("ino%d fh%d: Truncate on released file", f.qIno.Ino, f.intFd())
 		return fuse.EBADF
 	}
+	if code := f.killPriv(); !code.Ok() {
+		return code
+	}
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
+	defer f.exactSizeEnd(f.exactSizeBegin())
+	defer func() {
+		if code.Ok() {
+			f.markHiresMtime()
+		}
+	}()
+	if newSize > f.contentEnc.MaxPlainSize() {
+		return fuse.Status(syscall.EFBIG)
+	}
+	if status := f.flushDirtyLocked(); !status.Ok() {
+		return status
+	}
 	var err error
 	// Common case first: Truncate to zero
 	if newSize == 0 {
+		f.secureDiscard(0)
+		before := f.quotaBegin()
 		err = syscall.Ftruncate(int(f.fd.Fd()), 0)
+		f.quotaEnd(before)
 		if err != nil {
 			tlog.Warn.Printf("ino%d fh%d: Ftruncate(fd, 0) returned error: %v", f.qIno.Ino, f.intFd(), err)
 			return fuse.ToStatus(err)
@@ -131,6 +187,9 @@ func (f *File) Truncate(newSize uint64) fuse.Status {
 	}
 	// File grows
 	if newSize > oldSize {
+		if status := f.fs.quotaCheck(newSize - oldSize); !status.Ok() {
+			return status
+		}
 		return f.truncateGrowFile(oldSize, newSize)
 	}
 
@@ -149,7 +208,10 @@ func (f *File) Truncate(newSize uint64) fuse.Status {
 		}
 	}
 	// Truncate down to the last complete block
+	f.secureDiscard(cipherOff)
+	before := f.quotaBegin()
 	err = syscall.Ftruncate(int(f.fd.Fd()), int64(cipherOff))
+	f.quotaEnd(before)
 	if err != nil {
 		tlog.Warn.Printf("Truncate: shrink Ftruncate returned error: %v", err)
 		return fuse.ToStatus(err)
@@ -162,6 +224,51 @@ func (f *File) Truncate(newSize uint64) fuse.Status {
 	return fuse.OK
 }
 
+// punchHole deallocates the plaintext range "off", "sz" in the backing file
+// ("-discard"), which lets thin-provisioned storage reclaim the space.
+// Blocks that are completely inside the range become holes in the backing
+// file, which read back as zeros like any other file hole. Partially
+// covered blocks are overwritten with zeros. The file size does not change.
+//
+// Called with ContentLock held.
+func (f *File) punchHole(off uint64, sz uint64) fuse.Status {
+	plainSz, err := f.statPlainSize()
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	// Nothing to do past the end of the file
+	if off >= plainSz || sz == 0 {
+		return fuse.OK
+	}
+	if off+sz > plainSz {
+		sz = plainSz - off
+	}
+	// Only the first and the last block can be partial, the full blocks in
+	// between are contiguous in the backing file.
+	var holeOff, holeEnd uint64
+	for _, b := range f.contentEnc.ExplodePlainRange(off, sz) {
+		if b.IsPartial() {
+			zeros := make([]byte, b.Length)
+			if _, status := f.doWrite(zeros, int64(b.BlockPlainOff()+b.Skip)); !status.Ok() {
+				return status
+			}
+			continue
+		}
+		if holeEnd == 0 {
+			holeOff = b.BlockCipherOff()
+		}
+		holeEnd = b.BlockCipherOff() + f.contentEnc.CipherBS()
+	}
+	if holeEnd == 0 {
+		return fuse.OK
+	}
+	tlog.Debug.Printf("ino%d: punchHole off=%d sz=%d holeOff=%d holeEnd=%d",
+		f.qIno.Ino, off, sz, holeOff, holeEnd)
+	err = syscallcompat.Fallocate(f.intFd(), FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE,
+		int64(holeOff), int64(holeEnd-holeOff))
+	return fuse.ToStatus(err)
+}
+
 // statPlainSize stats the file and returns the plaintext size
 func (f *File) statPlainSize() (uint64, error) {
 	fi, err := f.fd.Stat()
@@ -213,7 +320,9 @@ func (f *File) truncateGrowFile(oldPlainSz uint64, newPlainSz uint64) fuse.Statu
 			f.fileTableEntry.ID = id
 		}
 		cSz := int64(f.contentEnc.PlainSizeToCipherSize(newPlainSz))
+		before := f.quotaBegin()
 		err := syscall.Ftruncate(f.intFd(), cSz)
+		f.quotaEnd(before)
 		if err != nil {
 			tlog.Warn.Printf("Truncate: grow Ftruncate returned error: %v", err)
 		}
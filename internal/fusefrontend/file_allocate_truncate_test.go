@@ -0,0 +1,141 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestPunchHoleDiscard checks that punching a hole with "-discard" frees
+// the space in the backing file, reads back as zeros and keeps the file
+// size and the rest of the content intact.
+func TestPunchHoleDiscard(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, Discard: true})
+	f, code := fs.Create("file", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	// Writes are limited to 128 kiB, like from the kernel
+	chunk := bytes.Repeat([]byte("x"), 128*1024)
+	var content []byte
+	for i := 0; i < 8; i++ {
+		if _, code = f.Write(chunk, int64(len(content))); !code.Ok() {
+			t.Fatal(code)
+		}
+		content = append(content, chunk...)
+	}
+	cName, err := fs.EncryptPath("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := func() syscall.Stat_t {
+		var st syscall.Stat_t
+		if err := syscall.Stat(filepath.Join(cipherdir, cName), &st); err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+	before := stat()
+	// Unaligned on both ends, so that the partial blocks are zeroed
+	const off, sz = 5000, 600000
+	if err = syscallcompat.Fallocate(int(f.(*File).fd.Fd()), FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE,
+		before.Size, 1); err != nil {
+		t.Skipf("backing filesystem does not support hole punching: %v", err)
+	}
+	code = f.Allocate(off, sz, FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	after := stat()
+	if after.Blocks >= before.Blocks {
+		t.Errorf("backing allocation did not shrink: %d -> %d blocks", before.Blocks, after.Blocks)
+	}
+	if after.Size != before.Size {
+		t.Errorf("backing file size changed: %d -> %d", before.Size, after.Size)
+	}
+	copy(content[off:off+sz], make([]byte, sz))
+	var data []byte
+	for {
+		buf := make([]byte, len(chunk))
+		res, code := f.Read(buf, int64(len(data)))
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		b, _ := res.Bytes(buf)
+		if len(b) == 0 {
+			break
+		}
+		data = append(data, b...)
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("content mismatch after punching hole, got %d bytes", len(data))
+	}
+}
+
+// TestPunchHoleNoDiscard checks that hole punching is rejected without
+// "-discard".
+func TestPunchHoleNoDiscard(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	f, code := fs.Create("file", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	if _, code = f.Write(make([]byte, 10000), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	code = f.Allocate(0, 10000, FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE)
+	if code != fuse.Status(syscall.EOPNOTSUPP) {
+		t.Errorf("want EOPNOTSUPP, got %v", code)
+	}
+}
+
+// TestMaxFileSize checks that operations beyond the largest possible file
+// size fail with EFBIG instead of overflowing the offset calculations.
+func TestMaxFileSize(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	f, code := fs.Create("file", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	if _, code = f.Write([]byte("hello"), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	max := fs.contentEnc.MaxPlainSize()
+	if code = f.Truncate(max + 1); code != fuse.Status(syscall.EFBIG) {
+		t.Errorf("Truncate beyond max size: want EFBIG, got %v", code)
+	}
+	if _, code = f.Write([]byte("xy"), int64(max-1)); code != fuse.Status(syscall.EFBIG) {
+		t.Errorf("Write beyond max size: want EFBIG, got %v", code)
+	}
+	if code = f.Allocate(max-1, 2, 0); code != fuse.Status(syscall.EFBIG) {
+		t.Errorf("Allocate beyond max size: want EFBIG, got %v", code)
+	}
+	buf := make([]byte, 100)
+	res, code := f.Read(buf, int64(max))
+	if !code.Ok() {
+		t.Fatalf("Read at max size: %v", code)
+	}
+	if data, _ := res.Bytes(buf); len(data) != 0 {
+		t.Errorf("Read at max size returned %d bytes", len(data))
+	}
+	var a fuse.Attr
+	if code = f.GetAttr(&a); !code.Ok() {
+		t.Fatal(code)
+	}
+	if a.Size != 5 {
+		t.Errorf("size changed to %d", a.Size)
+	}
+}
@@ -0,0 +1,165 @@
+package fusefrontend
+
+// "-coalesce-writes": keep the block that small writes go to in memory, so
+// that a run of small writes into the same block costs one
+// read-modify-write instead of one per write.
+//
+// Only one handle of a file can hold a dirty block at a time. It is
+// registered in openfiletable.Entry.Dirty, and every other operation on the
+// file that looks at the content on disk writes it out first.
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/inomap"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// dirtyBlock is a plaintext block that has been written to, but not to disk
+type dirtyBlock struct {
+	// off is the plaintext offset of the block
+	off int64
+	// data is the content of the block. Nil if there is no dirty block.
+	data []byte
+	// buf is kept for reuse between blocks
+	buf []byte
+	// err is the error of a failed flush that has not been reported by
+	// Flush or Fsync yet
+	err fuse.Status
+}
+
+// coalesceWrite stores a write that fits into a single block in the dirty
+// block. Returns false if the write has to go to disk directly.
+// The caller must hold ContentLock exclusively.
+func (f *File) coalesceWrite(data []byte, off int64) (handled bool, status fuse.Status) {
+	if !f.fs.args.CoalesceWrites {
+		return false, fuse.OK
+	}
+	bs := int64(f.contentEnc.PlainBS())
+	blockOff := off / bs * bs
+	if off+int64(len(data)) > blockOff+bs || int64(len(data)) == bs {
+		return false, fuse.OK
+	}
+	d := &f.dirty
+	if d.data == nil || d.off != blockOff {
+		if status = f.flushDirtyLocked(); !status.Ok() {
+			return true, status
+		}
+		if !f.isConsecutiveWrite(off) {
+			if status = f.writePadHole(off); !status.Ok() {
+				return true, status
+			}
+		}
+		oldData, pooled, status := f.doReadPooled(uint64(blockOff), uint64(bs))
+		if !status.Ok() {
+			return true, status
+		}
+		if d.buf == nil {
+			d.buf = make([]byte, 0, bs)
+		}
+		d.off = blockOff
+		d.data = append(d.buf[:0], oldData...)
+		if pooled != nil {
+			f.contentEnc.PReqPool.Put(pooled)
+		}
+		f.fileTableEntry.Dirty = f
+	}
+	skip := int(off - blockOff)
+	if end := skip + len(data); end > len(d.data) {
+		oldLen := len(d.data)
+		d.data = d.data[:end]
+		// Zero-fill a gap behind the old end of the block
+		for i := oldLen; i < skip; i++ {
+			d.data[i] = 0
+		}
+	}
+	copy(d.data[skip:], data)
+	return true, fuse.OK
+}
+
+// FlushDirty writes the dirty block to disk. It implements
+// openfiletable.DirtyFile. The caller must hold ContentLock exclusively.
+func (f *File) FlushDirty() error {
+	d := &f.dirty
+	f.fileTableEntry.Dirty = nil
+	if d.data == nil {
+		return nil
+	}
+	_, status := f.doWrite(d.data, d.off)
+	d.data = nil
+	if !status.Ok() {
+		tlog.Warn.Printf("ino%d fh%d: FlushDirty: writing block at offset %d failed: %v",
+			f.qIno.Ino, f.intFd(), d.off, status)
+		d.err = status
+		return syscall.Errno(status)
+	}
+	return nil
+}
+
+// flushDirtyLocked writes the dirty block of this file to disk, no matter
+// which handle holds it. The caller must hold ContentLock exclusively.
+func (f *File) flushDirtyLocked() fuse.Status {
+	if f.fileTableEntry.Dirty == nil {
+		return fuse.OK
+	}
+	return fuse.ToStatus(f.fileTableEntry.Dirty.FlushDirty())
+}
+
+// flushDirty is like flushDirtyLocked, but takes ContentLock itself.
+func (f *File) flushDirty() fuse.Status {
+	if !f.fs.args.CoalesceWrites {
+		return fuse.OK
+	}
+	f.fileTableEntry.ContentLock.Lock()
+	defer f.fileTableEntry.ContentLock.Unlock()
+	return f.flushDirtyLocked()
+}
+
+// syncDirty is like flushDirty, but also reports the error of an earlier
+// failed flush of this handle's dirty block, like the kernel reports
+// writeback errors on fsync and close. Used by Flush and Fsync.
+func (f *File) syncDirty() fuse.Status {
+	if !f.fs.args.CoalesceWrites {
+		return fuse.OK
+	}
+	f.fileTableEntry.ContentLock.Lock()
+	defer f.fileTableEntry.ContentLock.Unlock()
+	status := f.flushDirtyLocked()
+	if !f.dirty.err.Ok() {
+		status = f.dirty.err
+		f.dirty.err = fuse.OK
+	}
+	return status
+}
+
+// flushDirtyStat writes the dirty block of the open file with the backing
+// stat data "st" to disk, if there is one. Used by path-based operations
+// that look at the file size or timestamps.
+func (fs *FS) flushDirtyStat(st *unix.Stat_t) fuse.Status {
+	if !fs.args.CoalesceWrites {
+		return fuse.OK
+	}
+	st2 := syscallcompat.Unix2syscall(*st)
+	e := openfiletable.Lookup(inomap.QInoFromStat(&st2))
+	if e == nil {
+		return fuse.OK
+	}
+	e.ContentLock.RLock()
+	dirty := e.Dirty != nil
+	e.ContentLock.RUnlock()
+	if !dirty {
+		return fuse.OK
+	}
+	e.ContentLock.Lock()
+	defer e.ContentLock.Unlock()
+	if e.Dirty == nil {
+		return fuse.OK
+	}
+	return fuse.ToStatus(e.Dirty.FlushDirty())
+}
@@ -0,0 +1,177 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// plainSizeOnDisk returns the plaintext size of the backing file of "f"
+func plainSizeOnDisk(t *testing.T, f *File) uint64 {
+	fi, err := f.fd.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.contentEnc.CipherSizeToPlainSize(uint64(fi.Size()))
+}
+
+func readAll(t *testing.T, f *File) []byte {
+	buf := make([]byte, 64*1024)
+	res, code := f.Read(buf, 0)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	data, _ := res.Bytes(buf)
+	data = append([]byte(nil), data...)
+	res.Done()
+	return data
+}
+
+// TestCoalesceWrites writes byte by byte with "-coalesce-writes" and checks
+// that blocks only go to disk when the writes move on to the next block, or
+// when another handle or fsync needs the data.
+func TestCoalesceWrites(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, CoalesceWrites: true})
+	nodeFile, code := fs.Create("file", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer nodeFile.Release()
+	w := nodeFile.(*File)
+	bs := int(w.contentEnc.PlainBS())
+	var model []byte
+	write := func(f *File, data []byte, off int) {
+		if _, code := f.Write(data, int64(off)); !code.Ok() {
+			t.Fatal(code)
+		}
+		if end := off + len(data); end > len(model) {
+			model = append(model, make([]byte, end-len(model))...)
+		}
+		copy(model[off:], data)
+	}
+	for i := 0; i < bs; i++ {
+		write(w, []byte{byte(i)}, i)
+	}
+	// Crash consistency: nothing has been written yet, the file on disk is
+	// still the valid empty file
+	if sz := plainSizeOnDisk(t, w); sz != 0 {
+		t.Fatalf("block was written early, plaintext size on disk is %d", sz)
+	}
+	// Moving on to the next block writes out the first one
+	write(w, []byte("x"), bs)
+	if sz := plainSizeOnDisk(t, w); sz != uint64(bs) {
+		t.Fatalf("first block not written, plaintext size on disk is %d", sz)
+	}
+	// A path-based stat sees the cached block
+	a, code := fs.GetAttr("file", nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if a.Size != uint64(len(model)) {
+		t.Errorf("GetAttr: want size %d, got %d", len(model), a.Size)
+	}
+	// A second handle reads what the first one has written
+	nodeFile2, code := fs.Open("file", uint32(os.O_RDWR), nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer nodeFile2.Release()
+	r := nodeFile2.(*File)
+	write(w, []byte("yy"), bs+10)
+	if data := readAll(t, r); !bytes.Equal(data, model) {
+		t.Fatalf("second handle: content mismatch: got %d bytes, want %d", len(data), len(model))
+	}
+	// ... and its writes are merged correctly
+	write(w, []byte("zzz"), bs+20)
+	write(r, []byte("r"), bs+21)
+	write(w, []byte("w"), bs+22)
+	if data := readAll(t, w); !bytes.Equal(data, model) {
+		t.Fatalf("interleaved writes: content mismatch")
+	}
+	// Truncate through the second handle while the first one has a dirty
+	// block
+	write(w, []byte("tail"), bs+100)
+	if code = r.Truncate(uint64(bs + 102)); !code.Ok() {
+		t.Fatal(code)
+	}
+	model = model[:bs+102]
+	if data := readAll(t, r); !bytes.Equal(data, model) {
+		t.Fatalf("truncate: content mismatch")
+	}
+	// Fsync gets everything to disk
+	write(w, []byte("sync"), 3*bs)
+	if code = w.Fsync(0); !code.Ok() {
+		t.Fatal(code)
+	}
+	if sz := plainSizeOnDisk(t, w); sz != uint64(len(model)) {
+		t.Errorf("Fsync: want plaintext size %d on disk, got %d", len(model), sz)
+	}
+	if w.fileTableEntry.Dirty != nil {
+		t.Errorf("Fsync left a dirty block")
+	}
+	if data := readAll(t, r); !bytes.Equal(data, model) {
+		t.Fatalf("after fsync: content mismatch")
+	}
+}
+
+// TestCoalesceWritesLarge checks that full-block and multi-block writes
+// bypass the cache, and that a cached block is not overwritten by an older
+// version later.
+func TestCoalesceWritesLarge(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, CoalesceWrites: true})
+	nodeFile, code := fs.Create("file", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer nodeFile.Release()
+	f := nodeFile.(*File)
+	if _, code = f.Write([]byte("small"), 10); !code.Ok() {
+		t.Fatal(code)
+	}
+	big := bytes.Repeat([]byte("b"), 3*int(f.contentEnc.PlainBS()))
+	if _, code = f.Write(big, 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	if f.fileTableEntry.Dirty != nil {
+		t.Errorf("large write left a dirty block")
+	}
+	if data := readAll(t, f); !bytes.Equal(data, big) {
+		t.Errorf("the cached block overwrote the large write")
+	}
+}
+
+// BenchmarkSmallWrites appends 16 bytes per write, like a log file.
+func BenchmarkSmallWrites(b *testing.B) {
+	benchmarkSmallWrites(b, false)
+}
+
+// BenchmarkSmallWritesCoalesce is BenchmarkSmallWrites with
+// "-coalesce-writes" enabled.
+func BenchmarkSmallWritesCoalesce(b *testing.B) {
+	benchmarkSmallWrites(b, true)
+}
+
+func benchmarkSmallWrites(b *testing.B, coalesce bool) {
+	cipherdir := test_helpers.InitFS(nil)
+	fs := newTestFS(Args{Cipherdir: cipherdir, CoalesceWrites: coalesce})
+	f, code := fs.Create("file", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		b.Fatal(code)
+	}
+	defer f.Release()
+	data := bytes.Repeat([]byte("x"), 16)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, code = f.Write(data, int64(i*len(data))); !code.Ok() {
+			b.Fatal(code)
+		}
+	}
+	if code = f.Fsync(0); !code.Ok() {
+		b.Fatal(code)
+	}
+}
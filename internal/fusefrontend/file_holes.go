@@ -64,6 +64,9 @@ func (f *File) SeekData(oldOffset int64) (int64, error) {
 		return 0, syscall.EOPNOTSUPP
 	}
 	const SEEK_DATA = 3
+	if status := f.flushDirty(); !status.Ok() {
+		return 0, syscall.Errno(status)
+	}
 
 	// Convert plaintext offset to ciphertext offset and round down to the
 	// start of the current block. File holes smaller than a full block will
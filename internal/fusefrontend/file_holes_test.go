@@ -0,0 +1,98 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// sparseLimit is the most the backing file of a sparse test file may
+// allocate: a few blocks at the start and the end, plus what the backing
+// filesystem rounds up to
+const sparseLimit = 1024 * 1024
+
+// checkSparse verifies that the backing file of "path" has the ciphertext
+// size of "plainSize" bytes, but allocates at most sparseLimit bytes, and
+// that reading the gap at "holeOff" returns zeros.
+func checkSparse(t *testing.T, fs *FS, cipherdir string, path string, plainSize uint64, holeOff int64) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(backingFile(t, cipherdir), &st); err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(fs.contentEnc.PlainSizeToCipherSize(plainSize)); st.Size != want {
+		t.Errorf("backing file size: want %d, got %d", want, st.Size)
+	}
+	if st.Blocks*512 > sparseLimit {
+		t.Errorf("backing file allocates %d bytes, the gap was not left as a hole", st.Blocks*512)
+	}
+	f, code := fs.Open(path, uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	buf := make([]byte, 3*fs.contentEnc.PlainBS())
+	res, code := f.Read(buf, holeOff)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	data, _ := res.Bytes(buf)
+	if len(data) != len(buf) || !bytes.Equal(data, make([]byte, len(buf))) {
+		t.Errorf("reading the gap should return %d zero bytes, got %d bytes", len(buf), len(data))
+	}
+}
+
+// Writing far past EOF leaves the gap as a hole in the backing file. Only
+// the old last block is padded.
+func TestSparseWrite(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	f, code := fs.Create("file", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	// Unaligned, so the old last block needs padding
+	if _, code = f.Write([]byte("head"), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	const off = 1 << 30
+	if _, code = f.Write([]byte("tail"), off+100); !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	checkSparse(t, fs, cipherdir, "file", off+104, off/2+1)
+	got := readTestFile(t, fs, "file")
+	if !bytes.Equal(got[:4], []byte("head")) || !bytes.Equal(got[4:fs.contentEnc.PlainBS()], make([]byte, fs.contentEnc.PlainBS()-4)) {
+		t.Errorf("first block is wrong")
+	}
+	f, _ = fs.Open("file", uint32(os.O_RDONLY), nil)
+	defer f.Release()
+	buf := make([]byte, 4)
+	res, code := f.Read(buf, off+100)
+	if data, _ := res.Bytes(buf); !code.Ok() || string(data) != "tail" {
+		t.Errorf("want %q at the end, got %q (%v)", "tail", data, code)
+	}
+}
+
+// Growing a file with truncate does not write the new blocks
+func TestSparseTruncate(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	writeTestFile(t, fs, "file", []byte("content"))
+	f, code := fs.Open("file", uint32(os.O_RDWR), nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	// Block-aligned and unaligned new sizes take different paths
+	for _, size := range []uint64{1 << 30, 1<<31 + 12345} {
+		if code = f.Truncate(size); code != fuse.OK {
+			t.Fatal(code)
+		}
+		checkSparse(t, fs, cipherdir, "file", size, 1<<29)
+	}
+	f.Release()
+}
@@ -0,0 +1,63 @@
+package fusefrontend
+
+// Clearing the SUID and SGID bits on write, like the kernel does for
+// unprivileged writers. The kernel usually does it itself, before the write,
+// through a SETATTR request. But it decides based on the mode it has
+// cached, which can be stale, and gocryptfs writes to the backing file as
+// the user that mounted the filesystem, often root, which keeps the bits.
+
+import (
+	"sync/atomic"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// killPrivMode returns "mode" without the bits that writing to the file
+// clears: SUID, and SGID if the group has execute permission (otherwise,
+// SGID means mandatory locking). Only regular files are affected.
+func killPrivMode(mode uint32) uint32 {
+	if mode&syscall.S_IFMT != syscall.S_IFREG {
+		return mode
+	}
+	mode &^= syscall.S_ISUID
+	if mode&syscall.S_IXGRP != 0 {
+		mode &^= syscall.S_ISGID
+	}
+	return mode
+}
+
+// isPrivileged returns true if the caller is allowed to keep the SUID and
+// SGID bits when writing. Like for the other permission checks, root stands
+// in for CAP_FSETID. A nil context means that the caller is not known, for
+// example in tests, and the bits are kept.
+func isPrivileged(context *fuse.Context) bool {
+	return context == nil || context.Owner.Uid == 0
+}
+
+// killPriv clears the SUID and SGID bits of the backing file if the file
+// has been opened by an unprivileged caller. Only the first call per file
+// handle does any work. Call it before modifying the file content.
+func (f *File) killPriv() fuse.Status {
+	if atomic.LoadUint32(&f.killPrivPending) == 0 {
+		return fuse.OK
+	}
+	var st syscall.Stat_t
+	err := syscall.Fstat(f.intFd(), &st)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	mode := killPrivMode(uint32(st.Mode))
+	if mode != uint32(st.Mode) {
+		tlog.Debug.Printf("ino%d: killPriv: mode %#o -> %#o", f.qIno.Ino, st.Mode&07777, mode&07777)
+		err = syscall.Fchmod(f.intFd(), mode&07777)
+		if err != nil {
+			tlog.Warn.Printf("ino%d: killPriv: Fchmod failed: %v", f.qIno.Ino, err)
+			return fuse.ToStatus(err)
+		}
+	}
+	atomic.StoreUint32(&f.killPrivPending, 0)
+	return fuse.OK
+}
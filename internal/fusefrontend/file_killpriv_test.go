@@ -0,0 +1,77 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestKillPriv writes to SUID and SGID files as root and as another user,
+// and checks that only the unprivileged write clears the bits, like the
+// kernel does.
+func TestKillPriv(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	root := &fuse.Context{}
+	user := &fuse.Context{Caller: fuse.Caller{Owner: fuse.Owner{Uid: 1234, Gid: 1234}}}
+	testcases := []struct {
+		mode   uint32
+		caller *fuse.Context
+		op     string
+		want   uint32
+	}{
+		{04777, user, "write", 0777},
+		{02777, user, "write", 0777},
+		{06777, user, "write", 0777},
+		// Without group execute, SGID stays
+		{06767, user, "write", 02767},
+		{04777, user, "truncate", 0777},
+		{04777, user, "allocate", 0777},
+		{06777, root, "write", 06777},
+		{06777, nil, "write", 06777},
+	}
+	for i, tc := range testcases {
+		name := fmt.Sprintf("file%d", i)
+		f, code := fs.Create(name, uint32(os.O_WRONLY), 0600, nil)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		f.Release()
+		if code = fs.Chmod(name, tc.mode, nil); !code.Ok() {
+			t.Fatal(code)
+		}
+		f, code = fs.Open(name, uint32(os.O_RDWR), tc.caller)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		switch tc.op {
+		case "write":
+			_, code = f.Write([]byte("hello"), 0)
+		case "truncate":
+			code = f.Truncate(100)
+		case "allocate":
+			code = f.Allocate(0, 100, 0)
+		}
+		f.Release()
+		if !code.Ok() {
+			t.Fatalf("%s: %s: %v", name, tc.op, code)
+		}
+		cName, err := fs.EncryptPath(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var st syscall.Stat_t
+		if err = syscall.Stat(filepath.Join(cipherdir, cName), &st); err != nil {
+			t.Fatal(err)
+		}
+		if got := uint32(st.Mode) & 07777; got != tc.want {
+			t.Errorf("%s: mode %#o, %s: want %#o, got %#o", name, tc.mode, tc.op, tc.want, got)
+		}
+	}
+}
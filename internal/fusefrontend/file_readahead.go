@@ -0,0 +1,232 @@
+package fusefrontend
+
+// "-readahead N": prefetch and decrypt the blocks following a sequential
+// read in the background, so the next reads can be served from memory.
+//
+// Prefetched data lives in two windows of N blocks each. Reads are served
+// from the current window while the following window is prefetched. When
+// the current window is used up, the windows are swapped and the next
+// prefetch is started.
+
+import (
+	"sync"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+)
+
+// raWindow is a range of prefetched plaintext
+type raWindow struct {
+	// off is the plaintext offset of data. -1 if the window is empty.
+	off  int64
+	data []byte
+	// eof is set if the file ended within the window
+	eof bool
+	// opCount is openfiletable.WriteOpCount() at the time of the prefetch.
+	// If it has changed since, the file may have been modified, and data is
+	// stale.
+	opCount uint64
+}
+
+// covers returns true if the window can serve a read of "length" bytes at
+// "off".
+func (w *raWindow) covers(off int64, length int) bool {
+	if w.off < 0 || off < w.off {
+		return false
+	}
+	if w.eof {
+		return off <= w.end()
+	}
+	return off+int64(length) <= w.end()
+}
+
+// end returns the offset just behind the window
+func (w *raWindow) end() int64 {
+	return w.off + int64(len(w.data))
+}
+
+// readAhead is the prefetch state of one File.
+type readAhead struct {
+	// mu protects the fields below. It is never held while reading from
+	// disk.
+	mu sync.Mutex
+	// nextOff is where the next read starts if the access is sequential
+	nextOff int64
+	// done is closed when the last prefetch has finished. Nil if no
+	// prefetch has been started yet.
+	done chan struct{}
+	// running is set while the prefetch goroutine fills "next"
+	running bool
+	// cur is the window reads are served from, next is the window that is
+	// prefetched
+	cur, next raWindow
+	// spare is a buffer that is not in use and can be reused
+	spare []byte
+}
+
+func newReadAhead() *readAhead {
+	return &readAhead{
+		cur:  raWindow{off: -1},
+		next: raWindow{off: -1},
+	}
+}
+
+// drop empties window "w" and keeps its buffer for reuse.
+// The caller must hold ra.mu.
+func (ra *readAhead) drop(w *raWindow) {
+	if w.data != nil && ra.spare == nil {
+		ra.spare = w.data[:0]
+	}
+	*w = raWindow{off: -1}
+}
+
+// readAheadWait records the access pattern and returns true if the read at
+// "off" directly follows the previous one. If the read cannot be served
+// from the current window, it waits for a running prefetch to finish.
+//
+// It must be called without holding ContentLock, because the prefetch
+// goroutine needs it.
+func (f *File) readAheadWait(off int64, length int) (sequential bool) {
+	ra := f.readAhead
+	ra.mu.Lock()
+	sequential = off == ra.nextOff
+	ra.nextOff = off + int64(length)
+	var done chan struct{}
+	if ra.running && (!sequential || !ra.cur.covers(off, length)) {
+		done = ra.done
+	}
+	ra.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+	if !sequential {
+		// Random access. Drop the prefetched data and don't start a new
+		// prefetch.
+		ra.mu.Lock()
+		ra.drop(&ra.cur)
+		ra.drop(&ra.next)
+		ra.mu.Unlock()
+	}
+	return sequential
+}
+
+// readAheadGet copies the prefetched data for a read at "off" into "buf".
+// Returns false if the data has not been prefetched, or may be stale.
+// When the read moves on to the prefetched window, the prefetch of the
+// window after it is started.
+//
+// The caller must hold ContentLock.RLock, so the file cannot change while
+// we check opCount.
+func (f *File) readAheadGet(buf []byte, off int64) (out []byte, ok bool) {
+	ra := f.readAhead
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	opCount := openfiletable.WriteOpCount()
+	if ra.cur.opCount != opCount {
+		ra.drop(&ra.cur)
+	}
+	if !ra.running && ra.next.opCount != opCount {
+		ra.drop(&ra.next)
+	}
+	if !ra.cur.covers(off, len(buf)) {
+		if ra.running || !ra.next.covers(off, len(buf)) {
+			return nil, false
+		}
+		ra.drop(&ra.cur)
+		ra.cur, ra.next = ra.next, raWindow{off: -1}
+		if !ra.cur.eof {
+			f.readAheadStartLocked(ra.cur.end(), len(buf))
+		}
+	}
+	n := copy(buf, ra.cur.data[off-ra.cur.off:])
+	return buf[:n], true
+}
+
+// readAheadStart starts prefetching at plaintext offset "off", after a
+// sequential read of "length" bytes has been served from disk.
+func (f *File) readAheadStart(off int64, length int) {
+	ra := f.readAhead
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	if ra.running {
+		return
+	}
+	f.readAheadStartLocked(off, length)
+}
+
+// readAheadStartLocked starts prefetching the window at "off". We prefetch
+// a multiple of "length" bytes, so that the following reads of the same
+// size can be served from the window without leftovers.
+// The caller must hold ra.mu, and no prefetch may be running.
+func (f *File) readAheadStartLocked(off int64, length int) {
+	size := f.fs.args.ReadAhead * int(f.contentEnc.PlainBS())
+	size = (size + length - 1) / length * length
+	if max := f.contentEnc.MaxPlainSize(); uint64(off) >= max {
+		return
+	} else if uint64(off)+uint64(size) > max {
+		size = int(max - uint64(off))
+	}
+	ra := f.readAhead
+	ra.drop(&ra.next)
+	buf := ra.spare
+	ra.spare = nil
+	done := make(chan struct{})
+	ra.done = done
+	ra.running = true
+	go func() {
+		defer close(done)
+		f.fileTableEntry.ContentLock.RLock()
+		opCount := openfiletable.WriteOpCount()
+		status := fuse.OK
+		if f.fileTableEntry.Dirty != nil {
+			// "-coalesce-writes": the disk content is not up to date
+			status = fuse.EAGAIN
+		}
+		for status.Ok() && len(buf) < size {
+			chunk := size - len(buf)
+			if chunk > fuse.MAX_KERNEL_WRITE {
+				chunk = fuse.MAX_KERNEL_WRITE
+			}
+			have := len(buf)
+			var out []byte
+			out, status = f.doRead(buf, uint64(off)+uint64(have), uint64(chunk))
+			if !status.Ok() {
+				break
+			}
+			buf = out
+			if len(buf)-have < chunk {
+				// End of file
+				break
+			}
+		}
+		f.fileTableEntry.ContentLock.RUnlock()
+		ra.mu.Lock()
+		defer ra.mu.Unlock()
+		ra.running = false
+		if !status.Ok() {
+			// Let the next Read run into the error itself, or find the
+			// dirty block
+			ra.spare = buf[:0]
+			return
+		}
+		ra.next = raWindow{
+			off:     off,
+			data:    buf,
+			eof:     len(buf) < size,
+			opCount: opCount,
+		}
+	}()
+}
+
+// readAheadRelease waits for a running prefetch to finish. Called by
+// Release before the fd is closed.
+func (f *File) readAheadRelease() {
+	ra := f.readAhead
+	ra.mu.Lock()
+	done := ra.done
+	ra.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
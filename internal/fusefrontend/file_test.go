@@ -0,0 +1,351 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// BenchmarkFileRead measures sequential read throughput without the kernel
+// in the loop. Each iteration reads one maximum-sized FUSE request and
+// hands the result back the way go-fuse does.
+func BenchmarkFileRead(b *testing.B) {
+	benchmarkFileRead(b, 0, nil)
+}
+
+// BenchmarkFileReadStream models an application that streams a file
+// somewhere else, and spends time off the CPU between reads.
+func BenchmarkFileReadStream(b *testing.B) {
+	benchmarkFileRead(b, 0, streamConsumer)
+}
+
+// BenchmarkFileReadStreamAhead is BenchmarkFileReadStream with
+// "-readahead" enabled, so that decryption overlaps with the consumer.
+func BenchmarkFileReadStreamAhead(b *testing.B) {
+	benchmarkFileRead(b, 64, streamConsumer)
+}
+
+func streamConsumer([]byte) {
+	time.Sleep(50 * time.Microsecond)
+}
+
+func benchmarkFileRead(b *testing.B, readAhead int, consumer func([]byte)) {
+	const fileSize = 16 * 1024 * 1024
+	cipherdir := test_helpers.InitFS(nil)
+	fs := newTestFS(Args{Cipherdir: cipherdir, ReadAhead: readAhead})
+	f, code := fs.Create("file", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		b.Fatal(code)
+	}
+	defer f.Release()
+	chunk := bytes.Repeat([]byte("x"), fuse.MAX_KERNEL_WRITE)
+	for off := 0; off < fileSize; off += len(chunk) {
+		if _, code = f.Write(chunk, int64(off)); !code.Ok() {
+			b.Fatal(code)
+		}
+	}
+	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		off := int64(i*len(buf)) % fileSize
+		res, code := f.Read(buf, off)
+		if !code.Ok() {
+			b.Fatal(code)
+		}
+		data, _ := res.Bytes(buf)
+		if len(data) != len(buf) {
+			b.Fatalf("short read: %d bytes", len(data))
+		}
+		if consumer != nil {
+			consumer(data)
+		}
+		res.Done()
+	}
+}
+
+// TestReadPooledHole checks that file holes read back as zeros even when the
+// pooled read buffer still contains data from an earlier read, and that
+// unaligned reads return the right bytes.
+func TestReadPooledHole(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	f, code := fs.Create("file", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	chunk := bytes.Repeat([]byte("x"), fuse.MAX_KERNEL_WRITE)
+	if _, code = f.Write(chunk, 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	// Leaves a hole of one request size
+	holeEnd := int64(2 * len(chunk))
+	if _, code = f.Write([]byte("end"), holeEnd); !code.Ok() {
+		t.Fatal(code)
+	}
+	buf := make([]byte, len(chunk))
+	for i := 0; i < 10; i++ {
+		// Dirty the pool
+		res, code := f.Read(buf, 0)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		res.Done()
+		res, code = f.Read(buf, int64(len(chunk)))
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		data, _ := res.Bytes(buf)
+		if len(data) != len(chunk) || !bytes.Equal(data, make([]byte, len(chunk))) {
+			t.Fatalf("hole does not read back as zeros")
+		}
+		res.Done()
+	}
+	res, code := f.Read(buf[:10], holeEnd-5)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	data, _ := res.Bytes(buf)
+	if want := []byte("\x00\x00\x00\x00\x00end"); !bytes.Equal(data, want) {
+		t.Errorf("unaligned read: want %q, got %q", want, data)
+	}
+	res.Done()
+}
+
+// TestWriteRMW does unaligned writes, including writes that leave a gap
+// behind the end of the file, and compares the result with a model. The
+// Read-Modify-Write buffers come from a pool and may contain stale data.
+func TestWriteRMW(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	f, code := fs.Create("file", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	var model []byte
+	write := func(data []byte, off int) {
+		if _, code := f.Write(data, int64(off)); !code.Ok() {
+			t.Fatal(code)
+		}
+		if end := off + len(data); end > len(model) {
+			model = append(model, make([]byte, end-len(model))...)
+		}
+		copy(model[off:], data)
+	}
+	write(bytes.Repeat([]byte("a"), 10000), 0)
+	write([]byte("bbbb"), 4094)
+	write(bytes.Repeat([]byte("c"), 5000), 3000)
+	// Gap inside the last block
+	write([]byte("dd"), 10100)
+	// Gap of several blocks
+	write([]byte("ee"), 20000)
+	write([]byte("f"), 0)
+	buf := make([]byte, 32*1024)
+	res, code := f.Read(buf, 0)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	data, _ := res.Bytes(buf)
+	if !bytes.Equal(data, model) {
+		t.Errorf("content mismatch: got %d bytes, want %d", len(data), len(model))
+	}
+	res.Done()
+}
+
+// TestReadAhead reads a file that does not end on a block boundary
+// sequentially with "-readahead" enabled and compares the result, up to and
+// including EOF. It also checks that prefetched data is not served after the
+// file has been modified through another file handle.
+func TestReadAhead(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, ReadAhead: 4})
+	w, code := fs.Create("file", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer w.Release()
+	content := make([]byte, 10*4096+123)
+	rand.Read(content)
+	if _, code = w.Write(content, 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	nodeFile, code := fs.Open("file", uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer nodeFile.Release()
+	f := nodeFile.(*File)
+	read := func(off int64, length int) []byte {
+		buf := make([]byte, length)
+		res, code := f.Read(buf, off)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		data, _ := res.Bytes(buf)
+		data = append([]byte(nil), data...)
+		res.Done()
+		return data
+	}
+	// Unaligned chunk size, so that reads cross block boundaries and the
+	// last read crosses into the final partial block and beyond EOF.
+	for _, chunk := range []int{5000, 4096, 10 * 4096} {
+		var got []byte
+		for off := int64(0); ; {
+			data := read(off, chunk)
+			got = append(got, data...)
+			off += int64(len(data))
+			if len(data) < chunk {
+				break
+			}
+		}
+		if !bytes.Equal(got, content) {
+			t.Fatalf("chunk=%d: content mismatch: got %d bytes, want %d", chunk, len(got), len(content))
+		}
+		// Reading again at EOF returns nothing
+		if data := read(int64(len(content)), chunk); len(data) != 0 {
+			t.Errorf("chunk=%d: read at EOF returned %d bytes", chunk, len(data))
+		}
+	}
+	// Start a prefetch at offset 4096, then overwrite that range through the
+	// other file handle.
+	read(0, 4096)
+	modified := bytes.Repeat([]byte("y"), 4096)
+	if _, code = w.Write(modified, 4096); !code.Ok() {
+		t.Fatal(code)
+	}
+	if data := read(4096, 4096); !bytes.Equal(data, modified) {
+		t.Errorf("stale prefetched data was returned after a write")
+	}
+	// Random access drops the prefetched data
+	read(8*4096, 100)
+	if f.readAhead.cur.off != -1 || f.readAhead.next.off != -1 {
+		t.Errorf("random access did not drop the prefetched data")
+	}
+}
+
+// TestWriteNewFile checks the first write to a new file, which writes the
+// file header together with the first block if it can. The header must be
+// valid, the data must decrypt with a fresh file table, and the sizes must
+// be right.
+func TestWriteNewFile(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	testcases := []struct {
+		off int
+		len int
+	}{
+		{0, 1},
+		{0, 100},
+		{0, 4096},
+		{0, 10000},
+		{100, 200},
+		// Does not touch the first block, the header is written on its own
+		{5000, 100},
+	}
+	for i, tc := range testcases {
+		name := fmt.Sprintf("file%d", i)
+		data := bytes.Repeat([]byte{byte('a' + i)}, tc.len)
+		f, code := fs.Create(name, uint32(os.O_WRONLY), 0600, nil)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		if _, code = f.Write(data, int64(tc.off)); !code.Ok() {
+			t.Fatalf("%s: %v", name, code)
+		}
+		f.Release()
+		cName, err := fs.EncryptPath(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertext, err := ioutil.ReadFile(filepath.Join(cipherdir, cName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := uint64(tc.off + tc.len)
+		if want := fs.contentEnc.PlainSizeToCipherSize(size); uint64(len(ciphertext)) != want {
+			t.Errorf("%s: backing file has %d bytes, want %d", name, len(ciphertext), want)
+		}
+		if _, err = contentenc.ParseHeader(ciphertext[:contentenc.HeaderLen]); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		a, code := fs.GetAttr(name, nil)
+		if !code.Ok() || a.Size != size {
+			t.Errorf("%s: GetAttr size %d, %v", name, a.Size, code)
+		}
+	}
+	// Read back through a new FS, so nothing is cached
+	fs = newTestFS(Args{Cipherdir: cipherdir})
+	for i, tc := range testcases {
+		name := fmt.Sprintf("file%d", i)
+		f, code := fs.Open(name, uint32(os.O_RDONLY), nil)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		buf := make([]byte, tc.off+tc.len+10)
+		res, code := f.Read(buf, 0)
+		if !code.Ok() {
+			t.Fatalf("%s: %v", name, code)
+		}
+		got, _ := res.Bytes(buf)
+		want := append(make([]byte, tc.off), bytes.Repeat([]byte{byte('a' + i)}, tc.len)...)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: content mismatch", name)
+		}
+		res.Done()
+		f.Release()
+	}
+}
+
+// TestGetAttrOutOfBand checks that GetAttr on an open file reports the
+// plaintext size of the backing file as it is now, after another instance
+// has grown or shrunk it behind our back.
+func TestGetAttrOutOfBand(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	other := newTestFS(Args{Cipherdir: cipherdir})
+	f, code := fs.Create("log", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	if _, code = f.Write([]byte("first line\n"), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	f2, code := other.Open("log", uint32(os.O_RDWR), nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f2.Release()
+	var a fuse.Attr
+	// Grow across a block boundary, then shrink into the first block
+	for _, size := range []uint64{11, 10000, 4096, 4097, 100, 0} {
+		if code = f2.Truncate(size); !code.Ok() {
+			t.Fatal(code)
+		}
+		if code = f.GetAttr(&a); !code.Ok() {
+			t.Fatal(code)
+		}
+		if a.Size != size {
+			t.Errorf("size %d: GetAttr reported %d", size, a.Size)
+		}
+		st, err := os.Stat(backingFile(t, cipherdir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fs.contentEnc.PlainSizeToCipherSize(size); uint64(st.Size()) != want {
+			t.Errorf("size %d: backing size %d, want %d", size, st.Size(), want)
+		}
+	}
+}
@@ -5,6 +5,7 @@ package fusefrontend
 
 import (
 	"os"
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -20,6 +21,8 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/inomap"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/opstats"
+	"github.com/rfjakob/gocryptfs/internal/ratelimit"
 	"github.com/rfjakob/gocryptfs/internal/serialize_reads"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
@@ -27,6 +30,19 @@ import (
 
 // FS implements the go-fuse virtual filesystem interface.
 type FS struct {
+	// openFiles, bytesRead and bytesWritten are reported by the ctlsock
+	// "Status" command and are accessed atomically. They come first to be
+	// 64-bit aligned on 32-bit platforms.
+	openFiles    int64
+	bytesRead    uint64
+	bytesWritten uint64
+	// quotaUsed is the plaintext usage for "-quota", accessed atomically
+	quotaUsed int64
+	// mountTime is when NewFS was called
+	mountTime time.Time
+	// readOnly is set to 1 when the timer of "-readonly-after" expires,
+	// accessed atomically
+	readOnly uint32
 	// Embed pathfs.defaultFileSystem to avoid compile failure when the
 	// pathfs.FileSystem interface gets new functions. defaultFileSystem
 	// provides a no-op implementation for all functions.
@@ -34,7 +50,7 @@ type FS struct {
 	args Args // Stores configuration arguments
 	// dirIVLock: Lock()ed if any "gocryptfs.diriv" file is modified
 	// Readers must RLock() it to prevent them from seeing intermediate
-	// states
+	// states, which readDirIV does
 	dirIVLock sync.RWMutex
 	// Filename encryption helper
 	nameTransform nametransform.NameTransformer
@@ -59,9 +75,53 @@ type FS struct {
 	IsIdle uint32
 	// dirCache caches directory fds
 	dirCache dirCacheStruct
+	// backingFds limits the number of open file handles, "-max-backing-fds"
+	backingFds fdLimit
+	// corruptSeen contains the undecryptable entries that have already been
+	// logged, "-hide-corrupt" and "-show-corrupt"
+	corruptSeen     map[string]bool
+	corruptSeenLock sync.Mutex
 	// inoMap translates inode numbers from different devices to unique inode
 	// numbers.
 	inoMap *inomap.InoMap
+	// stats collects latency histograms if "-stats" is on. Disabled
+	// otherwise, see SetStats.
+	stats *opstats.Stats
+	// hiresTimeCAttr is the encrypted name of the xattr used by
+	// "-emulate-hires-time"
+	hiresTimeCAttr string
+	// hiresTimeWarnOnce makes sure we complain only once if the backing
+	// filesystem does not support xattrs
+	hiresTimeWarnOnce sync.Once
+	// exactSizeCAttr is the encrypted name of the xattr used by the
+	// "ExactSize" feature flag
+	exactSizeCAttr string
+	// forkCAttr is the encrypted name of the xattr used by "-macos-forks"
+	forkCAttr string
+	// watchSubs are the control socket clients that receive the events of
+	// "-watch"
+	watchSubs watchSubscribers
+	// dirCounts caches the number of entries of directories for
+	// "-dir-count-cache"
+	dirCounts dirCounts
+	// readOnlyTimer is the timer of "-readonly-after"
+	readOnlyTimer readOnlyTimer
+	// secureDelete is set if "-secure-delete" is on and not known to be
+	// ineffective on the backing storage
+	secureDelete bool
+	// noatimeWarnOnce makes sure we complain only once if O_NOATIME is
+	// rejected
+	noatimeWarnOnce sync.Once
+	// prefetch is the progress of the last ctlsock Prefetch walk
+	prefetch prefetchState
+	// readLimit and writeLimit throttle the content IO on CIPHERDIR,
+	// "-read-bps" and "-write-bps". Nil means no limit.
+	readLimit  *ratelimit.Bucket
+	writeLimit *ratelimit.Bucket
+	// journal is the state of "-journal". Nil if disabled.
+	journal *journal
+	// txnLock serializes ctlsock Transactions
+	txnLock sync.Mutex
 }
 
 //var _ pathfs.FileSystem = &FS{} // Verify that interface is implemented.
@@ -80,13 +140,68 @@ func NewFS(args Args, c *contentenc.ContentEnc, n nametransform.NameTransformer)
 		tlog.Warn.Printf("NewFS: could not stat cipherdir: %v", err)
 		st.Dev = 0
 	}
-	return &FS{
+	fs := &FS{
 		FileSystem:    pathfs.NewDefaultFileSystem(),
 		args:          args,
 		nameTransform: n,
 		contentEnc:    c,
 		inoMap:        inomap.New(),
+		mountTime:     time.Now(),
+		stats:         opstats.New(),
+		backingFds:    newFdLimit(args.MaxBackingFds),
+		readLimit:     ratelimit.New(args.ReadBps),
+		writeLimit:    ratelimit.New(args.WriteBps),
+	}
+	fs.stats.SetEnabled(args.Stats)
+	if args.EmulateHiresTime {
+		fs.hiresTimeCAttr = fs.encryptXattrName(hiresTimeXattr)
+		if !hiresTimeSupported(args.Cipherdir, fs.hiresTimeCAttr) {
+			// Complain now instead of on the first write
+			fs.hiresTimeWarnOnce.Do(func() {
+				tlog.Warn.Printf("-emulate-hires-time: the backing filesystem does not support " +
+					"extended attributes, timestamps keep its resolution")
+			})
+		}
+	}
+	if args.ExactSize {
+		fs.exactSizeCAttr = fs.encryptXattrName(exactSizeXattr)
+	}
+	if args.MacOSForks {
+		fs.forkCAttr = fs.encryptXattrName(forkXattr)
+	}
+	if args.SecureDelete {
+		if reason := secureDeleteIneffective(args.Cipherdir); reason != "" {
+			tlog.Warn.Printf("-secure-delete: disabled because %s", reason)
+		} else {
+			fs.secureDelete = true
+		}
+	}
+	if args.NoAtime && syscallcompat.O_NOATIME == 0 {
+		tlog.Warn.Printf("-noatime: not supported on this platform, ignoring")
+	}
+	if args.Journal && runtime.GOOS != "linux" {
+		tlog.Warn.Printf("-journal: not supported on this platform, ignoring")
+	} else if args.ReadOnly {
+		warnJournalReadOnly(args.Cipherdir)
+	} else if args.Journal {
+		if fs.journal, err = openJournal(args.Cipherdir); err != nil {
+			tlog.Warn.Printf("-journal: disabled: %v", err)
+		}
+	} else if !args.PlaintextNames {
+		replayJournal(args.Cipherdir)
+	}
+	if args.Quota > 0 {
+		used, err := fs.quotaScan()
+		if err != nil {
+			tlog.Warn.Printf("NewFS: -quota: scanning %q failed, usage may be too low: %v", args.Cipherdir, err)
+		}
+		fs.quotaUsed = int64(used)
+		tlog.Info.Printf("-quota: %d of %d bytes used", used, args.Quota)
+	}
+	if args.ReadOnlyAfter > 0 {
+		fs.startReadOnlyTimer(args.ReadOnlyAfter)
 	}
+	return fs
 }
 
 // GetAttr implements pathfs.Filesystem.
@@ -94,6 +209,10 @@ func NewFS(args Args, c *contentenc.ContentEnc, n nametransform.NameTransformer)
 // GetAttr is symlink-safe through use of openBackingDir() and Fstatat().
 func (fs *FS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
 	tlog.Debug.Printf("FS.GetAttr(%q)", relPath)
+	defer fs.stats.Record(opstats.GetAttr, fs.stats.Now())
+	if fs.isShownConf(relPath) {
+		return fs.getAttrConf(relPath)
+	}
 	if fs.isFiltered(relPath) {
 		return nil, fuse.EPERM
 	}
@@ -103,7 +222,18 @@ func (fs *FS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr, fuse.S
 	}
 	var st unix.Stat_t
 	err = syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err == nil && fs.args.CoalesceWrites && st.Mode&syscall.S_IFMT == syscall.S_IFREG {
+		// An open file may have a cached block that changes size and mtime
+		if status := fs.flushDirtyStat(&st); !status.Ok() {
+			syscall.Close(dirfd)
+			return nil, status
+		}
+		err = syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	}
 	syscall.Close(dirfd)
+	if err == syscall.ENOENT && fs.args.MacOSForks {
+		return fs.getAttrFork(relPath)
+	}
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
@@ -111,8 +241,14 @@ func (fs *FS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr, fuse.S
 	st2 := syscallcompat.Unix2syscall(st)
 	fs.inoMap.TranslateStat(&st2)
 	a.FromStat(&st2)
+	if fs.args.EmulateHiresTime {
+		fs.getAttrHiresTime(relPath, a)
+	}
 	if a.IsRegular() {
-		a.Size = fs.contentEnc.CipherSizeToPlainSize(a.Size)
+		fs.plainAttr(a)
+		if fs.args.ExactSize {
+			fs.getAttrExactSize(relPath, a)
+		}
 	} else if a.IsSymlink() {
 		target, _ := fs.Readlink(relPath, context)
 		a.Size = uint64(len(target))
@@ -123,6 +259,16 @@ func (fs *FS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr, fuse.S
 	return a, fuse.OK
 }
 
+// plainAttr converts the size, allocation and preferred IO size of the
+// regular file with backing attributes "a" to their plaintext values.
+// Reporting our plaintext block size as st_blksize makes applications that
+// honor it write whole blocks, avoiding read-modify-write cycles.
+func (fs *FS) plainAttr(a *fuse.Attr) {
+	a.Size = fs.contentEnc.CipherSizeToPlainSize(a.Size)
+	a.Blocks = fs.contentEnc.CipherSectorsToPlainSectors(a.Blocks)
+	setBlksize(a, fs.contentEnc.PlainBS())
+}
+
 // mangleOpenFlags is used by Create() and Open() to convert the open flags the user
 // wants to the flags we internally use to open the backing file.
 // The returned flags always contain O_NOFOLLOW.
@@ -138,6 +284,7 @@ func (fs *FS) mangleOpenFlags(flags uint32) (newFlags int) {
 	// crypto header, alignment will be off, even if userspace makes aligned
 	// accesses. Running xfstests generic/013 on ext4 used to trigger lots of
 	// EINVAL errors due to missing alignment. Just fall back to buffered IO.
+	// The plaintext still bypasses the page cache, see withDirectIO().
 	newFlags = newFlags &^ syscallcompat.O_DIRECT
 	// Create and Open are two separate FUSE operations, so O_CREAT should not
 	// be part of the open flags.
@@ -150,10 +297,38 @@ func (fs *FS) mangleOpenFlags(flags uint32) (newFlags int) {
 // Open - FUSE call. Open already-existing file.
 //
 // Symlink-safe through Openat().
-func (fs *FS) Open(path string, flags uint32, context *fuse.Context) (fuseFile nodefs.File, status fuse.Status) {
+func (fs *FS) Open(path string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	f, status := fs.open(path, flags, context, false)
+	return withDirectIO(f, status, flags)
+}
+
+// open implements Open, without the O_DIRECT handling. Files opened with
+// "internal" set do not take a slot from "-max-backing-fds", see fd_limit.go.
+func (fs *FS) open(path string, flags uint32, context *fuse.Context, internal bool) (fuseFile nodefs.File, status fuse.Status) {
+	if fs.isShownConf(path) {
+		return fs.openConf(path, flags)
+	}
 	if fs.isFiltered(path) {
 		return nil, fuse.EPERM
 	}
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0 {
+		if code := fs.checkWritable(); !code.Ok() {
+			return nil, code
+		}
+	}
+	if !internal {
+		// Wait for a slot before opening anything, see fd_limit.go
+		if !fs.backingFds.acquire() {
+			return nil, fuse.Status(syscall.EMFILE)
+		}
+		defer func() {
+			if f, ok := fuseFile.(*File); ok && status.Ok() {
+				f.fdSlot = true
+			} else {
+				fs.backingFds.release()
+			}
+		}()
+	}
 	newFlags := fs.mangleOpenFlags(flags)
 	// Taking this lock makes sure we don't race openWriteOnlyFile()
 	fs.openWriteOnlyLock.RLock()
@@ -164,21 +339,42 @@ func (fs *FS) Open(path string, flags uint32, context *fuse.Context) (fuseFile n
 		return nil, fuse.ToStatus(err)
 	}
 	defer syscall.Close(dirfd)
-	fd, err := syscallcompat.Openat(dirfd, cName, newFlags, 0)
+	var truncated int64
+	secureFd := -1
+	if newFlags&syscall.O_TRUNC != 0 {
+		truncated, _ = fs.quotaSizeAt(dirfd, cName)
+		// O_TRUNC would leave nothing to overwrite. Truncate after the
+		// overwrite instead.
+		if secureFd = fs.secureDeleteOpenAt(dirfd, cName); secureFd >= 0 {
+			newFlags &^= syscall.O_TRUNC
+		}
+	}
+	fd, err := fs.openatNoatime(dirfd, cName, newFlags, 0)
+	if secureFd >= 0 {
+		if err != nil {
+			syscall.Close(secureFd)
+		} else if err = secureTruncateFinish(secureFd, cName); err != nil {
+			syscall.Close(fd)
+		}
+	}
 	// Handle a few specific errors
 	if err != nil {
+		if err == syscall.ENOENT && fs.args.MacOSForks {
+			return fs.openFork(path, flags)
+		}
 		if err == syscall.EMFILE {
 			var lim syscall.Rlimit
 			syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim)
 			tlog.Warn.Printf("Open %q: too many open files. Current \"ulimit -n\": %d", cName, lim.Cur)
 		}
 		if err == syscall.EACCES && (int(flags)&syscall.O_ACCMODE) == syscall.O_WRONLY {
-			return fs.openWriteOnlyFile(dirfd, cName, newFlags)
+			return fs.openWriteOnlyFile(dirfd, cName, newFlags, context)
 		}
 		return nil, fuse.ToStatus(err)
 	}
+	fs.quotaAdd(-truncated)
 	f := os.NewFile(uintptr(fd), cName)
-	return NewFile(f, fs)
+	return NewFile(f, fs, context)
 }
 
 // openBackingFile opens the ciphertext file that backs relative plaintext
@@ -196,7 +392,7 @@ func (fs *FS) openBackingFile(relPath string, flags int) (fd int, err error) {
 // problem if the file permissions do not allow reading (i.e. 0200 permissions).
 // This function works around that problem by chmod'ing the file, obtaining a fd,
 // and chmod'ing it back.
-func (fs *FS) openWriteOnlyFile(dirfd int, cName string, newFlags int) (*File, fuse.Status) {
+func (fs *FS) openWriteOnlyFile(dirfd int, cName string, newFlags int, context *fuse.Context) (*File, fuse.Status) {
 	woFd, err := syscallcompat.Openat(dirfd, cName, syscall.O_WRONLY|syscall.O_NOFOLLOW, 0)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
@@ -238,23 +434,54 @@ func (fs *FS) openWriteOnlyFile(dirfd int, cName string, newFlags int) (*File, f
 		return nil, fuse.ToStatus(err)
 	}
 	f := os.NewFile(uintptr(rwFd), cName)
-	return NewFile(f, fs)
+	return NewFile(f, fs, context)
 }
 
 // Create - FUSE call. Creates a new file.
 //
 // Symlink-safe through the use of Openat().
 func (fs *FS) Create(path string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	defer fs.stats.Record(opstats.Create, fs.stats.Now())
 	if fs.isFiltered(path) {
 		return nil, fuse.EPERM
 	}
+	if code := fs.checkWritable(); !code.Ok() {
+		return nil, code
+	}
+	if code := fs.quotaExceeded(); !code.Ok() {
+		return nil, code
+	}
+	if fs.args.MacOSForks {
+		if f, status := fs.createFork(path); status != fuse.ENOENT {
+			return f, status
+		}
+	}
+	f, status := fs.create(path, flags, mode, context)
+	return withDirectIO(f, status, flags)
+}
+
+// create creates the backing file for "path". It is the part of Create that
+// is shared with "-macos-forks", which needs to bypass the checks.
+func (fs *FS) create(path string, flags uint32, mode uint32, context *fuse.Context) (fuseFile nodefs.File, status fuse.Status) {
+	// Wait for a slot before opening anything, see fd_limit.go
+	if !fs.backingFds.acquire() {
+		return nil, fuse.Status(syscall.EMFILE)
+	}
+	defer func() {
+		if status.Ok() {
+			fuseFile.(*File).fdSlot = true
+		} else {
+			fs.backingFds.release()
+		}
+	}()
 	newFlags := fs.mangleOpenFlags(flags)
-	dirfd, cName, err := fs.openBackingDir(path)
+	dirfd, cName, err := fs.openBackingDirNew(path, "")
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
 	defer syscall.Close(dirfd)
 	fd := -1
+	caller := context
 	// Make sure context is nil if we don't want to preserve the owner
 	if !fs.args.PreserveOwner {
 		context = nil
@@ -262,6 +489,7 @@ func (fs *FS) Create(path string, flags uint32, mode uint32, context *fuse.Conte
 	// Handle long file name
 	if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
 		// Create ".name"
+		mtime := fs.saveDirMtime(dirfd, ".")
 		err = fs.nameTransform.WriteLongNameAt(dirfd, cName, path)
 		if err != nil {
 			return nil, fuse.ToStatus(err)
@@ -269,7 +497,7 @@ func (fs *FS) Create(path string, flags uint32, mode uint32, context *fuse.Conte
 		// Create content
 		fd, err = syscallcompat.OpenatUser(dirfd, cName, newFlags|syscall.O_CREAT|syscall.O_EXCL, mode, context)
 		if err != nil {
-			nametransform.DeleteLongNameAt(dirfd, cName)
+			fs.rollbackLongName(dirfd, cName, mtime)
 		}
 	} else {
 		// Create content, normal (short) file name
@@ -284,8 +512,13 @@ func (fs *FS) Create(path string, flags uint32, mode uint32, context *fuse.Conte
 		}
 		return nil, fuse.ToStatus(err)
 	}
+	fs.dirCountAdd(dirfd, 1)
+	if err = fs.syncNewEntry(dirfd, cName); err != nil {
+		syscall.Close(fd)
+		return nil, fuse.ToStatus(err)
+	}
 	f := os.NewFile(uintptr(fd), cName)
-	return NewFile(f, fs)
+	return NewFile(f, fs, caller)
 }
 
 // Chmod - FUSE call. Change permissions on "path".
@@ -295,6 +528,9 @@ func (fs *FS) Chmod(path string, mode uint32, context *fuse.Context) (code fuse.
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
+	if code := fs.checkWritable(); !code.Ok() {
+		return code
+	}
 	dirfd, cName, err := fs.openBackingDir(path)
 	if err != nil {
 		return fuse.ToStatus(err)
@@ -303,6 +539,10 @@ func (fs *FS) Chmod(path string, mode uint32, context *fuse.Context) (code fuse.
 	// os.Chmod goes through the "syscallMode" translation function that messes
 	// up the suid and sgid bits. So use a syscall directly.
 	err = syscallcompat.FchmodatNofollow(dirfd, cName, mode)
+	if err == syscall.ENOENT && fs.isVirtualFork(path) {
+		// The mode of a virtual AppleDouble file follows the main file
+		return fuse.OK
+	}
 	return fuse.ToStatus(err)
 }
 
@@ -313,12 +553,19 @@ func (fs *FS) Chown(path string, uid uint32, gid uint32, context *fuse.Context)
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
+	if code := fs.checkWritable(); !code.Ok() {
+		return code
+	}
 	dirfd, cName, err := fs.openBackingDir(path)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
 	defer syscall.Close(dirfd)
 	err = syscallcompat.Fchownat(dirfd, cName, int(uid), int(gid), unix.AT_SYMLINK_NOFOLLOW)
+	if err == syscall.ENOENT && fs.isVirtualFork(path) {
+		// The owner of a virtual AppleDouble file follows the main file
+		return fuse.OK
+	}
 	return fuse.ToStatus(err)
 }
 
@@ -329,7 +576,10 @@ func (fs *FS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context)
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
-	dirfd, cName, err := fs.openBackingDir(path)
+	if code := fs.checkWritable(); !code.Ok() {
+		return code
+	}
+	dirfd, cName, err := fs.openBackingDirNew(path, "")
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
@@ -340,6 +590,7 @@ func (fs *FS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context)
 	}
 	// Create ".name" file to store long file name (except in PlaintextNames mode)
 	if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
+		mtime := fs.saveDirMtime(dirfd, ".")
 		err = fs.nameTransform.WriteLongNameAt(dirfd, cName, path)
 		if err != nil {
 			return fuse.ToStatus(err)
@@ -347,12 +598,15 @@ func (fs *FS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context)
 		// Create "gocryptfs.longfile." device node
 		err = syscallcompat.MknodatUser(dirfd, cName, mode, int(dev), context)
 		if err != nil {
-			nametransform.DeleteLongNameAt(dirfd, cName)
+			fs.rollbackLongName(dirfd, cName, mtime)
 		}
 	} else {
 		// Create regular device node
 		err = syscallcompat.MknodatUser(dirfd, cName, mode, int(dev), context)
 	}
+	if err == nil {
+		fs.dirCountAdd(dirfd, 1)
+	}
 	return fuse.ToStatus(err)
 }
 
@@ -364,7 +618,9 @@ func (fs *FS) Mknod(path string, mode uint32, dev uint32, context *fuse.Context)
 //
 // Symlink-safe by letting file.Truncate() do all the work.
 func (fs *FS) Truncate(path string, offset uint64, context *fuse.Context) (code fuse.Status) {
-	file, code := fs.Open(path, uint32(os.O_RDWR), context)
+	// Internal open: the caller may hold locks that the files waiting for a
+	// slot need, see fd_limit.go
+	file, code := fs.open(path, uint32(os.O_RDWR), context, true)
 	if code != fuse.OK {
 		return code
 	}
@@ -380,12 +636,32 @@ func (fs *FS) Utimens(path string, a *time.Time, m *time.Time, context *fuse.Con
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
+	if code := fs.checkWritable(); !code.Ok() {
+		return code
+	}
 	dirfd, cName, err := fs.openBackingDir(path)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
 	defer syscall.Close(dirfd)
+	if fs.args.CoalesceWrites {
+		// Flushing later would change the mtime again
+		var st unix.Stat_t
+		err = syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+		if err == nil {
+			if status := fs.flushDirtyStat(&st); !status.Ok() {
+				return status
+			}
+		}
+	}
 	err = syscallcompat.UtimesNanoAtNofollow(dirfd, cName, a, m)
+	if err == syscall.ENOENT && fs.isVirtualFork(path) {
+		// The timestamps of a virtual AppleDouble file follow the main file
+		return fuse.OK
+	}
+	if err == nil && fs.args.EmulateHiresTime {
+		fs.utimensHiresTime(dirfd, cName, a, m)
+	}
 	return fuse.ToStatus(err)
 }
 
@@ -439,6 +715,14 @@ func (fs *FS) Readlink(relPath string, context *fuse.Context) (out string, statu
 	if fs.args.PlaintextNames {
 		return cTarget, fuse.OK
 	}
+	// Long targets are stored separately
+	if id, ok := fs.longLinkID(cTarget); ok {
+		cTarget, err = fs.readLongLink(id)
+		if err != nil {
+			tlog.Warn.Printf("Readlink %q: reading %s/%s failed: %v", cName, LongLinkDirName, id, err)
+			return "", fuse.EIO
+		}
+	}
 	// Symlinks are encrypted like file contents (GCM) and base64-encoded
 	target, err := fs.decryptSymlinkTarget(cTarget)
 	if err != nil {
@@ -455,16 +739,39 @@ func (fs *FS) Unlink(path string, context *fuse.Context) (code fuse.Status) {
 	if fs.isFiltered(path) {
 		return fuse.EPERM
 	}
+	if code := fs.checkWritable(); !code.Ok() {
+		return code
+	}
 	dirfd, cName, err := fs.openBackingDir(path)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
 	defer syscall.Close(dirfd)
+	if fs.isVirtualFork(path) {
+		return fs.unlinkFork(path)
+	}
+	if fs.args.Trash {
+		_, err = fs.trashEntry(dirfd, cName, path)
+		if err == nil {
+			fs.dirCountAdd(dirfd, -1)
+		}
+		return fuse.ToStatus(err)
+	}
+	freed := fs.quotaFreedAt(dirfd, cName)
+	longLink := fs.longLinkAt(dirfd, cName)
+	secureFd := fs.secureDeleteOpenAt(dirfd, cName)
 	// Delete content
 	err = syscallcompat.Unlinkat(dirfd, cName, 0)
 	if err != nil {
+		if secureFd >= 0 {
+			syscall.Close(secureFd)
+		}
 		return fuse.ToStatus(err)
 	}
+	secureDeleteFinish(secureFd, cName)
+	fs.quotaAdd(-freed)
+	fs.deleteLongLink(longLink)
+	fs.dirCountAdd(dirfd, -1)
 	// Delete ".name" file
 	if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
 		err = nametransform.DeleteLongNameAt(dirfd, cName)
@@ -497,7 +804,10 @@ func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) (co
 	if fs.isFiltered(linkName) {
 		return fuse.EPERM
 	}
-	dirfd, cName, err := fs.openBackingDir(linkName)
+	if code := fs.checkWritable(); !code.Ok() {
+		return code
+	}
+	dirfd, cName, err := fs.openBackingDirNew(linkName, "")
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
@@ -513,18 +823,22 @@ func (fs *FS) Symlink(target string, linkName string, context *fuse.Context) (co
 	}
 	// Create ".name" file to store long file name (except in PlaintextNames mode)
 	if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
+		mtime := fs.saveDirMtime(dirfd, ".")
 		err = fs.nameTransform.WriteLongNameAt(dirfd, cName, linkName)
 		if err != nil {
 			return fuse.ToStatus(err)
 		}
 		// Create "gocryptfs.longfile." symlink
-		err = syscallcompat.SymlinkatUser(cTarget, dirfd, cName, context)
+		err = fs.symlinkat(cTarget, dirfd, cName, context)
 		if err != nil {
-			nametransform.DeleteLongNameAt(dirfd, cName)
+			fs.rollbackLongName(dirfd, cName, mtime)
 		}
 	} else {
 		// Create symlink
-		err = syscallcompat.SymlinkatUser(cTarget, dirfd, cName, context)
+		err = fs.symlinkat(cTarget, dirfd, cName, context)
+	}
+	if err == nil {
+		fs.dirCountAdd(dirfd, 1)
 	}
 	return fuse.ToStatus(err)
 }
@@ -537,22 +851,45 @@ func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (cod
 	if fs.isFiltered(newPath) {
 		return fuse.EPERM
 	}
+	if code := fs.checkWritable(); !code.Ok() {
+		return code
+	}
+	if fs.isVirtualFork(oldPath) {
+		return fs.renameFork(oldPath, newPath)
+	}
 	oldDirfd, oldCName, err := fs.openBackingDir(oldPath)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
 	defer syscall.Close(oldDirfd)
-	newDirfd, newCName, err := fs.openBackingDir(newPath)
+	newDirfd, newCName, err := fs.openBackingDirNew(newPath, oldPath)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
 	defer syscall.Close(newDirfd)
+	// A file that is overwritten by the rename does not count anymore
+	freed := fs.quotaReplaced(oldDirfd, oldCName, newDirfd, newCName)
+	// A long symlink that is overwritten needs its target deleted
+	longLink := fs.longLinkAt(newDirfd, newCName)
+	defer func() {
+		if code.Ok() {
+			fs.quotaAdd(-freed)
+			fs.deleteLongLink(longLink)
+			// The entry may have replaced an existing one in newDirfd
+			fs.dirCountAdd(oldDirfd, -1)
+			fs.dirCountForget(newDirfd)
+			if fs.args.MacOSForks {
+				fs.dropShadowedFork(newPath)
+			}
+		}
+	}()
 	// Easy case.
 	if fs.args.PlaintextNames {
 		return fuse.ToStatus(syscallcompat.Renameat(oldDirfd, oldCName, newDirfd, newCName))
 	}
 	// Long destination file name: create .name file
 	nameFileAlreadyThere := false
+	mtime := fs.saveDirMtime(newDirfd, ".")
 	if nametransform.IsLongContent(newCName) {
 		err = fs.nameTransform.WriteLongNameAt(newDirfd, newCName, newPath)
 		// Failure to write the .name file is expected when the target path already
@@ -575,13 +912,15 @@ func (fs *FS) Rename(oldPath string, newPath string, context *fuse.Context) (cod
 		// again.
 		tlog.Debug.Printf("Rename: Handling ENOTEMPTY")
 		if fs.Rmdir(newPath, context) == fuse.OK {
+			// Removing the target is a visible change
+			mtime.ok = false
 			err = syscallcompat.Renameat(oldDirfd, oldCName, newDirfd, newCName)
 		}
 	}
 	if err != nil {
 		if nametransform.IsLongContent(newCName) && nameFileAlreadyThere == false {
 			// Roll back .name creation unless the .name file was already there
-			nametransform.DeleteLongNameAt(newDirfd, newCName)
+			fs.rollbackLongName(newDirfd, newCName, mtime)
 		}
 		return fuse.ToStatus(err)
 	}
@@ -599,18 +938,22 @@ func (fs *FS) Link(oldPath string, newPath string, context *fuse.Context) (code
 	if fs.isFiltered(newPath) {
 		return fuse.EPERM
 	}
+	if code := fs.checkWritable(); !code.Ok() {
+		return code
+	}
 	oldDirFd, cOldName, err := fs.openBackingDir(oldPath)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
 	defer syscall.Close(oldDirFd)
-	newDirFd, cNewName, err := fs.openBackingDir(newPath)
+	newDirFd, cNewName, err := fs.openBackingDirNew(newPath, "")
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
 	defer syscall.Close(newDirFd)
 	// Handle long file name (except in PlaintextNames mode)
 	if !fs.args.PlaintextNames && nametransform.IsLongContent(cNewName) {
+		mtime := fs.saveDirMtime(newDirFd, ".")
 		err = fs.nameTransform.WriteLongNameAt(newDirFd, cNewName, newPath)
 		if err != nil {
 			return fuse.ToStatus(err)
@@ -618,12 +961,15 @@ func (fs *FS) Link(oldPath string, newPath string, context *fuse.Context) (code
 		// Create "gocryptfs.longfile." link
 		err = syscallcompat.Linkat(oldDirFd, cOldName, newDirFd, cNewName, 0)
 		if err != nil {
-			nametransform.DeleteLongNameAt(newDirFd, cNewName)
+			fs.rollbackLongName(newDirFd, cNewName, mtime)
 		}
 	} else {
 		// Create regular link
 		err = syscallcompat.Linkat(oldDirFd, cOldName, newDirFd, cNewName, 0)
 	}
+	if err == nil {
+		fs.dirCountAdd(newDirFd, 1)
+	}
 	return fuse.ToStatus(err)
 }
 
@@ -642,6 +988,12 @@ func (fs *FS) Link(oldPath string, newPath string, context *fuse.Context) (code
 //
 // Symlink-safe through use of faccessat.
 func (fs *FS) Access(relPath string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	if fs.isShownConf(relPath) {
+		if mode&unix.W_OK != 0 {
+			return fuse.EACCES
+		}
+		return fuse.OK
+	}
 	if fs.isFiltered(relPath) {
 		return fuse.EPERM
 	}
@@ -651,6 +1003,9 @@ func (fs *FS) Access(relPath string, mode uint32, context *fuse.Context) (code f
 	}
 	err = syscallcompat.Faccessat(dirfd, cName, mode)
 	syscall.Close(dirfd)
+	if err == syscall.ENOENT && fs.isVirtualFork(relPath) {
+		return fuse.OK
+	}
 	return fuse.ToStatus(err)
 }
 
@@ -671,6 +1026,13 @@ func (fs *FS) reportMitigatedCorruption(item string) {
 	}
 }
 
+// isConfName returns true if "name" in the directory "dirName" is the config
+// file or its backup and must be hidden. When the user has chosen a config
+// file outside of CIPHERDIR, nothing is hidden.
+func (fs *FS) isConfName(dirName string, name string) bool {
+	return dirName == "" && !fs.args.ConfigCustom && configfile.IsConfName(name)
+}
+
 // isFiltered - check if plaintext "path" should be forbidden
 //
 // Prevents name clashes with internal files when file names are not encrypted
@@ -680,10 +1042,22 @@ func (fs *FS) isFiltered(path string) bool {
 	if !fs.args.PlaintextNames {
 		return false
 	}
-	// gocryptfs.conf in the root directory is forbidden
-	if path == configfile.ConfDefaultName {
+	// gocryptfs.conf and its backup in the root directory are forbidden
+	if fs.isConfName("", path) {
 		tlog.Info.Printf("The name /%s is reserved when -plaintextnames is used\n",
-			configfile.ConfDefaultName)
+			path)
+		return true
+	}
+	// So is the "-trash" directory
+	if fs.args.Trash && path == TrashDirName {
+		tlog.Info.Printf("The name /%s is reserved when -plaintextnames and -trash are used\n",
+			path)
+		return true
+	}
+	// And the "-journal" directory
+	if fs.args.Journal && path == JournalDirName {
+		tlog.Info.Printf("The name /%s is reserved when -plaintextnames and -journal are used\n",
+			path)
 		return true
 	}
 	// Note: gocryptfs.diriv is NOT forbidden because diriv and plaintextnames
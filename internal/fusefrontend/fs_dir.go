@@ -5,16 +5,18 @@ package fusefrontend
 import (
 	"fmt"
 	"io"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"syscall"
 
 	"golang.org/x/sys/unix"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 
-	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/opstats"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
@@ -34,10 +36,15 @@ func (fs *FS) mkdirWithIv(dirfd int, cName string, mode uint32, context *fuse.Co
 	if err != nil {
 		return err
 	}
-	dirfd2, err := syscallcompat.Openat(dirfd, cName, syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscallcompat.O_PATH, 0)
+	dirfd2, err := fs.openat(dirfd, cName, syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscallcompat.O_PATH, 0)
 	if err == nil {
-		// Create gocryptfs.diriv
-		err = nametransform.WriteDirIVAt(dirfd2)
+		// Create gocryptfs.diriv (unless we are in flat mode). The new
+		// directory keeps the mtime of its creation.
+		mtime := fs.saveDirMtime(dirfd2, ".")
+		err = fs.nameTransform.WriteDirIVAt(dirfd2)
+		if err == nil {
+			fs.restoreDirMtime(mtime)
+		}
 		syscall.Close(dirfd2)
 	}
 	if err != nil {
@@ -46,8 +53,11 @@ func (fs *FS) mkdirWithIv(dirfd int, cName string, mode uint32, context *fuse.Co
 		if err2 != nil {
 			tlog.Warn.Printf("mkdirWithIv: rollback failed: %v", err2)
 		}
+		return err
 	}
-	return err
+	// "-fsync-metadata": without it, a crash can leave the directory without
+	// its gocryptfs.diriv
+	return fs.syncNewDir(dirfd, cName)
 }
 
 // Mkdir - FUSE call. Create a directory at "newPath" with permissions "mode".
@@ -57,7 +67,10 @@ func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fu
 	if fs.isFiltered(newPath) {
 		return fuse.EPERM
 	}
-	dirfd, cName, err := fs.openBackingDir(newPath)
+	if code := fs.checkWritable(); !code.Ok() {
+		return code
+	}
+	dirfd, cName, err := fs.openBackingDirNew(newPath, "")
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
@@ -68,18 +81,28 @@ func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fu
 	}
 	if fs.args.PlaintextNames {
 		err = syscallcompat.MkdiratUser(dirfd, cName, mode, context)
+		if err == nil {
+			fs.dirCountAdd(dirfd, 1)
+			err = fs.syncNewEntry(dirfd, cName)
+		}
+		if err == nil {
+			err = fs.fixNewDirMode(dirfd, cName, mode)
+		}
 		return fuse.ToStatus(err)
 	}
 
 	// We need write and execute permissions to create gocryptfs.diriv.
 	// Also, we need read permissions to open the directory (to avoid
 	// race-conditions between getting and setting the mode).
+	// Only the owner bits are added, so group and others never get more
+	// access than requested, not even temporarily.
 	origMode := mode
 	mode = mode | 0700
 
 	// Handle long file name
 	if nametransform.IsLongContent(cName) {
 		// Create ".name"
+		mtime := fs.saveDirMtime(dirfd, ".")
 		err = fs.nameTransform.WriteLongNameAt(dirfd, cName, newPath)
 		if err != nil {
 			return fuse.ToStatus(err)
@@ -88,7 +111,7 @@ func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fu
 		// Create directory
 		err = fs.mkdirWithIv(dirfd, cName, mode, context)
 		if err != nil {
-			nametransform.DeleteLongNameAt(dirfd, cName)
+			fs.rollbackLongName(dirfd, cName, mtime)
 			return fuse.ToStatus(err)
 		}
 	} else {
@@ -97,32 +120,65 @@ func (fs *FS) Mkdir(newPath string, mode uint32, context *fuse.Context) (code fu
 			return fuse.ToStatus(err)
 		}
 	}
+	fs.dirCountAdd(dirfd, 1)
+	fs.dirCountSet(dirfd, cName, 0)
 	// Set mode
-	if origMode != mode {
-		dirfd2, err := syscallcompat.Openat(dirfd, cName,
-			syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
-		if err != nil {
-			tlog.Warn.Printf("Mkdir %q: Openat failed: %v", cName, err)
-			return fuse.ToStatus(err)
-		}
-		defer syscall.Close(dirfd2)
-
-		var st syscall.Stat_t
-		err = syscall.Fstat(dirfd2, &st)
-		if err != nil {
-			tlog.Warn.Printf("Mkdir %q: Fstat failed: %v", cName, err)
-			return fuse.ToStatus(err)
-		}
+	return fuse.ToStatus(fs.fixNewDirMode(dirfd, cName, origMode))
+}
 
-		// Preserve SGID bit if it was set due to inheritance.
-		origMode = uint32(st.Mode&^0777) | origMode
-		err = syscall.Fchmod(dirfd2, origMode)
-		if err != nil {
-			tlog.Warn.Printf("Mkdir %q: Fchmod %#o -> %#o failed: %v", cName, mode, origMode, err)
-			return fuse.ToStatus(err)
+// fixNewDirMode gives the new directory "cName" in "dirfd" the mode and
+// group that mkdir(2) with the requested "mode" would have given it, as
+// Mkdir creates directories with extra permissions, and the backing
+// filesystem may not implement SGID inheritance.
+//
+// The permission bits are the requested ones minus the umask (or the
+// default ACL) that Mkdirat has applied. The SUID and SGID bits in "mode"
+// are ignored, and the sticky bit is only set if requested, it is not
+// inherited. If the parent directory has the SGID bit, the new directory
+// gets it too, together with the group of the parent directory.
+func (fs *FS) fixNewDirMode(dirfd int, cName string, mode uint32) error {
+	var parent syscall.Stat_t
+	err := syscall.Fstat(dirfd, &parent)
+	if err != nil {
+		tlog.Warn.Printf("Mkdir %q: Fstat parent failed: %v", cName, err)
+		return err
+	}
+	dirfd2, err := fs.openat(dirfd, cName,
+		syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		tlog.Warn.Printf("Mkdir %q: Openat failed: %v", cName, err)
+		return err
+	}
+	defer syscall.Close(dirfd2)
+	var st syscall.Stat_t
+	err = syscall.Fstat(dirfd2, &st)
+	if err != nil {
+		tlog.Warn.Printf("Mkdir %q: Fstat failed: %v", cName, err)
+		return err
+	}
+	want := mode&syscall.S_ISVTX | mode&uint32(st.Mode)&0777
+	if parent.Mode&syscall.S_ISGID != 0 {
+		want |= syscall.S_ISGID
+		if st.Gid != parent.Gid {
+			// Changing the group clears the SGID bit, so do it first
+			err = syscall.Fchown(dirfd2, -1, int(parent.Gid))
+			if err != nil {
+				// Only root can give away a directory to a group it is
+				// not a member of. Keep the directory anyway.
+				tlog.Warn.Printf("Mkdir %q: Fchown gid %d -> %d failed: %v", cName, st.Gid, parent.Gid, err)
+			}
+			st.Mode &^= syscall.S_ISGID
 		}
 	}
-	return fuse.OK
+	if uint32(st.Mode)&07777 == want {
+		return nil
+	}
+	err = syscall.Fchmod(dirfd2, want)
+	if err != nil {
+		tlog.Warn.Printf("Mkdir %q: Fchmod %#o -> %#o failed: %v", cName, st.Mode&07777, want, err)
+		return err
+	}
+	return nil
 }
 
 // haveDsstore return true if one of the entries in "names" is ".DS_Store".
@@ -139,17 +195,43 @@ func haveDsstore(entries []fuse.DirEntry) bool {
 //
 // Symlink-safe through Unlinkat() + AT_REMOVEDIR.
 func (fs *FS) Rmdir(relPath string, context *fuse.Context) (code fuse.Status) {
+	return fs.rmdir(relPath, fs.args.Trash)
+}
+
+// rmdir implements Rmdir. With "trash" set, the directory is moved into the
+// "-trash" directory instead of being deleted.
+func (fs *FS) rmdir(relPath string, trash bool) (code fuse.Status) {
 	defer fs.dirCache.Clear()
+	if code := fs.checkWritable(); !code.Ok() {
+		return code
+	}
 	parentDirFd, cName, err := fs.openBackingDir(relPath)
 	if err != nil {
 		return fuse.ToStatus(err)
 	}
 	defer syscall.Close(parentDirFd)
+	defer func() {
+		if code.Ok() {
+			fs.dirCountAdd(parentDirFd, -1)
+		}
+	}()
+	if trash {
+		_, err = fs.trashDir(parentDirFd, cName, relPath)
+		return fuse.ToStatus(err)
+	}
 	if fs.args.PlaintextNames {
 		// Unlinkat with AT_REMOVEDIR is equivalent to Rmdir
 		err = unix.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
 		return fuse.ToStatus(err)
 	}
+	if fs.args.Flat || fs.args.DirIVXattr {
+		// No gocryptfs.diriv to take care of
+		err = unix.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
+		if err == nil && nametransform.IsLongContent(cName) {
+			nametransform.DeleteLongNameAt(parentDirFd, cName)
+		}
+		return fuse.ToStatus(err)
+	}
 	// Unless we are running as root, we need read, write and execute permissions
 	// to handle gocryptfs.diriv.
 	permWorkaround := false
@@ -164,7 +246,7 @@ func (fs *FS) Rmdir(relPath string, context *fuse.Context) (code fuse.Status) {
 			tlog.Debug.Printf("Rmdir: permWorkaround")
 			permWorkaround = true
 			// This cast is needed on Darwin, where st.Mode is uint16.
-			origMode = uint32(st.Mode)
+			origMode = uint32(st.Mode) & 07777
 			err = syscallcompat.FchmodatNofollow(parentDirFd, cName, origMode|0700)
 			if err != nil {
 				tlog.Debug.Printf("Rmdir: permWorkaround: chmod failed: %v", err)
@@ -172,10 +254,16 @@ func (fs *FS) Rmdir(relPath string, context *fuse.Context) (code fuse.Status) {
 			}
 		}
 	}
-	dirfd, err := syscallcompat.Openat(parentDirFd, cName,
+	dirfd, err := fs.openat(parentDirFd, cName,
 		syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
 	if err != nil {
 		tlog.Debug.Printf("Rmdir: Open: %v", err)
+		if permWorkaround {
+			err2 := syscallcompat.FchmodatNofollow(parentDirFd, cName, origMode)
+			if err2 != nil {
+				tlog.Warn.Printf("Rmdir: permWorkaround: rollback failed: %v", err2)
+			}
+		}
 		return fuse.ToStatus(err)
 	}
 	defer syscall.Close(dirfd)
@@ -191,47 +279,74 @@ func (fs *FS) Rmdir(relPath string, context *fuse.Context) (code fuse.Status) {
 			}
 		}()
 	}
-retry:
-	// Check directory contents
-	children, err := syscallcompat.Getdents(dirfd)
-	if err == io.EOF {
-		// The directory is empty
-		tlog.Warn.Printf("Rmdir: %q: %s is missing", cName, nametransform.DirIVFilename)
-		err = unix.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
-		return fuse.ToStatus(err)
-	}
-	if err != nil {
-		tlog.Warn.Printf("Rmdir: Readdirnames: %v", err)
-		return fuse.ToStatus(err)
-	}
-	// MacOS sprinkles .DS_Store files everywhere. This is hard to avoid for
-	// users, so handle it transparently here.
-	if runtime.GOOS == "darwin" && len(children) <= 2 && haveDsstore(children) {
-		err = unix.Unlinkat(dirfd, dsStoreName, 0)
+	// "-dir-count-cache": no need to read a directory that is known to be
+	// empty. If it is not, Unlinkat fails below.
+	knownEmpty := fs.dirCountEmpty(dirfd)
+	if !knownEmpty {
+	retry:
+		// Check directory contents
+		children, err := syscallcompat.Getdents(dirfd)
+		if err == io.EOF {
+			// The directory is empty
+			tlog.Warn.Printf("Rmdir: %q: %s is missing", cName, fs.nameTransform.DirIVName())
+			err = unix.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
+			return fuse.ToStatus(err)
+		}
 		if err != nil {
-			tlog.Warn.Printf("Rmdir: failed to delete blocking file %q: %v", dsStoreName, err)
+			tlog.Warn.Printf("Rmdir: Readdirnames: %v", err)
 			return fuse.ToStatus(err)
 		}
-		tlog.Warn.Printf("Rmdir: had to delete blocking file %q", dsStoreName)
-		goto retry
-	}
-	// If the directory is not empty besides gocryptfs.diriv, do not even
-	// attempt the dance around gocryptfs.diriv.
-	if len(children) > 1 {
-		return fuse.ToStatus(syscall.ENOTEMPTY)
+		// MacOS sprinkles .DS_Store files everywhere. This is hard to avoid for
+		// users, so handle it transparently here.
+		if runtime.GOOS == "darwin" && len(children) <= 2 && haveDsstore(children) {
+			err = unix.Unlinkat(dirfd, dsStoreName, 0)
+			if err != nil {
+				tlog.Warn.Printf("Rmdir: failed to delete blocking file %q: %v", dsStoreName, err)
+				return fuse.ToStatus(err)
+			}
+			tlog.Warn.Printf("Rmdir: had to delete blocking file %q", dsStoreName)
+			goto retry
+		}
+		// If the directory is not empty besides gocryptfs.diriv, do not even
+		// attempt the dance around gocryptfs.diriv.
+		if len(children) > 1 {
+			return fuse.ToStatus(syscall.ENOTEMPTY)
+		}
 	}
 	// Move "gocryptfs.diriv" to the parent dir as "gocryptfs.diriv.rmdir.XYZ"
-	tmpName := fmt.Sprintf("%s.rmdir.%d", nametransform.DirIVFilename, cryptocore.RandUint64())
-	tlog.Debug.Printf("Rmdir: Renaming %s to %s", nametransform.DirIVFilename, tmpName)
+	tmpName := fmt.Sprintf("%s.rmdir.%d", fs.nameTransform.DirIVName(), cryptocore.RandUint64())
+	tlog.Debug.Printf("Rmdir: Renaming %s to %s", fs.nameTransform.DirIVName(), tmpName)
 	// The directory is in an inconsistent state between rename and rmdir.
 	// Protect against concurrent readers.
 	fs.dirIVLock.Lock()
 	defer fs.dirIVLock.Unlock()
-	err = syscallcompat.Renameat(dirfd, nametransform.DirIVFilename,
+	parentMtime := fs.saveDirMtime(parentDirFd, ".")
+	err = syscallcompat.Renameat(dirfd, fs.nameTransform.DirIVName(),
 		parentDirFd, tmpName)
+	if err == syscall.ENOENT && knownEmpty {
+		// gocryptfs.diriv is missing, which the check above would have found
+		tlog.Warn.Printf("Rmdir: %q: %s is missing", cName, fs.nameTransform.DirIVName())
+		err = unix.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
+		return fuse.ToStatus(err)
+	}
+	if syscallcompat.IsDenied(err) {
+		// Append-only or WORM storage that does not allow the rename may still
+		// allow deleting the file
+		tlog.Warn.Printf("Rmdir %q: moving %s to the parent directory failed: %v%s",
+			cName, fs.nameTransform.DirIVName(), err, syscallcompat.DeniedHint(err))
+		err = fs.rmdirInPlace(parentDirFd, dirfd, cName)
+		if err != nil {
+			return fuse.ToStatus(err)
+		}
+		if nametransform.IsLongContent(cName) {
+			nametransform.DeleteLongNameAt(parentDirFd, cName)
+		}
+		fs.dirCountForget(dirfd)
+		return fuse.OK
+	}
 	if err != nil {
 		tlog.Warn.Printf("Rmdir: Renaming %s to %s failed: %v",
-			nametransform.DirIVFilename, tmpName, err)
+			fs.nameTransform.DirIVName(), tmpName, err)
 		return fuse.ToStatus(err)
 	}
 	// Actual Rmdir
@@ -240,30 +355,92 @@ retry:
 		// This can happen if another file in the directory was created in the
 		// meantime, undo the rename
 		err2 := syscallcompat.Renameat(parentDirFd, tmpName,
-			dirfd, nametransform.DirIVFilename)
+			dirfd, fs.nameTransform.DirIVName())
 		if err2 != nil {
-			tlog.Warn.Printf("Rmdir: Rename rollback failed: %v", err2)
+			tlog.Warn.Printf("Rmdir: Rename rollback failed: %v%s", err2, syscallcompat.DeniedHint(err2))
+		} else {
+			// Not the directory itself, it has legitimately changed
+			fs.restoreDirMtime(parentMtime)
 		}
+		// The cache was wrong if it said the directory is empty
+		fs.dirCountForget(dirfd)
 		return fuse.ToStatus(err)
 	}
 	// Delete "gocryptfs.diriv.rmdir.XYZ"
 	err = syscallcompat.Unlinkat(parentDirFd, tmpName, 0)
 	if err != nil {
-		tlog.Warn.Printf("Rmdir: Could not clean up %s: %v", tmpName, err)
+		tlog.Warn.Printf("Rmdir: Could not clean up %s: %v%s", tmpName, err, syscallcompat.DeniedHint(err))
 	}
 	// Delete .name file
 	if nametransform.IsLongContent(cName) {
 		nametransform.DeleteLongNameAt(parentDirFd, cName)
 	}
+	fs.dirCountForget(dirfd)
 	return fuse.OK
 }
 
+// rmdirInPlace removes the directory "cName" without moving its
+// gocryptfs.diriv out first. This is the fallback for storage that does not
+// allow the rename. If the directory cannot be removed, gocryptfs.diriv is
+// written back with the same IV. The caller must hold dirIVLock, because
+// the directory has no gocryptfs.diriv in between.
+func (fs *FS) rmdirInPlace(parentDirFd int, dirfd int, cName string) error {
+	iv, err := fs.nameTransform.ReadDirIVAt(dirfd)
+	if err != nil {
+		tlog.Warn.Printf("Rmdir %q: reading %s failed: %v", cName, fs.nameTransform.DirIVName(), err)
+		return err
+	}
+	err = syscallcompat.Unlinkat(dirfd, fs.nameTransform.DirIVName(), 0)
+	if err != nil {
+		tlog.Warn.Printf("Rmdir %q: deleting %s failed: %v%s",
+			cName, fs.nameTransform.DirIVName(), err, syscallcompat.DeniedHint(err))
+		return err
+	}
+	err = syscallcompat.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
+	if err != nil {
+		if err2 := fs.nameTransform.RestoreDirIVAt(dirfd, iv); err2 != nil {
+			tlog.Warn.Printf("Rmdir %q: restoring %s failed, the directory is now inaccessible: %v",
+				cName, fs.nameTransform.DirIVName(), err2)
+		}
+		fs.dirCountForget(dirfd)
+		return err
+	}
+	return nil
+}
+
+// readDirIV reads the DirIV of the directory opened as "dirfd". It holds
+// dirIVLock for reading, so it waits for a concurrent Mkdir or Rmdir that
+// is creating, moving or restoring gocryptfs.diriv. Without it, it could see
+// the directory without gocryptfs.diriv and fail although the directory
+// ends up with one. The caller must not hold dirIVLock, because RLock()
+// while a writer is waiting deadlocks.
+func (fs *FS) readDirIV(dirfd int) ([]byte, error) {
+	fs.dirIVLock.RLock()
+	defer fs.dirIVLock.RUnlock()
+	return fs.nameTransform.ReadDirIVAt(dirfd)
+}
+
+// isDeletedDir returns true if the directory opened as "fd" has been removed.
+func isDeletedDir(fd int) bool {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return false
+	}
+	return st.Nlink == 0
+}
+
 // OpenDir - FUSE call
 //
 // This function is symlink-safe through use of openBackingDir() and
 // ReadDirIVAt().
+//
+// The pathfs API has no streaming interface: go-fuse calls OpenDir when the
+// directory is opened or rewound and serves all READDIR requests from the
+// returned slice. The listing is thus a snapshot, with each entry returned
+// exactly once, and changes made while it is being read are not visible.
 func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
 	tlog.Debug.Printf("OpenDir(%s)", dirName)
+	defer fs.stats.Record(opstats.OpenDir, fs.stats.Now())
 	parentDirFd, cDirName, err := fs.openBackingDir(dirName)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
@@ -272,39 +449,70 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 	// Read ciphertext directory
 	var cipherEntries []fuse.DirEntry
 	var status fuse.Status
-	fd, err := syscallcompat.Openat(parentDirFd, cDirName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	fd, err := fs.openatNoatime(parentDirFd, cDirName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
 	defer syscall.Close(fd)
+	// Read the entries and the DirIV under dirIVLock, so that a concurrent
+	// Mkdir or Rmdir cannot show us the directory without gocryptfs.diriv.
+	// The DirIV stays nil if PlaintextNames is used.
+	var cachedIV []byte
+	var ivErr error
+	fs.dirIVLock.RLock()
 	cipherEntries, err = syscallcompat.Getdents(fd)
+	if err == nil && !fs.args.PlaintextNames {
+		cachedIV, ivErr = fs.nameTransform.ReadDirIVAt(fd)
+	}
+	fs.dirIVLock.RUnlock()
+	if (err != nil || ivErr != nil) && isDeletedDir(fd) {
+		// A concurrent Rmdir has removed the directory
+		return nil, fuse.ENOENT
+	}
 	if err != nil {
 		return nil, fuse.ToStatus(err)
 	}
-	// Get DirIV (stays nil if PlaintextNames is used)
-	var cachedIV []byte
 	if !fs.args.PlaintextNames {
-		// Read the DirIV from disk
-		cachedIV, err = nametransform.ReadDirIVAt(fd)
-		if err != nil {
-			tlog.Warn.Printf("OpenDir %q: could not read %s: %v", cDirName, nametransform.DirIVFilename, err)
+		if err = ivErr; err != nil {
+			if fs.args.DirIVRecover {
+				return fs.dirIVRecover(dirName, fd, cipherEntries, err)
+			}
+			tlog.Warn.Printf("OpenDir %q: could not read %s: %v", cDirName, fs.nameTransform.DirIVName(), err)
 			return nil, fuse.EIO
 		}
 	}
 	// Decrypted directory entries
 	var plain []fuse.DirEntry
+	// Config files passed through by "-show-conf"
+	var conf []fuse.DirEntry
 	// Filter and decrypt filenames
 	for i := range cipherEntries {
 		cName := cipherEntries[i].Name
-		if dirName == "" && cName == configfile.ConfDefaultName {
-			// silently ignore "gocryptfs.conf" in the top level dir
+		if fs.isConfName(dirName, cName) {
+			// silently ignore "gocryptfs.conf" and its backup in the top level dir,
+			// unless "-show-conf" is on
+			if fs.args.ShowConf {
+				conf = append(conf, cipherEntries[i])
+			}
+			continue
+		}
+		if fs.isTrashName(dirName, cName) {
+			// the "-trash" directory is only accessible via the control socket
+			continue
+		}
+		if fs.isLongLinkDir(dirName, cName) {
+			// long symlink targets are read through the symlinks
+			continue
+		}
+		if fs.isJournalName(dirName, cName) {
+			// the "-journal" directory is internal
 			continue
 		}
 		if fs.args.PlaintextNames {
 			plain = append(plain, cipherEntries[i])
 			continue
 		}
-		if cName == nametransform.DirIVFilename {
+		if cName == fs.nameTransform.DirIVName() {
 			// silently ignore "gocryptfs.diriv" everywhere if dirIV is enabled
 			continue
 		}
@@ -316,21 +524,33 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 		if isLong == nametransform.LongNameContent {
 			cNameLong, err := nametransform.ReadLongNameAt(fd, cName)
 			if err != nil {
-				tlog.Warn.Printf("OpenDir %q: invalid entry %q: Could not read .name: %v",
+				fs.warnCorrupt(dirName, cName, "OpenDir %q: invalid entry %q: Could not read .name: %v",
 					cDirName, cName, err)
 				fs.reportMitigatedCorruption(cName)
+				if fs.args.ShowCorrupt {
+					cipherEntries[i].Name = corruptPlaceholder(cName)
+					plain = append(plain, cipherEntries[i])
+				}
 				continue
 			}
 			cName = cNameLong
 		} else if isLong == nametransform.LongNameFilename {
-			// ignore "gocryptfs.longname.*.name"
+			// ignore "gocryptfs.longname.*.name", but tell fsck about the
+			// ones that have lost their content entry
+			if fs.MitigatedCorruptions != nil && isLongNameOrphan(fd, cName) {
+				fs.reportMitigatedCorruption(cName)
+			}
 			continue
 		}
 		name, err := fs.nameTransform.DecryptName(cName, cachedIV)
 		if err != nil {
-			tlog.Warn.Printf("OpenDir %q: invalid entry %q: %v",
+			fs.warnCorrupt(dirName, cipherEntries[i].Name, "OpenDir %q: invalid entry %q: %v",
 				cDirName, cName, err)
 			fs.reportMitigatedCorruption(cName)
+			if fs.args.ShowCorrupt {
+				cipherEntries[i].Name = corruptPlaceholder(cipherEntries[i].Name)
+				plain = append(plain, cipherEntries[i])
+			}
 			continue
 		}
 		// Override the ciphertext name with the plaintext name but reuse the rest
@@ -338,6 +558,104 @@ func (fs *FS) OpenDir(dirName string, context *fuse.Context) ([]fuse.DirEntry, f
 		cipherEntries[i].Name = name
 		plain = append(plain, cipherEntries[i])
 	}
+	if !fs.args.PlaintextNames {
+		fs.checkNormalization(dirName, plain)
+	}
+	fs.dirCountSet(fd, ".", len(plain))
+	if conf != nil {
+		plain = appendShownConf(plain, conf)
+	}
+	if fs.args.MacOSForks {
+		plain = fs.appendForks(dirName, plain)
+	}
+	if fs.args.SortDirs {
+		// Sort in place, the entries are already in memory anyway. "." and
+		// ".." are not part of the list, go-fuse appends them afterwards.
+		sort.Slice(plain, func(i, j int) bool {
+			return plain[i].Name < plain[j].Name
+		})
+	}
 
 	return plain, status
 }
+
+// checkNormalization warns about entries that are not in the Unicode
+// normalization form set by "-unicode-normalize". Such entries were created
+// without the option (or by another program) and cannot be opened, because
+// the looked-up name is normalized before encryption. This is most confusing
+// when the directory contains the same name in both forms, so we point that
+// out explicitly.
+func (fs *FS) checkNormalization(dirName string, entries []fuse.DirEntry) {
+	var seen map[string]bool
+	for _, e := range entries {
+		n := fs.nameTransform.NormalizeName(e.Name)
+		if n == e.Name {
+			continue
+		}
+		if seen == nil {
+			seen = make(map[string]bool)
+			for _, e2 := range entries {
+				seen[e2.Name] = true
+			}
+		}
+		if seen[n] {
+			tlog.Warn.Printf("OpenDir %q: entries %q and %q only differ in Unicode normalization, "+
+				"only the second one is accessible", dirName, e.Name, n)
+		} else {
+			tlog.Warn.Printf("OpenDir %q: entry %q is not normalized and is inaccessible with -unicode-normalize",
+				dirName, e.Name)
+		}
+	}
+}
+
+// isLongNameOrphan returns true if the content entry of the long name file
+// "cName" in the directory "fd" does not exist.
+func isLongNameOrphan(fd int, cName string) bool {
+	var st unix.Stat_t
+	err := syscallcompat.Fstatat(fd, nametransform.RemoveLongNameSuffix(cName), &st, unix.AT_SYMLINK_NOFOLLOW)
+	return err == syscall.ENOENT
+}
+
+// dirIVRecover is called by OpenDir() when "-diriv-recover" is active and
+// gocryptfs.diriv in the directory "dirName" (opened as "fd") could not be
+// read. Without the diriv, the names in the directory cannot be decrypted,
+// so we log where the directory is and how many entries are affected, and
+// return an empty listing instead of EIO.
+//
+// If the diriv is missing and the directory has no entries that depend on
+// it, we can safely recreate it.
+func (fs *FS) dirIVRecover(dirName string, fd int, cipherEntries []fuse.DirEntry, readErr error) ([]fuse.DirEntry, fuse.Status) {
+	cPath, _ := fs.EncryptPath(dirName)
+	n := 0
+	for _, e := range cipherEntries {
+		if e.Name == fs.nameTransform.DirIVName() || fs.isConfName(dirName, e.Name) || fs.isTrashName(dirName, e.Name) ||
+			fs.isLongLinkDir(dirName, e.Name) || fs.isJournalName(dirName, e.Name) {
+			continue
+		}
+		if nametransform.NameType(e.Name) == nametransform.LongNameFilename {
+			continue
+		}
+		n++
+	}
+	if n == 0 && readErr == syscall.ENOENT {
+		fs.dirIVLock.Lock()
+		mtime := fs.saveDirMtime(fd, ".")
+		err := fs.nameTransform.WriteDirIVAt(fd)
+		if err == nil {
+			fs.restoreDirMtime(mtime)
+		}
+		fs.dirIVLock.Unlock()
+		if err == nil {
+			tlog.Info.Printf("OpenDir %q (ciphertext %q): recreated missing %s in empty directory",
+				dirName, cPath, fs.nameTransform.DirIVName())
+			return nil, fuse.OK
+		}
+		tlog.Warn.Printf("OpenDir %q (ciphertext %q): recreating %s failed: %v",
+			dirName, cPath, fs.nameTransform.DirIVName(), err)
+	}
+	tlog.Warn.Printf("OpenDir %q (ciphertext %q): could not read %s: %v. "+
+		"-diriv-recover: hiding %d undecryptable entries",
+		dirName, cPath, fs.nameTransform.DirIVName(), readErr, n)
+	fs.reportMitigatedCorruption(filepath.Join(cPath, fs.nameTransform.DirIVName()))
+	return nil, fuse.OK
+}
@@ -0,0 +1,380 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestDirIVRecover checks that OpenDir on a directory with a missing or
+// corrupt gocryptfs.diriv returns EIO by default, and an empty listing with
+// "-diriv-recover".
+func TestDirIVRecover(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	for _, rec := range []bool{false, true} {
+		fs := newTestFS(Args{Cipherdir: cipherdir, DirIVRecover: rec})
+		dir := "empty"
+		if rec {
+			dir += "_recover"
+		}
+		if code := fs.Mkdir(dir, 0700, nil); !code.Ok() {
+			t.Fatal(code)
+		}
+		cDir, err := fs.EncryptPath(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diriv := filepath.Join(cipherdir, cDir, nametransform.DirIVFilename)
+		if err = os.Remove(diriv); err != nil {
+			t.Fatal(err)
+		}
+		fs.dirCache.Clear()
+		entries, code := fs.OpenDir(dir, nil)
+		if !rec {
+			if code != fuse.EIO {
+				t.Errorf("want EIO, got %v", code)
+			}
+			continue
+		}
+		if !code.Ok() || len(entries) != 0 {
+			t.Fatalf("want empty listing, got %v, %v", entries, code)
+		}
+		// The diriv of the empty directory should have been recreated
+		if _, err = os.Stat(diriv); err != nil {
+			t.Error(err)
+		}
+	}
+	// Non-empty directory with a corrupt diriv
+	fs := newTestFS(Args{Cipherdir: cipherdir, DirIVRecover: true})
+	if code := fs.Mkdir("full", 0700, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.Mkdir("full/child", 0700, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	cDir, err := fs.EncryptPath("full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	diriv := filepath.Join(cipherdir, cDir, nametransform.DirIVFilename)
+	os.Chmod(diriv, 0600)
+	if err = ioutil.WriteFile(diriv, []byte("xxx"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fs.dirCache.Clear()
+	entries, code := fs.OpenDir("full", nil)
+	if !code.Ok() || len(entries) != 0 {
+		t.Fatalf("want empty listing, got %v, %v", entries, code)
+	}
+}
+
+// TestMkdirUmask checks that Mkdir, which creates directories with at least
+// 0700 to write gocryptfs.diriv, ends up with the requested mode minus the
+// umask, like mkdir(2).
+// TestCorruptNames checks that undecryptable entries are skipped by default
+// and with "-hide-corrupt", and listed under a placeholder name that can be
+// deleted with "-show-corrupt".
+func TestCorruptNames(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	// Not valid base64, so decryption fails
+	bad := "corrupt!name"
+	if err := ioutil.WriteFile(filepath.Join(cipherdir, bad), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range []Args{{}, {HideCorrupt: true}} {
+		args.Cipherdir = cipherdir
+		fs := newTestFS(args)
+		entries, code := fs.OpenDir("", nil)
+		if !code.Ok() || len(entries) != 0 {
+			t.Errorf("%+v: want empty listing, got %v, %v", args, entries, code)
+		}
+	}
+	fs := newTestFS(Args{Cipherdir: cipherdir, ShowCorrupt: true})
+	entries, code := fs.OpenDir("", nil)
+	placeholder := corruptPlaceholder(bad)
+	if !code.Ok() || len(entries) != 1 || entries[0].Name != placeholder {
+		t.Fatalf("want [%s], got %v, %v", placeholder, entries, code)
+	}
+	if _, code = fs.GetAttr(placeholder, nil); !code.Ok() {
+		t.Errorf("GetAttr: %v", code)
+	}
+	if code = fs.Unlink(placeholder, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, err := os.Stat(filepath.Join(cipherdir, bad)); !os.IsNotExist(err) {
+		t.Errorf("backing file should be gone: %v", err)
+	}
+	// Placeholders that do not match anything are normal names
+	if _, code = fs.GetAttr(placeholder, nil); code != fuse.ENOENT {
+		t.Errorf("want ENOENT, got %v", code)
+	}
+}
+
+// TestRmdirOpenDirRace hammers Mkdir, Rmdir, Create and OpenDir on the same
+// directory. Rmdir moves gocryptfs.diriv out of the directory and moves it
+// back if a file has been created in the meantime. OpenDir must never see
+// the directory without gocryptfs.diriv and fail with EIO.
+func TestRmdirOpenDirRace(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	const n = 1000
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			fs.Mkdir("d", 0700, nil)
+			fs.Rmdir("d", nil)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			if f, code := fs.Create("d/f", uint32(os.O_WRONLY), 0600, nil); code.Ok() {
+				f.Release()
+				fs.Unlink("d/f", nil)
+			}
+		}
+	}()
+	var eio int32
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			_, code := fs.OpenDir("d", nil)
+			if code == fuse.EIO {
+				atomic.AddInt32(&eio, 1)
+			}
+		}
+	}()
+	wg.Wait()
+	if eio > 0 {
+		t.Errorf("OpenDir failed with EIO %d times", eio)
+	}
+}
+
+func TestMkdirUmask(t *testing.T) {
+	fs := newTestFS(Args{Cipherdir: test_helpers.InitFS(t)})
+	defer syscall.Umask(syscall.Umask(0))
+	for _, umask := range []uint32{0, 022, 027, 077, 0277} {
+		syscall.Umask(int(umask))
+		for _, mode := range []uint32{0777, 0755, 0711, 0500, 0070, 0} {
+			dir := fmt.Sprintf("dir_%o_%o", umask, mode)
+			if code := fs.Mkdir(dir, mode, nil); !code.Ok() {
+				t.Fatalf("%s: %v", dir, code)
+			}
+			a, code := fs.GetAttr(dir, nil)
+			if !code.Ok() {
+				t.Fatalf("%s: %v", dir, code)
+			}
+			if got, want := a.Mode&07777, mode&^umask; got != want {
+				t.Errorf("%s: want mode %#o, got %#o", dir, want, got)
+			}
+			// Rmdir needs to elevate the permissions too
+			if code = fs.Rmdir(dir, nil); !code.Ok() {
+				t.Errorf("%s: Rmdir: %v", dir, code)
+			}
+		}
+	}
+}
+
+// TestMkdirSgidSticky checks that new directories inherit the SGID bit and
+// the group of their parent directory, but not the sticky bit, like with
+// mkdir(2).
+func TestMkdirSgidSticky(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("must run as root to change the group")
+	}
+	defer syscall.Umask(syscall.Umask(022))
+	const gid = 12345
+	for _, plain := range []bool{false, true} {
+		fs := newTestFS(Args{Cipherdir: test_helpers.InitFS(t), PlaintextNames: plain})
+		for _, dir := range []string{"sgid", "sticky"} {
+			if code := fs.Mkdir(dir, 0777, nil); !code.Ok() {
+				t.Fatal(code)
+			}
+		}
+		if code := fs.Chown("sgid", 0, gid, nil); !code.Ok() {
+			t.Fatal(code)
+		}
+		if code := fs.Chmod("sgid", 02775, nil); !code.Ok() {
+			t.Fatal(code)
+		}
+		if code := fs.Chmod("sticky", 01777, nil); !code.Ok() {
+			t.Fatal(code)
+		}
+		testcases := []struct {
+			dir     string
+			mode    uint32
+			want    uint32
+			wantGid uint32
+		}{
+			{"sgid/a", 0777, 02755, gid},
+			{"sgid/b", 0700, 02700, gid},
+			{"sgid/c", 01750, 03750, gid},
+			{"sgid/a/d", 0070, 02050, gid},
+			{"sticky/a", 0777, 0755, 0},
+			{"sticky/b", 01777, 01755, 0},
+			// SUID and SGID are not taken from the requested mode
+			{"sticky/c", 06755, 0755, 0},
+		}
+		for _, tc := range testcases {
+			if code := fs.Mkdir(tc.dir, tc.mode, nil); !code.Ok() {
+				t.Fatalf("plain=%v %s: %v", plain, tc.dir, code)
+			}
+			a, code := fs.GetAttr(tc.dir, nil)
+			if !code.Ok() {
+				t.Fatalf("plain=%v %s: %v", plain, tc.dir, code)
+			}
+			if got := a.Mode & 07777; got != tc.want {
+				t.Errorf("plain=%v %s: want mode %#o, got %#o", plain, tc.dir, tc.want, got)
+			}
+			if a.Gid != tc.wantGid {
+				t.Errorf("plain=%v %s: want gid %d, got %d", plain, tc.dir, tc.wantGid, a.Gid)
+			}
+		}
+	}
+}
+
+// TestOpenDirSorted checks that "-sort-dirs" returns the entries sorted by
+// the plaintext name
+func TestOpenDirSorted(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, SortDirs: true})
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("file%03d", (i*37)%100)
+		f, code := fs.Create(name, uint32(os.O_WRONLY), 0600, nil)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		f.Release()
+	}
+	entries, code := fs.OpenDir("", nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if len(entries) != 100 {
+		t.Fatalf("want 100 entries, got %d", len(entries))
+	}
+	for i, e := range entries {
+		if want := fmt.Sprintf("file%03d", i); e.Name != want {
+			t.Errorf("entry %d: want %q, got %q", i, want, e.Name)
+		}
+	}
+}
+
+// TestRmdirInPlace checks the Rmdir fallback for storage that does not allow
+// moving gocryptfs.diriv: a directory that is not empty keeps its IV.
+func TestRmdirInPlace(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	if code := fs.Mkdir("dir", 0700, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.Mkdir("dir/child", 0700, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	parentDirFd, cName, err := fs.openBackingDir("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(parentDirFd)
+	dirfd, err := syscallcompat.Openat(parentDirFd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	iv, err := nametransform.ReadDirIVAt(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.rmdirInPlace(parentDirFd, dirfd, cName); err != syscall.ENOTEMPTY {
+		t.Fatalf("want ENOTEMPTY, got %v", err)
+	}
+	iv2, err := nametransform.ReadDirIVAt(dirfd)
+	if err != nil || string(iv) != string(iv2) {
+		t.Fatalf("diriv has not been restored: %v", err)
+	}
+	if code := fs.Rmdir("dir/child", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if err = fs.rmdirInPlace(parentDirFd, dirfd, cName); err != nil {
+		t.Fatal(err)
+	}
+	if _, code := fs.GetAttr("dir", nil); code != fuse.ENOENT {
+		t.Errorf("want ENOENT, got %v", code)
+	}
+}
+
+// TestPruneEmptyDirs checks "-prune-empty-on-unmount": empty directories go,
+// also if they only contained empty directories, everything else stays.
+func TestPruneEmptyDirs(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	for _, dir := range []string{"a", "a/b", "c", "c/empty"} {
+		if code := fs.Mkdir(dir, 0700, nil); !code.Ok() {
+			t.Fatal(code)
+		}
+	}
+	f, code := fs.Create("c/file", uint32(os.O_WRONLY), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	if n := fs.PruneEmptyDirs(); n != 3 {
+		t.Errorf("want 3 pruned directories, got %d", n)
+	}
+	entries, code := fs.OpenDir("", nil)
+	if !code.Ok() || len(entries) != 1 || entries[0].Name != "c" {
+		t.Errorf("root: want [c], got %v, %v", entries, code)
+	}
+	entries, code = fs.OpenDir("c", nil)
+	if !code.Ok() || len(entries) != 1 || entries[0].Name != "file" {
+		t.Errorf("c: want [file], got %v, %v", entries, code)
+	}
+}
+
+// TestLongNameOrphan checks that OpenDir reports a .name file whose content
+// entry is gone to fsck, and does not list it.
+func TestLongNameOrphan(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, LongNames: true})
+	fs.MitigatedCorruptions = make(chan string, 1)
+	long := strings.Repeat("x", 200)
+	if code := fs.Mkdir(long, 0700, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	cPath, err := fs.EncryptPath(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nametransform.NameType(cPath) != nametransform.LongNameContent {
+		t.Fatalf("%q is not a long name", cPath)
+	}
+	if err = os.RemoveAll(filepath.Join(cipherdir, cPath)); err != nil {
+		t.Fatal(err)
+	}
+	entries, code := fs.OpenDir("", nil)
+	if !code.Ok() || len(entries) != 0 {
+		t.Fatalf("want empty listing, got %v, %v", entries, code)
+	}
+	select {
+	case item := <-fs.MitigatedCorruptions:
+		if item != cPath+nametransform.LongNameSuffix {
+			t.Errorf("wrong item reported: %q", item)
+		}
+	default:
+		t.Error("orphaned .name file has not been reported")
+	}
+}
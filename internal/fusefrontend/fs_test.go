@@ -0,0 +1,453 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestLinkLongName hardlinks a file with a long name to another long name,
+// deletes the original and checks that the content is still readable through
+// the link, and that each name has its own .name file.
+func TestLinkLongName(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, LongNames: true})
+	orig := strings.Repeat("o", 200)
+	link := strings.Repeat("l", 200)
+	content := []byte("hello hardlink")
+
+	f, code := fs.Create(orig, uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write(content, 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	if code = fs.Link(orig, link, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	// Linking again must fail and must not clobber the existing .name file
+	if code = fs.Link(orig, link, nil); code != fuse.Status(syscall.EEXIST) {
+		t.Errorf("second Link: want EEXIST, got %v", code)
+	}
+	cOrig, err := fs.EncryptPath(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cLink, err := fs.EncryptPath(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nametransform.IsLongContent(cOrig) || !nametransform.IsLongContent(cLink) || cOrig == cLink {
+		t.Fatalf("unexpected ciphertext names %q %q", cOrig, cLink)
+	}
+	for _, c := range []string{cOrig, cLink} {
+		if _, err = os.Stat(filepath.Join(cipherdir, c+nametransform.LongNameSuffix)); err != nil {
+			t.Error(err)
+		}
+	}
+	var st syscall.Stat_t
+	if err = syscall.Stat(filepath.Join(cipherdir, cLink), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Nlink != 2 {
+		t.Errorf("want Nlink=2, got %d", st.Nlink)
+	}
+
+	if code = fs.Unlink(orig, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, err = os.Stat(filepath.Join(cipherdir, cOrig+nametransform.LongNameSuffix)); !os.IsNotExist(err) {
+		t.Errorf(".name file of the deleted name should be gone, err=%v", err)
+	}
+	if _, err = os.Stat(filepath.Join(cipherdir, cLink+nametransform.LongNameSuffix)); err != nil {
+		t.Errorf(".name file of the link should survive: %v", err)
+	}
+	entries, code := fs.OpenDir("", nil)
+	if !code.Ok() || len(entries) != 1 || entries[0].Name != link {
+		t.Errorf("OpenDir: got %v, %v", entries, code)
+	}
+	f, code = fs.Open(link, uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	buf := make([]byte, 100)
+	res, code := f.Read(buf, 0)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	data, _ := res.Bytes(buf)
+	if !bytes.Equal(data, content) {
+		t.Errorf("content mismatch: %q", data)
+	}
+}
+
+// TestUtimensNsec sets distinct atime and mtime with nanosecond precision
+// and checks that they are stored exactly, and that a nil time (UTIME_OMIT)
+// leaves the timestamp alone.
+func TestUtimensNsec(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	f, code := fs.Create("file", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	check := func(wantA, wantM time.Time) {
+		t.Helper()
+		a, code := fs.GetAttr("file", nil)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		if !a.AccessTime().Equal(wantA) {
+			t.Errorf("atime: want %v, got %v", wantA, a.AccessTime())
+		}
+		if !a.ModTime().Equal(wantM) {
+			t.Errorf("mtime: want %v, got %v", wantM, a.ModTime())
+		}
+	}
+	atime := time.Date(2001, 2, 3, 4, 5, 6, 123456789, time.UTC)
+	mtime := time.Date(2002, 3, 4, 5, 6, 7, 987654321, time.UTC)
+	if code = fs.Utimens("file", &atime, &mtime, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	check(atime, mtime)
+	// Only set mtime, outside of the range of time.UnixNano()
+	mtime2 := time.Date(2300, 1, 1, 0, 0, 0, 1, time.UTC)
+	if code = fs.Utimens("file", nil, &mtime2, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	check(atime, mtime2)
+	// Same through the file handle, only set atime
+	atime2 := time.Date(1969, 12, 31, 23, 59, 59, 5, time.UTC)
+	if code = f.Utimens(&atime2, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	check(atime2, mtime2)
+}
+
+// TestConfigCustomNoHide checks that "gocryptfs.conf" in the root directory
+// is only hidden and reserved when it is actually the config file.
+func TestConfigCustomNoHide(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t, "-plaintextnames")
+	listed := func(fs *FS) bool {
+		entries, code := fs.OpenDir("", nil)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		for _, e := range entries {
+			if e.Name == "gocryptfs.conf" {
+				return true
+			}
+		}
+		return false
+	}
+	fs := newTestFS(Args{Cipherdir: cipherdir, PlaintextNames: true})
+	if listed(fs) {
+		t.Error("gocryptfs.conf should be hidden")
+	}
+	if _, code := fs.GetAttr("gocryptfs.conf", nil); code.Ok() {
+		t.Error("gocryptfs.conf should be reserved")
+	}
+	fs = newTestFS(Args{Cipherdir: cipherdir, PlaintextNames: true, ConfigCustom: true})
+	if !listed(fs) {
+		t.Error("gocryptfs.conf should be visible with an external config")
+	}
+	if _, code := fs.GetAttr("gocryptfs.conf", nil); !code.Ok() {
+		t.Errorf("GetAttr with an external config: %v", code)
+	}
+}
+
+// TestFlat checks that a flat filesystem works without gocryptfs.diriv files,
+// and that equal names get equal ciphertext names in different directories.
+func TestFlat(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t, "-flat")
+	fs := newTestFS(Args{Cipherdir: cipherdir, LongNames: true, Flat: true})
+	long := strings.Repeat("l", 200)
+	for _, dir := range []string{"a", "b", "a/c", "a/" + long} {
+		if code := fs.Mkdir(dir, 0700, nil); !code.Ok() {
+			t.Fatalf("Mkdir %q: %v", dir, code)
+		}
+	}
+	for _, path := range []string{"a/x", "b/x"} {
+		f, code := fs.Create(path, uint32(os.O_RDWR), 0600, nil)
+		if !code.Ok() {
+			t.Fatalf("Create %q: %v", path, code)
+		}
+		f.Release()
+	}
+	cNames := make(map[string]bool)
+	err := filepath.Walk(cipherdir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Name() == nametransform.DirIVFilename {
+			t.Errorf("found %q", path)
+		}
+		if fi.Mode().IsRegular() && filepath.Dir(path) != cipherdir && !strings.HasSuffix(path, nametransform.LongNameSuffix) {
+			cNames[fi.Name()] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cNames) != 1 {
+		t.Errorf("a/x and b/x should have the same ciphertext name, got %v", cNames)
+	}
+	entries, code := fs.OpenDir("a", nil)
+	if !code.Ok() || len(entries) != 3 {
+		t.Fatalf("OpenDir: %v, %v", code, entries)
+	}
+	for _, dir := range []string{"a/c", "a/" + long} {
+		if code := fs.Rmdir(dir, nil); !code.Ok() {
+			t.Errorf("Rmdir %q: %v", dir, code)
+		}
+	}
+	if code := fs.Unlink("a/x", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.Rmdir("a", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	// Only "b" and gocryptfs.conf are left. The .name file of the long
+	// directory must be gone.
+	list, err := ioutil.ReadDir(cipherdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Errorf("leftover files in %q: %v", cipherdir, list)
+	}
+}
+
+// TestDirIVXattr checks that "-diriv-xattr" stores the DirIVs in xattrs,
+// so that no gocryptfs.diriv files are created, and that the xattr is hidden
+// from ListXAttr.
+func TestDirIVXattr(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t, "-diriv-xattr")
+	fs := newTestFS(Args{Cipherdir: cipherdir, LongNames: true, DirIVXattr: true})
+	for _, dir := range []string{"a", "a/b"} {
+		if code := fs.Mkdir(dir, 0700, nil); !code.Ok() {
+			t.Fatalf("Mkdir %q: %v", dir, code)
+		}
+	}
+	f, code := fs.Create("a/b/x", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	err := filepath.Walk(cipherdir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Name() == nametransform.DirIVFilename {
+			t.Errorf("found %q", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, code := fs.OpenDir("a/b", nil)
+	if !code.Ok() || len(entries) != 1 || entries[0].Name != "x" {
+		t.Errorf("OpenDir: %v, %v", code, entries)
+	}
+	if names, _ := fs.ListXAttr("a", nil); len(names) != 0 {
+		t.Errorf("diriv xattr should be hidden, got %v", names)
+	}
+	if code = fs.Rmdir("a/b", nil); code != fuse.Status(syscall.ENOTEMPTY) {
+		t.Errorf("Rmdir of a non-empty dir: want ENOTEMPTY, got %v", code)
+	}
+	if code = fs.Unlink("a/b/x", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	for _, dir := range []string{"a/b", "a"} {
+		if code = fs.Rmdir(dir, nil); !code.Ok() {
+			t.Errorf("Rmdir %q: %v", dir, code)
+		}
+	}
+}
+
+func TestDirIVName(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t, "-diriv-name", ".iv")
+	fs := newTestFS(Args{Cipherdir: cipherdir, LongNames: true})
+	if err := fs.nameTransform.(*nametransform.NameTransform).SetDirIVName(".iv"); err != nil {
+		t.Fatal(err)
+	}
+	if code := fs.Mkdir("a", 0700, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	dirs := 0
+	err := filepath.Walk(cipherdir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Name() == nametransform.DirIVFilename {
+			t.Errorf("found %q", path)
+		}
+		if fi.IsDir() {
+			dirs++
+			if _, err = os.Stat(filepath.Join(path, ".iv")); err != nil {
+				t.Error(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dirs != 2 {
+		t.Errorf("want 2 directories, found %d", dirs)
+	}
+	entries, code := fs.OpenDir("", nil)
+	if !code.Ok() || len(entries) != 1 || entries[0].Name != "a" {
+		t.Errorf("OpenDir: %v, %v", code, entries)
+	}
+	if code = fs.Rmdir("a", nil); !code.Ok() {
+		t.Errorf("Rmdir: %v", code)
+	}
+}
+
+// TestFsyncMetadata creates files and directories with "-fsync-metadata",
+// including long names and directories without any permissions, which have
+// to be opened for fsync.
+func TestFsyncMetadata(t *testing.T) {
+	for _, flat := range []bool{false, true} {
+		var cipherdir string
+		if flat {
+			cipherdir = test_helpers.InitFS(t, "-flat")
+		} else {
+			cipherdir = test_helpers.InitFS(t)
+		}
+		fs := newTestFS(Args{Cipherdir: cipherdir, LongNames: true, Flat: flat, FsyncMetadata: true})
+		long := strings.Repeat("l", 200)
+		for _, dir := range []string{"a", "a/" + long} {
+			if code := fs.Mkdir(dir, 0700, nil); !code.Ok() {
+				t.Fatalf("flat=%v: Mkdir %q: %v", flat, dir, code)
+			}
+		}
+		if code := fs.Mkdir("a/noperm", 0, nil); !code.Ok() {
+			t.Fatalf("flat=%v: Mkdir: %v", flat, code)
+		}
+		a, code := fs.GetAttr("a/noperm", nil)
+		if !code.Ok() || a.Mode&0777 != 0 {
+			t.Errorf("flat=%v: GetAttr: %v, mode %#o", flat, code, a.Mode)
+		}
+		for _, path := range []string{"a/x", "a/" + long + "/" + long} {
+			f, code := fs.Create(path, uint32(os.O_WRONLY), 0200, nil)
+			if !code.Ok() {
+				t.Fatalf("flat=%v: Create %q: %v", flat, path, code)
+			}
+			f.Release()
+		}
+		entries, code := fs.OpenDir("a/"+long, nil)
+		if !code.Ok() || len(entries) != 1 || entries[0].Name != long {
+			t.Errorf("flat=%v: OpenDir: %v, %v", flat, code, entries)
+		}
+	}
+}
+
+// TestFsyncMetadataCreate checks that "-fsync-metadata" syncs the parent
+// directory when a file is created, but not when an existing file is opened.
+func TestFsyncMetadataCreate(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, FsyncMetadata: true})
+	var synced []string
+	fsyncAtHook = func(name string) { synced = append(synced, name) }
+	defer func() { fsyncAtHook = func(string) {} }()
+	f, code := fs.Create("x", uint32(os.O_WRONLY), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	if len(synced) != 1 || synced[0] != "." {
+		t.Errorf("Create: want the parent directory synced, got %q", synced)
+	}
+	synced = nil
+	f, code = fs.Open("x", uint32(os.O_RDWR), nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	if len(synced) != 0 {
+		t.Errorf("Open: want nothing synced, got %q", synced)
+	}
+}
+
+// TestStatus checks the counters reported by the ctlsock "Status" command
+func TestStatus(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, FeatureFlags: []string{"HKDF"}})
+	f, code := fs.Create("file", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write([]byte("hello world"), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	buf := make([]byte, 5)
+	if _, code = f.Read(buf, 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	s := fs.Status()
+	if s.OpenFiles != 1 || s.BytesWritten != 11 || s.BytesRead != 5 || s.Uptime <= 0 {
+		t.Errorf("wrong status: %+v", s)
+	}
+	if len(s.FeatureFlags) != 1 || s.FeatureFlags[0] != "HKDF" {
+		t.Errorf("wrong feature flags: %v", s.FeatureFlags)
+	}
+	f.Release()
+	if s = fs.Status(); s.OpenFiles != 0 {
+		t.Errorf("OpenFiles=%d after Release", s.OpenFiles)
+	}
+}
+
+// TestPathInfo checks the sizes reported by the ctlsock "PathInfo" command
+func TestPathInfo(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	f, code := fs.Create("file", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	// Two full blocks and one byte
+	if _, code = f.Write(make([]byte, 2*4096+1), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	info, err := fs.PathInfo("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cPath, _ := fs.EncryptPath("file")
+	fi, err := os.Stat(filepath.Join(cipherdir, cPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.CipherPath != cPath || info.PlainSize != 2*4096+1 || info.CipherSize != uint64(fi.Size()) ||
+		info.Blocks != 3 || info.HeaderBytes != 18 || info.Overhead <= 1 {
+		t.Errorf("wrong info: %+v", info)
+	}
+	if code = fs.Mkdir("dir", 0700, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, err = fs.PathInfo("dir"); err != syscall.EINVAL {
+		t.Errorf("directory: want EINVAL, got %v", err)
+	}
+	if _, err = fs.PathInfo("missing"); err != syscall.ENOENT {
+		t.Errorf("missing file: want ENOENT, got %v", err)
+	}
+}
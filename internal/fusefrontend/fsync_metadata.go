@@ -0,0 +1,76 @@
+package fusefrontend
+
+// "-fsync-metadata": make the creation of files and directories durable
+// before the FUSE call returns.
+
+import (
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// fsyncAt opens the file or directory "name" in "dirfd" and fsyncs it.
+// "dirfd" may be an O_PATH file descriptor.
+func fsyncAt(dirfd int, name string) error {
+	fsyncAtHook(name)
+	// O_NONBLOCK so we cannot hang if the file has been replaced by a FIFO
+	fd, err := syscallcompat.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		tlog.Warn.Printf("fsyncAt %q: Openat: %v", name, err)
+		return err
+	}
+	defer syscall.Close(fd)
+	err = syscall.Fsync(fd)
+	if err != nil {
+		tlog.Warn.Printf("fsyncAt %q: Fsync: %v", name, err)
+	}
+	return err
+}
+
+// fsyncAtHook is called by fsyncAt with the name it is about to fsync. Used by
+// the tests to check which entries are synced.
+var fsyncAtHook = func(name string) {}
+
+// syncNewEntry makes sure that the newly created "cName" in "dirfd"
+// survives a crash. It fsyncs the long name file of "cName", if there is
+// one, and the directory "dirfd". Does nothing without "-fsync-metadata".
+func (fs *FS) syncNewEntry(dirfd int, cName string) error {
+	if !fs.args.FsyncMetadata {
+		return nil
+	}
+	if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
+		err := fsyncAt(dirfd, cName+nametransform.LongNameSuffix)
+		if err != nil {
+			return err
+		}
+	}
+	return fsyncAt(dirfd, ".")
+}
+
+// syncNewDir is like syncNewEntry for the directory "cName" created by
+// mkdirWithIv. It also fsyncs gocryptfs.diriv in the new directory, and the
+// new directory itself, so that it cannot end up without its
+// gocryptfs.diriv.
+func (fs *FS) syncNewDir(dirfd int, cName string) error {
+	if !fs.args.FsyncMetadata {
+		return nil
+	}
+	if !fs.args.Flat && !fs.args.DirIVXattr {
+		dirfd2, err := fs.openat(dirfd, cName, syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscallcompat.O_PATH, 0)
+		if err != nil {
+			return err
+		}
+		err = fsyncAt(dirfd2, fs.nameTransform.DirIVName())
+		syscall.Close(dirfd2)
+		if err != nil {
+			return err
+		}
+	}
+	err := fsyncAt(dirfd, cName)
+	if err != nil {
+		return err
+	}
+	return fs.syncNewEntry(dirfd, cName)
+}
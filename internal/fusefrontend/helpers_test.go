@@ -0,0 +1,38 @@
+package fusefrontend
+
+import (
+	"os"
+	"testing"
+)
+
+// writeTestFile creates the file "path" in "fs" with the content "content"
+func writeTestFile(t *testing.T, fs *FS, path string, content []byte) {
+	f, code := fs.Create(path, uint32(os.O_WRONLY), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write(content, 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code = f.Flush(); !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+}
+
+// readTestFile returns the content of the file "path" in "fs". Reads at most
+// 128 KiB.
+func readTestFile(t *testing.T, fs *FS, path string) []byte {
+	f, code := fs.Open(path, uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatalf("Open %q: %v", path, code)
+	}
+	defer f.Release()
+	buf := make([]byte, 128*1024)
+	res, code := f.Read(buf, 0)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	data, _ := res.Bytes(buf)
+	return data
+}
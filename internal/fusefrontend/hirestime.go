@@ -0,0 +1,219 @@
+package fusefrontend
+
+// "-emulate-hires-time": store nanosecond timestamps of regular files in an
+// encrypted xattr, for backing filesystems with coarse timestamps like FAT.
+
+import (
+	"encoding/binary"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// hiresTimeXattr is the plaintext name of the xattr that stores the
+// timestamps. It is encrypted like user xattrs, but it is in no namespace the
+// kernel passes through, so it cannot be accessed from the mountpoint.
+const hiresTimeXattr = "gocryptfs.hirestime"
+
+// timespec is a timestamp with the resolution of fuse.Attr
+type timespec struct {
+	sec  uint64
+	nsec uint32
+}
+
+// hiresTimes is the content of the hiresTimeXattr xattr. Besides the
+// nanosecond timestamps, it records the coarse timestamps of the backing
+// file at the time they were stored. If the backing timestamps have changed
+// since, somebody modified the file behind our back, and the stored
+// timestamps are stale.
+type hiresTimes struct {
+	atime, mtime, backingAtime, backingMtime timespec
+}
+
+// hiresTimesLen is the length of a marshaled hiresTimes
+const hiresTimesLen = 4 * (8 + 4)
+
+func (h *hiresTimes) marshal() []byte {
+	b := make([]byte, 0, hiresTimesLen)
+	for _, t := range []timespec{h.atime, h.mtime, h.backingAtime, h.backingMtime} {
+		b = appendUint64(b, t.sec)
+		b = appendUint32(b, t.nsec)
+	}
+	return b
+}
+
+func (h *hiresTimes) unmarshal(b []byte) bool {
+	if len(b) != hiresTimesLen {
+		return false
+	}
+	for _, t := range []*timespec{&h.atime, &h.mtime, &h.backingAtime, &h.backingMtime} {
+		t.sec = binary.BigEndian.Uint64(b)
+		t.nsec = binary.BigEndian.Uint32(b[8:])
+		b = b[12:]
+	}
+	return true
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func timeToTimespec(t time.Time) timespec {
+	return timespec{sec: uint64(t.Unix()), nsec: uint32(t.Nanosecond())}
+}
+
+// mergeHiresTime replaces the timestamps in "a" with the nanosecond
+// timestamps stored in the encrypted xattr value "cData". Timestamps that
+// are stale, and all timestamps if "cData" is corrupt, are left alone.
+func (fs *FS) mergeHiresTime(cData []byte, a *fuse.Attr) {
+	data, err := fs.decryptXattrValue(cData)
+	var h hiresTimes
+	if err != nil || !h.unmarshal(data) {
+		tlog.Warn.Printf("mergeHiresTime: ino%d: corrupt timestamp xattr", a.Ino)
+		return
+	}
+	if h.backingAtime == (timespec{a.Atime, a.Atimensec}) {
+		a.Atime, a.Atimensec = h.atime.sec, h.atime.nsec
+	}
+	if h.backingMtime == (timespec{a.Mtime, a.Mtimensec}) {
+		a.Mtime, a.Mtimensec = h.mtime.sec, h.mtime.nsec
+	}
+}
+
+// hiresTimeSupported returns false if the backing filesystem of "cipherdir"
+// has no user extended attributes, like Linux' vfat and exfat drivers.
+// "-emulate-hires-time" cannot store anything there.
+func hiresTimeSupported(cipherdir string, cAttr string) bool {
+	_, err := unix.Lgetxattr(cipherdir, cAttr, nil)
+	return err != syscall.ENOTSUP && err != syscall.EOPNOTSUPP
+}
+
+// getAttrHiresTime merges the nanosecond timestamps of the regular file at
+// "relPath" into "a". Files without the xattr keep the backing timestamps.
+func (fs *FS) getAttrHiresTime(relPath string, a *fuse.Attr) {
+	if !a.IsRegular() {
+		return
+	}
+	cData, status := fs.getXAttr(relPath, fs.hiresTimeCAttr, nil)
+	if !status.Ok() {
+		return
+	}
+	fs.mergeHiresTime(cData, a)
+}
+
+// fgetAttrHiresTime is like getAttrHiresTime, but works on an open file.
+func (fs *FS) fgetAttrHiresTime(fd int, a *fuse.Attr) {
+	cData, err := syscallcompat.Fgetxattr(fd, fs.hiresTimeCAttr)
+	if err != nil {
+		return
+	}
+	fs.mergeHiresTime(cData, a)
+}
+
+// storeHiresTime stores the nanosecond timestamps "atime" and "mtime" for the
+// regular file opened as "fd". Call it after the backing timestamps have
+// been updated. A nil timestamp keeps its current value.
+func (fs *FS) storeHiresTime(fd int, atime *time.Time, mtime *time.Time) {
+	var st syscall.Stat_t
+	err := syscall.Fstat(fd, &st)
+	if err != nil {
+		tlog.Warn.Printf("storeHiresTime: Fstat: %v", err)
+		return
+	}
+	var backing fuse.Attr
+	backing.FromStat(&st)
+	if !backing.IsRegular() {
+		return
+	}
+	cur := backing
+	fs.fgetAttrHiresTime(fd, &cur)
+	h := hiresTimes{
+		atime:        timespec{cur.Atime, cur.Atimensec},
+		mtime:        timespec{cur.Mtime, cur.Mtimensec},
+		backingAtime: timespec{backing.Atime, backing.Atimensec},
+		backingMtime: timespec{backing.Mtime, backing.Mtimensec},
+	}
+	if atime != nil {
+		h.atime = timeToTimespec(*atime)
+	}
+	if mtime != nil {
+		h.mtime = timeToTimespec(*mtime)
+	}
+	err = unix.Fsetxattr(fd, fs.hiresTimeCAttr, fs.encryptXattrValue(h.marshal()), 0)
+	if err != nil {
+		fs.hiresTimeWarnOnce.Do(func() {
+			tlog.Warn.Printf("-emulate-hires-time: cannot store timestamps: %v. "+
+				"Does the backing filesystem support extended attributes?", err)
+		})
+	}
+}
+
+// utimensHiresTime stores the timestamps set by FS.Utimens for the regular
+// file "cName" in "dirfd".
+func (fs *FS) utimensHiresTime(dirfd int, cName string, atime *time.Time, mtime *time.Time) {
+	var st unix.Stat_t
+	err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return
+	}
+	// O_NONBLOCK so we cannot hang if the file has been replaced by a FIFO
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return
+	}
+	defer syscall.Close(fd)
+	fs.storeHiresTime(fd, atime, mtime)
+}
+
+// flushHiresTime stores the time of the last write as the nanosecond mtime.
+// The caller must hold fdLock.
+func (f *File) flushHiresTime() {
+	if !f.fs.args.EmulateHiresTime {
+		return
+	}
+	f.fileTableEntry.ContentLock.Lock()
+	mtime := f.hiresMtime
+	f.hiresMtime = time.Time{}
+	f.fileTableEntry.ContentLock.Unlock()
+	if mtime.IsZero() {
+		return
+	}
+	f.fs.storeHiresTime(f.intFd(), nil, &mtime)
+}
+
+// applyHiresMtime replaces the mtime in "a" with the time of the last write
+// that flushHiresTime has not stored yet, if there is one.
+// The caller must hold fdLock.
+func (f *File) applyHiresMtime(a *fuse.Attr) {
+	f.fileTableEntry.ContentLock.RLock()
+	mtime := f.hiresMtime
+	f.fileTableEntry.ContentLock.RUnlock()
+	if mtime.IsZero() {
+		return
+	}
+	t := timeToTimespec(mtime)
+	a.Mtime, a.Mtimensec = t.sec, t.nsec
+}
+
+// markHiresMtime remembers the current time as the mtime that
+// flushHiresTime stores. Call it after writing to the file.
+// The caller must hold ContentLock.
+func (f *File) markHiresMtime() {
+	if f.fs.args.EmulateHiresTime {
+		f.hiresMtime = time.Now()
+	}
+}
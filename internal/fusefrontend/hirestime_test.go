@@ -0,0 +1,133 @@
+package fusefrontend
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// backingFile returns the path of the only regular file in the top-level
+// directory of "cipherdir", except gocryptfs.conf.
+func backingFile(t *testing.T, cipherdir string) string {
+	matches, err := filepath.Glob(cipherdir + "/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range matches {
+		fi, err := os.Lstat(m)
+		if err == nil && fi.Mode().IsRegular() && filepath.Base(m) != "gocryptfs.conf" &&
+			filepath.Base(m) != "gocryptfs.diriv" {
+			return m
+		}
+	}
+	t.Fatalf("no backing file in %q", cipherdir)
+	return ""
+}
+
+func attrMtime(a *fuse.Attr) time.Time {
+	return time.Unix(int64(a.Mtime), int64(a.Mtimensec))
+}
+
+func TestEmulateHiresTime(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	if err := unix.Setxattr(cipherdir, "user.probe", []byte("x"), 0); err != nil {
+		t.Skipf("backing filesystem does not support xattrs: %v", err)
+	}
+	fs := newTestFS(Args{Cipherdir: cipherdir, LongNames: true, EmulateHiresTime: true})
+	f, code := fs.Create("file", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write([]byte("foo"), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Flush()
+	f.Release()
+	backing := backingFile(t, cipherdir)
+	// A coarse backing filesystem would have truncated these
+	atime := time.Unix(2000, 987654321)
+	mtime := time.Unix(1000, 123456789)
+	if code = fs.Utimens("file", &atime, &mtime, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	// Simulate the truncation
+	coarse := []unix.Timespec{{Sec: 2000}, {Sec: 1000}}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, backing, coarse, 0); err != nil {
+		t.Fatal(err)
+	}
+	// ...and adjust the stored backing timestamps to match, as if gocryptfs
+	// had stored them after the truncation
+	fd, err := syscall.Open(backing, syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.storeHiresTime(fd, &atime, &mtime)
+	syscall.Close(fd)
+	a, code := fs.GetAttr("file", nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if !attrMtime(a).Equal(mtime) || a.Atime != 2000 || a.Atimensec != 987654321 {
+		t.Errorf("wrong timestamps: atime=%d.%09d mtime=%v", a.Atime, a.Atimensec, attrMtime(a))
+	}
+	// The xattr is internal
+	names, code := fs.ListXAttr("file", nil)
+	if !code.Ok() || len(names) != 0 {
+		t.Errorf("ListXAttr: %v %v", code, names)
+	}
+	// A write updates the mtime
+	f2, code := fs.Open("file", uint32(os.O_RDWR), nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	before := time.Now()
+	if _, code = f2.Write([]byte("bar"), 3); !code.Ok() {
+		t.Fatal(code)
+	}
+	f2.Flush()
+	a = &fuse.Attr{}
+	if code = f2.GetAttr(a); !code.Ok() {
+		t.Fatal(code)
+	}
+	f2.Release()
+	if attrMtime(a).Before(before) {
+		t.Errorf("mtime %v was not updated by the write at %v", attrMtime(a), before)
+	}
+	// Modifying the backing file behind our back makes the stored
+	// timestamps stale
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, backing, coarse, 0); err != nil {
+		t.Fatal(err)
+	}
+	a, _ = fs.GetAttr("file", nil)
+	if !attrMtime(a).Equal(time.Unix(1000, 0)) {
+		t.Errorf("stale timestamp was used: mtime=%v", attrMtime(a))
+	}
+	// fstat after a write shows the nanosecond mtime even before the flush
+	// has stored it
+	f3, code := fs.Open("file", uint32(os.O_RDWR), nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f3.Write([]byte("baz"), 6); !code.Ok() {
+		t.Fatal(code)
+	}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, backing, coarse, 0); err != nil {
+		t.Fatal(err)
+	}
+	a = &fuse.Attr{}
+	if code = f3.GetAttr(a); !code.Ok() {
+		t.Fatal(code)
+	}
+	if pending := f3.(*File).hiresMtime; !attrMtime(a).Equal(pending) {
+		t.Errorf("fstat: want the pending mtime %v, got %v", pending, attrMtime(a))
+	}
+	f3.Release()
+}
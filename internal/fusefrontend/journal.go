@@ -0,0 +1,322 @@
+package fusefrontend
+
+// "-journal": doWrite overwrites ciphertext blocks in place. If the machine
+// crashes in the middle of that, a block can end up half old and half new,
+// and then fails authentication: the old data is lost together with the
+// new. With "-journal", every write that overwrites existing ciphertext is
+// first stored in a record in the root of CIPHERDIR:
+//
+//	.gocryptfs-journal/INO  <--- the last in-place write to inode INO
+//
+// The record is flushed to disk before the in-place write, and emptied
+// after the in-place write has been flushed. A record that is still there
+// on the next mount belongs to an interrupted write, and is written again.
+// This also happens on mounts without "-journal", so a left-over record
+// cannot hit a different file that got the inode number later, but not on
+// read-only mounts.
+// A record that was torn by the crash fails its checksum and is discarded,
+// the in-place write has not started in that case.
+//
+// Appends are not journaled. A torn append only damages the new data.
+//
+// A record looks like this, integers are little endian:
+//
+//	magic[8] ino[8] off[8] pathLen[4] dataLen[4] path data sha256[32]
+//
+// "path" is the path of the backing file relative to CIPHERDIR, and "ino" its
+// inode number. The record is only applied if both still match.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// JournalDirName is the name of the "-journal" directory in the root of
+	// CIPHERDIR. Like TrashDirName, it cannot clash with an encrypted name.
+	JournalDirName    = ".gocryptfs-journal"
+	journalMagic      = "GCJRNL01"
+	journalHeaderLen  = len(journalMagic) + 8 + 8 + 4 + 4
+	journalDirPerms   = 0700
+	journalRecordPerm = 0600
+)
+
+// errJournalCrash is returned by journal.write when journalCrashAt
+// simulates a crash
+var errJournalCrash = errors.New("simulated crash")
+
+// journalCrashAt is set by tests to simulate a crash in the middle of
+// a journaled write. "record" stops after writing half of the record,
+// "target" stops after writing half of the data in place.
+var journalCrashAt string
+
+// journal is the state of "-journal"
+type journal struct {
+	// dirfd is the journal directory, opened for reading so it can be
+	// fsync'ed
+	dirfd int
+	// cipherdir is CIPHERDIR with all symlinks resolved, as it appears in
+	// /proc/self/fd
+	cipherdir string
+}
+
+// isJournalName returns true if "name" in the directory "dirName" is the
+// journal directory and must be hidden. Like the trash directory, it is
+// hidden even without "-journal" if names are encrypted.
+func (fs *FS) isJournalName(dirName string, name string) bool {
+	return dirName == "" && name == JournalDirName && (fs.args.Journal || !fs.args.PlaintextNames)
+}
+
+// openJournal creates the journal directory if it does not exist yet,
+// replays the records of interrupted writes, and returns the journal.
+func openJournal(cipherdir string) (*journal, error) {
+	realCipherdir, err := filepath.EvalSymlinks(cipherdir)
+	if err != nil {
+		return nil, err
+	}
+	realCipherdir, err = filepath.Abs(realCipherdir)
+	if err != nil {
+		return nil, err
+	}
+	rootfd, err := syscallcompat.OpenDirNofollow(realCipherdir, "")
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(rootfd)
+	err = syscallcompat.Mkdirat(rootfd, JournalDirName, journalDirPerms)
+	if err != nil && err != syscall.EEXIST {
+		return nil, err
+	}
+	dirfd, err := syscallcompat.Openat(rootfd, JournalDirName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	j := &journal{dirfd: dirfd, cipherdir: realCipherdir}
+	if err = j.replay(); err != nil {
+		syscall.Close(dirfd)
+		return nil, err
+	}
+	return j, nil
+}
+
+// replayJournal replays the records left over in the journal directory of
+// "cipherdir", if there is one, for mounts without "-journal".
+func replayJournal(cipherdir string) {
+	if _, err := os.Lstat(filepath.Join(cipherdir, JournalDirName)); os.IsNotExist(err) {
+		return
+	}
+	j, err := openJournal(cipherdir)
+	if err != nil {
+		tlog.Warn.Printf("replaying the -journal records failed: %v", err)
+		return
+	}
+	syscall.Close(j.dirfd)
+}
+
+// warnJournalReadOnly warns if there are records left over in the journal
+// directory of "cipherdir". A read-only mount must not change CIPHERDIR, so
+// they are not replayed, and the blocks they cover may fail to decrypt.
+func warnJournalReadOnly(cipherdir string) {
+	entries, err := ioutil.ReadDir(filepath.Join(cipherdir, JournalDirName))
+	if err != nil || len(entries) == 0 {
+		return
+	}
+	tlog.Warn.Printf("-journal: %d records of interrupted writes are not replayed on a read-only mount. "+
+		"Mount read-write once to replay them.", len(entries))
+}
+
+// packJournalRecord serializes a record for writing "data" to offset "off"
+// of the file "path" with inode number "ino"
+func packJournalRecord(ino uint64, off int64, path string, data []byte) []byte {
+	rec := make([]byte, journalHeaderLen, journalHeaderLen+len(path)+len(data)+sha256.Size)
+	copy(rec, journalMagic)
+	p := len(journalMagic)
+	binary.LittleEndian.PutUint64(rec[p:], ino)
+	binary.LittleEndian.PutUint64(rec[p+8:], uint64(off))
+	binary.LittleEndian.PutUint32(rec[p+16:], uint32(len(path)))
+	binary.LittleEndian.PutUint32(rec[p+20:], uint32(len(data)))
+	rec = append(rec, path...)
+	rec = append(rec, data...)
+	sum := sha256.Sum256(rec)
+	return append(rec, sum[:]...)
+}
+
+// unpackJournalRecord parses a record. It returns an error if the record
+// is truncated or its checksum does not match.
+func unpackJournalRecord(rec []byte) (ino uint64, off int64, path string, data []byte, err error) {
+	if len(rec) < journalHeaderLen+sha256.Size || !bytes.HasPrefix(rec, []byte(journalMagic)) {
+		return 0, 0, "", nil, fmt.Errorf("bad header")
+	}
+	p := len(journalMagic)
+	ino = binary.LittleEndian.Uint64(rec[p:])
+	off = int64(binary.LittleEndian.Uint64(rec[p+8:]))
+	pathLen := int(binary.LittleEndian.Uint32(rec[p+16:]))
+	dataLen := int(binary.LittleEndian.Uint32(rec[p+20:]))
+	end := journalHeaderLen + pathLen + dataLen
+	if pathLen < 0 || dataLen < 0 || end < 0 || len(rec) < end+sha256.Size {
+		return 0, 0, "", nil, fmt.Errorf("truncated")
+	}
+	sum := sha256.Sum256(rec[:end])
+	if !bytes.Equal(sum[:], rec[end:end+sha256.Size]) {
+		return 0, 0, "", nil, fmt.Errorf("checksum mismatch")
+	}
+	path = string(rec[journalHeaderLen : journalHeaderLen+pathLen])
+	data = rec[journalHeaderLen+pathLen : end]
+	return ino, off, path, data, nil
+}
+
+// writeStep writes "buf" to "f" at "off". If journalCrashAt is "step", it
+// writes only half of "buf" and returns errJournalCrash.
+func writeStep(step string, f *os.File, buf []byte, off int64) error {
+	if journalCrashAt == step {
+		f.WriteAt(buf[:len(buf)/2], off)
+		return errJournalCrash
+	}
+	_, err := f.WriteAt(buf, off)
+	return err
+}
+
+// write writes "ciphertext" to offset "off" of "target". If it overwrites
+// existing data, the write goes through the journal.
+// The caller holds the ContentLock of "target", so there is only one write
+// per inode in flight.
+func (j *journal) write(target *os.File, ciphertext []byte, off int64) error {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(target.Fd()), &st); err != nil {
+		return err
+	}
+	// Appends cannot destroy old data, and an unlinked file is gone after a
+	// crash anyway
+	if off >= st.Size || st.Nlink == 0 {
+		_, err := target.WriteAt(ciphertext, off)
+		return err
+	}
+	path, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", target.Fd()))
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(path, j.cipherdir+"/") {
+		return fmt.Errorf("journal: %q is not in %q", path, j.cipherdir)
+	}
+	path = path[len(j.cipherdir)+1:]
+	name := strconv.FormatUint(st.Ino, 10)
+	created := true
+	fd, err := syscallcompat.Openat(j.dirfd, name, syscall.O_RDWR|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, journalRecordPerm)
+	if err == syscall.EEXIST {
+		created = false
+		fd, err = syscallcompat.Openat(j.dirfd, name, syscall.O_RDWR|syscall.O_NOFOLLOW, 0)
+	}
+	if err != nil {
+		return err
+	}
+	record := os.NewFile(uintptr(fd), name)
+	defer record.Close()
+	// 1) The record must be on disk before we touch the file
+	err = writeStep("record", record, packJournalRecord(st.Ino, off, path, ciphertext), 0)
+	if err != nil {
+		return err
+	}
+	if err = syscall.Fsync(fd); err != nil {
+		return err
+	}
+	if created {
+		if err = syscall.Fsync(j.dirfd); err != nil {
+			return err
+		}
+	}
+	// 2) The in-place write
+	err = writeStep("target", target, ciphertext, off)
+	if err == nil {
+		err = syscall.Fsync(int(target.Fd()))
+	}
+	if err == errJournalCrash {
+		return err
+	} else if err != nil {
+		// We keep running, so the file may be deleted and its inode number
+		// reused before the next mount. Drop the record rather than risk
+		// replaying it to the wrong file.
+		syscall.Ftruncate(fd, 0)
+		return err
+	}
+	// 3) The record is obsolete now. It must not be replayed over later
+	// writes after a crash, so emptying it must be on disk, too.
+	if err = syscall.Ftruncate(fd, 0); err != nil {
+		return err
+	}
+	return syscall.Fsync(fd)
+}
+
+// replay writes the records that are left over from interrupted writes
+// again, and removes all records.
+func (j *journal) replay() error {
+	dir := filepath.Join(j.cipherdir, JournalDirName)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Size() > 0 {
+			j.replayRecord(filepath.Join(dir, e.Name()))
+		}
+		if err = syscallcompat.Unlinkat(j.dirfd, e.Name(), 0); err != nil {
+			return err
+		}
+	}
+	return syscall.Fsync(j.dirfd)
+}
+
+// replayRecord applies the record in the file "recPath". Errors are only
+// logged, as there is nothing better we can do with the record.
+func (j *journal) replayRecord(recPath string) {
+	rec, err := ioutil.ReadFile(recPath)
+	if err != nil {
+		tlog.Warn.Printf("-journal: reading %q failed: %v", recPath, err)
+		return
+	}
+	ino, off, path, data, err := unpackJournalRecord(rec)
+	if err != nil {
+		// The crash happened while the record was written, before the
+		// in-place write
+		tlog.Info.Printf("-journal: discarding incomplete record %q: %v", recPath, err)
+		return
+	}
+	dir, name := filepath.Split(path)
+	dirfd, err := syscallcompat.OpenDirNofollow(j.cipherdir, strings.TrimSuffix(dir, "/"))
+	if err != nil {
+		tlog.Warn.Printf("-journal: cannot replay write to %q: %v", path, err)
+		return
+	}
+	defer syscall.Close(dirfd)
+	fd, err := syscallcompat.Openat(dirfd, name, syscall.O_WRONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		tlog.Warn.Printf("-journal: cannot replay write to %q: %v", path, err)
+		return
+	}
+	f := os.NewFile(uintptr(fd), path)
+	defer f.Close()
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil || st.Ino != ino {
+		tlog.Warn.Printf("-journal: cannot replay write to %q: file has been replaced", path)
+		return
+	}
+	if _, err = f.WriteAt(data, off); err == nil {
+		err = syscall.Fsync(fd)
+	}
+	if err != nil {
+		tlog.Warn.Printf("-journal: replaying write to %q failed: %v", path, err)
+		return
+	}
+	tlog.Info.Printf("-journal: replayed interrupted write of %d bytes to %q", len(data), path)
+}
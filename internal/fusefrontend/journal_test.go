@@ -0,0 +1,177 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// crashWrite overwrites "data" at "off" in "path", with journalCrashAt set
+// to "step". The write must fail.
+func crashWrite(t *testing.T, fs *FS, path string, data []byte, off int64, step string) {
+	f, code := fs.Open(path, uint32(os.O_RDWR), nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	journalCrashAt = step
+	defer func() { journalCrashAt = "" }()
+	if _, code = f.Write(data, off); code.Ok() {
+		t.Fatalf("the write should have crashed at %q", step)
+	}
+}
+
+// journalRecords returns the sizes of the records in the journal directory
+func journalRecords(t *testing.T, cipherdir string) []int64 {
+	entries, err := ioutil.ReadDir(filepath.Join(cipherdir, JournalDirName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int64
+	for _, e := range entries {
+		sizes = append(sizes, e.Size())
+	}
+	return sizes
+}
+
+// A crash in the middle of the in-place write destroys the block. The next
+// mount writes it again from the journal.
+func TestJournalReplay(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, Journal: true})
+	content := bytes.Repeat([]byte("a"), 3*4096)
+	writeTestFile(t, fs, "file", content)
+	// Appends are not journaled
+	if r := journalRecords(t, cipherdir); len(r) != 0 {
+		t.Fatalf("appends should not create records: %v", r)
+	}
+	// A complete overwrite leaves an empty record
+	f, code := fs.Open("file", uint32(os.O_RDWR), nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	copy(content[10:], "bbb")
+	if _, code = f.Write([]byte("bbb"), 10); !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	if r := journalRecords(t, cipherdir); len(r) != 1 || r[0] != 0 {
+		t.Fatalf("want one empty record, got %v", r)
+	}
+
+	newData := bytes.Repeat([]byte("c"), 100)
+	crashWrite(t, fs, "file", newData, 4096+10, "target")
+	copy(content[4096+10:], newData)
+	// Without the journal, the second block is lost
+	journalDir := filepath.Join(cipherdir, JournalDirName)
+	if err := os.Rename(journalDir, journalDir+".bak"); err != nil {
+		t.Fatal(err)
+	}
+	f, code = newTestFS(Args{Cipherdir: cipherdir}).Open("file", uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	buf := make([]byte, 4096)
+	if _, code = f.Read(buf, 4096); code != fuse.EIO {
+		t.Errorf("the torn block should fail to read, got %v", code)
+	}
+	f.Release()
+	if err := os.Rename(journalDir+".bak", journalDir); err != nil {
+		t.Fatal(err)
+	}
+
+	fs = newTestFS(Args{Cipherdir: cipherdir, Journal: true})
+	if got := readTestFile(t, fs, "file"); !bytes.Equal(got, content) {
+		t.Errorf("content is wrong after replay")
+	}
+	if r := journalRecords(t, cipherdir); len(r) != 0 {
+		t.Errorf("replay should remove all records, got %v", r)
+	}
+	entries, code := fs.OpenDir("", nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	for _, e := range entries {
+		if e.Name == JournalDirName {
+			t.Errorf("%s should be hidden", JournalDirName)
+		}
+	}
+}
+
+// A crash while writing the record happens before the in-place write. The
+// torn record is discarded, and the file keeps its old content.
+func TestJournalTornRecord(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, Journal: true})
+	content := bytes.Repeat([]byte("a"), 2*4096)
+	writeTestFile(t, fs, "file", content)
+	crashWrite(t, fs, "file", []byte("bbb"), 4096, "record")
+	if r := journalRecords(t, cipherdir); len(r) != 1 || r[0] == 0 {
+		t.Fatalf("want one torn record, got %v", r)
+	}
+	fs = newTestFS(Args{Cipherdir: cipherdir, Journal: true})
+	if got := readTestFile(t, fs, "file"); !bytes.Equal(got, content) {
+		t.Errorf("old content should be unchanged")
+	}
+	if r := journalRecords(t, cipherdir); len(r) != 0 {
+		t.Errorf("the torn record should be removed, got %v", r)
+	}
+}
+
+// A mount without -journal replays the records, too
+func TestJournalReplayWithoutFlag(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, Journal: true})
+	content := bytes.Repeat([]byte("a"), 4096)
+	writeTestFile(t, fs, "file", content)
+	crashWrite(t, fs, "file", []byte("bbb"), 0, "target")
+	copy(content, "bbb")
+	fs = newTestFS(Args{Cipherdir: cipherdir})
+	if got := readTestFile(t, fs, "file"); !bytes.Equal(got, content) {
+		t.Errorf("content is wrong after replay")
+	}
+	if r := journalRecords(t, cipherdir); len(r) != 0 {
+		t.Errorf("replay should remove all records, got %v", r)
+	}
+}
+
+// A read-only mount does not replay the records, it must not change CIPHERDIR
+func TestJournalReadOnly(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, Journal: true})
+	writeTestFile(t, fs, "file", bytes.Repeat([]byte("a"), 4096))
+	crashWrite(t, fs, "file", []byte("bbb"), 0, "target")
+	for _, journal := range []bool{false, true} {
+		newTestFS(Args{Cipherdir: cipherdir, ReadOnly: true, Journal: journal})
+		if r := journalRecords(t, cipherdir); len(r) != 1 {
+			t.Errorf("Journal=%v: the record should be kept, got %v", journal, r)
+		}
+	}
+}
+
+// A record is not applied to a file that has replaced the original
+func TestJournalReplaced(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, Journal: true})
+	writeTestFile(t, fs, "file", bytes.Repeat([]byte("a"), 4096))
+	crashWrite(t, fs, "file", []byte("bbb"), 0, "target")
+	content := bytes.Repeat([]byte("d"), 8192)
+	writeTestFile(t, fs, "file2", content)
+	// Replace the backing file behind the back of gocryptfs, like a restore
+	// from backup after the crash would
+	cFile, _ := fs.EncryptPath("file")
+	cFile2, _ := fs.EncryptPath("file2")
+	if err := os.Rename(filepath.Join(cipherdir, cFile2), filepath.Join(cipherdir, cFile)); err != nil {
+		t.Fatal(err)
+	}
+	fs = newTestFS(Args{Cipherdir: cipherdir, Journal: true})
+	if got := readTestFile(t, fs, "file"); !bytes.Equal(got, content) {
+		t.Errorf("the record was applied to the wrong file")
+	}
+}
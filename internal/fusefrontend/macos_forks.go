@@ -0,0 +1,424 @@
+package fusefrontend
+
+// "-macos-forks": store the AppleDouble file "._name", that macOS creates to
+// hold the resource fork and Finder info of "name" on filesystems without
+// native xattr support, in an encrypted xattr of "name" instead of a separate
+// ciphertext file. This halves the number of files in CIPHERDIR for typical
+// macOS usage and keeps the fork together with its file.
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/inomap"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// forkPrefix is the name prefix of AppleDouble files
+	forkPrefix = "._"
+	// forkXattr is the plaintext name of the xattr that stores the content
+	// of the AppleDouble file. It is in the "user" namespace, so it stays
+	// accessible as a normal xattr when mounted without "-macos-forks".
+	forkXattr = "user.gocryptfs.appledouble"
+	// forkInoTag separates the inode numbers of virtual AppleDouble files
+	// from those of the backing files
+	forkInoTag = 1
+	// forkMaxSize is the largest virtual AppleDouble file. The content is
+	// kept in memory while the file is open, so a write at a large offset
+	// must not make us allocate that much. Real AppleDouble files are far
+	// smaller.
+	forkMaxSize = 16 * 1024 * 1024
+)
+
+// forkMainPath returns the path of the file that "relPath" is the AppleDouble
+// file of, or "" if "relPath" is not an AppleDouble name.
+func forkMainPath(relPath string) string {
+	dir, name := filepath.Split(relPath)
+	if len(name) <= len(forkPrefix) || !strings.HasPrefix(name, forkPrefix) {
+		return ""
+	}
+	return dir + name[len(forkPrefix):]
+}
+
+// forkTooLarge returns true if storing an xattr failed because the backing
+// filesystem cannot hold it, as opposed to a permission problem.
+func forkTooLarge(status fuse.Status) bool {
+	switch syscall.Errno(status) {
+	case syscall.E2BIG, syscall.ENOSPC, syscall.ERANGE, syscall.ENOTSUP:
+		return true
+	}
+	return false
+}
+
+// canHoldFork returns true if the backing file of "mainPath" exists and can
+// carry the fork xattr. Symlinks cannot have "user" xattrs on Linux.
+func (fs *FS) canHoldFork(mainPath string) bool {
+	dirfd, cName, err := fs.openBackingDir(mainPath)
+	if err != nil {
+		return false
+	}
+	defer syscall.Close(dirfd)
+	var st unix.Stat_t
+	err = syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return false
+	}
+	t := st.Mode & syscall.S_IFMT
+	return t == syscall.S_IFREG || t == syscall.S_IFDIR
+}
+
+// isVirtualFork returns true if "relPath" is an AppleDouble file that is
+// stored in the xattr of its main file. A backing file with the same name
+// takes precedence.
+func (fs *FS) isVirtualFork(relPath string) bool {
+	if !fs.args.MacOSForks || forkMainPath(relPath) == "" || fs.backingExists(relPath) {
+		return false
+	}
+	_, status := fs.getXAttr(forkMainPath(relPath), fs.forkCAttr, nil)
+	return status.Ok()
+}
+
+// loadFork returns the decrypted content of the virtual AppleDouble file
+// "relPath" and the path of its main file. The caller must have checked that
+// there is no backing file called "relPath". Returns ENOENT if "relPath" is
+// not an AppleDouble name or its main file has no fork.
+func (fs *FS) loadFork(relPath string) (mainPath string, data []byte, status fuse.Status) {
+	mainPath = forkMainPath(relPath)
+	if !fs.args.MacOSForks || mainPath == "" {
+		return "", nil, fuse.ENOENT
+	}
+	cData, status := fs.getXAttr(mainPath, fs.forkCAttr, nil)
+	if !status.Ok() {
+		return "", nil, fuse.ENOENT
+	}
+	data, err := fs.decryptXattrValue(cData)
+	if err != nil {
+		tlog.Warn.Printf("loadFork %q: corrupt fork xattr: %v", relPath, err)
+		return "", nil, fuse.EIO
+	}
+	return mainPath, data, fuse.OK
+}
+
+// storeFork stores "data" as the content of the AppleDouble file "relPath".
+// If the xattr of "mainPath" cannot hold it, or "spilled" says that this has
+// happened before, it is written to a backing file called "relPath" instead.
+// Returns the new value of "spilled".
+func (fs *FS) storeFork(relPath string, mainPath string, data []byte, spilled bool) (bool, fuse.Status) {
+	if !spilled {
+		status := fs.setXAttr(mainPath, fs.forkCAttr, fs.encryptXattrValue(data), 0, nil)
+		if status.Ok() || !forkTooLarge(status) {
+			return false, status
+		}
+		tlog.Debug.Printf("storeFork %q: %d bytes do not fit into an xattr (%v), using a file",
+			relPath, len(data), status)
+	}
+	status := fs.writeForkFile(relPath, mainPath, data)
+	if !status.Ok() {
+		return spilled, status
+	}
+	if !spilled {
+		// The backing file shadows the xattr from now on
+		fs.removeXAttr(mainPath, fs.forkCAttr, nil)
+	}
+	return true, fuse.OK
+}
+
+// writeForkFile creates or overwrites the backing file of the AppleDouble file
+// "relPath" with "data". The permissions are taken from "mainPath".
+func (fs *FS) writeForkFile(relPath string, mainPath string, data []byte) fuse.Status {
+	var mode uint32 = 0600
+	if a, status := fs.GetAttr(mainPath, nil); status.Ok() {
+		mode = a.Mode & 0666
+	}
+	f, status := fs.create(relPath, syscall.O_WRONLY, mode, nil)
+	if status == fuse.Status(syscall.EEXIST) {
+		f, status = fs.Open(relPath, syscall.O_WRONLY|syscall.O_TRUNC, nil)
+	}
+	if !status.Ok() {
+		return status
+	}
+	defer f.Release()
+	if len(data) > 0 {
+		if _, status = f.Write(data, 0); !status.Ok() {
+			return status
+		}
+	}
+	return f.Flush()
+}
+
+// forkAttr returns the attributes of a virtual AppleDouble file of "size"
+// bytes. Owner and timestamps come from the main file.
+func (fs *FS) forkAttr(mainPath string, size uint64) (*fuse.Attr, fuse.Status) {
+	mainAttr, status := fs.GetAttr(mainPath, nil)
+	if !status.Ok() {
+		return nil, status
+	}
+	a := *mainAttr
+	a.Ino = fs.inoMap.Translate(inomap.NewQIno(0, forkInoTag, mainAttr.Ino))
+	a.Mode = syscall.S_IFREG | mainAttr.Mode&0666
+	a.Nlink = 1
+	a.Size = size
+	a.Blocks = (size + 511) / 512
+	return &a, fuse.OK
+}
+
+// getAttrFork is called by GetAttr when there is no backing file for
+// "relPath".
+func (fs *FS) getAttrFork(relPath string) (*fuse.Attr, fuse.Status) {
+	mainPath, data, status := fs.loadFork(relPath)
+	if !status.Ok() {
+		return nil, status
+	}
+	return fs.forkAttr(mainPath, uint64(len(data)))
+}
+
+// openFork is called by Open when there is no backing file for "relPath".
+func (fs *FS) openFork(relPath string, flags uint32) (nodefs.File, fuse.Status) {
+	mainPath, data, status := fs.loadFork(relPath)
+	if !status.Ok() {
+		return nil, status
+	}
+	f := fs.newForkFile(relPath, mainPath, data)
+	if flags&syscall.O_TRUNC != 0 {
+		f.data = nil
+		f.dirty = true
+	}
+	return f, fuse.OK
+}
+
+// createFork is called by Create. Returns ENOENT if "relPath" should be
+// created as a normal file, because it is not an AppleDouble name, its main
+// file does not exist, or the main file cannot carry xattrs.
+func (fs *FS) createFork(relPath string) (nodefs.File, fuse.Status) {
+	mainPath := forkMainPath(relPath)
+	if mainPath == "" || !fs.canHoldFork(mainPath) {
+		return nil, fuse.ENOENT
+	}
+	// Store an empty fork right away so the new file can be looked up
+	status := fs.setXAttr(mainPath, fs.forkCAttr, fs.encryptXattrValue(nil), 0, nil)
+	if forkTooLarge(status) {
+		return nil, fuse.ENOENT
+	} else if !status.Ok() {
+		return nil, status
+	}
+	return fs.newForkFile(relPath, mainPath, nil), fuse.OK
+}
+
+// unlinkFork deletes the virtual AppleDouble file "relPath".
+func (fs *FS) unlinkFork(relPath string) fuse.Status {
+	return fs.removeXAttr(forkMainPath(relPath), fs.forkCAttr, nil)
+}
+
+// renameFork moves the virtual AppleDouble file "oldPath" to "newPath". If
+// "newPath" is an AppleDouble name as well, the fork moves to the xattr of
+// its main file, otherwise it becomes a backing file.
+func (fs *FS) renameFork(oldPath string, newPath string) fuse.Status {
+	if oldPath == newPath {
+		return fuse.OK
+	}
+	oldMain, data, status := fs.loadFork(oldPath)
+	if !status.Ok() {
+		return status
+	}
+	newMain := forkMainPath(newPath)
+	if newMain != "" && fs.canHoldFork(newMain) && !fs.backingExists(newPath) {
+		_, status = fs.storeFork(newPath, newMain, data, false)
+	} else {
+		status = fs.writeForkFile(newPath, oldMain, data)
+	}
+	if !status.Ok() {
+		return status
+	}
+	return fs.unlinkFork(oldPath)
+}
+
+// dropShadowedFork removes the fork xattr that belongs to "relPath" after a
+// backing file has been moved there. The virtual file has been replaced.
+func (fs *FS) dropShadowedFork(relPath string) {
+	if mainPath := forkMainPath(relPath); mainPath != "" {
+		fs.removeXAttr(mainPath, fs.forkCAttr, nil)
+	}
+}
+
+// backingExists returns true if there is a backing entry for "relPath", or
+// if we cannot tell.
+func (fs *FS) backingExists(relPath string) bool {
+	dirfd, cName, err := fs.openBackingDir(relPath)
+	if err != nil {
+		return err != syscall.ENOENT
+	}
+	defer syscall.Close(dirfd)
+	var st unix.Stat_t
+	err = syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	return err != syscall.ENOENT
+}
+
+// appendForks adds the virtual AppleDouble files of the entries in the
+// directory "dirName" to the listing, so that copying the tree keeps them.
+func (fs *FS) appendForks(dirName string, entries []fuse.DirEntry) []fuse.DirEntry {
+	names := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		names[e.Name] = true
+	}
+	for _, e := range entries {
+		t := e.Mode & syscall.S_IFMT
+		if t != syscall.S_IFREG && t != syscall.S_IFDIR {
+			continue
+		}
+		forkName := forkPrefix + e.Name
+		if names[forkName] {
+			continue
+		}
+		_, status := fs.getXAttr(filepath.Join(dirName, e.Name), fs.forkCAttr, nil)
+		if !status.Ok() {
+			continue
+		}
+		entries = append(entries, fuse.DirEntry{Name: forkName, Mode: syscall.S_IFREG})
+	}
+	return entries
+}
+
+// forkFile is an open virtual AppleDouble file. The content is kept in memory
+// and stored in the xattr of the main file on Flush.
+type forkFile struct {
+	nodefs.File
+	fs *FS
+	// relPath is the path of the AppleDouble file, mainPath the path of the
+	// file it belongs to
+	relPath  string
+	mainPath string
+	// mu protects the fields below
+	mu   sync.Mutex
+	data []byte
+	// dirty is set when "data" has changed since the last Flush
+	dirty bool
+	// spilled is set once "data" has been moved to a backing file because it
+	// is too large for an xattr
+	spilled bool
+}
+
+func (fs *FS) newForkFile(relPath string, mainPath string, data []byte) *forkFile {
+	return &forkFile{
+		File:     nodefs.NewDefaultFile(),
+		fs:       fs,
+		relPath:  relPath,
+		mainPath: mainPath,
+		data:     data,
+	}
+}
+
+func (f *forkFile) String() string {
+	return "forkFile(" + f.relPath + ")"
+}
+
+// Read - FUSE call
+func (f *forkFile) Read(buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off >= int64(len(f.data)) {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	n := copy(buf, f.data[off:])
+	return fuse.ReadResultData(buf[:n]), fuse.OK
+}
+
+// Write - FUSE call
+func (f *forkFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	if off < 0 || off > forkMaxSize || int64(len(data)) > forkMaxSize-off {
+		return 0, fuse.Status(syscall.EFBIG)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := int(off) + len(data)
+	if end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+	copy(f.data[off:], data)
+	f.dirty = true
+	return uint32(len(data)), fuse.OK
+}
+
+// Truncate - FUSE call
+func (f *forkFile) Truncate(size uint64) fuse.Status {
+	if size > forkMaxSize {
+		return fuse.Status(syscall.EFBIG)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if size <= uint64(len(f.data)) {
+		f.data = f.data[:size]
+	} else {
+		f.data = append(f.data, make([]byte, size-uint64(len(f.data)))...)
+	}
+	f.dirty = true
+	return fuse.OK
+}
+
+// GetAttr - FUSE call
+func (f *forkFile) GetAttr(out *fuse.Attr) fuse.Status {
+	f.mu.Lock()
+	size := uint64(len(f.data))
+	f.mu.Unlock()
+	a, status := f.fs.forkAttr(f.mainPath, size)
+	if !status.Ok() {
+		return status
+	}
+	*out = *a
+	return fuse.OK
+}
+
+// Flush - FUSE call. Stores the content if it has changed.
+func (f *forkFile) Flush() fuse.Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.dirty {
+		return fuse.OK
+	}
+	spilled, status := f.fs.storeFork(f.relPath, f.mainPath, f.data, f.spilled)
+	f.spilled = spilled
+	if status.Ok() {
+		f.dirty = false
+	}
+	return status
+}
+
+// Fsync - FUSE call
+func (f *forkFile) Fsync(flags int) fuse.Status {
+	return f.Flush()
+}
+
+// Release - FUSE call. FS.Truncate releases without flushing, so we store
+// what is left here.
+func (f *forkFile) Release() {
+	if status := f.Flush(); !status.Ok() {
+		tlog.Warn.Printf("forkFile %q: Release: storing fork failed: %v", f.relPath, status)
+	}
+}
+
+// Utimens, Chmod and Chown are no-ops: the metadata of the virtual file comes
+// from the main file.
+
+// Utimens - FUSE call
+func (f *forkFile) Utimens(a *time.Time, m *time.Time) fuse.Status {
+	return fuse.OK
+}
+
+// Chmod - FUSE call
+func (f *forkFile) Chmod(perms uint32) fuse.Status {
+	return fuse.OK
+}
+
+// Chown - FUSE call
+func (f *forkFile) Chown(uid uint32, gid uint32) fuse.Status {
+	return fuse.OK
+}
@@ -0,0 +1,120 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+func TestMacOSForks(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	if err := unix.Setxattr(cipherdir, "user.probe", []byte("x"), 0); err != nil {
+		t.Skipf("backing filesystem does not support xattrs: %v", err)
+	}
+	fs := newTestFS(Args{Cipherdir: cipherdir, LongNames: true, MacOSForks: true})
+	writeTestFile(t, fs, "file", []byte("main"))
+	writeTestFile(t, fs, "._file", []byte("fork"))
+	// The fork must not have created a second backing file
+	backingFile(t, cipherdir)
+	entries, err := ioutil.ReadDir(cipherdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// gocryptfs.conf, gocryptfs.diriv, file
+	if len(entries) != 3 {
+		t.Errorf("want 3 backing entries, got %d", len(entries))
+	}
+	a, code := fs.GetAttr("._file", nil)
+	if !code.Ok() || !a.IsRegular() || a.Size != 4 {
+		t.Errorf("GetAttr: want regular file of size 4, got %v, %v", a, code)
+	}
+	if got := readTestFile(t, fs, "._file"); string(got) != "fork" {
+		t.Errorf("want %q, got %q", "fork", got)
+	}
+	plain, code := fs.OpenDir("", nil)
+	if !code.Ok() || len(plain) != 2 {
+		t.Errorf("OpenDir: want [file ._file], got %v, %v", plain, code)
+	}
+	names, _ := fs.ListXAttr("file", nil)
+	if len(names) != 0 {
+		t.Errorf("fork xattr should be hidden, got %v", names)
+	}
+	// Without the option, the fork is a normal xattr
+	fs2 := newTestFS(Args{Cipherdir: cipherdir, LongNames: true})
+	if _, code = fs2.GetAttr("._file", nil); code != fuse.ENOENT {
+		t.Errorf("want ENOENT, got %v", code)
+	}
+	data, code := fs2.GetXAttr("file", forkXattr, nil)
+	if !code.Ok() || string(data) != "fork" {
+		t.Errorf("GetXAttr: want %q, got %q, %v", "fork", data, code)
+	}
+	// Renaming the main file takes the fork along
+	if code = fs.Rename("file", "file2", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = fs.GetAttr("._file", nil); code != fuse.ENOENT {
+		t.Errorf("want ENOENT, got %v", code)
+	}
+	if got := readTestFile(t, fs, "._file2"); string(got) != "fork" {
+		t.Errorf("want %q, got %q", "fork", got)
+	}
+	if code = fs.Unlink("._file2", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = fs.GetAttr("._file2", nil); code != fuse.ENOENT {
+		t.Errorf("want ENOENT after Unlink, got %v", code)
+	}
+	// A fork without main file is a normal file
+	writeTestFile(t, fs, "._orphan", []byte("x"))
+	if code = fs.Unlink("._orphan", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	// A fork that does not fit into an xattr becomes a normal file
+	big := bytes.Repeat([]byte("y"), 100000)
+	writeTestFile(t, fs, "._file2", big)
+	if got := readTestFile(t, fs, "._file2"); !bytes.Equal(got, big) {
+		t.Errorf("big fork: got %d bytes", len(got))
+	}
+	if _, code = fs.getXAttr("file2", fs.forkCAttr, nil); code.Ok() {
+		t.Error("big fork: xattr should have been removed")
+	}
+}
+
+// TestMacOSForksMaxSize checks that a virtual AppleDouble file cannot be
+// grown beyond forkMaxSize, as its content is kept in memory.
+func TestMacOSForksMaxSize(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	if err := unix.Setxattr(cipherdir, "user.probe", []byte("x"), 0); err != nil {
+		t.Skipf("backing filesystem does not support xattrs: %v", err)
+	}
+	fs := newTestFS(Args{Cipherdir: cipherdir, MacOSForks: true})
+	writeTestFile(t, fs, "file", []byte("main"))
+	f, code := fs.Create("._file", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	if _, ok := f.(*forkFile); !ok {
+		t.Fatalf("want a forkFile, got %T", f)
+	}
+	if _, code = f.Write([]byte("x"), 1<<40); code != fuse.Status(syscall.EFBIG) {
+		t.Errorf("Write at 1 TiB: want EFBIG, got %v", code)
+	}
+	if _, code = f.Write([]byte("x"), forkMaxSize); code != fuse.Status(syscall.EFBIG) {
+		t.Errorf("Write beyond forkMaxSize: want EFBIG, got %v", code)
+	}
+	if code = f.Truncate(1 << 40); code != fuse.Status(syscall.EFBIG) {
+		t.Errorf("Truncate to 1 TiB: want EFBIG, got %v", code)
+	}
+	if code = f.Truncate(1000); !code.Ok() {
+		t.Errorf("Truncate to 1000: %v", code)
+	}
+}
@@ -0,0 +1,30 @@
+package fusefrontend
+
+import (
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// openatNoatime works like syscallcompat.Openat, but adds O_NOATIME if
+// "-noatime" is on. Reading through the returned fd then does not update the
+// access time of the backing file, which saves writes on read-only workloads.
+//
+// The kernel only accepts O_NOATIME from the owner of the file (or with
+// CAP_FOWNER) and returns EPERM otherwise. We then open the file like
+// without "-noatime" and warn once.
+func (fs *FS) openatNoatime(dirfd int, cName string, flags int, mode uint32) (int, error) {
+	if !fs.args.NoAtime || syscallcompat.O_NOATIME == 0 {
+		return fs.openat(dirfd, cName, flags, mode)
+	}
+	fd, err := fs.openat(dirfd, cName, flags|syscallcompat.O_NOATIME, mode)
+	if err != syscall.EPERM {
+		return fd, err
+	}
+	fs.noatimeWarnOnce.Do(func() {
+		tlog.Warn.Printf("-noatime: O_NOATIME rejected for %q, probably because we do not own it. "+
+			"The access time of such files is updated on read.", cName)
+	})
+	return fs.openat(dirfd, cName, flags, mode)
+}
@@ -0,0 +1,45 @@
+// +build linux
+
+package fusefrontend
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+func backingAtime(t *testing.T, path string) time.Time {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	return time.Unix(st.Atim.Unix())
+}
+
+func TestNoAtime(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, NoAtime: true})
+	writeTestFile(t, fs, "file", []byte("content"))
+	path := backingFile(t, cipherdir)
+	// An atime older than the mtime is updated on read even with "relatime"
+	old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(path, old, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, fs, "file"); string(got) != "content" {
+		t.Fatalf("want %q, got %q", "content", got)
+	}
+	if atime := backingAtime(t, path); !atime.Equal(old) {
+		t.Errorf("backing atime changed to %v", atime)
+	}
+	// Without the option, the read should update the atime, unless the
+	// backing filesystem is mounted with "noatime"
+	fs2 := newTestFS(Args{Cipherdir: cipherdir})
+	readTestFile(t, fs2, "file")
+	if atime := backingAtime(t, path); atime.Equal(old) {
+		t.Logf("backing atime is not updated without -noatime either, is %q mounted noatime?", cipherdir)
+	}
+}
@@ -18,7 +18,34 @@ import (
 //
 // openBackingDir is secure against symlink races by using Openat and
 // ReadDirIVAt.
+//
+// openBackingDir must not be called with dirIVLock held, see readDirIV.
 func (fs *FS) openBackingDir(relPath string) (dirfd int, cName string, err error) {
+	return fs.openBackingDirFold(relPath, true)
+}
+
+// openBackingDirNew is like openBackingDir, but for the name that a create,
+// rename or link operation is going to create. With "-casefold", the last
+// path component is used as given, and EEXIST is returned if it matches
+// an existing entry case-insensitively. The exception is the rename source
+// "oldPath" ("" for all other operations), so "mv foo Foo" changes the case
+// of a name.
+func (fs *FS) openBackingDirNew(relPath string, oldPath string) (dirfd int, cName string, err error) {
+	if fs.args.CaseFold {
+		folded := fs.casefoldPath(relPath, true)
+		if folded != fs.casefoldPath(relPath, false) && (oldPath == "" || folded != fs.casefoldPath(oldPath, true)) {
+			return -1, "", syscall.EEXIST
+		}
+	}
+	return fs.openBackingDirFold(relPath, false)
+}
+
+// openBackingDirFold implements openBackingDir and openBackingDirNew.
+// "foldLast" tells if "-casefold" applies to the last path component.
+func (fs *FS) openBackingDirFold(relPath string, foldLast bool) (dirfd int, cName string, err error) {
+	if fs.args.CaseFold {
+		relPath = fs.casefoldPath(relPath, foldLast)
+	}
 	dirRelPath := nametransform.Dir(relPath)
 	// With PlaintextNames, we don't need to read DirIVs. Easy.
 	if fs.args.PlaintextNames {
@@ -38,7 +65,7 @@ func (fs *FS) openBackingDir(relPath string) (dirfd int, cName string, err error
 			return dirfd, ".", nil
 		}
 		name := filepath.Base(relPath)
-		cName, err = fs.nameTransform.EncryptAndHashName(name, iv)
+		cName, err = fs.encryptAndHashName(dirfd, name, iv)
 		if err != nil {
 			syscall.Close(dirfd)
 			return -1, "", err
@@ -46,7 +73,7 @@ func (fs *FS) openBackingDir(relPath string) (dirfd int, cName string, err error
 		return dirfd, cName, nil
 	}
 	// Open cipherdir (following symlinks)
-	dirfd, err = syscall.Open(fs.args.Cipherdir, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+	dirfd, err = fs.openCipherdir()
 	if err != nil {
 		return -1, "", err
 	}
@@ -57,12 +84,12 @@ func (fs *FS) openBackingDir(relPath string) (dirfd int, cName string, err error
 	// Walk the directory tree
 	parts := strings.Split(relPath, "/")
 	for i, name := range parts {
-		iv, err := nametransform.ReadDirIVAt(dirfd)
+		iv, err := fs.readDirIV(dirfd)
 		if err != nil {
 			syscall.Close(dirfd)
 			return -1, "", err
 		}
-		cName, err = fs.nameTransform.EncryptAndHashName(name, iv)
+		cName, err = fs.encryptAndHashName(dirfd, name, iv)
 		if err != nil {
 			syscall.Close(dirfd)
 			return -1, "", err
@@ -73,7 +100,7 @@ func (fs *FS) openBackingDir(relPath string) (dirfd int, cName string, err error
 			break
 		}
 		// Not the last part? Descend into next directory.
-		dirfd2, err := syscallcompat.Openat(dirfd, cName, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+		dirfd2, err := fs.openat(dirfd, cName, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
 		syscall.Close(dirfd)
 		if err != nil {
 			return -1, "", err
@@ -0,0 +1,56 @@
+package fusefrontend
+
+// "-paranoid-write": read back every block right after writing it, and check
+// that it decrypts to what we wanted to write. This catches storage and
+// crypto faults at write time instead of on a later read.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+)
+
+// paranoidWriteHook is called after the data has been written and before
+// it is read back. Used by the tests to simulate a storage fault.
+var paranoidWriteHook = func(fd int, off int64, length int) {}
+
+// verifyWrite reads back "ciphertext", which we have just written at "cOff",
+// and decrypts it. "plaintext" are the blocks that have been encrypted into
+// "ciphertext", starting at block "firstBlockNo". If "withHeader" is set,
+// "ciphertext" starts with the file header.
+func (f *File) verifyWrite(ciphertext []byte, cOff int64, withHeader bool, firstBlockNo uint64, plaintext [][]byte) error {
+	paranoidWriteHook(f.intFd(), cOff, len(ciphertext))
+	buf := make([]byte, len(ciphertext))
+	n, err := syscall.Pread(f.intFd(), buf, cOff)
+	if err != nil {
+		return err
+	}
+	if n != len(buf) {
+		return fmt.Errorf("short read: got %d of %d bytes", n, len(buf))
+	}
+	if !bytes.Equal(buf, ciphertext) {
+		return errors.New("the data on disk differs from the data written")
+	}
+	if withHeader {
+		h, err := contentenc.ParseHeader(buf[:contentenc.HeaderLen])
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(h.ID, f.fileTableEntry.ID) {
+			return errors.New("file ID mismatch in the header")
+		}
+		buf = buf[contentenc.HeaderLen:]
+	}
+	decrypted, err := f.contentEnc.DecryptBlocks(buf, firstBlockNo, f.fileTableEntry.ID)
+	defer f.contentEnc.PReqPool.Put(decrypted)
+	if err != nil {
+		return fmt.Errorf("decryption failed: %v", err)
+	}
+	if !bytes.Equal(decrypted, bytes.Join(plaintext, nil)) {
+		return errors.New("the data does not decrypt to the data written")
+	}
+	return nil
+}
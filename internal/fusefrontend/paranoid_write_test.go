@@ -0,0 +1,54 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestParanoidWrite checks that a write that does not make it to disk
+// intact is rejected with EIO.
+func TestParanoidWrite(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, ParanoidWrite: true})
+	writeTestFile(t, fs, "file", bytes.Repeat([]byte("a"), 10000))
+	f, code := fs.Open("file", uint32(os.O_WRONLY), nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	// Flip a bit in the last byte that has been written
+	paranoidWriteHook = func(fd int, off int64, length int) {
+		b := make([]byte, 1)
+		syscall.Pread(fd, b, off+int64(length)-1)
+		b[0] ^= 1
+		syscall.Pwrite(fd, b, off+int64(length)-1)
+	}
+	defer func() { paranoidWriteHook = func(int, int64, int) {} }()
+	if _, code = f.Write([]byte("b"), 5000); code != fuse.EIO {
+		t.Errorf("want EIO, got %v", code)
+	}
+	// A new file is not left with a header and a corrupt block
+	f2, code := fs.Create("file2", uint32(os.O_WRONLY), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f2.Release()
+	if _, code = f2.Write([]byte("b"), 0); code != fuse.EIO {
+		t.Errorf("new file: want EIO, got %v", code)
+	}
+	var a fuse.Attr
+	if code = f2.GetAttr(&a); !code.Ok() || a.Size != 0 {
+		t.Errorf("new file: want size 0, got %d (%v)", a.Size, code)
+	}
+	// Intact writes go through. Block #1 stays corrupt.
+	paranoidWriteHook = func(int, int64, int) {}
+	if n, code := f.Write([]byte("b"), 100); !code.Ok() || n != 1 {
+		t.Errorf("want 1 byte written, got %d (%v)", n, code)
+	}
+}
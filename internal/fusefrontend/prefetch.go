@@ -0,0 +1,116 @@
+package fusefrontend
+
+// Prefetch walks a subtree in the background, so that a job that traverses
+// it later does not pay for cold caches. Reading the directories goes through
+// OpenDir, which reads the directory and its DirIV, and decrypts all names.
+// This warms the caches of the backing filesystem (dentries, inodes, the
+// directory blocks and the DirIV files), which is where the latency of a cold
+// traversal comes from, especially on network storage. The dirCache of
+// gocryptfs only holds dirCacheSize entries and is not filled up by the walk.
+
+import (
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+var _ ctlsocksrv.PrefetchInterface = &FS{} // Verify that interface is implemented.
+
+// prefetchState is the progress of the last Prefetch walk
+type prefetchState struct {
+	sync.Mutex
+	// status is nil until the first walk is started
+	status *ctlsock.PrefetchStatus
+}
+
+// snapshot returns a copy of the status, or nil
+func (p *prefetchState) snapshot() *ctlsock.PrefetchStatus {
+	p.Lock()
+	defer p.Unlock()
+	if p.status == nil {
+		return nil
+	}
+	s := *p.status
+	return &s
+}
+
+// add updates the counters of the running walk
+func (p *prefetchState) add(dirs, entries, errors uint64) {
+	p.Lock()
+	p.status.Dirs += dirs
+	p.status.Entries += entries
+	p.status.Errors += errors
+	p.Unlock()
+}
+
+// Prefetch implements ctlsocksrv.PrefetchInterface. It starts walking the
+// directory "plainPath" and returns right away. With "stat", every entry is
+// stat()ed as well. Fails with EBUSY if a walk is running already, and with
+// ENOTDIR if "plainPath" is not a directory.
+func (fs *FS) Prefetch(plainPath string, stat bool) (*ctlsock.PrefetchStatus, error) {
+	a, code := fs.GetAttr(plainPath, nil)
+	if !code.Ok() {
+		return nil, syscall.Errno(code)
+	}
+	if !a.IsDir() {
+		return nil, syscall.ENOTDIR
+	}
+	p := &fs.prefetch
+	p.Lock()
+	if p.status != nil && p.status.Running {
+		p.Unlock()
+		return nil, syscall.EBUSY
+	}
+	p.status = &ctlsock.PrefetchStatus{
+		Path:    plainPath,
+		Running: true,
+		Started: time.Now(),
+	}
+	p.Unlock()
+	tlog.Info.Printf("Prefetch: walking %q", plainPath)
+	go func() {
+		fs.prefetchDir(plainPath, stat)
+		p.Lock()
+		p.status.Running = false
+		p.status.Finished = time.Now()
+		tlog.Info.Printf("Prefetch: done with %q: %d directories, %d entries, %d errors",
+			plainPath, p.status.Dirs, p.status.Entries, p.status.Errors)
+		p.Unlock()
+	}()
+	return p.snapshot(), nil
+}
+
+// PrefetchStatus implements ctlsocksrv.PrefetchInterface.
+func (fs *FS) PrefetchStatus() *ctlsock.PrefetchStatus {
+	return fs.prefetch.snapshot()
+}
+
+// prefetchDir reads directory "dir" and descends into its subdirectories.
+// Errors are counted and skipped.
+func (fs *FS) prefetchDir(dir string, stat bool) {
+	entries, code := fs.OpenDir(dir, nil)
+	if !code.Ok() {
+		tlog.Debug.Printf("Prefetch: cannot read %q: %v", dir, code)
+		fs.prefetch.add(0, 0, 1)
+		return
+	}
+	var errors uint64
+	if stat {
+		for _, e := range entries {
+			if _, code = fs.GetAttr(filepath.Join(dir, e.Name), nil); !code.Ok() {
+				errors++
+			}
+		}
+	}
+	fs.prefetch.add(1, uint64(len(entries)), errors)
+	for _, e := range entries {
+		if e.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			fs.prefetchDir(filepath.Join(dir, e.Name), stat)
+		}
+	}
+}
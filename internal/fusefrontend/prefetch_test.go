@@ -0,0 +1,48 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+func TestPrefetch(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	if fs.PrefetchStatus() != nil {
+		t.Error("PrefetchStatus should be nil before the first walk")
+	}
+	for _, d := range []string{"a", "a/b", "a/b/c", "d"} {
+		if code := fs.Mkdir(d, 0700, nil); !code.Ok() {
+			t.Fatal(code)
+		}
+	}
+	writeTestFile(t, fs, "a/b/file1", []byte("x"))
+	writeTestFile(t, fs, "a/b/c/file2", []byte("x"))
+	if _, err := fs.Prefetch("a/b/file1", false); err != syscall.ENOTDIR {
+		t.Errorf("want ENOTDIR, got %v", err)
+	}
+	if _, err := fs.Prefetch("missing", false); err != syscall.ENOENT {
+		t.Errorf("want ENOENT, got %v", err)
+	}
+	status, err := fs.Prefetch("a", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Path != "a" || status.Started.IsZero() {
+		t.Errorf("unexpected initial status %+v", status)
+	}
+	for i := 0; status.Running && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		status = fs.PrefetchStatus()
+	}
+	if status.Running || status.Finished.IsZero() {
+		t.Fatalf("walk has not finished: %+v", status)
+	}
+	// a: b; a/b: file1, c; a/b/c: file2
+	if status.Dirs != 3 || status.Entries != 4 || status.Errors != 0 {
+		t.Errorf("want 3 dirs, 4 entries, 0 errors, got %+v", status)
+	}
+}
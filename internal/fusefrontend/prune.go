@@ -0,0 +1,51 @@
+package fusefrontend
+
+import (
+	"path/filepath"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// PruneEmptyDirs removes all empty directories below the root directory,
+// deepest first, so that directories that only contain empty directories go
+// as well. Uses the same emptiness check as Rmdir, and skips directories
+// that cannot be removed. Deleted directories do not go to the "-trash".
+// Returns the number of removed directories.
+//
+// This implements "-prune-empty-on-unmount" and must only be called after
+// unmount, when nobody can create files concurrently.
+func (fs *FS) PruneEmptyDirs() (pruned int) {
+	pruned, _ = fs.pruneEmptyDirs("")
+	return pruned
+}
+
+// pruneEmptyDirs removes the empty directories below "dir". Returns how
+// many it has removed, and whether "dir" is empty afterwards.
+func (fs *FS) pruneEmptyDirs(dir string) (pruned int, empty bool) {
+	entries, code := fs.OpenDir(dir, nil)
+	if !code.Ok() {
+		tlog.Warn.Printf("PruneEmptyDirs: cannot read %q: %v", dir, code)
+		return 0, false
+	}
+	left := len(entries)
+	for _, e := range entries {
+		if e.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			continue
+		}
+		path := filepath.Join(dir, e.Name)
+		n, childEmpty := fs.pruneEmptyDirs(path)
+		pruned += n
+		if !childEmpty {
+			continue
+		}
+		if code = fs.rmdir(path, false); !code.Ok() {
+			tlog.Info.Printf("PruneEmptyDirs: skipping %q: %v", path, code)
+			continue
+		}
+		tlog.Debug.Printf("PruneEmptyDirs: removed %q", path)
+		pruned++
+		left--
+	}
+	return pruned, left == 0
+}
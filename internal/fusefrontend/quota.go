@@ -0,0 +1,226 @@
+package fusefrontend
+
+// "-quota": limit the plaintext bytes stored in the filesystem.
+//
+// The usage is the sum of the plaintext sizes of all regular files,
+// computed from the size of the backing files. It is established by a scan
+// of CIPHERDIR on mount and then kept up to date by the operations that
+// change the size of a backing file. Sparse files count with their full
+// size. Directories, symlinks and gocryptfs' own metadata files do not
+// count.
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// quotaScan walks CIPHERDIR and returns the plaintext usage. Hard-linked
+// files are counted once.
+func (fs *FS) quotaScan() (uint64, error) {
+	var used uint64
+	seen := make(map[[2]uint64]bool)
+	root := fs.args.Cipherdir
+	// The trailing slash makes Walk follow CIPHERDIR if it is a symlink,
+	// like openBackingDir does. Symlinks inside are not followed.
+	err := filepath.Walk(root+"/", func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if fs.isQuotaMetadata(relPath) {
+			return nil
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if st.Nlink > 1 {
+			id := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+			if seen[id] {
+				return nil
+			}
+			seen[id] = true
+		}
+		used += fs.contentEnc.CipherSizeToPlainSize(uint64(st.Size))
+		return nil
+	})
+	return used, err
+}
+
+// isQuotaMetadata returns true if the regular file at "relPath" in
+// CIPHERDIR is not user data, like gocryptfs.diriv.
+func (fs *FS) isQuotaMetadata(relPath string) bool {
+	dir, name := filepath.Split(relPath)
+	dir = strings.TrimSuffix(dir, "/")
+	if fs.isConfName(dir, name) {
+		return true
+	}
+	// .gocryptfs-trash/ID/gocryptfs.trashinfo
+	if name == trashInfoName && filepath.Dir(dir) == TrashDirName {
+		return true
+	}
+	// .gocryptfs-journal/INO
+	if dir == JournalDirName {
+		return true
+	}
+	if fs.args.PlaintextNames {
+		return false
+	}
+	// gocryptfs.longlinks/ID
+	if dir == LongLinkDirName {
+		return true
+	}
+	return name == fs.nameTransform.DirIVName() || nametransform.NameType(name) == nametransform.LongNameFilename
+}
+
+// quotaAdd changes the usage by "delta" bytes
+func (fs *FS) quotaAdd(delta int64) {
+	if fs.args.Quota == 0 || delta == 0 {
+		return
+	}
+	atomic.AddInt64(&fs.quotaUsed, delta)
+}
+
+// quotaCheck returns EDQUOT if growing the usage by "grow" bytes would
+// exceed the quota. Concurrent writes are not serialized, so the quota can
+// be exceeded by the size of the writes that are in flight.
+func (fs *FS) quotaCheck(grow uint64) fuse.Status {
+	if fs.args.Quota == 0 {
+		return fuse.OK
+	}
+	used := atomic.LoadInt64(&fs.quotaUsed)
+	if used < 0 {
+		used = 0
+	}
+	if uint64(used)+grow > fs.args.Quota {
+		return fuse.Status(syscall.EDQUOT)
+	}
+	return fuse.OK
+}
+
+// quotaExceeded returns EDQUOT if the quota is used up. Used by Create.
+func (fs *FS) quotaExceeded() fuse.Status {
+	if fs.args.Quota == 0 {
+		return fuse.OK
+	}
+	if atomic.LoadInt64(&fs.quotaUsed) >= int64(fs.args.Quota) {
+		return fuse.Status(syscall.EDQUOT)
+	}
+	return fuse.OK
+}
+
+// quotaSizeAt returns the plaintext size of the entry "cName" in "dirfd"
+// and its number of hard links. The size is zero for anything but regular
+// files.
+func (fs *FS) quotaSizeAt(dirfd int, cName string) (size int64, nlink uint64) {
+	if fs.args.Quota == 0 {
+		return 0, 0
+	}
+	var st unix.Stat_t
+	err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return 0, 0
+	}
+	return int64(fs.contentEnc.CipherSizeToPlainSize(uint64(st.Size))), uint64(st.Nlink)
+}
+
+// quotaFreedAt returns the plaintext bytes that are freed when the entry
+// "cName" in "dirfd" goes away. This is zero for anything but regular files
+// without further hard links.
+func (fs *FS) quotaFreedAt(dirfd int, cName string) int64 {
+	size, nlink := fs.quotaSizeAt(dirfd, cName)
+	if nlink != 1 {
+		return 0
+	}
+	return size
+}
+
+// quotaReplaced is quotaFreedAt for the target of a rename. Renaming a file
+// over another hard link of itself frees nothing.
+func (fs *FS) quotaReplaced(oldDirfd int, oldCName string, newDirfd int, newCName string) int64 {
+	if fs.args.Quota == 0 {
+		return 0
+	}
+	var st1, st2 unix.Stat_t
+	if syscallcompat.Fstatat(oldDirfd, oldCName, &st1, unix.AT_SYMLINK_NOFOLLOW) != nil ||
+		syscallcompat.Fstatat(newDirfd, newCName, &st2, unix.AT_SYMLINK_NOFOLLOW) != nil {
+		return 0
+	}
+	if st1.Dev == st2.Dev && st1.Ino == st2.Ino {
+		return 0
+	}
+	return fs.quotaFreedAt(newDirfd, newCName)
+}
+
+// quotaBegin returns the plaintext size of the backing file before an
+// operation that may change it. Pass the result to quotaEnd afterwards.
+// The caller must hold ContentLock exclusively.
+func (f *File) quotaBegin() uint64 {
+	if f.fs.args.Quota == 0 {
+		return 0
+	}
+	sz, _ := f.statPlainSize()
+	return sz
+}
+
+// quotaEnd adds the size change since quotaBegin to the usage. Files that
+// have been unlinked have been taken off the usage by Unlink already.
+func (f *File) quotaEnd(before uint64) {
+	if f.fs.args.Quota == 0 {
+		return
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(f.intFd(), &st); err != nil || st.Nlink == 0 {
+		return
+	}
+	after := f.contentEnc.CipherSizeToPlainSize(uint64(st.Size))
+	f.fs.quotaAdd(int64(after) - int64(before))
+}
+
+// quotaCheckGrow returns EDQUOT if growing the file to the plaintext size
+// "newSize" would exceed the quota. The caller must hold ContentLock
+// exclusively.
+func (f *File) quotaCheckGrow(newSize uint64) fuse.Status {
+	if f.fs.args.Quota == 0 {
+		return fuse.OK
+	}
+	// A dirty "-coalesce-writes" block is not on disk and not in the usage
+	// yet, so comparing with the size on disk accounts for it
+	oldSize, err := f.statPlainSize()
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	if newSize <= oldSize {
+		return fuse.OK
+	}
+	return f.fs.quotaCheck(newSize - oldSize)
+}
+
+// Quota implements ctlsocksrv.QuotaInterface. Returns nil if "-quota" is
+// not enabled.
+func (fs *FS) Quota() *ctlsock.QuotaStatus {
+	if fs.args.Quota == 0 {
+		return nil
+	}
+	used := atomic.LoadInt64(&fs.quotaUsed)
+	if used < 0 {
+		tlog.Warn.Printf("Quota: usage is negative (%d), accounting is off", used)
+		used = 0
+	}
+	return &ctlsock.QuotaStatus{Used: uint64(used), Limit: fs.args.Quota}
+}
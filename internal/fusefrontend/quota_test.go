@@ -0,0 +1,160 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// quotaUsed returns the usage of "fs" and checks that a fresh scan, like on
+// the next mount, agrees.
+func quotaUsed(t *testing.T, fs *FS) uint64 {
+	t.Helper()
+	used := fs.Quota().Used
+	scanned, err := fs.quotaScan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scanned != used {
+		t.Errorf("usage %d does not match scan result %d", used, scanned)
+	}
+	return used
+}
+
+// TestQuotaSymlinkedCipherdir checks that the usage is found when CIPHERDIR
+// is a symlink to the actual directory
+func TestQuotaSymlinkedCipherdir(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	writeTestFile(t, fs, "file", bytes.Repeat([]byte("x"), 6000))
+	link := cipherdir + ".link"
+	if err := os.Symlink(cipherdir, link); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(link)
+	fs = newTestFS(Args{Cipherdir: link, Quota: 10000})
+	if u := quotaUsed(t, fs); u != 6000 {
+		t.Errorf("want usage 6000, got %d", u)
+	}
+	if got := readTestFile(t, fs, "file"); len(got) != 6000 {
+		t.Errorf("want 6000 bytes, got %d", len(got))
+	}
+}
+
+func TestQuota(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, Quota: 10000})
+	if u := quotaUsed(t, fs); u != 0 {
+		t.Fatalf("empty filesystem uses %d bytes", u)
+	}
+	f, code := fs.Create("file", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	buf := bytes.Repeat([]byte("x"), 6000)
+	if _, code = f.Write(buf, 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	if u := quotaUsed(t, fs); u != 6000 {
+		t.Errorf("want 6000, got %d", u)
+	}
+	// Overwriting does not use more space
+	if _, code = f.Write(buf[:1000], 100); !code.Ok() {
+		t.Fatal(code)
+	}
+	if u := quotaUsed(t, fs); u != 6000 {
+		t.Errorf("want 6000, got %d", u)
+	}
+	// Exceeding the quota fails, and does not change anything
+	if _, code = f.Write(buf, 5000); code != fuse.Status(syscall.EDQUOT) {
+		t.Errorf("want EDQUOT, got %v", code)
+	}
+	if code = f.Truncate(20000); code != fuse.Status(syscall.EDQUOT) {
+		t.Errorf("want EDQUOT, got %v", code)
+	}
+	if u := quotaUsed(t, fs); u != 6000 {
+		t.Errorf("want 6000, got %d", u)
+	}
+	// Shrinking and growing
+	if code = f.Truncate(5000); !code.Ok() {
+		t.Fatal(code)
+	}
+	if u := quotaUsed(t, fs); u != 5000 {
+		t.Errorf("want 5000, got %d", u)
+	}
+	if code = f.Truncate(8192); !code.Ok() {
+		t.Fatal(code)
+	}
+	if u := quotaUsed(t, fs); u != 8192 {
+		t.Errorf("want 8192, got %d", u)
+	}
+	f.Release()
+	// Hard links do not count twice, and only the last one frees the space
+	if code = fs.Link("file", "link", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code = fs.Unlink("file", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if u := quotaUsed(t, fs); u != 8192 {
+		t.Errorf("want 8192, got %d", u)
+	}
+	// Opening with O_TRUNC
+	f, code = fs.Open("link", uint32(os.O_RDWR|os.O_TRUNC), nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write(buf[:3000], 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	if u := quotaUsed(t, fs); u != 3000 {
+		t.Errorf("want 3000, got %d", u)
+	}
+	// Renaming over a file frees it
+	f, code = fs.Create("file2", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Write(buf[:100], 0)
+	f.Release()
+	if code = fs.Rename("file2", "link", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if u := quotaUsed(t, fs); u != 100 {
+		t.Errorf("want 100, got %d", u)
+	}
+	if code = fs.Unlink("link", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if u := quotaUsed(t, fs); u != 0 {
+		t.Errorf("want 0, got %d", u)
+	}
+}
+
+// TestQuotaCreate checks that Create fails once the quota is used up, and
+// that the usage is picked up by the scan on mount.
+func TestQuotaCreate(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, Quota: 100})
+	f, code := fs.Create("file", uint32(os.O_RDWR), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write(make([]byte, 100), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+	if _, code = fs.Create("file2", uint32(os.O_RDWR), 0600, nil); code != fuse.Status(syscall.EDQUOT) {
+		t.Errorf("want EDQUOT, got %v", code)
+	}
+	fs = newTestFS(Args{Cipherdir: cipherdir, Quota: 1000})
+	if u := quotaUsed(t, fs); u != 100 {
+		t.Errorf("want 100 after remount, got %d", u)
+	}
+}
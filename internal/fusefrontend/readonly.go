@@ -0,0 +1,88 @@
+package fusefrontend
+
+// "-readonly-after": a timer is started at mount time. When it expires, all
+// operations that change the filesystem fail with EROFS, as if it had been
+// mounted with "-ro". The timer can be restarted via the control socket as
+// long as it has not expired. Once the filesystem is read-only, it stays
+// read-only until it is mounted again.
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// readOnlyTimer is the timer of "-readonly-after"
+type readOnlyTimer struct {
+	sync.Mutex
+	timer    *time.Timer
+	deadline time.Time
+}
+
+// startReadOnlyTimer makes the filesystem read-only after "d"
+func (fs *FS) startReadOnlyTimer(d time.Duration) {
+	t := &fs.readOnlyTimer
+	t.Lock()
+	defer t.Unlock()
+	t.deadline = time.Now().Add(d)
+	t.timer = time.AfterFunc(d, fs.setReadOnly)
+	tlog.Info.Printf("-readonly-after: filesystem becomes read-only at %s", t.deadline.Format(time.RFC3339))
+}
+
+// setReadOnly makes the filesystem read-only
+func (fs *FS) setReadOnly() {
+	if atomic.CompareAndSwapUint32(&fs.readOnly, 0, 1) {
+		tlog.Info.Printf("-readonly-after: filesystem is now read-only")
+	}
+}
+
+// isReadOnly returns true if the timer of "-readonly-after" has expired
+func (fs *FS) isReadOnly() bool {
+	return atomic.LoadUint32(&fs.readOnly) != 0
+}
+
+// checkWritable returns EROFS if the filesystem has become read-only.
+// Called at the start of every operation that changes the filesystem.
+func (fs *FS) checkWritable() fuse.Status {
+	if fs.isReadOnly() {
+		return fuse.Status(syscall.EROFS)
+	}
+	return fuse.OK
+}
+
+// errReadOnlyDisabled is returned by the ctlsock ReadOnlyAfter command
+// without "-readonly-after"
+var errReadOnlyDisabled = &os.PathError{Op: "readonly-after", Path: "mounted without -readonly-after", Err: syscall.ENOTSUP}
+
+var _ ctlsocksrv.ReadOnlyInterface = &FS{} // Verify that interface is implemented.
+
+// ReadOnlyAfter implements ctlsocksrv.ReadOnlyInterface. It restarts the
+// timer of "-readonly-after" so that it expires "d" from now, and returns
+// the new deadline.
+func (fs *FS) ReadOnlyAfter(d time.Duration) (time.Time, error) {
+	if fs.args.ReadOnlyAfter == 0 {
+		return time.Time{}, errReadOnlyDisabled
+	}
+	if d <= 0 {
+		return time.Time{}, syscall.EINVAL
+	}
+	t := &fs.readOnlyTimer
+	t.Lock()
+	defer t.Unlock()
+	// Stop fails if the timer has already fired. setReadOnly may still be
+	// running, so check the timer and not only the flag.
+	if !t.timer.Stop() || fs.isReadOnly() {
+		return time.Time{}, syscall.EROFS
+	}
+	t.deadline = time.Now().Add(d)
+	t.timer = time.AfterFunc(d, fs.setReadOnly)
+	tlog.Info.Printf("-readonly-after: timer restarted, filesystem becomes read-only at %s", t.deadline.Format(time.RFC3339))
+	return t.deadline, nil
+}
@@ -0,0 +1,82 @@
+package fusefrontend
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestReadOnlyAfter checks that writes fail with EROFS once the timer of
+// "-readonly-after" has expired, and that reads keep working.
+func TestReadOnlyAfter(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, ReadOnlyAfter: time.Hour})
+	f, code := fs.Create("foo", uint32(os.O_WRONLY), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code = f.Write([]byte("hello"), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	if fs.Status().ReadOnly {
+		t.Error("filesystem should not be read-only yet")
+	}
+	if _, err := fs.ReadOnlyAfter(0); err != syscall.EINVAL {
+		t.Errorf("want EINVAL, got %v", err)
+	}
+	if _, err := fs.ReadOnlyAfter(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; !fs.isReadOnly(); i++ {
+		if i > 500 {
+			t.Fatal("timer did not expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !fs.Status().ReadOnly {
+		t.Error("Status should report the filesystem as read-only")
+	}
+	erofs := fuse.Status(syscall.EROFS)
+	// Already open files cannot be written to either
+	if _, code = f.Write([]byte("world"), 5); code != erofs {
+		t.Errorf("Write: want EROFS, got %v", code)
+	}
+	f.Release()
+	if _, code = fs.Create("bar", uint32(os.O_WRONLY), 0600, nil); code != erofs {
+		t.Errorf("Create: want EROFS, got %v", code)
+	}
+	if _, code = fs.Open("foo", uint32(os.O_RDWR), nil); code != erofs {
+		t.Errorf("Open O_RDWR: want EROFS, got %v", code)
+	}
+	if code = fs.Mkdir("dir", 0700, nil); code != erofs {
+		t.Errorf("Mkdir: want EROFS, got %v", code)
+	}
+	if code = fs.Rename("foo", "bar", nil); code != erofs {
+		t.Errorf("Rename: want EROFS, got %v", code)
+	}
+	if code = fs.Unlink("foo", nil); code != erofs {
+		t.Errorf("Unlink: want EROFS, got %v", code)
+	}
+	f, code = fs.Open("foo", uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatalf("Open O_RDONLY: %v", code)
+	}
+	defer f.Release()
+	buf := make([]byte, 10)
+	res, code := f.Read(buf, 0)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if data, _ := res.Bytes(buf); string(data) != "hello" {
+		t.Errorf("Read returned %q", data)
+	}
+	// The timer cannot be restarted anymore
+	if _, err := fs.ReadOnlyAfter(time.Hour); err != syscall.EROFS {
+		t.Errorf("want EROFS, got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package fusefrontend
+
+// "-secure-delete": overwrite file content in the backing directory before
+// the space is given back to the filesystem
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// secureDeleteChunk is the size of the random data written at a time
+const secureDeleteChunk = 128 * 1024
+
+// overwriteFd overwrites the content of the file "fd" from offset "off" to
+// the end with random bytes and waits until they are on disk.
+func overwriteFd(fd int, off int64) error {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return err
+	}
+	for off < st.Size {
+		n := st.Size - off
+		if n > secureDeleteChunk {
+			n = secureDeleteChunk
+		}
+		written, err := syscall.Pwrite(fd, cryptocore.RandBytes(int(n)), off)
+		if err != nil {
+			return err
+		}
+		off += int64(written)
+	}
+	return syscall.Fsync(fd)
+}
+
+// secureDeleteOpenAt opens the regular file "cName" in "dirfd" so that it
+// can be overwritten with secureDeleteFinish once the caller has removed or
+// truncated it. Returns -1 if "-secure-delete" is off, or if the file must
+// not be overwritten: other hard links still show the same content.
+//
+// Overwriting through an fd that was opened before the unlink means that a
+// failing unlink does not destroy the file, and the space is only given
+// back when the fd is closed.
+func (fs *FS) secureDeleteOpenAt(dirfd int, cName string) int {
+	if !fs.secureDelete {
+		return -1
+	}
+	var st unix.Stat_t
+	err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFREG || st.Size == 0 {
+		return -1
+	}
+	if st.Nlink > 1 {
+		tlog.Debug.Printf("-secure-delete: %q has %d hard links, not overwriting", cName, st.Nlink)
+		return -1
+	}
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_WRONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		tlog.Warn.Printf("-secure-delete: cannot open %q, not overwriting: %v", cName, err)
+		return -1
+	}
+	return fd
+}
+
+// secureDeleteFinish overwrites and closes the fd returned by
+// secureDeleteOpenAt. Does nothing for fd = -1.
+func secureDeleteFinish(fd int, cName string) {
+	if fd < 0 {
+		return
+	}
+	if err := overwriteFd(fd, 0); err != nil {
+		tlog.Warn.Printf("-secure-delete: overwriting %q failed: %v", cName, err)
+	}
+	syscall.Close(fd)
+}
+
+// secureTruncateHook is called by secureTruncateFinish between the overwrite
+// and the truncate. Used by tests.
+var secureTruncateHook = func() {}
+
+// secureTruncateFinish is secureDeleteFinish for an open with O_TRUNC: it
+// overwrites the file through the fd returned by secureDeleteOpenAt,
+// truncates it to zero and closes the fd.
+func secureTruncateFinish(fd int, cName string) error {
+	defer syscall.Close(fd)
+	if err := overwriteFd(fd, 0); err != nil {
+		tlog.Warn.Printf("-secure-delete: overwriting %q failed: %v", cName, err)
+	}
+	secureTruncateHook()
+	return syscall.Ftruncate(fd, 0)
+}
+
+// secureDiscard overwrites the backing file from ciphertext offset "off" to
+// the end, if "-secure-delete" is on. Called before shrinking the file, like
+// discard.
+func (f *File) secureDiscard(off uint64) {
+	if !f.fs.secureDelete {
+		return
+	}
+	if err := overwriteFd(f.intFd(), int64(off)); err != nil {
+		tlog.Warn.Printf("ino%d: -secure-delete: overwriting failed: %v", f.qIno.Ino, err)
+	}
+}
@@ -0,0 +1,25 @@
+package fusefrontend
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// secureDeleteIneffective returns why overwriting files in "dir" would not
+// destroy the old data, or "" if we cannot tell.
+func secureDeleteIneffective(dir string) string {
+	var sfs unix.Statfs_t
+	if err := unix.Statfs(dir, &sfs); err != nil {
+		return ""
+	}
+	var name []byte
+	for _, c := range sfs.Fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	if string(name) == "apfs" {
+		return "apfs is a copy-on-write filesystem"
+	}
+	return ""
+}
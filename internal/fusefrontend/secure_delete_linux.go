@@ -0,0 +1,48 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Filesystems that never overwrite data in place, from man 2 statfs
+var copyOnWriteFs = map[uint32]string{
+	unix.BTRFS_SUPER_MAGIC: "btrfs",
+	0x2fc12fc1:             "zfs",
+	0xf2f52010:             "f2fs",
+	0x3434:                 "nilfs2",
+	0xca451a4e:             "bcachefs",
+}
+
+// secureDeleteIneffective returns why overwriting files in "dir" would not
+// destroy the old data, or "" if we cannot tell.
+func secureDeleteIneffective(dir string) string {
+	var sfs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &sfs); err == nil {
+		if name, ok := copyOnWriteFs[uint32(sfs.Type)]; ok {
+			return name + " is a copy-on-write filesystem"
+		}
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return ""
+	}
+	dev := fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev)))
+	// Partitions have no "queue" directory, their disk has. The kernel
+	// resolves the ".." after following the symlink.
+	for _, p := range []string{dev + "/queue/rotational", dev + "/../queue/rotational"} {
+		val, err := ioutil.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(string(val)) == "0" {
+			return "the storage is an SSD, which remaps overwritten blocks"
+		}
+		return ""
+	}
+	return ""
+}
@@ -0,0 +1,95 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestSecureDelete checks that "-secure-delete" overwrites the ciphertext
+// of an unlinked or truncated file, and leaves files with other hard links
+// alone.
+func TestSecureDelete(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, SecureDelete: true})
+	// Do not depend on the storage the test runs on
+	fs.secureDelete = true
+	writeTestFile(t, fs, "file", bytes.Repeat([]byte("x"), 100000))
+	// The open fd keeps the data of the unlinked file readable
+	f, err := os.Open(backingFile(t, cipherdir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	before, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := fs.Unlink("file", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	after := make([]byte, len(before)+1)
+	n, _ := f.ReadAt(after, 0)
+	after = after[:n]
+	if len(after) != len(before) {
+		t.Fatalf("size changed: %d -> %d", len(before), len(after))
+	}
+	if bytes.Equal(after[:4096], before[:4096]) || bytes.Equal(after[len(after)-4096:], before[len(before)-4096:]) {
+		t.Error("ciphertext was not overwritten")
+	}
+	// Hard links share the content, which must survive
+	writeTestFile(t, fs, "file2", []byte("content"))
+	if code := fs.Link("file2", "link", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.Unlink("file2", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if got := readTestFile(t, fs, "link"); string(got) != "content" {
+		t.Errorf("hard link: want %q, got %q", "content", got)
+	}
+	// Shrinking keeps the remaining content intact
+	if code := fs.Truncate("link", 3, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if got := readTestFile(t, fs, "link"); string(got) != "con" {
+		t.Errorf("truncate: want %q, got %q", "con", got)
+	}
+	// Open with O_TRUNC overwrites the old content before truncating it
+	writeTestFile(t, fs, "file3", bytes.Repeat([]byte("x"), 100000))
+	cName, err := fs.EncryptPath("file3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err = ioutil.ReadFile(filepath.Join(cipherdir, cName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err = os.Open(filepath.Join(cipherdir, cName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var overwritten []byte
+	secureTruncateHook = func() {
+		overwritten = make([]byte, len(before))
+		n, _ := f.ReadAt(overwritten, 0)
+		overwritten = overwritten[:n]
+	}
+	defer func() { secureTruncateHook = func() {} }()
+	f3, code := fs.Open("file3", uint32(os.O_WRONLY|os.O_TRUNC), nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	f3.Release()
+	if len(overwritten) != len(before) || bytes.Equal(overwritten[:4096], before[:4096]) {
+		t.Error("O_TRUNC: ciphertext was not overwritten before truncating")
+	}
+	if got := readTestFile(t, fs, "file3"); len(got) != 0 {
+		t.Errorf("O_TRUNC: want an empty file, got %d bytes", len(got))
+	}
+}
@@ -0,0 +1,87 @@
+package fusefrontend
+
+// "-show-conf": list gocryptfs.conf and its backup in the root directory
+// instead of hiding them. They are passed through unencrypted and
+// read-only, so tools that read them get the JSON instead of an I/O error,
+// and nothing can damage them through the mount.
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// isShownConf returns true if "relPath" is a config file that "-show-conf"
+// passes through. With encrypted names, a file the user has called
+// "gocryptfs.conf" takes precedence.
+func (fs *FS) isShownConf(relPath string) bool {
+	if !fs.args.ShowConf || !fs.isConfName("", relPath) {
+		return false
+	}
+	return fs.args.PlaintextNames || !fs.backingExists(relPath)
+}
+
+// getAttrConf is GetAttr for a config file passed through by "-show-conf".
+// The write permissions are removed.
+func (fs *FS) getAttrConf(relPath string) (*fuse.Attr, fuse.Status) {
+	rootfd, err := syscallcompat.OpenDirNofollow(fs.args.Cipherdir, "")
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	defer syscall.Close(rootfd)
+	var st unix.Stat_t
+	if err = syscallcompat.Fstatat(rootfd, relPath, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	a := &fuse.Attr{}
+	st2 := syscallcompat.Unix2syscall(st)
+	fs.inoMap.TranslateStat(&st2)
+	a.FromStat(&st2)
+	a.Mode &^= 0222
+	if fs.args.ForceOwner != nil {
+		a.Owner = *fs.args.ForceOwner
+	}
+	return a, fuse.OK
+}
+
+// openConf is Open for a config file passed through by "-show-conf". Only
+// reading is allowed.
+func (fs *FS) openConf(relPath string, flags uint32) (nodefs.File, fuse.Status) {
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0 {
+		return nil, fuse.EPERM
+	}
+	rootfd, err := syscallcompat.OpenDirNofollow(fs.args.Cipherdir, "")
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	defer syscall.Close(rootfd)
+	fd, err := syscallcompat.Openat(rootfd, relPath, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	return nodefs.NewReadOnlyFile(nodefs.NewLoopbackFile(os.NewFile(uintptr(fd), relPath))), fuse.OK
+}
+
+// appendShownConf adds the config files "conf" to the root directory
+// listing "entries", unless a plaintext entry has the same name.
+func appendShownConf(entries []fuse.DirEntry, conf []fuse.DirEntry) []fuse.DirEntry {
+	for _, c := range conf {
+		shadowed := false
+		for _, e := range entries {
+			if e.Name == c.Name {
+				shadowed = true
+				break
+			}
+		}
+		if !shadowed {
+			entries = append(entries, c)
+		}
+	}
+	return entries
+}
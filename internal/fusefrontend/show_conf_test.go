@@ -0,0 +1,71 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+func listsConf(t *testing.T, fs *FS) bool {
+	entries, code := fs.OpenDir("", nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	n := 0
+	for _, e := range entries {
+		if e.Name == configfile.ConfDefaultName {
+			n++
+		}
+	}
+	if n > 1 {
+		t.Errorf("%s listed %d times", configfile.ConfDefaultName, n)
+	}
+	return n > 0
+}
+
+func TestShowConf(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	hidden := newTestFS(Args{Cipherdir: cipherdir})
+	if listsConf(t, hidden) {
+		t.Errorf("%s should be hidden without ShowConf", configfile.ConfDefaultName)
+	}
+	if _, code := hidden.GetAttr(configfile.ConfDefaultName, nil); code != fuse.ENOENT {
+		t.Errorf("want ENOENT, got %v", code)
+	}
+
+	fs := newTestFS(Args{Cipherdir: cipherdir, ShowConf: true})
+	if !listsConf(t, fs) {
+		t.Errorf("%s is not listed", configfile.ConfDefaultName)
+	}
+	a, code := fs.GetAttr(configfile.ConfDefaultName, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if a.Mode&0222 != 0 {
+		t.Errorf("write permissions should be removed, got mode %o", a.Mode&07777)
+	}
+	f, code := fs.Open(configfile.ConfDefaultName, syscall.O_RDONLY, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	defer f.Release()
+	buf := make([]byte, a.Size)
+	res, code := f.Read(buf, 0)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	data, _ := res.Bytes(buf)
+	if uint64(len(data)) != a.Size || len(data) == 0 || data[0] != '{' {
+		t.Errorf("want %d bytes of JSON, got %q", a.Size, data)
+	}
+	if _, code := fs.Open(configfile.ConfDefaultName, syscall.O_WRONLY, nil); code != fuse.EPERM {
+		t.Errorf("O_WRONLY: want EPERM, got %v", code)
+	}
+	if code := fs.Access(configfile.ConfDefaultName, 2, nil); code != fuse.EACCES {
+		t.Errorf("W_OK: want EACCES, got %v", code)
+	}
+}
@@ -0,0 +1,169 @@
+package fusefrontend
+
+// Long symlink targets: encrypted and base64-encoded targets are about 4/3
+// longer than the plaintext, and can exceed the limit of the backing
+// filesystem (4095 bytes on Linux). When creating the symlink fails with
+// ENAMETOOLONG, the encrypted target is stored in a file in the directory
+// "gocryptfs.longlinks" in the root of CIPHERDIR, and the symlink points to
+// "gocryptfs.longlink.[id]" instead. Unlike the ".name" file of a long
+// name, the file does not have to follow the symlink on rename, and is
+// shared by all hard links to the symlink.
+//
+// Older versions of gocryptfs cannot read these symlinks, so this is only
+// done with the "LongSymlinks" feature flag. Without it, creating the
+// symlink fails with ENAMETOOLONG.
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// LongLinkDirName is the directory in the root of CIPHERDIR that stores
+	// the encrypted targets of long symlinks.
+	LongLinkDirName = "gocryptfs.longlinks"
+	// longLinkPrefix is what long symlinks point to, followed by the ID
+	longLinkPrefix = "gocryptfs.longlink."
+	// longLinkIDLen is the number of random bytes in an ID
+	longLinkIDLen = 16
+)
+
+// isLongLinkDir returns true if "name" in the directory "dirName" is the
+// store of long symlink targets.
+func (fs *FS) isLongLinkDir(dirName string, name string) bool {
+	return dirName == "" && name == LongLinkDirName && !fs.args.PlaintextNames
+}
+
+// longLinkID returns the ID of the stored target if the symlink target
+// "cTarget" refers to one. The ID is checked strictly, as it ends up in a
+// path.
+func (fs *FS) longLinkID(cTarget string) (string, bool) {
+	if !fs.args.LongSymlinks || !strings.HasPrefix(cTarget, longLinkPrefix) {
+		return "", false
+	}
+	id := cTarget[len(longLinkPrefix):]
+	bin, err := hex.DecodeString(id)
+	if err != nil || len(bin) != longLinkIDLen {
+		return "", false
+	}
+	return id, true
+}
+
+// openLongLinkDir opens the store of long symlink targets, and creates it
+// if "create" is set.
+func (fs *FS) openLongLinkDir(create bool) (int, error) {
+	rootfd, err := syscallcompat.OpenDirNofollow(fs.args.Cipherdir, "")
+	if err != nil {
+		return -1, err
+	}
+	defer syscall.Close(rootfd)
+	if create {
+		err = syscallcompat.Mkdirat(rootfd, LongLinkDirName, 0700)
+		if err != nil && err != syscall.EEXIST {
+			return -1, err
+		}
+	}
+	return fs.openat(rootfd, LongLinkDirName, syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscallcompat.O_PATH, 0)
+}
+
+// symlinkat creates the symlink "cName" in "dirfd" pointing to the encrypted
+// target "cTarget". If the target is too long for the backing filesystem,
+// it is stored in LongLinkDirName.
+func (fs *FS) symlinkat(cTarget string, dirfd int, cName string, context *fuse.Context) error {
+	err := syscallcompat.SymlinkatUser(cTarget, dirfd, cName, context)
+	if err != syscall.ENAMETOOLONG || !fs.args.LongSymlinks || fs.args.PlaintextNames {
+		return err
+	}
+	tlog.Debug.Printf("symlinkat %q: storing target of %d bytes in %s", cName, len(cTarget), LongLinkDirName)
+	storefd, err := fs.openLongLinkDir(true)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(storefd)
+	id := hex.EncodeToString(cryptocore.RandBytes(longLinkIDLen))
+	fd, err := syscallcompat.Openat(storefd, id, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, 0400)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), id)
+	_, err = f.WriteString(cTarget)
+	if err == nil && fs.args.FsyncMetadata {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = syscallcompat.SymlinkatUser(longLinkPrefix+id, dirfd, cName, context)
+	}
+	if err != nil {
+		syscallcompat.Unlinkat(storefd, id, 0)
+		return err
+	}
+	return nil
+}
+
+// readLongLink returns the encrypted target stored as "id"
+func (fs *FS) readLongLink(id string) (string, error) {
+	storefd, err := fs.openLongLinkDir(false)
+	if err != nil {
+		return "", err
+	}
+	defer syscall.Close(storefd)
+	fd, err := syscallcompat.Openat(storefd, id, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return "", err
+	}
+	f := os.NewFile(uintptr(fd), id)
+	defer f.Close()
+	cTarget, err := ioutil.ReadAll(f)
+	return string(cTarget), err
+}
+
+// longLinkAt returns the ID of the stored target if "cName" in "dirfd" is
+// the last hard link to a long symlink. Call it before deleting or
+// replacing "cName", and pass the ID to deleteLongLink afterwards.
+func (fs *FS) longLinkAt(dirfd int, cName string) string {
+	if !fs.args.LongSymlinks || fs.args.PlaintextNames {
+		return ""
+	}
+	var st unix.Stat_t
+	err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFLNK || st.Nlink != 1 {
+		return ""
+	}
+	cTarget, err := syscallcompat.Readlinkat(dirfd, cName)
+	if err != nil {
+		return ""
+	}
+	id, _ := fs.longLinkID(cTarget)
+	return id
+}
+
+// deleteLongLink deletes the stored target "id". Does nothing if "id" is
+// empty.
+func (fs *FS) deleteLongLink(id string) {
+	if id == "" {
+		return
+	}
+	storefd, err := fs.openLongLinkDir(false)
+	if err != nil {
+		tlog.Warn.Printf("deleteLongLink %s: %v", id, err)
+		return
+	}
+	defer syscall.Close(storefd)
+	if err = syscallcompat.Unlinkat(storefd, id, 0); err != nil {
+		tlog.Warn.Printf("deleteLongLink %s: %v", id, err)
+	}
+}
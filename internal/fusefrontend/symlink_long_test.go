@@ -0,0 +1,123 @@
+package fusefrontend
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// longLinkCount returns the number of stored long symlink targets
+func longLinkCount(t *testing.T, cipherdir string) int {
+	t.Helper()
+	entries, err := ioutil.ReadDir(filepath.Join(cipherdir, LongLinkDirName))
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+// TestLongSymlink creates symlinks with targets around the limit of the
+// backing filesystem, where the encrypted target becomes too long, up to the
+// longest target the kernel passes to us.
+func TestLongSymlink(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, LongSymlinks: true})
+	const backingMax = 4095
+	for _, n := range []int{1000, 2980, 3030, 3100, 4095} {
+		target := strings.Repeat("x", n)
+		name := "link" + strings.Repeat("y", n%7)
+		stored := len(fs.encryptSymlinkTarget(target)) > backingMax
+		before := longLinkCount(t, cipherdir)
+		if code := fs.Symlink(target, name, nil); !code.Ok() {
+			t.Fatalf("n=%d: Symlink: %v", n, code)
+		}
+		want := 0
+		if stored {
+			want = 1
+		}
+		if got := longLinkCount(t, cipherdir) - before; got != want {
+			t.Errorf("n=%d: want %d stored targets, got %d", n, want, got)
+		}
+		out, code := fs.Readlink(name, nil)
+		if !code.Ok() || out != target {
+			t.Fatalf("n=%d: Readlink returned %d bytes, %v", n, len(out), code)
+		}
+		a, code := fs.GetAttr(name, nil)
+		if !code.Ok() || a.Size != uint64(n) {
+			t.Errorf("n=%d: GetAttr size %d, %v", n, a.Size, code)
+		}
+		if code = fs.Unlink(name, nil); !code.Ok() {
+			t.Fatal(code)
+		}
+		if c := longLinkCount(t, cipherdir); c != 0 {
+			t.Errorf("n=%d: %d stored targets left after Unlink", n, c)
+		}
+	}
+	// The store is hidden
+	entries, code := fs.OpenDir("", nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if len(entries) != 0 {
+		t.Errorf("root directory should look empty, has %d entries", len(entries))
+	}
+}
+
+// TestLongSymlinkLinks checks that the stored target is kept as long as a
+// hard link or a renamed symlink refers to it.
+func TestLongSymlinkLinks(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, LongSymlinks: true})
+	target := strings.Repeat("x", 4000)
+	if code := fs.Symlink(target, "a", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.Link("a", "b", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.Unlink("a", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.Mkdir("dir", 0700, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.Rename("b", "dir/c", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if out, code := fs.Readlink("dir/c", nil); !code.Ok() || out != target {
+		t.Fatalf("Readlink returned %d bytes, %v", len(out), code)
+	}
+	// Renaming over the symlink deletes its target
+	if code := fs.Symlink("short", "d", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.Rename("d", "dir/c", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if c := longLinkCount(t, cipherdir); c != 0 {
+		t.Errorf("%d stored targets left", c)
+	}
+}
+
+// TestLongSymlinkNoFlag checks that long targets are not stored without the
+// LongSymlinks feature flag, as older versions could not read them.
+func TestLongSymlinkNoFlag(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	if code := fs.Symlink(strings.Repeat("x", 4000), "a", nil); code != fuse.Status(syscall.ENAMETOOLONG) {
+		t.Errorf("want ENAMETOOLONG, got %v", code)
+	}
+	if c := longLinkCount(t, cipherdir); c != 0 {
+		t.Errorf("%d stored targets", c)
+	}
+}
@@ -0,0 +1,201 @@
+package fusefrontend
+
+// ctlsock "Transaction": apply a list of renames and unlinks all or nothing.
+// Entries that are unlinked or replaced by a rename are moved into the trash
+// first, so a failed transaction can put them back, like TrashRestore does.
+// When all operations have succeeded, they are deleted for good, unless
+// "-trash" keeps them.
+//
+// Transactions are serialized against each other, but not against FUSE
+// operations. Other processes can see the intermediate states, and a
+// concurrent change to the same paths can make the rollback fail. A crash in
+// the middle leaves the transaction partly applied, with the removed entries
+// in the trash directory.
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+var _ ctlsocksrv.TransactionInterface = &FS{} // Verify that interface is implemented.
+
+// txnStep is a change that a transaction has made
+type txnStep struct {
+	// undo reverts the change
+	undo func() error
+	// trashID is the trashed entry that is deleted on commit, if any
+	trashID string
+}
+
+// Transaction implements ctlsocksrv.TransactionInterface.
+func (fs *FS) Transaction(ops []ctlsock.TransactionOp) error {
+	if fs.isReadOnly() {
+		return syscall.EROFS
+	}
+	for _, op := range ops {
+		for _, p := range []string{op.Path, op.NewPath} {
+			if p != "" && (fs.isFiltered(p) || fs.isVirtualFork(p)) {
+				return &os.PathError{Op: "Transaction", Path: p, Err: syscall.EPERM}
+			}
+		}
+	}
+	fs.txnLock.Lock()
+	defer fs.txnLock.Unlock()
+	trashfd, err := fs.openTrashDir()
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(trashfd)
+	defer fs.txnRemoveTrashDir()
+	var steps []txnStep
+	for i, op := range ops {
+		var s []txnStep
+		if op.Op == ctlsock.TransactionRename {
+			s, err = fs.txnRename(trashfd, op.Path, op.NewPath)
+		} else {
+			s, err = fs.txnUnlink(trashfd, op.Path)
+		}
+		steps = append(steps, s...)
+		if err != nil {
+			fs.txnRollback(steps)
+			return &os.PathError{Op: fmt.Sprintf("Transaction operation %d (%s)", i, op.Op), Path: op.Path, Err: err}
+		}
+	}
+	// Commit
+	if !fs.args.Trash {
+		for _, s := range steps {
+			if s.trashID == "" {
+				continue
+			}
+			if err = fs.purgeTrashItem(trashfd, s.trashID); err != nil {
+				tlog.Warn.Printf("Transaction: could not delete trashed entry %q: %v", s.trashID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// txnTrashStep returns the step that moves the trashed entry "id" back.
+func (fs *FS) txnTrashStep(trashfd int, id string) txnStep {
+	return txnStep{
+		undo: func() error {
+			_, err := fs.restoreTrashItem(trashfd, id)
+			return err
+		},
+		trashID: id,
+	}
+}
+
+// txnUnlink moves the non-directory "relPath" into the trash.
+func (fs *FS) txnUnlink(trashfd int, relPath string) ([]txnStep, error) {
+	dirfd, cName, err := fs.openBackingDir(relPath)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(dirfd)
+	var st unix.Stat_t
+	if err = syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return nil, err
+	}
+	if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		return nil, syscall.EISDIR
+	}
+	id, err := fs.trashEntry(dirfd, cName, relPath)
+	if err != nil {
+		return nil, err
+	}
+	fs.dirCountAdd(dirfd, -1)
+	return []txnStep{fs.txnTrashStep(trashfd, id)}, nil
+}
+
+// txnRename renames "oldPath" to "newPath". An existing "newPath" is moved
+// into the trash first. On error, the steps that have been applied are
+// returned as well.
+func (fs *FS) txnRename(trashfd int, oldPath string, newPath string) ([]txnStep, error) {
+	oldDirfd, oldCName, err := fs.openBackingDir(oldPath)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(oldDirfd)
+	var oldSt unix.Stat_t
+	if err = syscallcompat.Fstatat(oldDirfd, oldCName, &oldSt, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return nil, err
+	}
+	newDirfd, newCName, err := fs.openBackingDirNew(newPath, oldPath)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(newDirfd)
+	var steps []txnStep
+	var newSt unix.Stat_t
+	err = syscallcompat.Fstatat(newDirfd, newCName, &newSt, unix.AT_SYMLINK_NOFOLLOW)
+	if err == nil {
+		if newSt.Dev == oldSt.Dev && newSt.Ino == oldSt.Ino {
+			// Like rename(2), do nothing if both are the same file
+			return nil, nil
+		}
+		oldIsDir := oldSt.Mode&syscall.S_IFMT == syscall.S_IFDIR
+		newIsDir := newSt.Mode&syscall.S_IFMT == syscall.S_IFDIR
+		if newIsDir && !oldIsDir {
+			return nil, syscall.EISDIR
+		}
+		if !newIsDir && oldIsDir {
+			return nil, syscall.ENOTDIR
+		}
+		var id string
+		if newIsDir {
+			id, err = fs.trashDir(newDirfd, newCName, newPath)
+		} else {
+			id, err = fs.trashEntry(newDirfd, newCName, newPath)
+		}
+		if err != nil {
+			return nil, err
+		}
+		fs.dirCountAdd(newDirfd, -1)
+		steps = append(steps, fs.txnTrashStep(trashfd, id))
+	} else if err != syscall.ENOENT {
+		return nil, err
+	}
+	if code := fs.Rename(oldPath, newPath, nil); !code.Ok() {
+		return steps, syscall.Errno(code)
+	}
+	steps = append(steps, txnStep{undo: func() error {
+		if code := fs.Rename(newPath, oldPath, nil); !code.Ok() {
+			return syscall.Errno(code)
+		}
+		return nil
+	}})
+	return steps, nil
+}
+
+// txnRollback undoes "steps" in reverse order.
+func (fs *FS) txnRollback(steps []txnStep) {
+	for i := len(steps) - 1; i >= 0; i-- {
+		if err := steps[i].undo(); err != nil {
+			tlog.Warn.Printf("Transaction: rollback failed: %v", err)
+		}
+	}
+}
+
+// txnRemoveTrashDir removes the trash directory without "-trash", where it
+// only holds the entries of a running transaction. Does nothing if it is not
+// empty.
+func (fs *FS) txnRemoveTrashDir() {
+	if fs.args.Trash {
+		return
+	}
+	rootfd, err := syscallcompat.OpenDirNofollow(fs.args.Cipherdir, "")
+	if err != nil {
+		return
+	}
+	syscallcompat.Unlinkat(rootfd, TrashDirName, unix.AT_REMOVEDIR)
+	syscall.Close(rootfd)
+}
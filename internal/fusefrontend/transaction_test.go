@@ -0,0 +1,94 @@
+package fusefrontend
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+func TestTransaction(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, LongNames: true})
+	long := strings.Repeat("l", 200)
+	for _, f := range []string{"a", "b", "c", long} {
+		writeTestFile(t, fs, f, []byte(f))
+	}
+	// The last operation fails, the others are undone
+	err := fs.Transaction([]ctlsock.TransactionOp{
+		{Op: ctlsock.TransactionRename, Path: "a", NewPath: "b"},
+		{Op: ctlsock.TransactionUnlink, Path: long},
+		{Op: ctlsock.TransactionRename, Path: "c", NewPath: "d"},
+		{Op: ctlsock.TransactionUnlink, Path: "missing"},
+	})
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.ENOENT {
+		t.Fatalf("want ENOENT, got %v", err)
+	}
+	for _, f := range []string{"a", "b", "c", long} {
+		if got := string(readTestFile(t, fs, f)); got != f {
+			t.Errorf("%s: want content %q, got %q", f, f, got)
+		}
+	}
+	if _, code := fs.GetAttr("d", nil); code.Ok() {
+		t.Error("d should not exist after the rollback")
+	}
+	if _, err = os.Stat(filepath.Join(cipherdir, TrashDirName)); !os.IsNotExist(err) {
+		t.Errorf("the trash directory should be gone: %v", err)
+	}
+	// Now without the failing operation
+	err = fs.Transaction([]ctlsock.TransactionOp{
+		{Op: ctlsock.TransactionRename, Path: "a", NewPath: "b"},
+		{Op: ctlsock.TransactionUnlink, Path: long},
+		{Op: ctlsock.TransactionRename, Path: "c", NewPath: "d"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, code := fs.OpenDir("", nil)
+	if !code.Ok() || len(entries) != 2 {
+		t.Fatalf("want 2 entries, got %v (%v)", entries, code)
+	}
+	if got := string(readTestFile(t, fs, "b")); got != "a" {
+		t.Errorf("b: want content %q, got %q", "a", got)
+	}
+	if _, err = os.Stat(filepath.Join(cipherdir, TrashDirName)); !os.IsNotExist(err) {
+		t.Errorf("the trash directory should be gone: %v", err)
+	}
+}
+
+// With "-trash", the removed entries stay in the trash
+func TestTransactionTrash(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, Trash: true})
+	if code := fs.Mkdir("dir1", 0700, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.Mkdir("dir2", 0700, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	writeTestFile(t, fs, "file", []byte("x"))
+	err := fs.Transaction([]ctlsock.TransactionOp{
+		{Op: ctlsock.TransactionRename, Path: "file", NewPath: "dir1"},
+	})
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EISDIR {
+		t.Errorf("want EISDIR, got %v", err)
+	}
+	err = fs.Transaction([]ctlsock.TransactionOp{
+		{Op: ctlsock.TransactionRename, Path: "dir1", NewPath: "dir2"},
+		{Op: ctlsock.TransactionUnlink, Path: "file"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := fs.TrashList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Path != "dir2" || items[1].Path != "file" {
+		t.Errorf("wrong trash content: %+v", items)
+	}
+}
@@ -0,0 +1,362 @@
+package fusefrontend
+
+// "-trash": Unlink and Rmdir move the deleted entry into a trash directory
+// in the root of CIPHERDIR instead of deleting it. Trashed entries can be
+// listed, restored and purged through the control socket.
+//
+// Every trashed entry gets a directory of its own in the trash:
+//
+//	.gocryptfs-trash/ID/gocryptfs.trashdata  <--- the deleted file or directory
+//	.gocryptfs-trash/ID/gocryptfs.trashinfo  <--- encrypted plaintext path and deletion time
+//
+// The encrypted name of an entry depends on the gocryptfs.diriv of its
+// parent directory, and the parent may be gone or recreated by the time the
+// entry is restored. So we do not keep the encrypted name, but the
+// plaintext path, and encrypt the name again under the current diriv of the
+// parent on restore.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// TrashDirName is the name of the trash directory in the root of
+	// CIPHERDIR. It cannot clash with an encrypted name because the base64
+	// alphabet does not contain ".".
+	TrashDirName   = ".gocryptfs-trash"
+	trashDataName  = "gocryptfs.trashdata"
+	trashInfoName  = "gocryptfs.trashinfo"
+	trashPurgeAll  = "*"
+	trashDirPerms  = 0700
+	trashInfoPerms = 0400
+)
+
+// trashInfo is the content of gocryptfs.trashinfo before encryption
+type trashInfo struct {
+	// Path is the plaintext path the entry was deleted from
+	Path string
+	// Time is when the entry was deleted
+	Time time.Time
+}
+
+// isTrashName returns true if "name" in the directory "dirName" is the
+// trash directory and must be hidden. With encrypted names, it is hidden even
+// without "-trash", so it does not show up as an undecryptable name.
+func (fs *FS) isTrashName(dirName string, name string) bool {
+	return dirName == "" && name == TrashDirName && (fs.args.Trash || !fs.args.PlaintextNames)
+}
+
+// openTrashDir opens the trash directory, and creates it if it does not
+// exist yet.
+func (fs *FS) openTrashDir() (int, error) {
+	rootfd, err := syscallcompat.OpenDirNofollow(fs.args.Cipherdir, "")
+	if err != nil {
+		return -1, err
+	}
+	defer syscall.Close(rootfd)
+	err = syscallcompat.Mkdirat(rootfd, TrashDirName, trashDirPerms)
+	if err != nil && err != syscall.EEXIST {
+		return -1, err
+	}
+	return fs.openat(rootfd, TrashDirName, syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscallcompat.O_PATH, 0)
+}
+
+// openTrashItem opens the directory of the trashed entry "id" in "trashfd".
+func openTrashItem(trashfd int, id string) (int, error) {
+	if id == "" || id == "." || id == ".." || filepath.Base(id) != id {
+		return -1, syscall.EINVAL
+	}
+	return syscallcompat.Openat(trashfd, id, syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscallcompat.O_PATH, 0)
+}
+
+// trashEntry moves "cName" in "dirfd", which is the plaintext path
+// "relPath", into the trash, and returns the ID of the trashed entry.
+func (fs *FS) trashEntry(dirfd int, cName string, relPath string) (string, error) {
+	trashfd, err := fs.openTrashDir()
+	if err != nil {
+		tlog.Warn.Printf("trashEntry: cannot open trash directory: %v", err)
+		return "", err
+	}
+	defer syscall.Close(trashfd)
+	// The ID sorts by deletion time
+	now := time.Now()
+	id := fmt.Sprintf("%d.%016x", now.UnixNano(), cryptocore.RandUint64())
+	err = syscallcompat.Mkdirat(trashfd, id, trashDirPerms)
+	if err != nil {
+		return "", err
+	}
+	itemfd, err := openTrashItem(trashfd, id)
+	if err != nil {
+		syscallcompat.Unlinkat(trashfd, id, unix.AT_REMOVEDIR)
+		return "", err
+	}
+	defer syscall.Close(itemfd)
+	err = fs.writeTrashInfo(itemfd, trashInfo{Path: relPath, Time: now})
+	if err == nil {
+		err = syscallcompat.Renameat(dirfd, cName, itemfd, trashDataName)
+	}
+	if err != nil {
+		syscallcompat.Unlinkat(itemfd, trashInfoName, 0)
+		syscallcompat.Unlinkat(trashfd, id, unix.AT_REMOVEDIR)
+		return "", err
+	}
+	// The ".name" file is not needed anymore, we have the plaintext path
+	if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
+		err = nametransform.DeleteLongNameAt(dirfd, cName)
+		if err != nil {
+			tlog.Warn.Printf("trashEntry: could not delete .name file: %v", err)
+		}
+	}
+	return id, nil
+}
+
+// trashDir is Rmdir with "-trash". Like rmdir(2), it only works on empty
+// directories.
+func (fs *FS) trashDir(parentDirFd int, cName string, relPath string) (string, error) {
+	dirfd, err := fs.openat(parentDirFd, cName,
+		syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return "", err
+	}
+	children, err := syscallcompat.Getdents(dirfd)
+	syscall.Close(dirfd)
+	if err != nil {
+		return "", err
+	}
+	for _, c := range children {
+		if c.Name != fs.nameTransform.DirIVName() || fs.args.PlaintextNames {
+			return "", syscall.ENOTEMPTY
+		}
+	}
+	return fs.trashEntry(parentDirFd, cName, relPath)
+}
+
+// writeTrashInfo encrypts "info" and writes it to gocryptfs.trashinfo in
+// "itemfd".
+func (fs *FS) writeTrashInfo(itemfd int, info trashInfo) error {
+	js, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	fd, err := syscallcompat.Openat(itemfd, trashInfoName,
+		syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, trashInfoPerms)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), trashInfoName)
+	_, err = f.Write(fs.contentEnc.EncryptBlock(js, 0, nil))
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// readTrashInfo reads and decrypts gocryptfs.trashinfo in "itemfd".
+func (fs *FS) readTrashInfo(itemfd int) (info trashInfo, err error) {
+	fd, err := syscallcompat.Openat(itemfd, trashInfoName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return info, err
+	}
+	f := os.NewFile(uintptr(fd), trashInfoName)
+	cData, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return info, err
+	}
+	js, err := fs.contentEnc.DecryptBlock(cData, 0, nil)
+	if err != nil {
+		tlog.Warn.Printf("readTrashInfo: %v", err)
+		return info, syscall.EIO
+	}
+	err = json.Unmarshal(js, &info)
+	if err != nil {
+		tlog.Warn.Printf("readTrashInfo: %v", err)
+		return info, syscall.EIO
+	}
+	return info, nil
+}
+
+// TrashList implements ctlsocksrv.TrashInterface. It returns the trashed
+// entries, oldest first.
+func (fs *FS) TrashList() ([]ctlsock.TrashItem, error) {
+	if !fs.args.Trash {
+		return nil, errTrashDisabled
+	}
+	trashfd, err := fs.openTrashDir()
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(trashfd)
+	fd, err := fs.openat(trashfd, ".", syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := syscallcompat.Getdents(fd)
+	syscall.Close(fd)
+	if err != nil {
+		return nil, err
+	}
+	items := []ctlsock.TrashItem{}
+	for _, e := range entries {
+		itemfd, err := openTrashItem(trashfd, e.Name)
+		if err != nil {
+			continue
+		}
+		info, err := fs.readTrashInfo(itemfd)
+		syscall.Close(itemfd)
+		if err != nil {
+			tlog.Warn.Printf("TrashList: %q: %v", e.Name, err)
+			continue
+		}
+		items = append(items, ctlsock.TrashItem{ID: e.Name, Path: info.Path, Time: info.Time})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	return items, nil
+}
+
+// TrashRestore implements ctlsocksrv.TrashInterface. It moves the trashed
+// entry "id" back to where it was deleted from, and returns that path.
+// Fails with ENOENT if the parent directory does not exist anymore, and with
+// EEXIST if something else has been created in its place.
+func (fs *FS) TrashRestore(id string) (string, error) {
+	if !fs.args.Trash {
+		return "", errTrashDisabled
+	}
+	if fs.isReadOnly() {
+		return "", syscall.EROFS
+	}
+	trashfd, err := fs.openTrashDir()
+	if err != nil {
+		return "", err
+	}
+	defer syscall.Close(trashfd)
+	return fs.restoreTrashItem(trashfd, id)
+}
+
+// restoreTrashItem moves the trashed entry "id" in "trashfd" back to where
+// it was deleted from, and returns that path.
+func (fs *FS) restoreTrashItem(trashfd int, id string) (string, error) {
+	itemfd, err := openTrashItem(trashfd, id)
+	if err != nil {
+		return "", &os.PathError{Op: "TrashRestore", Path: id, Err: err}
+	}
+	defer syscall.Close(itemfd)
+	info, err := fs.readTrashInfo(itemfd)
+	if err != nil {
+		return "", &os.PathError{Op: "TrashRestore", Path: id, Err: err}
+	}
+	err = fs.restoreEntry(itemfd, info.Path)
+	if err != nil {
+		return "", &os.PathError{Op: "TrashRestore", Path: info.Path, Err: err}
+	}
+	syscallcompat.Unlinkat(itemfd, trashInfoName, 0)
+	err = syscallcompat.Unlinkat(trashfd, id, unix.AT_REMOVEDIR)
+	if err != nil {
+		tlog.Warn.Printf("TrashRestore: could not remove %q: %v", id, err)
+	}
+	return info.Path, nil
+}
+
+// restoreEntry moves gocryptfs.trashdata in "itemfd" to "relPath".
+func (fs *FS) restoreEntry(itemfd int, relPath string) error {
+	// The parent directory may have been recreated, so we may see
+	// a different diriv than the last time
+	fs.dirCache.Clear()
+	dirfd, cName, err := fs.openBackingDir(relPath)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	var st unix.Stat_t
+	err = syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err == nil {
+		return syscall.EEXIST
+	}
+	if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
+		err = fs.nameTransform.WriteLongNameAt(dirfd, cName, relPath)
+		if err != nil {
+			return err
+		}
+	}
+	err = syscallcompat.Renameat(itemfd, trashDataName, dirfd, cName)
+	if err != nil {
+		if !fs.args.PlaintextNames && nametransform.IsLongContent(cName) {
+			nametransform.DeleteLongNameAt(dirfd, cName)
+		}
+		return err
+	}
+	return nil
+}
+
+// TrashPurge implements ctlsocksrv.TrashInterface. It deletes the trashed
+// entry "id" for good, or all of them if "id" is "*".
+func (fs *FS) TrashPurge(id string) error {
+	if !fs.args.Trash {
+		return errTrashDisabled
+	}
+	if fs.isReadOnly() {
+		return syscall.EROFS
+	}
+	trashfd, err := fs.openTrashDir()
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(trashfd)
+	trashPath := filepath.Join(fs.args.Cipherdir, TrashDirName)
+	if id == trashPurgeAll {
+		items, err := ioutil.ReadDir(trashPath)
+		if err != nil {
+			return err
+		}
+		for _, fi := range items {
+			if err = fs.TrashPurge(fi.Name()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if id == "" || id == "." || id == ".." || filepath.Base(id) != id {
+		return &os.PathError{Op: "TrashPurge", Path: id, Err: syscall.EINVAL}
+	}
+	return fs.purgeTrashItem(trashfd, id)
+}
+
+// purgeTrashItem deletes the trashed entry "id" in "trashfd" for good.
+func (fs *FS) purgeTrashItem(trashfd int, id string) error {
+	itemPath := filepath.Join(fs.args.Cipherdir, TrashDirName, id)
+	if _, err := os.Lstat(itemPath); err != nil {
+		return err
+	}
+	var freed int64
+	var longLink string
+	if itemfd, err := openTrashItem(trashfd, id); err == nil {
+		freed = fs.quotaFreedAt(itemfd, trashDataName)
+		longLink = fs.longLinkAt(itemfd, trashDataName)
+		syscall.Close(itemfd)
+	}
+	// RemoveAll does not follow symlinks
+	err := os.RemoveAll(itemPath)
+	if err == nil {
+		fs.quotaAdd(-freed)
+		fs.deleteLongLink(longLink)
+	}
+	return err
+}
+
+// errTrashDisabled is returned by the ctlsock trash commands without "-trash"
+var errTrashDisabled = &os.PathError{Op: "trash", Path: "mounted without -trash", Err: syscall.ENOTSUP}
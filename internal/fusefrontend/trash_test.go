@@ -0,0 +1,154 @@
+package fusefrontend
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// trashTestFile creates "path" with "content" in "fs"
+func trashTestFile(t *testing.T, fs *FS, path string, content string) {
+	f, code := fs.Create(path, uint32(os.O_WRONLY), 0600, nil)
+	if !code.Ok() {
+		t.Fatalf("Create %q: %v", path, code)
+	}
+	if _, code = f.Write([]byte(content), 0); !code.Ok() {
+		t.Fatal(code)
+	}
+	f.Release()
+}
+
+// trashTestRead returns the content of "path" in "fs"
+func trashTestRead(t *testing.T, fs *FS, path string) string {
+	f, code := fs.Open(path, uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Fatalf("Open %q: %v", path, code)
+	}
+	defer f.Release()
+	buf := make([]byte, 100)
+	res, code := f.Read(buf, 0)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	data, _ := res.Bytes(buf)
+	return string(data)
+}
+
+func TestTrash(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, Trash: true})
+	longName := strings.Repeat("x", 200)
+	trashTestFile(t, fs, "file", "hello")
+	trashTestFile(t, fs, longName, "long")
+	if code := fs.Unlink("file", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.Unlink(longName, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, code := fs.GetAttr("file", nil); code != fuse.ENOENT {
+		t.Fatalf("file should be gone, got %v", code)
+	}
+	// The trash directory must not show up in the root directory
+	entries, code := fs.OpenDir("", nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if len(entries) != 0 {
+		t.Errorf("root directory should be empty, got %v", entries)
+	}
+	items, err := fs.TrashList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Path != "file" || items[1].Path != longName {
+		t.Fatalf("wrong trash content: %v", items)
+	}
+	// Restore
+	path, err := fs.TrashRestore(items[0].ID)
+	if err != nil || path != "file" {
+		t.Fatalf("TrashRestore: %q %v", path, err)
+	}
+	if c := trashTestRead(t, fs, "file"); c != "hello" {
+		t.Errorf("wrong content after restore: %q", c)
+	}
+	path, err = fs.TrashRestore(items[1].ID)
+	if err != nil || path != longName {
+		t.Fatalf("TrashRestore: %q %v", path, err)
+	}
+	if c := trashTestRead(t, fs, longName); c != "long" {
+		t.Errorf("wrong content after restore: %q", c)
+	}
+	if items, _ = fs.TrashList(); len(items) != 0 {
+		t.Errorf("trash should be empty: %v", items)
+	}
+	// Restore must not overwrite an existing file
+	fs.Unlink("file", nil)
+	trashTestFile(t, fs, "file", "new")
+	items, _ = fs.TrashList()
+	_, err = fs.TrashRestore(items[0].ID)
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EEXIST {
+		t.Errorf("want EEXIST, got %v", err)
+	}
+	// Purge
+	if err = fs.TrashPurge(items[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if items, _ = fs.TrashList(); len(items) != 0 {
+		t.Errorf("trash should be empty: %v", items)
+	}
+	if err = fs.TrashPurge("../file"); err == nil {
+		t.Error("TrashPurge should reject paths")
+	}
+}
+
+// TestTrashDir checks the order "rm -r" deletes things in: first the files,
+// then the directory. The directory must be restored first.
+func TestTrashDir(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, Trash: true})
+	if code := fs.Mkdir("dir", 0700, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	trashTestFile(t, fs, "dir/file", "content")
+	if code := fs.Rmdir("dir", nil); code != fuse.Status(syscall.ENOTEMPTY) {
+		t.Fatalf("want ENOTEMPTY, got %v", code)
+	}
+	if code := fs.Unlink("dir/file", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.Rmdir("dir", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	items, err := fs.TrashList()
+	if err != nil || len(items) != 2 {
+		t.Fatalf("TrashList: %v %v", items, err)
+	}
+	_, err = fs.TrashRestore(items[0].ID)
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.ENOENT {
+		t.Errorf("restoring the file without its directory: want ENOENT, got %v", err)
+	}
+	if _, err = fs.TrashRestore(items[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.TrashRestore(items[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if c := trashTestRead(t, fs, "dir/file"); c != "content" {
+		t.Errorf("wrong content after restore: %q", c)
+	}
+	// Purge all
+	fs.Unlink("dir/file", nil)
+	fs.Rmdir("dir", nil)
+	if err = fs.TrashPurge("*"); err != nil {
+		t.Fatal(err)
+	}
+	if items, _ = fs.TrashList(); len(items) != 0 {
+		t.Errorf("trash should be empty: %v", items)
+	}
+}
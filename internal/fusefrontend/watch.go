@@ -0,0 +1,118 @@
+package fusefrontend
+
+// "-watch": report changes to CIPHERDIR, including those made behind our
+// back, in terms of plaintext paths. FUSE has no way to make the kernel
+// generate inotify events on the mount, so the events are streamed through
+// the control socket instead. In addition, the kernel is told to drop its
+// cached data of the changed entries, so that the mount shows changes that
+// have been made directly in CIPHERDIR right away.
+//
+// The platform-specific part that watches CIPHERDIR is in watch_linux.go.
+
+import (
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Notifier invalidates kernel caches. It is implemented by
+// *pathfs.PathNodeFs.
+type Notifier interface {
+	// EntryNotify makes the kernel forget the entry "name" in "dir"
+	EntryNotify(dir string, name string) fuse.Status
+	// FileNotify makes the kernel forget the attributes and content of "path"
+	FileNotify(path string, off int64, length int64) fuse.Status
+}
+
+// watchQueueLen is the number of events that can be queued for a
+// subscriber before it is dropped
+const watchQueueLen = 1000
+
+// watchSubscribers are the ctlsock clients of "-watch"
+type watchSubscribers struct {
+	sync.Mutex
+	subs map[chan ctlsock.WatchEvent]struct{}
+}
+
+var _ ctlsocksrv.WatchInterface = &FS{} // Verify that interface is implemented.
+
+// Watch implements ctlsocksrv.WatchInterface. The returned channel receives
+// the events until "cancel" is called. It is closed if the subscriber cannot
+// keep up. Returns a nil channel if "-watch" is not enabled.
+func (fs *FS) Watch() (events <-chan ctlsock.WatchEvent, cancel func()) {
+	if !fs.args.Watch {
+		return nil, func() {}
+	}
+	ch := make(chan ctlsock.WatchEvent, watchQueueLen)
+	w := &fs.watchSubs
+	w.Lock()
+	if w.subs == nil {
+		w.subs = make(map[chan ctlsock.WatchEvent]struct{})
+	}
+	w.subs[ch] = struct{}{}
+	w.Unlock()
+	cancel = func() {
+		w.Lock()
+		defer w.Unlock()
+		if _, ok := w.subs[ch]; ok {
+			delete(w.subs, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// watchPublish sends "ev" to all subscribers
+func (fs *FS) watchPublish(ev ctlsock.WatchEvent) {
+	w := &fs.watchSubs
+	w.Lock()
+	defer w.Unlock()
+	for ch := range w.subs {
+		select {
+		case ch <- ev:
+		default:
+			tlog.Info.Printf("-watch: dropping subscriber that cannot keep up")
+			delete(w.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// watchEvent handles a change of the entry "name" in the plaintext
+// directory "dir": it invalidates the kernel cache through "n" and
+// publishes the event.
+func (fs *FS) watchEvent(n Notifier, op string, dir string, name string) {
+	p := path.Join(dir, name)
+	tlog.Debug.Printf("watchEvent %s %q", op, p)
+	if op == ctlsock.WatchModify {
+		n.FileNotify(p, 0, 0)
+	} else {
+		n.EntryNotify(dir, name)
+	}
+	fs.watchPublish(ctlsock.WatchEvent{Op: op, Path: p})
+}
+
+// isInternalName returns true if "cName" in the ciphertext directory
+// "cDir" is a file that gocryptfs keeps for itself, like gocryptfs.diriv.
+// Events for these are not reported.
+func (fs *FS) isInternalName(cDir string, cName string) bool {
+	if fs.isConfName(cDir, cName) || (cDir == "" && cName == TrashDirName) || fs.isLongLinkDir(cDir, cName) ||
+		(cDir == "" && cName == JournalDirName) {
+		return true
+	}
+	if fs.args.PlaintextNames {
+		return false
+	}
+	if cName == fs.nameTransform.DirIVName() || nametransform.NameType(cName) == nametransform.LongNameFilename {
+		return true
+	}
+	// Rmdir temporarily moves gocryptfs.diriv into the parent directory
+	return strings.HasPrefix(cName, fs.nameTransform.DirIVName()+".")
+}
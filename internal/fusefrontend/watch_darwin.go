@@ -0,0 +1,10 @@
+package fusefrontend
+
+import (
+	"syscall"
+)
+
+// StartWatch is not implemented on macOS, which has no inotify
+func (fs *FS) StartWatch(n Notifier) error {
+	return syscall.ENOTSUP
+}
@@ -0,0 +1,253 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// watchMask are the inotify events we watch for. Writes are reported once,
+// when the file is closed.
+const watchMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_CLOSE_WRITE | unix.IN_ONLYDIR | unix.IN_DONT_FOLLOW
+
+// watchDir is a watched ciphertext directory
+type watchDir struct {
+	// cPath and pPath are the ciphertext and plaintext path relative to
+	// CIPHERDIR and the mountpoint
+	cPath string
+	pPath string
+	// iv is the directory IV, nil with plaintext names
+	iv []byte
+	// long caches the plaintext of long names. When the delete event for
+	// a long name arrives, its ".name" file is usually gone already.
+	long map[string]string
+}
+
+// watcher follows the changes in CIPHERDIR through inotify
+type watcher struct {
+	fs *FS
+	n  Notifier
+	fd int
+	// dirs maps inotify watch descriptors to directories
+	dirs map[int]*watchDir
+	// moveCookie and moveFrom are the cookie and the old ciphertext path of
+	// the last IN_MOVED_FROM event of a directory, to pair it with the
+	// IN_MOVED_TO event that follows
+	moveCookie uint32
+	moveFrom   string
+}
+
+// StartWatch starts watching CIPHERDIR for "-watch". Kernel caches are
+// invalidated through "n".
+func (fs *FS) StartWatch(n Notifier) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	w := &watcher{
+		fs:   fs,
+		n:    n,
+		fd:   fd,
+		dirs: make(map[int]*watchDir),
+	}
+	if err = w.addTree("", ""); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	tlog.Debug.Printf("StartWatch: watching %d directories", len(w.dirs))
+	go w.loop()
+	return nil
+}
+
+// addTree watches the ciphertext directory "cPath" and all directories
+// below it. "pPath" is the plaintext path.
+func (w *watcher) addTree(cPath string, pPath string) error {
+	wd, err := unix.InotifyAddWatch(w.fd, filepath.Join(w.fs.args.Cipherdir, cPath), watchMask)
+	if err != nil {
+		if err == syscall.ENOSPC {
+			tlog.Warn.Printf("-watch: inotify watch limit reached, see /proc/sys/fs/inotify/max_user_watches")
+		}
+		return err
+	}
+	dirfd, err := w.openDir(cPath)
+	if err != nil {
+		unix.InotifyRmWatch(w.fd, uint32(wd))
+		return err
+	}
+	defer syscall.Close(dirfd)
+	d := &watchDir{cPath: cPath, pPath: pPath, long: make(map[string]string)}
+	w.dirs[wd] = d
+	if !w.fs.args.PlaintextNames {
+		// A directory that has just been created may not have its
+		// gocryptfs.diriv yet. decryptName reads it when it is needed.
+		d.iv, _ = w.fs.readDirIV(dirfd)
+	}
+	entries, err := syscallcompat.Getdents(dirfd)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if w.fs.isInternalName(cPath, e.Name) {
+			continue
+		}
+		name, err := w.decryptName(d, dirfd, e.Name)
+		if err != nil {
+			continue
+		}
+		if e.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			continue
+		}
+		if err = w.addTree(path.Join(cPath, e.Name), path.Join(pPath, name)); err != nil {
+			tlog.Warn.Printf("-watch: cannot watch %q: %v", path.Join(pPath, name), err)
+		}
+	}
+	return nil
+}
+
+// openDir opens the ciphertext directory "cPath" for reading.
+// OpenDirNofollow returns an O_PATH file descriptor that Getdents cannot use.
+func (w *watcher) openDir(cPath string) (int, error) {
+	pathfd, err := syscallcompat.OpenDirNofollow(w.fs.args.Cipherdir, cPath)
+	if err != nil {
+		return -1, err
+	}
+	defer syscall.Close(pathfd)
+	return w.fs.openat(pathfd, ".", syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+}
+
+// decryptName decrypts "cName" in the directory "d", opened as "dirfd"
+func (w *watcher) decryptName(d *watchDir, dirfd int, cName string) (string, error) {
+	if w.fs.args.PlaintextNames {
+		return cName, nil
+	}
+	if name, ok := d.long[cName]; ok {
+		return name, nil
+	}
+	if d.iv == nil {
+		iv, err := w.fs.readDirIV(dirfd)
+		if err != nil {
+			return "", err
+		}
+		d.iv = iv
+	}
+	longName := cName
+	if nametransform.IsLongContent(cName) {
+		var err error
+		longName, err = nametransform.ReadLongNameAt(dirfd, cName)
+		if err != nil {
+			return "", err
+		}
+	}
+	name, err := w.fs.nameTransform.DecryptName(longName, d.iv)
+	if err != nil {
+		return "", err
+	}
+	if longName != cName {
+		d.long[cName] = name
+	}
+	return name, nil
+}
+
+// loop reads and handles inotify events until the file descriptor is closed
+func (w *watcher) loop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || n <= 0 {
+			tlog.Warn.Printf("-watch: reading inotify events failed: %v", err)
+			return
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)]
+			name := string(bytes.TrimRight(nameBytes, "\x00"))
+			w.handle(ev, name)
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+		}
+	}
+}
+
+// handle handles the inotify event "ev" for the entry "cName"
+func (w *watcher) handle(ev *unix.InotifyEvent, cName string) {
+	if ev.Mask&unix.IN_Q_OVERFLOW != 0 {
+		tlog.Warn.Printf("-watch: inotify queue overflow, events have been lost")
+		w.fs.watchPublish(ctlsock.WatchEvent{Op: ctlsock.WatchOverflow})
+		return
+	}
+	if ev.Mask&unix.IN_IGNORED != 0 {
+		delete(w.dirs, int(ev.Wd))
+		return
+	}
+	d := w.dirs[int(ev.Wd)]
+	if d == nil || cName == "" || w.fs.isInternalName(d.cPath, cName) {
+		return
+	}
+	dirfd, err := syscallcompat.OpenDirNofollow(w.fs.args.Cipherdir, d.cPath)
+	if err != nil {
+		return
+	}
+	name, err := w.decryptName(d, dirfd, cName)
+	syscall.Close(dirfd)
+	if err != nil {
+		tlog.Debug.Printf("-watch: cannot decrypt %q in %q: %v", cName, d.pPath, err)
+		return
+	}
+	cPath := path.Join(d.cPath, cName)
+	pPath := path.Join(d.pPath, name)
+	isDir := ev.Mask&unix.IN_ISDIR != 0
+	switch {
+	case ev.Mask&unix.IN_CLOSE_WRITE != 0:
+		w.fs.watchEvent(w.n, ctlsock.WatchModify, d.pPath, name)
+	case ev.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+		if isDir {
+			if ev.Mask&unix.IN_MOVED_TO != 0 && w.moveFrom != "" && ev.Cookie == w.moveCookie {
+				w.renameTree(w.moveFrom, cPath, pPath)
+				w.moveFrom = ""
+			} else if err := w.addTree(cPath, pPath); err != nil {
+				tlog.Warn.Printf("-watch: cannot watch %q: %v", pPath, err)
+			}
+		}
+		w.fs.watchEvent(w.n, ctlsock.WatchCreate, d.pPath, name)
+	case ev.Mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0:
+		delete(d.long, cName)
+		if isDir && ev.Mask&unix.IN_MOVED_FROM != 0 {
+			// The watches stay in place if the directory is moved within
+			// CIPHERDIR. If it is moved out, the watches are useless but
+			// harmless.
+			w.moveCookie = ev.Cookie
+			w.moveFrom = cPath
+		}
+		w.fs.watchEvent(w.n, ctlsock.WatchDelete, d.pPath, name)
+	}
+}
+
+// renameTree updates the paths of the watched directory "oldCPath" and the
+// directories below it after it has been moved to "newCPath".
+func (w *watcher) renameTree(oldCPath string, newCPath string, newPPath string) {
+	var oldPPath string
+	for _, d := range w.dirs {
+		if d.cPath == oldCPath {
+			oldPPath = d.pPath
+		}
+	}
+	for _, d := range w.dirs {
+		if d.cPath == oldCPath || strings.HasPrefix(d.cPath, oldCPath+"/") {
+			d.cPath = newCPath + strings.TrimPrefix(d.cPath, oldCPath)
+			d.pPath = newPPath + strings.TrimPrefix(d.pPath, oldPPath)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package fusefrontend
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// fakeNotifier records the invalidations it gets
+type fakeNotifier struct {
+	sync.Mutex
+	calls []string
+}
+
+func (n *fakeNotifier) EntryNotify(dir string, name string) fuse.Status {
+	n.Lock()
+	defer n.Unlock()
+	n.calls = append(n.calls, "entry "+dir+" "+name)
+	return fuse.OK
+}
+
+func (n *fakeNotifier) FileNotify(path string, off int64, length int64) fuse.Status {
+	n.Lock()
+	defer n.Unlock()
+	n.calls = append(n.calls, "file "+path)
+	return fuse.OK
+}
+
+// nextEvent waits for the next event on "events"
+func nextEvent(t *testing.T, events <-chan ctlsock.WatchEvent) ctlsock.WatchEvent {
+	t.Helper()
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatal("events channel has been closed")
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for event")
+	}
+	return ctlsock.WatchEvent{}
+}
+
+// TestWatch checks that changes are reported with their plaintext path,
+// including long names, and that internal files are not reported.
+func TestWatch(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir, Watch: true})
+	events, cancel := fs.Watch()
+	defer cancel()
+	n := &fakeNotifier{}
+	if err := fs.StartWatch(n); err != nil {
+		t.Fatal(err)
+	}
+	if code := fs.Mkdir("dir", 0700, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if ev := nextEvent(t, events); ev != (ctlsock.WatchEvent{Op: ctlsock.WatchCreate, Path: "dir"}) {
+		t.Errorf("wrong event: %+v", ev)
+	}
+	longName := "dir/" + strings.Repeat("x", 200)
+	f, code := fs.Create(longName, uint32(os.O_WRONLY), 0600, nil)
+	if !code.Ok() {
+		t.Fatal(code)
+	}
+	if ev := nextEvent(t, events); ev != (ctlsock.WatchEvent{Op: ctlsock.WatchCreate, Path: longName}) {
+		t.Errorf("wrong event: %+v", ev)
+	}
+	f.Write([]byte("foo"), 0)
+	f.Release()
+	if ev := nextEvent(t, events); ev != (ctlsock.WatchEvent{Op: ctlsock.WatchModify, Path: longName}) {
+		t.Errorf("wrong event: %+v", ev)
+	}
+	if code = fs.Unlink(longName, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if ev := nextEvent(t, events); ev != (ctlsock.WatchEvent{Op: ctlsock.WatchDelete, Path: longName}) {
+		t.Errorf("wrong event: %+v", ev)
+	}
+	n.Lock()
+	defer n.Unlock()
+	want := []string{"entry  dir", "entry dir " + longName[4:], "file " + longName, "entry dir " + longName[4:]}
+	if strings.Join(n.calls, "\n") != strings.Join(want, "\n") {
+		t.Errorf("wrong notifications:\n%s\nwant:\n%s", strings.Join(n.calls, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestWatchDisabled checks that there are no events without "-watch"
+func TestWatchDisabled(t *testing.T) {
+	fs := newTestFS(Args{Cipherdir: test_helpers.InitFS(t)})
+	events, cancel := fs.Watch()
+	defer cancel()
+	if events != nil {
+		t.Error("got an events channel without -watch")
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -20,13 +21,27 @@ var xattrNameIV = []byte("xattr_name_iv_xx")
 // encrypted original name.
 var xattrStorePrefix = "user.gocryptfs."
 
+// isAcl returns true if the attribute name is for storing POSIX ACLs.
+// ACLs are passed through to the backing file unencrypted: the backing
+// filesystem has to understand them to apply default ACLs to new files, and
+// they contain no file data.
+func isAcl(attr string) bool {
+	return attr == "system.posix_acl_access" || attr == "system.posix_acl_default"
+}
+
 // GetXAttr - FUSE call. Reads the value of extended attribute "attr".
 //
 // This function is symlink-safe through Fgetxattr.
 func (fs *FS) GetXAttr(relPath string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	if fs.isShownConf(relPath) {
+		return nil, fuse.ENOATTR
+	}
 	if fs.isFiltered(relPath) {
 		return nil, fuse.EPERM
 	}
+	if isAcl(attr) {
+		return fs.getXAttr(relPath, attr, context)
+	}
 	cAttr := fs.encryptXattrName(attr)
 
 	cData, status := fs.getXAttr(relPath, cAttr, context)
@@ -49,7 +64,13 @@ func (fs *FS) SetXAttr(relPath string, attr string, data []byte, flags int, cont
 	if fs.isFiltered(relPath) {
 		return fuse.EPERM
 	}
+	if code := fs.checkWritable(); !code.Ok() {
+		return code
+	}
 	flags = filterXattrSetFlags(flags)
+	if isAcl(attr) {
+		return fs.setXAttr(relPath, attr, data, flags, context)
+	}
 	cAttr := fs.encryptXattrName(attr)
 	cData := fs.encryptXattrValue(data)
 	return fs.setXAttr(relPath, cAttr, cData, flags, context)
@@ -62,6 +83,12 @@ func (fs *FS) RemoveXAttr(relPath string, attr string, context *fuse.Context) fu
 	if fs.isFiltered(relPath) {
 		return fuse.EPERM
 	}
+	if code := fs.checkWritable(); !code.Ok() {
+		return code
+	}
+	if isAcl(attr) {
+		return fs.removeXAttr(relPath, attr, context)
+	}
 	cAttr := fs.encryptXattrName(attr)
 	return fs.removeXAttr(relPath, cAttr, context)
 }
@@ -70,6 +97,9 @@ func (fs *FS) RemoveXAttr(relPath string, attr string, context *fuse.Context) fu
 //
 // This function is symlink-safe through Flistxattr.
 func (fs *FS) ListXAttr(relPath string, context *fuse.Context) ([]string, fuse.Status) {
+	if fs.isShownConf(relPath) {
+		return nil, fuse.OK
+	}
 	if fs.isFiltered(relPath) {
 		return nil, fuse.EPERM
 	}
@@ -81,15 +111,31 @@ func (fs *FS) ListXAttr(relPath string, context *fuse.Context) ([]string, fuse.S
 
 	names := make([]string, 0, len(cNames))
 	for _, curName := range cNames {
+		if isAcl(curName) {
+			names = append(names, curName)
+			continue
+		}
 		if !strings.HasPrefix(curName, xattrStorePrefix) {
 			continue
 		}
+		if curName == nametransform.DirIVXattr && fs.args.DirIVXattr {
+			// Internal, see nametransform/diriv_xattr.go
+			continue
+		}
 		name, err := fs.decryptXattrName(curName)
 		if err != nil {
 			tlog.Warn.Printf("ListXAttr: invalid xattr name %q: %v", curName, err)
 			fs.reportMitigatedCorruption(curName)
 			continue
 		}
+		if name == hiresTimeXattr || name == exactSizeXattr {
+			// Internal, see hirestime.go and exactsize.go
+			continue
+		}
+		if name == forkXattr && fs.args.MacOSForks {
+			// Shown as a "._" file, see macos_forks.go
+			continue
+		}
 		names = append(names, name)
 	}
 	return names, fuse.OK
@@ -0,0 +1,99 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+const (
+	aclAccess  = "system.posix_acl_access"
+	aclDefault = "system.posix_acl_default"
+)
+
+// testACL returns an ACL in the format of the kernel that gives the user
+// "uid" read and execute permissions, like "setfacl -m u:UID:rx".
+func testACL(uid uint32) []byte {
+	entries := []struct {
+		tag, perm uint16
+		id        uint32
+	}{
+		{0x01, 7, 0xffffffff}, // ACL_USER_OBJ
+		{0x02, 5, uid},        // ACL_USER
+		{0x04, 5, 0xffffffff}, // ACL_GROUP_OBJ
+		{0x10, 5, 0xffffffff}, // ACL_MASK
+		{0x20, 0, 0xffffffff}, // ACL_OTHER
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(2)) // POSIX_ACL_XATTR_VERSION
+	for _, e := range entries {
+		binary.Write(&buf, binary.LittleEndian, e)
+	}
+	return buf.Bytes()
+}
+
+// ACLs are stored on the backing file unencrypted, and a default ACL is
+// inherited by new directories.
+func TestACLPassthrough(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	acl := testACL(12345)
+	if code := fs.Mkdir("dir", 0755, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	code := fs.SetXAttr("dir", aclDefault, acl, 0, nil)
+	if code.Ok() {
+		code = fs.SetXAttr("dir", aclAccess, acl, 0, nil)
+	}
+	if code == _EOPNOTSUPP {
+		t.Skip("backing filesystem does not support ACLs")
+	} else if !code.Ok() {
+		t.Fatal(code)
+	}
+	cDir, _ := fs.EncryptPath("dir")
+	backing := filepath.Join(cipherdir, cDir)
+	if val, err := syscallcompat.Lgetxattr(backing, aclAccess); err != nil || !bytes.Equal(val, acl) {
+		t.Errorf("the backing directory should have the plain ACL: %v", err)
+	}
+	if val, code := fs.GetXAttr("dir", aclAccess, nil); !code.Ok() || !bytes.Equal(val, acl) {
+		t.Errorf("GetXAttr: %v", code)
+	}
+	names, code := fs.ListXAttr("dir", nil)
+	if !code.Ok() || len(names) != 2 {
+		t.Errorf("want both ACLs listed, got %q (%v)", names, code)
+	}
+
+	// The new directory inherits the default ACL. The requested mode limits
+	// the mask, like mkdir(2) does.
+	if code = fs.Mkdir("dir/sub", 0700, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	cSub, _ := fs.EncryptPath("dir/sub")
+	backing = filepath.Join(cipherdir, cSub)
+	if val, err := syscallcompat.Lgetxattr(backing, aclDefault); err != nil || !bytes.Equal(val, acl) {
+		t.Errorf("the default ACL has not been inherited: %v", err)
+	}
+	val, err := syscallcompat.Lgetxattr(backing, aclAccess)
+	if err != nil || !bytes.Contains(val, []byte{0x02, 0, 5, 0}) {
+		t.Errorf("the access ACL has not been inherited: %v", err)
+	}
+	var st syscall.Stat_t
+	if err = syscall.Stat(backing, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode&0777 != 0700 {
+		t.Errorf("want mode 0700, got %#o", st.Mode&0777)
+	}
+
+	if code = fs.RemoveXAttr("dir", aclAccess, nil); !code.Ok() {
+		t.Error(code)
+	}
+	if _, code = fs.GetXAttr("dir", aclAccess, nil); code.Ok() {
+		t.Error("the ACL should be gone")
+	}
+}
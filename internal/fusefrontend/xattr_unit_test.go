@@ -15,8 +15,10 @@ func newTestFS(args Args) *FS {
 	// Init crypto backend
 	key := make([]byte, cryptocore.KeyLen)
 	cCore := cryptocore.New(key, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true, false)
-	cEnc := contentenc.New(cCore, contentenc.DefaultBS, false)
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS, false, false)
 	nameTransform := nametransform.New(cCore.EMECipher, true, true)
+	nameTransform.SetFlat(args.Flat)
+	nameTransform.SetDirIVXattr(args.DirIVXattr)
 	return NewFS(args, cEnc, nameTransform)
 }
 
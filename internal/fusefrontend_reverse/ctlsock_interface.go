@@ -3,11 +3,15 @@ package fusefrontend_reverse
 import (
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"golang.org/x/sys/unix"
 
+	"github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/ctlsocksrv"
 	"github.com/rfjakob/gocryptfs/internal/pathiv"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 )
 
 var _ ctlsocksrv.Interface = &ReverseFS{} // Verify that interface is implemented.
@@ -31,6 +35,45 @@ func (rfs *ReverseFS) EncryptPath(plainPath string) (string, error) {
 	return cipherPath, nil
 }
 
+var _ ctlsocksrv.PathInfoInterface = &ReverseFS{} // Verify that interface is implemented.
+
+// PathInfo implements ctlsocksrv.PathInfoInterface. Only works on regular
+// files, fails with EINVAL otherwise.
+func (rfs *ReverseFS) PathInfo(plainPath string) (*ctlsock.PathInfo, error) {
+	if rfs.isExcludedPlain(plainPath) {
+		return nil, syscall.ENOENT
+	}
+	dirfd, pName, err := rfs.openBackingDir(plainPath)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(dirfd)
+	var st unix.Stat_t
+	err = syscallcompat.Fstatat(dirfd, pName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return nil, err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return nil, syscall.EINVAL
+	}
+	cPath, err := rfs.EncryptPath(plainPath)
+	if err != nil {
+		return nil, err
+	}
+	cipherSize := rfs.contentEnc.PlainSizeToCipherSize(uint64(st.Size))
+	info := &ctlsock.PathInfo{
+		CipherPath:  cPath,
+		PlainSize:   uint64(st.Size),
+		CipherSize:  cipherSize,
+		Blocks:      rfs.contentEnc.CipherSizeToBlocks(cipherSize),
+		HeaderBytes: contentenc.MinUint64(cipherSize, contentenc.HeaderLen),
+	}
+	if info.PlainSize > 0 {
+		info.Overhead = float64(info.CipherSize) / float64(info.PlainSize)
+	}
+	return info, nil
+}
+
 // DecryptPath implements ctlsock.Backend
 func (rfs *ReverseFS) DecryptPath(cipherPath string) (string, error) {
 	p, err := rfs.decryptPath(cipherPath)
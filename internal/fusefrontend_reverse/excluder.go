@@ -60,7 +60,8 @@ func getLines(file string) ([]string, error) {
 }
 
 // isExcludedPlain finds out if the plaintext path "pPath" is
-// excluded (used when -exclude is passed by the user).
+// excluded (used when -exclude or -reverse-include is passed by the user).
+// -exclude wins over -reverse-include.
 func (rfs *ReverseFS) isExcludedPlain(pPath string) bool {
-	return rfs.excluder != nil && rfs.excluder.MatchesPath(pPath)
+	return rfs.excluder != nil && rfs.excluder.MatchesPath(pPath) || !rfs.isIncludedPlain(pPath)
 }
@@ -0,0 +1,94 @@
+package fusefrontend_reverse
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// prepareIncluder splits the "-reverse-include" patterns into their path
+// components. Every component is a shell pattern as understood by
+// filepath.Match.
+func (rfs *ReverseFS) prepareIncluder(args fusefrontend.Args) {
+	for _, p := range args.ReverseInclude {
+		p = strings.Trim(filepath.Clean(p), "/")
+		if p == "" || p == "." || strings.HasPrefix(p, "../") || p == ".." {
+			tlog.Fatal.Printf("-reverse-include: %q is not a relative path", p)
+			os.Exit(exitcodes.ExcludeError)
+		}
+		parts := strings.Split(p, "/")
+		for _, part := range parts {
+			if _, err := filepath.Match(part, ""); err != nil {
+				tlog.Fatal.Printf("-reverse-include: invalid pattern %q: %v", p, err)
+				os.Exit(exitcodes.ExcludeError)
+			}
+		}
+		rfs.includes = append(rfs.includes, parts)
+	}
+}
+
+// matchInclude compares the components of a path with those of an include
+// pattern, as far as both go. It returns true if they match, and "full" if
+// the path is the match itself or inside it, and not only one of its
+// ancestors.
+func matchInclude(pattern []string, parts []string) (match bool, full bool) {
+	for i := 0; i < len(parts) && i < len(pattern); i++ {
+		if ok, _ := filepath.Match(pattern[i], parts[i]); !ok {
+			return false, false
+		}
+	}
+	return true, len(parts) >= len(pattern)
+}
+
+// isIncludedPlain finds out if the plaintext path "pPath" is visible with
+// "-reverse-include": it matches a pattern, is inside a matching
+// directory, or is a directory that is an ancestor of possible matches.
+// Always true without "-reverse-include".
+func (rfs *ReverseFS) isIncludedPlain(pPath string) bool {
+	if rfs.includes == nil || pPath == "" {
+		return true
+	}
+	parts := strings.Split(pPath, "/")
+	ancestor := false
+	for _, pattern := range rfs.includes {
+		match, full := matchInclude(pattern, parts)
+		if full {
+			return true
+		}
+		ancestor = ancestor || match
+	}
+	return ancestor && rfs.isDirPlain(pPath)
+}
+
+// isConfigEntry returns true if "name" in the plaintext directory "pDir"
+// is the config file that is shown as gocryptfs.conf. With
+// "-plaintextnames", openDirPlaintextnames has already translated the
+// name.
+func (rfs *ReverseFS) isConfigEntry(pDir string, name string) bool {
+	if pDir != "" || rfs.args.ConfigCustom {
+		return false
+	}
+	return name == configfile.ConfReverseName || rfs.args.PlaintextNames && name == configfile.ConfDefaultName
+}
+
+// isDirPlain returns true if "pPath" is a directory. Symlinks are not
+// followed.
+func (rfs *ReverseFS) isDirPlain(pPath string) bool {
+	dirfd, name, err := rfs.openBackingDir(pPath)
+	if err != nil {
+		return false
+	}
+	defer syscall.Close(dirfd)
+	var st unix.Stat_t
+	err = syscallcompat.Fstatat(dirfd, name, &st, unix.AT_SYMLINK_NOFOLLOW)
+	return err == nil && st.Mode&syscall.S_IFMT == syscall.S_IFDIR
+}
@@ -0,0 +1,97 @@
+package fusefrontend_reverse
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+)
+
+// newIncludeRFS creates a plaintext tree and a ReverseFS on top of it with
+// the include and exclude patterns from "args"
+func newIncludeRFS(t *testing.T, args fusefrontend.Args) *ReverseFS {
+	dir, err := ioutil.TempDir("", "includer_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"Documents/sub", "Photos/2019", "Photos/2020", "Music"} {
+		if err = os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"Documents/a.txt", "Documents/sub/b.txt", "Photos/2019/x.jpg",
+		"Photos/2020/y.jpg", "Music/song.ogg", "notes", configfile.ConfReverseName} {
+		if err = ioutil.WriteFile(filepath.Join(dir, f), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args.Cipherdir = dir
+	var rfs ReverseFS
+	rfs.args = args
+	rfs.prepareExcluder(args)
+	rfs.prepareIncluder(args)
+	return &rfs
+}
+
+func TestShouldNotCreateIncluderIfNoPatternsWereSpecified(t *testing.T) {
+	rfs := newIncludeRFS(t, fusefrontend.Args{})
+	defer os.RemoveAll(rfs.args.Cipherdir)
+	if rfs.includes != nil || rfs.isExcludedPlain("Music/song.ogg") {
+		t.Error("everything should be included")
+	}
+}
+
+func TestShouldOnlyIncludeMatchesAndTheirAncestors(t *testing.T) {
+	rfs := newIncludeRFS(t, fusefrontend.Args{ReverseInclude: []string{"Documents", "Photos/2020*"}})
+	defer os.RemoveAll(rfs.args.Cipherdir)
+	visible := []string{"Documents", "Documents/a.txt", "Documents/sub/b.txt",
+		"Photos", "Photos/2020", "Photos/2020/y.jpg"}
+	hidden := []string{"Music", "Music/song.ogg", "notes", "Photos/2019", "Photos/2019/x.jpg"}
+	for _, p := range visible {
+		if rfs.isExcludedPlain(p) {
+			t.Errorf("%q should be visible", p)
+		}
+	}
+	for _, p := range hidden {
+		if !rfs.isExcludedPlain(p) {
+			t.Errorf("%q should be hidden", p)
+		}
+	}
+	entries := []fuse.DirEntry{{Name: "Documents"}, {Name: "Music"}, {Name: "Photos"},
+		{Name: "notes"}, {Name: configfile.ConfReverseName}}
+	got := rfs.excludeDirEntries("", entries)
+	want := []fuse.DirEntry{{Name: "Documents"}, {Name: "Photos"}, {Name: configfile.ConfReverseName}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+// Only directories are traversable ancestors. A file with the name of an
+// ancestor is hidden.
+func TestShouldHideFilesThatAreOnlyAncestors(t *testing.T) {
+	rfs := newIncludeRFS(t, fusefrontend.Args{ReverseInclude: []string{"notes/today", "Music/*.ogg"}})
+	defer os.RemoveAll(rfs.args.Cipherdir)
+	if !rfs.isExcludedPlain("notes") {
+		t.Error("the file \"notes\" should be hidden")
+	}
+	if rfs.isExcludedPlain("Music") || rfs.isExcludedPlain("Music/song.ogg") {
+		t.Error("Music/song.ogg and its directory should be visible")
+	}
+}
+
+func TestExcludeShouldWinOverInclude(t *testing.T) {
+	rfs := newIncludeRFS(t, fusefrontend.Args{ReverseInclude: []string{"Documents"}, Exclude: []string{"Documents/sub"}})
+	defer os.RemoveAll(rfs.args.Cipherdir)
+	if rfs.isExcludedPlain("Documents/a.txt") {
+		t.Error("Documents/a.txt should be visible")
+	}
+	if !rfs.isExcludedPlain("Documents/sub") || !rfs.isExcludedPlain("Documents/sub/b.txt") {
+		t.Error("Documents/sub should be excluded")
+	}
+}
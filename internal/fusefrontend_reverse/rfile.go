@@ -93,7 +93,7 @@ func (rfs *ReverseFS) newFile(relPath string, pRelPath string) (*reverseFile, fu
 		}
 	}
 	header := contentenc.FileHeader{
-		Version: contentenc.CurrentVersion,
+		Version: rfs.contentEnc.HeaderVersion(),
 		ID:      derivedIVs.ID,
 	}
 	return &reverseFile{
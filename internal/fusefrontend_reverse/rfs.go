@@ -39,6 +39,9 @@ type ReverseFS struct {
 	contentEnc *contentenc.ContentEnc
 	// Tests whether a path is excluded (hiden) from the user. Used by -exclude.
 	excluder ignore.IgnoreParser
+	// includes are the "-reverse-include" patterns, split into path
+	// components. Nil if everything is included.
+	includes [][]string
 	// inoMap translates inode numbers from different devices to unique inode
 	// numbers.
 	inoMap *inomap.InoMap
@@ -61,6 +64,7 @@ func NewFS(args fusefrontend.Args, c *contentenc.ContentEnc, n nametransform.Nam
 		inoMap:        inomap.New(),
 	}
 	fs.prepareExcluder(args)
+	fs.prepareIncluder(args)
 	return fs
 }
 
@@ -237,7 +241,11 @@ func (rfs *ReverseFS) GetAttr(relPath string, context *fuse.Context) (*fuse.Attr
 	var a fuse.Attr
 	a.FromStat(&st)
 	// Calculate encrypted file size
-	if a.IsRegular() {
+	if a.IsRegular() && rfs.args.ReverseNameOnly {
+		// Files are presented as empty, see Open()
+		a.Size = 0
+		a.Blocks = 0
+	} else if a.IsRegular() {
 		a.Size = rfs.contentEnc.PlainSizeToCipherSize(a.Size)
 	} else if a.IsSymlink() {
 		var linkTarget string
@@ -301,6 +309,18 @@ func (rfs *ReverseFS) Open(relPath string, flags uint32, context *fuse.Context)
 	if ftype == typeName {
 		return rfs.newNameFile(relPath)
 	}
+	if rfs.args.ReverseNameOnly {
+		// "-reverse-name-only": open the backing file to get the same error
+		// handling as usual, but present it as empty. An empty file is
+		// also what an empty plaintext file encrypts to, so the result is
+		// a valid (if incomplete) gocryptfs ciphertext tree.
+		f, status := rfs.newFile(relPath, pPath)
+		if !status.Ok() {
+			return nil, status
+		}
+		f.Release()
+		return nodefs.NewDataFile(nil), fuse.OK
+	}
 	return rfs.newFile(relPath, pPath)
 }
 
@@ -410,7 +430,7 @@ func (rfs *ReverseFS) OpenDir(cipherPath string, context *fuse.Context) ([]fuse.
 // pDir is the relative plaintext path to the directory these entries are
 // from. The entries should be plaintext files.
 func (rfs *ReverseFS) excludeDirEntries(pDir string, entries []fuse.DirEntry) (filtered []fuse.DirEntry) {
-	if rfs.excluder == nil {
+	if rfs.excluder == nil && rfs.includes == nil {
 		return entries
 	}
 	filtered = make([]fuse.DirEntry, 0, len(entries))
@@ -418,6 +438,13 @@ func (rfs *ReverseFS) excludeDirEntries(pDir string, entries []fuse.DirEntry) (f
 		// filepath.Join handles the case of pDir="" correctly:
 		// Join("", "foo") -> "foo". This does not: pDir + "/" + name"
 		p := filepath.Join(pDir, entry.Name)
+		if rfs.isConfigEntry(pDir, entry.Name) {
+			// The config file is not subject to -reverse-include
+			if rfs.excluder == nil || !rfs.excluder.MatchesPath(p) {
+				filtered = append(filtered, entry)
+			}
+			continue
+		}
 		if rfs.isExcludedPlain(p) {
 			// Skip file
 			continue
@@ -1,9 +1,15 @@
 package fusefrontend_reverse
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 )
 
@@ -122,3 +128,65 @@ func TestShouldDecryptPathAndReturnTrueForExcludedPath(t *testing.T) {
 		t.Error("Didn't call IgnoreParser with decrypted path")
 	}
 }
+
+// TestReverseNameOnly checks that "-reverse-name-only" presents files as
+// empty, but uses the same encrypted names as a normal reverse mount.
+func TestReverseNameOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestReverseNameOnly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = os.Mkdir(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "sub/file"), []byte("secret content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key := make([]byte, cryptocore.KeyLen)
+	cCore := cryptocore.New(key, cryptocore.BackendAESSIV, contentenc.DefaultIVBits, true, false)
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS, false, false)
+	nameTransform := nametransform.New(cCore.EMECipher, true, true)
+	full := NewFS(fusefrontend.Args{Cipherdir: dir, LongNames: true}, cEnc, nameTransform)
+	nameOnly := NewFS(fusefrontend.Args{Cipherdir: dir, LongNames: true, ReverseNameOnly: true}, cEnc, nameTransform)
+
+	cPath, _ := full.EncryptPath("sub/file")
+	cPath2, _ := nameOnly.EncryptPath("sub/file")
+	if cPath != cPath2 {
+		t.Fatalf("encrypted names differ: %q vs %q", cPath, cPath2)
+	}
+	entries, status := nameOnly.OpenDir(filepath.Dir(cPath), nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	found := false
+	for _, e := range entries {
+		if e.Name == filepath.Base(cPath) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("%q not in listing %v", cPath, entries)
+	}
+	a, status := full.GetAttr(cPath, nil)
+	if !status.Ok() || a.Size == 0 {
+		t.Errorf("full: GetAttr: size=%d status=%v", a.Size, status)
+	}
+	a, status = nameOnly.GetAttr(cPath, nil)
+	if !status.Ok() || a.Size != 0 {
+		t.Errorf("name-only: GetAttr: size=%d status=%v", a.Size, status)
+	}
+	f, status := nameOnly.Open(cPath, uint32(os.O_RDONLY), nil)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	defer f.Release()
+	buf := make([]byte, 100)
+	res, status := f.Read(buf, 0)
+	if !status.Ok() {
+		t.Fatal(status)
+	}
+	if res.Size() != 0 {
+		t.Errorf("name-only: read %d bytes, want 0", res.Size())
+	}
+}
@@ -8,9 +8,10 @@ type namespaceData struct {
 	// Stat_t.Dev is uint64 on 32- and 64-bit Linux
 	Dev uint64
 	// Tag acts like an extension of the Dev field.
-	// It is used by reverse mode for virtual files.
-	// Normal (forward) mode does not use it and it
-	// stays always zero there.
+	// It is used by reverse mode for virtual files,
+	// and by forward mode for the virtual AppleDouble
+	// files of "-macos-forks". Backing files always
+	// have tag zero.
 	Tag uint8
 }
 
@@ -0,0 +1,27 @@
+// Package keyring caches master keys in the Linux kernel keyring, see
+// "-use-keyring". The keys live in the session keyring of the user, so
+// they are only visible to the processes of the login session, and the
+// kernel removes them when their timeout expires.
+package keyring
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+var (
+	// ErrUnsupported is returned on platforms without a kernel keyring
+	ErrUnsupported = errors.New("the kernel keyring is only supported on Linux")
+	// ErrNotFound is returned if there is no key with the description,
+	// for example because it has expired
+	ErrNotFound = errors.New("key not found")
+)
+
+// Description returns the key description for the config file with the
+// contents "conf". Any change of the config file, like a new password,
+// gives a new description, so an outdated key is never used.
+func Description(conf []byte) string {
+	h := sha256.Sum256(conf)
+	return "gocryptfs:" + hex.EncodeToString(h[:])
+}
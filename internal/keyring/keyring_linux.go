@@ -0,0 +1,85 @@
+package keyring
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/mlock"
+)
+
+// keyType is the kernel key type. The payload of "user" keys can be read
+// back by the processes that possess the key.
+const keyType = "user"
+
+// maxKeyLen is the largest key Load reads back
+const maxKeyLen = 64
+
+// Store puts "key" into the session keyring under the description "desc",
+// replacing an existing key. The kernel removes it after "ttl".
+func Store(desc string, key []byte, ttl time.Duration) error {
+	// Passing KEY_SPEC_SESSION_KEYRING to add_key directly would create a new
+	// session keyring that only this process uses if it does not have one.
+	// Looking it up without "create" falls back to the user session keyring
+	// instead.
+	ring, err := unix.KeyctlGetKeyringID(unix.KEY_SPEC_SESSION_KEYRING, false)
+	if err != nil {
+		return err
+	}
+	id, err := unix.AddKey(keyType, desc, key, ring)
+	if err != nil {
+		return err
+	}
+	// Round up, a timeout of 0 would mean "never expire"
+	secs := int((ttl + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	if _, err = unix.KeyctlInt(unix.KEYCTL_SET_TIMEOUT, id, secs, 0, 0); err != nil {
+		// Do not leave a key behind that never expires
+		unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0)
+		return err
+	}
+	return nil
+}
+
+// search returns the ID of the key stored under "desc". Fails with
+// ErrNotFound if there is none.
+func search(desc string) (int, error) {
+	id, err := unix.KeyctlSearch(unix.KEY_SPEC_SESSION_KEYRING, keyType, desc, 0)
+	// An expired key stays visible for a moment until the kernel collects it
+	if err == unix.ENOKEY || err == unix.EKEYEXPIRED || err == unix.EKEYREVOKED {
+		return -1, ErrNotFound
+	}
+	return id, err
+}
+
+// Load returns the key stored under "desc". Fails with ErrNotFound if there
+// is none.
+func Load(desc string) ([]byte, error) {
+	id, err := search(desc)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxKeyLen)
+	mlock.Lock(buf)
+	n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	if n > len(buf) {
+		return nil, unix.EMSGSIZE
+	}
+	return buf[:n], nil
+}
+
+// Clear removes the key stored under "desc" from all keyrings.
+// Fails with ErrNotFound if there is none.
+func Clear(desc string) error {
+	id, err := search(desc)
+	if err != nil {
+		return err
+	}
+	_, err = unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0)
+	return err
+}
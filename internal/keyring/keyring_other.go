@@ -0,0 +1,22 @@
+// +build !linux
+
+package keyring
+
+import (
+	"time"
+)
+
+// Store returns ErrUnsupported
+func Store(desc string, key []byte, ttl time.Duration) error {
+	return ErrUnsupported
+}
+
+// Load returns ErrUnsupported
+func Load(desc string) ([]byte, error) {
+	return nil, ErrUnsupported
+}
+
+// Clear returns ErrUnsupported
+func Clear(desc string) error {
+	return ErrUnsupported
+}
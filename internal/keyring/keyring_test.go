@@ -0,0 +1,59 @@
+// +build linux
+
+package keyring
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestStoreLoadClear(t *testing.T) {
+	desc := Description([]byte("TestStoreLoadClear"))
+	key := bytes.Repeat([]byte{0xaa}, 32)
+	if err := Store(desc, key, time.Minute); err != nil {
+		t.Skipf("kernel keyring not available: %v", err)
+	}
+	defer Clear(desc)
+	got, err := Load(desc)
+	if err != nil || !bytes.Equal(got, key) {
+		t.Fatalf("want %x, got %x, %v", key, got, err)
+	}
+	// Storing again replaces the key
+	key2 := bytes.Repeat([]byte{0xbb}, 32)
+	if err = Store(desc, key2, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = Load(desc); !bytes.Equal(got, key2) {
+		t.Errorf("want %x, got %x", key2, got)
+	}
+	if err = Clear(desc); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Load(desc); err != ErrNotFound {
+		t.Errorf("want ErrNotFound after Clear, got %v", err)
+	}
+	if err = Clear(desc); err != ErrNotFound {
+		t.Errorf("want ErrNotFound for a second Clear, got %v", err)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	desc := Description([]byte("TestExpire"))
+	if err := Store(desc, []byte("key"), time.Millisecond); err != nil {
+		t.Skipf("kernel keyring not available: %v", err)
+	}
+	defer Clear(desc)
+	// The timeout is rounded up to one second
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := Load(desc); err != ErrNotFound {
+		t.Errorf("want ErrNotFound, got %v", err)
+	}
+}
+
+func TestDescription(t *testing.T) {
+	d1 := Description([]byte("a"))
+	if d1 == Description([]byte("b")) || d1 != Description([]byte("a")) {
+		t.Error("the description must depend on the config file, and only on it")
+	}
+}
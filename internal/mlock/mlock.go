@@ -0,0 +1,53 @@
+// Package mlock locks buffers holding key material into RAM, so that they
+// are not written to swap ("-mlock").
+package mlock
+
+import (
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+var (
+	// enabled is set by Enable. Lock is a no-op otherwise.
+	enabled bool
+	// strict makes a failed Lock call fatal ("-mlock-strict")
+	strict bool
+	// warnOnce makes sure we warn only once, not for every buffer
+	warnOnce sync.Once
+)
+
+// Enable turns on locking. It must be called before any key material
+// is read, and before other goroutines are started.
+func Enable(strictArg bool) {
+	enabled = true
+	strict = strictArg
+}
+
+// Lock locks the memory pages holding "b" into RAM, if enabled.
+//
+// On failure, which usually means that RLIMIT_MEMLOCK is too low, a warning
+// is printed (once), or, in strict mode, we exit.
+//
+// The pages stay locked until the process exits. Locks do not stack, and
+// the pages may be shared with other locked buffers, so there is no Unlock.
+func Lock(b []byte) {
+	if !enabled || len(b) == 0 {
+		return
+	}
+	err := unix.Mlock(b)
+	if err == nil {
+		return
+	}
+	if strict {
+		tlog.Fatal.Printf("mlock failed: %v. Raise the memlock limit (\"ulimit -l\") or drop -mlock-strict.", err)
+		os.Exit(exitcodes.Mlock)
+	}
+	warnOnce.Do(func() {
+		tlog.Warn.Printf("mlock failed: %v. Key material may be written to swap. Raise the memlock limit (\"ulimit -l\") to fix this.", err)
+	})
+}
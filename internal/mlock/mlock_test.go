@@ -0,0 +1,47 @@
+package mlock
+
+import (
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// vmLck returns the amount of locked memory of this process in kiB, as
+// reported by /proc/self/status
+func vmLck(t *testing.T) int {
+	status, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		t.Skip(err)
+	}
+	m := regexp.MustCompile(`VmLck:\s+(\d+) kB`).FindSubmatch(status)
+	if m == nil {
+		t.Skip("no VmLck in /proc/self/status")
+	}
+	kb, _ := strconv.Atoi(string(m[1]))
+	return kb
+}
+
+func TestLock(t *testing.T) {
+	buf := make([]byte, 3*unix.Getpagesize())
+	// Disabled: must not lock anything
+	Lock(buf)
+	if vmLck(t) != 0 {
+		t.Fatal("Lock locked memory although it is not enabled")
+	}
+	Enable(true)
+	defer func() { enabled = false; strict = false }()
+	// Find out if we are allowed to lock memory at all. Lock itself would
+	// exit in strict mode.
+	if err := unix.Mlock(buf[:1]); err != nil {
+		t.Skipf("mlock is not allowed here: %v", err)
+	}
+	unix.Munlock(buf[:1])
+	Lock(buf)
+	defer unix.Munlock(buf)
+	if vmLck(t) < 3*unix.Getpagesize()/1024 {
+		t.Errorf("VmLck=%d kB, too small", vmLck(t))
+	}
+}
@@ -16,7 +16,8 @@ import (
 const (
 	// DirIVLen is identical to AES block size
 	DirIVLen = 16
-	// DirIVFilename is the filename used to store directory IV.
+	// DirIVFilename is the default filename used to store directory IV,
+	// see SetDirIVName.
 	// Exported because we have to ignore this name in directory listing.
 	DirIVFilename = "gocryptfs.diriv"
 )
@@ -24,12 +25,17 @@ const (
 // ReadDirIVAt reads "gocryptfs.diriv" from the directory that is opened as "dirfd".
 // Using the dirfd makes it immune to concurrent renames of the directory.
 func ReadDirIVAt(dirfd int) (iv []byte, err error) {
-	fdRaw, err := syscallcompat.Openat(dirfd, DirIVFilename,
+	return readDirIVAt(dirfd, DirIVFilename)
+}
+
+// readDirIVAt is ReadDirIVAt for the DirIV file "name".
+func readDirIVAt(dirfd int, name string) (iv []byte, err error) {
+	fdRaw, err := syscallcompat.Openat(dirfd, name,
 		syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
 	if err != nil {
 		return nil, err
 	}
-	fd := os.NewFile(uintptr(fdRaw), DirIVFilename)
+	fd := os.NewFile(uintptr(fdRaw), name)
 	defer fd.Close()
 	return fdReadDirIV(fd)
 }
@@ -46,7 +52,11 @@ func fdReadDirIV(fd *os.File) (iv []byte, err error) {
 	if err != nil && err != io.EOF {
 		return nil, fmt.Errorf("read failed: %v", err)
 	}
-	iv = iv[0:n]
+	return checkDirIV(iv[0:n])
+}
+
+// checkDirIV verifies the length and content of a DirIV read from disk.
+func checkDirIV(iv []byte) ([]byte, error) {
 	if len(iv) != DirIVLen {
 		return nil, fmt.Errorf("wanted %d bytes, got %d", DirIVLen, len(iv))
 	}
@@ -61,6 +71,23 @@ func fdReadDirIV(fd *os.File) (iv []byte, err error) {
 // This function is exported because it is used from fusefrontend, main,
 // and also the automated tests.
 func WriteDirIVAt(dirfd int) error {
+	return WriteDirIVNameAt(dirfd, DirIVFilename)
+}
+
+// WriteDirIVNameAt is WriteDirIVAt for the DirIV file "name", see
+// SetDirIVName.
+func WriteDirIVNameAt(dirfd int, name string) error {
+	return restoreDirIVAt(dirfd, name, cryptocore.RandBytes(DirIVLen))
+}
+
+// RestoreDirIVAt is like WriteDirIVAt but writes "iv" instead of a random IV.
+// It is used to put back a gocryptfs.diriv file that has been deleted.
+func RestoreDirIVAt(dirfd int, iv []byte) error {
+	return restoreDirIVAt(dirfd, DirIVFilename, iv)
+}
+
+// restoreDirIVAt is RestoreDirIVAt for the DirIV file "name".
+func restoreDirIVAt(dirfd int, name string, iv []byte) error {
 	// It makes sense to have the diriv files group-readable so the FS can
 	// be mounted from several users from a network drive (see
 	// https://github.com/rfjakob/gocryptfs/issues/387 ).
@@ -69,40 +96,39 @@ func WriteDirIVAt(dirfd int) error {
 	// owner must explicitly chmod it to permit access.
 	const dirivPerms = 0440
 
-	iv := cryptocore.RandBytes(DirIVLen)
 	// 0400 permissions: gocryptfs.diriv should never be modified after creation.
 	// Don't use "ioutil.WriteFile", it causes trouble on NFS:
 	// https://github.com/rfjakob/gocryptfs/commit/7d38f80a78644c8ec4900cc990bfb894387112ed
-	fd, err := syscallcompat.Openat(dirfd, DirIVFilename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, dirivPerms)
+	fd, err := syscallcompat.Openat(dirfd, name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, dirivPerms)
 	if err != nil {
-		tlog.Warn.Printf("WriteDirIV: Openat: %v", err)
+		tlog.Warn.Printf("WriteDirIV: creating %s failed: %v%s", name, err, syscallcompat.DeniedHint(err))
 		return err
 	}
 	// Wrap the fd in an os.File - we need the write retry logic.
-	f := os.NewFile(uintptr(fd), DirIVFilename)
+	f := os.NewFile(uintptr(fd), name)
 	_, err = f.Write(iv)
 	if err != nil {
 		f.Close()
 		// It is normal to get ENOSPC here
 		if !syscallcompat.IsENOSPC(err) {
-			tlog.Warn.Printf("WriteDirIV: Write: %v", err)
+			tlog.Warn.Printf("WriteDirIV: writing %s failed: %v%s", name, err, syscallcompat.DeniedHint(err))
 		}
 		// Delete incomplete gocryptfs.diriv file
-		syscallcompat.Unlinkat(dirfd, DirIVFilename, 0)
+		syscallcompat.Unlinkat(dirfd, name, 0)
 		return err
 	}
 	err = f.Close()
 	if err != nil {
-		tlog.Warn.Printf("WriteDirIV: Close: %v", err)
+		tlog.Warn.Printf("WriteDirIV: closing %s failed: %v", name, err)
 		// Delete incomplete gocryptfs.diriv file
-		syscallcompat.Unlinkat(dirfd, DirIVFilename, 0)
+		syscallcompat.Unlinkat(dirfd, name, 0)
 		return err
 	}
 	return nil
 }
 
 // encryptAndHashName encrypts "name" and hashes it to a longname if it is
-// too long.
+// longer than the threshold set by SetLongNameMax.
 // Returns ENAMETOOLONG if "name" is longer than 255 bytes.
 func (be *NameTransform) EncryptAndHashName(name string, iv []byte) (string, error) {
 	// Prevent the user from creating files longer than 255 chars.
@@ -110,7 +136,7 @@ func (be *NameTransform) EncryptAndHashName(name string, iv []byte) (string, err
 		return "", syscall.ENAMETOOLONG
 	}
 	cName := be.EncryptName(name, iv)
-	if be.longNames && len(cName) > NameMax {
+	if be.longNames && len(cName) > be.longNameMax {
 		return be.HashLongName(cName), nil
 	}
 	return cName, nil
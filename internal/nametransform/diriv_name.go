@@ -0,0 +1,56 @@
+package nametransform
+
+import (
+	"fmt"
+	"strings"
+)
+
+// b64Chars are the characters that can appear in an encrypted name, in both
+// padded and unpadded base64url encoding.
+const b64Chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_="
+
+// confNames are the names of the config files, configfile.ConfDefaultName
+// and configfile.ConfReverseName. configfile imports this package, so we
+// cannot use its constants.
+var confNames = []string{"gocryptfs.conf", ".gocryptfs.reverse.conf"}
+
+// CheckDirIVName checks if "name" can be used as the name of the DirIV
+// files, see SetDirIVName. It must be a valid file name that can never
+// collide with an encrypted or a long name, or with the config file and the
+// ".bak" and ".tmp" files that are created next to it.
+func CheckDirIVName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("%q is not a valid file name", name)
+	}
+	if len(name) > NameMax {
+		return fmt.Errorf("%q is longer than %d bytes", name, NameMax)
+	}
+	if strings.Trim(name, b64Chars) == "" {
+		return fmt.Errorf("%q could be an encrypted name, it must contain a character like '.'", name)
+	}
+	if NameType(name) != LongNameNone {
+		return fmt.Errorf("%q could be a long name, it must not start with %q", name, longNamePrefix)
+	}
+	for _, c := range confNames {
+		if strings.HasPrefix(name, c) {
+			return fmt.Errorf("%q is reserved for the config file, it must not start with %q", name, c)
+		}
+	}
+	return nil
+}
+
+// SetDirIVName sets the name of the DirIV files (the "DirIVName" feature
+// flag). The default is DirIVFilename.
+func (n *NameTransform) SetDirIVName(name string) error {
+	if err := CheckDirIVName(name); err != nil {
+		return err
+	}
+	n.dirIVName = name
+	return nil
+}
+
+// DirIVName returns the name of the DirIV files. Like DirIVFilename, it is
+// hidden from directory listings.
+func (n *NameTransform) DirIVName() string {
+	return n.dirIVName
+}
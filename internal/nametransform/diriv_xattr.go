@@ -0,0 +1,53 @@
+package nametransform
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// DirIVXattr is the name of the xattr that holds the DirIV of a directory
+// when the "DirIVXattr" feature flag is set. Like gocryptfs.diriv, it is
+// stored as plain bytes.
+const DirIVXattr = "user.gocryptfs.diriv"
+
+// SetDirIVXattr enables or disables storing the DirIVs in the DirIVXattr xattr
+// of each directory instead of a gocryptfs.diriv file (the "DirIVXattr"
+// feature flag).
+func (n *NameTransform) SetDirIVXattr(enable bool) {
+	n.dirIVXattr = enable
+}
+
+// ReadDirIVXattrAt reads the DirIVXattr xattr of the directory that is opened
+// as "dirfd". A missing xattr is reported as ENOENT.
+func ReadDirIVXattrAt(dirfd int) (iv []byte, err error) {
+	// One byte more so we detect values that are too long
+	iv = make([]byte, DirIVLen+1)
+	n, err := syscallcompat.DirGetxattr(dirfd, DirIVXattr, iv)
+	if err == syscall.ERANGE {
+		return nil, fmt.Errorf("wanted %d bytes, got more", DirIVLen)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return checkDirIV(iv[:n])
+}
+
+// WriteDirIVXattrAt stores a new random DirIV in the DirIVXattr xattr of the
+// directory opened as "dirfd". Fails if the directory already has one.
+func WriteDirIVXattrAt(dirfd int) error {
+	err := syscallcompat.DirSetxattr(dirfd, DirIVXattr, cryptocore.RandBytes(DirIVLen), unix.XATTR_CREATE)
+	if err != nil {
+		hint := syscallcompat.DeniedHint(err)
+		if err == syscall.ENOTSUP {
+			hint = " (the backing filesystem does not support extended attributes)"
+		}
+		tlog.Warn.Printf("WriteDirIV: setting xattr %s failed: %v%s", DirIVXattr, err, hint)
+	}
+	return err
+}
@@ -0,0 +1,44 @@
+package nametransform
+
+// flatIV is the IV used for all directories in flat mode. As the names are
+// encrypted with EME using the master key, a public, constant IV only makes
+// the encryption deterministic across directories.
+var flatIV = make([]byte, DirIVLen)
+
+// SetFlat enables or disables flat mode (the "Flat" feature flag). In flat
+// mode, there are no gocryptfs.diriv files, and file names are encrypted
+// with the same fixed IV in every directory.
+func (n *NameTransform) SetFlat(flat bool) {
+	n.flat = flat
+}
+
+// ReadDirIVAt returns the IV used to encrypt the names in the directory
+// opened as "dirfd". This is the content of its DirIV file (see
+// SetDirIVName), of its DirIVXattr xattr, or, in flat mode, a fixed IV.
+func (n *NameTransform) ReadDirIVAt(dirfd int) (iv []byte, err error) {
+	if n.flat {
+		return flatIV, nil
+	}
+	if n.dirIVXattr {
+		return ReadDirIVXattrAt(dirfd)
+	}
+	return readDirIVAt(dirfd, n.dirIVName)
+}
+
+// WriteDirIVAt creates a DirIV file, or the DirIVXattr xattr, in
+// the directory opened as "dirfd". It does nothing in flat mode.
+func (n *NameTransform) WriteDirIVAt(dirfd int) error {
+	if n.flat {
+		return nil
+	}
+	if n.dirIVXattr {
+		return WriteDirIVXattrAt(dirfd)
+	}
+	return WriteDirIVNameAt(dirfd, n.dirIVName)
+}
+
+// RestoreDirIVAt puts back the DirIV file of the directory opened as "dirfd"
+// with content "iv", see the RestoreDirIVAt function.
+func (n *NameTransform) RestoreDirIVAt(dirfd int, iv []byte) error {
+	return restoreDirIVAt(dirfd, n.dirIVName, iv)
+}
@@ -20,8 +20,24 @@ const (
 	// gocryptfs.longname.[sha256].name  <--- File name, suffix = .name
 	LongNameSuffix = ".name"
 	longNamePrefix = "gocryptfs.longname."
+	// MinLongNameMax is the smallest threshold SetLongNameMax accepts. Below
+	// it, "gocryptfs.longname.[sha256].name" would be longer than the names
+	// it replaces.
+	MinLongNameMax = len(longNamePrefix) + 44 + len(LongNameSuffix)
 )
 
+// SetLongNameMax sets the length above which encrypted names are stored as
+// long names (the "LongNameMax" config value). The default is NameMax.
+// Lookups use the same threshold, so it must not change over the lifetime of
+// a filesystem.
+func (n *NameTransform) SetLongNameMax(max int) error {
+	if max < MinLongNameMax || max > NameMax {
+		return fmt.Errorf("name length limit %d is out of range %d...%d", max, MinLongNameMax, NameMax)
+	}
+	n.longNameMax = max
+	return nil
+}
+
 // HashLongName - take the hash of a long string "name" and return
 // "gocryptfs.longname.[sha256]"
 //
@@ -76,6 +92,35 @@ func RemoveLongNameSuffix(cName string) string {
 	return cName[:len(cName)-len(LongNameSuffix)]
 }
 
+// FindLongNameOrphans checks the long name entries in the directory listing
+// "names". "orphans" are the ".name" files whose content entry is gone,
+// "unnamed" are the content entries whose ".name" file is gone. Both are left
+// behind when a crash interrupts the creation, rename or deletion of a long
+// name entry.
+//
+// This function does not do any I/O.
+func FindLongNameOrphans(names []string) (orphans []string, unnamed []string) {
+	have := make(map[string]bool)
+	for _, n := range names {
+		if NameType(n) != LongNameNone {
+			have[n] = true
+		}
+	}
+	for _, n := range names {
+		switch NameType(n) {
+		case LongNameFilename:
+			if !have[RemoveLongNameSuffix(n)] {
+				orphans = append(orphans, n)
+			}
+		case LongNameContent:
+			if !have[n+LongNameSuffix] {
+				unnamed = append(unnamed, n)
+			}
+		}
+	}
+	return orphans, unnamed
+}
+
 // ReadLongName - read cName + ".name" from the directory opened as dirfd.
 //
 // Symlink-safe through Openat().
@@ -114,7 +159,8 @@ func ReadLongNameAt(dirfd int, cName string) (string, error) {
 func DeleteLongNameAt(dirfd int, hashName string) error {
 	err := syscallcompat.Unlinkat(dirfd, hashName+LongNameSuffix, 0)
 	if err != nil {
-		tlog.Warn.Printf("DeleteLongName: %v", err)
+		tlog.Warn.Printf("DeleteLongName: deleting %s failed: %v%s",
+			hashName+LongNameSuffix, err, syscallcompat.DeniedHint(err))
 	}
 	return err
 }
@@ -128,7 +174,7 @@ func (n *NameTransform) WriteLongNameAt(dirfd int, hashName string, plainName st
 	plainName = filepath.Base(plainName)
 
 	// Encrypt the basename
-	dirIV, err := ReadDirIVAt(dirfd)
+	dirIV, err := n.ReadDirIVAt(dirfd)
 	if err != nil {
 		return err
 	}
@@ -141,7 +187,8 @@ func (n *NameTransform) WriteLongNameAt(dirfd int, hashName string, plainName st
 		// Don't warn if the file already exists - this is allowed for renames
 		// and should be handled by the caller.
 		if err != syscall.EEXIST {
-			tlog.Warn.Printf("WriteLongName: Openat: %v", err)
+			tlog.Warn.Printf("WriteLongName: creating %s failed: %v%s",
+				hashName+LongNameSuffix, err, syscallcompat.DeniedHint(err))
 		}
 		return err
 	}
@@ -149,14 +196,15 @@ func (n *NameTransform) WriteLongNameAt(dirfd int, hashName string, plainName st
 	_, err = fd.Write([]byte(cName))
 	if err != nil {
 		fd.Close()
-		tlog.Warn.Printf("WriteLongName: Write: %v", err)
+		tlog.Warn.Printf("WriteLongName: writing %s failed: %v%s",
+			hashName+LongNameSuffix, err, syscallcompat.DeniedHint(err))
 		// Delete incomplete longname file
 		syscallcompat.Unlinkat(dirfd, hashName+LongNameSuffix, 0)
 		return err
 	}
 	err = fd.Close()
 	if err != nil {
-		tlog.Warn.Printf("WriteLongName: Close: %v", err)
+		tlog.Warn.Printf("WriteLongName: closing %s failed: %v", hashName+LongNameSuffix, err)
 		// Delete incomplete longname file
 		syscallcompat.Unlinkat(dirfd, hashName+LongNameSuffix, 0)
 		return err
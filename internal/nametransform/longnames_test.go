@@ -1,6 +1,8 @@
 package nametransform
 
 import (
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -28,3 +30,45 @@ func TestRemoveLongNameSuffix(t *testing.T) {
 		t.Error(".name suffix not removed")
 	}
 }
+
+func TestFindLongNameOrphans(t *testing.T) {
+	const a = "gocryptfs.longname.LkwUdALvV_ANnzQN6ZZMYnxxfARD3IeZWCKnxGJjYmU="
+	const b = "gocryptfs.longname.URrM8kgxTKYMgCk4hKk7RO9Lcfr30XQof4L_5bD9Iro="
+	const c = "gocryptfs.longname.i1bpTaVLZq7sRNA9mL_2Ig_5bD9IroAAAAAAAAAAAAA="
+	names := []string{"gocryptfs.diriv", a, a + ".name", b + ".name", c, "i1bpTaVLZq7sRNA9mL_2Ig=="}
+	orphans, unnamed := FindLongNameOrphans(names)
+	if !reflect.DeepEqual(orphans, []string{b + ".name"}) {
+		t.Errorf("wrong orphans: %q", orphans)
+	}
+	if !reflect.DeepEqual(unnamed, []string{c}) {
+		t.Errorf("wrong unnamed entries: %q", unnamed)
+	}
+}
+
+// TestSetLongNameMax checks that names are hashed above the configured
+// threshold, and that the hashed names fit below the smallest one.
+func TestSetLongNameMax(t *testing.T) {
+	n := newTestNameTransform(t)
+	iv := make([]byte, DirIVLen)
+	// 100 plaintext bytes encrypt to 112 bytes, which is 150 in base64
+	plain := strings.Repeat("x", 100)
+	cName, err := n.EncryptAndHashName(plain, iv)
+	if err != nil || NameType(cName) != LongNameNone {
+		t.Fatalf("default threshold: %q %v", cName, err)
+	}
+	if err = n.SetLongNameMax(143); err != nil {
+		t.Fatal(err)
+	}
+	cName, err = n.EncryptAndHashName(plain, iv)
+	if err != nil || NameType(cName) != LongNameContent {
+		t.Fatalf("threshold 143: %q %v", cName, err)
+	}
+	if l := len(cName + LongNameSuffix); l > MinLongNameMax {
+		t.Errorf("long name file %q has %d bytes, MinLongNameMax is %d", cName, l, MinLongNameMax)
+	}
+	for _, max := range []int{MinLongNameMax - 1, NameMax + 1} {
+		if n.SetLongNameMax(max) == nil {
+			t.Errorf("SetLongNameMax(%d) should fail", max)
+		}
+	}
+}
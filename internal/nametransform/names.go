@@ -9,6 +9,7 @@ import (
 	"syscall"
 
 	"github.com/rfjakob/eme"
+	"golang.org/x/text/unicode/norm"
 
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
@@ -22,11 +23,16 @@ const (
 type NameTransformer interface {
 	DecryptName(cipherName string, iv []byte) (string, error)
 	EncryptName(plainName string, iv []byte) string
+	NormalizeName(name string) string
 	EncryptAndHashName(name string, iv []byte) (string, error)
 	HashLongName(name string) string
 	WriteLongNameAt(dirfd int, hashName string, plainName string) error
 	B64EncodeToString(src []byte) string
 	B64DecodeString(s string) ([]byte, error)
+	ReadDirIVAt(dirfd int) ([]byte, error)
+	WriteDirIVAt(dirfd int) error
+	RestoreDirIVAt(dirfd int, iv []byte) error
+	DirIVName() string
 }
 
 // NameTransform is used to transform filenames.
@@ -38,6 +44,16 @@ type NameTransform struct {
 	B64 *base64.Encoding
 	// Patterns to bypass decryption
 	BadnamePatterns []string
+	// Unicode normalization applied by EncryptName, nil = disabled
+	normForm *norm.Form
+	// flat disables gocryptfs.diriv files, see SetFlat
+	flat bool
+	// dirIVXattr stores the DirIVs in xattrs, see SetDirIVXattr
+	dirIVXattr bool
+	// dirIVName is the name of the DirIV files, see SetDirIVName
+	dirIVName string
+	// Encrypted names longer than this are hashed, see SetLongNameMax
+	longNameMax int
 }
 
 // New returns a new NameTransform instance.
@@ -47,9 +63,11 @@ func New(e *eme.EMECipher, longNames bool, raw64 bool) *NameTransform {
 		b64 = base64.RawURLEncoding
 	}
 	return &NameTransform{
-		emeCipher: e,
-		longNames: longNames,
-		B64:       b64,
+		emeCipher:   e,
+		longNames:   longNames,
+		B64:         b64,
+		dirIVName:   DirIVFilename,
+		longNameMax: NameMax,
 	}
 }
 
@@ -120,7 +138,7 @@ func (n *NameTransform) decryptName(cipherName string, iv []byte) (string, error
 // This function is exported because in some cases, fusefrontend needs access
 // to the full (not hashed) name if longname is used.
 func (n *NameTransform) EncryptName(plainName string, iv []byte) (cipherName64 string) {
-	bin := []byte(plainName)
+	bin := []byte(n.NormalizeName(plainName))
 	bin = pad16(bin)
 	bin = n.emeCipher.Encrypt(iv, bin)
 	cipherName64 = n.B64.EncodeToString(bin)
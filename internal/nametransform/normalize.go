@@ -0,0 +1,47 @@
+package nametransform
+
+import (
+	"fmt"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Unicode normalization forms accepted by SetUnicodeNormalize
+const (
+	// NormalizeNone leaves file names untouched (the default)
+	NormalizeNone = ""
+	// NormalizeNFC converts names to the composed form, as written by most
+	// Linux programs
+	NormalizeNFC = "nfc"
+	// NormalizeNFD converts names to the decomposed form, as stored by HFS+
+	NormalizeNFD = "nfd"
+)
+
+// SetUnicodeNormalize makes EncryptName normalize the plaintext name to
+// "form" before encrypting it. This way, the same name gets the same
+// ciphertext regardless of how the application spelled it.
+func (n *NameTransform) SetUnicodeNormalize(form string) error {
+	switch form {
+	case NormalizeNone:
+		n.normForm = nil
+	case NormalizeNFC:
+		f := norm.NFC
+		n.normForm = &f
+	case NormalizeNFD:
+		f := norm.NFD
+		n.normForm = &f
+	default:
+		return fmt.Errorf("unknown normalization form %q, valid values are %q and %q",
+			form, NormalizeNFC, NormalizeNFD)
+	}
+	return nil
+}
+
+// NormalizeName returns "name" in the normalization form set via
+// SetUnicodeNormalize, or unchanged if normalization is disabled.
+func (n *NameTransform) NormalizeName(name string) string {
+	if n.normForm == nil {
+		return name
+	}
+	return n.normForm.String(name)
+}
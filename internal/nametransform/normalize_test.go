@@ -0,0 +1,47 @@
+package nametransform
+
+import (
+	"crypto/aes"
+	"testing"
+
+	"github.com/rfjakob/eme"
+)
+
+func newTestNameTransform(t *testing.T) *NameTransform {
+	c, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(eme.New(c), true, true)
+}
+
+func TestUnicodeNormalize(t *testing.T) {
+	// "é" as a single code point and as "e" + combining acute accent
+	nfc := "caf\u00e9"
+	nfd := "cafe\u0301"
+	iv := make([]byte, DirIVLen)
+	n := newTestNameTransform(t)
+	if n.EncryptName(nfc, iv) == n.EncryptName(nfd, iv) {
+		t.Fatal("without normalization, both forms should encrypt differently")
+	}
+	for _, form := range []string{NormalizeNFC, NormalizeNFD} {
+		if err := n.SetUnicodeNormalize(form); err != nil {
+			t.Fatal(err)
+		}
+		c1 := n.EncryptName(nfc, iv)
+		c2 := n.EncryptName(nfd, iv)
+		if c1 != c2 {
+			t.Errorf("%s: ciphertexts differ: %q != %q", form, c1, c2)
+		}
+		plain, err := n.DecryptName(c1, iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]string{NormalizeNFC: nfc, NormalizeNFD: nfd}[form]; plain != want {
+			t.Errorf("%s: decrypted to %q, want %q", form, plain, want)
+		}
+	}
+	if err := n.SetUnicodeNormalize("nfkc"); err == nil {
+		t.Error("invalid form should be rejected")
+	}
+}
@@ -48,6 +48,16 @@ type Entry struct {
 	// IDLock must be taken before reading or writing the ID field in this struct,
 	// unless you have an exclusive lock on ContentLock.
 	IDLock sync.Mutex
+	// Dirty is the file handle that holds written data of this file that is
+	// not on disk yet, or nil. Protected by ContentLock.
+	Dirty DirtyFile
+}
+
+// DirtyFile is a file handle that caches writes.
+type DirtyFile interface {
+	// FlushDirty writes the cached data to disk and clears Entry.Dirty.
+	// The caller must hold ContentLock exclusively.
+	FlushDirty() error
 }
 
 // Register creates an open file table entry for "qi" (or incrementes the
@@ -65,6 +75,13 @@ func Register(qi inomap.QIno) *Entry {
 	return e
 }
 
+// Lookup returns the entry for "qi", or nil if the file is not open.
+func Lookup(qi inomap.QIno) *Entry {
+	t.Lock()
+	defer t.Unlock()
+	return t.entries[qi]
+}
+
 // Unregister decrements the reference count for "qi" and deletes the entry from
 // the open file table if the reference count reaches 0.
 func Unregister(qi inomap.QIno) {
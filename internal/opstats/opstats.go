@@ -0,0 +1,181 @@
+// Package opstats records latency histograms of FUSE operations,
+// "-stats" on the command line. The histograms can be queried through the
+// control socket.
+package opstats
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/ctlsock"
+)
+
+// Op identifies an instrumented operation
+type Op int
+
+const (
+	// Read is File.Read
+	Read Op = iota
+	// Write is File.Write
+	Write
+	// GetAttr is FS.GetAttr, which also serves the kernel's LOOKUP requests
+	GetAttr
+	// OpenDir is FS.OpenDir, which serves READDIR
+	OpenDir
+	// Create is FS.Create
+	Create
+	numOps
+)
+
+var opNames = [numOps]string{"Read", "Write", "GetAttr", "OpenDir", "Create"}
+
+// String returns the name of the operation as reported by the control socket.
+func (op Op) String() string {
+	return opNames[op]
+}
+
+// Stats collects one latency histogram per operation. All methods can be
+// called on a nil *Stats, in which case they do nothing. This keeps the
+// overhead close to zero when "-stats" is not passed. A disabled Stats
+// behaves like a nil one, but can be enabled later.
+type Stats struct {
+	hist [numOps]histogram
+	// disabled is 1 if collection is off, accessed atomically
+	disabled uint32
+}
+
+// New returns an empty, enabled Stats object.
+func New() *Stats {
+	return &Stats{}
+}
+
+// SetEnabled turns collection on or off. The histograms are kept while
+// collection is off.
+func (s *Stats) SetEnabled(enabled bool) {
+	var v uint32
+	if !enabled {
+		v = 1
+	}
+	atomic.StoreUint32(&s.disabled, v)
+}
+
+// Enabled returns true if s is not nil and collection is on.
+func (s *Stats) Enabled() bool {
+	return s != nil && atomic.LoadUint32(&s.disabled) == 0
+}
+
+// Now returns the current time, or the zero time if s is nil or disabled.
+// Use it together with Record, so that the clock is not read if stats are
+// disabled:
+//
+//	defer fs.stats.Record(opstats.Read, fs.stats.Now())
+func (s *Stats) Now() time.Time {
+	if !s.Enabled() {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// Record adds the time elapsed since "start" to the histogram of "op".
+// Does nothing if "start" is the zero time.
+func (s *Stats) Record(op Op, start time.Time) {
+	if s == nil || start.IsZero() {
+		return
+	}
+	s.hist[op].record(uint64(time.Since(start)))
+}
+
+// Snapshot returns p50, p99 and max latencies of all operations, keyed by
+// operation name. Returns nil if s is nil or disabled.
+func (s *Stats) Snapshot() map[string]ctlsock.OpStats {
+	if !s.Enabled() {
+		return nil
+	}
+	m := make(map[string]ctlsock.OpStats, numOps)
+	for op := Op(0); op < numOps; op++ {
+		m[op.String()] = s.hist[op].snapshot()
+	}
+	return m
+}
+
+// The histogram uses the log-linear bucket layout of HdrHistogram: values
+// below 2*subBuckets get one bucket each. Above that, every power of two is
+// split into subBuckets equally sized buckets, giving a relative error of
+// at most 1/subBuckets.
+const (
+	subBucketBits = 4
+	subBuckets    = 1 << subBucketBits
+	numBuckets    = (64-subBucketBits-1)*subBuckets + 2*subBuckets
+)
+
+// histogram is safe for concurrent use. Values are nanoseconds.
+type histogram struct {
+	counts [numBuckets]uint64
+	max    uint64
+}
+
+// bucketIndex returns the bucket that "v" is counted in.
+func bucketIndex(v uint64) int {
+	if v < 2*subBuckets {
+		return int(v)
+	}
+	shift := uint(bits.Len64(v) - subBucketBits - 1)
+	return int(shift)*subBuckets + int(v>>shift)
+}
+
+// bucketHigh returns the highest value that is counted in bucket "i".
+func bucketHigh(i int) uint64 {
+	if i < 2*subBuckets {
+		return uint64(i)
+	}
+	shift := uint(i/subBuckets - 1)
+	mant := uint64(i%subBuckets + subBuckets)
+	return (mant+1)<<shift - 1
+}
+
+func (h *histogram) record(v uint64) {
+	atomic.AddUint64(&h.counts[bucketIndex(v)], 1)
+	for {
+		max := atomic.LoadUint64(&h.max)
+		if v <= max || atomic.CompareAndSwapUint64(&h.max, max, v) {
+			return
+		}
+	}
+}
+
+func (h *histogram) snapshot() ctlsock.OpStats {
+	var counts [numBuckets]uint64
+	var total uint64
+	for i := range counts {
+		counts[i] = atomic.LoadUint64(&h.counts[i])
+		total += counts[i]
+	}
+	max := atomic.LoadUint64(&h.max)
+	percentile := func(p uint64) time.Duration {
+		if total == 0 {
+			return 0
+		}
+		// Rank of the wanted value, rounded up
+		rank := (total*p + 99) / 100
+		var seen uint64
+		for i, c := range counts {
+			seen += c
+			if seen >= rank {
+				v := bucketHigh(i)
+				// The bucket may extend beyond the largest recorded value
+				if v > max {
+					v = max
+				}
+				return time.Duration(v)
+			}
+		}
+		return time.Duration(max)
+	}
+	return ctlsock.OpStats{
+		Count: total,
+		P50:   percentile(50),
+		P99:   percentile(99),
+		Max:   time.Duration(max),
+	}
+}
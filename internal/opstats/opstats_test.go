@@ -0,0 +1,85 @@
+package opstats
+
+import (
+	"testing"
+	"time"
+)
+
+// TestBuckets checks that every value lands in a bucket that contains it,
+// that buckets are ordered, and that the relative error is bounded.
+func TestBuckets(t *testing.T) {
+	var prev int
+	for v := uint64(0); v < 100000; v++ {
+		i := bucketIndex(v)
+		if i < prev {
+			t.Fatalf("bucket index decreased at v=%d", v)
+		}
+		prev = i
+		high := bucketHigh(i)
+		if high < v {
+			t.Fatalf("v=%d: bucket %d ends at %d", v, i, high)
+		}
+		if (high-v)*subBuckets > v {
+			t.Fatalf("v=%d: bucket %d ends at %d, error too big", v, i, high)
+		}
+	}
+	for _, v := range []uint64{1 << 62, 1<<64 - 1} {
+		if i := bucketIndex(v); i >= numBuckets || bucketHigh(i) < v {
+			t.Errorf("v=%d: bad bucket %d", v, i)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	s := New()
+	for i := 1; i <= 1000; i++ {
+		s.hist[Read].record(uint64(i) * uint64(time.Microsecond))
+	}
+	r := s.Snapshot()["Read"]
+	if r.Count != 1000 {
+		t.Errorf("wrong count %d", r.Count)
+	}
+	if r.Max != time.Millisecond {
+		t.Errorf("wrong max %v", r.Max)
+	}
+	within := func(got, want time.Duration) bool {
+		return got >= want && got <= want+want/subBuckets
+	}
+	if !within(r.P50, 500*time.Microsecond) {
+		t.Errorf("wrong p50 %v", r.P50)
+	}
+	if !within(r.P99, 990*time.Microsecond) {
+		t.Errorf("wrong p99 %v", r.P99)
+	}
+	if w := s.Snapshot()["Write"]; w.Count != 0 || w.Max != 0 || w.P50 != 0 {
+		t.Errorf("empty histogram should be zero: %+v", w)
+	}
+}
+
+// TestNil checks that a nil *Stats can be used when "-stats" is off.
+func TestNil(t *testing.T) {
+	var s *Stats
+	if !s.Now().IsZero() {
+		t.Error("Now() on nil should return the zero time")
+	}
+	s.Record(Read, s.Now())
+	if s.Snapshot() != nil {
+		t.Error("Snapshot() on nil should return nil")
+	}
+}
+
+// TestSetEnabled checks that a disabled Stats records nothing, and keeps
+// its histograms until it is enabled again.
+func TestSetEnabled(t *testing.T) {
+	s := New()
+	s.Record(Read, s.Now())
+	s.SetEnabled(false)
+	s.Record(Read, s.Now())
+	if s.Snapshot() != nil {
+		t.Error("Snapshot() on disabled Stats should return nil")
+	}
+	s.SetEnabled(true)
+	if c := s.Snapshot()["Read"].Count; c != 1 {
+		t.Errorf("want count 1, got %d", c)
+	}
+}
@@ -0,0 +1,107 @@
+// Package ratelimit implements the token bucket behind "-read-bps" and
+// "-write-bps", which limit the bandwidth a mount uses against CIPHERDIR.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Replaced by the tests
+var (
+	timeNow = time.Now
+	sleep   = time.Sleep
+)
+
+// Bucket is a token bucket that refills at "bps" bytes per second and holds
+// up to one second worth of tokens. All methods can be called on a nil
+// *Bucket, which means no limit.
+//
+// An operation takes its tokens up front and may drive the bucket into
+// debt. It then sleeps until the debt is paid back. This way, an operation
+// that is larger than the bucket waits for a while instead of forever, and
+// concurrent operations queue up behind it in the order they arrived.
+type Bucket struct {
+	mu  sync.Mutex
+	bps uint64
+	// tokens is negative while the bucket is in debt
+	tokens float64
+	// last is when tokens was last refilled
+	last time.Time
+	// total is the number of bytes that went through Wait
+	total uint64
+	// windowStart and windowBytes measure the current rate
+	windowStart time.Time
+	windowBytes uint64
+	// rate is the rate measured over the last window
+	rate uint64
+}
+
+// rateWindow is the interval the current rate is measured over
+const rateWindow = time.Second
+
+// New returns a bucket that allows "bps" bytes per second, or nil if "bps"
+// is 0.
+func New(bps uint64) *Bucket {
+	if bps == 0 {
+		return nil
+	}
+	now := timeNow()
+	return &Bucket{
+		bps:         bps,
+		tokens:      float64(bps),
+		last:        now,
+		windowStart: now,
+	}
+}
+
+// Wait blocks until "n" bytes may be transferred.
+func (b *Bucket) Wait(n int) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.mu.Lock()
+	now := timeNow()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.bps)
+	if b.tokens > float64(b.bps) {
+		b.tokens = float64(b.bps)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	b.total += uint64(n)
+	b.roll(now)
+	b.windowBytes += uint64(n)
+	var d time.Duration
+	if b.tokens < 0 {
+		d = time.Duration(-b.tokens / float64(b.bps) * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if d > 0 {
+		sleep(d)
+	}
+}
+
+// roll starts a new measuring window if the current one is over.
+// Caller must hold b.mu.
+func (b *Bucket) roll(now time.Time) {
+	elapsed := now.Sub(b.windowStart)
+	if elapsed < rateWindow {
+		return
+	}
+	b.rate = uint64(float64(b.windowBytes) / elapsed.Seconds())
+	b.windowStart = now
+	b.windowBytes = 0
+}
+
+// Status returns the limit, the rate measured over the last second and the
+// number of bytes transferred since the bucket was created. All zero for a
+// nil bucket.
+func (b *Bucket) Status() (limit, rate, total uint64) {
+	if b == nil {
+		return 0, 0, 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.roll(timeNow())
+	return b.bps, b.rate, b.total
+}
@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock replaces timeNow and sleep. Sleeping advances the clock.
+type fakeClock struct {
+	sync.Mutex
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	c.slept += d
+}
+
+func useFakeClock() (*fakeClock, func()) {
+	c := &fakeClock{now: time.Unix(1000, 0)}
+	timeNow = c.Now
+	sleep = c.Sleep
+	return c, func() {
+		timeNow = time.Now
+		sleep = time.Sleep
+	}
+}
+
+func TestNil(t *testing.T) {
+	b := New(0)
+	if b != nil {
+		t.Fatal("New(0) should return nil")
+	}
+	b.Wait(100)
+	if limit, rate, total := b.Status(); limit != 0 || rate != 0 || total != 0 {
+		t.Errorf("want all zero, got %d %d %d", limit, rate, total)
+	}
+}
+
+func TestWait(t *testing.T) {
+	c, restore := useFakeClock()
+	defer restore()
+	b := New(1000)
+	// The bucket starts full
+	b.Wait(1000)
+	if c.slept != 0 {
+		t.Errorf("should not wait for a full bucket, slept %v", c.slept)
+	}
+	b.Wait(500)
+	if c.slept != 500*time.Millisecond {
+		t.Errorf("want 500ms, slept %v", c.slept)
+	}
+	// Three times the bucket size must not block forever, it pays the debt
+	b.Wait(3000)
+	if c.slept != 3500*time.Millisecond {
+		t.Errorf("want 3.5s, slept %v", c.slept)
+	}
+	limit, _, total := b.Status()
+	if limit != 1000 || total != 4500 {
+		t.Errorf("want limit 1000 and total 4500, got %d and %d", limit, total)
+	}
+}
+
+func TestRate(t *testing.T) {
+	c, restore := useFakeClock()
+	defer restore()
+	b := New(1000)
+	for i := 0; i < 10; i++ {
+		b.Wait(250)
+	}
+	// 2500 bytes were allowed in 1.5s. The first window has seen 2000 bytes
+	// in 1s.
+	if c.slept != 1500*time.Millisecond {
+		t.Errorf("want 1.5s, slept %v", c.slept)
+	}
+	if _, rate, _ := b.Status(); rate != 2000 {
+		t.Errorf("want a rate of 2000, got %d", rate)
+	}
+	// After a quiet period, the rate drops
+	c.Sleep(10 * time.Second)
+	if _, rate, _ := b.Status(); rate > 100 {
+		t.Errorf("rate should have dropped, got %d", rate)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"os/exec"
 	"testing"
 
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -26,7 +27,7 @@ func TestExtpass(t *testing.T) {
 
 func TestOnceExtpass(t *testing.T) {
 	p1 := "lkadsf0923rdfi48rqwhdsf"
-	p2 := string(Once([]string{"echo " + p1}, nil, ""))
+	p2 := string(Once([]string{"echo " + p1}, nil, -1, ""))
 	if p1 != p2 {
 		t.Errorf("p1=%q != p2=%q", p1, p2)
 	}
@@ -35,7 +36,7 @@ func TestOnceExtpass(t *testing.T) {
 // extpass with two arguments
 func TestOnceExtpass2(t *testing.T) {
 	p1 := "foo"
-	p2 := string(Once([]string{"echo", p1}, nil, ""))
+	p2 := string(Once([]string{"echo", p1}, nil, -1, ""))
 	if p1 != p2 {
 		t.Errorf("p1=%q != p2=%q", p1, p2)
 	}
@@ -44,7 +45,7 @@ func TestOnceExtpass2(t *testing.T) {
 // extpass with three arguments
 func TestOnceExtpass3(t *testing.T) {
 	p1 := "foo bar baz"
-	p2 := string(Once([]string{"echo", "foo", "bar", "baz"}, nil, ""))
+	p2 := string(Once([]string{"echo", "foo", "bar", "baz"}, nil, -1, ""))
 	if p1 != p2 {
 		t.Errorf("p1=%q != p2=%q", p1, p2)
 	}
@@ -52,7 +53,7 @@ func TestOnceExtpass3(t *testing.T) {
 
 func TestOnceExtpassSpaces(t *testing.T) {
 	p1 := "mypassword"
-	p2 := string(Once([]string{"cat", "passfile_test_files/file with spaces.txt"}, nil, ""))
+	p2 := string(Once([]string{"cat", "passfile_test_files/file with spaces.txt"}, nil, -1, ""))
 	if p1 != p2 {
 		t.Errorf("p1=%q != p2=%q", p1, p2)
 	}
@@ -60,7 +61,7 @@ func TestOnceExtpassSpaces(t *testing.T) {
 
 func TestTwiceExtpass(t *testing.T) {
 	p1 := "w5w44t3wfe45srz434"
-	p2 := string(Once([]string{"echo " + p1}, nil, ""))
+	p2 := string(Once([]string{"echo " + p1}, nil, -1, ""))
 	if p1 != p2 {
 		t.Errorf("p1=%q != p2=%q", p1, p2)
 	}
@@ -83,3 +84,18 @@ func TestExtpassEmpty(t *testing.T) {
 	}
 	t.Fatal("empty password should have failed")
 }
+
+// When extpass fails, we should exit with exitcodes.ReadPassword
+func TestExtpassFail(t *testing.T) {
+	if os.Getenv("TEST_SLAVE") == "1" {
+		readPasswordExtpass([]string{"sh", "-c", "echo foo; exit 1"})
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=TestExtpassFail$")
+	cmd.Env = append(os.Environ(), "TEST_SLAVE=1")
+	err := cmd.Run()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != exitcodes.ReadPassword {
+		t.Fatalf("want exit code %d, got %v", exitcodes.ReadPassword, err)
+	}
+}
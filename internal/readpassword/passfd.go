@@ -0,0 +1,31 @@
+package readpassword
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// readPasswordFd reads the first line from the already-open file descriptor
+// "fd" and closes it. The writer may deliver the password in several chunks,
+// like through a pipe, we read until newline or EOF.
+// Exits on read error or empty result.
+func readPasswordFd(fd int) []byte {
+	tlog.Info.Printf("passfd: reading from file descriptor %d", fd)
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		tlog.Fatal.Printf("fatal: passfd: invalid file descriptor %d: %v", fd, err)
+		os.Exit(exitcodes.ReadPassword)
+	}
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("passfd %d", fd))
+	p := readLineUnbuffered(f)
+	f.Close()
+	if len(p) == 0 {
+		tlog.Fatal.Printf("fatal: passfd: empty first line from file descriptor %d", fd)
+		os.Exit(exitcodes.ReadPassword)
+	}
+	return p
+}
@@ -0,0 +1,44 @@
+package readpassword
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The password arrives through a pipe in several chunks. Everything after
+// the first newline is ignored, and the fd is closed afterwards.
+func TestPassfd(t *testing.T) {
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for _, chunk := range []string{"my", "pass", "word\nsecond line"} {
+			syscall.Write(p[1], []byte(chunk))
+			time.Sleep(10 * time.Millisecond)
+		}
+		syscall.Close(p[1])
+	}()
+	pw := readPasswordFd(p[0])
+	if string(pw) != "mypassword" {
+		t.Errorf("want %q, got %q", "mypassword", pw)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(p[0], &st); err != syscall.EBADF {
+		t.Errorf("fd %d should be closed, Fstat returned %v", p[0], err)
+	}
+}
+
+// The password is terminated by EOF instead of a newline
+func TestPassfdEOF(t *testing.T) {
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatal(err)
+	}
+	syscall.Write(p[1], []byte("mypassword"))
+	syscall.Close(p[1])
+	if pw := readPasswordFd(p[0]); string(pw) != "mypassword" {
+		t.Errorf("want %q, got %q", "mypassword", pw)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/mlock"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -14,6 +15,7 @@ func readPassFileConcatenate(passfileSlice []string) (result []byte) {
 	for _, e := range passfileSlice {
 		result = append(result, readPassFile(e)...)
 	}
+	mlock.Lock(result)
 	return result
 }
 
@@ -29,6 +31,7 @@ func readPassFile(passfile string) []byte {
 	// +1 for an optional trailing newline,
 	// +2 so we can detect if maxPasswordLen is exceeded.
 	buf := make([]byte, maxPasswordLen+2)
+	mlock.Lock(buf)
 	n, err := f.Read(buf)
 	if err != nil {
 		tlog.Fatal.Printf("fatal: passfile: could not read from %q: %v", passfile, err)
@@ -12,6 +12,7 @@ import (
 	"golang.org/x/crypto/ssh/terminal"
 
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/mlock"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -20,12 +21,16 @@ const (
 	maxPasswordLen = 2048
 )
 
-// Once tries to get a password from the user, either from the terminal, extpass, passfile
-// or stdin. Leave "prompt" empty to use the default "Password: " prompt.
-func Once(extpass []string, passfile []string, prompt string) []byte {
+// Once tries to get a password from the user, either from the terminal, extpass, passfile,
+// passfd or stdin. Pass -1 as "passfd" if it is not used. Leave "prompt" empty to use the
+// default "Password: " prompt.
+func Once(extpass []string, passfile []string, passfd int, prompt string) []byte {
 	if len(passfile) != 0 {
 		return readPassFileConcatenate(passfile)
 	}
+	if passfd >= 0 {
+		return readPasswordFd(passfd)
+	}
 	if len(extpass) != 0 {
 		return readPasswordExtpass(extpass)
 	}
@@ -40,10 +45,13 @@ func Once(extpass []string, passfile []string, prompt string) []byte {
 
 // Twice is the same as Once but will prompt twice if we get the password from
 // the terminal.
-func Twice(extpass []string, passfile []string) []byte {
+func Twice(extpass []string, passfile []string, passfd int) []byte {
 	if len(passfile) != 0 {
 		return readPassFileConcatenate(passfile)
 	}
+	if passfd >= 0 {
+		return readPasswordFd(passfd)
+	}
 	if len(extpass) != 0 {
 		return readPasswordExtpass(extpass)
 	}
@@ -79,6 +87,7 @@ func readPasswordTerminal(prompt string) []byte {
 		tlog.Fatal.Println("Password is empty")
 		os.Exit(exitcodes.PasswordEmpty)
 	}
+	mlock.Lock(p)
 	return p
 }
 
@@ -121,7 +130,7 @@ func readPasswordExtpass(extpass []string) []byte {
 	pipe.Close()
 	err = cmd.Wait()
 	if err != nil {
-		tlog.Fatal.Printf("extpass program returned an error: %v", err)
+		tlog.Fatal.Printf("extpass program %q returned an error: %v", parts[0], err)
 		os.Exit(exitcodes.ReadPassword)
 	}
 	if len(p) == 0 {
@@ -135,6 +144,10 @@ func readPasswordExtpass(extpass []string) []byte {
 // The returned string does NOT contain the trailing "\n".
 func readLineUnbuffered(r io.Reader) (l []byte) {
 	b := make([]byte, 1)
+	// Allocate the maximum size upfront so append never has to copy the
+	// password around, and we can lock it into RAM before it is read
+	l = make([]byte, 0, maxPasswordLen+1)
+	mlock.Lock(l[:cap(l)])
 	for {
 		if len(l) > maxPasswordLen {
 			tlog.Fatal.Printf("fatal: maximum password length of %d bytes exceeded", maxPasswordLen)
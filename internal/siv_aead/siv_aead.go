@@ -7,6 +7,8 @@ import (
 	"log"
 
 	"github.com/jacobsa/crypto/siv"
+
+	"github.com/rfjakob/gocryptfs/internal/mlock"
 )
 
 type sivAead struct {
@@ -35,6 +37,7 @@ func New(key []byte) cipher.AEAD {
 func new2(keyIn []byte) cipher.AEAD {
 	// Create a private copy so the caller can zero the one he owns
 	key := append([]byte{}, keyIn...)
+	mlock.Lock(key)
 	return &sivAead{
 		key: key,
 	}
@@ -0,0 +1,83 @@
+package speed
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// Ciphertext block size: 4096 bytes payload + 16 bytes IV + 16 bytes tag
+const cipherBlockSize = blockSize + 32
+
+// Write size per iteration. The kernel caps FUSE writes at 128 kiB, which
+// is 32 plaintext blocks.
+const writeLen = 32 * cipherBlockSize
+
+// We truncate the test file back to zero when it reaches this size so we
+// don't fill up the disk on fast storage.
+const writeFileMax = 256 * 1024 * 1024
+
+// RunPrealloc benchmarks ciphertext write throughput with and without
+// preallocation on the filesystem that contains "dir".
+// Used by "gocryptfs -speed DIR".
+func RunPrealloc(dir string) {
+	bTable := []struct {
+		name     string
+		prealloc bool
+	}{
+		{name: "Write-Prealloc", prealloc: true},
+		{name: "Write-NoPrealloc", prealloc: false},
+	}
+	for _, b := range bTable {
+		fmt.Printf("%-20s\t", b.name)
+		mbs := mbPerSec(testing.Benchmark(bWrite(dir, b.prealloc)))
+		if mbs > 0 {
+			fmt.Printf("%7.2f MB/s\n", mbs)
+		} else {
+			fmt.Printf("    N/A\n")
+		}
+	}
+}
+
+// bWrite returns a benchmark function that performs sequential writes into
+// a temporary file in "dir", mimicking what fusefrontend's doWrite() does.
+func bWrite(dir string, prealloc bool) func(*testing.B) {
+	return func(b *testing.B) {
+		f, err := ioutil.TempFile(dir, ".gocryptfs-speed.")
+		if err != nil {
+			b.Skipf("cannot create test file: %v", err)
+		}
+		// Unlink right away so we don't leave garbage behind on crash
+		os.Remove(f.Name())
+		defer f.Close()
+		fd := int(f.Fd())
+		buf := randBytes(writeLen)
+		b.SetBytes(int64(len(buf)))
+
+		b.ResetTimer()
+		var off int64
+		for i := 0; i < b.N; i++ {
+			if off+writeLen > writeFileMax {
+				b.StopTimer()
+				syscall.Ftruncate(fd, 0)
+				off = 0
+				b.StartTimer()
+			}
+			if prealloc {
+				err = syscallcompat.EnospcPrealloc(fd, off, writeLen)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			_, err = f.WriteAt(buf, off)
+			if err != nil {
+				b.Fatal(err)
+			}
+			off += writeLen
+		}
+	}
+}
@@ -13,6 +13,7 @@ ok  	github.com/rfjakob/gocryptfs/internal/speed	6.022s
 */
 
 import (
+	"os"
 	"testing"
 )
 
@@ -27,3 +28,11 @@ func BenchmarkGoGCM(b *testing.B) {
 func BenchmarkAESSIV(b *testing.B) {
 	bAESSIV(b)
 }
+
+func BenchmarkWritePrealloc(b *testing.B) {
+	bWrite(os.TempDir(), true)(b)
+}
+
+func BenchmarkWriteNoPrealloc(b *testing.B) {
+	bWrite(os.TempDir(), false)(b)
+}
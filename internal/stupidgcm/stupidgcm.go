@@ -13,6 +13,8 @@ import (
 	"fmt"
 	"log"
 	"unsafe"
+
+	"github.com/rfjakob/gocryptfs/internal/mlock"
 )
 
 const (
@@ -40,6 +42,7 @@ func New(keyIn []byte, forceDecode bool) cipher.AEAD {
 	}
 	// Create a private copy of the key
 	key := append([]byte{}, keyIn...)
+	mlock.Lock(key)
 	return &StupidGCM{key: key, forceDecode: forceDecode}
 }
 
@@ -0,0 +1,72 @@
+// +build faultinject
+
+package syscallcompat
+
+import (
+	"sync"
+)
+
+// Fault makes one call of a syscall wrapper in this package fail. Only
+// available when building with "-tags faultinject", so tests can reach
+// error paths like rollbacks deterministically.
+type Fault struct {
+	// Op is the wrapper to fail: "Openat", "Renameat", "Unlinkat" or
+	// "Getdents"
+	Op string
+	// Path selects the call site by the path argument. Renameat matches
+	// both its paths. Empty matches every call, and is the only value that
+	// matches Getdents, which has no path.
+	Path string
+	// Skip lets this many matching calls pass before the fault fires
+	Skip int
+	// Err is returned instead of calling the syscall. Inside the "-retry"
+	// loop, so a transient error is retried.
+	Err error
+}
+
+// faults are the armed faults, in the order they were injected
+var faults struct {
+	sync.Mutex
+	list []*Fault
+}
+
+// InjectFault arms "f". It fires once, on the first matching call after
+// "f.Skip" matching calls. The returned function disarms it and reports
+// whether it has fired.
+func InjectFault(f Fault) (disarm func() (fired bool)) {
+	p := &f
+	faults.Lock()
+	faults.list = append(faults.list, p)
+	faults.Unlock()
+	return func() bool {
+		faults.Lock()
+		defer faults.Unlock()
+		for i, f := range faults.list {
+			if f == p {
+				faults.list = append(faults.list[:i], faults.list[i+1:]...)
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// injectFault returns the error of the first armed fault for "op" that
+// matches "path1" or "path2" and has nothing left to skip, and removes the
+// fault. Returns nil if no fault fires.
+func injectFault(op string, path1 string, path2 string) error {
+	faults.Lock()
+	defer faults.Unlock()
+	for i, f := range faults.list {
+		if f.Op != op || f.Path != "" && f.Path != path1 && f.Path != path2 {
+			continue
+		}
+		if f.Skip > 0 {
+			f.Skip--
+			continue
+		}
+		faults.list = append(faults.list[:i], faults.list[i+1:]...)
+		return f.Err
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+// +build !faultinject
+
+package syscallcompat
+
+// injectFault never fails without "-tags faultinject". The compiler inlines
+// it, so the checks in the syscall wrappers disappear.
+func injectFault(op string, path1 string, path2 string) error {
+	return nil
+}
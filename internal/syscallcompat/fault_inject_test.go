@@ -0,0 +1,65 @@
+// +build faultinject
+
+package syscallcompat
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestFaultInject(t *testing.T) {
+	disarm := InjectFault(Fault{Op: "Unlinkat", Path: "TestFaultInject", Skip: 1, Err: syscall.EIO})
+	defer disarm()
+	// Other paths and ops do not match
+	if err := Unlinkat(tmpDirFd, "TestFaultInject.other", 0); err != syscall.ENOENT {
+		t.Errorf("other path: want ENOENT, got %v", err)
+	}
+	if err := Renameat(tmpDirFd, "TestFaultInject", tmpDirFd, "x"); err != syscall.ENOENT {
+		t.Errorf("other op: want ENOENT, got %v", err)
+	}
+	// The first match is skipped, the second one fires, the third one
+	// passes again
+	for i, want := range []error{syscall.ENOENT, syscall.EIO, syscall.ENOENT} {
+		if err := Unlinkat(tmpDirFd, "TestFaultInject", 0); err != want {
+			t.Errorf("call %d: want %v, got %v", i, want, err)
+		}
+	}
+	if !disarm() {
+		t.Error("disarm should report that the fault has fired")
+	}
+	if InjectFault(Fault{Op: "Getdents", Err: syscall.EIO})() {
+		t.Error("disarm should report that the fault has not fired")
+	}
+}
+
+// A transient fault is retried
+func TestFaultInjectRetry(t *testing.T) {
+	SetRetry(1, 0)
+	defer SetRetry(0, 0)
+	disarm := InjectFault(Fault{Op: "Getdents", Err: syscall.EINTR})
+	defer disarm()
+	if _, err := Getdents(tmpDirFd); err != nil {
+		t.Fatal(err)
+	}
+	if !disarm() {
+		t.Error("fault did not fire")
+	}
+}
+
+// Renames are not retried, as the first attempt may have succeeded
+func TestFaultInjectRenameNoRetry(t *testing.T) {
+	SetRetry(1, 0)
+	defer SetRetry(0, 0)
+	fd, err := Openat(tmpDirFd, "TestFaultInjectRenameNoRetry", syscall.O_CREAT|syscall.O_EXCL|syscall.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(fd)
+	defer Unlinkat(tmpDirFd, "TestFaultInjectRenameNoRetry", 0)
+	disarm := InjectFault(Fault{Op: "Renameat", Err: syscall.ESTALE})
+	defer disarm()
+	err = Renameat(tmpDirFd, "TestFaultInjectRenameNoRetry", tmpDirFd, "TestFaultInjectRenameNoRetry.2")
+	if err != syscall.ESTALE {
+		t.Errorf("want ESTALE, got %v", err)
+	}
+}
@@ -19,3 +19,23 @@ func IsENOSPC(err error) bool {
 	}
 	return false
 }
+
+// IsDenied tries to find out if "err" is a (potentially wrapped) EPERM or
+// EROFS error. The storage below CIPHERDIR returns them for operations it
+// does not allow at all, like renaming or deleting files on append-only,
+// immutable or WORM storage.
+func IsDenied(err error) bool {
+	if err2, ok := err.(*os.PathError); ok {
+		err = err2.Err
+	}
+	return err == syscall.EPERM || err == syscall.EROFS
+}
+
+// DeniedHint returns an explanation to append to a log message if "err" is
+// an error IsDenied recognizes, and "" otherwise.
+func DeniedHint(err error) string {
+	if !IsDenied(err) {
+		return ""
+	}
+	return " (the storage below CIPHERDIR does not allow this operation. Is it append-only, immutable or read-only?)"
+}
@@ -0,0 +1,46 @@
+package syscallcompat
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Settings for "-retry", see SetRetry. Retrying is disabled by default.
+var (
+	retryCount   int
+	retryBackoff time.Duration
+)
+
+// SetRetry makes Openat and Getdents retry up to "count" times
+// when they fail with a transient error, as network filesystems sometimes
+// return. The first retry waits for "backoff", every further retry waits
+// twice as long as the previous one. count = 0 disables retrying.
+//
+// Must be called before the filesystem is mounted.
+func SetRetry(count int, backoff time.Duration) {
+	retryCount = count
+	retryBackoff = backoff
+}
+
+// isRetryable returns true for errors that may go away when the operation
+// is repeated.
+func isRetryable(err error) bool {
+	return err == syscall.EAGAIN || err == syscall.EINTR || err == syscall.ESTALE
+}
+
+// retry calls "f" until it succeeds, fails with an error that isRetryable
+// does not accept, or the retries set by SetRetry are used up. Returns the
+// last error.
+func retry(op string, f func() error) error {
+	err := f()
+	wait := retryBackoff
+	for i := 1; i <= retryCount && isRetryable(err); i++ {
+		tlog.Debug.Printf("%s: %v, retry %d/%d in %v", op, err, i, retryCount, wait)
+		time.Sleep(wait)
+		wait *= 2
+		err = f()
+	}
+	return err
+}
@@ -0,0 +1,37 @@
+package syscallcompat
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	defer SetRetry(0, 0)
+	// Fails with "errs" one after the other, then succeeds
+	var calls int
+	failing := func(errs ...error) func() error {
+		calls = 0
+		return func() error {
+			calls++
+			if calls <= len(errs) {
+				return errs[calls-1]
+			}
+			return nil
+		}
+	}
+	// Disabled by default
+	if err := retry("test", failing(syscall.EAGAIN)); err != syscall.EAGAIN || calls != 1 {
+		t.Errorf("disabled: err=%v calls=%d", err, calls)
+	}
+	SetRetry(3, time.Millisecond)
+	if err := retry("test", failing(syscall.EAGAIN, syscall.ESTALE, syscall.EINTR)); err != nil || calls != 4 {
+		t.Errorf("transient errors: err=%v calls=%d", err, calls)
+	}
+	if err := retry("test", failing(syscall.EAGAIN, syscall.EAGAIN, syscall.EAGAIN, syscall.EAGAIN)); err != syscall.EAGAIN || calls != 4 {
+		t.Errorf("retries used up: err=%v calls=%d", err, calls)
+	}
+	if err := retry("test", failing(syscall.ENOENT)); err != syscall.ENOENT || calls != 1 {
+		t.Errorf("permanent error: err=%v calls=%d", err, calls)
+	}
+}
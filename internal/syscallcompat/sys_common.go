@@ -44,7 +44,8 @@ func Faccessat(dirfd int, path string, mode uint32) error {
 	return unix.Faccessat(dirfd, path, mode, 0)
 }
 
-// Openat wraps the Openat syscall.
+// Openat wraps the Openat syscall. Retried on transient errors unless
+// O_CREAT is set, see SetRetry.
 func Openat(dirfd int, path string, flags int, mode uint32) (fd int, err error) {
 	if flags&syscall.O_CREAT != 0 {
 		// O_CREAT should be used with O_EXCL. O_NOFOLLOW has no effect with O_EXCL.
@@ -59,16 +60,39 @@ func Openat(dirfd int, path string, flags int, mode uint32) (fd int, err error)
 			flags |= syscall.O_NOFOLLOW
 		}
 	}
-	return unix.Openat(dirfd, path, flags, mode)
+	if flags&syscall.O_CREAT != 0 {
+		// Not retried: if the file has been created before the error, the
+		// retry would fail with EEXIST
+		if err = injectFault("Openat", path, ""); err != nil {
+			return -1, err
+		}
+		return unix.Openat(dirfd, path, flags, mode)
+	}
+	err = retry("Openat", func() error {
+		if err := injectFault("Openat", path, ""); err != nil {
+			return err
+		}
+		fd, err = unix.Openat(dirfd, path, flags, mode)
+		return err
+	})
+	return fd, err
 }
 
-// Renameat wraps the Renameat syscall.
+// Renameat wraps the Renameat syscall. Unlike Openat, it is not retried (see
+// SetRetry): if the first attempt has renamed the file but still returned an
+// error, the retry would fail with ENOENT.
 func Renameat(olddirfd int, oldpath string, newdirfd int, newpath string) (err error) {
+	if err = injectFault("Renameat", oldpath, newpath); err != nil {
+		return err
+	}
 	return unix.Renameat(olddirfd, oldpath, newdirfd, newpath)
 }
 
 // Unlinkat syscall.
 func Unlinkat(dirfd int, path string, flags int) (err error) {
+	if err = injectFault("Unlinkat", path, ""); err != nil {
+		return err
+	}
 	return unix.Unlinkat(dirfd, path, flags)
 }
 
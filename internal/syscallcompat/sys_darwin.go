@@ -21,6 +21,9 @@ const (
 	// O_PATH is only defined on Linux
 	O_PATH = 0
 
+	// O_NOATIME is only defined on Linux
+	O_NOATIME = 0
+
 	// KAUTH_UID_NONE and KAUTH_GID_NONE are special values to
 	// revert permissions to the process credentials.
 	KAUTH_UID_NONE = ^uint32(0) - 100
@@ -116,6 +119,22 @@ func FchmodatNofollow(dirfd int, path string, mode uint32) (err error) {
 	return unix.Fchmodat(dirfd, path, mode, unix.AT_SYMLINK_NOFOLLOW)
 }
 
+// DirGetxattr reads the xattr "attr" of the directory opened as "dirfd" into
+// "buf" and returns the length of the value. A missing xattr is reported as
+// ENOENT, like a missing file.
+func DirGetxattr(dirfd int, attr string, buf []byte) (int, error) {
+	sz, err := unix.Fgetxattr(dirfd, attr, buf)
+	if err == unix.ENOATTR {
+		return 0, syscall.ENOENT
+	}
+	return sz, err
+}
+
+// DirSetxattr sets the xattr "attr" of the directory opened as "dirfd".
+func DirSetxattr(dirfd int, attr string, data []byte, flags int) error {
+	return unix.Fsetxattr(dirfd, attr, data, flags)
+}
+
 func SymlinkatUser(oldpath string, newdirfd int, newpath string, context *fuse.Context) (err error) {
 	if context != nil {
 		runtime.LockOSThread()
@@ -212,6 +231,13 @@ func UtimesNanoAtNofollow(dirfd int, path string, a *time.Time, m *time.Time) (e
 		unsafe.Sizeof(attributes), unix.FSOPT_NOFOLLOW)
 }
 
-func Getdents(fd int) ([]fuse.DirEntry, error) {
-	return emulateGetdents(fd)
+func Getdents(fd int) (entries []fuse.DirEntry, err error) {
+	err = retry("Getdents", func() error {
+		if err := injectFault("Getdents", "", ""); err != nil {
+			return err
+		}
+		entries, err = emulateGetdents(fd)
+		return err
+	})
+	return entries, err
 }
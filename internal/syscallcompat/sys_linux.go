@@ -27,6 +27,9 @@ const (
 
 	// O_PATH is only defined on Linux
 	O_PATH = unix.O_PATH
+
+	// O_NOATIME is only defined on Linux
+	O_NOATIME = syscall.O_NOATIME
 )
 
 var preallocWarn sync.Once
@@ -189,6 +192,27 @@ func FchmodatNofollow(dirfd int, path string, mode uint32) (err error) {
 	return syscall.Chmod(procPath, mode)
 }
 
+// DirGetxattr reads the xattr "attr" of the directory opened as "dirfd" into
+// "buf" and returns the length of the value. A missing xattr is reported as
+// ENOENT, like a missing file.
+//
+// Fgetxattr does not work with O_PATH, but Getxattr via /proc/self/fd works.
+func DirGetxattr(dirfd int, attr string, buf []byte) (int, error) {
+	procPath := fmt.Sprintf("/proc/self/fd/%d", dirfd)
+	sz, err := unix.Getxattr(procPath, attr, buf)
+	if err == unix.ENODATA {
+		return 0, syscall.ENOENT
+	}
+	return sz, err
+}
+
+// DirSetxattr sets the xattr "attr" of the directory opened as "dirfd", which
+// may be an O_PATH fd like in DirGetxattr.
+func DirSetxattr(dirfd int, attr string, data []byte, flags int) error {
+	procPath := fmt.Sprintf("/proc/self/fd/%d", dirfd)
+	return unix.Setxattr(procPath, attr, data, flags)
+}
+
 // SymlinkatUser runs the Symlinkat syscall in the context of a different user.
 func SymlinkatUser(oldpath string, newdirfd int, newpath string, context *fuse.Context) (err error) {
 	if context != nil {
@@ -245,16 +269,34 @@ func MkdiratUser(dirfd int, path string, mode uint32, context *fuse.Context) (er
 	return Mkdirat(dirfd, path, mode)
 }
 
-func timesToTimespec(a *time.Time, m *time.Time) []unix.Timespec {
+func timesToTimespec(a *time.Time, m *time.Time) ([]unix.Timespec, error) {
 	ts := make([]unix.Timespec, 2)
-	ts[0] = unix.Timespec(fuse.UtimeToTimespec(a))
-	ts[1] = unix.Timespec(fuse.UtimeToTimespec(m))
-	return ts
+	var err error
+	ts[0], err = timeToTimespec(a)
+	if err != nil {
+		return nil, err
+	}
+	ts[1], err = timeToTimespec(m)
+	return ts, err
+}
+
+// timeToTimespec converts "t" to a Timespec with full nanosecond precision.
+// nil is converted to UTIME_OMIT, which makes utimensat leave the timestamp
+// alone. Unlike fuse.UtimeToTimespec, this does not go through t.UnixNano(),
+// which overflows for dates outside of the years 1678-2262.
+func timeToTimespec(t *time.Time) (unix.Timespec, error) {
+	if t == nil {
+		return unix.Timespec{Nsec: unix.UTIME_OMIT}, nil
+	}
+	return unix.TimeToTimespec(*t)
 }
 
 // FutimesNano syscall.
 func FutimesNano(fd int, a *time.Time, m *time.Time) (err error) {
-	ts := timesToTimespec(a, m)
+	ts, err := timesToTimespec(a, m)
+	if err != nil {
+		return err
+	}
 	// To avoid introducing a separate syscall wrapper for futimens()
 	// (as done in go-fuse, for example), we instead use the /proc/self/fd trick.
 	procPath := fmt.Sprintf("/proc/self/fd/%d", fd)
@@ -263,11 +305,21 @@ func FutimesNano(fd int, a *time.Time, m *time.Time) (err error) {
 
 // UtimesNanoAtNofollow is like UtimesNanoAt but never follows symlinks.
 func UtimesNanoAtNofollow(dirfd int, path string, a *time.Time, m *time.Time) (err error) {
-	ts := timesToTimespec(a, m)
+	ts, err := timesToTimespec(a, m)
+	if err != nil {
+		return err
+	}
 	return unix.UtimesNanoAt(dirfd, path, ts, unix.AT_SYMLINK_NOFOLLOW)
 }
 
-// Getdents syscall.
-func Getdents(fd int) ([]fuse.DirEntry, error) {
-	return getdents(fd)
+// Getdents syscall. Retried on transient errors, see SetRetry.
+func Getdents(fd int) (entries []fuse.DirEntry, err error) {
+	err = retry("Getdents", func() error {
+		if err := injectFault("Getdents", "", ""); err != nil {
+			return err
+		}
+		entries, err = getdents(fd)
+		return err
+	})
+	return entries, err
 }
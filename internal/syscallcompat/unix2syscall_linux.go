@@ -21,8 +21,10 @@ func Unix2syscall(u unix.Stat_t) syscall.Stat_t {
 		Size:    u.Size,
 		Blksize: u.Blksize,
 		Blocks:  u.Blocks,
-		Atim:    syscall.NsecToTimespec(unix.TimespecToNsec(u.Atim)),
-		Mtim:    syscall.NsecToTimespec(unix.TimespecToNsec(u.Mtim)),
-		Ctim:    syscall.NsecToTimespec(unix.TimespecToNsec(u.Ctim)),
+		// Convert directly instead of going through nanoseconds, which
+		// overflows for dates outside of the years 1678-2262.
+		Atim: syscall.Timespec(u.Atim),
+		Mtim: syscall.Timespec(u.Mtim),
+		Ctim: syscall.Timespec(u.Ctim),
 	}
 }
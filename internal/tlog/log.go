@@ -50,6 +50,8 @@ type toggledLogger struct {
 	Enabled bool
 	// Panic after logging a message, useful in regression tests
 	Wpanic bool
+	// Drop messages in silent mode, see SetSilent
+	silenceable bool
 	// Private prefix and postfix are used for coloring
 	prefix  string
 	postfix string
@@ -68,8 +70,25 @@ func trimNewline(msg string) string {
 	return msg
 }
 
+// silent is set by SetSilent
+var silent bool
+
+// SetSilent switches silent mode on or off. In silent mode, Info and Warn
+// drop all messages no matter what their Enabled setting says, so only
+// Debug and Fatal messages are printed. Code that disables a logger
+// temporarily cannot switch it back on by accident.
+// Used by "-silent".
+func SetSilent(s bool) {
+	silent = s
+}
+
+// IsSilent returns true in silent mode, see SetSilent
+func IsSilent() bool {
+	return silent
+}
+
 func (l *toggledLogger) Printf(format string, v ...interface{}) {
-	if !l.Enabled {
+	if !l.Enabled || l.silenceable && silent {
 		return
 	}
 	msg := trimNewline(fmt.Sprintf(format, v...))
@@ -79,7 +98,7 @@ func (l *toggledLogger) Printf(format string, v ...interface{}) {
 	}
 }
 func (l *toggledLogger) Println(v ...interface{}) {
-	if !l.Enabled {
+	if !l.Enabled || l.silenceable && silent {
 		return
 	}
 	msg := trimNewline(fmt.Sprint(v...))
@@ -94,12 +113,13 @@ func (l *toggledLogger) Println(v ...interface{}) {
 var Debug *toggledLogger
 
 // Info logs informational message
-// Can be disabled by passing "-q"
+// Can be disabled by passing "-q" or "-silent"
 var Info *toggledLogger
 
 // Warn logs warnings,
 // meaning nothing serious by itself but might indicate problems.
 // Passing "-wpanic" will make this function panic after printing the message.
+// Can be disabled by passing "-silent"
 var Warn *toggledLogger
 
 // Fatal error, we are about to exit
@@ -118,14 +138,16 @@ func init() {
 		Logger: log.New(os.Stdout, "", 0),
 	}
 	Info = &toggledLogger{
-		Enabled: true,
-		Logger:  log.New(os.Stdout, "", 0),
+		Enabled:     true,
+		silenceable: true,
+		Logger:      log.New(os.Stdout, "", 0),
 	}
 	Warn = &toggledLogger{
-		Enabled: true,
-		Logger:  log.New(os.Stderr, "", 0),
-		prefix:  ColorYellow,
-		postfix: ColorReset,
+		Enabled:     true,
+		silenceable: true,
+		Logger:      log.New(os.Stderr, "", 0),
+		prefix:      ColorYellow,
+		postfix:     ColorReset,
 	}
 	Fatal = &toggledLogger{
 		Enabled: true,
@@ -165,7 +187,7 @@ func SwitchLoggerToSyslog(p syslog.Priority) {
 // PrintMasterkeyReminder reminds the user that he should store the master key in
 // a safe place.
 func PrintMasterkeyReminder(key []byte) {
-	if !Info.Enabled {
+	if !Info.Enabled || silent {
 		// Quiet mode
 		return
 	}
@@ -1,6 +1,9 @@
 package tlog
 
 import (
+	"bytes"
+	"log"
+	"strings"
 	"testing"
 )
 
@@ -24,3 +27,31 @@ func TestTrimNewline(t *testing.T) {
 		}
 	}
 }
+
+// Silent mode drops Info and Warn messages, even if a logger is disabled
+// and enabled again in the meantime
+func TestSilent(t *testing.T) {
+	var buf bytes.Buffer
+	oldInfo, oldWarn, oldFatal := Info.Logger, Warn.Logger, Fatal.Logger
+	Info.Logger, Warn.Logger, Fatal.Logger = log.New(&buf, "", 0), log.New(&buf, "", 0), log.New(&buf, "", 0)
+	defer func() {
+		Info.Logger, Warn.Logger, Fatal.Logger = oldInfo, oldWarn, oldFatal
+		SetSilent(false)
+	}()
+	SetSilent(true)
+	Warn.Enabled = false
+	Warn.Enabled = true
+	Info.Printf("info")
+	Warn.Println("warn")
+	Fatal.Printf("fatal")
+	if !strings.Contains(buf.String(), "fatal") || strings.Contains(buf.String(), "info") ||
+		strings.Contains(buf.String(), "warn") {
+		t.Errorf("want only the fatal message, got %q", buf.String())
+	}
+	SetSilent(false)
+	buf.Reset()
+	Warn.Printf("warn")
+	if !strings.Contains(buf.String(), "warn") {
+		t.Errorf("warning missing after SetSilent(false): %q", buf.String())
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// showKDFProgress makes slow key derivations in "-init" and "-passwd" visible,
+// so the user does not think that gocryptfs hangs.
+func showKDFProgress() {
+	configfile.KDFProgress = kdfSpinner
+}
+
+// kdfSpinner implements configfile.KDFProgress. On a terminal, it shows a
+// spinner and the elapsed time until the key derivation is done. Otherwise,
+// it only prints the message once.
+func kdfSpinner(logN int, done <-chan struct{}) {
+	if !tlog.Info.Enabled || tlog.IsSilent() {
+		// Quiet mode
+		return
+	}
+	msg := fmt.Sprintf("Deriving key (scrypt logN=%d), this may take a while...", logN)
+	if !terminal.IsTerminal(int(os.Stdout.Fd())) {
+		tlog.Info.Println(msg)
+		return
+	}
+	start := time.Now().Add(-configfile.KDFProgressDelay)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	const frames = `|/-\`
+	for i := 0; ; i++ {
+		fmt.Printf("\r%s %c %ds", msg, frames[i%len(frames)], int(time.Since(start).Seconds()))
+		select {
+		case <-done:
+			// Clear the line, the next message takes its place
+			fmt.Printf("\r\033[K")
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -17,9 +17,11 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/mlock"
 	"github.com/rfjakob/gocryptfs/internal/readpassword"
 	"github.com/rfjakob/gocryptfs/internal/speed"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -35,6 +37,23 @@ var BuildDate = "0000-00-00"
 // raceDetector is set to true by race.go if we are compiled with "go build -race"
 var raceDetector bool
 
+// defaultConfigPath returns where the config file is stored when "-config"
+// is not passed.
+func defaultConfigPath(args *argContainer) string {
+	if args.reverse {
+		return filepath.Join(args.cipherdir, configfile.ConfReverseName)
+	}
+	return filepath.Join(args.cipherdir, configfile.ConfDefaultName)
+}
+
+// configExists returns true if there is a config file at "path". A config
+// file that cannot be accessed counts as existing, so that loading it
+// reports the error.
+func configExists(path string) bool {
+	_, err := os.Stat(path)
+	return !os.IsNotExist(err)
+}
+
 // loadConfig loads the config file `args.config` and decrypts the masterkey,
 // or gets via the `-masterkey` or `-zerokey` command line options, if specified.
 func loadConfig(args *argContainer) (masterkey []byte, cf *configfile.ConfFile, err error) {
@@ -44,13 +63,34 @@ func loadConfig(args *argContainer) (masterkey []byte, cf *configfile.ConfFile,
 		tlog.Fatal.Printf("Cannot open config file: %v", err)
 		return nil, nil, err
 	}
+	// "-zerokey" on a filesystem that has a real master key would create files
+	// that cannot be decrypted with the real key
+	if args.zerokey && !cf.IsZeroKey() {
+		tlog.Fatal.Printf("Config file %q has not been created with -zerokey", args.config)
+		return nil, nil, exitcodes.NewErr("not a -zerokey config file", exitcodes.MasterKey)
+	}
 	// The user may have passed the master key on the command line (probably because
 	// he forgot the password).
 	masterkey = handleArgsMasterkey(args)
 	if masterkey != nil {
 		return masterkey, cf, nil
 	}
-	pw := readpassword.Once([]string(args.extpass), []string(args.passfile), "")
+	// "-use-keyring": no password needed if the master key is cached
+	var keyDesc string
+	if args.useKeyring {
+		keyDesc = keyringDescription(args)
+		if masterkey = loadCachedKey(keyDesc); masterkey != nil {
+			return masterkey, cf, nil
+		}
+	}
+	if len(args.fido2) != 0 && !cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		tlog.Warn.Printf("The filesystem does not use a FIDO2 key, ignoring -fido2")
+	}
+	pw := readpassword.Once([]string(args.extpass), []string(args.passfile), args.passfd, "")
+	pw, err = combineFIDO2(args, cf, pw)
+	if err != nil {
+		return nil, nil, err
+	}
 	tlog.Info.Println("Decrypting master key")
 	masterkey, err = cf.DecryptMasterKey(pw)
 	for i := range pw {
@@ -61,6 +101,9 @@ func loadConfig(args *argContainer) (masterkey []byte, cf *configfile.ConfFile,
 		tlog.Fatal.Println(err)
 		return nil, nil, err
 	}
+	if args.useKeyring {
+		storeCachedKey(keyDesc, masterkey, args.keyringTTL)
+	}
 	return masterkey, cf, nil
 }
 
@@ -79,7 +122,19 @@ func changePassword(args *argContainer) {
 			log.Panic("empty masterkey")
 		}
 		tlog.Info.Println("Please enter your new password.")
-		newPw := readpassword.Twice([]string(args.extpass), []string(args.passfile))
+		newPw := readpassword.Twice([]string(args.extpass), []string(args.passfile), args.passfd)
+		// Resetting the password with "-masterkey" is the way out if all FIDO2
+		// keys have been lost, so it removes them. Otherwise, the FIDO2 slots
+		// stay the same, only the password changes.
+		if args.masterkey != "" && confFile.IsFeatureFlagSet(configfile.FlagFIDO2) {
+			tlog.Info.Printf("Removing all FIDO2 keys, the new password alone unlocks the filesystem")
+			confFile.ClearFeatureFlag(configfile.FlagFIDO2)
+			confFile.FIDO2 = nil
+		}
+		newPw, err = combineFIDO2(args, confFile, newPw)
+		if err != nil {
+			exitcodes.Exit(err)
+		}
 		logN := confFile.ScryptObject.LogN()
 		if args._explicitScryptn {
 			logN = args.scryptn
@@ -94,24 +149,23 @@ func changePassword(args *argContainer) {
 		// masterkey and newPw run out of scope here
 	}
 	// Are we resetting the password without knowing the old one using
-	// "-masterkey"?
+	// "-masterkey"? Then keep a copy of the old config file.
+	var err error
 	if args.masterkey != "" {
-		bak := args.config + ".bak"
-		err := os.Link(args.config, bak)
-		if err != nil {
-			tlog.Fatal.Printf("Could not create backup file: %v", err)
-			os.Exit(exitcodes.Init)
-		}
-		tlog.Info.Printf(tlog.ColorGrey+
-			"A copy of the old config file has been created at %q.\n"+
-			"Delete it after you have verified that you can access your files with the new password."+
-			tlog.ColorReset, bak)
+		err = confFile.WriteFileKeepBackup()
+	} else {
+		err = confFile.WriteFile()
 	}
-	err := confFile.WriteFile()
 	if err != nil {
 		tlog.Fatal.Println(err)
 		os.Exit(exitcodes.WriteConf)
 	}
+	if args.masterkey != "" {
+		tlog.Info.Printf(tlog.ColorGrey+
+			"A copy of the old config file has been created at %q.\n"+
+			"Delete it after you have verified that you can access your files with the new password."+
+			tlog.ColorReset, args.config+configfile.ConfBackupSuffix)
+	}
 	tlog.Info.Printf(tlog.ColorGreen + "Password changed." + tlog.ColorReset)
 }
 
@@ -154,12 +208,26 @@ func main() {
 	// Fork a child into the background if "-fg" is not set AND we are mounting
 	// a filesystem. The child will do all the work.
 	if !args.fg && flagSet.NArg() == 2 {
-		ret := forkChild()
+		ret := forkChild(args.passfd, args.readyFd)
 		os.Exit(ret)
 	}
+	// "-runtime-opts" overrides the options in runtimeArgs
+	args._cliRuntimeArgs = args.runtimeArgs
+	if args.runtimeOpts != "" {
+		args.runtimeOpts, _ = filepath.Abs(args.runtimeOpts)
+		args.runtimeArgs, err = readRuntimeOpts(args.runtimeOpts, args.runtimeArgs)
+		if err != nil {
+			tlog.Fatal.Printf("-runtime-opts: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
 	if args.debug {
 		tlog.Debug.Enabled = true
 	}
+	// "-silent"
+	if args.silent {
+		tlog.SetSilent(true)
+	}
 	// "-v"
 	if args.version {
 		tlog.Debug.Printf("openssl=%v\n", args.openssl)
@@ -176,6 +244,11 @@ func main() {
 	if args.speed {
 		printVersion()
 		speed.Run()
+		// "-speed DIR" additionally benchmarks preallocation on the filesystem
+		// that contains DIR
+		if flagSet.NArg() > 0 {
+			speed.RunPrealloc(flagSet.Arg(0))
+		}
 		os.Exit(0)
 	}
 	if args.wpanic {
@@ -205,14 +278,130 @@ func main() {
 	if args.quiet {
 		tlog.Info.Enabled = false
 	}
+	// "-json": stdout is reserved for the JSON document
+	if args.json {
+		tlog.Info.Enabled = false
+	}
+	// "-mlock", "-mlock-strict". Must come before we read the password.
+	if args.mlock || args.mlockStrict {
+		mlock.Enable(args.mlockStrict)
+	}
 	// "-reverse" implies "-aessiv"
 	if args.reverse {
 		args.aessiv = true
+		if args.stats {
+			tlog.Fatal.Printf("-stats only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.emulateHiresTime {
+			tlog.Fatal.Printf("-emulate-hires-time only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.coalesceWrites {
+			tlog.Fatal.Printf("-coalesce-writes only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.fsyncMetadata {
+			tlog.Fatal.Printf("-fsync-metadata only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.trash {
+			tlog.Fatal.Printf("-trash only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.quota > 0 {
+			tlog.Fatal.Printf("-quota only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.readBps > 0 || args.writeBps > 0 {
+			tlog.Fatal.Printf("-read-bps and -write-bps only work in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.preserveDirMtime {
+			tlog.Fatal.Printf("-preserve-dir-mtime only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.watch {
+			tlog.Fatal.Printf("-watch only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.dirCountCache {
+			tlog.Fatal.Printf("-dir-count-cache only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.readonlyAfter > 0 {
+			tlog.Fatal.Printf("-readonly-after only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.sortDirs {
+			tlog.Fatal.Printf("-sort-dirs only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.maxNameLength != 0 {
+			tlog.Fatal.Printf("-max-name-length only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.macosForks {
+			tlog.Fatal.Printf("-macos-forks only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.pruneEmptyOnUnmount {
+			tlog.Fatal.Printf("-prune-empty-on-unmount only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.maxBackingFds > 0 {
+			tlog.Fatal.Printf("-max-backing-fds only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.hideCorrupt || args.showCorrupt {
+			tlog.Fatal.Printf("-hide-corrupt and -show-corrupt only work in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.dirivName != "" {
+			tlog.Fatal.Printf("-diriv-name only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.secureDelete {
+			tlog.Fatal.Printf("-secure-delete only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.noatime {
+			tlog.Fatal.Printf("-noatime only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.compatOpendir {
+			tlog.Fatal.Printf("-compat-opendir only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.journal {
+			tlog.Fatal.Printf("-journal only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.showConf {
+			tlog.Fatal.Printf("-show-conf only works in forward mode")
+			os.Exit(exitcodes.Usage)
+		}
 	} else {
 		if args.exclude != nil {
 			tlog.Fatal.Printf("-exclude only works in reverse mode")
 			os.Exit(exitcodes.ExcludeError)
 		}
+		if args.reverseInclude != nil {
+			tlog.Fatal.Printf("-reverse-include only works in reverse mode")
+			os.Exit(exitcodes.ExcludeError)
+		}
+		if args.reverseNameOnly {
+			tlog.Fatal.Printf("-reverse-name-only only works in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	// "-stats" can only be queried through the control socket
+	if args.stats && args.ctlsock == "" && args.ctlsockRo == "" {
+		tlog.Info.Printf(tlog.ColorYellow + "-stats: statistics can only be queried via -ctlsock or -ctlsock-ro" + tlog.ColorReset)
+	}
+	// "-trash" can only be emptied through the control socket
+	if args.trash && args.ctlsock == "" {
+		tlog.Info.Printf(tlog.ColorYellow + "-trash: the trash can only be restored and emptied via -ctlsock" + tlog.ColorReset)
 	}
 	// "-config"
 	if args.config != "" {
@@ -222,11 +411,11 @@ func main() {
 			os.Exit(exitcodes.Init)
 		}
 		tlog.Info.Printf("Using config file at custom location %s", args.config)
-		args._configCustom = true
-	} else if args.reverse {
-		args.config = filepath.Join(args.cipherdir, configfile.ConfReverseName)
+		// Pointing "-config" at the default location is the same as not
+		// passing it at all
+		args._configCustom = args.config != defaultConfigPath(&args)
 	} else {
-		args.config = filepath.Join(args.cipherdir, configfile.ConfDefaultName)
+		args.config = defaultConfigPath(&args)
 	}
 	// "-force_owner"
 	if args.force_owner != "" {
@@ -266,6 +455,8 @@ func main() {
 	if args.cpuprofile != "" || args.memprofile != "" || args.trace != "" {
 		tlog.Info.Printf("Note: You must unmount gracefully, otherwise the profile file(s) will stay empty!\n")
 	}
+	// "-retry"
+	syscallcompat.SetRetry(args.retry, args.retryBackoff)
 	// "-openssl"
 	if !args.openssl {
 		tlog.Debug.Printf("OpenSSL disabled, using Go GCM")
@@ -274,6 +465,12 @@ func main() {
 	}
 	// Operation flags
 	nOps := countOpFlags(&args)
+	// A cached master key must not skip the password check of "-passwd" and
+	// the other operations
+	if args.useKeyring && nOps != 0 {
+		tlog.Fatal.Printf("-use-keyring only works when mounting")
+		os.Exit(exitcodes.Usage)
+	}
 	if nOps == 0 {
 		// Default operation: mount.
 		if flagSet.NArg() != 2 {
@@ -283,31 +480,36 @@ func main() {
 			tlog.Fatal.Printf("Usage: %s [OPTIONS] CIPHERDIR MOUNTPOINT [-o COMMA-SEPARATED-OPTIONS]", tlog.ProgramName)
 			os.Exit(exitcodes.Usage)
 		}
-		doMount(&args)
+		err := doMount(&args)
+		if err != nil {
+			exitcodes.Exit(err)
+		}
 		// Don't call os.Exit to give deferred functions a chance to run
 		return
 	}
 	if nOps > 1 {
-		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -fsck is allowed")
+		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -fsck, -scrub, -migrate-names, -repair-longnames, -encrypt-path, -decrypt-path, -same-masterkey, -fido2-add, -fido2-remove, -clear-keyring is allowed")
 		os.Exit(exitcodes.Usage)
 	}
 	if flagSet.NArg() != 1 {
-		tlog.Fatal.Printf("The options -info, -init, -passwd, -fsck take exactly one argument, %d given",
+		tlog.Fatal.Printf("The options -info, -init, -passwd, -fsck, -scrub, -migrate-names, -repair-longnames, -encrypt-path, -decrypt-path, -same-masterkey, -fido2-add, -fido2-remove, -clear-keyring take exactly one argument, %d given",
 			flagSet.NArg())
 		os.Exit(exitcodes.Usage)
 	}
 	// "-info"
 	if args.info {
-		info(args.config)
+		info(args.config, args.json)
 		os.Exit(0)
 	}
 	// "-init"
 	if args.init {
+		showKDFProgress()
 		initDir(&args)
 		os.Exit(0)
 	}
 	// "-passwd"
 	if args.passwd {
+		showKDFProgress()
 		changePassword(&args)
 		os.Exit(0)
 	}
@@ -316,4 +518,47 @@ func main() {
 		fsck(&args)
 		os.Exit(0)
 	}
+	// "-scrub"
+	if args.scrub {
+		scrub(&args)
+		os.Exit(0)
+	}
+	// "-migrate-names"
+	if args.migrateNames {
+		migrateNames(&args)
+		os.Exit(0)
+	}
+	// "-repair-longnames"
+	if args.repairLongnames {
+		repairLongNames(&args)
+		os.Exit(0)
+	}
+	// "-encrypt-path", "-decrypt-path"
+	if args.encryptPath != "" || args.decryptPath != "" {
+		translatePath(&args)
+		os.Exit(0)
+	}
+	// "-same-masterkey"
+	if args.sameMasterkey != "" {
+		showKDFProgress()
+		sameMasterkey(&args)
+		os.Exit(0)
+	}
+	// "-fido2-add"
+	if args.fido2Add != "" {
+		showKDFProgress()
+		fido2Add(&args)
+		os.Exit(0)
+	}
+	// "-fido2-remove"
+	if args.fido2Remove >= 0 {
+		showKDFProgress()
+		fido2Remove(&args)
+		os.Exit(0)
+	}
+	// "-clear-keyring"
+	if args.clearKeyring {
+		clearKeyring(&args)
+		os.Exit(0)
+	}
 }
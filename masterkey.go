@@ -2,12 +2,23 @@ package main
 
 import (
 	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"syscall"
 
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/mlock"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -20,6 +31,7 @@ func unhexMasterKey(masterkey string, fromStdin bool) []byte {
 		tlog.Fatal.Printf("Could not parse master key: %v", err)
 		os.Exit(exitcodes.MasterKey)
 	}
+	mlock.Lock(key)
 	if len(key) != cryptocore.KeyLen {
 		tlog.Fatal.Printf("Master key has length %d but we require length %d", len(key), cryptocore.KeyLen)
 		os.Exit(exitcodes.MasterKey)
@@ -39,7 +51,7 @@ func unhexMasterKey(masterkey string, fromStdin bool) []byte {
 func handleArgsMasterkey(args *argContainer) (masterkey []byte) {
 	// "-masterkey=stdin"
 	if args.masterkey == "stdin" {
-		in := string(readpassword.Once(nil, nil, "Masterkey"))
+		in := string(readpassword.Once(nil, nil, -1, "Masterkey"))
 		return unhexMasterKey(in, true)
 	}
 	// "-masterkey=941a6029-3adc6a1c-..."
@@ -48,13 +60,185 @@ func handleArgsMasterkey(args *argContainer) (masterkey []byte) {
 	}
 	// "-zerokey"
 	if args.zerokey {
-		tlog.Info.Printf("Using all-zero dummy master key.")
-		tlog.Info.Printf(tlog.ColorYellow +
-			"ZEROKEY MODE PROVIDES NO SECURITY AT ALL AND SHOULD ONLY BE USED FOR TESTING." +
-			tlog.ColorReset)
+		printZerokeyWarning()
 		return make([]byte, cryptocore.KeyLen)
 	}
 	// No master key source specified on the command line. Caller must parse
 	// the config file.
 	return nil
 }
+
+// printZerokeyWarning tells the user that "-zerokey" is not meant for real
+// data
+func printZerokeyWarning() {
+	tlog.Info.Printf("Using all-zero dummy master key.")
+	tlog.Info.Printf(tlog.ColorYellow +
+		"ZEROKEY MODE PROVIDES NO SECURITY AT ALL AND SHOULD ONLY BE USED FOR TESTING." +
+		tlog.ColorReset)
+}
+
+// masterkeyCheckMax is the maximum number of file names and of files that
+// checkMasterkeyFormat looks at
+const masterkeyCheckMax = 10
+
+// checkMasterkeyFormat checks that the filesystem in "cipherdir" can be
+// read with the master key and the feature flags passed on the command
+// line. Without a config file, nothing else tells us about the on-disk
+// format, and a mismatch would only show up as EIO later on.
+//
+// The check passes if one file name and one file content decrypt, so a
+// few corrupt files do not prevent the mount. An empty filesystem always
+// passes.
+func checkMasterkeyFormat(cipherdir string, plaintextNames bool, flat bool, dirIVXattr bool,
+	n *nametransform.NameTransform, cEnc *contentenc.ContentEnc) error {
+	entries, err := ioutil.ReadDir(cipherdir)
+	if err != nil {
+		return err
+	}
+	dirIVName := n.DirIVName()
+	_, err = os.Stat(filepath.Join(cipherdir, dirIVName))
+	hasDirIV := err == nil
+	switch {
+	case plaintextNames && hasDirIV:
+		return fmt.Errorf("CIPHERDIR contains %s, so the file names are encrypted. Drop -plaintextnames",
+			dirIVName)
+	case flat && hasDirIV:
+		return fmt.Errorf("CIPHERDIR contains %s, so the filesystem is not flat. Drop -flat",
+			dirIVName)
+	case dirIVXattr && hasDirIV:
+		return fmt.Errorf("CIPHERDIR contains %s, so the directory IVs are not stored in xattrs. Drop -diriv-xattr",
+			dirIVName)
+	case !plaintextNames && !flat && !dirIVXattr && !hasDirIV && len(masterkeyCheckNames(entries, false, dirIVName)) > 0:
+		return fmt.Errorf("%s is missing in CIPHERDIR. Was the filesystem created with -plaintextnames, -flat, -diriv-xattr or -diriv-name?",
+			dirIVName)
+	}
+	if !plaintextNames {
+		if err = checkMasterkeyNames(cipherdir, masterkeyCheckNames(entries, true, dirIVName), n); err != nil {
+			return err
+		}
+	}
+	return checkMasterkeyContent(cipherdir, cEnc, dirIVName)
+}
+
+// isInternalRootName returns true if "name" in the root of CIPHERDIR is
+// one of gocryptfs' own files. "dirIVName" is the name of the DirIV files.
+func isInternalRootName(name string, dirIVName string) bool {
+	return configfile.IsConfName(name) ||
+		name == dirIVName || name == fusefrontend.TrashDirName ||
+		name == fusefrontend.LongLinkDirName || name == fusefrontend.JournalDirName
+}
+
+// masterkeyCheckNames returns the names in "entries" that are not
+// gocryptfs' own files. With "content" set, only returns the names that
+// belong to a file or directory, and not the ".name" files of long names.
+func masterkeyCheckNames(entries []os.FileInfo, content bool, dirIVName string) []string {
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if isInternalRootName(name, dirIVName) {
+			continue
+		}
+		if content && nametransform.NameType(name) == nametransform.LongNameFilename {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// checkMasterkeyNames tries to decrypt "names" in the root directory
+// "cipherdir"
+func checkMasterkeyNames(cipherdir string, names []string, n *nametransform.NameTransform) error {
+	if len(names) == 0 {
+		return nil
+	}
+	dirfd, err := syscallcompat.OpenDirNofollow(cipherdir, "")
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	iv, err := n.ReadDirIVAt(dirfd)
+	if err != nil {
+		return err
+	}
+	tried := 0
+	for _, cName := range names {
+		if tried == masterkeyCheckMax {
+			break
+		}
+		tried++
+		if nametransform.IsLongContent(cName) {
+			cName, err = nametransform.ReadLongNameAt(dirfd, cName)
+			if err != nil {
+				continue
+			}
+		}
+		if _, err = n.DecryptName(cName, iv); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("none of the %d file names that were tried could be decrypted. "+
+		"Wrong master key, or -raw64 or -hkdf do not match the filesystem", tried)
+}
+
+// checkMasterkeyContent tries to decrypt the first block of the non-empty
+// files it finds in "cipherdir", breadth-first
+func checkMasterkeyContent(cipherdir string, cEnc *contentenc.ContentEnc, dirIVName string) error {
+	dirs := []string{cipherdir}
+	tried := 0
+	for len(dirs) > 0 && tried < masterkeyCheckMax {
+		dir := dirs[0]
+		dirs = dirs[1:]
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if dir == cipherdir && isInternalRootName(e.Name(), dirIVName) {
+				continue
+			}
+			if e.IsDir() {
+				dirs = append(dirs, filepath.Join(dir, e.Name()))
+				continue
+			}
+			if !e.Mode().IsRegular() || e.Size() <= contentenc.HeaderLen ||
+				nametransform.NameType(e.Name()) == nametransform.LongNameFilename ||
+				e.Name() == dirIVName {
+				continue
+			}
+			if tried == masterkeyCheckMax {
+				break
+			}
+			tried++
+			if checkMasterkeyFile(filepath.Join(dir, e.Name()), cEnc) == nil {
+				return nil
+			}
+		}
+	}
+	if tried == 0 {
+		return nil
+	}
+	return fmt.Errorf("none of the %d files that were tried could be decrypted. "+
+		"Wrong master key, or -aessiv, -hkdf or -blockcrc do not match the filesystem", tried)
+}
+
+// checkMasterkeyFile decrypts the first block of the file at "path"
+func checkMasterkeyFile(path string, cEnc *contentenc.ContentEnc) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, contentenc.HeaderLen+cEnc.CipherBS())
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	buf = buf[:n]
+	h, err := cEnc.ParseHeader(buf[:contentenc.HeaderLen])
+	if err != nil {
+		return err
+	}
+	_, err = cEnc.DecryptBlock(buf[contentenc.HeaderLen:], 0, h.ID)
+	return err
+}
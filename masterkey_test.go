@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// masterkeyTestFlags are the feature flags that can be passed on the command
+// line together with "-masterkey"
+type masterkeyTestFlags struct {
+	aessiv, hkdf, raw64, plaintextNames bool
+}
+
+// masterkeyTestCrypto returns the name and content encryption for "key" and
+// "flags"
+func masterkeyTestCrypto(key []byte, flags masterkeyTestFlags) (*nametransform.NameTransform, *contentenc.ContentEnc) {
+	backend := cryptocore.BackendGoGCM
+	if flags.aessiv {
+		backend = cryptocore.BackendAESSIV
+	}
+	cCore := cryptocore.New(key, backend, contentenc.DefaultIVBits, flags.hkdf, false)
+	return nametransform.New(cCore.EMECipher, true, flags.raw64), contentenc.New(cCore, contentenc.DefaultBS, false, false)
+}
+
+// masterkeyTestFS creates a filesystem with a few files in a temporary
+// directory
+func masterkeyTestFS(t *testing.T, key []byte, flags masterkeyTestFlags) string {
+	dir, err := ioutil.TempDir("", "gocryptfs-test-masterkey.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !flags.plaintextNames {
+		dirfd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = nametransform.WriteDirIVAt(dirfd)
+		syscall.Close(dirfd)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, cEnc := masterkeyTestCrypto(key, flags)
+	fs := fusefrontend.NewFS(fusefrontend.Args{Cipherdir: dir, PlaintextNames: flags.plaintextNames, LongNames: true}, cEnc, n)
+	if code := fs.Mkdir("dir", 0700, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	for _, name := range []string{"dir/foo", strings.Repeat("x", 200)} {
+		f, code := fs.Create(name, uint32(os.O_WRONLY), 0600, nil)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		if _, code = f.Write([]byte("hello"), 0); !code.Ok() {
+			t.Fatal(code)
+		}
+		f.Release()
+	}
+	return dir
+}
+
+func TestCheckMasterkeyFormat(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	key[0] = 1
+	otherKey := make([]byte, cryptocore.KeyLen)
+	def := masterkeyTestFlags{hkdf: true, raw64: true}
+	testcases := []struct {
+		created masterkeyTestFlags
+		mounted masterkeyTestFlags
+		key     []byte
+		ok      bool
+	}{
+		{def, def, key, true},
+		{def, def, otherKey, false},
+		{def, masterkeyTestFlags{aessiv: true, hkdf: true, raw64: true}, key, false},
+		{def, masterkeyTestFlags{hkdf: true}, key, false},
+		{def, masterkeyTestFlags{raw64: true}, key, false},
+		{def, masterkeyTestFlags{hkdf: true, raw64: true, plaintextNames: true}, key, false},
+		{masterkeyTestFlags{aessiv: true, hkdf: true, raw64: true}, masterkeyTestFlags{aessiv: true, hkdf: true, raw64: true}, key, true},
+		{masterkeyTestFlags{hkdf: true, plaintextNames: true}, masterkeyTestFlags{hkdf: true, plaintextNames: true}, key, true},
+		{masterkeyTestFlags{hkdf: true, plaintextNames: true}, def, key, false},
+	}
+	for i, tc := range testcases {
+		dir := masterkeyTestFS(t, key, tc.created)
+		n, cEnc := masterkeyTestCrypto(tc.key, tc.mounted)
+		err := checkMasterkeyFormat(dir, tc.mounted.plaintextNames, false, false, n, cEnc)
+		if (err == nil) != tc.ok {
+			t.Errorf("testcase %d: created with %+v, mounted with %+v: want ok=%v, got %v",
+				i, tc.created, tc.mounted, tc.ok, err)
+		}
+		os.RemoveAll(dir)
+	}
+	// An empty filesystem always passes
+	dir, err := ioutil.TempDir("", "gocryptfs-test-masterkey.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	n, cEnc := masterkeyTestCrypto(otherKey, def)
+	if err = checkMasterkeyFormat(dir, true, false, false, n, cEnc); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+// "-migrate-names": encrypt the file names of a filesystem that has been
+// created with "-plaintextnames", in place. File contents are encrypted the
+// same way with and without encrypted names and are not touched.
+//
+// The migration works one directory at a time, top-down. Before the entries
+// of a directory are renamed, their names and the new directory IV are
+// recorded in a journal file in the directory. gocryptfs.diriv is written
+// after all entries have been renamed, and the journal is deleted after
+// that. If the migration is interrupted, running it again replays the
+// journals it finds and continues with the directories that have no
+// gocryptfs.diriv yet.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// migrateJournalName is the name of the journal file that
+	// "-migrate-names" keeps in the directory it is working on
+	migrateJournalName = "gocryptfs.migrate"
+	migrateJournalTmp  = migrateJournalName + ".tmp"
+)
+
+// migrateJournal is the content of the journal file
+type migrateJournal struct {
+	// DirIV is the IV the entries are encrypted with. It is written to
+	// gocryptfs.diriv when all entries have been renamed.
+	DirIV []byte
+	// Entries lists the directory entries that have to be renamed
+	Entries []migrateEntry
+}
+
+type migrateEntry struct {
+	// Name is the plaintext name of the entry
+	Name string
+	// Target is the encrypted symlink target if the entry is a symlink.
+	// Symlink targets are encrypted with a random nonce, so we have to
+	// store the result to get the same symlink when the journal is
+	// replayed.
+	Target string `json:",omitempty"`
+}
+
+// nameMigration holds what we need to migrate the directories of a
+// filesystem
+type nameMigration struct {
+	configCustom  bool
+	nameTransform *nametransform.NameTransform
+	contentEnc    *contentenc.ContentEnc
+}
+
+// migrateNamesHook is called after each step that changes the cipherdir.
+// Used by the tests to simulate a crash.
+var migrateNamesHook = func(step string) {}
+
+// migrateNames implements "-migrate-names".
+// Calls os.Exit on errors.
+func migrateNames(args *argContainer) {
+	if args.reverse {
+		tlog.Fatal.Printf("-migrate-names only works in forward mode")
+		os.Exit(exitcodes.Usage)
+	}
+	masterkey, cf, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	err = migrateNamesConf(args.cipherdir, args._configCustom, cf, masterkey)
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-migrate-names: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+}
+
+// migrateNamesConf encrypts the file names in "cipherdir" and updates the
+// feature flags in "cf". It starts a new migration if "cf" has the
+// PlaintextNames flag, and finishes an interrupted one if it has the
+// NamesMigration flag.
+func migrateNamesConf(cipherdir string, configCustom bool, cf *configfile.ConfFile, masterkey []byte) error {
+	if !cf.IsFeatureFlagSet(configfile.FlagPlaintextNames) && !cf.IsFeatureFlagSet(configfile.FlagNamesMigration) {
+		tlog.Info.Printf("File names are already encrypted, nothing to do")
+		return nil
+	}
+	cryptoBackend := cryptocore.BackendGoGCM
+	if cf.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		cryptoBackend = cryptocore.BackendAESSIV
+	}
+	cCore := cryptocore.New(masterkey, cryptoBackend, contentenc.DefaultIVBits,
+		cf.IsFeatureFlagSet(configfile.FlagHKDF), false)
+	defer cCore.Wipe()
+	m := nameMigration{
+		configCustom:  configCustom,
+		nameTransform: nametransform.New(cCore.EMECipher, true, true),
+		contentEnc:    contentenc.New(cCore, contentenc.DefaultBS, false, cf.IsFeatureFlagSet(configfile.FlagBlockCRC)),
+	}
+	rootfd, err := syscall.Open(cipherdir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(rootfd)
+	if cf.IsFeatureFlagSet(configfile.FlagPlaintextNames) {
+		// Names that would confuse a resumed migration must not exist
+		// anywhere. This is only checked on the first run: afterwards, the
+		// names we create ourselves exist.
+		if err = m.checkDir(rootfd, ""); err != nil {
+			return err
+		}
+		cf.ClearFeatureFlag(configfile.FlagPlaintextNames)
+		cf.SetFeatureFlag(configfile.FlagDirIV)
+		cf.SetFeatureFlag(configfile.FlagEMENames)
+		cf.SetFeatureFlag(configfile.FlagLongNames)
+		cf.SetFeatureFlag(configfile.FlagRaw64)
+		cf.SetFeatureFlag(configfile.FlagNamesMigration)
+		if err = cf.WriteFile(); err != nil {
+			return err
+		}
+		migrateNamesHook("config")
+	} else {
+		tlog.Info.Printf("Resuming interrupted migration")
+	}
+	if err = m.migrateDir(rootfd, ""); err != nil {
+		return err
+	}
+	cf.ClearFeatureFlag(configfile.FlagNamesMigration)
+	if err = cf.WriteFile(); err != nil {
+		return err
+	}
+	tlog.Info.Printf(tlog.ColorGreen + "File names encrypted successfully." + tlog.ColorReset)
+	return nil
+}
+
+// isConfName returns true if "name" in "relDir" is the config file or its
+// backup. These stay where they are.
+func (m *nameMigration) isConfName(relDir string, name string) bool {
+	return relDir == "" && !m.configCustom && configfile.IsConfName(name)
+}
+
+// readDirAt lists the entries of the directory "dirfd", without "." and "..".
+func readDirAt(dirfd int) ([]fuse.DirEntry, error) {
+	// Open the directory again to get a fresh directory offset
+	fd, err := syscallcompat.Openat(dirfd, ".", syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	entries, err := syscallcompat.Getdents(fd)
+	if err != nil {
+		return nil, err
+	}
+	out := entries[:0]
+	for _, e := range entries {
+		if e.Name != "." && e.Name != ".." {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+// isDirEntry returns true if "e" is a directory
+func isDirEntry(e fuse.DirEntry) bool {
+	return e.Mode&syscall.S_IFMT == syscall.S_IFDIR
+}
+
+// openSubdir opens the directory "name" in "dirfd" for reading
+func openSubdir(dirfd int, name string) (int, error) {
+	return syscallcompat.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+}
+
+// checkDir checks that there are no entries with names that gocryptfs uses
+// for itself in the directory "dirfd" and below.
+func (m *nameMigration) checkDir(dirfd int, relDir string) error {
+	entries, err := readDirAt(dirfd)
+	if err != nil {
+		return fmt.Errorf("%q: %v", "/"+relDir, err)
+	}
+	for _, e := range entries {
+		relPath := filepath.Join(relDir, e.Name)
+		if m.isConfName(relDir, e.Name) {
+			continue
+		}
+		if relDir == "" && e.Name == fusefrontend.TrashDirName {
+			// The trashed entries would not be migrated
+			return fmt.Errorf("%q: please empty the -trash directory first", "/"+relPath)
+		}
+		if relDir == "" && e.Name == fusefrontend.JournalDirName {
+			// Left-over -journal records are replayed by the next mount
+			// with -journal, before the names change
+			continue
+		}
+		if e.Name == nametransform.DirIVFilename || e.Name == migrateJournalName ||
+			e.Name == migrateJournalTmp || nametransform.NameType(e.Name) != nametransform.LongNameNone {
+			return fmt.Errorf("%q: the name is reserved when file names are encrypted, "+
+				"please rename it", "/"+relPath)
+		}
+		if !isDirEntry(e) {
+			continue
+		}
+		fd, err := openSubdir(dirfd, e.Name)
+		if err != nil {
+			return fmt.Errorf("%q: %v", "/"+relPath, err)
+		}
+		err = m.checkDir(fd, relPath)
+		syscall.Close(fd)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateDir encrypts the names in the directory "dirfd" and below.
+func (m *nameMigration) migrateDir(dirfd int, relDir string) error {
+	j, err := readJournalAt(dirfd)
+	if err == syscall.ENOENT {
+		var st unix.Stat_t
+		err = syscallcompat.Fstatat(dirfd, nametransform.DirIVFilename, &st, unix.AT_SYMLINK_NOFOLLOW)
+		if err == syscall.ENOENT {
+			// Not migrated yet
+			j, err = m.writeJournal(dirfd, relDir)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%q: %v", "/"+relDir, err)
+	}
+	// j is nil if the directory has been migrated completely before
+	if j != nil {
+		if err = m.replayJournal(dirfd, relDir, j); err != nil {
+			return err
+		}
+	}
+	entries, err := readDirAt(dirfd)
+	if err != nil {
+		return fmt.Errorf("%q: %v", "/"+relDir, err)
+	}
+	for _, e := range entries {
+		if !isDirEntry(e) {
+			continue
+		}
+		relPath := filepath.Join(relDir, e.Name)
+		fd, err := openSubdir(dirfd, e.Name)
+		if err != nil {
+			return fmt.Errorf("%q: %v", "/"+relPath, err)
+		}
+		err = m.migrateDir(fd, relPath)
+		syscall.Close(fd)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readJournalAt reads the journal in "dirfd". Returns ENOENT if there is none.
+func readJournalAt(dirfd int) (*migrateJournal, error) {
+	fd, err := syscallcompat.Openat(dirfd, migrateJournalName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), migrateJournalName)
+	js, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	var j migrateJournal
+	err = json.Unmarshal(js, &j)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt %s: %v", migrateJournalName, err)
+	}
+	if len(j.DirIV) != nametransform.DirIVLen {
+		return nil, fmt.Errorf("corrupt %s: invalid DirIV length %d", migrateJournalName, len(j.DirIV))
+	}
+	return &j, nil
+}
+
+// writeFileAt atomically creates the file "name" in "dirfd" with content
+// "data" and makes it durable.
+func writeFileAt(dirfd int, name string, data []byte, mode uint32) error {
+	tmp := name + ".tmp"
+	// Left over from an earlier run that was interrupted
+	syscallcompat.Unlinkat(dirfd, tmp, 0)
+	fd, err := syscallcompat.Openat(dirfd, tmp, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, mode)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), tmp)
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		syscallcompat.Unlinkat(dirfd, tmp, 0)
+		return err
+	}
+	err = syscallcompat.Renameat(dirfd, tmp, dirfd, name)
+	if err != nil {
+		return err
+	}
+	return syscall.Fsync(dirfd)
+}
+
+// writeJournal records the entries of the directory "dirfd" and a new
+// random directory IV in the journal.
+func (m *nameMigration) writeJournal(dirfd int, relDir string) (*migrateJournal, error) {
+	entries, err := readDirAt(dirfd)
+	if err != nil {
+		return nil, err
+	}
+	j := &migrateJournal{
+		DirIV:   cryptocore.RandBytes(nametransform.DirIVLen),
+		Entries: []migrateEntry{},
+	}
+	for _, e := range entries {
+		if m.isConfName(relDir, e.Name) || e.Name == migrateJournalTmp {
+			continue
+		}
+		me := migrateEntry{Name: e.Name}
+		if e.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+			target, err := syscallcompat.Readlinkat(dirfd, e.Name)
+			if err != nil {
+				return nil, err
+			}
+			cTarget := m.contentEnc.EncryptBlock([]byte(target), 0, nil)
+			me.Target = m.nameTransform.B64EncodeToString(cTarget)
+		}
+		j.Entries = append(j.Entries, me)
+	}
+	js, err := json.MarshalIndent(j, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	err = writeFileAt(dirfd, migrateJournalName, js, 0400)
+	if err != nil {
+		return nil, err
+	}
+	migrateNamesHook("journal")
+	return j, nil
+}
+
+// replayJournal renames the entries listed in the journal "j" that have not
+// been renamed yet, writes gocryptfs.diriv and deletes the journal.
+func (m *nameMigration) replayJournal(dirfd int, relDir string, j *migrateJournal) error {
+	for _, e := range j.Entries {
+		relPath := filepath.Join(relDir, e.Name)
+		err := m.migrateEntry(dirfd, j.DirIV, e)
+		if err != nil {
+			return fmt.Errorf("%q: %v", "/"+relPath, err)
+		}
+	}
+	err := syscall.Fsync(dirfd)
+	if err == nil {
+		err = writeFileAt(dirfd, nametransform.DirIVFilename, j.DirIV, 0440)
+	}
+	if err != nil {
+		return fmt.Errorf("%q: %v", "/"+relDir, err)
+	}
+	migrateNamesHook("diriv")
+	err = syscallcompat.Unlinkat(dirfd, migrateJournalName, 0)
+	if err == nil {
+		err = syscall.Fsync(dirfd)
+	}
+	if err != nil {
+		return fmt.Errorf("%q: %v", "/"+relDir, err)
+	}
+	migrateNamesHook("done")
+	return nil
+}
+
+// migrateEntry renames the entry "e" to its encrypted name. Does nothing if
+// it has been renamed before.
+func (m *nameMigration) migrateEntry(dirfd int, iv []byte, e migrateEntry) error {
+	var st unix.Stat_t
+	err := syscallcompat.Fstatat(dirfd, e.Name, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err == syscall.ENOENT {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	cName, err := m.nameTransform.EncryptAndHashName(e.Name, iv)
+	if err != nil {
+		return err
+	}
+	if nametransform.IsLongContent(cName) {
+		// The long name file may be left over from an interrupted run, and
+		// is replaced. checkDir has made sure that it is not a user file.
+		lName := cName + nametransform.LongNameSuffix
+		err = writeFileAt(dirfd, lName, []byte(m.nameTransform.EncryptName(e.Name, iv)), 0400)
+		if err != nil {
+			return err
+		}
+	}
+	if e.Target != "" {
+		err = migrateSymlink(dirfd, e, cName, &st)
+	} else {
+		err = migrateRename(dirfd, e.Name, cName)
+	}
+	if err != nil {
+		return err
+	}
+	migrateNamesHook("entry")
+	return nil
+}
+
+// migrateRename renames "name" to "cName" in "dirfd", but never replaces an
+// existing "cName".
+func migrateRename(dirfd int, name string, cName string) error {
+	var st unix.Stat_t
+	err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err == nil {
+		return fmt.Errorf("cannot rename to %q: file exists", cName)
+	} else if err != syscall.ENOENT {
+		return err
+	}
+	return syscallcompat.Renameat(dirfd, name, dirfd, cName)
+}
+
+// migrateSymlink replaces the symlink "e" with a symlink "cName" that points
+// to the encrypted target. "st" is the stat data of the old symlink.
+func migrateSymlink(dirfd int, e migrateEntry, cName string, st *unix.Stat_t) error {
+	target, err := syscallcompat.Readlinkat(dirfd, cName)
+	if err == nil {
+		// Created by an interrupted run
+		if target != e.Target {
+			return fmt.Errorf("cannot create symlink %q: file exists", cName)
+		}
+	} else {
+		err = syscallcompat.Symlinkat(e.Target, dirfd, cName)
+		if err != nil {
+			return err
+		}
+	}
+	// Keep owner and timestamps. Changing the owner fails if we are not
+	// root and do not own the symlink, which is not worth failing over.
+	err = syscallcompat.Fchownat(dirfd, cName, int(st.Uid), int(st.Gid), unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		tlog.Warn.Printf("symlink %q: could not keep owner: %v", e.Name, err)
+	}
+	atime := time.Unix(st.Atim.Unix())
+	mtime := time.Unix(st.Mtim.Unix())
+	err = syscallcompat.UtimesNanoAtNofollow(dirfd, cName, &atime, &mtime)
+	if err != nil {
+		tlog.Warn.Printf("symlink %q: could not keep timestamps: %v", e.Name, err)
+	}
+	return syscallcompat.Unlinkat(dirfd, e.Name, 0)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// migrateTestFS creates a "-plaintextnames" filesystem in a temporary
+// directory and returns the directory and the master key.
+func migrateTestFS(t *testing.T) (string, []byte) {
+	dir, err := ioutil.TempDir("", "gocryptfs-test-migrate.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, configfile.ConfDefaultName)
+	err = configfile.Create(&configfile.CreateArgs{
+		Filename:       conf,
+		Password:       []byte("test"),
+		PlaintextNames: true,
+		LogN:           10,
+		Creator:        "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterkey, _, err := configfile.LoadAndDecrypt(conf, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, masterkey
+}
+
+// loadTestFS returns the filesystem in "dir" as configured by its config file
+func loadTestFS(t *testing.T, dir string, masterkey []byte) (*fusefrontend.FS, *configfile.ConfFile) {
+	cf, err := configfile.Load(filepath.Join(dir, configfile.ConfDefaultName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := fusefrontend.Args{
+		Cipherdir:      dir,
+		PlaintextNames: cf.IsFeatureFlagSet(configfile.FlagPlaintextNames),
+		LongNames:      cf.IsFeatureFlagSet(configfile.FlagLongNames),
+	}
+	cCore := cryptocore.New(masterkey, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true, false)
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS, false, false)
+	nameTransform := nametransform.New(cCore.EMECipher, args.LongNames,
+		cf.IsFeatureFlagSet(configfile.FlagRaw64))
+	return fusefrontend.NewFS(args, cEnc, nameTransform), cf
+}
+
+// migrateTestTree creates files, directories and symlinks with short and
+// long names in the filesystem "fs".
+func migrateTestTree(t *testing.T, fs *fusefrontend.FS) {
+	longName := strings.Repeat("l", 200)
+	for _, d := range []string{"dir", "dir/sub", "dir/" + longName} {
+		if code := fs.Mkdir(d, 0700, nil); !code.Ok() {
+			t.Fatalf("Mkdir %q: %v", d, code)
+		}
+	}
+	for _, f := range []string{"dir/file", "dir/sub/" + longName} {
+		file, code := fs.Create(f, uint32(os.O_WRONLY), 0600, nil)
+		if !code.Ok() {
+			t.Fatalf("Create %q: %v", f, code)
+		}
+		if _, code = file.Write([]byte(f), 0); !code.Ok() {
+			t.Fatal(code)
+		}
+		file.Release()
+	}
+	if code := fs.Symlink("../target", "dir/link", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.Symlink("x", "dir/"+longName+"/"+longName+"2", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+}
+
+// listTree returns the content of the filesystem "fs" as a string
+func listTree(t *testing.T, fs *fusefrontend.FS, dir string) string {
+	entries, code := fs.OpenDir(dir, nil)
+	if !code.Ok() {
+		t.Fatalf("OpenDir %q: %v", dir, code)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	var out string
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name)
+		out += p
+		switch e.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			out += "/\n" + listTree(t, fs, p)
+			continue
+		case syscall.S_IFLNK:
+			target, code := fs.Readlink(p, nil)
+			if !code.Ok() {
+				t.Fatalf("Readlink %q: %v", p, code)
+			}
+			out += " -> " + target
+		default:
+			file, code := fs.Open(p, uint32(os.O_RDONLY), nil)
+			if !code.Ok() {
+				t.Fatalf("Open %q: %v", p, code)
+			}
+			buf := make([]byte, 1000)
+			res, code := file.Read(buf, 0)
+			if !code.Ok() {
+				t.Fatalf("Read %q: %v", p, code)
+			}
+			data, _ := res.Bytes(buf)
+			out += ": " + string(data)
+			file.Release()
+		}
+		out += "\n"
+	}
+	return out
+}
+
+type migrateCrash struct{}
+
+// migrateNamesCrash runs the migration and simulates a crash at step
+// "crashAt". Returns false if it has crashed.
+func migrateNamesCrash(t *testing.T, dir string, masterkey []byte, crashAt int) (done bool) {
+	var step int
+	migrateNamesHook = func(string) {
+		step++
+		if step == crashAt {
+			panic(migrateCrash{})
+		}
+	}
+	defer func() {
+		migrateNamesHook = func(string) {}
+		if r := recover(); r != nil {
+			if _, ok := r.(migrateCrash); !ok {
+				panic(r)
+			}
+		}
+	}()
+	cf, err := configfile.Load(filepath.Join(dir, configfile.ConfDefaultName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrateNamesConf(dir, false, cf, append([]byte(nil), masterkey...)); err != nil {
+		t.Fatal(err)
+	}
+	return true
+}
+
+// TestMigrateNames migrates a filesystem from "-plaintextnames" to encrypted
+// names. The migration is interrupted at every step in turn, and resumed,
+// like after a crash.
+func TestMigrateNames(t *testing.T) {
+	for crashAt := 1; ; crashAt++ {
+		dir, masterkey := migrateTestFS(t)
+		defer os.RemoveAll(dir)
+		fs, _ := loadTestFS(t, dir, masterkey)
+		migrateTestTree(t, fs)
+		want := listTree(t, fs, "")
+		completed := migrateNamesCrash(t, dir, masterkey, crashAt)
+		if !completed {
+			// The filesystem must not be mounted until the migration has
+			// finished
+			_, cf := loadTestFS(t, dir, masterkey)
+			if !cf.IsFeatureFlagSet(configfile.FlagNamesMigration) {
+				t.Errorf("crash at step %d: NamesMigration flag is not set", crashAt)
+			}
+			migrateNamesCrash(t, dir, masterkey, 0)
+		}
+		fs, cf := loadTestFS(t, dir, masterkey)
+		if cf.IsFeatureFlagSet(configfile.FlagPlaintextNames) || cf.IsFeatureFlagSet(configfile.FlagNamesMigration) ||
+			!cf.IsFeatureFlagSet(configfile.FlagDirIV) {
+			t.Fatalf("crash at step %d: wrong feature flags: %v", crashAt, cf.FeatureFlags)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "dir")); !os.IsNotExist(err) {
+			t.Fatalf("crash at step %d: file names are not encrypted on disk", crashAt)
+		}
+		if got := listTree(t, fs, ""); got != want {
+			t.Fatalf("crash at step %d: content mismatch\nwant:\n%s\ngot:\n%s", crashAt, want, got)
+		}
+		if completed {
+			t.Logf("tested %d crash points", crashAt-1)
+			break
+		}
+	}
+}
+
+// TestMigrateNamesReserved checks that the migration refuses to start if a
+// file has a name that gocryptfs uses internally.
+func TestMigrateNamesReserved(t *testing.T) {
+	dir, masterkey := migrateTestFS(t)
+	defer os.RemoveAll(dir)
+	fs, cf := loadTestFS(t, dir, masterkey)
+	if code := fs.Mkdir("dir", 0700, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if code := fs.Mkdir("dir/"+nametransform.DirIVFilename, 0700, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if err := migrateNamesConf(dir, false, cf, masterkey); err == nil {
+		t.Fatal("migration should have failed")
+	}
+	_, cf = loadTestFS(t, dir, masterkey)
+	if !cf.IsFeatureFlagSet(configfile.FlagPlaintextNames) {
+		t.Errorf("config has been changed")
+	}
+}
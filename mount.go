@@ -38,9 +38,10 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
-// doMount mounts an encrypted directory.
+// doMount mounts an encrypted directory. It returns after unmount, with
+// an error only if "-exec-strict" is set and "-exec-after-unmount" failed.
 // Called from main.
-func doMount(args *argContainer) {
+func doMount(args *argContainer) error {
 	// Check mountpoint
 	var err error
 	args.mountpoint, err = filepath.Abs(flagSet.Arg(1))
@@ -62,8 +63,19 @@ func doMount(args *argContainer) {
 			args.mountpoint, args.cipherdir)
 		os.Exit(exitcodes.MountPoint)
 	}
+	if args.mkdir || args.mkdirParents {
+		args._createdDirs, err = mkdirMountpoint(args.mountpoint, args.mkdirParents)
+		if err != nil {
+			tlog.Fatal.Printf("Could not create mountpoint: %v", err)
+			os.Exit(exitcodes.MountPoint)
+		}
+	}
 	if args.nonempty {
 		err = isDir(args.mountpoint)
+		if err == nil && isEmptyDir(args.mountpoint) != nil {
+			tlog.Warn.Printf("Mountpoint %q is not empty. The files in it will be hidden "+
+				"while the filesystem is mounted, and reappear after unmount.", args.mountpoint)
+		}
 	} else {
 		err = isEmptyDir(args.mountpoint)
 		// OSXFuse will create the mountpoint for us ( https://github.com/rfjakob/gocryptfs/issues/194 )
@@ -77,30 +89,25 @@ func doMount(args *argContainer) {
 		tlog.Fatal.Printf("Invalid mountpoint: %v", err)
 		os.Exit(exitcodes.MountPoint)
 	}
-	// Open control socket early so we can error out before asking the user
+	// Open control sockets early so we can error out before asking the user
 	// for the password
 	if args.ctlsock != "" {
-		// We must use an absolute path because we cd to / when daemonizing.
-		// This messes up the delete-on-close logic in the unix socket object.
-		args.ctlsock, _ = filepath.Abs(args.ctlsock)
-		var sock net.Listener
-		sock, err = net.Listen("unix", args.ctlsock)
-		if err != nil {
-			tlog.Fatal.Printf("ctlsock: %v", err)
-			os.Exit(exitcodes.CtlSock)
-		}
-		args._ctlsockFd = sock
+		args._ctlsockFd = openCtlsock(&args.ctlsock)
 		// Close also deletes the socket file
-		defer func() {
-			err = sock.Close()
-			if err != nil {
-				tlog.Warn.Printf("ctlsock close: %v", err)
-			}
-		}()
+		defer closeCtlsock(args._ctlsockFd)
+	}
+	if args.ctlsockRo != "" {
+		args._ctlsockRoFd = openCtlsock(&args.ctlsockRo)
+		defer closeCtlsock(args._ctlsockRoFd)
 	}
 	// Preallocation on Btrfs is broken ( https://github.com/rfjakob/gocryptfs/issues/395 )
 	// and slow ( https://github.com/rfjakob/gocryptfs/issues/63 ).
-	if !args.noprealloc {
+	if args.noprealloc {
+		tlog.Info.Printf(tlog.ColorYellow +
+			"-noprealloc: preallocation is disabled. Running out of disk space while writing " +
+			"may leave the last written block corrupt and unreadable." +
+			tlog.ColorReset)
+	} else {
 		// darwin does not have unix.BTRFS_SUPER_MAGIC, so we define it here
 		const BTRFS_SUPER_MAGIC = 0x9123683e
 		var st unix.Statfs_t
@@ -122,7 +129,38 @@ func doMount(args *argContainer) {
 	// Try to wipe secret keys from memory after unmount
 	defer wipeKeys()
 
+	// Jump into the server loop. It returns when it gets an umount request
+	// from the kernel, which closes serveDone.
+	serveDone := make(chan struct{})
+	go func() {
+		srv.Serve()
+		close(serveDone)
+	}()
 	tlog.Info.Println(tlog.ColorGreen + "Filesystem mounted and ready." + tlog.ColorReset)
+	// "-exec-after-mount" and "-ready-fd" need the mount to be up. WaitMount
+	// can only be called once.
+	if !args.execAfterMount.Empty() || args.readyFd >= 0 {
+		if err = srv.WaitMount(); err != nil {
+			tlog.Warn.Printf("WaitMount: %v", err)
+		}
+	}
+	// Run "-exec-after-mount" before we report success to the parent, so a
+	// failure with "-exec-strict" shows up in its exit code.
+	if !args.execAfterMount.Empty() {
+		err = runHook("-exec-after-mount", args.execAfterMount, args.mountpoint)
+		if err != nil && args.execStrict {
+			tlog.Fatal.Printf("-exec-strict: unmounting %q", args.mountpoint)
+			unmount(srv, args.mountpoint)
+			<-serveDone
+			wipeKeys()
+			rmdirCreated(args._createdDirs)
+			os.Exit(exitcodes.ExecHook)
+		}
+	}
+	// "-ready-fd". Before SIGUSR1, so the event is there when the parent exits.
+	if args.readyFd >= 0 {
+		notifyReadyFd(args.readyFd, args.mountpoint)
+	}
 	// We have been forked into the background, as evidenced by the set
 	// "notifypid".
 	if args.notifypid > 0 {
@@ -155,7 +193,9 @@ func doMount(args *argContainer) {
 	// Wait for SIGINT in the background and unmount ourselves if we get it.
 	// This prevents a dangling "Transport endpoint is not connected"
 	// mountpoint if the user hits CTRL-C.
-	handleSigint(srv, args.mountpoint)
+	sig := handleSigint(srv, args.mountpoint)
+	// Reload "-runtime-opts" on SIGHUP
+	handleSighup(args, fs)
 	// Return memory that was allocated for scrypt (64M by default!) and other
 	// stuff that is no longer needed to the OS
 	debug.FreeOSMemory()
@@ -165,8 +205,99 @@ func doMount(args *argContainer) {
 		fwdFs := fs.(*fusefrontend.FS)
 		go idleMonitor(args.idle, fwdFs, srv, args.mountpoint)
 	}
-	// Jump into server loop. Returns when it gets an umount request from the kernel.
-	srv.Serve()
+	// After a signal, a lazy unmount does not end the server loop while files
+	// are still open, so do not wait for it.
+	select {
+	case <-serveDone:
+	case <-sig.unmounted:
+	}
+	pruneEmptyDirs(fs, args)
+	rmdirCreated(args._createdDirs)
+	err = runAfterUnmountHook(args)
+	if sig.received() {
+		// Deferred functions do not run on os.Exit
+		wipeKeys()
+		if err != nil {
+			exitcodes.Exit(err)
+		}
+		os.Exit(exitcodes.SigInt)
+	}
+	return err
+}
+
+// pruneEmptyDirs implements "-prune-empty-on-unmount". It must only be called
+// after unmount.
+func pruneEmptyDirs(fs pathfs.FileSystem, args *argContainer) {
+	if !args.pruneEmptyOnUnmount {
+		return
+	}
+	n := fs.(*fusefrontend.FS).PruneEmptyDirs()
+	tlog.Info.Printf("-prune-empty-on-unmount: removed %d empty directories", n)
+}
+
+// mkdirMountpoint creates "dir" with permissions 0700 if it does not exist.
+// With "parents", it works like "mkdir -p" and creates all missing parents as
+// well, otherwise a missing parent is an error. It returns the directories it
+// has created, parents first.
+func mkdirMountpoint(dir string, parents bool) (created []string, err error) {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		_, err = os.Stat(d)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) || d == filepath.Dir(d) {
+			return nil, err
+		}
+		if len(missing) == 1 && !parents {
+			return nil, fmt.Errorf("parent directory %q does not exist, use -mkdir-parents to create it", d)
+		}
+		missing = append(missing, d)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		err = os.Mkdir(missing[i], 0700)
+		if err != nil {
+			rmdirCreated(created)
+			return nil, err
+		}
+		tlog.Debug.Printf("mkdirMountpoint: created %q", missing[i])
+		created = append(created, missing[i])
+	}
+	return created, nil
+}
+
+// rmdirCreated removes the directories created by mkdirMountpoint after unmount,
+// deepest first. Directories that are no longer empty are left alone.
+func rmdirCreated(created []string) {
+	for i := len(created) - 1; i >= 0; i-- {
+		err := syscall.Rmdir(created[i])
+		if err != nil {
+			tlog.Info.Printf("Not removing %q: %v", created[i], err)
+			return
+		}
+	}
+}
+
+// openCtlsock creates the control socket at "*path" and makes "*path"
+// absolute. Exits on error.
+func openCtlsock(path *string) net.Listener {
+	// We must use an absolute path because we cd to / when daemonizing.
+	// This messes up the delete-on-close logic in the unix socket object.
+	*path, _ = filepath.Abs(*path)
+	sock, err := net.Listen("unix", *path)
+	if err != nil {
+		tlog.Fatal.Printf("ctlsock: %v", err)
+		os.Exit(exitcodes.CtlSock)
+	}
+	return sock
+}
+
+// closeCtlsock closes (and thereby deletes) a control socket.
+func closeCtlsock(sock net.Listener) {
+	err := sock.Close()
+	if err != nil {
+		tlog.Warn.Printf("ctlsock close: %v", err)
+	}
 }
 
 // Based on the EncFS idle monitor:
@@ -234,17 +365,25 @@ type ctlsockFs interface {
 func initFuseFrontend(args *argContainer) (pfs pathfs.FileSystem, wipeKeys func()) {
 	var err error
 	var confFile *configfile.ConfFile
-	// Get the masterkey from the command line if it was specified
-	masterkey := handleArgsMasterkey(args)
+	var masterkey []byte
+	// Get the masterkey from the command line if it was specified. "-zerokey"
+	// only bypasses the config file if there is none, otherwise loadConfig
+	// checks that the config file has been created with "-zerokey".
+	if args.masterkey != "" || args.zerokey && !configExists(args.config) {
+		masterkey = handleArgsMasterkey(args)
+	}
 	// Otherwise, load masterkey from config file (normal operation).
 	// Prompts the user for the password.
 	if masterkey == nil {
 		masterkey, confFile, err = loadConfig(args)
 		if err != nil {
+			// Close the socket files (which also deletes them)
 			if args._ctlsockFd != nil {
-				// Close the socket file (which also deletes it)
 				args._ctlsockFd.Close()
 			}
+			if args._ctlsockRoFd != nil {
+				args._ctlsockRoFd.Close()
+			}
 			exitcodes.Exit(err)
 		}
 	}
@@ -263,28 +402,79 @@ func initFuseFrontend(args *argContainer) (pfs pathfs.FileSystem, wipeKeys func(
 		args.allow_other = true
 	}
 	frontendArgs := fusefrontend.Args{
-		Cipherdir:       args.cipherdir,
-		PlaintextNames:  args.plaintextnames,
-		LongNames:       args.longnames,
-		ConfigCustom:    args._configCustom,
-		NoPrealloc:      args.noprealloc,
-		SerializeReads:  args.serialize_reads,
-		ForceDecode:     args.forcedecode,
-		ForceOwner:      args._forceOwner,
-		Exclude:         args.exclude,
-		ExcludeWildcard: args.excludeWildcard,
-		ExcludeFrom:     args.excludeFrom,
+		Cipherdir:        args.cipherdir,
+		PlaintextNames:   args.plaintextnames,
+		LongNames:        args.longnames,
+		Flat:             args.flat,
+		DirIVXattr:       args.dirivXattr,
+		ExactSize:        args.exactSize,
+		LongSymlinks:     args.longSymlinks,
+		ConfigCustom:     args._configCustom,
+		NoPrealloc:       args.noprealloc,
+		SerializeReads:   args.serialize_reads,
+		ReadAhead:        args.readahead,
+		ForceDecode:      args.forcedecode,
+		ForceOwner:       args._forceOwner,
+		Exclude:          args.exclude,
+		ExcludeWildcard:  args.excludeWildcard,
+		ExcludeFrom:      args.excludeFrom,
+		ReverseInclude:   args.reverseInclude,
+		DirIVRecover:     args.dirivRecover,
+		CaseFold:         args.casefold,
+		ReverseNameOnly:  args.reverseNameOnly,
+		Discard:          args.discard,
+		Stats:            args.stats,
+		EmulateHiresTime: args.emulateHiresTime,
+		CoalesceWrites:   args.coalesceWrites,
+		FsyncMetadata:    args.fsyncMetadata,
+		Trash:            args.trash,
+		Quota:            args.quota,
+		ReadBps:          args.readBps,
+		WriteBps:         args.writeBps,
+		PreserveDirMtime: args.preserveDirMtime,
+		Watch:            args.watch,
+		DirCountCache:    args.dirCountCache,
+		SortDirs:         args.sortDirs,
+		ReadOnlyAfter:    args.readonlyAfter,
+		MacOSForks:       args.macosForks,
+		MaxBackingFds:    args.maxBackingFds,
+		HideCorrupt:      args.hideCorrupt,
+		ShowCorrupt:      args.showCorrupt,
+		SecureDelete:     args.secureDelete,
+		NoAtime:          args.noatime,
+		CompatOpendir:    args.compatOpendir,
+		ReadOnly:         args.ro,
+		Journal:          args.journal,
+		ParanoidWrite:    args.paranoidWrite,
+		ShowConf:         args.showConf,
 	}
 	// confFile is nil when "-zerokey" or "-masterkey" was used
 	if confFile != nil {
+		if confFile.IsFeatureFlagSet(configfile.FlagNamesMigration) {
+			tlog.Fatal.Printf("The file names of this filesystem are only partly encrypted. " +
+				"Run -migrate-names again to finish the migration.")
+			os.Exit(exitcodes.LoadConf)
+		}
 		// Settings from the config file override command line args
+		frontendArgs.FeatureFlags = confFile.FeatureFlags
 		frontendArgs.PlaintextNames = confFile.IsFeatureFlagSet(configfile.FlagPlaintextNames)
+		frontendArgs.Flat = confFile.IsFeatureFlagSet(configfile.FlagFlat)
+		frontendArgs.DirIVXattr = confFile.IsFeatureFlagSet(configfile.FlagDirIVXattr)
+		frontendArgs.ExactSize = confFile.IsFeatureFlagSet(configfile.FlagExactSize)
+		frontendArgs.LongSymlinks = confFile.IsFeatureFlagSet(configfile.FlagLongSymlinks)
 		args.raw64 = confFile.IsFeatureFlagSet(configfile.FlagRaw64)
 		args.hkdf = confFile.IsFeatureFlagSet(configfile.FlagHKDF)
 		if confFile.IsFeatureFlagSet(configfile.FlagAESSIV) {
 			cryptoBackend = cryptocore.BackendAESSIV
-		} else if args.reverse {
-			tlog.Fatal.Printf("AES-SIV is required by reverse mode, but not enabled in the config file")
+		}
+		args.blockcrc = confFile.IsFeatureFlagSet(configfile.FlagBlockCRC)
+		args.maxNameLength = confFile.LongNameMax
+		args.dirivName = confFile.DirIVName
+		if mismatches := confFile.ReverseMismatches(); args.reverse && len(mismatches) > 0 {
+			tlog.Fatal.Printf("The config file cannot be used in reverse mode:")
+			for _, m := range mismatches {
+				tlog.Fatal.Printf("  %s", m)
+			}
 			os.Exit(exitcodes.Usage)
 		}
 	}
@@ -297,9 +487,47 @@ func initFuseFrontend(args *argContainer) (pfs pathfs.FileSystem, wipeKeys func(
 	tlog.Debug.Printf("frontendArgs: %s", string(jsonBytes))
 
 	// Init crypto backend
+	if err = cryptocore.SelfTest(cryptoBackend, args.hkdf); err != nil {
+		tlog.Fatal.Printf("Crypto self-test failed: %v", err)
+		os.Exit(exitcodes.SelfTest)
+	}
 	cCore := cryptocore.New(masterkey, cryptoBackend, contentenc.DefaultIVBits, args.hkdf, args.forcedecode)
-	cEnc := contentenc.New(cCore, contentenc.DefaultBS, args.forcedecode)
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS, args.forcedecode, args.blockcrc)
 	nameTransform := nametransform.New(cCore.EMECipher, frontendArgs.LongNames, args.raw64)
+	// "-flat" or "Flat" feature flag
+	if frontendArgs.Flat {
+		if frontendArgs.PlaintextNames || args.reverse {
+			tlog.Fatal.Printf("Flat mode is not supported together with -plaintextnames or -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+		nameTransform.SetFlat(true)
+	}
+	// "-diriv-xattr" or "DirIVXattr" feature flag
+	if frontendArgs.DirIVXattr {
+		if frontendArgs.PlaintextNames || frontendArgs.Flat || args.reverse {
+			tlog.Fatal.Printf("-diriv-xattr is not supported together with -plaintextnames, -flat or -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+		nameTransform.SetDirIVXattr(true)
+	}
+	// "-diriv-name" or "DirIVName" config value
+	if args.dirivName != "" {
+		if frontendArgs.PlaintextNames || frontendArgs.Flat || frontendArgs.DirIVXattr || args.reverse {
+			tlog.Fatal.Printf("-diriv-name is not supported together with -plaintextnames, -flat, -diriv-xattr or -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+		if err = nameTransform.SetDirIVName(args.dirivName); err != nil {
+			tlog.Fatal.Printf("-diriv-name: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	// "-max-name-length" or "LongNameMax" config value
+	if args.maxNameLength != 0 {
+		if err = nameTransform.SetLongNameMax(args.maxNameLength); err != nil {
+			tlog.Fatal.Printf("-max-name-length: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
 	// Init badname patterns
 	nameTransform.BadnamePatterns = make([]string, 0)
 	for _, pattern := range args.badname {
@@ -311,6 +539,38 @@ func initFuseFrontend(args *argContainer) (pfs pathfs.FileSystem, wipeKeys func(
 			nameTransform.BadnamePatterns = append(nameTransform.BadnamePatterns, pattern)
 		}
 	}
+	// "-unicode-normalize"
+	if args.unicodeNormalize != "" {
+		if args.plaintextnames || args.reverse {
+			tlog.Fatal.Printf("-unicode-normalize is not supported together with -plaintextnames or -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+		if err := nameTransform.SetUnicodeNormalize(args.unicodeNormalize); err != nil {
+			tlog.Fatal.Printf("-unicode-normalize: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if !frontendArgs.PlaintextNames {
+		if err = nameSelfTest(nameTransform); err != nil {
+			tlog.Fatal.Printf("Crypto self-test failed: %v", err)
+			os.Exit(exitcodes.SelfTest)
+		}
+	}
+	// "-masterkey", or "-zerokey" without a config file: only the command line
+	// tells us the on-disk format, check that it matches. "-forcedecode" is
+	// for filesystems that are known to be corrupt, skip the check there.
+	if confFile == nil && !args.reverse && !args.forcedecode {
+		err = checkMasterkeyFormat(args.cipherdir, frontendArgs.PlaintextNames, frontendArgs.Flat,
+			frontendArgs.DirIVXattr, nameTransform, cEnc)
+		if err != nil {
+			if args.zerokey {
+				tlog.Fatal.Printf("-zerokey: %v", err)
+			} else {
+				tlog.Fatal.Printf("-masterkey: %v", err)
+			}
+			os.Exit(exitcodes.MasterKey)
+		}
+	}
 	// After the crypto backend is initialized,
 	// we can purge the master key from memory.
 	for i := range masterkey {
@@ -333,9 +593,52 @@ func initFuseFrontend(args *argContainer) (pfs pathfs.FileSystem, wipeKeys func(
 	if args._ctlsockFd != nil {
 		go ctlsocksrv.Serve(args._ctlsockFd, fs)
 	}
+	if args._ctlsockRoFd != nil {
+		go ctlsocksrv.ServeReadOnly(args._ctlsockRoFd, fs)
+	}
 	return fs, func() { cCore.Wipe() }
 }
 
+// nameSelfTest encrypts and decrypts a file name with the master key of the
+// filesystem and the name encoding options in use. cryptocore.SelfTest
+// has already checked EME itself with a known answer.
+func nameSelfTest(n *nametransform.NameTransform) error {
+	const name = "gocryptfs-self-test"
+	iv := make([]byte, nametransform.DirIVLen)
+	cName := n.EncryptName(name, iv)
+	name2, err := n.DecryptName(cName, iv)
+	if err != nil {
+		return fmt.Errorf("file name %q: decryption failed: %v", cName, err)
+	}
+	if name2 != name {
+		return fmt.Errorf("file name %q: decrypted to %q", cName, name2)
+	}
+	return nil
+}
+
+// mountNames returns the filesystem name and the subtype of the mount,
+// which "df -T" and "findmnt" show as "Filesystem" and, prefixed with
+// "fuse.", as "Type".
+func mountNames(args *argContainer) (fsname string, subtype string) {
+	fsname = args.cipherdir
+	if args.fsname != "" {
+		fsname = args.fsname
+	}
+	fsname2 := strings.Replace(fsname, ",", "_", -1)
+	if fsname2 != fsname {
+		tlog.Warn.Printf("Warning: %q will be displayed as %q in \"df -T\"", fsname, fsname2)
+		fsname = fsname2
+	}
+	if args.subtype != "" {
+		return fsname, args.subtype
+	}
+	subtype = "gocryptfs"
+	if args.reverse {
+		subtype += "-reverse"
+	}
+	return fsname, subtype
+}
+
 func initGoFuse(fs pathfs.FileSystem, args *argContainer) *fuse.Server {
 	// pathFsOpts are passed into go-fuse/pathfs
 	pathFsOpts := &pathfs.PathNodeFsOptions{ClientInodes: true}
@@ -359,11 +662,12 @@ func initGoFuse(fs pathfs.FileSystem, args *argContainer) *fuse.Server {
 		fuseOpts = &nodefs.Options{}
 	} else {
 		fuseOpts = &nodefs.Options{
-			// These options are to be compatible with libfuse defaults,
-			// making benchmarking easier.
-			NegativeTimeout: time.Second,
-			AttrTimeout:     time.Second,
-			EntryTimeout:    time.Second,
+			// The defaults of "-negative-timeout", "-attr-timeout" and
+			// "-entry-timeout" are compatible with libfuse, making
+			// benchmarking easier.
+			NegativeTimeout: args.negativeTimeout,
+			AttrTimeout:     args.attrTimeout,
+			EntryTimeout:    args.entryTimeout,
 		}
 	}
 	conn := nodefs.NewFileSystemConnector(pathFs.Root(), fuseOpts)
@@ -388,28 +692,21 @@ func initGoFuse(fs pathfs.FileSystem, args *argContainer) *fuse.Server {
 		tlog.Info.Printf(tlog.ColorYellow + "THE OPTION \"-forcedecode\" IS ACTIVE. GOCRYPTFS WILL RETURN CORRUPT DATA!" +
 			tlog.ColorReset)
 	}
+	// go-fuse takes a global lock around the processing of each request
+	if args.singleThreaded {
+		tlog.Info.Printf(tlog.ColorYellow + "The option \"-single-threaded\" is set. It is a debugging aid " +
+			"and makes the filesystem slow, do not use it in production." + tlog.ColorReset)
+		mOpts.SingleThreaded = true
+	}
 	// fusermount from libfuse 3.x removed the "nonempty" option and exits
 	// with an error if it sees it. Only add it to the options on libfuse 2.x.
 	if args.nonempty && haveFusermount2() {
 		mOpts.Options = append(mOpts.Options, "nonempty")
 	}
 	// Set values shown in "df -T" and friends
-	// First column, "Filesystem"
-	fsname := args.cipherdir
-	if args.fsname != "" {
-		fsname = args.fsname
-	}
-	fsname2 := strings.Replace(fsname, ",", "_", -1)
-	if fsname2 != fsname {
-		tlog.Warn.Printf("Warning: %q will be displayed as %q in \"df -T\"", fsname, fsname2)
-		fsname = fsname2
-	}
+	var fsname string
+	fsname, mOpts.Name = mountNames(args)
 	mOpts.Options = append(mOpts.Options, "fsname="+fsname)
-	// Second column, "Type", will be shown as "fuse." + Name
-	mOpts.Name = "gocryptfs"
-	if args.reverse {
-		mOpts.Name += "-reverse"
-	}
 	// Add a volume name if running osxfuse. Otherwise the Finder will show it as
 	// something like "osxfuse Volume 0 (gocryptfs)".
 	if runtime.GOOS == "darwin" {
@@ -446,7 +743,11 @@ func initGoFuse(fs pathfs.FileSystem, args *argContainer) *fuse.Server {
 		tlog.Debug.Printf("Adding -ko mount options: %v", parts)
 		mOpts.Options = append(mOpts.Options, parts...)
 	}
-	srv, err := fuse.NewServer(conn.RawFS(), args.mountpoint, &mOpts)
+	rawFS := conn.RawFS()
+	if args.noReaddirplus {
+		rawFS = &noReadDirPlusFS{rawFS}
+	}
+	srv, err := fuse.NewServer(rawFS, args.mountpoint, &mOpts)
 	if err != nil {
 		tlog.Fatal.Printf("fuse.NewServer failed: %s", strings.TrimSpace(err.Error()))
 		if runtime.GOOS == "darwin" {
@@ -455,6 +756,12 @@ func initGoFuse(fs pathfs.FileSystem, args *argContainer) *fuse.Server {
 		os.Exit(exitcodes.FuseNewServer)
 	}
 	srv.SetDebug(args.fusedebug)
+	// "-watch" needs the server to notify the kernel of changes
+	if args.watch {
+		if err := fs.(*fusefrontend.FS).StartWatch(pathFs); err != nil {
+			tlog.Warn.Printf("-watch: cannot watch CIPHERDIR, no events will be reported: %v", err)
+		}
+	}
 
 	// All FUSE file and directory create calls carry explicit permission
 	// information. We need an unrestricted umask to create the files and
@@ -487,15 +794,36 @@ func haveFusermount2() bool {
 	return false
 }
 
-func handleSigint(srv *fuse.Server, mountpoint string) {
+// sigintState is returned by handleSigint.
+type sigintState struct {
+	// got is set to 1 before unmounting
+	got int32
+	// unmounted is closed after the unmount has been attempted
+	unmounted chan struct{}
+}
+
+// received returns true if we got SIGINT or SIGTERM.
+func (s *sigintState) received() bool {
+	return atomic.LoadInt32(&s.got) == 1
+}
+
+// handleSigint unmounts the filesystem when we get SIGINT or SIGTERM. The
+// cleanup after unmount and the exit with exitcodes.SigInt are left to
+// doMount, so they happen exactly once.
+func handleSigint(srv *fuse.Server, mountpoint string) *sigintState {
+	s := &sigintState{unmounted: make(chan struct{})}
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
 	signal.Notify(ch, syscall.SIGTERM)
 	go func() {
-		<-ch
+		sig := <-ch
+		tlog.Debug.Printf("handleSigint: got %v, unmounting", sig)
+		// Set before unmounting, so doMount sees it when serveDone is closed
+		atomic.StoreInt32(&s.got, 1)
 		unmount(srv, mountpoint)
-		os.Exit(exitcodes.SigInt)
+		close(s.unmounted)
 	}()
+	return s
 }
 
 func unmount(srv *fuse.Server, mountpoint string) {
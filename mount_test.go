@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMountNames(t *testing.T) {
+	testcases := []struct {
+		args    argContainer
+		fsname  string
+		subtype string
+	}{
+		{argContainer{cipherdir: "/a/b"}, "/a/b", "gocryptfs"},
+		{argContainer{cipherdir: "/a/b", reverse: true}, "/a/b", "gocryptfs-reverse"},
+		{argContainer{cipherdir: "/a,b", fsname: "tag", subtype: "backup"}, "tag", "backup"},
+		{argContainer{cipherdir: "/a,b", reverse: true, subtype: "backup"}, "/a_b", "backup"},
+	}
+	for _, tc := range testcases {
+		fsname, subtype := mountNames(&tc.args)
+		if fsname != tc.fsname || subtype != tc.subtype {
+			t.Errorf("%q: want %q %q, got %q %q", tc.args.cipherdir, tc.fsname, tc.subtype, fsname, subtype)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+// Package mountlib is a Go library that mounts a gocryptfs filesystem from
+// within the calling process, without running the gocryptfs binary. It can
+// also translate paths between plaintext and ciphertext without mounting.
+//
+// Example:
+//
+//	srv, err := mountlib.Mount("/home/user/cipher", "/home/user/plain", mountlib.MountOptions{
+//		Password: func() ([]byte, error) { return []byte("secret"), nil },
+//	})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer srv.Unmount()
+package mountlib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend_reverse"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// MountOptions covers the commonly used command-line options.
+// The zero value mounts read-write, accessible only by the calling user.
+type MountOptions struct {
+	// Password is called once to get the password that unlocks the
+	// master key. It must be set. The returned slice is overwritten
+	// with zeros after use.
+	Password func() ([]byte, error)
+	// Config is the path of the config file. Defaults to
+	// CIPHERDIR/gocryptfs.conf, or CIPHERDIR/.gocryptfs.reverse.conf in
+	// reverse mode. Like "-config".
+	Config string
+	// ReadOnly mounts the filesystem read-only, like "-ro". Unlike with
+	// "-ro", writes fail with EPERM instead of EROFS.
+	ReadOnly bool
+	// AllowOther allows other users to access the filesystem, like
+	// "-allow_other".
+	AllowOther bool
+	// Reverse shows an encrypted view of a plaintext directory, like
+	// "-reverse". Reverse mounts are always read-only.
+	Reverse bool
+	// FsName is shown in the first column of "df -T". Defaults to the
+	// cipher directory, like "-fsname".
+	FsName string
+	// FuseDebug enables debug output of the FUSE library, like "-fusedebug".
+	FuseDebug bool
+}
+
+// Server is a mounted gocryptfs filesystem.
+type Server struct {
+	srv      *fuse.Server
+	wipeKeys func()
+	// done is closed when the FUSE server loop has exited
+	done chan struct{}
+}
+
+// ErrNoPassword is returned when MountOptions.Password is nil.
+var ErrNoPassword = errors.New("mountlib: MountOptions.Password is not set")
+
+// ErrFIDO2 is returned for filesystems that need a FIDO2 key in addition to
+// the password ("-fido2"), however many keys have been registered with
+// "-fido2-add". mountlib cannot talk to FIDO2 keys.
+var ErrFIDO2 = errors.New("mountlib: filesystems that need a FIDO2 key are not supported")
+
+// Mount unlocks the gocryptfs filesystem in "cipherDir" and mounts it at
+// "mountPoint". It returns once the mount is ready, and serves FUSE requests
+// in the background until Unmount is called.
+//
+// Like the gocryptfs binary, Mount sets the process umask to zero so files
+// are created with exactly the permissions requested by the application.
+func Mount(cipherDir, mountPoint string, opts MountOptions) (*Server, error) {
+	mountPoint, err := filepath.Abs(mountPoint)
+	if err != nil {
+		return nil, err
+	}
+	fs, wipeKeys, err := newFS(cipherDir, opts)
+	if err != nil {
+		return nil, err
+	}
+	// See initGoFuse() in gocryptfs' mount.go for the rationale behind the
+	// options below.
+	pathFsOpts := &pathfs.PathNodeFsOptions{ClientInodes: !opts.Reverse}
+	var pfs pathfs.FileSystem = fs
+	if opts.ReadOnly || opts.Reverse {
+		// Not the "ro" mount option: WaitMount works around a deadlock in
+		// the Go runtime by creating a file in the mount, which would fail
+		// with EROFS. Writes fail with EPERM instead.
+		pfs = pathfs.NewReadonlyFileSystem(fs)
+	}
+	pathFs := pathfs.NewPathNodeFs(pfs, pathFsOpts)
+	conn := nodefs.NewFileSystemConnector(pathFs.Root(), &nodefs.Options{
+		NegativeTimeout: time.Second,
+		AttrTimeout:     time.Second,
+		EntryTimeout:    time.Second,
+	})
+	mOpts := fuse.MountOptions{
+		MaxWrite: fuse.MAX_KERNEL_WRITE,
+		Options:  []string{fmt.Sprintf("max_read=%d", fuse.MAX_KERNEL_WRITE)},
+		Name:     "gocryptfs",
+		Debug:    opts.FuseDebug,
+	}
+	if opts.AllowOther {
+		mOpts.AllowOther = true
+		mOpts.Options = append(mOpts.Options, "default_permissions")
+	}
+	fsname, _ := filepath.Abs(cipherDir)
+	if opts.FsName != "" {
+		fsname = opts.FsName
+	}
+	mOpts.Options = append(mOpts.Options, "fsname="+strings.Replace(fsname, ",", "_", -1))
+	if opts.Reverse {
+		mOpts.Name += "-reverse"
+	}
+	srv, err := fuse.NewServer(conn.RawFS(), mountPoint, &mOpts)
+	if err != nil {
+		wipeKeys()
+		return nil, err
+	}
+	syscall.Umask(0000)
+	s := &Server{
+		srv:      srv,
+		wipeKeys: wipeKeys,
+		done:     make(chan struct{}),
+	}
+	go func() {
+		srv.Serve()
+		s.wipeKeys()
+		close(s.done)
+	}()
+	if err = srv.WaitMount(); err != nil {
+		srv.Unmount()
+		<-s.done
+		return nil, err
+	}
+	return s, nil
+}
+
+// Unmount unmounts the filesystem and waits until the FUSE server has
+// exited. The encryption keys are wiped from memory afterwards.
+func (s *Server) Unmount() error {
+	err := s.srv.Unmount()
+	if err != nil {
+		return err
+	}
+	<-s.done
+	return nil
+}
+
+// Wait blocks until the filesystem is unmounted, either via Unmount or
+// externally (for example by "fusermount -u").
+func (s *Server) Wait() {
+	<-s.done
+}
+
+// EncryptPath returns the ciphertext path of "plainPath", like
+// "gocryptfs -encrypt-path". The filesystem is unlocked as described
+// for Mount, but not mounted. All directories on the way must exist.
+func EncryptPath(cipherDir string, plainPath string, opts MountOptions) (string, error) {
+	fs, wipeKeys, err := newFS(cipherDir, opts)
+	if err != nil {
+		return "", err
+	}
+	defer wipeKeys()
+	return fs.EncryptPath(plainPath)
+}
+
+// DecryptPath returns the plaintext path of "cipherPath", like
+// "gocryptfs -decrypt-path". Long names are resolved using their .name
+// files, so all path components must exist.
+func DecryptPath(cipherDir string, cipherPath string, opts MountOptions) (string, error) {
+	fs, wipeKeys, err := newFS(cipherDir, opts)
+	if err != nil {
+		return "", err
+	}
+	defer wipeKeys()
+	return fs.DecryptPath(cipherPath)
+}
+
+// ctlsockFs satisfies both the pathfs.FileSystem and the ctlsocksrv.Interface
+// interfaces
+type ctlsockFs interface {
+	pathfs.FileSystem
+	ctlsocksrv.Interface
+}
+
+// newFS loads the config file, unlocks the master key and returns the
+// (forward or reverse) filesystem and a function that wipes the keys.
+func newFS(cipherDir string, opts MountOptions) (fs ctlsockFs, wipeKeys func(), err error) {
+	if opts.Password == nil {
+		return nil, nil, ErrNoPassword
+	}
+	cipherDir, err = filepath.Abs(cipherDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	fi, err := os.Stat(cipherDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !fi.IsDir() {
+		return nil, nil, fmt.Errorf("mountlib: %q is not a directory", cipherDir)
+	}
+	config := opts.Config
+	if config == "" {
+		if opts.Reverse {
+			config = filepath.Join(cipherDir, configfile.ConfReverseName)
+		} else {
+			config = filepath.Join(cipherDir, configfile.ConfDefaultName)
+		}
+	}
+	cf, err := configfile.Load(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagNamesMigration) {
+		return nil, nil, errors.New("mountlib: the file names are only partly encrypted, run \"gocryptfs -migrate-names\" to finish the migration")
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		// The password alone does not decrypt the master key, so fail
+		// before asking for it instead of reporting a wrong password
+		return nil, nil, ErrFIDO2
+	}
+	pw, err := opts.Password()
+	if err != nil {
+		return nil, nil, err
+	}
+	masterkey, err := cf.DecryptMasterKey(pw)
+	for i := range pw {
+		pw[i] = 0
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	cryptoBackend := cryptocore.BackendGoGCM
+	if cf.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		cryptoBackend = cryptocore.BackendAESSIV
+	}
+	if mismatches := cf.ReverseMismatches(); opts.Reverse && len(mismatches) > 0 {
+		var msgs []string
+		for _, m := range mismatches {
+			msgs = append(msgs, m.String())
+		}
+		return nil, nil, fmt.Errorf("mountlib: the config file cannot be used in reverse mode: %s",
+			strings.Join(msgs, "; "))
+	}
+	frontendArgs := fusefrontend.Args{
+		Cipherdir:      cipherDir,
+		PlaintextNames: cf.IsFeatureFlagSet(configfile.FlagPlaintextNames),
+		LongNames:      cf.IsFeatureFlagSet(configfile.FlagLongNames),
+		Flat:           cf.IsFeatureFlagSet(configfile.FlagFlat),
+		DirIVXattr:     cf.IsFeatureFlagSet(configfile.FlagDirIVXattr),
+		ExactSize:      cf.IsFeatureFlagSet(configfile.FlagExactSize),
+		LongSymlinks:   cf.IsFeatureFlagSet(configfile.FlagLongSymlinks),
+		ConfigCustom:   opts.Config != "",
+		FeatureFlags:   cf.FeatureFlags,
+		ReadOnly:       opts.ReadOnly,
+	}
+	cCore := cryptocore.New(masterkey, cryptoBackend, contentenc.DefaultIVBits,
+		cf.IsFeatureFlagSet(configfile.FlagHKDF), false)
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS, false, cf.IsFeatureFlagSet(configfile.FlagBlockCRC))
+	nameTransform := nametransform.New(cCore.EMECipher, frontendArgs.LongNames,
+		cf.IsFeatureFlagSet(configfile.FlagRaw64))
+	nameTransform.SetFlat(frontendArgs.Flat)
+	nameTransform.SetDirIVXattr(frontendArgs.DirIVXattr)
+	if cf.IsFeatureFlagSet(configfile.FlagLongNameMax) {
+		if err = nameTransform.SetLongNameMax(cf.LongNameMax); err != nil {
+			cCore.Wipe()
+			return nil, nil, err
+		}
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagDirIVName) {
+		if err = nameTransform.SetDirIVName(cf.DirIVName); err != nil {
+			cCore.Wipe()
+			return nil, nil, err
+		}
+	}
+	if opts.Reverse {
+		fs = fusefrontend_reverse.NewFS(frontendArgs, cEnc, nameTransform)
+	} else {
+		fs = fusefrontend.NewFS(frontendArgs, cEnc, nameTransform)
+	}
+	return fs, cCore.Wipe, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// noReadDirPlusFS answers READDIRPLUS requests like READDIR, for
+// "-no-readdirplus". go-fuse always accepts READDIRPLUS when the kernel
+// offers it, and has no option to turn it off. Entries with node ID zero
+// tell the kernel that no attributes are included, so it handles them like
+// the entries of a READDIR reply.
+type noReadDirPlusFS struct {
+	fuse.RawFileSystem
+}
+
+// dirent is the layout of struct fuse_dirent, the header of each entry that
+// DirEntryList serializes
+type dirent struct {
+	Ino     uint64
+	Off     uint64
+	NameLen uint32
+	Typ     uint32
+}
+
+const direntSize = int(unsafe.Sizeof(dirent{}))
+
+// parseDirents returns the entries that a DirEntryList has serialized into
+// the zeroed buffer "buf", skipping "prefix" bytes before each one.
+func parseDirents(buf []byte, prefix int) (entries []fuse.DirEntry) {
+	for len(buf) >= prefix+direntSize {
+		d := (*dirent)(unsafe.Pointer(&buf[prefix]))
+		end := prefix + direntSize + int(d.NameLen)
+		if d.NameLen == 0 || end > len(buf) {
+			break
+		}
+		entries = append(entries, fuse.DirEntry{
+			Name: string(buf[prefix+direntSize : end]),
+			Ino:  d.Ino,
+			Mode: d.Typ << 12,
+		})
+		// Entries are padded to 8 bytes
+		end = (end + 7) &^ 7
+		if end > len(buf) {
+			break
+		}
+		buf = buf[end:]
+	}
+	return entries
+}
+
+// ReadDirPlus reads the entries with ReadDir and returns them without
+// attributes. The offsets of the entries are the same as with ReadDir. If
+// fewer entries fit in "out" than in the READDIR reply, the kernel asks
+// again from the offset of the last one.
+func (fs *noReadDirPlusFS) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	buf := make([]byte, input.Size)
+	code := fs.RawFileSystem.ReadDir(cancel, input, fuse.NewDirEntryList(buf, input.Offset))
+	if !code.Ok() {
+		return code
+	}
+	for _, e := range parseDirents(buf, 0) {
+		if out.AddDirLookupEntry(e) == nil {
+			break
+		}
+	}
+	return fuse.OK
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// dirRawFS serves a directory with the entries "entries" through ReadDir
+type dirRawFS struct {
+	fuse.RawFileSystem
+	entries []fuse.DirEntry
+}
+
+func (fs *dirRawFS) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	for _, e := range fs.entries[input.Offset:] {
+		if !out.AddDirEntry(e) {
+			break
+		}
+	}
+	return fuse.OK
+}
+
+func TestNoReadDirPlus(t *testing.T) {
+	inner := &dirRawFS{RawFileSystem: fuse.NewDefaultRawFileSystem()}
+	for _, name := range []string{"a", "dir", "a-name-with-more-than-eight-bytes", "b"} {
+		mode := uint32(syscall.S_IFREG)
+		if name == "dir" {
+			mode = syscall.S_IFDIR
+		}
+		inner.entries = append(inner.entries, fuse.DirEntry{Name: name, Mode: mode, Ino: uint64(len(name))})
+	}
+	fs := &noReadDirPlusFS{inner}
+	const entryOutSize = int(unsafe.Sizeof(fuse.EntryOut{}))
+	// Room for "dir" and the long name in READDIRPLUS format, but not for
+	// "b", which still fits into the READDIR reply
+	input := &fuse.ReadIn{Offset: 1, Size: uint32(2*(entryOutSize+direntSize) + 8 + 40)}
+	buf := make([]byte, input.Size)
+	if code := fs.ReadDirPlus(nil, input, fuse.NewDirEntryList(buf, input.Offset)); !code.Ok() {
+		t.Fatal(code)
+	}
+	got := parseDirents(buf, entryOutSize)
+	if !reflect.DeepEqual(got, inner.entries[1:3]) {
+		t.Errorf("want %v, got %v", inner.entries[1:3], got)
+	}
+	// The kernel gets no node IDs, so no attributes. The offset of an entry
+	// is the index of the next one.
+	for i, off := range []int{0, entryOutSize + direntSize + 8} {
+		if (*fuse.EntryOut)(unsafe.Pointer(&buf[off])).NodeId != 0 {
+			t.Errorf("entry %d has a node ID", i)
+		}
+		if d := (*dirent)(unsafe.Pointer(&buf[off+entryOutSize])); d.Off != uint64(i+2) {
+			t.Errorf("entry %d: want offset %d, got %d", i, i+2, d.Off)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// readyEvent is written to "-ready-fd" as a line of JSON once the filesystem
+// is mounted
+type readyEvent struct {
+	// Event is always "ready"
+	Event      string
+	Mountpoint string
+	// Pid is the process that serves the filesystem. With daemonization,
+	// this is the background process.
+	Pid int
+}
+
+// notifyReadyFd makes sure that the root directory of the mount at
+// "mountpoint" answers, writes a readyEvent to "fd" and closes it. If we
+// exit before, the reader gets EOF instead.
+func notifyReadyFd(fd int, mountpoint string) {
+	// WaitMount has seen the first request, but that does not have to be
+	// one for the root directory
+	var st syscall.Stat_t
+	if err := syscall.Stat(mountpoint, &st); err != nil {
+		tlog.Warn.Printf("-ready-fd: stat %q: %v", mountpoint, err)
+	}
+	f := os.NewFile(uintptr(fd), "ready-fd")
+	defer f.Close()
+	line, _ := json.Marshal(readyEvent{
+		Event:      "ready",
+		Mountpoint: mountpoint,
+		Pid:        os.Getpid(),
+	})
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		tlog.Warn.Printf("-ready-fd %d: %v", fd, err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// repairLongNames handles "gocryptfs -repair-longnames". It finds the
+// "gocryptfs.longname.*.name" files in CIPHERDIR whose content entry is gone
+// and deletes them, or only lists them with "-dry-run". Like "-scrub", it
+// only looks at the names, so it does not need the password.
+//
+// Long name entries whose .name file is gone are listed, but not deleted:
+// the entry is still accessible by its plaintext name, and may hold data.
+func repairLongNames(args *argContainer) {
+	if args.reverse {
+		tlog.Fatal.Printf("Running -repair-longnames with -reverse is not supported")
+		os.Exit(exitcodes.Usage)
+	}
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		os.Exit(exitcodes.LoadConf)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagPlaintextNames) {
+		tlog.Fatal.Printf("-repair-longnames does not work on filesystems created with -plaintextnames")
+		os.Exit(exitcodes.Usage)
+	}
+	var orphanPaths []string
+	var nRemoved, nUnnamed, nErrors int
+	// The trailing slash makes Walk follow CIPHERDIR if it is a symlink
+	err = filepath.Walk(args.cipherdir+"/", func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			fmt.Printf("repair-longnames: %v\n", err)
+			nErrors++
+			return nil
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		atRoot := filepath.Dir(path) == filepath.Clean(args.cipherdir)
+		if atRoot && fi.Name() == fusefrontend.LongLinkDirName {
+			return filepath.SkipDir
+		}
+		orphans, unnamed, err := findLongNameOrphansIn(path)
+		if err != nil {
+			fmt.Printf("repair-longnames: %v\n", err)
+			nErrors++
+			return nil
+		}
+		for _, name := range unnamed {
+			fmt.Printf("repair-longnames: %q has no %s file and is not listed, leaving it alone\n",
+				filepath.Join(path, name), nametransform.LongNameSuffix)
+			nUnnamed++
+		}
+		for _, name := range orphans {
+			orphanPaths = append(orphanPaths, filepath.Join(path, name))
+		}
+		return nil
+	})
+	if err != nil {
+		tlog.Fatal.Printf("repair-longnames: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	// Walk would stumble over the files we remove while it is in the
+	// directory, so we remove the orphans afterwards
+	for _, p := range orphanPaths {
+		if args.dryRun {
+			fmt.Printf("repair-longnames: orphaned %q, would remove it\n", p)
+			continue
+		}
+		if err := os.Remove(p); err != nil {
+			fmt.Printf("repair-longnames: %v\n", err)
+			nErrors++
+			continue
+		}
+		fmt.Printf("repair-longnames: orphaned %q, removed\n", p)
+		nRemoved++
+	}
+	nOrphans := len(orphanPaths)
+	if nOrphans == 0 && nUnnamed == 0 && nErrors == 0 {
+		tlog.Info.Printf("repair-longnames summary: no problems found")
+		return
+	}
+	fmt.Printf("repair-longnames summary: %d orphaned %s files, %d removed, %d entries without %s file, %d errors\n",
+		nOrphans, nametransform.LongNameSuffix, nRemoved, nUnnamed, nametransform.LongNameSuffix, nErrors)
+	if nRemoved < nOrphans || nUnnamed > 0 || nErrors > 0 {
+		os.Exit(exitcodes.FsckErrors)
+	}
+}
+
+// findLongNameOrphansIn runs nametransform.FindLongNameOrphans on the
+// entries of the directory "dir".
+func findLongNameOrphansIn(dir string) (orphans []string, unnamed []string, err error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, nil, err
+	}
+	orphans, unnamed = nametransform.FindLongNameOrphans(names)
+	return orphans, unnamed, nil
+}
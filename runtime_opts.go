@@ -0,0 +1,116 @@
+package main
+
+// "-runtime-opts": read the options in runtimeArgs from a file at mount
+// time, and again when we get SIGHUP, so they can be changed without
+// remounting.
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// statsSetter is implemented by filesystems that support "-stats"
+type statsSetter interface {
+	SetStats(enabled bool)
+}
+
+// readRuntimeOpts reads the runtime-tunable options from "path". The file
+// contains options like on the command line, separated by whitespace or
+// newlines. Lines starting with "#" are comments. Options that are not in
+// the file keep their value from "base". Options that cannot be changed
+// after mount are ignored with a warning.
+func readRuntimeOpts(path string, base runtimeArgs) (runtimeArgs, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return base, err
+	}
+	var opts []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		opts = append(opts, strings.Fields(line)...)
+	}
+	rt := base
+	rtFlags := flag.NewFlagSet("runtime-opts", flag.ContinueOnError)
+	rtFlags.SetOutput(ioutil.Discard)
+	rtFlags.BoolVar(&rt.debug, "d", rt.debug, "")
+	rtFlags.BoolVar(&rt.debug, "debug", rt.debug, "")
+	rtFlags.BoolVar(&rt.quiet, "q", rt.quiet, "")
+	rtFlags.BoolVar(&rt.quiet, "quiet", rt.quiet, "")
+	rtFlags.BoolVar(&rt.silent, "silent", rt.silent, "")
+	rtFlags.BoolVar(&rt.stats, "stats", rt.stats, "")
+	// Sort out the options that cannot be changed
+	var tunable []string
+	for i := 0; i < len(opts); i++ {
+		o := opts[i]
+		if !strings.HasPrefix(o, "-") {
+			return base, fmt.Errorf("%s: unexpected argument %q", path, o)
+		}
+		name := strings.TrimLeft(o, "-")
+		hasValue := strings.Contains(name, "=")
+		name = strings.SplitN(name, "=", 2)[0]
+		if rtFlags.Lookup(name) != nil {
+			tunable = append(tunable, o)
+			continue
+		}
+		f := flagSet.Lookup(name)
+		if f == nil {
+			return base, fmt.Errorf("%s: unknown option %q", path, o)
+		}
+		tlog.Warn.Printf("%s: -%s cannot be changed after mount, ignoring it", path, name)
+		// Skip the value of non-bool options passed as "-name value"
+		if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); !hasValue && !(ok && bf.IsBoolFlag()) {
+			i++
+		}
+	}
+	if err = rtFlags.Parse(tunable); err != nil {
+		return base, fmt.Errorf("%s: %v", path, err)
+	}
+	return rt, nil
+}
+
+// applyRuntimeArgs applies "rt" to the logger and the mounted filesystem
+func applyRuntimeArgs(rt runtimeArgs, fs pathfs.FileSystem) {
+	tlog.Debug.Enabled = rt.debug
+	tlog.Info.Enabled = !rt.quiet
+	tlog.SetSilent(rt.silent)
+	if sfs, ok := fs.(statsSetter); ok {
+		sfs.SetStats(rt.stats)
+	} else if rt.stats {
+		tlog.Warn.Printf("-stats is not supported by this filesystem, ignoring it")
+	}
+}
+
+// handleSighup re-reads "-runtime-opts" and applies it when we get SIGHUP.
+// Without "-runtime-opts", SIGHUP is ignored instead of killing us without
+// unmounting.
+func handleSighup(args *argContainer, fs pathfs.FileSystem) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if args.runtimeOpts == "" {
+				tlog.Info.Printf("SIGHUP: nothing to reload without -runtime-opts")
+				continue
+			}
+			rt, err := readRuntimeOpts(args.runtimeOpts, args._cliRuntimeArgs)
+			if err != nil {
+				tlog.Warn.Printf("SIGHUP: %v, keeping the current settings", err)
+				continue
+			}
+			applyRuntimeArgs(rt, fs)
+			tlog.Info.Printf("SIGHUP: reloaded %s: debug=%v quiet=%v silent=%v stats=%v",
+				args.runtimeOpts, rt.debug, rt.quiet, rt.silent, rt.stats)
+		}
+	}()
+}
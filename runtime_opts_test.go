@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadRuntimeOpts(t *testing.T) {
+	// Initialize flagSet, which is used to recognize the options that
+	// cannot be changed
+	oldArgs := os.Args
+	os.Args = []string{"gocryptfs"}
+	parseCliOpts()
+	os.Args = oldArgs
+
+	dir, err := ioutil.TempDir("", "gocryptfs-test-runtime-opts.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "opts")
+	testcases := []struct {
+		content string
+		base    runtimeArgs
+		want    runtimeArgs
+		wantErr bool
+	}{
+		{"", runtimeArgs{debug: true}, runtimeArgs{debug: true}, false},
+		{"-d -stats", runtimeArgs{}, runtimeArgs{debug: true, stats: true}, false},
+		{"# comment -d\n--quiet\n", runtimeArgs{}, runtimeArgs{quiet: true}, false},
+		{"-debug=false", runtimeArgs{debug: true}, runtimeArgs{}, false},
+		// Options that cannot be changed are skipped, including their value
+		{"-fsname foo -stats -ro", runtimeArgs{}, runtimeArgs{stats: true}, false},
+		{"-ctlsock=/tmp/x -q", runtimeArgs{}, runtimeArgs{quiet: true}, false},
+		{"-silent", runtimeArgs{quiet: true}, runtimeArgs{quiet: true, silent: true}, false},
+		{"-nosuchoption", runtimeArgs{}, runtimeArgs{}, true},
+		{"-d foo", runtimeArgs{}, runtimeArgs{}, true},
+	}
+	for _, tc := range testcases {
+		if err := ioutil.WriteFile(path, []byte(tc.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		rt, err := readRuntimeOpts(path, tc.base)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%q: wantErr=%v, got %v", tc.content, tc.wantErr, err)
+			continue
+		}
+		if err != nil {
+			if rt != tc.base {
+				t.Errorf("%q: error should return the base settings, got %+v", tc.content, rt)
+			}
+			continue
+		}
+		if rt != tc.want {
+			t.Errorf("%q: want %+v, got %+v", tc.content, tc.want, rt)
+		}
+	}
+}
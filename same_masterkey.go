@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/subtle"
+	"os"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// otherConfigPath returns the config file of "-same-masterkey OTHER". OTHER
+// can be a config file or a CIPHERDIR, forward or reverse.
+func otherConfigPath(other string) string {
+	fi, err := os.Stat(other)
+	if err != nil || !fi.IsDir() {
+		return other
+	}
+	p := filepath.Join(other, configfile.ConfDefaultName)
+	if !configExists(p) {
+		if p2 := filepath.Join(other, configfile.ConfReverseName); configExists(p2) {
+			return p2
+		}
+	}
+	return p
+}
+
+// sameMasterkey implements "-same-masterkey": it decrypts the master keys of
+// CIPHERDIR and of OTHER with the same password and reports whether they are
+// equal. The keys are never printed.
+// Calls os.Exit on errors and on mismatch.
+func sameMasterkey(args *argContainer) {
+	other := otherConfigPath(args.sameMasterkey)
+	cf1, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		exitcodes.Exit(err)
+	}
+	cf2, err := configfile.Load(other)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		exitcodes.Exit(err)
+	}
+	pw := readpassword.Once([]string(args.extpass), []string(args.passfile), args.passfd, "")
+	// Both filesystems may use a FIDO2 key. combineFIDO2 wipes its input, so
+	// the first one gets a copy.
+	pw1, err := combineFIDO2(args, cf1, append([]byte(nil), pw...))
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	pw2, err := combineFIDO2(args, cf2, pw)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	tlog.Info.Println("Decrypting master keys")
+	key1, err := cf1.DecryptMasterKey(pw1)
+	for i := range pw1 {
+		pw1[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Printf("%s: %v", args.config, err)
+		exitcodes.Exit(err)
+	}
+	key2, err := cf2.DecryptMasterKey(pw2)
+	for i := range pw2 {
+		pw2[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Printf("%s: %v", other, err)
+		exitcodes.Exit(err)
+	}
+	same := subtle.ConstantTimeCompare(key1, key2) == 1
+	for i := range key1 {
+		key1[i] = 0
+	}
+	for i := range key2 {
+		key2[i] = 0
+	}
+	if !same {
+		tlog.Fatal.Printf("Master keys differ: %q and %q", args.config, other)
+		os.Exit(exitcodes.KeyMismatch)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Same master key: %q and %q"+tlog.ColorReset, args.config, other)
+}
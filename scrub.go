@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// scrub handles "gocryptfs -scrub". It checks the CRC32C of all file content
+// blocks in CIPHERDIR without decrypting anything, so it does not need the
+// password. Only works on filesystems created with "-blockcrc".
+//
+// A CRC mismatch means bit rot. Tampering is only detected by "-fsck", which
+// checks the GCM tags.
+func scrub(args *argContainer) {
+	if args.reverse {
+		tlog.Fatal.Printf("Running -scrub with -reverse is not supported")
+		os.Exit(exitcodes.Usage)
+	}
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		os.Exit(exitcodes.LoadConf)
+	}
+	if !cf.IsFeatureFlagSet(configfile.FlagBlockCRC) {
+		tlog.Fatal.Printf("-scrub only works on filesystems created with -blockcrc")
+		os.Exit(exitcodes.Usage)
+	}
+	nFiles, nCorrupt, err := scrubDir(args.cipherdir, args.config, cf)
+	if err != nil {
+		tlog.Fatal.Printf("scrub: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	if nCorrupt == 0 {
+		tlog.Info.Printf("scrub summary: %d files checked, no problems found", nFiles)
+		return
+	}
+	fmt.Printf("scrub summary: %d files checked, %d corrupt files\n", nFiles, nCorrupt)
+	os.Exit(exitcodes.FsckErrors)
+}
+
+// scrubDir checks all file content in "cipherdir", whose config file "cf"
+// is stored at "config", and prints what is wrong. Returns the number of
+// files checked and how many of them are corrupt.
+func scrubDir(cipherdir string, config string, cf *configfile.ConfFile) (nFiles int, nCorrupt int, err error) {
+	plaintextNames := cf.IsFeatureFlagSet(configfile.FlagPlaintextNames)
+	dirIVName := nametransform.DirIVFilename
+	if cf.DirIVName != "" {
+		dirIVName = cf.DirIVName
+	}
+	// The trailing slash makes Walk follow CIPHERDIR if it is a symlink
+	err = filepath.Walk(cipherdir+"/", func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			fmt.Printf("scrub: %v\n", err)
+			nCorrupt++
+			return nil
+		}
+		name := fi.Name()
+		atRoot := filepath.Dir(path) == filepath.Clean(cipherdir)
+		if atRoot && configfile.IsConfName(name) || path == config {
+			return nil
+		}
+		if atRoot && !plaintextNames && name == fusefrontend.LongLinkDirName {
+			// The encrypted targets of long symlinks are not file content
+			return filepath.SkipDir
+		}
+		if atRoot && fi.IsDir() && (name == fusefrontend.TrashDirName || name == fusefrontend.JournalDirName) {
+			// The gocryptfs.trashinfo files and the journal records have
+			// no file header
+			return filepath.SkipDir
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		if !plaintextNames && (name == dirIVName ||
+			nametransform.NameType(name) == nametransform.LongNameFilename) {
+			return nil
+		}
+		nFiles++
+		if !scrubFile(path, fi.Size()) {
+			nCorrupt++
+		}
+		return nil
+	})
+	return nFiles, nCorrupt, err
+}
+
+// scrubFile checks the ciphertext file at "path" and prints what is wrong
+// with it. Returns false if the file is corrupt.
+func scrubFile(path string, size int64) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("scrub: %v\n", err)
+		return false
+	}
+	defer f.Close()
+	badBlocks, err := contentenc.ScrubFile(f, size, contentenc.DefaultBS)
+	if err != nil {
+		fmt.Printf("scrub: corrupt file %q: %v\n", path, err)
+		return false
+	}
+	if len(badBlocks) > 0 {
+		fmt.Printf("scrub: corrupt file %q: CRC32C mismatch in blocks %v\n", path, badBlocks)
+		return false
+	}
+	return true
+}
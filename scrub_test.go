@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// TestScrubTrash checks that -scrub does not report the entries in the
+// trash directory as corrupt.
+func TestScrubTrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gocryptfs-test-scrub.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := filepath.Join(dir, configfile.ConfDefaultName)
+	err = configfile.Create(&configfile.CreateArgs{
+		Filename: conf,
+		Password: []byte("test"),
+		LogN:     10,
+		Creator:  "test",
+		BlockCRC: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterkey, cf, err := configfile.LoadAndDecrypt(conf, []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootfd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(rootfd)
+	syscall.Close(rootfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cCore := cryptocore.New(masterkey, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true, false)
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS, false, true)
+	nameTransform := nametransform.New(cCore.EMECipher, true, false)
+	fs := fusefrontend.NewFS(fusefrontend.Args{Cipherdir: dir, LongNames: true, Trash: true}, cEnc, nameTransform)
+	for _, name := range []string{"keep", "trashed"} {
+		f, code := fs.Create(name, uint32(os.O_WRONLY), 0600, nil)
+		if !code.Ok() {
+			t.Fatal(code)
+		}
+		if _, code = f.Write([]byte(name), 0); !code.Ok() {
+			t.Fatal(code)
+		}
+		f.Release()
+	}
+	if code := fs.Unlink("trashed", nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if _, err = os.Stat(filepath.Join(dir, fusefrontend.TrashDirName)); err != nil {
+		t.Fatal(err)
+	}
+	nFiles, nCorrupt, err := scrubDir(dir, conf, cf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nFiles != 1 || nCorrupt != 0 {
+		t.Errorf("want 1 file checked and 0 corrupt, got %d and %d", nFiles, nCorrupt)
+	}
+}
@@ -67,6 +67,9 @@ go test -count 1 ./... "$@" 200>&-
 #       ^^^^^^^^
 #   Disable result caching
 
+# Tests that inject syscall failures, see syscallcompat.InjectFault
+go test -count 1 -tags faultinject -run Fault ./internal/... 200>&-
+
 # Clean up dangling filesystems but do exit with an error if we found one
 unmount_leftovers || { echo "Error: the tests left mounted filesystems behind" ; exit 1 ; }
 
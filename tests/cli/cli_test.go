@@ -3,6 +3,8 @@ package cli
 // Test CLI operations like "-init", "-password" etc
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -15,6 +17,7 @@ import (
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/keyring"
 
 	"github.com/rfjakob/gocryptfs/tests/test_helpers"
 )
@@ -45,6 +48,43 @@ func TestInit(t *testing.T) {
 	}
 }
 
+// Test that of several concurrent -init runs on the same directory, exactly
+// one succeeds, and the others fail because the config file exists
+func TestInitConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir(test_helpers.TmpDir, "TestInitConcurrent.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 8
+	codes := make(chan int, n)
+	outputs := make(chan string, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-init", "-extpass", "echo test",
+				"-scryptn=10", dir)
+			out, err := cmd.CombinedOutput()
+			codes <- test_helpers.ExtractCmdExitCode(err)
+			outputs <- string(out)
+		}()
+	}
+	success := 0
+	for i := 0; i < n; i++ {
+		code := <-codes
+		out := <-outputs
+		if code == 0 {
+			success++
+		} else if code != exitcodes.Init || !strings.Contains(out, "already exists") {
+			t.Errorf("loser: want exit code %d and EEXIST, got %d: %s", exitcodes.Init, code, out)
+		}
+	}
+	if success != 1 {
+		t.Errorf("want exactly one successful -init, got %d", success)
+	}
+	if _, _, err = configfile.LoadAndDecrypt(dir+"/"+configfile.ConfDefaultName, testPw); err != nil {
+		t.Error(err)
+	}
+}
+
 // Test that gocryptfs.conf and gocryptfs.diriv are there with the expected
 // permissions after -init
 func TestInitFilePerms(t *testing.T) {
@@ -229,6 +269,45 @@ func TestPasswdMasterkey(t *testing.T) {
 	test_helpers.UnmountPanic(mnt)
 }
 
+// TestPasswdBackup checks that -passwd keeps the old config as backup, and
+// that -passwd -masterkey refuses to replace an existing backup.
+func TestPasswdBackup(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	cp(t, "gocryptfs.conf.b9e5ba23", dir+"/gocryptfs.conf")
+	bak := dir + "/gocryptfs.conf.bak"
+	testPasswd(t, dir)
+	if _, _, err := configfile.LoadAndDecrypt(bak, []byte("test")); err != nil {
+		t.Errorf("-passwd should keep the old config: %v", err)
+	}
+	masterkeyReset := func(pw string) error {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-passwd", "-masterkey",
+			"b9e5ba23-981a22b8-c8d790d8-627add29-f680513f-b7b7035f-d203fb83-21d82205", dir)
+		cmd.Stdin = strings.NewReader(pw + "\n")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+	if err := masterkeyReset("pw2"); err == nil {
+		t.Error("-masterkey should refuse to replace the existing backup")
+	}
+	if err := os.Remove(bak); err != nil {
+		t.Fatal(err)
+	}
+	if err := masterkeyReset("pw2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := masterkeyReset("pw3"); err == nil {
+		t.Error("second -masterkey should refuse to replace the backup")
+	}
+	// The backup is still the config from before the first reset
+	if _, _, err := configfile.LoadAndDecrypt(bak, []byte("newpasswd")); err != nil {
+		t.Errorf("backup: %v", err)
+	}
+	if _, _, err := configfile.LoadAndDecrypt(dir+"/gocryptfs.conf", []byte("pw2")); err != nil {
+		t.Errorf("config: %v", err)
+	}
+}
+
 // Test -passwd with -masterkey=stdin
 func TestPasswdMasterkeyStdin(t *testing.T) {
 	// Create FS
@@ -302,6 +381,287 @@ func TestPasswdScryptn(t *testing.T) {
 	}
 }
 
+// Test -same-masterkey
+func TestSameMasterkey(t *testing.T) {
+	dir1 := test_helpers.InitFS(t)
+	dir2 := test_helpers.InitFS(t)
+	sameMasterkey := func(other string, pw string) int {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-extpass", "echo "+pw,
+			"-same-masterkey", other, dir1)
+		cmd.Stderr = os.Stderr
+		return test_helpers.ExtractCmdExitCode(cmd.Run())
+	}
+	if code := sameMasterkey(dir2, "test"); code != exitcodes.KeyMismatch {
+		t.Errorf("different filesystems: want exit code %d, got %d", exitcodes.KeyMismatch, code)
+	}
+	// A copy of the config file has the same master key
+	cp(t, dir1+"/gocryptfs.conf", dir2+"/gocryptfs.conf")
+	if code := sameMasterkey(dir2, "test"); code != 0 {
+		t.Errorf("copy: want exit code 0, got %d", code)
+	}
+	if code := sameMasterkey(dir2+"/gocryptfs.conf", "test"); code != 0 {
+		t.Errorf("copy, passed as file: want exit code 0, got %d", code)
+	}
+	if code := sameMasterkey(dir2, "wrong"); code != exitcodes.PasswordIncorrect {
+		t.Errorf("wrong password: want exit code %d, got %d", exitcodes.PasswordIncorrect, code)
+	}
+}
+
+// Test -passfd with -init and with a command that reads the password once
+func TestPassfd(t *testing.T) {
+	run := func(pw string, args ...string) int {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command(test_helpers.GocryptfsBinary, append([]string{"-q", "-passfd", "3"}, args...)...)
+		cmd.Stderr = os.Stderr
+		cmd.ExtraFiles = []*os.File{r}
+		if err = cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+		// Deliver the password in two chunks
+		w.Write([]byte(pw[:2]))
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte(pw[2:] + "\n"))
+		w.Close()
+		return test_helpers.ExtractCmdExitCode(cmd.Wait())
+	}
+	dir := test_helpers.TmpDir + "/TestPassfd"
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if code := run("test", "-init", "-scryptn=10", dir); code != 0 {
+		t.Fatalf("-init: want exit code 0, got %d", code)
+	}
+	if code := run("test", "-same-masterkey", dir, dir); code != 0 {
+		t.Errorf("want exit code 0, got %d", code)
+	}
+	if code := run("wrong", "-same-masterkey", dir, dir); code != exitcodes.PasswordIncorrect {
+		t.Errorf("wrong password: want exit code %d, got %d", exitcodes.PasswordIncorrect, code)
+	}
+}
+
+// Test that -ready-fd reports the mount, also when daemonizing
+func TestReadyFd(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	if err := os.Mkdir(mnt, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// fd 100 is not open. Not fd 3: the Go runtime may keep a cgroup file
+	// open there.
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-extpass", "echo test", "-ready-fd", "100", dir, mnt)
+	if code := test_helpers.ExtractCmdExitCode(cmd.Run()); code != exitcodes.Usage {
+		t.Errorf("closed fd: want exit code %d, got %d", exitcodes.Usage, code)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-extpass", "echo test", "-ready-fd", "3", dir, mnt)
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{w}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	// If the mount fails, we get EOF
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil {
+		cmd.Wait()
+		t.Fatalf("reading the ready event: %v", err)
+	}
+	defer test_helpers.UnmountPanic(mnt)
+	var ev struct {
+		Event, Mountpoint string
+		Pid               int
+	}
+	if err = json.Unmarshal([]byte(line), &ev); err != nil {
+		t.Fatalf("%q: %v", line, err)
+	}
+	if ev.Event != "ready" || ev.Mountpoint != mnt || ev.Pid == cmd.Process.Pid {
+		t.Errorf("wrong event %+v, the parent is %d", ev, cmd.Process.Pid)
+	}
+	// The filesystem is serving when the event arrives
+	if err = ioutil.WriteFile(mnt+"/file", []byte("x"), 0600); err != nil {
+		t.Error(err)
+	}
+	if err = cmd.Wait(); err != nil {
+		t.Errorf("parent: %v", err)
+	}
+}
+
+// Test -use-keyring, -keyring-ttl and -clear-keyring
+func TestUseKeyring(t *testing.T) {
+	if err := keyring.Store(keyring.Description([]byte("TestUseKeyring")), []byte("x"), time.Second); err != nil {
+		t.Skipf("kernel keyring not available: %v", err)
+	}
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	clear := func() int {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-clear-keyring", dir)
+		cmd.Stderr = os.Stderr
+		return test_helpers.ExtractCmdExitCode(cmd.Run())
+	}
+	defer clear()
+	// Operations other than mounting never use the cache
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-use-keyring", "-passwd", "-extpass", "echo test", dir)
+	if code := test_helpers.ExtractCmdExitCode(cmd.Run()); code != exitcodes.Usage {
+		t.Errorf("-passwd: want exit code %d, got %d", exitcodes.Usage, code)
+	}
+	// The first mount caches the master key, the second one does not need
+	// the password
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-use-keyring", "-keyring-ttl=1m")
+	test_helpers.UnmountPanic(mnt)
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo wrong", "-use-keyring")
+	test_helpers.UnmountPanic(mnt)
+	if code := clear(); code != 0 {
+		t.Fatalf("-clear-keyring: want exit code 0, got %d", code)
+	}
+	if err := test_helpers.Mount(dir, mnt, false, "-extpass=echo wrong", "-use-keyring"); err == nil {
+		test_helpers.UnmountPanic(mnt)
+		t.Error("mount with the wrong password should fail after -clear-keyring")
+	}
+	// Nothing to clear is no error
+	if code := clear(); code != 0 {
+		t.Errorf("second -clear-keyring: want exit code 0, got %d", code)
+	}
+}
+
+// fakeFIDO2 writes fido2-cred and fido2-assert scripts that emulate keys
+// without PIN into "dir", plus the devices hidraw0 and hidraw1. The
+// credential ID is the device path, and the hmac-secret is the salt.
+func fakeFIDO2(t *testing.T, dir string) {
+	scripts := map[string]string{
+		"fido2-cred": "#!/bin/sh\nread cdh; read rp; read user; read uid\n" +
+			"cred=$(printf %s \"$3\" | base64 -w0)\n" +
+			"printf '%s\\n%s\\npacked\\nYXV0aA==\\n%s\\nc2ln\\n' \"$cdh\" \"$rp\" \"$cred\"\n",
+		"fido2-assert": "#!/bin/sh\nread cdh; read rp; read cred; read salt\n" +
+			"[ \"$cred\" = \"$(printf %s \"$3\" | base64 -w0)\" ] || { echo FIDO_ERR_NO_CREDENTIALS >&2; exit 1; }\n" +
+			"printf '%s\\n%s\\nYXV0aA==\\nc2ln\\n%s\\n' \"$cdh\" \"$rp\" \"$salt\"\n",
+		"hidraw0": "",
+		"hidraw1": "",
+	}
+	for name, content := range scripts {
+		if err := ioutil.WriteFile(dir+"/"+name, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Test -fido2, -fido2-add and -fido2-remove with fake libfido2 tools
+func TestFIDO2(t *testing.T) {
+	tools := test_helpers.TmpDir + "/TestFIDO2.tools"
+	if err := os.Mkdir(tools, 0700); err != nil {
+		t.Fatal(err)
+	}
+	fakeFIDO2(t, tools)
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", tools+":"+oldPath)
+	defer os.Setenv("PATH", oldPath)
+	run := func(pw string, args ...string) int {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, append([]string{"-q", "-extpass", "echo " + pw}, args...)...)
+		cmd.Stderr = os.Stderr
+		return test_helpers.ExtractCmdExitCode(cmd.Run())
+	}
+	key0, key1, missing := tools+"/hidraw0", tools+"/hidraw1", tools+"/hidraw2"
+	dir := test_helpers.InitFS(t, "-fido2", key0)
+	slots := func() int {
+		c, err := configfile.Load(dir + "/gocryptfs.conf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.IsFeatureFlagSet(configfile.FlagFIDO2) {
+			t.Fatalf("FIDO2 flag missing: %v", c.FeatureFlags)
+		}
+		return len(c.FIDO2)
+	}
+	if n := slots(); n != 1 {
+		t.Fatalf("want 1 slot, got %d", n)
+	}
+	if code := run("test", "-fido2", key0, "-same-masterkey", dir, dir); code != 0 {
+		t.Errorf("password and key: want exit code 0, got %d", code)
+	}
+	if code := run("test", "-same-masterkey", dir, dir); code != exitcodes.FIDO2 {
+		t.Errorf("without key: want exit code %d, got %d", exitcodes.FIDO2, code)
+	}
+	if code := run("test", "-fido2", missing, "-same-masterkey", dir, dir); code != exitcodes.FIDO2 {
+		t.Errorf("device missing: want exit code %d, got %d", exitcodes.FIDO2, code)
+	}
+	if code := run("test", "-fido2", key1, "-same-masterkey", dir, dir); code != exitcodes.FIDO2 {
+		t.Errorf("unregistered key: want exit code %d, got %d", exitcodes.FIDO2, code)
+	}
+	if code := run("wrong", "-fido2", key0, "-same-masterkey", dir, dir); code != exitcodes.PasswordIncorrect {
+		t.Errorf("wrong password: want exit code %d, got %d", exitcodes.PasswordIncorrect, code)
+	}
+	// Adding a key needs the password and a registered key
+	if code := run("wrong", "-fido2", key0, "-fido2-add", key1, dir); code != exitcodes.PasswordIncorrect {
+		t.Errorf("add with wrong password: want exit code %d, got %d", exitcodes.PasswordIncorrect, code)
+	}
+	if code := run("test", "-fido2", key0, "-fido2-add", key1, dir); code != 0 {
+		t.Fatalf("add: want exit code 0, got %d", code)
+	}
+	if n := slots(); n != 2 {
+		t.Fatalf("want 2 slots, got %d", n)
+	}
+	// Either key unlocks, and missing devices are skipped
+	if code := run("test", "-fido2", missing, "-fido2", key1, "-same-masterkey", dir, dir); code != 0 {
+		t.Errorf("second key: want exit code 0, got %d", code)
+	}
+	if code := run("test", "-fido2", key1, "-fido2-remove", "0", dir); code != 0 {
+		t.Fatalf("remove: want exit code 0, got %d", code)
+	}
+	if code := run("test", "-fido2", key0, "-same-masterkey", dir, dir); code != exitcodes.FIDO2 {
+		t.Errorf("removed key: want exit code %d, got %d", exitcodes.FIDO2, code)
+	}
+	// The last key cannot be removed
+	if code := run("test", "-fido2", key1, "-fido2-remove", "0", dir); code != exitcodes.Usage {
+		t.Errorf("remove last: want exit code %d, got %d", exitcodes.Usage, code)
+	}
+	if n := slots(); n != 1 {
+		t.Errorf("want 1 slot, got %d", n)
+	}
+}
+
+// Test that -silent drops warnings that -q keeps
+func TestSilent(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	// -fido2 on a filesystem without FIDO2 gives a warning
+	for _, flag := range []string{"-q", "-silent"} {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, flag, "-extpass", "echo test",
+			"-fido2", "/dev/null", "-fsck", dir)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: %v: %s", flag, err, out)
+		}
+		if flag == "-q" && !strings.Contains(string(out), "ignoring -fido2") {
+			t.Errorf("-q should keep the warning, got %q", out)
+		}
+		if flag == "-silent" && len(out) != 0 {
+			t.Errorf("-silent should print nothing, got %q", out)
+		}
+	}
+	// Fatal errors are still printed
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-silent", "-extpass", "echo wrong",
+		"-same-masterkey", dir, dir)
+	out, _ := cmd.CombinedOutput()
+	if !strings.Contains(string(out), "Password incorrect") {
+		t.Errorf("fatal error missing: %q", out)
+	}
+}
+
+// Test that the parent process still reports success with -silent when it
+// daemonizes
+func TestSilentMount(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-silent")
+	test_helpers.UnmountPanic(mnt)
+}
+
 // Test -init & -config flag
 func TestInitConfig(t *testing.T) {
 	config := test_helpers.TmpDir + "/TestInitConfig.conf"
@@ -321,6 +681,23 @@ func TestInitConfig(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
+
+	// Nothing config-related must end up in the cipherdir
+	for _, n := range []string{"gocryptfs.conf", "gocryptfs.conf.bak"} {
+		if _, err = os.Stat(dir + "/" + n); err == nil {
+			t.Errorf("%s was created in the cipherdir", n)
+		}
+	}
+
+	// Test -fsck & -config
+	cmd3 := exec.Command(test_helpers.GocryptfsBinary, "-q", "-fsck", "-extpass", "echo test",
+		"-config", config, dir)
+	cmd3.Stdout = os.Stdout
+	cmd3.Stderr = os.Stderr
+	err = cmd3.Run()
+	if err != nil {
+		t.Error(err)
+	}
 }
 
 // Test -ro
@@ -341,6 +718,127 @@ func TestRo(t *testing.T) {
 	}
 }
 
+// encryptPath returns the ciphertext path of "path" in CIPHERDIR "dir"
+func encryptPath(t *testing.T, dir string, path string) string {
+	out, err := exec.Command(test_helpers.GocryptfsBinary, "-q", "-extpass", "echo test",
+		"-encrypt-path", path, dir).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// Test that "-negative-timeout" does not hide files that are created after
+// a failed lookup, through the mount or, with "-watch", directly in
+// CIPHERDIR
+func TestNegativeTimeout(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-negative-timeout=1h", "-watch")
+	defer test_helpers.UnmountPanic(mnt)
+	for _, n := range []string{"a", "b", "c"} {
+		if _, err := os.Stat(mnt + "/" + n); !os.IsNotExist(err) {
+			t.Fatalf("%s: want ENOENT, got %v", n, err)
+		}
+	}
+	// Create and rename through the mount
+	if err := ioutil.WriteFile(mnt+"/a", []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(mnt + "/a"); err != nil {
+		t.Error(err)
+	}
+	if err := os.Link(mnt+"/a", mnt+"/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(mnt+"/b", mnt+"/c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(mnt + "/c"); err != nil {
+		t.Error(err)
+	}
+	// Created directly in CIPHERDIR. The content does not depend on the
+	// name, so a copy of the backing file of "a" is a valid file.
+	if _, err := os.Stat(mnt + "/b"); !os.IsNotExist(err) {
+		t.Fatalf("want ENOENT, got %v", err)
+	}
+	content, err := ioutil.ReadFile(dir + "/" + encryptPath(t, dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(dir+"/"+encryptPath(t, dir, "b"), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err = os.Stat(mnt + "/b"); err == nil {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("file created in CIPHERDIR did not show up: %v", err)
+}
+
+// Test that changes made directly in CIPHERDIR show up after
+// "-attr-timeout" and "-entry-timeout" have expired
+func TestAttrEntryTimeout(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-attr-timeout=200ms", "-entry-timeout=200ms")
+	defer test_helpers.UnmountPanic(mnt)
+	if err := ioutil.WriteFile(mnt+"/a", []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mnt+"/b", []byte("xyz"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(mnt + "/a")
+	if err != nil || fi.Size() != 1 {
+		t.Fatalf("want size 1, got %v, %v", fi, err)
+	}
+	// Replace "a" by "b" behind our back. The content does not depend on
+	// the name, so this gives a valid file.
+	err = os.Rename(dir+"/"+encryptPath(t, dir, "b"), dir+"/"+encryptPath(t, dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	fi, err = os.Stat(mnt + "/a")
+	if err != nil || fi.Size() != 3 {
+		t.Errorf("want size 3, got %v, %v", fi, err)
+	}
+}
+
+// Test that concurrent access works with "-single-threaded". go-fuse
+// serializes the requests, so this would hang if a request depended on
+// another one.
+func TestSingleThreaded(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-single-threaded")
+	defer test_helpers.UnmountPanic(mnt)
+	errs := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			path := fmt.Sprintf("%s/file%d", mnt, i)
+			content := []byte(strings.Repeat(strconv.Itoa(i), 100000))
+			if err := ioutil.WriteFile(path, content, 0600); err != nil {
+				errs <- err
+				return
+			}
+			got, err := ioutil.ReadFile(path)
+			if err == nil && string(got) != string(content) {
+				err = fmt.Errorf("%s: content mismatch", path)
+			}
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
 // Test "-nonempty"
 func TestNonempty(t *testing.T) {
 	dir := test_helpers.InitFS(t)
@@ -357,9 +855,26 @@ func TestNonempty(t *testing.T) {
 	if err == nil {
 		t.Errorf("Mounting over a file should fail per default")
 	}
-	// Should work with "-nonempty"
-	test_helpers.MountOrFatal(t, dir, mnt, "-nonempty", "-extpass=echo test")
+	// Should work with "-nonempty". The warning about the hidden file must
+	// not panic.
+	test_helpers.MountOrFatal(t, dir, mnt, "-nonempty", "-extpass=echo test", "-wpanic=false")
+	// The existing file is hidden while mounted
+	if _, err = os.Stat(mnt + "/somefile"); !os.IsNotExist(err) {
+		t.Errorf("somefile should be hidden by the mount, got err=%v", err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	// ... and visible again after unmount
+	content, err := ioutil.ReadFile(mnt + "/somefile")
+	if err != nil || string(content) != "xyz" {
+		t.Errorf("somefile should be visible after unmount: %v, %q", err, content)
+	}
+	// "-mkdir" must not remove a mountpoint it has not created
+	test_helpers.MountOrFatal(t, dir, mnt, "-nonempty", "-mkdir", "-extpass=echo test", "-wpanic=false")
 	test_helpers.UnmountPanic(mnt)
+	time.Sleep(100 * time.Millisecond)
+	if _, err = os.Stat(mnt + "/somefile"); err != nil {
+		t.Errorf("somefile should still exist after -mkdir unmount: %v", err)
+	}
 }
 
 // -nofail should be ignored and the mount should succeed
@@ -800,3 +1315,121 @@ func TestPassfileX2(t *testing.T) {
 	test_helpers.MountOrFatal(t, dir, mnt, "-passfile="+passfile1, "-passfile="+passfile2)
 	defer test_helpers.UnmountPanic(mnt)
 }
+
+// Test -encrypt-path and -decrypt-path
+func TestEncryptDecryptPath(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-extpass", "echo test",
+		"-encrypt-path", "/foo.txt", dir)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cPath := strings.TrimSpace(string(out))
+	if cPath == "" || cPath == "foo.txt" {
+		t.Fatalf("bad ciphertext path %q", cPath)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-extpass", "echo test",
+		"-decrypt-path", cPath, dir)
+	out, err = cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := strings.TrimSpace(string(out)); p != "foo.txt" {
+		t.Errorf("want %q, got %q", "foo.txt", p)
+	}
+	// A garbage ciphertext name must fail
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-extpass", "echo test",
+		"-decrypt-path", "not/encrypted", dir)
+	if err = cmd.Run(); err == nil {
+		t.Error("-decrypt-path of an invalid name should fail")
+	}
+}
+
+// Test -mkdir and -mkdir-parents
+func TestMkdir(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	parent := dir + ".parent"
+	mnt := parent + "/mnt"
+	// -mkdir does not create missing parents
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-mkdir", "-extpass", "echo test", dir, mnt)
+	if err := cmd.Run(); err == nil {
+		t.Fatal("-mkdir with a missing parent should have failed")
+	}
+	if _, err := os.Stat(parent); !os.IsNotExist(err) {
+		t.Fatalf("-mkdir should not have created %q: %v", parent, err)
+	}
+	// A failed mount leaves the created directories in place
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-mkdir-parents", "-extpass", "echo wrong", dir, mnt)
+	if err := cmd.Run(); err == nil {
+		t.Fatal("mount with wrong password should have failed")
+	}
+	if _, err := os.Stat(mnt); err != nil {
+		t.Fatalf("mountpoint should still exist after a failed mount: %v", err)
+	}
+	if err := os.RemoveAll(parent); err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-mkdir-parents", "-extpass", "echo test", dir, mnt)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mnt+"/foo", nil, 0600); err != nil {
+		t.Error(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	// The background process removes the directories after it has exited
+	// its server loop
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(parent); os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("%q was not removed after unmount", parent)
+}
+
+// Test that SIGTERM unmounts the filesystem and exits with exitcodes.SigInt
+// (after wiping the keys)
+func TestSigterm(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	if err := os.Mkdir(mnt, 0700); err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(mnt, &st); err != nil {
+		t.Fatal(err)
+	}
+	unmountedDev := st.Dev
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-fg", "-nosyslog", "-extpass", "echo test", dir, mnt)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	mounted := false
+	for i := 0; i < 200; i++ {
+		if err := syscall.Stat(mnt, &st); err == nil && st.Dev != unmountedDev {
+			mounted = true
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !mounted {
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Fatal("timeout waiting for the mount")
+	}
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	err := cmd.Wait()
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.SigInt {
+		t.Errorf("wrong exit code: want %d, got %d", exitcodes.SigInt, code)
+	}
+	if err := syscall.Stat(mnt, &st); err != nil || st.Dev != unmountedDev {
+		t.Errorf("%q is still mounted", mnt)
+	}
+}
@@ -1,6 +1,7 @@
 package defaults
 
 import (
+	"io/ioutil"
 	"os"
 	"syscall"
 	"testing"
@@ -96,3 +97,100 @@ func TestCtlSockDecryptCrash(t *testing.T) {
 	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
 	defer test_helpers.UnmountPanic(pDir)
 }
+
+// The read-only control socket should answer queries just like the normal one
+func TestCtlSockRo(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	sockRo := cDir + ".ro.sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-ctlsock-ro="+sockRo, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	req := ctlsock.RequestStruct{
+		EncryptPath: "foobar",
+	}
+	response := test_helpers.QueryCtlSock(t, sock, req)
+	responseRo := test_helpers.QueryCtlSock(t, sockRo, req)
+	if responseRo.ErrNo != 0 || responseRo.Result != response.Result {
+		t.Errorf("read-only socket: got %+v, want %+v", responseRo, response)
+	}
+}
+
+// Test the "Stats" request with and without "-stats"
+func TestCtlSockStats(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-stats", "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	if err := ioutil.WriteFile(pDir+"/foo", []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadFile(pDir + "/foo"); err != nil {
+		t.Fatal(err)
+	}
+	req := ctlsock.RequestStruct{Stats: true}
+	response := test_helpers.QueryCtlSock(t, sock, req)
+	if response.ErrNo != 0 {
+		t.Fatal(response.ErrText)
+	}
+	for _, op := range []string{"Read", "Write", "GetAttr", "OpenDir", "Create"} {
+		if _, ok := response.Stats[op]; !ok {
+			t.Errorf("op %q missing from stats", op)
+		}
+	}
+	for _, op := range []string{"Write", "Create"} {
+		s := response.Stats[op]
+		if s.Count == 0 || s.Max == 0 || s.P50 > s.Max || s.P99 > s.Max {
+			t.Errorf("bad stats for %q: %+v", op, s)
+		}
+	}
+	// Without "-stats", the request fails
+	cDir2 := test_helpers.InitFS(t)
+	pDir2 := cDir2 + ".mnt"
+	sock2 := cDir2 + ".sock"
+	test_helpers.MountOrFatal(t, cDir2, pDir2, "-ctlsock="+sock2, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir2)
+	response = test_helpers.QueryCtlSock(t, sock2, req)
+	if response.ErrNo == 0 {
+		t.Errorf("Stats without -stats should fail: %+v", response)
+	}
+}
+
+// Test the "Status" request
+func TestCtlSockStatus(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	f, err := os.Create(pDir + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	req := ctlsock.RequestStruct{Status: true}
+	response := test_helpers.QueryCtlSock(t, sock, req)
+	if response.ErrNo != 0 {
+		t.Fatal(response.ErrText)
+	}
+	s := response.Status
+	if s == nil {
+		t.Fatal("Status missing from response")
+	}
+	if s.OpenFiles != 1 || s.BytesWritten != 5 || s.Uptime <= 0 {
+		t.Errorf("bad status: %+v", s)
+	}
+	if len(s.FeatureFlags) == 0 {
+		t.Errorf("feature flags missing")
+	}
+	// Asking for both is ambiguous
+	req.Stats = true
+	response = test_helpers.QueryCtlSock(t, sock, req)
+	if response.ErrNo == 0 {
+		t.Errorf("Status+Stats should fail: %+v", response)
+	}
+}
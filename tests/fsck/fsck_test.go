@@ -2,6 +2,8 @@ package fsck
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"runtime"
@@ -48,6 +50,44 @@ func TestBrokenFsV14(t *testing.T) {
 	}
 }
 
+// TestBrokenFsV14JSON checks that "-fsck -json" prints the corrupt files
+// as a JSON document on stdout
+func TestBrokenFsV14JSON(t *testing.T) {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-json", "-extpass", "echo test", "broken_fs_v1.4")
+	outBin, err := cmd.Output()
+	code := test_helpers.ExtractCmdExitCode(err)
+	if code != exitcodes.FsckErrors {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	var res struct {
+		Corrupt []struct {
+			Path    string
+			Offset  *int64
+			Message string
+		}
+		CorruptCount int
+		ExitStatus   int
+	}
+	if err := json.Unmarshal(outBin, &res); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, outBin)
+	}
+	if res.CorruptCount == 0 || res.CorruptCount != len(res.Corrupt) {
+		t.Errorf("CorruptCount=%d, but %d entries", res.CorruptCount, len(res.Corrupt))
+	}
+	if res.ExitStatus != exitcodes.FsckErrors {
+		t.Errorf("ExitStatus=%d, want %d", res.ExitStatus, exitcodes.FsckErrors)
+	}
+	var haveOffset bool
+	for _, c := range res.Corrupt {
+		if c.Offset != nil {
+			haveOffset = true
+		}
+	}
+	if !haveOffset {
+		t.Errorf("no corrupt file content with offset reported: %s", outBin)
+	}
+}
+
 func TestExampleFses(t *testing.T) {
 	dirfd, err := os.Open("../example_filesystems")
 	if err != nil {
@@ -125,3 +165,42 @@ func TestTerabyteFile(t *testing.T) {
 	cmd.Wait()
 	timer.Stop()
 }
+
+// TestRepairLongNames checks that "-repair-longnames" removes orphaned .name
+// files, but only lists them with "-dry-run", and leaves long name entries
+// without .name file alone.
+func TestRepairLongNames(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	orphan := cDir + "/gocryptfs.longname.LkwUdALvV_ANnzQN6ZZMYnxxfARD3IeZWCKnxGJjYmU=.name"
+	unnamed := cDir + "/gocryptfs.longname.URrM8kgxTKYMgCk4hKk7RO9Lcfr30XQof4L_5bD9Iro="
+	for _, f := range []string{orphan, unnamed} {
+		if err := ioutil.WriteFile(f, []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run := func(args ...string) int {
+		args = append(append([]string{"-repair-longnames"}, args...), cDir)
+		out, err := exec.Command(test_helpers.GocryptfsBinary, args...).CombinedOutput()
+		t.Log(string(out))
+		return test_helpers.ExtractCmdExitCode(err)
+	}
+	if code := run("-dry-run"); code != exitcodes.FsckErrors {
+		t.Errorf("-dry-run: wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	if _, err := os.Stat(orphan); err != nil {
+		t.Errorf("-dry-run has removed the orphan: %v", err)
+	}
+	if code := run(); code != exitcodes.FsckErrors {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("orphan has not been removed: %v", err)
+	}
+	if _, err := os.Stat(unnamed); err != nil {
+		t.Errorf("entry without .name file has been removed: %v", err)
+	}
+	os.Remove(unnamed)
+	if code := run(); code != 0 {
+		t.Errorf("clean filesystem: wrong exit code, have=%d want=0", code)
+	}
+}
@@ -0,0 +1,147 @@
+package mountlib
+
+// Tests for the in-process mount API in package mountlib
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/mountlib"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+func password(pw string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		return []byte(pw), nil
+	}
+}
+
+func TestMountUnmount(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	if err := os.Mkdir(pDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := mountlib.Mount(cDir, pDir, mountlib.MountOptions{Password: password("test")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("hello mountlib")
+	if err = ioutil.WriteFile(pDir+"/file", content, 0600); err != nil {
+		t.Error(err)
+	}
+	if err = srv.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	// Mount again read-only and check that the content survived
+	srv, err = mountlib.Mount(cDir, pDir, mountlib.MountOptions{Password: password("test"), ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Unmount()
+	data, err := ioutil.ReadFile(pDir + "/file")
+	if err != nil || string(data) != string(content) {
+		t.Errorf("read back %q, err=%v", data, err)
+	}
+	if err = ioutil.WriteFile(pDir+"/file2", content, 0600); err == nil {
+		t.Error("write to read-only mount should fail")
+	}
+}
+
+func TestMountErrors(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	_, err := mountlib.Mount(cDir, pDir, mountlib.MountOptions{})
+	if err != mountlib.ErrNoPassword {
+		t.Errorf("want ErrNoPassword, got %v", err)
+	}
+	_, err = mountlib.Mount(cDir, pDir, mountlib.MountOptions{Password: password("wrong")})
+	if err == nil {
+		t.Error("wrong password should fail")
+	}
+	_, err = mountlib.Mount(cDir+".nonexistent", pDir, mountlib.MountOptions{Password: password("test")})
+	if !os.IsNotExist(err) {
+		t.Errorf("want ENOENT, got %v", err)
+	}
+}
+
+func TestEncryptDecryptPath(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	opts := mountlib.MountOptions{Password: password("test")}
+	cPath, err := mountlib.EncryptPath(cDir, "foo", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pPath, err := mountlib.DecryptPath(cDir, cPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pPath != "foo" {
+		t.Errorf("want %q, got %q", "foo", pPath)
+	}
+}
+
+// TestFIDO2 checks that a filesystem that needs a FIDO2 key is rejected with
+// ErrFIDO2 instead of a wrong password error, also with additional slots
+// like "-fido2-add" creates.
+func TestFIDO2(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	conf := cDir + "/" + configfile.ConfDefaultName
+	cf, err := configfile.Load(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.SetFeatureFlag(configfile.FlagFIDO2)
+	for i := 0; i < 2; i++ {
+		slot, err := configfile.NewFIDO2Slot([]byte{byte(i)}, make([]byte, 32),
+			make([]byte, cryptocore.KeyLen), make([]byte, configfile.FIDO2SecretLen))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cf.FIDO2 = append(cf.FIDO2, *slot)
+		if err = cf.WriteFile(); err != nil {
+			t.Fatal(err)
+		}
+		_, err = mountlib.EncryptPath(cDir, "foo", mountlib.MountOptions{Password: password("test")})
+		if err != mountlib.ErrFIDO2 {
+			t.Errorf("%d slot(s): want ErrFIDO2, got %v", i+1, err)
+		}
+	}
+}
+
+// TestExactSize checks that the ExactSize feature flag from the config file is
+// honored, so that the size of a file written through the mount is stored in
+// an xattr on the backing file.
+func TestExactSize(t *testing.T) {
+	cDir := test_helpers.InitFS(t, "-exact-size")
+	pDir := cDir + ".mnt"
+	if err := os.Mkdir(pDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	opts := mountlib.MountOptions{Password: password("test")}
+	srv, err := mountlib.Mount(cDir, pDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(pDir+"/file", []byte("hello"), 0600)
+	srv.Unmount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cPath, err := mountlib.EncryptPath(cDir, "file", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := syscallcompat.Llistxattr(cDir + "/" + cPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attrs) == 0 {
+		t.Error("the backing file has no size xattr")
+	}
+}
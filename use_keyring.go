@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/keyring"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// keyringDescription returns the description of the cached master key for
+// the config file "-config", see keyring.Description. Returns an empty
+// string if the config file cannot be read.
+func keyringDescription(args *argContainer) string {
+	conf, err := ioutil.ReadFile(args.config)
+	if err != nil {
+		tlog.Warn.Printf("-use-keyring: %v", err)
+		return ""
+	}
+	return keyring.Description(conf)
+}
+
+// loadCachedKey returns the master key cached under "desc", or nil if there
+// is none.
+func loadCachedKey(desc string) []byte {
+	if desc == "" {
+		return nil
+	}
+	key, err := keyring.Load(desc)
+	if err == keyring.ErrNotFound {
+		tlog.Debug.Printf("-use-keyring: no cached master key")
+		return nil
+	}
+	if err != nil {
+		tlog.Warn.Printf("-use-keyring: reading the cached master key failed: %v", err)
+		return nil
+	}
+	tlog.Info.Printf("Using the master key cached in the kernel keyring")
+	return key
+}
+
+// storeCachedKey caches "masterkey" under "desc" for "ttl". Failure is not
+// fatal, the next mount asks for the password again.
+func storeCachedKey(desc string, masterkey []byte, ttl time.Duration) {
+	if desc == "" {
+		return
+	}
+	if err := keyring.Store(desc, masterkey, ttl); err != nil {
+		tlog.Warn.Printf("-use-keyring: caching the master key failed: %v", err)
+		return
+	}
+	tlog.Info.Printf("Master key cached in the kernel session keyring for %v", ttl)
+}
+
+// clearKeyring removes the master key of "-config" from the kernel keyring.
+// It is no error if there is none.
+func clearKeyring(args *argContainer) {
+	conf, err := ioutil.ReadFile(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		os.Exit(exitcodes.LoadConf)
+	}
+	err = keyring.Clear(keyring.Description(conf))
+	if err == keyring.ErrNotFound {
+		tlog.Info.Printf("No master key cached for %q", args.config)
+		return
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-clear-keyring: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	tlog.Info.Printf("Removed the cached master key from the kernel keyring")
+}